@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// ackOutcomeWindow is how many of a robot's latest twists its unacked
+// ratio covers
+const ackOutcomeWindow = 100
+
+// AckTimeouts tracks, per robot, which of its latest forwarded twists were
+// acked and which timed out, for relay_unacked_ratio and /status
+type AckTimeouts struct {
+	mu     sync.Mutex
+	robots map[string]*ackOutcomes
+}
+
+type ackOutcomes struct {
+	ring     [ackOutcomeWindow]bool // true = timed out
+	next     int
+	n        int
+	timeouts int // in ring
+	total    uint64
+}
+
+// AckTimeoutStats is one robot's entry in /status
+type AckTimeoutStats struct {
+	Timeouts     uint64  `json:"timeouts"`
+	UnackedRatio float64 `json:"unacked_ratio"` // over the latest twists, see ackOutcomeWindow
+}
+
+var ackTimeouts = &AckTimeouts{robots: make(map[string]*ackOutcomes)}
+
+// outcome records whether robotID's latest twist timed out
+func (a *AckTimeouts) outcome(robotID string, timedOut bool) {
+	if config.AckTimeout <= 0 {
+		return
+	}
+	a.mu.Lock()
+	o := a.robots[robotID]
+	if o == nil {
+		o = &ackOutcomes{}
+		a.robots[robotID] = o
+	}
+	if o.n == ackOutcomeWindow && o.ring[o.next] {
+		o.timeouts--
+	}
+	o.ring[o.next] = timedOut
+	o.next = (o.next + 1) % ackOutcomeWindow
+	o.n = min(o.n+1, ackOutcomeWindow)
+	if timedOut {
+		o.timeouts++
+		o.total++
+	}
+	ratio := float64(o.timeouts) / float64(o.n)
+	a.mu.Unlock()
+	metricUnackedRatio.WithLabelValues(robotID).Set(ratio)
+}
+
+// snapshot returns every robot's timeout totals and unacked ratio
+func (a *AckTimeouts) snapshot() map[string]AckTimeoutStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make(map[string]AckTimeoutStats, len(a.robots))
+	for robotID, o := range a.robots {
+		out[robotID] = AckTimeoutStats{Timeouts: o.total, UnackedRatio: float64(o.timeouts) / float64(o.n)}
+	}
+	return out
+}
+
+// watchAckTimeouts expires forwarded twists left unacked for
+// config.AckTimeout: each is counted against its robot and its sender gets
+// an Ack Timeout frame. A late ack still reaches browsers. Twists that
+// never reached the robot, superseded in its queue or dropped as stale,
+// are not counted, and Joy frames are not tracked.
+func watchAckTimeouts() {
+	ticker := time.NewTicker(max(config.AckTimeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, t := range latency.expire(config.AckTimeout) {
+			metricAckTimeouts.WithLabelValues(t.robotID).Inc()
+			ackTimeouts.outcome(t.robotID, true)
+			slog.Debug("Twist unacked", "msg_type", "twist", "msg_id", t.msgID, "robot_id", t.robotID, "source", t.source)
+			sendAckTimeout(t.source, t.msgID, time.Since(t.sent))
+		}
+	}
+}
+
+// sendAckTimeout tells the web peer source that its twist msgID went
+// unacked for waited
+func sendAckTimeout(source string, msgID uint64, waited time.Duration) {
+	p := manager.getPeer(source)
+	if p == nil || !p.watchesRobot() {
+		return
+	}
+	msg := make([]byte, protocol.AckTimeoutSize)
+	msg[0] = protocol.MsgTypeAckTimeout
+	binary.LittleEndian.PutUint64(msg[1:9], msgID)
+	binary.LittleEndian.PutUint32(msg[9:13], uint32(min(waited.Milliseconds(), 1<<32-1)))
+	p.send(msg)
+}
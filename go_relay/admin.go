@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go_relay/protocol"
+)
+
+// PeerInfo is one connected peer as reported by GET /admin/peers
+type PeerInfo struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	RobotID     string    `json:"robot_id"`
+	Subject     string    `json:"subject,omitempty"`
+	Remote      string    `json:"remote"`
+	ConnectedAt time.Time `json:"connected_at"`
+	MessagesIn  uint64    `json:"messages_in"`
+	MessagesOut uint64    `json:"messages_out"`
+	QueueDepth  int       `json:"queue_depth"` // frames waiting in SendChan
+	QueueCap    int       `json:"queue_capacity"`
+	Overflow    string    `json:"overflow"` // policy when the queue is full
+	Drops       uint64    `json:"drops"`    // frames lost to a full queue
+	AvgWriteMs  float64   `json:"avg_write_ms"`
+	Session     bool      `json:"session"` // completed the binary Session handshake
+	Subprotocol string    `json:"subprotocol,omitempty"`
+
+	MessagesInByType  map[string]uint64 `json:"messages_in_by_type"`
+	MessagesOutByType map[string]uint64 `json:"messages_out_by_type"`
+	BytesIn           uint64            `json:"bytes_in"`
+	BytesOut          uint64            `json:"bytes_out"`
+	LastActivity      time.Time         `json:"last_activity"` // last message or pong from the peer
+	LastMessage       time.Time         `json:"last_message"`  // last message, see -idle-timeout
+	PingRTTMs         float64           `json:"ping_rtt_ms"`   // WebSocket peers only, 0 until the first pong
+	Compression       bool              `json:"compression"`   // permessage-deflate negotiated
+	SpeedProfile      *speedProfile     `json:"speed_profile,omitempty"`
+
+	PeerMeta // name, client_version, capabilities
+}
+
+// msgTypeSlots bounds the message types counted per peer; higher ones
+// are counted as type 0 ("unknown")
+const msgTypeSlots = 0x40
+
+// typeCounts counts messages by type byte
+type typeCounts [msgTypeSlots]atomic.Uint64
+
+func (c *typeCounts) add(t byte) {
+	if int(t) >= msgTypeSlots {
+		t = 0
+	}
+	c[t].Add(1)
+}
+
+// snapshot returns the non-zero counts by message type name
+func (c *typeCounts) snapshot() map[string]uint64 {
+	out := make(map[string]uint64)
+	for t := range c {
+		if n := c[t].Load(); n > 0 {
+			out[protocol.TypeName(byte(t))] += n
+		}
+	}
+	return out
+}
+
+// pong records a WebSocket pong and the round trip of its ping
+func (p *Peer) pong(rtt time.Duration) {
+	p.touch()
+	p.pongs.Store(p.pings.Load())
+	if rtt > 0 {
+		p.rtt.add(rtt)
+		metricPingRTT.WithLabelValues(p.Type).Observe(rtt.Seconds())
+	}
+}
+
+func (p *Peer) info() PeerInfo {
+	return p.infoFor(manager.robotFor(p))
+}
+
+// infoFor is info for a caller that already knows the peer's robot, such
+// as one holding manager.mu
+func (p *Peer) infoFor(robotID string) PeerInfo {
+	return PeerInfo{
+		ID:                p.ID,
+		Type:              p.Type,
+		RobotID:           robotID,
+		Subject:           p.Subject,
+		PeerMeta:          p.Meta,
+		Remote:            p.Conn.RemoteAddr(),
+		ConnectedAt:       p.ConnectedAt,
+		MessagesIn:        p.msgsIn.Load(),
+		MessagesOut:       p.msgsOut.Load(),
+		QueueDepth:        len(p.SendChan),
+		QueueCap:          cap(p.SendChan),
+		Overflow:          p.overflowPolicy,
+		Drops:             p.drops.Load(),
+		Subprotocol:       p.subprotocol,
+		AvgWriteMs:        float64(p.avgWrite()) / float64(time.Millisecond),
+		Session:           p.session.Load(),
+		MessagesInByType:  p.typesIn.snapshot(),
+		MessagesOutByType: p.typesOut.snapshot(),
+		BytesIn:           p.bytesIn.Load(),
+		BytesOut:          p.bytesOut.Load(),
+		LastActivity:      time.UnixMilli(p.lastSeen.Load()),
+		LastMessage:       time.UnixMilli(p.lastMessage.Load()),
+		PingRTTMs:         p.rtt.snapshot().LastMs,
+		Compression:       deflating(p),
+		SpeedProfile:      p.profile.Load(),
+	}
+}
+
+func deflating(p *Peer) bool {
+	c, ok := p.Conn.(compressTransport)
+	return ok && c.deflating()
+}
+
+// getPeer returns the peer with the given ID, or nil
+func (m *PeerManager) getPeer(id string) *Peer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.peers[id]
+}
+
+// handleAdminPeers serves GET /admin/peers: every peer, oldest first
+func handleAdminPeers(w http.ResponseWriter, r *http.Request) {
+	peers := manager.allPeers()
+	infos := make([]PeerInfo, len(peers))
+	for i, p := range peers {
+		infos[i] = p.info()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ConnectedAt.Before(infos[j].ConnectedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"peers": infos,
+	})
+}
+
+// handleAdminKick serves DELETE /admin/peers/{id}: the peer is sent what
+// is already queued for it and closed with 1008 (policy violation)
+func handleAdminKick(w http.ResponseWriter, r *http.Request) {
+	peer := manager.getPeer(r.PathValue("id"))
+	if peer == nil {
+		http.Error(w, "no such peer", http.StatusNotFound)
+		return
+	}
+	peer.logger().Info("Peer kicked by admin", "admin", r.RemoteAddr, "remote", peer.Conn.RemoteAddr())
+	peer.close(websocket.ClosePolicyViolation, "kicked by admin")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peer.info())
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+/*
+COMMAND AUDIT LOG
+=================
+
+With -audit-db set, the relay keeps a SQLite database of who commanded
+what, for incident review. Every twist forwarded to a robot becomes a
+row in twists and every e-stop that changed a robot's state a row in
+estops:
+
+  twists  time_ms, robot_id, peer_id, peer_type, client_id, subject,
+          msg_id, linear_x/y/z, angular_x/y/z (as forwarded, i.e.
+          clamped), t1_browser_send, t2_relay_rx, t3_relay_tx (Unix ms)
+  estops  time_ms, robot_id, action ("engage" or "release"), by (peer
+          ID, "REST <addr>" or "upstream"), and the identity columns
+          when by is a connected peer
+
+Rows are written from a background goroutine in batches, so the
+forwarding path never waits on the disk; a full queue drops rows and
+counts them in relay_audit_dropped_total. Once a minute rows older than
+-audit-retention are deleted, and each table is cut back to its newest
+-audit-max-rows.
+*/
+
+const (
+	auditQueueSize     = 4096
+	auditBatch         = 256 // rows per transaction at most
+	auditPruneInterval = time.Minute
+)
+
+const auditSchema = `
+PRAGMA journal_mode = WAL;
+PRAGMA synchronous = NORMAL;
+CREATE TABLE IF NOT EXISTS twists (
+	id INTEGER PRIMARY KEY,
+	time_ms INTEGER NOT NULL,
+	robot_id TEXT NOT NULL,
+	peer_id TEXT NOT NULL,
+	peer_type TEXT NOT NULL,
+	client_id TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	msg_id INTEGER NOT NULL,
+	linear_x REAL, linear_y REAL, linear_z REAL,
+	angular_x REAL, angular_y REAL, angular_z REAL,
+	t1_browser_send INTEGER, t2_relay_rx INTEGER, t3_relay_tx INTEGER
+);
+CREATE INDEX IF NOT EXISTS twists_time ON twists (time_ms);
+CREATE INDEX IF NOT EXISTS twists_client ON twists (client_id, time_ms);
+CREATE TABLE IF NOT EXISTS estops (
+	id INTEGER PRIMARY KEY,
+	time_ms INTEGER NOT NULL,
+	robot_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	by TEXT NOT NULL,
+	peer_type TEXT NOT NULL,
+	client_id TEXT NOT NULL,
+	subject TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS estops_time ON estops (time_ms);
+`
+
+// auditIdentity names who sent a command
+type auditIdentity struct {
+	peerID, peerType, clientID, subject string
+}
+
+// identify looks up the connected peer behind source, keeping source as
+// the peer ID either way
+func identify(source string) auditIdentity {
+	id := auditIdentity{peerID: source}
+	if p := manager.getPeer(source); p != nil {
+		id.peerType, id.clientID, id.subject = p.Type, p.Meta.ClientID, p.Subject
+	}
+	return id
+}
+
+// auditRow is one queued twist or e-stop row
+type auditRow struct {
+	time    int64
+	robotID string
+	who     auditIdentity
+
+	estop  string // e-stop action, "" for a twist
+	msgID  uint64
+	vel    [6]float64
+	stamps [3]uint64 // t1, t2, t3
+}
+
+// AuditLog writes command rows to the -audit-db database
+type AuditLog struct {
+	db    *sql.DB
+	path  string
+	queue chan auditRow
+	done  chan struct{}
+}
+
+// audit is nil unless -audit-db is set
+var audit *AuditLog
+
+// openAuditLog opens (creating if needed) the database at path
+func openAuditLog(path string) (*AuditLog, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // one writer; SQLite serializes them anyway
+	if _, err := db.Exec(auditSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	a := &AuditLog{
+		db:    db,
+		path:  path,
+		queue: make(chan auditRow, auditQueueSize),
+		done:  make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// twist queues a row for a twist forwarded to robotID: the extended
+// 81-byte form, after clamping and relay timestamps. It never blocks.
+func (a *AuditLog) twist(robotID, source string, extended []byte) {
+	if a == nil {
+		return
+	}
+	le := binary.LittleEndian
+	row := auditRow{
+		time:    time.Now().UnixMilli(),
+		robotID: robotID,
+		who:     identify(source),
+		msgID:   le.Uint64(extended[1:9]),
+		stamps:  [3]uint64{le.Uint64(extended[9:17]), le.Uint64(extended[65:73]), le.Uint64(extended[73:81])},
+	}
+	for i := range row.vel {
+		row.vel[i] = math.Float64frombits(le.Uint64(extended[17+8*i:]))
+	}
+	a.enqueue(row)
+}
+
+// estop queues a row for an e-stop that changed robotID's state
+func (a *AuditLog) estop(robotID string, action byte, by string) {
+	if a == nil {
+		return
+	}
+	row := auditRow{time: time.Now().UnixMilli(), robotID: robotID, who: identify(by), estop: "release"}
+	if action == EStopEngage {
+		row.estop = "engage"
+	}
+	a.enqueue(row)
+}
+
+func (a *AuditLog) enqueue(row auditRow) {
+	select {
+	case a.queue <- row:
+	default:
+		metricAuditDropped.Inc()
+	}
+}
+
+func (a *AuditLog) run() {
+	defer close(a.done)
+	prune := time.NewTicker(auditPruneInterval)
+	defer prune.Stop()
+	a.prune()
+
+	batch := make([]auditRow, 0, auditBatch)
+	for {
+		select {
+		case row, ok := <-a.queue:
+			if !ok {
+				return
+			}
+			batch = append(batch[:0], row)
+		drain:
+			for len(batch) < auditBatch {
+				select {
+				case row, ok := <-a.queue:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, row)
+				default:
+					break drain
+				}
+			}
+			if err := a.write(batch); err != nil {
+				metricAuditDropped.Add(float64(len(batch)))
+				slog.Error("Audit log write failed", "path", a.path, "rows", len(batch), "err", err)
+			}
+		case <-prune.C:
+			a.prune()
+		}
+	}
+}
+
+// write inserts rows in one transaction
+func (a *AuditLog) write(rows []auditRow) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range rows {
+		w := r.who
+		if r.estop != "" {
+			_, err = tx.Exec(`INSERT INTO estops (time_ms, robot_id, action, by, peer_type, client_id, subject)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				r.time, r.robotID, r.estop, w.peerID, w.peerType, w.clientID, w.subject)
+		} else {
+			_, err = tx.Exec(`INSERT INTO twists (time_ms, robot_id, peer_id, peer_type, client_id, subject, msg_id,
+				linear_x, linear_y, linear_z, angular_x, angular_y, angular_z, t1_browser_send, t2_relay_rx, t3_relay_tx)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				r.time, r.robotID, w.peerID, w.peerType, w.clientID, w.subject, int64(r.msgID),
+				r.vel[0], r.vel[1], r.vel[2], r.vel[3], r.vel[4], r.vel[5],
+				int64(r.stamps[0]), int64(r.stamps[1]), int64(r.stamps[2]))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	metricAuditRows.Add(float64(len(rows)))
+	return nil
+}
+
+// prune applies -audit-retention and -audit-max-rows to both tables
+func (a *AuditLog) prune() {
+	for _, table := range []string{"twists", "estops"} {
+		if config.AuditRetention > 0 {
+			cutoff := time.Now().Add(-config.AuditRetention).UnixMilli()
+			if _, err := a.db.Exec(`DELETE FROM `+table+` WHERE time_ms < ?`, cutoff); err != nil {
+				slog.Error("Audit log prune failed", "table", table, "err", err)
+			}
+		}
+		if config.AuditMaxRows > 0 {
+			if _, err := a.db.Exec(`DELETE FROM `+table+` WHERE id <= (SELECT max(id) FROM `+table+`) - ?`, config.AuditMaxRows); err != nil {
+				slog.Error("Audit log prune failed", "table", table, "err", err)
+			}
+		}
+	}
+}
+
+// close writes the queued rows and closes the database
+func (a *AuditLog) close() {
+	if a == nil {
+		return
+	}
+	close(a.queue)
+	<-a.done
+	a.db.Close()
+	slog.Info("Audit log closed", "path", a.path)
+}
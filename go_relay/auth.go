@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// WebSocket close codes for rejected connections (4000-4999 is the
+// application range, mirroring HTTP 401/403)
+const (
+	CloseUnauthorized    = 4401 // missing, malformed or expired token
+	CloseForbidden       = 4403 // valid token without the scope for this peer type
+	CloseUpgradeRequired = 4426 // no subprotocol the relay speaks was offered
+)
+
+// Claims carried by relay tokens. Scope is a space-separated list
+// (e.g. "web" or "python") naming the peer types the bearer may register as.
+type Claims struct {
+	Scope    string `json:"scope"`
+	ClientID string `json:"client_id,omitempty"` // the only client ID the bearer may use, see identity.go
+	jwt.RegisteredClaims
+}
+
+// hasScope reports whether the token grants scope
+func (c *Claims) hasScope(scope string) bool {
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator validates HS256 tokens signed with -jwt-secret (or
+// JWT_SECRET); a nil secret disables auth. A peer's token must grant its
+// peer type as a scope, and ?supervisor also "supervisor"; the admin and
+// speed profile endpoints want "admin", the read endpoints any of
+// readScopes.
+type Authenticator struct {
+	secret []byte
+}
+
+// auth is created by main from config.JWTSecret
+var auth *Authenticator
+
+func newAuthenticator(secret string) *Authenticator {
+	if secret == "" {
+		return &Authenticator{}
+	}
+	return &Authenticator{secret: []byte(secret)}
+}
+
+func (a *Authenticator) enabled() bool {
+	return a.secret != nil
+}
+
+var (
+	errNoToken  = errors.New("missing token")
+	errBadToken = errors.New("invalid token")
+	errNoScope  = errors.New("token lacks required scope")
+)
+
+// authorize checks the request's token for one of scopes. Browsers
+// cannot set headers on WebSocket upgrades, so ?token= is accepted
+// alongside "Authorization: Bearer". With auth disabled it always succeeds.
+func (a *Authenticator) authorize(r *http.Request, scopes ...string) (*Claims, error) {
+	if !a.enabled() {
+		return &Claims{Scope: strings.Join(scopes, " ")}, nil
+	}
+
+	raw := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); raw == "" && strings.HasPrefix(h, "Bearer ") {
+		raw = strings.TrimPrefix(h, "Bearer ")
+	}
+	return a.authorizeToken(raw, r.RemoteAddr, scopes...)
+}
+
+// authorizeToken checks a raw token for one of scopes, for transports
+// without HTTP requests; remote only labels log lines
+func (a *Authenticator) authorizeToken(raw, remote string, scopes ...string) (*Claims, error) {
+	if !a.enabled() {
+		return &Claims{Scope: strings.Join(scopes, " ")}, nil
+	}
+	if raw == "" {
+		return nil, errNoToken
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(*jwt.Token) (interface{}, error) {
+		return a.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		slog.Warn("Auth: rejected token", "remote", remote, "err", err)
+		return nil, errBadToken
+	}
+	for _, scope := range scopes {
+		if claims.hasScope(scope) {
+			return claims, nil
+		}
+	}
+	slog.Warn("Auth: missing scope", "subject", claims.Subject, "scope", strings.Join(scopes, " "))
+	return nil, errNoScope
+}
+
+// closeCodeFor maps an authorize error to a WebSocket close code
+func closeCodeFor(err error) int {
+	if errors.Is(err, errNoScope) || errors.Is(err, errClientID) {
+		return CloseForbidden
+	}
+	return CloseUnauthorized
+}
+
+// readScopes are the scopes that may read relay state over REST: anyone
+// allowed to watch robots
+var readScopes = []string{"web", "observer", "supervisor", "admin"}
+
+// requireRead guards a read-only REST handler the way the WebSocket
+// upgrade guards a browser: any token with a read scope will do
+func requireRead(next http.HandlerFunc) http.HandlerFunc {
+	return guard(next, readScopes...)
+}
+
+// requireScope guards a REST handler with the given token scope
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return guard(next, scope)
+}
+
+// guard answers 401 or 403 unless the request's token has one of scopes
+func guard(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := auth.authorize(r, scopes...); err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, errNoScope) {
+				status = http.StatusForbidden
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signedToken(t *testing.T, secret, scope string) string {
+	t.Helper()
+	claims := Claims{Scope: scope, RegisteredClaims: jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}}
+	raw, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestRequireRead(t *testing.T) {
+	prev := auth
+	auth = newAuthenticator("secret")
+	defer func() { auth = prev }()
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	handler := requireRead(ok)
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"forged token", signedToken(t, "other", "web"), http.StatusUnauthorized},
+		{"robot token", signedToken(t, "secret", "python"), http.StatusForbidden},
+		{"browser token", signedToken(t, "secret", "web"), http.StatusOK},
+		{"observer token", signedToken(t, "secret", "observer"), http.StatusOK},
+		{"admin among others", signedToken(t, "secret", "relay admin"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/status", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	prev := origins
+	origins = newOriginPolicy("https://teleop.example.com,https://*.lab.example.com")
+	defer func() { origins = prev }()
+
+	handler := corsMiddleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	for origin, want := range map[string]string{
+		"https://teleop.example.com":    "https://teleop.example.com",
+		"https://bench.lab.example.com": "https://bench.lab.example.com",
+		"https://evil.example.net":      "",
+		"":                              "",
+	} {
+		r := httptest.NewRequest("GET", "/robots", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("origin %q: Access-Control-Allow-Origin %q, want %q", origin, got, want)
+		}
+	}
+}
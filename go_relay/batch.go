@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+
+	"go_relay/protocol"
+)
+
+// batchable reports whether f may share a Batch with the frames queued
+// behind it: twists and acks to a WebSocket peer that negotiated
+// FeatureBatch
+func (p *Peer) batchable(f *Frame) bool {
+	if f.text || len(f.buf) == 0 || !p.codec().has(FeatureBatch) {
+		return false
+	}
+	if _, ok := p.Conn.(*wsTransport); !ok {
+		return false
+	}
+	t := f.buf[0]
+	return t == protocol.MsgTypeTwist || t == protocol.MsgTypeTwistAck
+}
+
+// writeBacklog writes f together with the batchable frames queued behind
+// it on SendChan as one Batch, instead of a WebSocket message each. The
+// first frame that cannot join ends the batch and is written after it.
+// Peers see the frames one by one, and relay_batched_frames_total counts
+// those sent batched.
+func writeBacklog(peer *Peer, f *Frame) error {
+	frames := []*Frame{f}
+	var next *Frame
+	for len(frames) < protocol.MaxBatchFrames && len(peer.SendChan) > 0 {
+		g := <-peer.SendChan
+		if !peer.batchable(g) {
+			next = g
+			break
+		}
+		frames = append(frames, g)
+	}
+	err := writeBatch(peer, frames)
+	if next != nil {
+		if err != nil {
+			next.release()
+			return err
+		}
+		err = writeFrame(peer, next)
+	}
+	return err
+}
+
+// writeBatch writes frames as one Batch, each with its CRC trailer if the
+// peer takes one, and releases them. A single frame goes out on its own.
+func writeBatch(peer *Peer, frames []*Frame) error {
+	if len(frames) == 1 {
+		return writeFrame(peer, frames[0])
+	}
+	defer func() {
+		for _, f := range frames {
+			f.release()
+		}
+	}()
+
+	size := protocol.BatchHeaderSize
+	for _, f := range frames {
+		size += 2 + len(f.buf) + CRCSize
+	}
+	batch := protocol.NewBatch(make([]byte, 0, size))
+	var crcBuf [CRCSize]byte
+	for _, f := range frames {
+		batch = protocol.AppendBatch(batch, f.buf, peer.crcTrailer(f.buf, &crcBuf))
+	}
+
+	peer.mu.Lock()
+	setCompression(peer, frames[0].buf[0], len(batch))
+	err := peer.writeTimed(batch, nil)
+	peer.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	metricBytes.WithLabelValues("out").Add(float64(len(batch)))
+	metricBatchedFrames.Add(float64(len(frames)))
+	peer.msgsOut.Add(uint64(len(frames)))
+	peer.bytesOut.Add(uint64(len(batch)))
+	for _, f := range frames {
+		peer.typesOut.add(f.buf[0])
+		size := 2 + len(f.buf) // with its length prefix in the batch
+		if peer.usesCRC(f.buf[0]) {
+			size += CRCSize
+		}
+		observeMessage("out", protocol.TypeName(f.buf[0]), size)
+	}
+	return nil
+}
+
+// handleBatch passes each frame of a Batch from peer to handleBinary
+func handleBatch(peer *Peer, data []byte) {
+	if !peer.codec().has(FeatureBatch) {
+		rejectFrame(peer, data, ProtoErrUnknownType, 0)
+		return
+	}
+	frames, err := protocol.SplitBatch(data)
+	if err != nil {
+		code := byte(ProtoErrTooShort)
+		if errors.Is(err, protocol.ErrTrailing) {
+			code = ProtoErrTooLong
+		}
+		peer.logger().Debug("Batch not split", "error", err)
+		rejectFrame(peer, data, code, 0)
+		return
+	}
+	for _, frame := range frames {
+		if frame[0] == protocol.MsgTypeBatch {
+			rejectFrame(peer, frame, ProtoErrUnknownType, 0)
+			continue
+		}
+		handleBinary(peer, frame)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go_relay/protocol"
+)
+
+// benchAckGrace is how long bench waits for acks after the last twist
+const benchAckGrace = 500 * time.Millisecond
+
+// benchRobot is one robot under bench: a simulated robot peer that acks
+// every twist at once and the simulated browsers sending it twists
+type benchRobot struct {
+	id       string
+	robot    *websocket.Conn
+	browsers []*benchBrowser
+}
+
+// benchBrowser is one simulated web peer. Its message IDs carry its index
+// in the top 16 bits, so it can tell its own acks from the other
+// browsers' on the same robot.
+type benchBrowser struct {
+	index int
+	conn  *websocket.Conn
+
+	mu     sync.Mutex
+	sent   map[uint64]time.Time // unanswered twists by message ID
+	rtts   []float64            // ms, browser send to ack receipt
+	n      int                  // twists sent
+	nacked int
+}
+
+// benchStats sums browsers for one row of the report
+type benchStats struct {
+	sent, nacked int
+	rtts         []float64
+}
+
+func (s *benchStats) add(o benchStats) {
+	s.sent += o.sent
+	s.nacked += o.nacked
+	s.rtts = append(s.rtts, o.rtts...)
+}
+
+// runBench implements `bench [flags]`: it connects a simulated robot and
+// -peers simulated browsers for each of -robots robots, sends twists from
+// every browser at -rate for -duration and reports throughput, drop rate
+// (twists neither acked nor nacked) and round-trip percentiles per robot.
+// Only a robot's driver is forwarded, so with -peers above 1 the relay
+// should run with -nacks.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	relayURL := fs.String("url", "ws://localhost:8080/ws/data", "relay WebSocket URL")
+	robots := fs.Int("robots", 1, "robots, each served by one simulated robot peer")
+	peers := fs.Int("peers", 1, "simulated web peers per robot, all sending twists")
+	rate := fs.Float64("rate", 50, "twists per second per web peer")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send twists")
+	prefix := fs.String("robot-prefix", "bench", "robot IDs are <prefix>-<n>")
+	token := fs.String("token", "", "JWT with 'web' and 'python' scope if the relay requires auth")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: go_relay bench [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *robots < 1 || *peers < 1 || *rate <= 0 || *duration <= 0 {
+		return errors.New("-robots, -peers, -rate and -duration must be positive")
+	}
+	if *peers > 0xFFFF {
+		return errors.New("-peers must be at most 65535")
+	}
+
+	bench := make([]*benchRobot, 0, *robots)
+	defer func() {
+		for _, b := range bench {
+			b.close()
+		}
+	}()
+	for i := 0; i < *robots; i++ {
+		b := &benchRobot{id: fmt.Sprintf("%s-%d", *prefix, i)}
+		bench = append(bench, b)
+		if err := b.connect(*relayURL, *token, *peers); err != nil {
+			return fmt.Errorf("%s: %w", b.id, err)
+		}
+	}
+
+	fmt.Printf("Sending from %d web peer(s) on each of %d robot(s) at %g Hz for %s\n", *peers, *robots, *rate, *duration)
+	interval := time.Duration(float64(time.Second) / *rate)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, b := range bench {
+		for _, br := range b.browsers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				br.drive(interval, *duration)
+			}()
+		}
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	time.Sleep(benchAckGrace)
+
+	fmt.Printf("%-16s %8s %8s %8s %7s %9s %8s %8s %8s %8s\n",
+		"robot", "sent", "acked", "nacked", "drop%", "acks/s", "p50ms", "p95ms", "p99ms", "maxms")
+	var total benchStats
+	for _, b := range bench {
+		stats := b.stats()
+		printBenchRow(b.id, stats, elapsed)
+		total.add(stats)
+	}
+	if len(bench) > 1 {
+		printBenchRow("total", total, elapsed)
+	}
+	if *peers > 1 {
+		fmt.Println("Only each robot's driver is forwarded; run the relay with -nacks so the other peers' twists count as nacked, not dropped.")
+	}
+	return nil
+}
+
+func printBenchRow(name string, s benchStats, elapsed time.Duration) {
+	acked := len(s.rtts)
+	drop := 0.0
+	if s.sent > 0 {
+		drop = 100 * float64(s.sent-acked-s.nacked) / float64(s.sent)
+	}
+	maxRTT := 0.0
+	for _, rtt := range s.rtts {
+		maxRTT = math.Max(maxRTT, rtt)
+	}
+	p := percentiles(s.rtts)
+	fmt.Printf("%-16s %8d %8d %8d %7.2f %9.1f %8.2f %8.2f %8.2f %8.2f\n",
+		name, s.sent, acked, s.nacked, drop, float64(acked)/elapsed.Seconds(), p.P50, p.P95, p.P99, maxRTT)
+}
+
+// connect opens the robot peer, then the browsers, and starts reading
+func (b *benchRobot) connect(relayURL, token string, peers int) error {
+	var err error
+	if b.robot, err = dialRelay(relayURL, "python", b.id, token); err != nil {
+		return err
+	}
+	go b.serveRobot()
+	for i := 0; i < peers; i++ {
+		conn, err := dialRelay(relayURL, "web", b.id, token)
+		if err != nil {
+			return err
+		}
+		br := &benchBrowser{index: i, conn: conn, sent: make(map[uint64]time.Time)}
+		b.browsers = append(b.browsers, br)
+		go br.readReplies()
+	}
+	return nil
+}
+
+func (b *benchRobot) close() {
+	if b.robot != nil {
+		b.robot.Close()
+	}
+	for _, br := range b.browsers {
+		br.conn.Close()
+	}
+}
+
+func (b *benchRobot) stats() benchStats {
+	var s benchStats
+	for _, br := range b.browsers {
+		br.mu.Lock()
+		s.add(benchStats{sent: br.n, nacked: br.nacked, rtts: br.rtts})
+		br.mu.Unlock()
+	}
+	return s
+}
+
+// serveRobot acks every twist the relay forwards, as a robot that takes
+// no time to process it would
+func (b *benchRobot) serveRobot() {
+	for {
+		_, data, err := b.robot.ReadMessage()
+		if err != nil {
+			return
+		}
+		twist, err := protocol.UnmarshalTwist(data, true)
+		if err != nil {
+			continue
+		}
+		now := currentTimeMs()
+		ack := encodeMockAck(twist, now, now, 0)
+		if b.robot.WriteMessage(websocket.BinaryMessage, ack) != nil {
+			return
+		}
+	}
+}
+
+// readReplies matches acks and Nacks to the browser's own twists
+func (br *benchBrowser) readReplies() {
+	for {
+		_, data, err := br.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var nack bool
+		switch {
+		case len(data) >= protocol.AckToBrowserSize && data[0] == protocol.MsgTypeTwistAck:
+		case len(data) >= protocol.NackSize && data[0] == protocol.MsgTypeNack:
+			nack = true
+		default:
+			continue
+		}
+		msgID := binary.LittleEndian.Uint64(data[1:9])
+		br.mu.Lock()
+		if sentAt, ok := br.sent[msgID]; ok {
+			delete(br.sent, msgID)
+			if nack {
+				br.nacked++
+			} else {
+				br.rtts = append(br.rtts, float64(time.Since(sentAt).Microseconds())/1000)
+			}
+		}
+		br.mu.Unlock()
+	}
+}
+
+// drive sends a twist every interval for duration
+func (br *benchBrowser) drive(interval, duration time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.Now().Add(duration)
+	for seq := uint64(1); time.Now().Before(deadline); seq++ {
+		msgID := uint64(br.index)<<48 | seq
+		frame := protocol.Twist{
+			MsgID:         msgID,
+			T1BrowserSend: currentTimeMs(),
+			Linear:        [3]float64{0.1, 0, 0},
+		}.Marshal()
+
+		br.mu.Lock()
+		br.sent[msgID] = time.Now()
+		br.n++
+		br.mu.Unlock()
+		if br.conn.WriteMessage(websocket.BinaryMessage, frame) != nil {
+			return
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// Blend modes for -blend
+const (
+	BlendWeighted = "weighted" // weighted average of every fresh input
+	BlendPriority = "priority" // weighted average of the highest-priority inputs that move
+)
+
+// blendSource is the source the relay's blended twists are forwarded as
+const blendSource = "blend"
+
+// Blender implements shared control: with -blend set, every web peer's
+// twists for a robot are inputs rather than commands, and the relay sends
+// the robot one twist blended from the fresh inputs every 1/-blend-rate.
+// An input is fresh for -blend-timeout after its twist. Each peer's
+// weight (?blend_weight=, default 1) and priority (?blend_priority=,
+// default 0) come from its connect query. Blended twists carry the relay's
+// own message IDs, so their acks match no browser's twist.
+type Blender struct {
+	mu     sync.Mutex
+	robots map[string]*blendRobot
+}
+
+type blendRobot struct {
+	inputs map[string]*blendInput // by peer ID
+	seq    uint64                 // message ID of the last blended twist
+}
+
+type blendInput struct {
+	vel      [6]float64
+	at       time.Time
+	weight   float64
+	priority int
+}
+
+// BlendInput is one input as reported in /status
+type BlendInput struct {
+	PeerID   string     `json:"peer_id"`
+	Weight   float64    `json:"weight"`
+	Priority int        `json:"priority"`
+	AgeMs    int64      `json:"age_ms"`
+	Velocity [6]float64 `json:"velocity"` // linear x/y/z, angular x/y/z
+}
+
+// blender is nil unless -blend is set
+var blender *Blender
+
+func newBlender() *Blender {
+	return &Blender{robots: make(map[string]*blendRobot)}
+}
+
+// parseBlendMeta reads a peer's ?blend_weight= and ?blend_priority=
+func parseBlendMeta(weight, priority string) (float64, int, error) {
+	w, p := 1.0, 0
+	if weight != "" {
+		v, err := strconv.ParseFloat(weight, 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return 0, 0, errors.New("blend_weight must be a non-negative number")
+		}
+		w = v
+	}
+	if priority != "" {
+		v, err := strconv.Atoi(priority)
+		if err != nil {
+			return 0, 0, errors.New("blend_priority must be an integer")
+		}
+		p = v
+	}
+	return w, p, nil
+}
+
+// input records peer's twist as its current input for robotID
+func (b *Blender) input(robotID string, peer *Peer, twist []byte) {
+	in := &blendInput{at: time.Now(), weight: peer.Meta.BlendWeight, priority: peer.Meta.BlendPriority}
+	for i := range in.vel {
+		in.vel[i] = math.Float64frombits(binary.LittleEndian.Uint64(twist[17+8*i:]))
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.robots[robotID]
+	if r == nil {
+		r = &blendRobot{inputs: make(map[string]*blendInput)}
+		b.robots[robotID] = r
+	}
+	r.inputs[peer.ID] = in
+}
+
+// leave drops peerID's inputs, once it disconnected, so its last twist
+// stops counting at once
+func (b *Blender) leave(peerID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.robots {
+		delete(r.inputs, peerID)
+	}
+}
+
+// run sends every robot with fresh inputs its blended twist each interval
+func (b *Blender) run(interval, timeout time.Duration, mode string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for robotID, frame := range b.blend(timeout, mode) {
+			if estops.engaged(robotID) || overrides.active(robotID) {
+				continue
+			}
+			if forwardTwist(robotID, blendSource, frame, currentTimeMs()) {
+				metricBlendedTwists.Inc()
+				deadman.kick(robotID, "")
+			}
+		}
+	}
+}
+
+// blend drops stale inputs and returns a browser twist for each robot
+// that still has some
+func (b *Blender) blend(timeout time.Duration, mode string) map[string][]byte {
+	cutoff := time.Now().Add(-timeout)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[string][]byte)
+	for robotID, r := range b.robots {
+		for id, in := range r.inputs {
+			if in.at.Before(cutoff) {
+				delete(r.inputs, id)
+			}
+		}
+		if len(r.inputs) == 0 {
+			continue // r stays so seq never repeats an ID the robot has seen
+		}
+		r.seq++
+		frame := make([]byte, protocol.TwistBrowserSize)
+		frame[0] = protocol.MsgTypeTwist
+		binary.LittleEndian.PutUint64(frame[1:9], r.seq)
+		binary.LittleEndian.PutUint64(frame[9:17], currentTimeMs())
+		for i, v := range blendInputs(r.inputs, mode) {
+			binary.LittleEndian.PutUint64(frame[17+8*i:], math.Float64bits(v))
+		}
+		out[robotID] = frame
+	}
+	return out
+}
+
+// blendInputs mixes inputs by mode. Under priority only the inputs of the
+// highest priority that command any motion count, so a higher-priority
+// peer takes over while it moves and hands back when it lets go.
+func blendInputs(inputs map[string]*blendInput, mode string) [6]float64 {
+	top, moving := math.MinInt, false
+	if mode == BlendPriority {
+		for _, in := range inputs {
+			if in.vel != ([6]float64{}) && (!moving || in.priority > top) {
+				top, moving = in.priority, true
+			}
+		}
+	}
+	var sum [6]float64
+	total := 0.0
+	for _, in := range inputs {
+		if moving && in.priority != top {
+			continue
+		}
+		for i, v := range in.vel {
+			sum[i] += in.weight * v
+		}
+		total += in.weight
+	}
+	if total > 0 {
+		for i := range sum {
+			sum[i] /= total
+		}
+	}
+	return sum
+}
+
+// snapshot returns every robot's fresh inputs
+func (b *Blender) snapshot() map[string][]BlendInput {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[string][]BlendInput, len(b.robots))
+	for robotID, r := range b.robots {
+		for id, in := range r.inputs {
+			out[robotID] = append(out[robotID], BlendInput{
+				PeerID:   id,
+				Weight:   in.weight,
+				Priority: in.priority,
+				AgeMs:    time.Since(in.at).Milliseconds(),
+				Velocity: in.vel,
+			})
+		}
+	}
+	return out
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"go_relay/protocol"
+)
+
+func TestBlendIDsSurviveIdle(t *testing.T) {
+	twist := make([]byte, protocol.TwistBrowserSize)
+	twist[0] = protocol.MsgTypeTwist
+	b := newBlender()
+	driver := &Peer{ID: "a", Meta: PeerMeta{BlendWeight: 1}}
+
+	var ids []uint64
+	for range 3 {
+		b.input("r", driver, twist)
+		ids = append(ids, binary.LittleEndian.Uint64(b.blend(time.Hour, BlendWeighted)["r"][1:9]))
+		b.leave("a") // idle: no inputs until the next round
+		if frames := b.blend(time.Hour, BlendWeighted); frames["r"] != nil {
+			t.Fatal("idle robot blended")
+		}
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("blended IDs %v repeat after an idle spell", ids)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"unicode/utf8"
+
+	"go_relay/protocol"
+)
+
+// chatMaxText bounds a chat message's text in bytes
+const chatMaxText = 1024
+
+// chatSender names a peer in the chat: its ?name=, else its peer ID
+func chatSender(peer *Peer) string {
+	if peer.Meta.Name != "" {
+		return peer.Meta.Name
+	}
+	return peer.ID
+}
+
+// handleChat relays a chat message to everyone watching the sender's
+// robot, the sender included, so all operators see one order. The relay
+// fills in the sender, whatever the peer put there, so names can't be
+// spoofed. Web peers' messages also reach the robot with -chat-to-robot;
+// a robot's go to its operators.
+func handleChat(peer *Peer, data []byte) {
+	if !peer.isRobot() && !peer.watchesRobot() {
+		return
+	}
+	if len(data) < protocol.ChatMinSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.ChatMinSize)
+		return
+	}
+	header := protocol.ChatMinSize + int(data[9])
+	if len(data) < header {
+		rejectFrame(peer, data, ProtoErrTooShort, header)
+		return
+	}
+	text := data[header:]
+	if len(text) > chatMaxText {
+		rejectFrame(peer, data, ProtoErrTooLong, header+chatMaxText)
+		return
+	}
+	if len(text) == 0 || !utf8.Valid(text) {
+		peer.logger().Debug("Chat message dropped, empty or not UTF-8", "msg_type", "chat")
+		return
+	}
+	robotID := manager.robotFor(peer)
+	from := chatSender(peer)
+
+	msg := make([]byte, 0, protocol.ChatMinSize+len(from)+len(text))
+	msg = append(msg, data[:9]...)
+	msg = append(msg, byte(len(from)))
+	msg = append(msg, from...)
+	msg = append(msg, text...)
+
+	// Shared by every operator
+	f := wrapFrame(msg)
+	for _, web := range manager.getWebPeers(robotID) {
+		web.sendFrame(f.retain())
+	}
+	f.release()
+	if config.ChatToRobot && !peer.isRobot() {
+		if python := manager.getPython(robotID); python != nil && python.Type == "python" {
+			python.send(msg)
+		}
+	}
+	metricChatMessages.Inc()
+	peer.logger().Debug("Chat message", "msg_type", "chat", "robot_id", robotID, "from", from, "len", len(text))
+}
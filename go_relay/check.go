@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go_relay/protocol"
+)
+
+// probeTimeout bounds each step of check -probe
+const probeTimeout = 5 * time.Second
+
+// runCheck implements `check [flags]`: it loads the configuration from
+// the same file, environment and flags serve would, reports what it
+// enables and fails if it is invalid. With -probe it then connects to a
+// running relay as an observer, negotiates every feature this binary
+// knows and times a Clock Sync round trip.
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	probe := fs.String("probe", "", "also check the protocol of the relay at this WebSocket URL (ws://host:8080/ws/data)")
+	probeToken := fs.String("probe-token", "", "JWT with 'observer' scope for -probe if the relay requires auth")
+	cfg, err := parseConfig(fs, args)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	fmt.Printf("config ok: listen %s, static dir %s\n", cfg.Listen, cfg.StaticDir)
+	fmt.Printf("  features: %s\n", strings.Join(cfg.features(), ","))
+	for _, w := range cfg.warnings() {
+		fmt.Println("  warning:", w)
+	}
+	if *probe == "" {
+		return nil
+	}
+	return probeRelay(*probe, *probeToken)
+}
+
+// warnings lists settings that are valid but probably not intended
+func (c *Config) warnings() []string {
+	var warnings []string
+	if info, err := os.Stat(c.StaticDir); err != nil || !info.IsDir() {
+		warnings = append(warnings, fmt.Sprintf("static_dir %q is not a directory; / will answer 404", c.StaticDir))
+	}
+	if c.JWTSecret == "" {
+		warnings = append(warnings, "auth disabled: anyone who reaches the relay can drive robots")
+	}
+	if c.AllowedOrigins == "" {
+		warnings = append(warnings, "allowed_origins unset: any website may open connections from a browser")
+	}
+	if c.Deadman == 0 {
+		warnings = append(warnings, "deadman disabled: robots keep their last twist when a driver goes silent")
+	}
+	return warnings
+}
+
+// features lists the optional parts of the relay the configuration turns
+// on, for check and serve's startup line
+func (c *Config) features() []string {
+	var features []string
+	add := func(on bool, name string) {
+		if on {
+			features = append(features, name)
+		}
+	}
+	add(c.JWTSecret != "", "auth")
+	add(c.Compression, "compression")
+	add(c.Blend != "", "blend")
+	add(len(c.Mux) > 0, "mux")
+	add(c.FailoverTimeout > 0, "failover")
+	add(c.ResumeGrace > 0, "resume")
+	add(c.WebTransportAddr != "", "webtransport")
+	add(c.UDPAddr != "", "udp")
+	add(c.TCPAddr != "", "tcp")
+	add(c.UnixSocket != "", "unix")
+	add(c.GRPCAddr != "", "grpc")
+	add(c.MQTT.Broker != "", "mqtt")
+	add(c.Zenoh.Router != "", "zenoh")
+	add(c.ROS2.Robot != "", "ros2")
+	add(c.Upstream != "", "upstream")
+	add(c.MockRobot, "mock-robot")
+	add(c.Impairment.Uplink.active() || c.Impairment.Downlink.active(), "impairment")
+	add(c.RecordDir != "" || c.MCAPDir != "", "recording")
+	add(c.AuditDB != "", "audit")
+	add(c.KernelTimestamps, "kernel-timestamps")
+	add(c.OTLPEndpoint != "", "tracing")
+	add(c.DebugAddr != "", "debug")
+	return features
+}
+
+// probeRelay checks a running relay's Hello/Welcome negotiation and Clock
+// Sync, printing what it finds
+func probeRelay(rawURL, token string) error {
+	conn, err := dialRelay(rawURL, "observer", "", token)
+	if err != nil {
+		return fmt.Errorf("probe: %w", err)
+	}
+	defer conn.Close()
+
+	hello := make([]byte, protocol.HelloSize)
+	hello[0] = protocol.MsgTypeHello
+	hello[1] = ProtocolVersion
+	binary.LittleEndian.PutUint32(hello[2:], supportedFeatures)
+	if err := conn.WriteMessage(websocket.BinaryMessage, hello); err != nil {
+		return fmt.Errorf("probe: hello: %w", err)
+	}
+	welcome, err := readProbeFrame(conn, protocol.MsgTypeWelcome, protocol.HelloSize, legacyCodec)
+	if err != nil {
+		return fmt.Errorf("probe: no welcome: %w", err)
+	}
+	codec := &Codec{Version: welcome[1], Features: binary.LittleEndian.Uint32(welcome[2:6])}
+	fmt.Printf("protocol ok: version %d (this binary %d), features %#x of %#x\n",
+		codec.Version, ProtocolVersion, codec.Features, supportedFeatures)
+	if codec.Version < ProtocolVersion {
+		fmt.Println("  warning: the relay is older than this binary")
+	}
+
+	start := time.Now()
+	req := protocol.ClockSyncReq{T1: currentTimeMs()}.Marshal()
+	if codec.has(FeatureCBOR) {
+		if req, err = protocol.ToCBOR(req, false); err != nil {
+			return fmt.Errorf("probe: clock sync: %w", err)
+		}
+	} else if codec.has(FeatureProtobuf) {
+		if req, err = protocol.ToProto(req, false); err != nil {
+			return fmt.Errorf("probe: clock sync: %w", err)
+		}
+	}
+	if codec.has(FeatureCRC32) {
+		req = binary.LittleEndian.AppendUint32(req, crc32.ChecksumIEEE(req))
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, req); err != nil {
+		return fmt.Errorf("probe: clock sync: %w", err)
+	}
+	resp, err := readProbeFrame(conn, protocol.MsgTypeClockSyncResp, protocol.ClockSyncRespSize, codec)
+	if err != nil {
+		return fmt.Errorf("probe: no clock sync response: %w", err)
+	}
+	rtt, t4 := time.Since(start), currentTimeMs()
+	cs, err := protocol.UnmarshalClockSyncResp(resp)
+	if err != nil {
+		return fmt.Errorf("probe: clock sync: %w", err)
+	}
+	fmt.Printf("clock sync ok: round trip %s, relay clock offset %.0fms\n", rtt.Round(time.Microsecond), cs.Offset(t4))
+
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "check finished"),
+		time.Now().Add(time.Second))
+	return nil
+}
+
+// readProbeFrame skips text messages and other frames until one of type
+// t arrives, decoding it as codec negotiated (CRC, CBOR profile), and
+// fails unless it has at least size bytes
+func readProbeFrame(conn *websocket.Conn, t byte, size int, codec *Codec) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if kind != websocket.BinaryMessage || len(data) == 0 {
+			continue
+		}
+		if codec.has(FeatureCRC32) {
+			body, ok := verifyCRC(data)
+			if !ok {
+				return nil, errors.New("CRC mismatch")
+			}
+			data = body
+		}
+		switch {
+		case codec.has(FeatureCBOR):
+			data, err = protocol.FromCBOR(data, true)
+		case codec.has(FeatureProtobuf):
+			data, err = protocol.FromProto(data, true)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if data[0] != t {
+			continue
+		}
+		if len(data) < size {
+			return nil, fmt.Errorf("%d-byte frame, want %d", len(data), size)
+		}
+		return data, nil
+	}
+}
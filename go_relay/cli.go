@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go_relay/protocol"
+)
+
+// command is one subcommand of the relay binary
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+	failure string // fatal log message when run fails
+}
+
+var commands = []command{
+	{"serve", "run the relay (the default without a subcommand)", runServe, "Relay failed"},
+	{"replay", "play the twists of a recorded session or MCAP file to a relay", runReplay, "Replay failed"},
+	{"bench", "drive simulated browsers and robots through a relay and report latency", runBench, "Bench failed"},
+	{"check", "validate the configuration and, with -probe, a running relay's protocol", runCheck, "Check failed"},
+	{"check-client", "stand in for a relay and test a browser or robot client's protocol conformance", runCheckClient, "Client check failed"},
+}
+
+func main() {
+	args := os.Args[1:]
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(args); err != nil {
+				fatal(cmd.failure, "err", err)
+			}
+			return
+		}
+	}
+	if name != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	}
+	usage()
+	if name != "help" {
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: go_relay [command] [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run go_relay <command> -h for a command's flags.")
+}
+
+// dialRelay opens a /ws/data connection to a relay as a peerType peer,
+// for robotID unless it is empty
+func dialRelay(rawURL, peerType, robotID, token string) (*websocket.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("type", peerType)
+	if robotID != "" {
+		q.Set("robot", robotID)
+	}
+	if token != "" {
+		q.Set("token", token)
+	}
+	u.RawQuery = q.Encode()
+
+	conn, _, err := relayDialer.Dial(u.String(), nil)
+	return conn, err
+}
+
+// relayDialer offers the /ws/data subprotocol
+var relayDialer = &websocket.Dialer{
+	Proxy:            http.ProxyFromEnvironment,
+	HandshakeTimeout: 45 * time.Second,
+	Subprotocols:     []string{protocol.Subprotocol},
+}
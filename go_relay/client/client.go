@@ -0,0 +1,521 @@
+// Package client connects Go programs to the teleop relay's /ws/data
+// endpoint, so robots and test harnesses written in Go need not
+// reimplement the wire format. A web client sends twists and gets a
+// callback for every ack; a robot client gets a callback for every twist
+// and answers with Ack. The client keeps its connection up, reconnecting
+// with exponential backoff, and tracks the relay's clock offset through
+// periodic clock sync exchanges.
+//
+// The client skips the Hello handshake, so the relay uses the original
+// frame formats: no CRC trailers, sequence or trace blocks.
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go_relay/protocol"
+)
+
+// ErrNotConnected is returned by the send methods between connections
+var ErrNotConnected = errors.New("client: not connected")
+
+// dialer offers the relay's subprotocol, which it requires by default
+var dialer = &websocket.Dialer{
+	Proxy:            http.ProxyFromEnvironment,
+	HandshakeTimeout: 45 * time.Second,
+	Subprotocols:     []string{protocol.Subprotocol},
+}
+
+// Options configures a Client. Only URL is required.
+type Options struct {
+	URL      string // relay data endpoint, e.g. ws://localhost:8080/ws/data
+	Type     string // peer type: "web" (default), "python" for robots, or "observer"
+	RobotID  string // robot to join; empty for the relay's default robot
+	Token    string // JWT, if the relay requires auth
+	ClientID string // stable identity across reconnects; with auth, the token's subject
+	Room     string // relay room RobotID is taken within; empty for none
+
+	SyncInterval time.Duration // between clock sync requests; default 10s, negative disables
+	MinBackoff   time.Duration // first reconnect delay; default 500ms
+	MaxBackoff   time.Duration // reconnect delay cap; default 30s
+
+	// Callbacks run on the client's read goroutine and must not block
+	OnConnect    func()
+	OnDisconnect func(err error)
+	OnAck        func(ack protocol.Ack, rtt time.Duration) // web peers; rtt from the twist's t1
+	OnTwist      func(twist protocol.Twist)                // robot peers; answer with Client.Ack
+	OnFrame      func(frame []byte)                        // every other binary frame
+
+	// Reliable commands (see SendCommand). OnCommand runs once per command
+	// on robot peers and its status is acked, also to the relay's
+	// retransmissions; OnCommandAck gets web peers the robot's status.
+	OnCommand    func(kind byte, payload []byte) (status byte)
+	OnCommandAck func(msgID uint64, status byte)
+
+	// OnRaw gets Raw frames (see SendRaw) with the sender's send time
+	OnRaw func(channel uint16, tSend uint64, payload []byte)
+
+	// OnChat gets operators' chat messages (see SendChat), the sender
+	// named by the relay
+	OnChat func(from, text string)
+
+	// File transfers (see SendFile): chunks and acks of the transfers this
+	// client takes part in. The client does no pacing of its own.
+	OnFileChunk func(chunk protocol.FileChunk)
+	OnFileAck   func(ack protocol.FileAck)
+
+	// OnParam gets Param Requests on robot peers, to answer with SendParam
+	// under the same request ID, and the answers to GetParam and SetParam
+	// on web peers
+	OnParam func(p protocol.Param)
+
+	// Service calls (see CallService). OnServiceCall gets robot peers each
+	// call, to answer with RespondService before its timeout, without
+	// blocking the read loop on long ones; OnServiceResponse gets web peers
+	// the answers.
+	OnServiceCall     func(call protocol.ServiceCall)
+	OnServiceResponse func(resp protocol.ServiceResponse)
+
+	// OnDiagAlert gets web peers the relay's alerts of robot components
+	// entering or leaving ERROR (see SendDiagnostics)
+	OnDiagAlert func(alert protocol.DiagAlert)
+
+	// OnLatencyWarning gets web peers the relay's warnings that the
+	// robot's round-trip p95 went over its SLO, and back under it
+	OnLatencyWarning func(w protocol.LatencyWarning)
+}
+
+// commandDedup is how many recent command IDs a robot client remembers
+const commandDedup = 1024
+
+// Client is one peer connection to the relay. Its send methods are safe
+// for concurrent use.
+type Client struct {
+	opts Options
+	url  string
+
+	mu   sync.Mutex // guards conn and serializes writes
+	conn *websocket.Conn
+
+	msgID     atomic.Uint64
+	commandID atomic.Uint64 // apart from msgID, which the relay checks for gaps
+	paramID   atomic.Uint64
+	callID    atomic.Uint64
+	offset    atomic.Int64 // relay clock minus ours, in µs
+
+	// Statuses of the latest commands by relay ID, oldest first in order
+	commands map[uint64]byte
+	order    []uint64
+}
+
+// New checks opts and fills in defaults; call Run to connect
+func New(opts Options) (*Client, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("client: URL scheme must be ws or wss, not %q", u.Scheme)
+	}
+	if opts.Type == "" {
+		opts.Type = "web"
+	}
+	if len(opts.RobotID) > protocol.MaxRobotIDLen {
+		return nil, fmt.Errorf("client: robot ID longer than %d bytes", protocol.MaxRobotIDLen)
+	}
+	if opts.SyncInterval == 0 {
+		opts.SyncInterval = 10 * time.Second
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(30*time.Second, opts.MinBackoff)
+	}
+
+	q := u.Query()
+	q.Set("type", opts.Type)
+	if opts.RobotID != "" {
+		q.Set("robot", opts.RobotID)
+	}
+	if opts.Token != "" {
+		q.Set("token", opts.Token)
+	}
+	if opts.ClientID != "" {
+		q.Set("client_id", opts.ClientID)
+	}
+	if opts.Room != "" {
+		q.Set("room", opts.Room)
+	}
+	u.RawQuery = q.Encode()
+	return &Client{opts: opts, url: u.String(), commands: make(map[uint64]byte)}, nil
+}
+
+// Run connects and serves the connection until ctx is done, reconnecting
+// after every failure. The delay doubles from MinBackoff up to MaxBackoff
+// and resets once a connection succeeds. It returns ctx.Err().
+func (c *Client) Run(ctx context.Context) error {
+	backoff := c.opts.MinBackoff
+	for {
+		conn, _, err := dialer.DialContext(ctx, c.url, nil)
+		if err == nil {
+			backoff = c.opts.MinBackoff
+			err = c.serve(ctx, conn)
+			if c.opts.OnDisconnect != nil {
+				c.opts.OnDisconnect(err)
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, c.opts.MaxBackoff)
+	}
+}
+
+// serve reads conn until it fails or ctx is done, syncing clocks meanwhile
+func (c *Client) serve(ctx context.Context, conn *websocket.Conn) error {
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+	}()
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	if c.opts.SyncInterval > 0 {
+		go c.syncClock(done)
+	}
+
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if kind == websocket.BinaryMessage && len(data) > 0 {
+			c.handle(data)
+		}
+	}
+}
+
+// syncClock sends a clock sync request now and every SyncInterval
+func (c *Client) syncClock(done <-chan struct{}) {
+	ticker := time.NewTicker(c.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		if c.write(protocol.ClockSyncReq{T1: nowMs()}.Marshal()) != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (c *Client) handle(data []byte) {
+	rx := nowMs()
+	switch data[0] {
+	case protocol.MsgTypeTwistAck:
+		ack, err := protocol.UnmarshalAck(data, true)
+		if err == nil && c.opts.OnAck != nil {
+			c.opts.OnAck(ack, time.Duration(rx-ack.T1BrowserSend)*time.Millisecond)
+		}
+	case protocol.MsgTypeTwist:
+		twist, err := protocol.UnmarshalTwist(data, true)
+		if err == nil && c.opts.OnTwist != nil {
+			c.opts.OnTwist(twist)
+		}
+	case protocol.MsgTypeCommand:
+		if len(data) >= protocol.CommandMinSize && c.opts.OnCommand != nil {
+			c.handleCommand(data)
+		}
+	case protocol.MsgTypeCommandAck:
+		if len(data) >= protocol.CommandAckSize && c.opts.OnCommandAck != nil {
+			c.opts.OnCommandAck(binary.LittleEndian.Uint64(data[1:9]), data[9])
+		}
+	case protocol.MsgTypeRaw:
+		if len(data) >= protocol.RawHeaderSize && c.opts.OnRaw != nil {
+			c.opts.OnRaw(binary.LittleEndian.Uint16(data[1:3]), binary.LittleEndian.Uint64(data[3:11]),
+				data[protocol.RawHeaderSize:])
+		}
+	case protocol.MsgTypeChat:
+		if len(data) < protocol.ChatMinSize || c.opts.OnChat == nil {
+			break
+		}
+		if n := protocol.ChatMinSize + int(data[9]); len(data) >= n {
+			c.opts.OnChat(string(data[protocol.ChatMinSize:n]), string(data[n:]))
+		}
+	case protocol.MsgTypeFileChunk:
+		if chunk, err := protocol.UnmarshalFileChunk(data); err == nil && c.opts.OnFileChunk != nil {
+			c.opts.OnFileChunk(chunk)
+		}
+	case protocol.MsgTypeFileAck:
+		if ack, err := protocol.UnmarshalFileAck(data); err == nil && c.opts.OnFileAck != nil {
+			c.opts.OnFileAck(ack)
+		}
+	case protocol.MsgTypeParamRequest, protocol.MsgTypeParamResponse:
+		if p, err := protocol.UnmarshalParam(data); err == nil && c.opts.OnParam != nil {
+			c.opts.OnParam(p)
+		}
+	case protocol.MsgTypeServiceCall:
+		if call, err := protocol.UnmarshalServiceCall(data); err == nil && c.opts.OnServiceCall != nil {
+			call.Payload = append([]byte(nil), call.Payload...)
+			c.opts.OnServiceCall(call)
+		}
+	case protocol.MsgTypeServiceResponse:
+		if resp, err := protocol.UnmarshalServiceResponse(data); err == nil && c.opts.OnServiceResponse != nil {
+			c.opts.OnServiceResponse(resp)
+		}
+	case protocol.MsgTypeDiagAlert:
+		if alert, err := protocol.UnmarshalDiagAlert(data); err == nil && c.opts.OnDiagAlert != nil {
+			c.opts.OnDiagAlert(alert)
+		}
+	case protocol.MsgTypeLatencyWarning:
+		if w, err := protocol.UnmarshalLatencyWarning(data); err == nil && c.opts.OnLatencyWarning != nil {
+			c.opts.OnLatencyWarning(w)
+		}
+	case protocol.MsgTypeClockSyncResp:
+		if resp, err := protocol.UnmarshalClockSyncResp(data); err == nil {
+			c.offset.Store(int64(resp.Offset(rx) * 1000))
+		}
+	case protocol.MsgTypeSyncBeacon:
+		if len(data) >= protocol.SyncBeaconSize {
+			reply := make([]byte, protocol.BeaconReplySize)
+			reply[0] = protocol.MsgTypeBeaconReply
+			copy(reply[1:9], data[1:9])
+			binary.LittleEndian.PutUint64(reply[9:17], rx)
+			binary.LittleEndian.PutUint64(reply[17:25], nowMs())
+			c.write(reply)
+		}
+	default:
+		if c.opts.OnFrame != nil {
+			c.opts.OnFrame(data)
+		}
+	}
+}
+
+// SendTwist sends a velocity command and returns its message ID, which
+// the matching ack carries
+func (c *Client) SendTwist(linear, angular [3]float64) (uint64, error) {
+	for _, v := range append(linear[:], angular[:]...) {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0, fmt.Errorf("client: %w: %v", protocol.ErrNotFinite, v)
+		}
+	}
+	twist := protocol.Twist{
+		MsgID:         c.msgID.Add(1),
+		T1BrowserSend: nowMs(),
+		Linear:        linear,
+		Angular:       angular,
+	}
+	return twist.MsgID, c.write(twist.Marshal())
+}
+
+// handleCommand runs OnCommand for a command not seen before and acks it
+// with the status, which duplicates get again
+func (c *Client) handleCommand(data []byte) {
+	id := binary.LittleEndian.Uint64(data[1:9])
+	status, seen := c.commands[id]
+	if !seen {
+		status = c.opts.OnCommand(data[9], data[protocol.CommandMinSize:])
+		c.commands[id] = status
+		if c.order = append(c.order, id); len(c.order) > commandDedup {
+			delete(c.commands, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+	ack := make([]byte, protocol.CommandAckSize)
+	ack[0] = protocol.MsgTypeCommandAck
+	binary.LittleEndian.PutUint64(ack[1:9], id)
+	ack[9] = status
+	c.write(ack)
+}
+
+// SendCommand sends a reliable command, e.g. a parameter set or waypoint,
+// and returns its message ID. kind and payload mean whatever the robot
+// makes of them. The relay retransmits it until the robot acks it; the
+// robot's status arrives through OnCommandAck, or a Nack if it never did.
+func (c *Client) SendCommand(kind byte, payload []byte) (uint64, error) {
+	id := c.commandID.Add(1)
+	frame := make([]byte, protocol.CommandMinSize, protocol.CommandMinSize+len(payload))
+	frame[0] = protocol.MsgTypeCommand
+	binary.LittleEndian.PutUint64(frame[1:9], id)
+	frame[9] = kind
+	return id, c.write(append(frame, payload...))
+}
+
+// SendRaw sends payload on a Raw channel, which the relay passes
+// uninterpreted between a robot and its web peers
+func (c *Client) SendRaw(channel uint16, payload []byte) error {
+	frame := make([]byte, protocol.RawHeaderSize, protocol.RawHeaderSize+len(payload))
+	frame[0] = protocol.MsgTypeRaw
+	binary.LittleEndian.PutUint16(frame[1:3], channel)
+	binary.LittleEndian.PutUint64(frame[3:11], nowMs())
+	return c.write(append(frame, payload...))
+}
+
+// SendChat sends a chat message to the robot's operators; the relay adds
+// this client's name
+func (c *Client) SendChat(text string) error {
+	frame := make([]byte, protocol.ChatMinSize, protocol.ChatMinSize+len(text))
+	frame[0] = protocol.MsgTypeChat
+	binary.LittleEndian.PutUint64(frame[1:9], nowMs())
+	return c.write(append(frame, text...))
+}
+
+// SendFile sends a File Chunk: an upload's opening chunk, a download
+// request, or a piece of data within the window the last File Ack
+// allowed. Browsers pick transfer IDs; robots answer under the relay's.
+func (c *Client) SendFile(chunk protocol.FileChunk) error {
+	if len(chunk.Name) > protocol.FileMaxName || len(chunk.Data) > protocol.FileMaxChunk {
+		return errors.New("client: file chunk name or data too long")
+	}
+	return c.write(chunk.Marshal())
+}
+
+// SendFileAck acks the file data received so far and opens the window for
+// more
+func (c *Client) SendFileAck(ack protocol.FileAck) error {
+	return c.write(ack.Marshal())
+}
+
+// GetParam asks the robot for a parameter's value and returns the request
+// ID its Param Response, through OnParam, will carry. Only the driver
+// gets an answer from the robot.
+func (c *Client) GetParam(name string) (uint64, error) {
+	return c.requestParam(protocol.ParamGet, name, nil)
+}
+
+// SetParam sets a robot parameter to value, a bool, int64, float64 or
+// string, like GetParam
+func (c *Client) SetParam(name string, value any) (uint64, error) {
+	return c.requestParam(protocol.ParamSet, name, value)
+}
+
+func (c *Client) requestParam(op byte, name string, value any) (uint64, error) {
+	id := c.paramID.Add(1)
+	frame, err := protocol.Param{RequestID: id, Code: op, Name: name, Value: value}.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return id, c.write(frame)
+}
+
+// SendParam sends a Param Request or, from robots, the Param Response to
+// one received through OnParam
+func (c *Client) SendParam(p protocol.Param) error {
+	frame, err := p.Marshal()
+	if err != nil {
+		return err
+	}
+	return c.write(frame)
+}
+
+// CallService calls a robot service with payload and returns the call ID
+// its Service Response, through OnServiceResponse, will carry. The relay
+// answers with a timeout status if the robot has not within timeout (0
+// for the relay's default).
+func (c *Client) CallService(service string, payload []byte, timeout time.Duration) (uint64, error) {
+	id := c.callID.Add(1)
+	frame, err := protocol.ServiceCall{CallID: id, TimeoutMs: uint32(timeout.Milliseconds()), Service: service,
+		Payload: payload}.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return id, c.write(frame)
+}
+
+// RespondService answers a call received through OnServiceCall
+func (c *Client) RespondService(call protocol.ServiceCall, status byte, payload []byte) error {
+	frame, err := protocol.ServiceResponse{CallID: call.CallID, Status: status, Service: call.Service,
+		Payload: payload}.Marshal()
+	if err != nil {
+		return err
+	}
+	return c.write(frame)
+}
+
+// SendDiagnostics reports robot components' statuses, at most 255 per
+// call; the relay keeps the latest per component for /diagnostics
+func (c *Client) SendDiagnostics(statuses []protocol.DiagStatus) error {
+	frame, err := protocol.Diagnostics{Time: nowMs(), Statuses: statuses}.Marshal()
+	if err != nil {
+		return err
+	}
+	return c.write(frame)
+}
+
+// Ack answers a twist received through OnTwist at rx (ms, our clock).
+// Pass 0 for rx to use the time the ack is sent.
+func (c *Client) Ack(twist protocol.Twist, rx uint64) error {
+	tx := nowMs()
+	if rx == 0 {
+		rx = tx
+	}
+	return c.write(protocol.AckFor(twist, rx, tx).Marshal())
+}
+
+// Send writes a raw frame, for message types the client has no method for
+func (c *Client) Send(frame []byte) error {
+	if err := protocol.Validate(frame); err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+	return c.write(frame)
+}
+
+func (c *Client) write(frame []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	return c.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// Connected reports whether the client has a connection right now
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// ClockOffset is the latest estimate of how far the relay's clock is
+// ahead of ours; zero until the first clock sync response
+func (c *Client) ClockOffset() time.Duration {
+	return time.Duration(c.offset.Load()) * time.Microsecond
+}
+
+func nowMs() uint64 {
+	return uint64(time.Now().UnixMilli())
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+const (
+	clockSamples    = 256 // recent exchanges kept per peer, ~20 min of 5s beacons
+	clockFilterSize = 8   // exchanges per NTP-style filter group
+	clockMinFit     = 3   // filtered points needed to fit drift
+	clockMinSpanMs  = 30_000
+)
+
+// ClockEstimate tracks a peer's clock offset from relay-initiated beacons
+// and session handshakes. Offset is peer clock minus relay clock, so a
+// peer timestamp maps onto the relay timeline as t - offset.
+//
+// Like NTP's clock filter, each run of clockFilterSize exchanges is
+// represented by its lowest-RTT one, the least disturbed by queueing. Once
+// the filtered points span clockMinSpanMs a least-squares line through
+// them gives the offset's drift, and the offset is extrapolated to now;
+// before that the latest filtered point stands and drift is 0.
+type ClockEstimate struct {
+	mu      sync.Mutex
+	samples []clockSample
+}
+
+type clockSample struct {
+	at     float64 // relay time (Unix ms) the exchange completed
+	offset float64 // ms
+	rtt    float64 // ms
+}
+
+func (c *ClockEstimate) add(at uint64, offset, rtt float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples = append(c.samples, clockSample{at: float64(at), offset: offset, rtt: rtt})
+	if len(c.samples) > clockSamples {
+		c.samples = c.samples[1:]
+	}
+}
+
+// ClockSnapshot is the current estimate in ms. Uncertainty is half the
+// filtered RTT (the most an asymmetric path can skew one exchange) plus
+// the RMS scatter of the filtered offsets around the model.
+type ClockSnapshot struct {
+	OffsetMs      float64 `json:"offset_ms"`
+	DriftPPM      float64 `json:"drift_ppm"`
+	UncertaintyMs float64 `json:"uncertainty_ms"`
+	RttMs         float64 `json:"rtt_ms"` // median of all kept exchanges
+	Samples       int     `json:"samples"`
+}
+
+func (c *ClockEstimate) snapshot() ClockSnapshot {
+	now := float64(currentTimeMs())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.samples) == 0 {
+		return ClockSnapshot{}
+	}
+
+	points := c.filtered()
+	rtts := make([]float64, len(c.samples))
+	for i, s := range c.samples {
+		rtts[i] = s.rtt
+	}
+	snap := ClockSnapshot{RttMs: median(rtts), Samples: len(c.samples)}
+
+	// offset(t) = base + slope*(t - t0), slope 0 until there is a span to fit
+	last := points[len(points)-1]
+	t0, base, slope := last.at, last.offset, 0.0
+	if len(points) >= clockMinFit && last.at-points[0].at >= clockMinSpanMs {
+		t0, base, slope = fitLine(points)
+	}
+	snap.OffsetMs = base + slope*(now-t0)
+	snap.DriftPPM = slope * 1e6
+
+	var halfRTT, sq float64
+	for _, p := range points {
+		halfRTT += p.rtt / 2
+		r := p.offset - (base + slope*(p.at-t0))
+		sq += r * r
+	}
+	snap.UncertaintyMs = halfRTT/float64(len(points)) + math.Sqrt(sq/float64(len(points)))
+	return snap
+}
+
+// filtered picks the lowest-RTT exchange of each clockFilterSize run,
+// oldest first; caller holds c.mu
+func (c *ClockEstimate) filtered() []clockSample {
+	var points []clockSample
+	for i := 0; i < len(c.samples); i += clockFilterSize {
+		group := c.samples[i:min(i+clockFilterSize, len(c.samples))]
+		best := group[0]
+		for _, s := range group[1:] {
+			if s.rtt < best.rtt {
+				best = s
+			}
+		}
+		points = append(points, best)
+	}
+	return points
+}
+
+// fitLine fits offset against time by least squares, returning the line
+// as its value base at the mean time t0 and its slope (ms per ms)
+func fitLine(points []clockSample) (t0, base, slope float64) {
+	n := float64(len(points))
+	for _, p := range points {
+		t0 += p.at / n
+		base += p.offset / n
+	}
+	var cov, variance float64
+	for _, p := range points {
+		dt := p.at - t0
+		cov += dt * (p.offset - base)
+		variance += dt * dt
+	}
+	if variance > 0 {
+		slope = cov / variance
+	}
+	return t0, base, slope
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted[len(sorted)/2]
+}
+
+// ClockInfo is one peer's clock as reported by GET /clock
+type ClockInfo struct {
+	PeerID  string `json:"peer_id"`
+	Type    string `json:"type"`
+	RobotID string `json:"robot_id,omitempty"`
+	ClockSnapshot
+}
+
+// handleClock serves GET /clock: the offset model of every peer with at
+// least one exchange, or of ?peer=<id> alone (404 if it has none)
+func handleClock(w http.ResponseWriter, r *http.Request) {
+	want := r.URL.Query().Get("peer")
+	clocks := []ClockInfo{}
+	for _, p := range manager.allPeers() {
+		if want != "" && p.ID != want {
+			continue
+		}
+		if c := p.clock.snapshot(); c.Samples > 0 {
+			clocks = append(clocks, ClockInfo{PeerID: p.ID, Type: p.Type, RobotID: manager.robotFor(p), ClockSnapshot: c})
+		}
+	}
+	if want != "" && len(clocks) == 0 {
+		http.Error(w, "no clock samples for peer", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clocks)
+}
+
+// runSyncBeacons pushes a Sync Beacon to every peer each interval
+// (-sync-beacon-interval). Peers answer with a Beacon Reply, the mirror
+// image of a Clock Sync exchange, feeding their ClockEstimate, which
+// -max-command-age also ages commands by; peers that ignore beacons are
+// unaffected.
+func runSyncBeacons(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, p := range manager.allPeers() {
+			p.send(encodeSyncBeacon())
+		}
+	}
+}
+
+// encodeSyncBeacon stamps a Sync Beacon with the current relay time
+func encodeSyncBeacon() []byte {
+	beacon := make([]byte, protocol.SyncBeaconSize)
+	beacon[0] = protocol.MsgTypeSyncBeacon
+	binary.LittleEndian.PutUint64(beacon[1:], currentTimeMs())
+	return beacon
+}
+
+// handleBeaconReply completes an exchange: t1 is our beacon send time,
+// t2/t3 the peer's receive/reply times, t4 our receive time.
+func handleBeaconReply(peer *Peer, data []byte) {
+	t4 := currentTimeMs()
+
+	if len(data) < protocol.BeaconReplySize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.BeaconReplySize)
+		return
+	}
+
+	t1 := int64(binary.LittleEndian.Uint64(data[1:9]))
+	t2 := int64(binary.LittleEndian.Uint64(data[9:17]))
+	t3 := int64(binary.LittleEndian.Uint64(data[17:25]))
+
+	rtt := float64((int64(t4) - t1) - (t3 - t2))
+	offset := float64((t2-t1)+(t3-int64(t4))) / 2
+	peer.clock.add(t4, offset, rtt)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// twistsCoalesced counts queued twists replaced by a newer one
+var twistsCoalesced atomic.Uint64
+
+// TwistQueue holds the twists waiting to be written to a python peer, at
+// most one per source. A newer twist from the same source replaces the
+// queued one in place, so under congestion the relay loses stale commands
+// instead of the freshest.
+type TwistQueue struct {
+	mu      sync.Mutex
+	pending map[string]*Frame // source -> latest frame
+	order   []string          // sources with a pending frame, oldest first
+	ready   chan struct{}     // holds a token while frames are pending
+}
+
+func newTwistQueue() *TwistQueue {
+	return &TwistQueue{
+		pending: make(map[string]*Frame),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// push queues frame for source, reporting whether it replaced a stale
+// one and that one's message ID. The queue takes over the caller's
+// reference.
+func (q *TwistQueue) push(source string, frame *Frame) (uint64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stale, replaced := q.pending[source]
+	q.pending[source] = frame
+	var staleID uint64
+	if replaced {
+		staleID = stale.msgID
+		stale.release()
+		metricTwistsCoalesced.Inc()
+		twistsCoalesced.Add(1)
+	} else {
+		q.order = append(q.order, source)
+	}
+	q.signal()
+	return staleID, replaced
+}
+
+// pop returns the oldest pending frame, or nil when the queue is empty.
+// The ready token is re-armed while frames remain.
+func (q *TwistQueue) pop() *Frame {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.order) == 0 {
+		return nil
+	}
+	source := q.order[0]
+	q.order = q.order[1:]
+	frame := q.pending[source]
+	delete(q.pending, source)
+	if len(q.order) > 0 {
+		q.signal()
+	}
+	return frame
+}
+
+// clear discards every pending frame and returns how many there were
+func (q *TwistQueue) clear() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.order)
+	for _, f := range q.pending {
+		f.release()
+	}
+	q.pending = make(map[string]*Frame)
+	q.order = nil
+	return n
+}
+
+// len returns the number of pending twists
+func (q *TwistQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.order)
+}
+
+// signal arms ready without blocking; caller holds q.mu
+func (q *TwistQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTwistQueueCoalesces(t *testing.T) {
+	type push struct {
+		source string
+		msgID  uint64
+	}
+	tests := []struct {
+		name      string
+		pushes    []push
+		wantStale []uint64 // IDs replaced, in push order
+		wantPops  []uint64
+	}{
+		{"one source keeps its latest", []push{{"a", 1}, {"a", 2}, {"a", 3}}, []uint64{1, 2}, []uint64{3}},
+		{"sources do not replace each other", []push{{"a", 1}, {"b", 2}}, nil, []uint64{1, 2}},
+		{"replacement keeps the source's place", []push{{"a", 1}, {"b", 2}, {"a", 3}}, []uint64{1}, []uint64{3, 2}},
+		{"empty queue", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTwistQueue()
+			var stale []uint64
+			for _, p := range tt.pushes {
+				f := wrapFrame(nil)
+				f.source, f.msgID = p.source, p.msgID
+				if id, replaced := q.push(p.source, f); replaced {
+					stale = append(stale, id)
+				}
+			}
+			if !slices.Equal(stale, tt.wantStale) {
+				t.Errorf("replaced %v, want %v", stale, tt.wantStale)
+			}
+			if q.len() != len(tt.wantPops) {
+				t.Errorf("len = %d, want %d", q.len(), len(tt.wantPops))
+			}
+			var pops []uint64
+			for f := q.pop(); f != nil; f = q.pop() {
+				pops = append(pops, f.msgID)
+			}
+			if !slices.Equal(pops, tt.wantPops) {
+				t.Errorf("popped %v, want %v", pops, tt.wantPops)
+			}
+		})
+	}
+}
+
+func TestTwistQueueClear(t *testing.T) {
+	q := newTwistQueue()
+	q.push("a", wrapFrame(nil))
+	q.push("b", wrapFrame(nil))
+	if n := q.clear(); n != 2 {
+		t.Errorf("clear = %d, want 2", n)
+	}
+	if f := q.pop(); f != nil {
+		t.Error("frame left after clear")
+	}
+}
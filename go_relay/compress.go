@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go_relay/protocol"
+)
+
+// compressionPolicy decides, frame by frame, what a WebSocket peer that
+// negotiated permessage-deflate gets compressed. Latency-critical types
+// and small frames go out plain: deflating them saves little and costs
+// CPU on the control path.
+type compressionPolicy struct {
+	exempt  [256]bool
+	minSize int
+}
+
+// compression is set by main from config
+var compression compressionPolicy
+
+// newCompressionPolicy parses a comma-separated list of message type
+// names (protocol.TypeName) that are never compressed
+func newCompressionPolicy(exempt string, minSize int) (compressionPolicy, error) {
+	p := compressionPolicy{minSize: minSize}
+	for _, name := range strings.Split(exempt, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		t, ok := protocol.TypeByName(name)
+		if !ok {
+			return p, fmt.Errorf("compression_exempt: unknown message type %q", name)
+		}
+		p.exempt[t] = true
+	}
+	return p, nil
+}
+
+// wants reports whether a frame of type t and size bytes is compressed
+func (p *compressionPolicy) wants(t byte, size int) bool {
+	return !p.exempt[t] && size >= p.minSize
+}
+
+// offersDeflate reports whether the client's upgrade request offers
+// permessage-deflate, which the upgrader then accepts
+func offersDeflate(r *http.Request) bool {
+	for _, ext := range r.Header.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(ext, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// compressTransport is implemented by transports that can compress
+// individual frames
+type compressTransport interface {
+	deflating() bool // permessage-deflate was negotiated
+	compress(on bool)
+}
+
+// setCompression applies the policy to the next frame written to peer
+func setCompression(peer *Peer, t byte, size int) {
+	c, ok := peer.Conn.(compressTransport)
+	if !ok || !c.deflating() {
+		return
+	}
+	on := compression.wants(t, size)
+	c.compress(on)
+	if on {
+		metricCompressed.WithLabelValues(protocol.TypeName(t)).Inc()
+	}
+}
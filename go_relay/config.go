@@ -0,0 +1,623 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"go_relay/protocol"
+)
+
+// Config holds every tunable of the relay. Values are layered, later
+// sources winning: built-in defaults, the YAML file given by -config (or
+// RELAY_CONFIG), RELAY_<FLAG_NAME> environment variables, then CLI flags.
+type Config struct {
+	Listen    string `yaml:"listen"`
+	StaticDir string `yaml:"static_dir"`
+	// Cache-Control max-age for web client assets other than HTML, 0 revalidates everything
+	StaticMaxAge time.Duration `yaml:"static_max_age"`
+
+	LogLevel  string `yaml:"log_level"`  // debug, info, warn or error
+	LogFormat string `yaml:"log_format"` // text or json
+
+	OTLPEndpoint string `yaml:"otlp_endpoint"` // OTLP/HTTP trace collector URL, empty disables
+	DebugAddr    string `yaml:"debug_addr"`    // pprof and /debug/runtime, empty disables
+
+	// Inbound frame sizes, in bytes
+	MaxFrameSize int            `yaml:"max_frame_size"` // hard cap for every transport
+	ReadLimits   map[string]int `yaml:"read_limits"`    // per peer type, at most max_frame_size
+
+	// Buffers
+	SendBuffer       int                  `yaml:"send_buffer"`        // queued messages per peer
+	SendOverflow     string               `yaml:"send_overflow"`      // drop-newest, drop-oldest or disconnect
+	SendBlockTimeout time.Duration        `yaml:"send_block_timeout"` // longest wait under the block policy
+	SendQueues       map[string]SendQueue `yaml:"send_queues"`        // per peer type overrides
+	MediaBuffer      int                  `yaml:"media_buffer"`       // queued media chunks per peer and channel
+	ReadBufferSize   int                  `yaml:"read_buffer_size"`
+	WriteBufferSize  int                  `yaml:"write_buffer_size"`
+
+	// permessage-deflate for WebSocket peers that offer it
+	Compression        bool   `yaml:"compression"`
+	CompressionLevel   int    `yaml:"compression_level"`    // 1 (fastest) to 9
+	CompressionMinSize int    `yaml:"compression_min_size"` // smaller frames go out plain
+	CompressionExempt  string `yaml:"compression_exempt"`   // comma-separated message types never compressed
+
+	// Deadlines
+	PingInterval time.Duration        `yaml:"ping_interval"`
+	PongTimeout  time.Duration        `yaml:"pong_timeout"` // close WebSocket peers leaving a ping unanswered this long, 0 disables
+	ReadTimeout  time.Duration        `yaml:"read_timeout"` // extended by every message and pong
+	WriteTimeout time.Duration        `yaml:"write_timeout"`
+	Heartbeats   map[string]Heartbeat `yaml:"heartbeats"` // per peer type overrides of the three above
+	Deadman      time.Duration        `yaml:"deadman"`    // 0 disables the timer
+	DrainTimeout time.Duration        `yaml:"drain_timeout"`
+
+	// Shared control: blend all web peers' twists per robot, empty disables
+	Blend        string        `yaml:"blend"`         // weighted or priority
+	BlendRate    float64       `yaml:"blend_rate"`    // blended twists per second
+	BlendTimeout time.Duration `yaml:"blend_timeout"` // an input counts this long after its twist
+
+	// twist_mux-style arbitration between named inputs, empty disables
+	Mux MuxInputs `yaml:"mux"`
+
+	// A supervisor's override ends this long after its last moving command
+	SupervisorCooldown time.Duration `yaml:"supervisor_cooldown"`
+
+	WebTransportAddr string `yaml:"webtransport_addr"` // UDP, empty disables
+	UDPAddr          string `yaml:"udp_addr"`          // robot peers over raw UDP, empty disables
+	TCPAddr          string `yaml:"tcp_addr"`          // robot peers over length-prefixed TCP, empty disables
+	UnixSocket       string `yaml:"unix_socket"`       // same frames for a local robot over a Unix socket, empty disables
+	GRPCAddr         string `yaml:"grpc_addr"`         // RelayService for robot peers, empty disables
+
+	// rosbridge robots at /ws/rosbridge
+	RosbridgeCmdTopic string `yaml:"rosbridge_cmd_topic"`
+	RosbridgeAckTopic string `yaml:"rosbridge_ack_topic"`
+
+	MQTT MQTTOptions `yaml:"mqtt"`
+
+	// ROS 2 robots driven through a Zenoh router
+	Zenoh ZenohOptions `yaml:"zenoh"`
+
+	// A robot driven by the relay's own ROS 2 node (-tags ros2 builds)
+	ROS2 ROS2Options `yaml:"ros2"`
+
+	// Federation: serve this relay's robots to an upstream relay
+	Upstream      string `yaml:"upstream"` // ws(s)://host/ws/data, empty disables
+	UpstreamToken string `yaml:"upstream_token"`
+
+	SyncBeaconInterval time.Duration `yaml:"sync_beacon_interval"` // 0 disables
+	LossReports        bool          `yaml:"loss_reports"`
+	Dedup              bool          `yaml:"dedup"` // drop repeated twist and Joy message IDs
+
+	// Drop twists older than this when forwarded, 0 disables
+	MaxCommandAge time.Duration `yaml:"max_command_age"`
+	StaleNotify   bool          `yaml:"stale_notify"`
+	AckTimeout    time.Duration `yaml:"ack_timeout"` // 0 disables
+
+	// Round-trip p95 above which browsers are warned (0 disables), over
+	// the latest LatencySLOWindow
+	LatencySLO       time.Duration `yaml:"latency_slo"`
+	LatencySLOWindow time.Duration `yaml:"latency_slo_window"`
+
+	// Reliable commands: first retransmit delay, doubling, and how many
+	CommandRetry   time.Duration `yaml:"command_retry"`
+	CommandRetries int           `yaml:"command_retries"`
+
+	FileTimeout time.Duration `yaml:"file_timeout"` // abort file transfers idle this long
+
+	ParamTimeout time.Duration `yaml:"param_timeout"` // answer param requests unanswered this long
+
+	// Service calls: the timeout of calls asking for none, and the longest
+	// any call may ask for
+	ServiceTimeout    time.Duration `yaml:"service_timeout"`
+	ServiceMaxTimeout time.Duration `yaml:"service_max_timeout"`
+
+	Nacks bool `yaml:"nacks"` // tell browsers about discarded commands
+
+	ChatToRobot bool `yaml:"chat_to_robot"` // also show operators' chat robot-side
+
+	ProtocolErrors bool `yaml:"protocol_errors"` // tell peers about malformed frames
+
+	EventsInterval time.Duration `yaml:"events_interval"` // /events latency and drop updates
+
+	// /health/ready fails once every connected robot's last ack is older
+	ReadyAckAge time.Duration `yaml:"ready_ack_age"`
+
+	// Hold commands while a robot reconnects, 0 disables
+	ReconnectGrace time.Duration `yaml:"reconnect_grace"`
+	HoldBuffer     int           `yaml:"hold_buffer"` // held commands per robot
+
+	// Keep extra robot peers as standbys and fail over to them, 0 disables
+	FailoverTimeout time.Duration `yaml:"failover_timeout"`
+
+	// Close web and observer peers that send no message this long, 0 disables
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// Let web and observer peers resume their session this long after a disconnect, 0 disables
+	ResumeGrace time.Duration `yaml:"resume_grace"`
+
+	// Close peers that stay behind on their frames this long, 0 disables
+	SlowConsumerTimeout time.Duration `yaml:"slow_consumer_timeout"`
+	SlowQueueFill       float64       `yaml:"slow_queue_fill"`    // fraction of the send queue that counts as behind
+	SlowWriteLatency    time.Duration `yaml:"slow_write_latency"` // mean frame write time that counts as behind
+
+	// In-process robot peer that acks every twist, for frontend work
+	MockRobot   bool          `yaml:"mock_robot"`
+	MockRobotID string        `yaml:"mock_robot_id"`
+	MockDelay   time.Duration `yaml:"mock_delay"` // simulated processing time per twist
+
+	// Deliberate delay, jitter and loss per direction, for experiments
+	Impairment ImpairmentConfig `yaml:"impairment"`
+
+	// Connection limits, 0 disables
+	MaxConnsPerIP int `yaml:"max_conns_per_ip"`
+	MaxWebPeers   int `yaml:"max_web_peers"`
+
+	// Protocol limits
+	RobotIDMaxLen int `yaml:"robot_id_max_len"`
+
+	// Twist velocity limits, per robot overriding the default
+	Limits      VelocityLimit            `yaml:"max_velocity"`
+	RobotLimits map[string]VelocityLimit `yaml:"robot_limits"`
+
+	// Twist scale factors an admin can assign web peers by name
+	SpeedProfiles SpeedProfiles `yaml:"speed_profiles"`
+
+	RecordDir     string `yaml:"record_dir"`     // empty disables recording
+	MCAPDir       string `yaml:"mcap_dir"`       // empty disables MCAP recording
+	LatencyWindow int    `yaml:"latency_window"` // acks kept for /latency
+
+	// SO_TIMESTAMPING on accepted connections (Linux)
+	KernelTimestamps bool `yaml:"kernel_timestamps"`
+
+	// SQLite command audit log, empty disables
+	AuditDB        string        `yaml:"audit_db"`
+	AuditRetention time.Duration `yaml:"audit_retention"` // rows older than this are deleted, 0 keeps them
+	AuditMaxRows   int           `yaml:"audit_max_rows"`  // newest rows kept per table, 0 keeps all
+
+	AllowedOrigins string `yaml:"allowed_origins"` // comma-separated, empty allows any
+
+	// Close /ws/data clients that offer no known subprotocol
+	RequireSubprotocol bool `yaml:"require_subprotocol"`
+
+	JWTSecret string     `yaml:"jwt_secret"`
+	TLS       TLSOptions `yaml:"tls"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:             ":8080",
+		StaticDir:          "../web-client",
+		StaticMaxAge:       time.Hour,
+		LogLevel:           "info",
+		LogFormat:          "text",
+		MaxFrameSize:       128 << 10,
+		RequireSubprotocol: true,
+		Dedup:              true,
+		SendBuffer:         256,
+		SendOverflow:       OverflowDropNewest,
+		SendBlockTimeout:   50 * time.Millisecond,
+		SlowQueueFill:      0.9,
+		SlowWriteLatency:   100 * time.Millisecond,
+		MediaBuffer:        64,
+		HoldBuffer:         32,
+		EventsInterval:     5 * time.Second,
+		ReadyAckAge:        10 * time.Second,
+		MockRobotID:        protocol.DefaultRobotID,
+		MockDelay:          5 * time.Millisecond,
+		Impairment:         noImpairment(),
+		ReadBufferSize:     1024,
+		WriteBufferSize:    1024,
+		CompressionLevel:   1,
+		CompressionMinSize: 256,
+		CompressionExempt:  "twist,ack,joy,estop,clock_sync_request,clock_sync_response,nack,control_state",
+		PingInterval:       30 * time.Second,
+		ReadTimeout:        60 * time.Second,
+		WriteTimeout:       10 * time.Second,
+		Deadman:            500 * time.Millisecond,
+		BlendRate:          20,
+		BlendTimeout:       250 * time.Millisecond,
+		SupervisorCooldown: time.Second,
+		CommandRetry:       200 * time.Millisecond,
+		CommandRetries:     5,
+		FileTimeout:        30 * time.Second,
+		ParamTimeout:       2 * time.Second,
+		LatencySLOWindow:   30 * time.Second,
+		ServiceTimeout:     5 * time.Second,
+		ServiceMaxTimeout:  time.Minute,
+		DrainTimeout:       5 * time.Second,
+		RobotIDMaxLen:      64,
+		LatencyWindow:      1000,
+		AuditRetention:     30 * 24 * time.Hour,
+		SpeedProfiles:      SpeedProfiles{"novice": 0.3, "expert": 1},
+		RosbridgeCmdTopic:  "/cmd_vel",
+		RosbridgeAckTopic:  "/cmd_vel_ack",
+		MQTT: MQTTOptions{
+			ClientID:    "teleop-relay",
+			TopicPrefix: "teleop",
+		},
+		Zenoh: ZenohOptions{
+			KeyPrefix: "teleop",
+		},
+		ROS2: ROS2Options{
+			Node:     "teleop_relay",
+			CmdTopic: "/cmd_vel",
+			AckTopic: "/cmd_vel_ack",
+		},
+		TLS: TLSOptions{
+			AutocertCache: "certs",
+			ACMEHTTPAddr:  ":80",
+		},
+	}
+}
+
+// config is the active configuration, set once by main before serving
+var config = defaultConfig()
+
+// bindFlags registers a flag for every field, defaulting to its current value
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "listen address")
+	fs.StringVar(&c.StaticDir, "static-dir", c.StaticDir, "directory served at /")
+	fs.DurationVar(&c.StaticMaxAge, "static-max-age", c.StaticMaxAge, "how long browsers may cache web client assets other than HTML without revalidating (0 always revalidates)")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum log level: debug (every twist and ack), info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log output: text or json")
+	fs.StringVar(&c.DebugAddr, "debug-addr", c.DebugAddr, "separate listener for pprof and /debug/runtime, e.g. localhost:6060 (empty disables)")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", c.OTLPEndpoint, "export OpenTelemetry spans to this OTLP/HTTP URL, e.g. http://localhost:4318 (empty disables)")
+	fs.IntVar(&c.MaxFrameSize, "max-frame-size", c.MaxFrameSize, "largest inbound frame in bytes; peers sending more are closed with 1009 (read_limits in the config file lowers it per peer type)")
+	fs.IntVar(&c.SendBuffer, "send-buffer", c.SendBuffer, "queued outbound messages per peer (send_queues in the config file sets it per peer type)")
+	fs.StringVar(&c.SendOverflow, "send-overflow", c.SendOverflow, "when a peer's queue is full: drop-newest, drop-oldest or disconnect (block only per robot queue, see send_queues)")
+	fs.DurationVar(&c.SendBlockTimeout, "send-block-timeout", c.SendBlockTimeout, "longest a sender waits for room in a robot queue set to block in send_queues")
+	fs.IntVar(&c.MediaBuffer, "media-buffer", c.MediaBuffer, "queued media chunks per peer and channel; the oldest frame is dropped beyond it")
+	fs.IntVar(&c.ReadBufferSize, "read-buffer-size", c.ReadBufferSize, "WebSocket read buffer bytes")
+	fs.IntVar(&c.WriteBufferSize, "write-buffer-size", c.WriteBufferSize, "WebSocket write buffer bytes")
+	fs.BoolVar(&c.Compression, "compression", c.Compression, "negotiate permessage-deflate with WebSocket peers that offer it")
+	fs.IntVar(&c.CompressionLevel, "compression-level", c.CompressionLevel, "deflate level, 1 (fastest) to 9 (smallest)")
+	fs.IntVar(&c.CompressionMinSize, "compression-min-size", c.CompressionMinSize, "frames smaller than this many bytes are sent uncompressed")
+	fs.StringVar(&c.CompressionExempt, "compression-exempt", c.CompressionExempt, "comma-separated message types never compressed, to keep them free of deflate jitter")
+	fs.DurationVar(&c.PingInterval, "ping-interval", c.PingInterval, "interval between WebSocket pings")
+	fs.DurationVar(&c.PongTimeout, "pong-timeout", c.PongTimeout, "close WebSocket peers that leave a ping unanswered this long, failing robots over (0 disables)")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "close peers silent for this long (no message or pong)")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "deadline for a single WebSocket write")
+	fs.DurationVar(&c.Deadman, "deadman", c.Deadman, "stop a robot after this long without driver commands (0 disables the timer; robots still stop when their driver disconnects)")
+	fs.Var(&c.Mux, "mux", "arbitrate web peers by ?mux_input= like twist_mux: name:priority:timeout,... (first is the default input)")
+	fs.StringVar(&c.Blend, "blend", c.Blend, "blend twists from every web peer per robot: weighted or priority (empty disables)")
+	fs.Float64Var(&c.BlendRate, "blend-rate", c.BlendRate, "blended twists sent to each robot per second")
+	fs.DurationVar(&c.BlendTimeout, "blend-timeout", c.BlendTimeout, "how long a peer's last twist counts as its blend input")
+	fs.DurationVar(&c.SupervisorCooldown, "supervisor-cooldown", c.SupervisorCooldown, "hand a robot back to its driver this long after the supervisor's last moving command")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", c.DrainTimeout, "on SIGINT/SIGTERM, wait this long for peers to close")
+	fs.StringVar(&c.WebTransportAddr, "webtransport-addr", c.WebTransportAddr, "UDP address for WebTransport peers at /wt/data (requires TLS)")
+	fs.StringVar(&c.UDPAddr, "udp-addr", c.UDPAddr, "UDP address for robot (python) peers speaking raw binary frames")
+	fs.StringVar(&c.TCPAddr, "tcp-addr", c.TCPAddr, "TCP address for robot (python) peers speaking length-prefixed binary frames")
+	fs.StringVar(&c.UnixSocket, "unix-socket", c.UnixSocket, "Unix socket path for a robot (python) peer on this machine, framed as -tcp-addr")
+	fs.StringVar(&c.GRPCAddr, "grpc-addr", c.GRPCAddr, "TCP address for robot (python) peers using the gRPC RelayService")
+	fs.StringVar(&c.RosbridgeCmdTopic, "rosbridge-cmd-topic", c.RosbridgeCmdTopic, "topic /ws/rosbridge robots receive twists on")
+	fs.StringVar(&c.RosbridgeAckTopic, "rosbridge-ack-topic", c.RosbridgeAckTopic, "topic /ws/rosbridge robots publish acks on")
+	fs.StringVar(&c.MQTT.Broker, "mqtt-broker", c.MQTT.Broker, "MQTT broker URL (tcp://host:1883) bridging robots on <prefix>/<robot>/cmd and /ack")
+	fs.StringVar(&c.MQTT.ClientID, "mqtt-client-id", c.MQTT.ClientID, "MQTT client ID of the relay")
+	fs.StringVar(&c.MQTT.Username, "mqtt-username", c.MQTT.Username, "MQTT username")
+	fs.StringVar(&c.MQTT.Password, "mqtt-password", c.MQTT.Password, "MQTT password")
+	fs.StringVar(&c.MQTT.TopicPrefix, "mqtt-topic-prefix", c.MQTT.TopicPrefix, "first level of the MQTT robot topics")
+	fs.StringVar(&c.Zenoh.Router, "zenoh-router", c.Zenoh.Router, "REST URL of a zenohd router (http://host:8000) driving robots on <prefix>/<robot>/cmd_vel")
+	fs.StringVar(&c.Zenoh.KeyPrefix, "zenoh-key-prefix", c.Zenoh.KeyPrefix, "first chunk of the Zenoh robot keys")
+	fs.StringVar(&c.Zenoh.Robots, "zenoh-robots", c.Zenoh.Robots, "comma-separated robots to drive over Zenoh from startup")
+	fs.StringVar(&c.ROS2.Robot, "ros2-robot", c.ROS2.Robot, "robot ID to drive from the relay's own ROS 2 node (needs a -tags ros2 build)")
+	fs.StringVar(&c.ROS2.Node, "ros2-node", c.ROS2.Node, "name of the relay's ROS 2 node")
+	fs.StringVar(&c.ROS2.CmdTopic, "ros2-cmd-topic", c.ROS2.CmdTopic, "topic the relay's ROS 2 node publishes geometry_msgs/Twist on")
+	fs.StringVar(&c.ROS2.AckTopic, "ros2-ack-topic", c.ROS2.AckTopic, "std_msgs/UInt64 topic the relay's ROS 2 node reads acks from")
+	fs.StringVar(&c.Upstream, "upstream", c.Upstream, "upstream relay /ws/data URL to serve this relay's robots to as a \"relay\" peer")
+	fs.StringVar(&c.UpstreamToken, "upstream-token", c.UpstreamToken, "token with the \"relay\" scope for -upstream")
+	fs.DurationVar(&c.SyncBeaconInterval, "sync-beacon-interval", c.SyncBeaconInterval, "push clock sync beacons to every peer this often (0 disables)")
+	fs.BoolVar(&c.Dedup, "dedup", c.Dedup, "drop twists and Joy frames repeating one of the sender's last 64 message IDs")
+	fs.BoolVar(&c.LossReports, "loss-reports", c.LossReports, "send browsers a Loss Report for every gap in their twist message IDs")
+	fs.DurationVar(&c.MaxCommandAge, "max-command-age", c.MaxCommandAge, "drop twists and Joy frames this long after the browser sent them instead of delivering them late (0 disables)")
+	fs.BoolVar(&c.StaleNotify, "stale-notify", c.StaleNotify, "send browsers a Stale Command frame for each command dropped by -max-command-age")
+	fs.DurationVar(&c.CommandRetry, "command-retry", c.CommandRetry, "resend an unacked reliable command after this long, doubling each time")
+	fs.IntVar(&c.CommandRetries, "command-retries", c.CommandRetries, "resends of a reliable command before its sender gets an undelivered Nack")
+	fs.DurationVar(&c.FileTimeout, "file-timeout", c.FileTimeout, "abort a file transfer after this long without a chunk or ack")
+	fs.DurationVar(&c.ServiceTimeout, "service-timeout", c.ServiceTimeout, "answer a service call that set no timeout with a timeout status if the robot has not after this long")
+	fs.DurationVar(&c.ServiceMaxTimeout, "service-max-timeout", c.ServiceMaxTimeout, "longest timeout a service call may set; longer ones are cut to it")
+	fs.DurationVar(&c.ParamTimeout, "param-timeout", c.ParamTimeout, "answer a parameter request with a timeout status if the robot has not after this long")
+	fs.DurationVar(&c.LatencySLO, "latency-slo", c.LatencySLO, "warn browsers when their robot's round-trip p95 exceeds this (0 disables)")
+	fs.DurationVar(&c.LatencySLOWindow, "latency-slo-window", c.LatencySLOWindow, "sliding window of round trips the -latency-slo p95 covers")
+	fs.DurationVar(&c.AckTimeout, "ack-timeout", c.AckTimeout, "send browsers an Ack Timeout frame for each forwarded twist not acked this long after (0 disables)")
+	fs.DurationVar(&c.ReconnectGrace, "reconnect-grace", c.ReconnectGrace, "hold twists and Joy frames this long for a robot whose robot peer dropped and forward them if it reconnects (0 disables)")
+	fs.IntVar(&c.HoldBuffer, "hold-buffer", c.HoldBuffer, "commands held per robot during -reconnect-grace; the oldest is dropped beyond it")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "close web and observer peers that send no message (pongs aside) this long (0 disables)")
+	fs.DurationVar(&c.ResumeGrace, "resume-grace", c.ResumeGrace, "let web and observer peers that reconnect this long after a disconnect resume their peer ID and driver status (0 disables)")
+	fs.DurationVar(&c.SlowConsumerTimeout, "slow-consumer-timeout", c.SlowConsumerTimeout, "close peers that stay behind on their frames this long with 4408 (0 disables)")
+	fs.Float64Var(&c.SlowQueueFill, "slow-queue-fill", c.SlowQueueFill, "send queue fill, as a fraction of its size, at which a peer counts as behind")
+	fs.DurationVar(&c.SlowWriteLatency, "slow-write-latency", c.SlowWriteLatency, "mean frame write time at which a peer counts as behind")
+	fs.DurationVar(&c.FailoverTimeout, "failover-timeout", c.FailoverTimeout, "keep further robot peers for a robot as standbys and fail over when the primary is silent this long or disconnects (0 disables)")
+	fs.DurationVar(&c.EventsInterval, "events-interval", c.EventsInterval, "how often /events pushes the latency summary and changed drop counters")
+	fs.DurationVar(&c.ReadyAckAge, "ready-ack-age", c.ReadyAckAge, "/health/ready succeeds only while a connected robot acked within this long")
+	fs.BoolVar(&c.MockRobot, "mock-robot", c.MockRobot, "serve -mock-robot-id with a built-in robot peer that acks every twist, no ROS needed")
+	fs.StringVar(&c.MockRobotID, "mock-robot-id", c.MockRobotID, "robot ID the -mock-robot serves")
+	fs.DurationVar(&c.MockDelay, "mock-delay", c.MockDelay, "simulated processing time before the -mock-robot acks a twist")
+	fs.Var(&c.Impairment.Uplink, "impair-uplink", "impair frames from browsers: delay=100ms,jitter=20ms,distribution=uniform|normal,loss=0.05 (changeable at /admin/impairment)")
+	fs.Var(&c.Impairment.Downlink, "impair-downlink", "impair frames from robots, like -impair-uplink")
+	fs.BoolVar(&c.Nacks, "nacks", c.Nacks, "send browsers a Nack with a reason code for each twist or Joy frame the relay discards")
+	fs.BoolVar(&c.ChatToRobot, "chat-to-robot", c.ChatToRobot, "also forward operators' chat messages to the robot, e.g. for an on-robot display")
+	fs.BoolVar(&c.ProtocolErrors, "protocol-errors", c.ProtocolErrors, "send peers a Protocol Error for each malformed or unknown frame the relay rejects")
+	fs.IntVar(&c.MaxConnsPerIP, "max-conns-per-ip", c.MaxConnsPerIP, "concurrent connections allowed from one source IP (0 disables)")
+	fs.IntVar(&c.MaxWebPeers, "max-web-peers", c.MaxWebPeers, "web and observer peers allowed at once (0 disables)")
+	fs.IntVar(&c.RobotIDMaxLen, "robot-id-max-len", c.RobotIDMaxLen, "longest accepted robot ID in bytes")
+	fs.Var(&c.SpeedProfiles, "speed-profiles", "speed profiles admins can assign web peers at /admin/peers/{id}/profile: name=scale,... (scale 0-1)")
+	fs.Float64Var(&c.Limits.Linear, "max-linear", c.Limits.Linear, "clamp each linear twist component to this many m/s (0 disables)")
+	fs.Float64Var(&c.Limits.Angular, "max-angular", c.Limits.Angular, "clamp each angular twist component to this many rad/s (0 disables)")
+	fs.Float64Var(&c.Limits.LinearAccel, "max-linear-accel", c.Limits.LinearAccel, "limit changes of each linear twist component to this many m/s² (0 disables)")
+	fs.Float64Var(&c.Limits.AngularAccel, "max-angular-accel", c.Limits.AngularAccel, "limit changes of each angular twist component to this many rad/s² (0 disables)")
+	fs.Float64Var(&c.Limits.LinearJerk, "max-linear-jerk", c.Limits.LinearJerk, "limit linear acceleration changes to this many m/s³ (0 disables)")
+	fs.Float64Var(&c.Limits.AngularJerk, "max-angular-jerk", c.Limits.AngularJerk, "limit angular acceleration changes to this many rad/s³ (0 disables)")
+	fs.StringVar(&c.RecordDir, "record-dir", c.RecordDir, "record every frame to a session file in this directory")
+	fs.StringVar(&c.MCAPDir, "mcap-dir", c.MCAPDir, "record twists, acks and telemetry as ROS 2 messages to an MCAP file in this directory")
+	fs.StringVar(&c.AuditDB, "audit-db", c.AuditDB, "log every forwarded twist and e-stop with who sent it to this SQLite database")
+	fs.DurationVar(&c.AuditRetention, "audit-retention", c.AuditRetention, "delete audit rows older than this (0 keeps them)")
+	fs.IntVar(&c.AuditMaxRows, "audit-max-rows", c.AuditMaxRows, "keep at most this many of the newest rows per audit table (0 keeps all)")
+	fs.IntVar(&c.LatencyWindow, "latency-window", c.LatencyWindow, "number of recent acks used for /latency percentiles")
+	fs.BoolVar(&c.KernelTimestamps, "kernel-timestamps", c.KernelTimestamps, "record kernel receive times of frames with SO_TIMESTAMPING (Linux)")
+	fs.BoolVar(&c.RequireSubprotocol, "require-subprotocol", c.RequireSubprotocol, "close /ws/data clients that do not offer the "+protocol.Subprotocol+" subprotocol with 4426")
+	fs.StringVar(&c.AllowedOrigins, "allowed-origins", c.AllowedOrigins, "comma-separated browser origins allowed to connect, wildcards like https://*.example.com (empty allows any)")
+	fs.StringVar(&c.JWTSecret, "jwt-secret", c.JWTSecret, "HS256 secret; enables token auth on /ws/data")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "TLS certificate file (PEM)")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "TLS private key file (PEM)")
+	fs.StringVar(&c.TLS.AutocertDomains, "autocert-domains", c.TLS.AutocertDomains, "comma-separated domains to obtain Let's Encrypt certificates for")
+	fs.StringVar(&c.TLS.AutocertCache, "autocert-cache", c.TLS.AutocertCache, "directory to cache Let's Encrypt certificates")
+	fs.StringVar(&c.TLS.AutocertEmail, "autocert-email", c.TLS.AutocertEmail, "contact email for the ACME account")
+	fs.StringVar(&c.TLS.ACMEHTTPAddr, "acme-http-addr", c.TLS.ACMEHTTPAddr, "listener for ACME http-01 challenges and HTTPS redirects")
+}
+
+func (c *Config) validate() error {
+	if _, err := newLogHandler(io.Discard, c.LogLevel, c.LogFormat); err != nil {
+		return err
+	}
+	if c.MaxFrameSize < protocol.MediaHeaderSize+MediaMaxPayload {
+		return fmt.Errorf("max_frame_size must be at least %d, a full media chunk", protocol.MediaHeaderSize+MediaMaxPayload)
+	}
+	if n := protocol.FileChunkMinSize + protocol.FileMaxName + protocol.FileMaxChunk; c.MaxFrameSize < n {
+		return fmt.Errorf("max_frame_size must be at least %d, a full file chunk", n)
+	}
+	if err := c.validReadLimits(); err != nil {
+		return err
+	}
+	if c.SendBuffer < 1 {
+		return errors.New("send_buffer must be at least 1")
+	}
+	if c.SendOverflow == "" {
+		return errors.New("send_overflow must not be empty")
+	}
+	if err := (SendQueue{Overflow: c.SendOverflow}).validate(); err != nil {
+		return fmt.Errorf("send_overflow: %w", err)
+	}
+	if c.SendOverflow == OverflowBlock {
+		return errors.New("send_overflow: block would stall robot readers; set it for python in send_queues instead")
+	}
+	if c.SendBlockTimeout <= 0 {
+		return errors.New("send_block_timeout must be positive")
+	}
+	if err := c.validSendQueues(); err != nil {
+		return err
+	}
+	if c.MediaBuffer < 1 {
+		return errors.New("media_buffer must be at least 1")
+	}
+	if c.CompressionLevel < 1 || c.CompressionLevel > 9 {
+		return errors.New("compression_level must be between 1 and 9")
+	}
+	if _, err := newCompressionPolicy(c.CompressionExempt, c.CompressionMinSize); err != nil {
+		return err
+	}
+	if c.PingInterval <= 0 || c.ReadTimeout <= c.PingInterval {
+		return errors.New("read_timeout must exceed a positive ping_interval")
+	}
+	if c.WriteTimeout <= 0 {
+		return errors.New("write_timeout must be positive")
+	}
+	if c.PongTimeout < 0 {
+		return errors.New("pong_timeout must not be negative")
+	}
+	if err := c.validHeartbeats(); err != nil {
+		return err
+	}
+	if c.CommandRetry <= 0 || c.CommandRetries < 0 {
+		return errors.New("command_retry must be positive and command_retries not negative")
+	}
+	if c.FileTimeout <= 0 {
+		return errors.New("file_timeout must be positive")
+	}
+	if c.ParamTimeout <= 0 {
+		return errors.New("param_timeout must be positive")
+	}
+	if c.ServiceTimeout <= 0 || c.ServiceMaxTimeout < c.ServiceTimeout {
+		return errors.New("service_timeout must be positive and service_max_timeout at least as long")
+	}
+	if c.LatencySLO < 0 || c.LatencySLOWindow <= 0 {
+		return errors.New("latency_slo must not be negative and latency_slo_window must be positive")
+	}
+	if c.AckTimeout < 0 {
+		return errors.New("ack_timeout must not be negative")
+	}
+	if c.MaxCommandAge < 0 {
+		return errors.New("max_command_age must not be negative")
+	}
+	if c.ReconnectGrace < 0 {
+		return errors.New("reconnect_grace must not be negative")
+	}
+	if c.FailoverTimeout < 0 {
+		return errors.New("failover_timeout must not be negative")
+	}
+	if c.IdleTimeout < 0 {
+		return errors.New("idle_timeout must not be negative")
+	}
+	if c.AuditRetention < 0 {
+		return errors.New("audit_retention must not be negative")
+	}
+	if c.AuditMaxRows < 0 {
+		return errors.New("audit_max_rows must not be negative")
+	}
+	if c.ResumeGrace < 0 {
+		return errors.New("resume_grace must not be negative")
+	}
+	if c.SlowConsumerTimeout < 0 {
+		return errors.New("slow_consumer_timeout must not be negative")
+	}
+	if c.SlowQueueFill <= 0 || c.SlowQueueFill > 1 {
+		return errors.New("slow_queue_fill must be above 0 and at most 1")
+	}
+	if c.SlowWriteLatency <= 0 {
+		return errors.New("slow_write_latency must be positive")
+	}
+	if c.EventsInterval <= 0 {
+		return errors.New("events_interval must be positive")
+	}
+	if c.StaticMaxAge < 0 {
+		return errors.New("static_max_age must not be negative")
+	}
+	if c.MockDelay < 0 {
+		return errors.New("mock_delay must not be negative")
+	}
+	if c.MockRobotID == "" || len(c.MockRobotID) > c.RobotIDMaxLen {
+		return fmt.Errorf("mock_robot_id must be 1 to %d bytes", c.RobotIDMaxLen)
+	}
+	if err := c.Impairment.validate(); err != nil {
+		return fmt.Errorf("impairment: %w", err)
+	}
+	if c.ReadyAckAge <= 0 {
+		return errors.New("ready_ack_age must be positive")
+	}
+	if c.HoldBuffer < 1 {
+		return errors.New("hold_buffer must be at least 1")
+	}
+	if c.MaxConnsPerIP < 0 || c.MaxWebPeers < 0 {
+		return errors.New("max_conns_per_ip and max_web_peers must not be negative")
+	}
+	if c.RobotIDMaxLen < 1 || c.RobotIDMaxLen > protocol.MaxRobotIDLen {
+		return fmt.Errorf("robot_id_max_len must be 1-%d", protocol.MaxRobotIDLen)
+	}
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+	for id, l := range c.RobotLimits {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("robot_limits[%s]: %w", id, err)
+		}
+	}
+	if c.WebTransportAddr != "" && c.TLS.CertFile == "" && c.TLS.AutocertDomains == "" {
+		return errors.New("webtransport_addr requires TLS")
+	}
+	if c.MQTT.Broker != "" && c.MQTT.TopicPrefix == "" {
+		return errors.New("mqtt.topic_prefix must not be empty")
+	}
+	if c.Zenoh.Router != "" && strings.Trim(c.Zenoh.KeyPrefix, "/") == "" {
+		return errors.New("zenoh.key_prefix must not be empty")
+	}
+	if len(c.ROS2.Robot) > c.RobotIDMaxLen {
+		return fmt.Errorf("ros2.robot exceeds %d bytes", c.RobotIDMaxLen)
+	}
+	if c.LatencyWindow < 1 {
+		return errors.New("latency_window must be at least 1")
+	}
+	switch c.Blend {
+	case "", BlendWeighted, BlendPriority:
+	default:
+		return fmt.Errorf("unknown blend mode %q (weighted or priority)", c.Blend)
+	}
+	if c.Blend != "" && (c.BlendRate <= 0 || c.BlendRate > 1000 || c.BlendTimeout <= 0) {
+		return errors.New("blend_rate must be in (0, 1000] and blend_timeout positive")
+	}
+	if err := c.SpeedProfiles.validate(); err != nil {
+		return err
+	}
+	if err := c.Mux.validate(); err != nil {
+		return err
+	}
+	if len(c.Mux) > 0 && c.Blend != "" {
+		return errors.New("mux and blend are mutually exclusive")
+	}
+	if c.SupervisorCooldown <= 0 {
+		return errors.New("supervisor_cooldown must be positive")
+	}
+	return c.TLS.validate()
+}
+
+// loadConfig builds the configuration from defaults, file, env and args
+func loadConfig(args []string) (*Config, error) {
+	return parseConfig(flag.NewFlagSet("serve", flag.ExitOnError), args)
+}
+
+// parseConfig is loadConfig for a subcommand with flags of its own, which
+// it defines on fs beforehand
+func parseConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := defaultConfig()
+
+	path := os.Getenv("RELAY_CONFIG")
+	if p := findConfigArg(args); p != "" {
+		path = p
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+		f.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	// Variables predating the config system
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.Listen = ":" + port
+	}
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		cfg.JWTSecret = secret
+	}
+
+	fs.String("config", path, "YAML config file (env RELAY_CONFIG)")
+	cfg.bindFlags(fs)
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := "RELAY_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(name); ok && f.Name != "config" {
+			if err := f.Value.Set(v); err != nil && envErr == nil {
+				envErr = fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+
+	fs.Parse(args)
+
+	if cfg.TLS.AutocertDomains != "" && cfg.Listen == defaultConfig().Listen {
+		cfg.Listen = ":443"
+	}
+	return cfg, cfg.validate()
+}
+
+// findConfigArg pre-scans args for -config so the file can be loaded
+// before the remaining flags are parsed on top of it
+func findConfigArg(args []string) string {
+	for i, a := range args {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if !strings.HasPrefix(a, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,657 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+
+	"go_relay/protocol"
+)
+
+// conformanceTimeout bounds each step of check-client
+const conformanceTimeout = 3 * time.Second
+
+// conformancePeerID is the peer ID check-client gives the client under
+// test in its welcome and Session
+const conformancePeerID = "check-client"
+
+// Outcomes of a check-client case
+const (
+	conformancePass = "PASS"
+	conformanceFail = "FAIL"
+	conformanceSkip = "SKIP"
+)
+
+// conformanceResult is one line of the check-client report
+type conformanceResult struct {
+	status string
+	name   string
+	detail string
+}
+
+// conformanceClient is the client under test, seen from check-client
+// standing in for its relay
+type conformanceClient struct {
+	ws       *websocket.Conn
+	peerType string
+	robotID  string
+	codec    *Codec   // legacyCodec until the client's Hello
+	pending  [][]byte // frames read ahead: a pushed-back first frame, the rest of a Batch
+
+	relaySeq uint64          // last relay sequence number sent
+	acked    map[uint64]bool // message IDs of the acks a robot sent
+	syncs    int             // Clock Sync Requests answered
+	twists   int             // twists and Joy frames a browser sent
+	lastID   uint64          // their last message ID
+	unasked  []string        // problems with frames the client sent unprompted
+	results  []conformanceResult
+}
+
+// runCheckClient implements `check-client [flags]`: it stands in for a
+// relay, waits for one browser or robot client to connect to /ws/data on
+// -listen, exercises every message type that peer type handles, including
+// malformed frames, and prints a conformance report. It fails if any case
+// fails.
+func runCheckClient(args []string) error {
+	fs := flag.NewFlagSet("check-client", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:8090", "address to accept the client under test on; point it at ws://<listen>/ws/data")
+	wait := fs.Duration("wait", 2*time.Minute, "give up if no client connects within this")
+	fs.Parse(args)
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	clients := make(chan *conformanceClient, 1)
+	var taken atomic.Bool
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws/data" {
+			http.NotFound(w, r)
+			return
+		}
+		if !taken.CompareAndSwap(false, true) {
+			http.Error(w, "check-client tests one client at a time", http.StatusServiceUnavailable)
+			return
+		}
+		peerType, robotID, err := parsePeerQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		u := upgrader
+		u.Subprotocols = subprotocols
+		ws, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		if r.URL.Query().Get("welcome") != "binary" {
+			ws.WriteJSON(map[string]interface{}{
+				"type":     "welcome",
+				"peer_id":  conformancePeerID,
+				"robot_id": bareRobotID(robotID),
+			})
+		}
+		clients <- &conformanceClient{ws: ws, peerType: peerType, robotID: robotID, codec: legacyCodec, acked: make(map[uint64]bool)}
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	fmt.Printf("waiting for a client at ws://%s/ws/data\n", ln.Addr())
+	var c *conformanceClient
+	select {
+	case c = <-clients:
+	case <-time.After(*wait):
+		return fmt.Errorf("no client connected within %s", *wait)
+	}
+	defer c.ws.Close()
+	fmt.Printf("%s client connected from %s, robot %q\n\n", c.peerType, c.ws.RemoteAddr(), bareRobotID(c.robotID))
+
+	c.run()
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "check finished"),
+		time.Now().Add(time.Second))
+
+	failed := 0
+	for _, r := range c.results {
+		fmt.Printf("%s  %-18s %s\n", r.status, r.name, r.detail)
+		if r.status == conformanceFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d cases failed", failed, len(c.results))
+	}
+	fmt.Printf("\nall %d cases passed or were skipped\n", len(c.results))
+	return nil
+}
+
+// run exercises the client. A case that loses the connection fails it
+// and every later case.
+func (c *conformanceClient) run() {
+	c.check("subprotocol", c.checkSubprotocol)
+	c.check("hello", c.checkHello)
+	c.check("session", c.checkSession)
+	c.check("sync_beacon", func() (string, string) {
+		if err := c.alive(); err != nil {
+			return conformanceFail, err.Error()
+		}
+		return conformancePass, "Beacon Reply echoes t1, t2 <= t3"
+	})
+	if c.peerType == "python" {
+		c.robotCases()
+	} else {
+		c.webCases()
+	}
+	c.malformedCases()
+	c.check("batch", c.checkBatch)
+	c.check("clock_sync", func() (string, string) {
+		if c.syncs == 0 {
+			return conformanceSkip, "the client sent no Clock Sync Request"
+		}
+		return conformancePass, fmt.Sprintf("%d requests answered", c.syncs)
+	})
+	if c.peerType != "python" {
+		c.check("twists", func() (string, string) {
+			if c.twists == 0 {
+				return conformanceSkip, "the client sent no twist or Joy frame; drive while the check runs to include them"
+			}
+			return conformancePass, fmt.Sprintf("%d twists and Joy frames, IDs in sequence", c.twists)
+		})
+	}
+	c.check("unprompted_frames", func() (string, string) {
+		if len(c.unasked) > 0 {
+			return conformanceFail, fmt.Sprintf("%d problems, first: %s", len(c.unasked), c.unasked[0])
+		}
+		return conformancePass, "every frame the client sent on its own was well-formed"
+	})
+}
+
+// check runs one case and records its outcome
+func (c *conformanceClient) check(name string, run func() (status, detail string)) {
+	status, detail := run()
+	c.results = append(c.results, conformanceResult{status, name, detail})
+}
+
+// exercise sends frame and passes if the client still answers a Sync
+// Beacon afterwards
+func (c *conformanceClient) exercise(name string, frame []byte) {
+	c.check(name, func() (string, string) {
+		if err := c.send(frame); err != nil {
+			return conformanceFail, err.Error()
+		}
+		if err := c.alive(); err != nil {
+			return conformanceFail, "no Beacon Reply afterwards: " + err.Error()
+		}
+		return conformancePass, fmt.Sprintf("%d-byte frame handled", len(frame))
+	})
+}
+
+func (c *conformanceClient) checkSubprotocol() (string, string) {
+	if c.ws.Subprotocol() != protocol.Subprotocol {
+		return conformanceFail, fmt.Sprintf("not offered; relays require %s by default", protocol.Subprotocol)
+	}
+	return conformancePass, protocol.Subprotocol
+}
+
+// checkHello negotiates as the relay would if the client's first frame
+// is a Hello
+func (c *conformanceClient) checkHello() (string, string) {
+	c.ws.SetReadDeadline(time.Now().Add(conformanceTimeout))
+	frame, err := c.next()
+	if err != nil {
+		return conformanceFail, "no frame: " + err.Error()
+	}
+	if frame[0] != protocol.MsgTypeHello {
+		c.pending = append(c.pending, frame)
+		return conformanceSkip, "the first frame is no Hello; the client gets the legacy formats"
+	}
+	if len(frame) < protocol.HelloSize {
+		return conformanceFail, fmt.Sprintf("%d-byte Hello, want %d", len(frame), protocol.HelloSize)
+	}
+	if frame[1] == 0 {
+		return conformanceFail, "Hello with version 0"
+	}
+	offered := binary.LittleEndian.Uint32(frame[2:6])
+	codec := negotiate(frame[1], offered)
+
+	welcome := make([]byte, protocol.HelloSize)
+	welcome[0] = protocol.MsgTypeWelcome
+	welcome[1] = codec.Version
+	binary.LittleEndian.PutUint32(welcome[2:], codec.Features)
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, welcome); err != nil {
+		return conformanceFail, err.Error()
+	}
+	c.codec = codec
+	detail := fmt.Sprintf("version %d, offered %#x, negotiated %#x", frame[1], offered, codec.Features)
+	if unknown := offered &^ supportedFeatures; unknown != 0 {
+		detail += fmt.Sprintf(" (unknown bits %#x ignored)", unknown)
+	}
+	return conformancePass, detail
+}
+
+func (c *conformanceClient) checkSession() (string, string) {
+	if !c.codec.has(FeatureSession) {
+		return conformanceSkip, "not negotiated"
+	}
+	robotID := bareRobotID(c.robotID)
+	relayTime := currentTimeMs()
+	frame := make([]byte, 10, protocol.SessionMinSize+len(conformancePeerID)+len(robotID))
+	frame[0] = protocol.MsgTypeSession
+	frame[1] = c.codec.Version
+	binary.LittleEndian.PutUint64(frame[2:10], relayTime)
+	frame = append(frame, byte(len(conformancePeerID)))
+	frame = append(frame, conformancePeerID...)
+	frame = append(frame, byte(len(robotID)))
+	frame = append(frame, robotID...)
+	frame = append(frame, 0) // no resumption token
+	if err := c.send(frame); err != nil {
+		return conformanceFail, err.Error()
+	}
+	ack, err := c.expect(protocol.MsgTypeSessionAck, nil)
+	if err != nil {
+		return conformanceFail, "no Session Ack: " + err.Error()
+	}
+	if len(ack) < protocol.SessionAckSize {
+		return conformanceFail, fmt.Sprintf("%d-byte Session Ack, want %d", len(ack), protocol.SessionAckSize)
+	}
+	if got := binary.LittleEndian.Uint64(ack[1:9]); got != relayTime {
+		return conformanceFail, fmt.Sprintf("Session Ack echoes relay time %d, sent %d", got, relayTime)
+	}
+	return conformancePass, "Session Ack echoes the relay time"
+}
+
+// robotCases exercise what a relay sends a robot
+func (c *conformanceClient) robotCases() {
+	c.check("twist", func() (string, string) { return c.checkTwistAck(1, c.relayTwist(1, 0.5)) })
+	c.check("deadman_stop", func() (string, string) { return c.checkTwistAck(DeadmanMsgID, c.relayTwist(DeadmanMsgID, 0)) })
+	c.check("joy", func() (string, string) {
+		joy := make([]byte, protocol.JoyHeaderSize+8+16)
+		joy[0] = protocol.MsgTypeJoy
+		binary.LittleEndian.PutUint64(joy[1:9], 2)
+		binary.LittleEndian.PutUint64(joy[9:17], currentTimeMs())
+		binary.LittleEndian.PutUint32(joy[17:21], 1)
+		joy[21] = 2
+		binary.LittleEndian.PutUint32(joy[22:26], math.Float32bits(0.5))
+		binary.LittleEndian.PutUint32(joy[26:30], math.Float32bits(-0.5))
+		binary.LittleEndian.PutUint64(joy[30:38], currentTimeMs())
+		binary.LittleEndian.PutUint64(joy[38:46], currentTimeMs())
+		return c.checkTwistAck(2, c.codec.appendJoy(nil, joy, c.robotID))
+	})
+	c.check("command", func() (string, string) {
+		frame := []byte{protocol.MsgTypeCommand, 3, 0, 0, 0, 0, 0, 0, 0, 1}
+		frame = append(frame, "check-client"...)
+		if err := c.send(frame); err != nil {
+			return conformanceFail, err.Error()
+		}
+		ack, err := c.expect(protocol.MsgTypeCommandAck, func(f []byte) bool {
+			return len(f) >= 9 && binary.LittleEndian.Uint64(f[1:9]) == 3
+		})
+		if err != nil {
+			return conformanceFail, "no Command Ack: " + err.Error()
+		}
+		if len(ack) < protocol.CommandAckSize {
+			return conformanceFail, fmt.Sprintf("%d-byte Command Ack, want %d", len(ack), protocol.CommandAckSize)
+		}
+		return conformancePass, fmt.Sprintf("acked with status %d", ack[9])
+	})
+	c.exercise("estop_engage", encodeEStop(EStopEngage))
+	c.exercise("estop_release", encodeEStop(EStopRelease))
+	c.exercise("protocol_error", []byte{protocol.MsgTypeProtocolError, ProtoErrTooShort, protocol.MsgTypeTwist, 65, 0, 10, 0})
+}
+
+// relayTwist builds a twist as the relay forwards it to this client
+func (c *conformanceClient) relayTwist(msgID uint64, linearX float64) []byte {
+	now := currentTimeMs()
+	twist := protocol.Twist{MsgID: msgID, T1BrowserSend: now, Linear: [3]float64{linearX}, Relayed: true, T2RelayRx: now, T3RelayTx: now}
+	frame := c.codec.appendTwist(nil, twist.Marshal(), c.robotID)
+	if c.codec.has(FeatureRelaySeq) {
+		c.relaySeq++
+		frame = appendRelaySeq(frame, c.relaySeq)
+	}
+	if c.codec.has(FeatureTraceContext) {
+		frame = appendTraceBlock(frame, trace.SpanContext{})
+	}
+	return frame
+}
+
+// checkTwistAck sends a twist or Joy frame and checks the ack that answers it
+func (c *conformanceClient) checkTwistAck(msgID uint64, frame []byte) (string, string) {
+	if err := c.send(frame); err != nil {
+		return conformanceFail, err.Error()
+	}
+	data, err := c.expect(protocol.MsgTypeTwistAck, func(f []byte) bool {
+		return len(f) >= 9 && binary.LittleEndian.Uint64(f[1:9]) == msgID
+	})
+	if err != nil {
+		return conformanceFail, "no ack: " + err.Error()
+	}
+	ack, err := protocol.UnmarshalAck(data, false)
+	if err != nil {
+		return conformanceFail, err.Error()
+	}
+	sent := binary.LittleEndian.Uint64(frame[9:17])
+	switch {
+	case ack.T1BrowserSend != sent:
+		return conformanceFail, fmt.Sprintf("t1 %d not echoed (sent %d)", ack.T1BrowserSend, sent)
+	case frame[0] == protocol.MsgTypeTwist && c.codec.has(FeatureRelayTimestamps) && (ack.T2RelayRx != sent || ack.T3RelayTx != sent):
+		return conformanceFail, "relay timestamps t2/t3 not echoed"
+	case ack.T3PythonRx == 0 || ack.T4PythonAck < ack.T3PythonRx:
+		return conformanceFail, fmt.Sprintf("robot times out of order: rx %d, ack %d", ack.T3PythonRx, ack.T4PythonAck)
+	}
+	return conformancePass, fmt.Sprintf("%d-byte ack, processed in %dµs", len(data), ack.DecodeUs+ack.ProcessUs+ack.EncodeUs)
+}
+
+// webCases exercise what a relay sends a browser
+func (c *conformanceClient) webCases() {
+	now := currentTimeMs()
+	ack := protocol.Ack{MsgID: 1, T1BrowserSend: now, T2RelayRx: now, T3RelayTx: now, T3PythonRx: now, T4PythonAck: now,
+		T4RelayAckRx: now, ToBrowser: true, T5RelayAckTx: now}.Marshal()
+	ackFrame := c.codec.appendAck(nil, ack, c.robotID)
+	if c.codec.has(FeatureRelaySeq) {
+		ackFrame = appendRelaySeq(ackFrame, 1)
+	}
+	if c.codec.has(FeatureTraceContext) {
+		ackFrame = appendTraceBlock(ackFrame, trace.SpanContext{})
+	}
+
+	telemetry := make([]byte, protocol.TelemetrySize)
+	telemetry[0] = protocol.MsgTypeTelemetry
+	binary.LittleEndian.PutUint64(telemetry[1:9], now)
+	binary.LittleEndian.PutUint32(telemetry[9:13], math.Float32bits(87.5))
+	odometry := make([]byte, protocol.OdometryToBrowserSize)
+	odometry[0] = protocol.MsgTypeOdometry
+	binary.LittleEndian.PutUint64(odometry[1:9], now)
+	binary.LittleEndian.PutUint64(odometry[57:65], math.Float64bits(1)) // orientation w
+	media := []byte{protocol.MsgTypeMedia, 0, 0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 0xFF, 0xD8}
+
+	c.exercise("control_state", encodeControlState(conformancePeerID, conformancePeerID))
+	c.exercise("ack", ackFrame)
+	c.exercise("telemetry", c.codec.appendFrame(nil, telemetry, c.robotID))
+	c.exercise("odometry", c.codec.appendOdometry(nil, odometry, c.robotID))
+	c.exercise("media", media)
+	c.exercise("presence", encodePresence(PresencePeerJoined, true, 2, 0, "other-peer"))
+	c.exercise("loss_report", []byte{protocol.MsgTypeLossReport, 5, 0, 0, 0, 0, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0})
+	c.exercise("stale_command", []byte{protocol.MsgTypeStaleCommand, 8, 0, 0, 0, 0, 0, 0, 0, 44, 1, 0, 0})
+	c.exercise("nack", []byte{protocol.MsgTypeNack, 9, 0, 0, 0, 0, 0, 0, 0, NackNotDriver})
+	c.exercise("ack_timeout", []byte{protocol.MsgTypeAckTimeout, 10, 0, 0, 0, 0, 0, 0, 0, 232, 3, 0, 0})
+	c.exercise("command_ack", []byte{protocol.MsgTypeCommandAck, 11, 0, 0, 0, 0, 0, 0, 0, 0})
+	c.exercise("failover", encodeFailover(FailoverDisconnected, "standby-peer"))
+	c.exercise("estop_engage", encodeEStop(EStopEngage))
+	c.exercise("estop_release", encodeEStop(EStopRelease))
+	c.exercise("protocol_error", []byte{protocol.MsgTypeProtocolError, ProtoErrTooShort, protocol.MsgTypeTwist, 65, 0, 10, 0})
+	c.exercise("control_released", encodeControlState(conformancePeerID, ""))
+}
+
+// malformedCases send frames a relay never should; the client must drop
+// them and carry on
+func (c *conformanceClient) malformedCases() {
+	c.check("empty_frame", func() (string, string) {
+		if err := c.ws.WriteMessage(websocket.BinaryMessage, nil); err != nil {
+			return conformanceFail, err.Error()
+		}
+		if err := c.alive(); err != nil {
+			return conformanceFail, "no Beacon Reply afterwards: " + err.Error()
+		}
+		return conformancePass, "ignored"
+	})
+	c.exercise("unknown_type", []byte{0xFF, 1, 2, 3})
+
+	robot := c.peerType == "python"
+	c.check("truncated", func() (string, string) {
+		frame := c.relayTwist(10, 0.1)[:30]
+		if !robot {
+			frame = []byte{protocol.MsgTypeTwistAck, 10, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3}
+		}
+		return c.checkDropped(10, frame, false)
+	})
+	c.check("bad_robot_trailer", func() (string, string) {
+		var frame []byte
+		if robot {
+			frame = protocol.Twist{MsgID: 11, T1BrowserSend: currentTimeMs(), Relayed: true}.Marshal()
+		} else {
+			frame = protocol.Ack{MsgID: 11, ToBrowser: true}.Marshal()
+		}
+		return c.checkDropped(11, append(frame, 200, 'x'), true)
+	})
+	if robot {
+		c.check("non_finite_twist", func() (string, string) {
+			return c.checkDropped(12, c.relayTwist(12, math.NaN()), true)
+		})
+	}
+	c.check("bad_crc", func() (string, string) {
+		if !c.codec.has(FeatureCRC32) {
+			return conformanceSkip, "CRC32 not negotiated"
+		}
+		frame := c.relayTwist(13, 0.1)
+		if !robot {
+			frame = c.codec.appendAck(nil, protocol.Ack{MsgID: 13, ToBrowser: true}.Marshal(), c.robotID)
+		}
+		frame = binary.LittleEndian.AppendUint32(frame, ^crc32.ChecksumIEEE(frame))
+		if err := c.ws.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			return conformanceFail, err.Error()
+		}
+		if err := c.alive(); err != nil {
+			return conformanceFail, "no Beacon Reply afterwards: " + err.Error()
+		}
+		if c.acked[13] {
+			return conformanceFail, "the robot acked a twist that failed its CRC"
+		}
+		return conformancePass, "dropped"
+	})
+}
+
+// checkDropped sends a malformed frame, raw but with a valid CRC, and
+// passes if the client survives it. A robot must not ack msgID unless
+// acking is allowed.
+func (c *conformanceClient) checkDropped(msgID uint64, frame []byte, mayAck bool) (string, string) {
+	if err := c.sendRaw(frame); err != nil {
+		return conformanceFail, err.Error()
+	}
+	if err := c.alive(); err != nil {
+		return conformanceFail, "no Beacon Reply afterwards: " + err.Error()
+	}
+	if c.acked[msgID] {
+		if !mayAck {
+			return conformanceFail, fmt.Sprintf("the robot acked a malformed %d-byte twist", len(frame))
+		}
+		return conformancePass, "tolerated and acked"
+	}
+	return conformancePass, "dropped"
+}
+
+// checkBatch wraps a Sync Beacon in a Batch
+func (c *conformanceClient) checkBatch() (string, string) {
+	if !c.codec.has(FeatureBatch) {
+		return conformanceSkip, "not negotiated"
+	}
+	beacon := encodeSyncBeacon()
+	if c.codec.has(FeatureCRC32) {
+		beacon = binary.LittleEndian.AppendUint32(beacon, crc32.ChecksumIEEE(beacon))
+	}
+	batch := protocol.AppendBatch(protocol.NewBatch(nil), beacon)
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, batch); err != nil {
+		return conformanceFail, err.Error()
+	}
+	t1 := binary.LittleEndian.Uint64(beacon[1:9])
+	if _, err := c.expect(protocol.MsgTypeBeaconReply, func(f []byte) bool {
+		return len(f) >= 9 && binary.LittleEndian.Uint64(f[1:9]) == t1
+	}); err != nil {
+		return conformanceFail, "no Beacon Reply to the batched beacon: " + err.Error()
+	}
+	return conformancePass, "batched Sync Beacon answered"
+}
+
+// alive sends a Sync Beacon and checks the Beacon Reply
+func (c *conformanceClient) alive() error {
+	beacon := encodeSyncBeacon()
+	t1 := binary.LittleEndian.Uint64(beacon[1:9])
+	if err := c.send(beacon); err != nil {
+		return err
+	}
+	reply, err := c.expect(protocol.MsgTypeBeaconReply, func(f []byte) bool {
+		return len(f) >= 9 && binary.LittleEndian.Uint64(f[1:9]) == t1
+	})
+	if err != nil {
+		return err
+	}
+	if len(reply) < protocol.BeaconReplySize {
+		return fmt.Errorf("%d-byte Beacon Reply, want %d", len(reply), protocol.BeaconReplySize)
+	}
+	if t2, t3 := binary.LittleEndian.Uint64(reply[9:17]), binary.LittleEndian.Uint64(reply[17:25]); t2 == 0 || t3 < t2 {
+		return fmt.Errorf("Beacon Reply times out of order: t2 %d, t3 %d", t2, t3)
+	}
+	return nil
+}
+
+// send writes a frame the relay builds, encoded as the client negotiated
+func (c *conformanceClient) send(frame []byte) error {
+	if c.codec.has(profileFeatures) {
+		encoded, err := c.codec.encodeProfile(frame)
+		if err != nil {
+			return err
+		}
+		frame = encoded
+	}
+	return c.sendRaw(frame)
+}
+
+// sendRaw writes frame in the binary layout, with a CRC if negotiated
+func (c *conformanceClient) sendRaw(frame []byte) error {
+	if c.codec.has(FeatureCRC32) {
+		frame = binary.LittleEndian.AppendUint32(frame, crc32.ChecksumIEEE(frame))
+	}
+	return c.ws.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// expect reads until a frame of type t that match accepts, or any of
+// type t if match is nil, observing the frames it passes over
+func (c *conformanceClient) expect(t byte, match func([]byte) bool) ([]byte, error) {
+	c.ws.SetReadDeadline(time.Now().Add(conformanceTimeout))
+	for {
+		frame, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		c.observe(frame)
+		if frame[0] == t && (match == nil || match(frame)) {
+			return frame, nil
+		}
+	}
+}
+
+// next returns the client's next frame in its binary layout, unwrapping
+// Batches and checking CRCs; frames that fail are noted and skipped
+func (c *conformanceClient) next() ([]byte, error) {
+	for {
+		if len(c.pending) > 0 {
+			frame := c.pending[0]
+			c.pending = c.pending[1:]
+			return frame, nil
+		}
+		kind, data, err := c.ws.ReadMessage()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return nil, fmt.Errorf("nothing within %s", conformanceTimeout)
+			}
+			return nil, err
+		}
+		if kind != websocket.BinaryMessage {
+			continue // signaling
+		}
+		if len(data) == 0 {
+			c.unasked = append(c.unasked, "empty frame")
+			continue
+		}
+		if data[0] == protocol.MsgTypeBatch && !c.codec.has(profileFeatures) {
+			frames, err := protocol.SplitBatch(data)
+			if err != nil {
+				c.unasked = append(c.unasked, "batch: "+err.Error())
+			} else if !c.codec.has(FeatureBatch) {
+				c.unasked = append(c.unasked, "batch without negotiating it")
+			}
+			for _, f := range frames {
+				if f, ok := c.decode(f); ok {
+					c.pending = append(c.pending, f)
+				}
+			}
+			continue
+		}
+		if frame, ok := c.decode(data); ok {
+			return frame, nil
+		}
+	}
+}
+
+// decode strips the CRC and transcodes a profile frame, noting failures
+func (c *conformanceClient) decode(data []byte) ([]byte, bool) {
+	if data[0] == protocol.MsgTypeHello {
+		return data, true
+	}
+	if c.codec.has(FeatureCRC32) {
+		body, ok := verifyCRC(data)
+		if !ok {
+			c.unasked = append(c.unasked, fmt.Sprintf("%d-byte frame with a bad CRC", len(data)))
+			return nil, false
+		}
+		data = body
+	}
+	if c.codec.has(profileFeatures) {
+		frame, err := c.codec.decodeProfile(data)
+		if err != nil {
+			c.unasked = append(c.unasked, err.Error())
+			return nil, false
+		}
+		data = frame
+	}
+	if err := protocol.Validate(data); err != nil {
+		c.unasked = append(c.unasked, err.Error())
+		return nil, false
+	}
+	return data, true
+}
+
+// observe handles what the client sends on its own: clock sync it is
+// answered, acks and twists are recorded and checked
+func (c *conformanceClient) observe(frame []byte) {
+	switch frame[0] {
+	case protocol.MsgTypeClockSyncRequest:
+		t2 := currentTimeMs()
+		req, err := protocol.UnmarshalClockSyncReq(frame)
+		if err != nil {
+			c.unasked = append(c.unasked, err.Error())
+			return
+		}
+		c.send(protocol.ClockSyncResp{T1: req.T1, T2: t2, T3: currentTimeMs()}.Marshal())
+		c.syncs++
+	case protocol.MsgTypeTwistAck:
+		c.acked[binary.LittleEndian.Uint64(frame[1:9])] = true
+	case protocol.MsgTypeTwist, protocol.MsgTypeJoy:
+		if frame[0] == protocol.MsgTypeTwist {
+			if _, err := protocol.UnmarshalTwist(frame, false); err != nil {
+				c.unasked = append(c.unasked, err.Error())
+				return
+			}
+		} else if joySize(frame) == 0 {
+			c.unasked = append(c.unasked, fmt.Sprintf("%d-byte Joy frame shorter than its axis count", len(frame)))
+			return
+		}
+		// Twists and Joy frames share one message ID sequence
+		id := binary.LittleEndian.Uint64(frame[1:9])
+		if c.twists > 0 && id != c.lastID+1 {
+			c.unasked = append(c.unasked, fmt.Sprintf("%s ID %d after %d", protocol.TypeName(frame[0]), id, c.lastID))
+		}
+		c.twists++
+		c.lastID = id
+	}
+}
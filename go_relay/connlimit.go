@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var (
+	errTooManyForIP   = errors.New("too many connections from this address")
+	errTooManyWebPeer = errors.New("relay is full")
+)
+
+// ConnLimiter caps concurrent upgraded connections per source IP and the
+// number of web peers (observers included). Zero disables either cap.
+type ConnLimiter struct {
+	maxPerIP int
+	maxWeb   int
+
+	mu    sync.Mutex
+	perIP map[string]int
+	web   int
+}
+
+// limiter is set by main from config
+var limiter = newConnLimiter(0, 0)
+
+func newConnLimiter(maxPerIP, maxWeb int) *ConnLimiter {
+	return &ConnLimiter{maxPerIP: maxPerIP, maxWeb: maxWeb, perIP: make(map[string]int)}
+}
+
+// acquire reserves a slot for a connection from r as peerType, before any
+// WebSocket handshake so excess upgrades get a plain 429; the caller must
+// call release once the connection is gone
+func (l *ConnLimiter) acquire(r *http.Request, peerType string) (release func(), err error) {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	web := peerType == "web" || peerType == "observer"
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		metricConnsRejected.WithLabelValues("per_ip").Inc()
+		slog.Warn("Connection refused: per-IP limit", "peer_type", peerType, "ip", ip, "open", l.perIP[ip])
+		return nil, errTooManyForIP
+	}
+	if web && l.maxWeb > 0 && l.web >= l.maxWeb {
+		metricConnsRejected.WithLabelValues("web_peers").Inc()
+		slog.Warn("Connection refused: web peer limit", "peer_type", peerType, "ip", ip, "web_peers", l.web)
+		return nil, errTooManyWebPeer
+	}
+	l.perIP[ip]++
+	if web {
+		l.web++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.perIP[ip]--; l.perIP[ip] == 0 {
+				delete(l.perIP, ip)
+			}
+			if web {
+				l.web--
+			}
+		})
+	}, nil
+}
+
+// ConnUsage is the limiter's state as shown in /status
+type ConnUsage struct {
+	MaxPerIP    int            `json:"max_per_ip"`
+	MaxWebPeers int            `json:"max_web_peers"`
+	WebPeers    int            `json:"web_peers"`
+	ByIP        map[string]int `json:"by_ip"`
+}
+
+func (l *ConnLimiter) usage() ConnUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	byIP := make(map[string]int, len(l.perIP))
+	for ip, n := range l.perIP {
+		byIP[ip] = n
+	}
+	return ConnUsage{MaxPerIP: l.maxPerIP, MaxWebPeers: l.maxWeb, WebPeers: l.web, ByIP: byIP}
+}
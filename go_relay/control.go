@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"go_relay/protocol"
+)
+
+// Control actions carried in byte 1 of a Control Request
+const (
+	ControlTake    = 0x01 // become driver if nobody drives
+	ControlRelease = 0x02 // give up driver status
+	ControlSteal   = 0x03 // become driver even if someone else drives
+)
+
+// Roles reported in byte 1 of a Control State
+const (
+	RoleObserver = 0x00
+	RoleDriver   = 0x01
+)
+
+// ControlArbiter tracks which web peer drives each robot. Only the
+// driver's twists are forwarded: a web peer twisting a robot nobody drives
+// becomes its driver, and keeps it until it releases, is stolen from,
+// addresses another robot or disconnects. Every change reaches the
+// robot's web peers as a Control State.
+type ControlArbiter struct {
+	mu      sync.Mutex
+	drivers map[string]string // robot ID -> driver peer ID
+}
+
+var arbiter = &ControlArbiter{
+	drivers: make(map[string]string),
+}
+
+// driver returns the peer ID driving robotID, or ""
+func (a *ControlArbiter) driver(robotID string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.drivers[robotID]
+}
+
+// take makes peerID the driver if the robot is free. It reports whether
+// peerID drives afterwards and whether this call claimed the robot.
+func (a *ControlArbiter) take(robotID, peerID string) (driving, claimed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cur, ok := a.drivers[robotID]
+	if !ok {
+		a.drivers[robotID] = peerID
+		slog.Info("Control taken", "peer_id", peerID, "robot_id", robotID)
+		return true, true
+	}
+	return cur == peerID, false
+}
+
+// steal makes peerID the driver unconditionally and returns the previous driver
+func (a *ControlArbiter) steal(robotID, peerID string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prev := a.drivers[robotID]
+	a.drivers[robotID] = peerID
+	if prev != peerID {
+		slog.Info("Control stolen", "peer_id", peerID, "robot_id", robotID, "previous_driver", prev)
+	}
+	return prev
+}
+
+// release drops peerID's driver status on robotID; reports whether it held it
+func (a *ControlArbiter) release(robotID, peerID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.drivers[robotID] != peerID {
+		return false
+	}
+	delete(a.drivers, robotID)
+	slog.Info("Control released", "peer_id", peerID, "robot_id", robotID)
+	return true
+}
+
+// forceRelease clears the driver of robotID regardless of who holds it
+func (a *ControlArbiter) forceRelease(robotID string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prev := a.drivers[robotID]
+	delete(a.drivers, robotID)
+	if prev != "" {
+		slog.Info("Control revoked", "peer_id", prev, "robot_id", robotID)
+	}
+	return prev
+}
+
+// releaseAll drops every robot driven by peerID and returns their IDs
+func (a *ControlArbiter) releaseAll(peerID string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var robots []string
+	for robotID, cur := range a.drivers {
+		if cur == peerID {
+			delete(a.drivers, robotID)
+			robots = append(robots, robotID)
+		}
+	}
+	return robots
+}
+
+// drivenBy returns the IDs of the robots peerID drives
+func (a *ControlArbiter) drivenBy(peerID string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var robots []string
+	for robotID, cur := range a.drivers {
+		if cur == peerID {
+			robots = append(robots, robotID)
+		}
+	}
+	return robots
+}
+
+// snapshot copies the robot -> driver map
+func (a *ControlArbiter) snapshot() map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make(map[string]string, len(a.drivers))
+	for k, v := range a.drivers {
+		out[k] = v
+	}
+	return out
+}
+
+// encodeControlState builds the Control State frame for one recipient
+func encodeControlState(recipientID, driverID string) []byte {
+	role := byte(RoleObserver)
+	if driverID != "" && driverID == recipientID {
+		role = RoleDriver
+	}
+	frame := make([]byte, 2, protocol.ControlStateMinSize+len(driverID))
+	frame[0] = protocol.MsgTypeControlState
+	frame[1] = role
+	frame = append(frame, byte(len(driverID)))
+	return append(frame, driverID...)
+}
+
+// broadcastControlState tells every web peer on robotID who drives it
+func broadcastControlState(robotID string) {
+	driverID := arbiter.driver(robotID)
+	for _, web := range manager.getWebPeers(robotID) {
+		web.send(encodeControlState(web.ID, driverID))
+	}
+}
+
+func handleControl(peer *Peer, data []byte) {
+	if peer.Type != "web" {
+		return
+	}
+	if len(data) < protocol.ControlReqSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.ControlReqSize)
+		return
+	}
+
+	robotID := manager.robotFor(peer)
+	switch data[1] {
+	case ControlTake:
+		arbiter.take(robotID, peer.ID)
+	case ControlRelease:
+		if arbiter.release(robotID, peer.ID) {
+			deadman.trip(robotID, "driver released control")
+		}
+	case ControlSteal:
+		if prev := arbiter.steal(robotID, peer.ID); prev != "" && prev != peer.ID {
+			deadman.trip(robotID, "control stolen")
+		}
+	default:
+		peer.logger().Warn("Unknown control action", "msg_type", "control", "action", data[1])
+		return
+	}
+	broadcastControlState(robotID)
+}
+
+// handleControlGet serves GET /control: the driver of each robot
+func handleControlGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"drivers": arbiter.snapshot(),
+	})
+}
+
+// handleControlPost serves POST /control {"robot","action","peer_id"} for
+// out-of-band arbitration. Releasing without a peer_id clears the driver.
+func handleControlPost(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Robot  string `json:"robot"`
+		Action string `json:"action"`
+		PeerID string `json:"peer_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.Robot == "" {
+		req.Robot = protocol.DefaultRobotID
+	}
+
+	switch req.Action {
+	case "release":
+		if req.PeerID == "" {
+			arbiter.forceRelease(req.Robot)
+		} else if !arbiter.release(req.Robot, req.PeerID) {
+			http.Error(w, "peer is not the driver", http.StatusConflict)
+			return
+		}
+		deadman.trip(req.Robot, "control released via REST")
+	case "take", "steal":
+		if !manager.isWebPeerOn(req.PeerID, req.Robot) {
+			http.Error(w, "unknown web peer for robot", http.StatusNotFound)
+			return
+		}
+		if req.Action == "steal" {
+			if prev := arbiter.steal(req.Robot, req.PeerID); prev != "" && prev != req.PeerID {
+				deadman.trip(req.Robot, "control stolen via REST")
+			}
+		} else if driving, _ := arbiter.take(req.Robot, req.PeerID); !driving {
+			http.Error(w, "robot already has a driver", http.StatusConflict)
+			return
+		}
+	default:
+		http.Error(w, "action must be take, release or steal", http.StatusBadRequest)
+		return
+	}
+
+	broadcastControlState(req.Robot)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"robot":  req.Robot,
+		"driver": arbiter.driver(req.Robot),
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestControlArbiter(t *testing.T) {
+	type op struct {
+		action byte // ControlTake, ControlRelease or ControlSteal
+		peer   string
+	}
+	tests := []struct {
+		name       string
+		ops        []op
+		wantDriver string
+	}{
+		{"first taker drives", []op{{ControlTake, "a"}, {ControlTake, "b"}}, "a"},
+		{"steal preempts", []op{{ControlTake, "a"}, {ControlSteal, "b"}}, "b"},
+		{"only the driver releases", []op{{ControlTake, "a"}, {ControlRelease, "b"}}, "a"},
+		{"released robot is free", []op{{ControlTake, "a"}, {ControlRelease, "a"}, {ControlTake, "b"}}, "b"},
+		{"nobody drives", []op{{ControlRelease, "a"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &ControlArbiter{drivers: make(map[string]string)}
+			for _, o := range tt.ops {
+				switch o.action {
+				case ControlTake:
+					a.take("r1", o.peer)
+				case ControlRelease:
+					a.release("r1", o.peer)
+				case ControlSteal:
+					a.steal("r1", o.peer)
+				}
+			}
+			if got := a.driver("r1"); got != tt.wantDriver {
+				t.Errorf("driver %q, want %q", got, tt.wantDriver)
+			}
+		})
+	}
+}
+
+func TestControlReleaseAll(t *testing.T) {
+	a := &ControlArbiter{drivers: map[string]string{"r1": "a", "r2": "a", "r3": "b"}}
+	released := a.releaseAll("a")
+	slices.Sort(released)
+	if !slices.Equal(released, []string{"r1", "r2"}) {
+		t.Errorf("released %v", released)
+	}
+	if a.driver("r3") != "b" || a.driver("r1") != "" {
+		t.Errorf("drivers left %v", a.snapshot())
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync/atomic"
+
+	"go_relay/protocol"
+)
+
+// CRCSize is the length of the CRC32 trailer on frames from and to peers
+// that negotiated FeatureCRC32
+const CRCSize = 4
+
+// crcFailures counts inbound frames dropped for a bad or missing CRC,
+// crc_failures in /status
+var crcFailures atomic.Uint64
+
+// verifyCRC checks and strips the CRC32 trailer
+func verifyCRC(frame []byte) ([]byte, bool) {
+	n := len(frame) - CRCSize
+	if n < 1 {
+		return nil, false
+	}
+	if crc32.ChecksumIEEE(frame[:n]) != binary.LittleEndian.Uint32(frame[n:]) {
+		return nil, false
+	}
+	return frame[:n], true
+}
+
+// usesCRC reports whether a frame of type t to or from peer carries a
+// CRC. Hello and Welcome never do, since they set up the negotiation,
+// and neither does a Batch, whose frames carry their own.
+func (p *Peer) usesCRC(t byte) bool {
+	return t != protocol.MsgTypeHello && t != protocol.MsgTypeWelcome && t != protocol.MsgTypeBatch && p.codec().has(FeatureCRC32)
+}
+
+// crcTrailer returns the CRC32 (IEEE, LE) to write after an outgoing
+// frame, backed by buf, or nil when the peer takes none. Frames may be
+// shared between peers, so the trailer is never appended in place.
+func (p *Peer) crcTrailer(msg []byte, buf *[CRCSize]byte) []byte {
+	if len(msg) == 0 || !p.usesCRC(msg[0]) {
+		return nil
+	}
+	return binary.LittleEndian.AppendUint32(buf[:0], crc32.ChecksumIEEE(msg))
+}
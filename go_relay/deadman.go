@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// DeadmanMsgID marks twists synthesized by the relay. Acks carrying it are
+// not forwarded to browsers since no browser sent the command.
+const DeadmanMsgID = 0
+
+// Deadman stops a robot when its driver goes quiet. Every forwarded twist
+// re-arms a per-robot timer (-deadman, 500ms by default); if it expires,
+// or the driver disconnects or loses control, the relay sends the robot a
+// zero-velocity twist with DeadmanMsgID. The
+// disconnect stop does not depend on the timer: whatever the timeout and
+// arbitration mode, a robot is stopped when the peer whose command it
+// last got, or its last command source, disconnects.
+type Deadman struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	armed   map[string]*deadmanTimer // robot ID -> pending watchdog
+	sources map[string]*robotSources // robot ID -> peers commanding it
+	stop    func(robotID string)     // sendZeroTwist, replaced in tests
+}
+
+// robotSources are the peers whose commands reached a robot since it was
+// last stopped, and the latest of them
+type robotSources struct {
+	peers  map[string]bool
+	latest string
+}
+
+type deadmanTimer struct {
+	timer *time.Timer
+	gen   uint64
+}
+
+// deadman is created by main from config.Deadman
+var deadman *Deadman
+
+func newDeadman(timeout time.Duration) *Deadman {
+	return &Deadman{
+		timeout: timeout,
+		armed:   make(map[string]*deadmanTimer),
+		sources: make(map[string]*robotSources),
+		stop:    sendZeroTwist,
+	}
+}
+
+// kick re-arms the watchdog for robotID after a forwarded command and
+// notes source, the peer that sent it ("" for the relay's own twists), as
+// commanding the robot
+func (d *Deadman) kick(robotID, source string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if source != "" {
+		s := d.sources[robotID]
+		if s == nil {
+			s = &robotSources{peers: make(map[string]bool)}
+			d.sources[robotID] = s
+		}
+		s.peers[source] = true
+		s.latest = source
+	}
+	if d.timeout <= 0 {
+		return
+	}
+
+	entry, ok := d.armed[robotID]
+	if !ok {
+		entry = &deadmanTimer{}
+		d.armed[robotID] = entry
+	} else {
+		entry.timer.Stop()
+	}
+	entry.gen++
+	gen := entry.gen
+	entry.timer = time.AfterFunc(d.timeout, func() {
+		d.expire(robotID, gen)
+	})
+}
+
+// expire fires when no command arrived within the timeout
+func (d *Deadman) expire(robotID string, gen uint64) {
+	d.mu.Lock()
+	entry, ok := d.armed[robotID]
+	if !ok || entry.gen != gen {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.armed, robotID)
+	delete(d.sources, robotID)
+	d.mu.Unlock()
+
+	slog.Warn("Deadman: no command", "robot_id", robotID, "timeout", d.timeout)
+	d.stop(robotID)
+}
+
+// trip stops robotID immediately if it has a live watchdog or a command
+// source, e.g. because its driver disconnected. Robots that were never
+// commanded are left alone.
+func (d *Deadman) trip(robotID, reason string) {
+	d.mu.Lock()
+	ok := d.disarmLocked(robotID)
+	d.mu.Unlock()
+
+	if ok {
+		slog.Info("Deadman: robot stopped", "robot_id", robotID, "reason", reason)
+		d.stop(robotID)
+	}
+}
+
+// disarmLocked forgets robotID's watchdog and sources, reporting whether
+// it had either; d.mu is held
+func (d *Deadman) disarmLocked(robotID string) bool {
+	entry, armed := d.armed[robotID]
+	if armed {
+		entry.timer.Stop()
+		delete(d.armed, robotID)
+	}
+	_, commanded := d.sources[robotID]
+	delete(d.sources, robotID)
+	return armed || commanded
+}
+
+// leave stops every robot whose latest or last remaining command source
+// was peerID, once that peer disconnected. Robots another peer commanded
+// since keep going; that peer's command is the one in effect.
+func (d *Deadman) leave(peerID string) {
+	var stopped []string
+	d.mu.Lock()
+	for robotID, s := range d.sources {
+		if !s.peers[peerID] {
+			continue
+		}
+		delete(s.peers, peerID)
+		if s.latest == peerID || len(s.peers) == 0 {
+			d.disarmLocked(robotID)
+			stopped = append(stopped, robotID)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, robotID := range stopped {
+		slog.Info("Deadman: robot stopped", "robot_id", robotID, "reason", "command source disconnected")
+		d.stop(robotID)
+	}
+}
+
+// tripAll stops every robot with a live watchdog or command source
+func (d *Deadman) tripAll(reason string) {
+	d.mu.Lock()
+	robots := make([]string, 0, len(d.armed)+len(d.sources))
+	for robotID := range d.armed {
+		robots = append(robots, robotID)
+	}
+	for robotID := range d.sources {
+		if _, ok := d.armed[robotID]; !ok {
+			robots = append(robots, robotID)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, robotID := range robots {
+		d.trip(robotID, reason)
+	}
+}
+
+// sendZeroTwist synthesizes and forwards a zero-velocity twist
+func sendZeroTwist(robotID string) {
+	t := currentTimeMs()
+	twist := make([]byte, protocol.TwistBrowserSize)
+	twist[0] = protocol.MsgTypeTwist
+	binary.LittleEndian.PutUint64(twist[1:9], DeadmanMsgID)
+	binary.LittleEndian.PutUint64(twist[9:17], t)
+	// Velocities are already zero
+	forwardTwist(robotID, "deadman", twist, t)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// recordStops replaces d's stop with one noting the robots stopped
+func recordStops(d *Deadman) *[]string {
+	var stopped []string
+	d.stop = func(robotID string) { stopped = append(stopped, robotID) }
+	return &stopped
+}
+
+func TestDeadmanLeave(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		kicks   []string // command sources, in order
+		leave   []string
+		want    []string
+	}{
+		{"driver, no timeout", 0, []string{"driver"}, []string{"driver"}, []string{"r"}},
+		{"driver with timeout", time.Hour, []string{"driver"}, []string{"driver"}, []string{"r"}},
+		{"bystander leaves", 0, []string{"driver"}, []string{"observer"}, nil},
+		{"mux, earlier input leaves", 0, []string{"teleop", "autonomy"}, []string{"teleop"}, nil},
+		{"mux, latest input leaves", 0, []string{"teleop", "autonomy"}, []string{"autonomy"}, []string{"r"}},
+		{"mux, last input leaves", 0, []string{"teleop", "autonomy"}, []string{"teleop", "autonomy"}, []string{"r"}},
+		{"relay twists only", 0, []string{""}, []string{"driver"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDeadman(tt.timeout)
+			stopped := recordStops(d)
+			for _, source := range tt.kicks {
+				d.kick("r", source)
+			}
+			for _, peerID := range tt.leave {
+				d.leave(peerID)
+			}
+			got := slices.Clone(*stopped)
+			d.tripAll("test over") // stops the timers
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("stopped %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeadmanTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		kicked  bool
+		want    int
+	}{
+		{"commanded, no timeout", 0, true, 1},
+		{"commanded with timeout", time.Hour, true, 1},
+		{"never commanded", time.Hour, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDeadman(tt.timeout)
+			stopped := recordStops(d)
+			if tt.kicked {
+				d.kick("r", "driver")
+			}
+			d.trip("r", "driver released control")
+			d.trip("r", "again")
+			if len(*stopped) != tt.want {
+				t.Fatalf("stopped %v, want %d stop", *stopped, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeadmanExpires(t *testing.T) {
+	d := newDeadman(10 * time.Millisecond)
+	stopped := make(chan string, 1)
+	d.stop = func(robotID string) { stopped <- robotID }
+	d.kick("r", "driver")
+	select {
+	case robotID := <-stopped:
+		if robotID != "r" {
+			t.Fatalf("stopped %q, want r", robotID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watchdog never fired")
+	}
+	d.leave("driver") // already stopped, nothing left to do
+	select {
+	case robotID := <-stopped:
+		t.Fatalf("stopped %q again", robotID)
+	default:
+	}
+}
+
+func TestBlenderLeave(t *testing.T) {
+	twist := make([]byte, protocol.TwistBrowserSize)
+	twist[0] = protocol.MsgTypeTwist
+	binary.LittleEndian.PutUint64(twist[17:], math.Float64bits(1))
+
+	b := newBlender()
+	for _, id := range []string{"a", "b"} {
+		b.input("r", &Peer{ID: id, Meta: PeerMeta{BlendWeight: 1}}, twist)
+	}
+	b.leave("a")
+	if frames := b.blend(time.Hour, BlendWeighted); frames["r"] == nil {
+		t.Fatal("robot with a remaining input not blended")
+	}
+	b.leave("b")
+	if frames := b.blend(time.Hour, BlendWeighted); frames["r"] != nil {
+		t.Fatal("robot blended after its last input left")
+	}
+}
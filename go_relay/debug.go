@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// debugServer serves pprof and runtime stats on -debug-addr; it is kept
+// off the main listener so it is never exposed with the relay
+var debugServer *http.Server
+
+func serveDebug(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", handleDebugRuntime)
+
+	debugServer = &http.Server{Addr: addr, Handler: mux}
+	slog.Info("Debug listener", "addr", addr)
+	return debugServer.ListenAndServe()
+}
+
+// PeerQueues is one peer's outbound backlog in /debug/runtime
+type PeerQueues struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	SendDepth  int    `json:"send_depth"`
+	SendCap    int    `json:"send_capacity"`
+	Urgent     int    `json:"urgent_depth"`
+	TwistQueue int    `json:"twist_queue"` // coalesced twists waiting, python peers
+	MediaQueue int    `json:"media_queue"` // media chunks waiting, web peers
+}
+
+// handleDebugRuntime reports goroutines, memory and GC stats, and every
+// peer's queue depths, deepest first
+func handleDebugRuntime(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var gc debug.GCStats
+	gc.PauseQuantiles = make([]time.Duration, 5)
+	debug.ReadGCStats(&gc)
+	pausesMs := make([]float64, len(gc.PauseQuantiles))
+	for i, d := range gc.PauseQuantiles {
+		pausesMs[i] = float64(d) / float64(time.Millisecond)
+	}
+
+	peers := manager.allPeers()
+	queues := make([]PeerQueues, len(peers))
+	for i, p := range peers {
+		queues[i] = PeerQueues{
+			ID:         p.ID,
+			Type:       p.Type,
+			SendDepth:  len(p.SendChan),
+			SendCap:    cap(p.SendChan),
+			Urgent:     len(p.urgent),
+			TwistQueue: p.twists.len(),
+			MediaQueue: p.media.len(),
+		}
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].SendDepth > queues[j].SendDepth })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"goroutines": runtime.NumGoroutine(),
+		"memory": map[string]interface{}{
+			"heap_alloc":   mem.HeapAlloc,
+			"heap_inuse":   mem.HeapInuse,
+			"heap_objects": mem.HeapObjects,
+			"sys":          mem.Sys,
+		},
+		"gc": map[string]interface{}{
+			"num_gc":          gc.NumGC,
+			"last_gc":         gc.LastGC,
+			"pause_total_ms":  float64(gc.PauseTotal) / float64(time.Millisecond),
+			"pause_ms":        pausesMs, // min, 25%, 50%, 75%, max
+			"gc_cpu_fraction": mem.GCCPUFraction,
+			"next_gc":         mem.NextGC,
+		},
+		"peers": queues,
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// Robots push diagnostic status arrays, as ROS diagnostic_aggregator
+// would, one status per component. The relay keeps each component's
+// latest status per robot for /diagnostics and tells the robot's browsers
+// when a component enters ERROR, and again when it leaves it, so operators
+// see a failing motor or sensor without watching a dashboard; browsers
+// joining get an alert for each component standing in error. A robot's
+// components are forgotten when it disconnects.
+
+// maxDiagComponents bounds the components kept per robot; statuses of
+// further ones are dropped
+const maxDiagComponents = 256
+
+// diagLevelNames label diagnostic levels in /diagnostics and metrics
+var diagLevelNames = [...]string{"ok", "warn", "error", "stale"}
+
+// diagLevelName names level, reading any above stale as stale
+func diagLevelName(level byte) string {
+	return diagLevelNames[min(level, protocol.DiagStale)]
+}
+
+// DiagComponent is a component's latest status as reported in /diagnostics
+type DiagComponent struct {
+	protocol.DiagStatus
+	LevelName string `json:"level_name"`
+	RobotTime uint64 `json:"robot_time"` // ms, robot clock
+	AgeMs     int64  `json:"age_ms"`     // since the relay received it
+}
+
+type diagEntry struct {
+	status    protocol.DiagStatus
+	robotTime uint64
+	rx        time.Time
+}
+
+// DiagnosticsStore keeps every robot's latest status per component
+type DiagnosticsStore struct {
+	mu     sync.Mutex
+	robots map[string]map[string]*diagEntry
+}
+
+var diagnostics = &DiagnosticsStore{robots: make(map[string]map[string]*diagEntry)}
+
+// handleDiagnostics stores a robot's statuses and alerts its browsers of
+// components entering or leaving ERROR
+func handleDiagnostics(peer *Peer, data []byte) {
+	if !peer.isRobot() {
+		return
+	}
+	d, err := protocol.UnmarshalDiagnostics(data)
+	if errors.Is(err, protocol.ErrTrailing) {
+		rejectFrame(peer, data, ProtoErrTooLong, len(data))
+		return
+	}
+	if err != nil {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.DiagnosticsMinSize)
+		return
+	}
+	robotID := manager.robotFor(peer)
+	for _, a := range diagnostics.update(robotID, d) {
+		metricDiagAlerts.WithLabelValues(diagLevelName(a.Level)).Inc()
+		if a.Level == protocol.DiagError {
+			peer.logger().Warn("Robot component in error", "msg_type", "diagnostics", "component", a.Name, "message", a.Message)
+		} else {
+			peer.logger().Info("Robot component recovered", "msg_type", "diagnostics", "component", a.Name,
+				"level", diagLevelName(a.Level))
+		}
+		f := wrapFrame(a.Marshal())
+		for _, web := range manager.getWebPeers(robotID) {
+			web.sendFrame(f.retain())
+		}
+		f.release()
+	}
+}
+
+// update stores d's statuses for robotID, returning an alert for each
+// component entering or leaving ERROR
+func (ds *DiagnosticsStore) update(robotID string, d protocol.Diagnostics) []protocol.DiagAlert {
+	now := time.Now()
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	components := ds.robots[robotID]
+	if components == nil {
+		components = make(map[string]*diagEntry)
+		ds.robots[robotID] = components
+	}
+	var alerts []protocol.DiagAlert
+	for _, s := range d.Statuses {
+		e := components[s.Name]
+		if e == nil {
+			if len(components) >= maxDiagComponents {
+				continue
+			}
+			e = &diagEntry{status: protocol.DiagStatus{Level: protocol.DiagOK}}
+			components[s.Name] = e
+		}
+		wasError := e.status.Level == protocol.DiagError
+		if (s.Level == protocol.DiagError) != wasError {
+			alerts = append(alerts, protocol.DiagAlert{Time: currentTimeMs(), Level: s.Level, Name: s.Name, Message: s.Message})
+		}
+		e.status, e.robotTime, e.rx = s, d.Time, now
+	}
+	ds.countLocked(robotID)
+	return alerts
+}
+
+// forget drops robotID's components and their gauges, once the robot
+// disconnected
+func (ds *DiagnosticsStore) forget(robotID string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, ok := ds.robots[robotID]; !ok {
+		return
+	}
+	delete(ds.robots, robotID)
+	for _, name := range diagLevelNames {
+		metricDiagComponents.DeleteLabelValues(robotID, name)
+	}
+}
+
+// countLocked sets robotID's components-per-level gauge; ds.mu is held
+func (ds *DiagnosticsStore) countLocked(robotID string) {
+	counts := make(map[string]int)
+	for _, e := range ds.robots[robotID] {
+		counts[diagLevelName(e.status.Level)]++
+	}
+	for _, name := range diagLevelNames {
+		metricDiagComponents.WithLabelValues(robotID, name).Set(float64(counts[name]))
+	}
+}
+
+// alerts returns the standing ERROR alerts of robotID, for browsers
+// joining it
+func (ds *DiagnosticsStore) alerts(robotID string) [][]byte {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	var frames [][]byte
+	for _, e := range ds.robots[robotID] {
+		if e.status.Level == protocol.DiagError {
+			frames = append(frames, protocol.DiagAlert{Time: currentTimeMs(), Level: e.status.Level,
+				Name: e.status.Name, Message: e.status.Message}.Marshal())
+		}
+	}
+	return frames
+}
+
+// snapshot returns the components of robotID, or of every robot if it is
+// empty, sorted by name
+func (ds *DiagnosticsStore) snapshot(robotID string) map[string][]DiagComponent {
+	now := time.Now()
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	out := make(map[string][]DiagComponent)
+	for id, components := range ds.robots {
+		if robotID != "" && id != robotID {
+			continue
+		}
+		list := make([]DiagComponent, 0, len(components))
+		for _, e := range components {
+			list = append(list, DiagComponent{
+				DiagStatus: e.status,
+				LevelName:  diagLevelName(e.status.Level),
+				RobotTime:  e.robotTime,
+				AgeMs:      now.Sub(e.rx).Milliseconds(),
+			})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		out[id] = list
+	}
+	return out
+}
+
+// handleDiagnosticsGet serves GET /diagnostics: every robot's components
+// and its worst level, or one robot's with ?robot=
+func handleDiagnosticsGet(w http.ResponseWriter, r *http.Request) {
+	type robotDiag struct {
+		Level      string          `json:"level"`
+		Components []DiagComponent `json:"components"`
+	}
+	robots := make(map[string]robotDiag)
+	for id, components := range diagnostics.snapshot(r.URL.Query().Get("robot")) {
+		var worst byte
+		for _, c := range components {
+			// Stale ranks below error: the component stopped reporting, but
+			// nothing says it failed
+			if c.Level == protocol.DiagError || (worst != protocol.DiagError && c.Level > worst) {
+				worst = c.Level
+			}
+		}
+		robots[id] = robotDiag{Level: diagLevelName(worst), Components: components}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"robots": robots})
+}
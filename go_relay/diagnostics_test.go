@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"go_relay/protocol"
+)
+
+func TestDiagLevelName(t *testing.T) {
+	tests := []struct {
+		level byte
+		want  string
+	}{
+		{protocol.DiagOK, "ok"},
+		{protocol.DiagWarn, "warn"},
+		{protocol.DiagError, "error"},
+		{protocol.DiagStale, "stale"},
+		{4, "stale"},
+		{255, "stale"},
+	}
+	for _, tt := range tests {
+		if got := diagLevelName(tt.level); got != tt.want {
+			t.Errorf("diagLevelName(%d) = %q, want %q", tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestDiagnosticsUpdateAlerts(t *testing.T) {
+	status := func(level byte) protocol.Diagnostics {
+		return protocol.Diagnostics{Statuses: []protocol.DiagStatus{{Level: level, Name: "left_motor"}}}
+	}
+	steps := []struct {
+		name   string
+		level  byte
+		alerts int
+	}{
+		{"ok", protocol.DiagOK, 0},
+		{"enters error", protocol.DiagError, 1},
+		{"stays in error", protocol.DiagError, 0},
+		{"leaves error", protocol.DiagWarn, 1},
+		{"warn again", protocol.DiagWarn, 0},
+	}
+	ds := &DiagnosticsStore{robots: make(map[string]map[string]*diagEntry)}
+	for _, st := range steps {
+		if got := len(ds.update("r1", status(st.level))); got != st.alerts {
+			t.Fatalf("%s: %d alerts, want %d", st.name, got, st.alerts)
+		}
+	}
+}
+
+func TestDiagnosticsForget(t *testing.T) {
+	ds := &DiagnosticsStore{robots: make(map[string]map[string]*diagEntry)}
+	errored := protocol.Diagnostics{Statuses: []protocol.DiagStatus{{Level: protocol.DiagError, Name: "lidar"}}}
+	ds.update("r1", errored)
+	ds.update("r2", errored)
+	ds.forget("r1")
+	if _, ok := ds.snapshot("")["r1"]; ok {
+		t.Fatal("disconnected robot still listed")
+	}
+	if len(ds.alerts("r1")) != 0 {
+		t.Fatal("disconnected robot still has standing alerts")
+	}
+	if len(ds.alerts("r2")) != 1 {
+		t.Fatal("other robot's components dropped")
+	}
+	if alerts := ds.update("r1", errored); len(alerts) != 1 {
+		t.Fatalf("reconnected robot's error raised %d alerts, want 1", len(alerts))
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+
+	"go_relay/protocol"
+)
+
+// E-Stop actions (second byte of an E-Stop frame)
+const (
+	EStopEngage  = 0x01
+	EStopRelease = 0x02
+
+	// Frames a peer can have queued ahead of its SendChan
+	urgentBuffer = 8
+)
+
+// EStops latches emergency stops per robot. Any web peer can engage one
+// for its robot (or the robot its trailer names), as can POST /estop for
+// one robot or every connected one. While a robot is stopped the relay
+// forwards none of its commands until the stop is released.
+type EStops struct {
+	mu      sync.Mutex
+	stopped map[string]string // robot ID -> who engaged it
+}
+
+var estops = &EStops{stopped: make(map[string]string)}
+
+// engage latches robotID, returning false if it was already stopped
+func (e *EStops) engage(robotID, by string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.stopped[robotID]; ok {
+		return false
+	}
+	e.stopped[robotID] = by
+	return true
+}
+
+// release clears the latch, returning false if robotID was not stopped
+func (e *EStops) release(robotID string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.stopped[robotID]; !ok {
+		return false
+	}
+	delete(e.stopped, robotID)
+	return true
+}
+
+func (e *EStops) engaged(robotID string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.stopped[robotID]
+	return ok
+}
+
+// snapshot returns the stopped robots, sorted
+func (e *EStops) snapshot() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	robots := make([]string, 0, len(e.stopped))
+	for id := range e.stopped {
+		robots = append(robots, id)
+	}
+	sort.Strings(robots)
+	return robots
+}
+
+// refuseStopped drops a command from source for robotID while its stop
+// is latched, Nacking msgID, and reports whether it did
+func refuseStopped(robotID, source string, msgID uint64) bool {
+	if !estops.engaged(robotID) {
+		return false
+	}
+	slog.Debug("Command for e-stopped robot dropped", "robot_id", robotID, "source", source, "msg_id", msgID)
+	sendNack(source, msgID, NackEStopped)
+	return true
+}
+
+func encodeEStop(action byte) []byte {
+	return []byte{protocol.MsgTypeEStop, action}
+}
+
+// setEStop engages or releases robotID's stop and, if that changed
+// anything, tells its Python peer ahead of any queued twists and its web
+// peers so every operator sees the state.
+func setEStop(robotID string, action byte, by string) bool {
+	var changed bool
+	switch action {
+	case EStopEngage:
+		changed = estops.engage(robotID, by)
+	case EStopRelease:
+		changed = estops.release(robotID)
+	}
+	if !changed {
+		return false
+	}
+
+	frame := encodeEStop(action)
+	if python := manager.getPython(robotID); python != nil {
+		if action == EStopEngage {
+			python.twists.clear()
+		}
+		python.sendUrgent(frame)
+	}
+	for _, standby := range manager.getStandbys(robotID) {
+		standby.sendUrgent(frame)
+	}
+	if action == EStopEngage {
+		holds.clear(robotID, NackEStopped)
+	}
+	for _, web := range manager.getWebPeers(robotID) {
+		web.send(frame)
+	}
+	recorder.record(RecordOut, robotID, nil, frame)
+	audit.estop(robotID, action, by)
+
+	if action == EStopEngage {
+		slog.Warn("E-STOP engaged", "robot_id", robotID, "by", by)
+	} else {
+		slog.Info("E-stop released", "robot_id", robotID, "by", by)
+	}
+	return true
+}
+
+func handleEStop(peer *Peer, data []byte) {
+	if peer.Type != "web" {
+		return
+	}
+	if len(data) < protocol.EStopSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.EStopSize)
+		return
+	}
+	if data[1] != EStopEngage && data[1] != EStopRelease {
+		peer.logger().Warn("Unknown e-stop action", "msg_type", "estop", "action", data[1])
+		return
+	}
+
+	robotID := parseRobotTrailer(data, protocol.EStopSize)
+	if robotID == "" {
+		robotID = manager.robotFor(peer)
+	} else {
+		robotID = roomRobotID(peer.Meta.Room, robotID)
+	}
+	setEStop(robotID, data[1], peer.ID)
+}
+
+// handleEStopGet serves GET /estop: the robots currently stopped
+func handleEStopGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stopped": estops.snapshot(),
+	})
+}
+
+// handleEStopPost serves POST /estop {"robot","action"}. Without a robot
+// the action applies to every connected robot.
+func handleEStopPost(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Robot  string `json:"robot"`
+		Action string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	var action byte
+	switch req.Action {
+	case "engage":
+		action = EStopEngage
+	case "release":
+		action = EStopRelease
+	default:
+		http.Error(w, "action must be engage or release", http.StatusBadRequest)
+		return
+	}
+
+	robots := []string{req.Robot}
+	if req.Robot == "" {
+		manager.mu.RLock()
+		robots = manager.robotIDs()
+		manager.mu.RUnlock()
+	}
+	for _, robotID := range robots {
+		setEStop(robotID, action, "REST "+r.RemoteAddr)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"robots":  robots,
+		"stopped": estops.snapshot(),
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestEStopLatchRejectsCommands(t *testing.T) {
+	tests := []struct {
+		name       string
+		actions    []byte // applied to robot r1 in order
+		wantLatch  bool
+		wantRefuse bool
+	}{
+		{"never stopped", nil, false, false},
+		{"engaged", []byte{EStopEngage}, true, true},
+		{"engaged twice stays latched", []byte{EStopEngage, EStopEngage}, true, true},
+		{"released", []byte{EStopEngage, EStopRelease}, false, false},
+		{"re-engaged after release", []byte{EStopEngage, EStopRelease, EStopEngage}, true, true},
+		{"release without a stop", []byte{EStopRelease}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := estops
+			estops = &EStops{stopped: make(map[string]string)}
+			t.Cleanup(func() { estops = prev })
+
+			for _, action := range tt.actions {
+				if action == EStopEngage {
+					estops.engage("r1", "operator")
+				} else {
+					estops.release("r1")
+				}
+			}
+			if got := estops.engaged("r1"); got != tt.wantLatch {
+				t.Fatalf("engaged = %v, want %v", got, tt.wantLatch)
+			}
+			if got := refuseStopped("r1", "driver", 7); got != tt.wantRefuse {
+				t.Fatalf("refuseStopped = %v, want %v", got, tt.wantRefuse)
+			}
+			if refuseStopped("r2", "driver", 8) {
+				t.Error("another robot's twist refused")
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventBuffer is how many events a slow /events client may fall behind
+// before further ones are dropped for it
+const eventBuffer = 64
+
+// Event is one Server-Sent Event: its name and JSON payload
+type Event struct {
+	Name string
+	Data []byte
+}
+
+// EventHub fans relay events out to /events subscribers: "peer" and
+// "robot" on presence changes, "latency" every -events-interval, "drops"
+// when a drop total changes and "override" when a supervisor override
+// starts or ends
+type EventHub struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+var events = &EventHub{subs: make(map[chan Event]struct{})}
+
+// publish sends an event to every subscriber that keeps up
+func (h *EventHub) publish(name string, data interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- Event{Name: name, Data: payload}:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel of events, or nil once the hub is closed
+func (h *EventHub) subscribe() chan Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	ch := make(chan Event, eventBuffer)
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *EventHub) unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// close ends every stream, so HTTP shutdown need not wait for them
+func (h *EventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// DropCounts is the "drops" event: frames lost since startup, by cause
+type DropCounts struct {
+	SendBuffer  uint64 `json:"send_buffer"` // a peer's SendChan was full
+	Coalesced   uint64 `json:"coalesced"`   // twists replaced by a newer one
+	Stale       uint64 `json:"stale"`       // see -max-command-age
+	CRCFailures uint64 `json:"crc_failures"`
+}
+
+func dropCounts() DropCounts {
+	return DropCounts{
+		SendBuffer:  sendDropped.Load(),
+		Coalesced:   twistsCoalesced.Load(),
+		Stale:       staleDropped.Load(),
+		CRCFailures: crcFailures.Load(),
+	}
+}
+
+// LatencySummary is one robot's part of the "latency" event
+type LatencySummary struct {
+	Samples  int                    `json:"samples"`
+	Segments map[string]Percentiles `json:"segments"`
+}
+
+// latencySummaries summarizes the latency window per robot
+func latencySummaries() map[string]LatencySummary {
+	byRobot := make(map[string][]LatencyRecord)
+	for _, rec := range latency.snapshot("") {
+		byRobot[rec.RobotID] = append(byRobot[rec.RobotID], rec)
+	}
+	out := make(map[string]LatencySummary, len(byRobot))
+	for robotID, records := range byRobot {
+		out[robotID] = LatencySummary{Samples: len(records), Segments: summarize(records)}
+	}
+	return out
+}
+
+// runEventTicker publishes the latency summary every interval, and the
+// drop counters whenever they changed
+func runEventTicker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last DropCounts
+	for range ticker.C {
+		events.publish("latency", map[string]interface{}{"unit": "ms", "robots": latencySummaries()})
+		if drops := dropCounts(); drops != last {
+			events.publish("drops", drops)
+			last = drops
+		}
+	}
+}
+
+// handleEvents serves GET /events: a Server-Sent Events stream of peer
+// and robot presence, failovers, latency summaries and drop counters.
+// The current drop counters are sent first.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := events.subscribe()
+	if ch == nil {
+		http.Error(w, "relay shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	drops, _ := json.Marshal(dropCounts())
+	writeEvent(w, Event{Name: "drops", Data: drops})
+	flusher.Flush()
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if writeEvent(w, ev) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev Event) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, ev.Data)
+	return err
+}
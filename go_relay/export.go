@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// latencyCSVHeader names the columns of /export/latency?format=csv
+var latencyCSVHeader = []string{
+	"msg_id", "robot_id", "peer_id", "robot_peer_id",
+	"t1_browser_send", "t2_relay_rx", "t3_relay_tx", "t3_python_rx", "t4_python_ack", "t4_relay_ack_rx", "t5_relay_ack_tx",
+	"python_decode_us", "python_process_us", "python_encode_us", "hops", "clock_step",
+	"t2_kernel_rx_us", "t4_kernel_rx_us",
+}
+
+func (r LatencyRecord) csvRow() []string {
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	return []string{
+		u(r.MsgID), r.RobotID, r.PeerID, r.RobotPeerID,
+		u(r.T1BrowserSend), u(r.T2RelayRx), u(r.T3RelayTx), u(r.T3PythonRx), u(r.T4PythonAck), u(r.T4RelayAckRx), u(r.T5RelayAckTx),
+		u(uint64(r.DecodeUs)), u(uint64(r.ProcessUs)), u(uint64(r.EncodeUs)), strconv.Itoa(len(r.Hops)),
+		strconv.FormatBool(r.ClockStep), u(r.T2KernelRxUs), u(r.T4KernelRxUs),
+	}
+}
+
+// parseSince reads ?since= as Unix ms, an RFC 3339 time or a duration
+// back from now (e.g. 5m); "" means everything
+func parseSince(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if ms, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return uint64(max(t.UnixMilli(), 0)), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		now, back := currentTimeMs(), uint64(d.Milliseconds())
+		if back >= now {
+			return 0, nil // further back than the epoch: everything
+		}
+		return now - back, nil
+	}
+	return 0, errors.New("since: want Unix ms, an RFC 3339 time or a duration")
+}
+
+// handleLatencyExport serves GET /export/latency: the raw records behind
+// /latency, one per acked twist, oldest first. ?since= keeps those the
+// relay received at or after it, ?robot= those of one robot, and
+// ?format= picks csv or jsonl (the default). Records around a wall-clock
+// step are flagged clock_step. Acks do not name the sender, so it is
+// looked up by robot and message ID.
+func handleLatencyExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	since, err := parseSince(q.Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := q.Get("format")
+	switch format {
+	case "":
+		format = "jsonl"
+	case "csv", "jsonl":
+	default:
+		http.Error(w, "format: want csv or jsonl", http.StatusBadRequest)
+		return
+	}
+
+	records := latency.snapshot(q.Get("robot"))
+	for i := range records {
+		records[i].ClockStep = clockSteps.between(records[i].T2RelayRx, records[i].T5RelayAckTx)
+	}
+	name := "latency-" + time.Now().UTC().Format("20060102-150405") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		cw.Write(latencyCSVHeader)
+		for _, rec := range records {
+			if rec.T2RelayRx >= since {
+				cw.Write(rec.csvRow())
+			}
+		}
+		cw.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		if rec.T2RelayRx >= since {
+			enc.Encode(rec)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestParseSince(t *testing.T) {
+	now := currentTimeMs()
+	tests := []struct {
+		in      string
+		lo, hi  uint64 // accepted range, inclusive
+		wantErr bool
+	}{
+		{in: "", lo: 0, hi: 0},
+		{in: "1700000000000", lo: 1700000000000, hi: 1700000000000},
+		{in: "2023-11-14T22:13:20Z", lo: 1700000000000, hi: 1700000000000},
+		{in: "1900-01-01T00:00:00Z", lo: 0, hi: 0},
+		{in: "5m", lo: now - 5*60*1000, hi: now - 5*60*1000 + 1000},
+		{in: "1000000h", lo: 0, hi: 0},
+		{in: "-5m", wantErr: true},
+		{in: "yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.in)
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("parseSince(%q) = %d, want an error", tt.in, got)
+		case !tt.wantErr && err != nil:
+			t.Errorf("parseSince(%q): %v", tt.in, err)
+		case !tt.wantErr && (got < tt.lo || got > tt.hi):
+			t.Errorf("parseSince(%q) = %d, want %d..%d", tt.in, got, tt.lo, tt.hi)
+		}
+	}
+}
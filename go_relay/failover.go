@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// With -failover-timeout set, a further robot peer registering for a robot
+// that already has one queues as its standby instead of replacing it.
+// Commands go to the primary only, and standbys' acks, telemetry, odometry
+// and media are ignored. When the primary closes, or a WebSocket primary
+// stays silent for the timeout, the first standby takes over and the
+// robot's web peers get a Failover naming it.
+
+// Failover reasons (second byte of a Failover frame)
+const (
+	FailoverDisconnected = 0x01 // the primary's connection closed
+	FailoverUnresponsive = 0x02 // the primary missed pongs for -failover-timeout
+)
+
+// touch records that the peer was heard from, by message or pong
+func (p *Peer) touch() {
+	p.lastSeen.Store(relayTime())
+}
+
+// silentFor returns how long ago the peer was last heard from
+func (p *Peer) silentFor() time.Duration {
+	return time.Duration(relayTime()-p.lastSeen.Load()) * time.Millisecond
+}
+
+// pingInterval returns how often the writer pings the peer: robot peers
+// are pinged often enough under -failover-timeout to notice a dead one
+func (p *Peer) pingInterval() time.Duration {
+	if p.isRobot() && config.FailoverTimeout > 0 {
+		return min(p.heartbeat.PingInterval, config.FailoverTimeout/3)
+	}
+	return p.heartbeat.PingInterval
+}
+
+// isStandby reports whether p is a robot peer waiting behind a primary
+func (m *PeerManager) isStandby(p *Peer) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cur, ok := m.robots[p.RobotID]
+	return p.isRobot() && ok && cur.ID != p.ID
+}
+
+// getStandbys returns robotID's standby robot peers, next in line first
+func (m *PeerManager) getStandbys(robotID string) []*Peer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*Peer(nil), m.standby[robotID]...)
+}
+
+// promote makes robotID's first standby its primary if the primary is
+// dead or gone, returning the new primary or nil
+func (m *PeerManager) promote(robotID string, dead *Peer) *Peer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, ok := m.robots[robotID]; ok && cur != dead {
+		return nil
+	}
+	queue := m.standby[robotID]
+	if len(queue) == 0 {
+		return nil
+	}
+	next := queue[0]
+	if len(queue) == 1 {
+		delete(m.standby, robotID)
+	} else {
+		m.standby[robotID] = queue[1:]
+	}
+	m.robots[robotID] = next
+	m.registry.changed(robotID)
+	return next
+}
+
+// removeStandbyLocked drops p from its robot's standby list; caller holds m.mu
+func (m *PeerManager) removeStandbyLocked(p *Peer) {
+	queue := m.standby[p.RobotID]
+	for i, s := range queue {
+		if s.ID == p.ID {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(m.standby, p.RobotID)
+	} else {
+		m.standby[p.RobotID] = queue
+	}
+}
+
+// standbySnapshot returns the standby peer IDs per robot for /status
+func (m *PeerManager) standbySnapshot() map[string][]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make(map[string][]string, len(m.standby))
+	for robotID, queue := range m.standby {
+		for _, p := range queue {
+			out[robotID] = append(out[robotID], p.ID)
+		}
+	}
+	return out
+}
+
+// failover hands robotID to its next standby when the primary dead has
+// gone, and tells the robot's web peers which peer now serves it
+func failover(robotID string, dead *Peer, reason byte) bool {
+	next := manager.promote(robotID, dead)
+	if next == nil {
+		return false
+	}
+	name := "disconnected"
+	if reason == FailoverUnresponsive {
+		name = "unresponsive"
+	}
+	metricFailovers.WithLabelValues(name).Inc()
+	slog.Warn("Robot peer failed over", "robot_id", robotID, "reason", name,
+		"previous_peer_id", dead.ID, "peer_id", next.ID)
+
+	frame := encodeFailover(reason, next.ID)
+	for _, web := range manager.getWebPeers(robotID) {
+		web.send(frame)
+	}
+	recorder.record(RecordOut, robotID, nil, frame)
+	events.publish("robot", map[string]interface{}{
+		"event":            "failover",
+		"reason":           name,
+		"robot_id":         robotID,
+		"peer_id":          next.ID,
+		"previous_peer_id": dead.ID,
+	})
+	return true
+}
+
+func encodeFailover(reason byte, peerID string) []byte {
+	frame := make([]byte, 0, protocol.FailoverMinSize+len(peerID))
+	frame = append(frame, protocol.MsgTypeFailover, reason, byte(len(peerID)))
+	return append(frame, peerID...)
+}
+
+// watchPrimaries fails robots over from primaries silent for longer than
+// timeout, closing the silent peer, while a standby is waiting
+func watchPrimaries(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		for robotID := range manager.standbySnapshot() {
+			primary := manager.getPython(robotID)
+			if primary == nil || primary.silentFor() < timeout {
+				continue
+			}
+			// Only WebSocket peers answer pings; other transports
+			// notice dead peers themselves within -read-timeout
+			if _, ok := primary.Conn.(*wsTransport); !ok {
+				continue
+			}
+			if failover(robotID, primary, FailoverUnresponsive) {
+				primary.Conn.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPromoteStandby(t *testing.T) {
+	robot := func(id string) *Peer { return &Peer{ID: id, Type: "python", RobotID: "r1"} }
+	primary, first, second := robot("primary"), robot("first"), robot("second")
+
+	tests := []struct {
+		name        string
+		standby     []*Peer
+		current     *Peer // r1's primary when promote runs, nil once removed
+		dead        *Peer
+		wantPrimary string // "" when nothing is promoted
+		wantStandby []string
+	}{
+		{"next in line takes over", []*Peer{first, second}, primary, primary, "first", []string{"second"}},
+		{"last standby takes over", []*Peer{first}, nil, primary, "first", nil},
+		{"no standby", nil, primary, primary, "", nil},
+		{"primary is alive", []*Peer{first}, primary, second, "", []string{"first"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &PeerManager{
+				robots:   make(map[string]*Peer),
+				standby:  make(map[string][]*Peer),
+				registry: newRobotRegistry(),
+			}
+			if tt.current != nil {
+				m.robots["r1"] = tt.current
+			}
+			if tt.standby != nil {
+				m.standby["r1"] = slices.Clone(tt.standby)
+			}
+
+			next := m.promote("r1", tt.dead)
+			switch {
+			case tt.wantPrimary == "" && next != nil:
+				t.Fatalf("promoted %s", next.ID)
+			case tt.wantPrimary != "" && (next == nil || next.ID != tt.wantPrimary || m.robots["r1"] != next):
+				t.Fatalf("promoted %v, want %s as r1's primary", next, tt.wantPrimary)
+			}
+			if got := m.standbySnapshot()["r1"]; !slices.Equal(got, tt.wantStandby) {
+				t.Errorf("standby %v, want %v", got, tt.wantStandby)
+			}
+		})
+	}
+}
+
+func TestRemoveStandby(t *testing.T) {
+	a, b := &Peer{ID: "a", RobotID: "r1"}, &Peer{ID: "b", RobotID: "r1"}
+	m := &PeerManager{standby: map[string][]*Peer{"r1": {a, b}}}
+	m.removeStandbyLocked(a)
+	if got := m.standbySnapshot()["r1"]; !slices.Equal(got, []string{"b"}) {
+		t.Fatalf("standby %v after removing a", got)
+	}
+	m.removeStandbyLocked(b)
+	if _, ok := m.standby["r1"]; ok {
+		t.Error("empty standby list kept")
+	}
+}
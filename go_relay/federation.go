@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+
+	"go_relay/protocol"
+)
+
+// HopRecord is one relay's timestamps for a twist that crossed it on the
+// way to a downstream relay. Records in the twist direction are partial
+// (no ack times yet); acks come back with them completed.
+type HopRecord struct {
+	TwistRx uint64 `json:"twist_rx"`
+	TwistTx uint64 `json:"twist_tx"`
+	AckRx   uint64 `json:"ack_rx"`
+	AckTx   uint64 `json:"ack_tx"`
+}
+
+// HopRecordSize is the wire size of one HopRecord
+const HopRecordSize = 32
+
+// maxHops bounds the hop block; its count is a single byte
+const maxHops = 255
+
+// appendHops appends the hop block: the records, then a uint8 count
+func appendHops(dst []byte, hops []HopRecord) []byte {
+	hops = hops[:min(len(hops), maxHops)]
+	for _, h := range hops {
+		dst = binary.LittleEndian.AppendUint64(dst, h.TwistRx)
+		dst = binary.LittleEndian.AppendUint64(dst, h.TwistTx)
+		dst = binary.LittleEndian.AppendUint64(dst, h.AckRx)
+		dst = binary.LittleEndian.AppendUint64(dst, h.AckTx)
+	}
+	return append(dst, byte(len(hops)))
+}
+
+// splitHops removes the hop block from the end of frame, given the size
+// of everything in front of it
+func splitHops(frame []byte, minSize int) (body []byte, hops []HopRecord, ok bool) {
+	if len(frame) < minSize+1 {
+		return nil, nil, false
+	}
+	n := int(frame[len(frame)-1])
+	start := len(frame) - 1 - n*HopRecordSize
+	if start < minSize {
+		return nil, nil, false
+	}
+	hops = make([]HopRecord, n)
+	for i := range hops {
+		b := frame[start+i*HopRecordSize:]
+		hops[i] = HopRecord{
+			TwistRx: binary.LittleEndian.Uint64(b[0:]),
+			TwistTx: binary.LittleEndian.Uint64(b[8:]),
+			AckRx:   binary.LittleEndian.Uint64(b[16:]),
+			AckTx:   binary.LittleEndian.Uint64(b[24:]),
+		}
+	}
+	return frame[:start], hops, true
+}
+
+// mergeAckHops folds an ack from a downstream relay into the hop list.
+// The ack's fixed layout holds the sender's own times; the last partial
+// record is this relay's, which it takes back out. It returns the new
+// list and this relay's record.
+func mergeAckHops(ack []byte, hops []HopRecord) ([]HopRecord, HopRecord, bool) {
+	le := binary.LittleEndian
+	sender := HopRecord{
+		TwistRx: le.Uint64(ack[17:25]),
+		TwistTx: le.Uint64(ack[25:33]),
+		AckRx:   le.Uint64(ack[61:69]),
+		AckTx:   le.Uint64(ack[69:77]),
+	}
+	for k := len(hops) - 1; k >= 0; k-- {
+		if hops[k].AckRx == 0 {
+			merged := make([]HopRecord, 0, len(hops))
+			merged = append(append(merged, hops[:k]...), sender)
+			return append(merged, hops[k+1:]...), hops[k], true
+		}
+	}
+	return nil, HopRecord{}, false
+}
+
+// completeHops returns the records of relays downstream of this one
+func completeHops(hops []HopRecord) []HopRecord {
+	for k := len(hops) - 1; k >= 0; k-- {
+		if hops[k].AckRx == 0 {
+			return hops[k+1:]
+		}
+	}
+	return hops
+}
+
+// Federation chains this relay below an upstream one. For every robot
+// connected here it keeps a link to the upstream relay as a "relay" peer
+// for that robot, forwards the twists it gets there to the robot and
+// sends the robot's acks back with the hop timestamps.
+type Federation struct {
+	url   string
+	token string
+
+	mu    sync.Mutex
+	links map[string]*upstreamLink // robot ID -> link
+}
+
+// federation is set by main when -upstream is given
+var federation *Federation
+
+func newFederation(upstream, token string) *Federation {
+	return &Federation{url: upstream, token: token, links: make(map[string]*upstreamLink)}
+}
+
+// robotUp opens robotID's upstream link if it has none
+func (f *Federation) robotUp(robotID string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.links[robotID] != nil {
+		return
+	}
+	l := &upstreamLink{
+		robotID: robotID,
+		quit:    make(chan struct{}),
+		pending: make(map[uint64][]HopRecord),
+	}
+	f.links[robotID] = l
+	go l.run(f)
+}
+
+// robotDown closes robotID's upstream link
+func (f *Federation) robotDown(robotID string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	l := f.links[robotID]
+	delete(f.links, robotID)
+	f.mu.Unlock()
+	if l != nil {
+		l.close()
+	}
+}
+
+// forwardAck sends an ack (77-byte browser layout) upstream. hops is the
+// merged list for acks from a downstream relay, or nil to use the records
+// that came with the twist.
+func (f *Federation) forwardAck(robotID string, ack []byte, hops []HopRecord) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	l := f.links[robotID]
+	f.mu.Unlock()
+	if l != nil {
+		l.sendAck(ack, hops)
+	}
+}
+
+// forwardRobotFrame relays a frame the robot originates (telemetry,
+// odometry) upstream, if linked
+func (f *Federation) forwardRobotFrame(robotID string, frame []byte) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	l := f.links[robotID]
+	f.mu.Unlock()
+	if l == nil {
+		return
+	}
+	out := append([]byte(nil), frame...)
+	if l.features.Load()&FeatureRobotTrailer != 0 {
+		out = protocol.AppendRobotTrailer(out, robotID)
+	}
+	l.write(out)
+}
+
+func (f *Federation) close() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	links := f.links
+	f.links = make(map[string]*upstreamLink)
+	f.mu.Unlock()
+	for _, l := range links {
+		l.close()
+	}
+}
+
+// maxPendingHops bounds the twists a link remembers hops for
+const maxPendingHops = 256
+
+// upstreamLink is one robot's connection to the -upstream relay, which
+// treats it as that robot's python peer (peer type and token scope
+// "relay"). Twists come down it to the robot and acks go back up, with hop
+// timestamps once negotiated.
+type upstreamLink struct {
+	robotID   string
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	wmu      sync.Mutex // guards conn writes
+	conn     *websocket.Conn
+	features atomic.Uint32 // from the upstream Welcome
+
+	pmu     sync.Mutex
+	pending map[uint64][]HopRecord // message ID -> hops so far
+}
+
+func (l *upstreamLink) close() {
+	l.closeOnce.Do(func() {
+		close(l.quit)
+		l.wmu.Lock()
+		if l.conn != nil {
+			l.conn.Close()
+		}
+		l.wmu.Unlock()
+	})
+}
+
+// run keeps the link connected, retrying every ping interval, until closed
+func (l *upstreamLink) run(f *Federation) {
+	u, err := url.Parse(f.url)
+	if err != nil {
+		slog.Error("Upstream: invalid URL", "url", f.url, "err", err)
+		return
+	}
+	q := u.Query()
+	q.Set("type", "relay")
+	q.Set("robot", l.robotID)
+	u.RawQuery = q.Encode()
+	header := http.Header{}
+	if f.token != "" {
+		header.Set("Authorization", "Bearer "+f.token)
+	}
+
+	for {
+		conn, _, err := relayDialer.Dial(u.String(), header)
+		if err != nil {
+			slog.Warn("Upstream link failed", "robot_id", l.robotID, "err", err)
+		} else {
+			slog.Info("Upstream link connected", "robot_id", l.robotID, "upstream", u.Host)
+			l.serve(conn)
+			slog.Info("Upstream link closed", "robot_id", l.robotID)
+		}
+		select {
+		case <-l.quit:
+			return
+		case <-time.After(config.PingInterval):
+		}
+	}
+}
+
+func (l *upstreamLink) serve(conn *websocket.Conn) {
+	l.wmu.Lock()
+	select {
+	case <-l.quit:
+		l.wmu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	l.conn = conn
+	l.features.Store(0)
+	l.wmu.Unlock()
+	defer conn.Close()
+
+	hello := make([]byte, protocol.HelloSize)
+	hello[0] = protocol.MsgTypeHello
+	hello[1] = ProtocolVersion
+	binary.LittleEndian.PutUint32(hello[2:], FeatureRobotTrailer|FeatureRelayTimestamps|FeatureHops)
+	if l.write(hello) != nil {
+		return
+	}
+
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if msgType != websocket.BinaryMessage || len(data) == 0 {
+			continue
+		}
+		switch data[0] {
+		case protocol.MsgTypeWelcome:
+			if len(data) >= protocol.HelloSize {
+				l.features.Store(binary.LittleEndian.Uint32(data[2:6]))
+			}
+		case protocol.MsgTypeTwist:
+			l.handleTwist(data)
+		case protocol.MsgTypeEStop:
+			if len(data) >= protocol.EStopSize {
+				setEStop(l.robotID, data[1], "upstream")
+			}
+		case protocol.MsgTypeSyncBeacon:
+			if len(data) >= protocol.SyncBeaconSize {
+				now := currentTimeMs()
+				reply := make([]byte, protocol.BeaconReplySize)
+				reply[0] = protocol.MsgTypeBeaconReply
+				copy(reply[1:9], data[1:9])
+				binary.LittleEndian.PutUint64(reply[9:], now)
+				binary.LittleEndian.PutUint64(reply[17:], currentTimeMs())
+				l.write(reply)
+			}
+		}
+	}
+}
+
+// handleTwist forwards an upstream twist to the robot, moving the
+// upstream relay's t2/t3 into the hop list
+func (l *upstreamLink) handleTwist(data []byte) {
+	t2 := currentTimeMs()
+	var hops []HopRecord
+	if l.features.Load()&FeatureHops != 0 {
+		body, h, ok := splitHops(data, protocol.TwistToPythonSize)
+		if !ok {
+			slog.Warn("Upstream twist without hop block", "robot_id", l.robotID, "msg_type", "twist")
+			return
+		}
+		data, hops = body, h
+	}
+	if len(data) < protocol.TwistToPythonSize {
+		slog.Warn("Invalid upstream message size", "robot_id", l.robotID, "msg_type", "twist", "size", len(data))
+		return
+	}
+	hops = append(hops, HopRecord{
+		TwistRx: binary.LittleEndian.Uint64(data[65:73]),
+		TwistTx: binary.LittleEndian.Uint64(data[73:81]),
+	})
+
+	msgID := binary.LittleEndian.Uint64(data[1:9])
+	if msgID != DeadmanMsgID {
+		l.pmu.Lock()
+		if len(l.pending) >= maxPendingHops {
+			for id := range l.pending {
+				delete(l.pending, id)
+				break
+			}
+		}
+		l.pending[msgID] = hops
+		l.pmu.Unlock()
+	}
+	forwardTwistHops(l.robotID, "upstream", data, t2, hops, trace.SpanContext{})
+}
+
+// sendAck writes a 77-byte ack upstream with its hop block
+func (l *upstreamLink) sendAck(ack []byte, hops []HopRecord) {
+	msgID := binary.LittleEndian.Uint64(ack[1:9])
+	l.pmu.Lock()
+	pending, ok := l.pending[msgID]
+	delete(l.pending, msgID)
+	l.pmu.Unlock()
+	if hops == nil {
+		if !ok {
+			return // not a twist from upstream
+		}
+		hops = pending
+	}
+
+	features := l.features.Load()
+	frame := append([]byte(nil), ack[:protocol.AckToBrowserSize]...)
+	if features&FeatureRobotTrailer != 0 {
+		frame = protocol.AppendRobotTrailer(frame, l.robotID)
+	}
+	if features&FeatureHops != 0 {
+		frame = appendHops(frame, hops)
+	}
+	l.write(frame)
+}
+
+func (l *upstreamLink) write(frame []byte) error {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	if l.conn == nil {
+		return websocket.ErrCloseSent
+	}
+	l.conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+	return l.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
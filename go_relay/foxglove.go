@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// foxgloveSubprotocol is the Foxglove WebSocket protocol, v1
+const foxgloveSubprotocol = "foxglove.websocket.v1"
+
+// foxgloveOpMessageData prefixes binary messages: opcode, uint32
+// subscription ID, uint64 receive time (ns), payload
+const foxgloveOpMessageData = 0x01
+
+// foxgloveChannel is one channel as advertised to Foxglove clients
+type foxgloveChannel struct {
+	ID             uint32 `json:"id"`
+	Topic          string `json:"topic"`
+	Encoding       string `json:"encoding"`
+	SchemaName     string `json:"schemaName"`
+	Schema         string `json:"schema"`
+	SchemaEncoding string `json:"schemaEncoding"`
+}
+
+const (
+	foxgloveChanTwist uint32 = 1
+	foxgloveChanAck   uint32 = 2
+)
+
+var foxgloveChannels = []foxgloveChannel{
+	{
+		ID:             foxgloveChanTwist,
+		Topic:          "/relay/twist",
+		Encoding:       "json",
+		SchemaName:     "teleop.RelayTwist",
+		SchemaEncoding: "jsonschema",
+		Schema: `{"type":"object","properties":{` +
+			`"robot_id":{"type":"string"},"msg_id":{"type":"integer"},` +
+			`"t1_browser_send":{"type":"integer"},"t2_relay_rx":{"type":"integer"},"t3_relay_tx":{"type":"integer"},` +
+			`"linear":{"$ref":"#/$defs/vector3"},"angular":{"$ref":"#/$defs/vector3"}},` +
+			`"$defs":{"vector3":{"type":"object","properties":{"x":{"type":"number"},"y":{"type":"number"},"z":{"type":"number"}}}}}`,
+	},
+	{
+		ID:             foxgloveChanAck,
+		Topic:          "/relay/ack",
+		Encoding:       "json",
+		SchemaName:     "teleop.RelayAck",
+		SchemaEncoding: "jsonschema",
+		Schema: `{"type":"object","properties":{` +
+			`"robot_id":{"type":"string"},"msg_id":{"type":"integer"},` +
+			`"t1_browser_send":{"type":"integer"},"t2_relay_rx":{"type":"integer"},"t3_relay_tx":{"type":"integer"},` +
+			`"t3_python_rx":{"type":"integer"},"t4_python_ack":{"type":"integer"},` +
+			`"t4_relay_ack_rx":{"type":"integer"},"t5_relay_ack_tx":{"type":"integer"},` +
+			`"python_decode_us":{"type":"integer"},"python_process_us":{"type":"integer"},"python_encode_us":{"type":"integer"}}}`,
+	},
+}
+
+// foxgloveTwist is a twist as forwarded to a robot, clamped and stamped
+type foxgloveTwist struct {
+	RobotID       string     `json:"robot_id"`
+	MsgID         uint64     `json:"msg_id"`
+	T1BrowserSend uint64     `json:"t1_browser_send"`
+	T2RelayRx     uint64     `json:"t2_relay_rx"`
+	T3RelayTx     uint64     `json:"t3_relay_tx"`
+	Linear        rosVector3 `json:"linear"`
+	Angular       rosVector3 `json:"angular"`
+}
+
+// FoxgloveServer streams relayed twists and acks to Foxglove Studio over
+// the Foxglove WebSocket protocol at /ws/foxglove. Nothing is encoded
+// until a client subscribes.
+type FoxgloveServer struct {
+	mu      sync.RWMutex
+	clients map[*foxgloveClient]struct{}
+	subs    atomic.Int32 // subscriptions across all clients
+}
+
+var foxglove = &FoxgloveServer{clients: make(map[*foxgloveClient]struct{})}
+
+type foxgloveClient struct {
+	conn *websocket.Conn
+	send chan []byte
+	quit chan struct{}
+
+	mu   sync.Mutex
+	subs map[uint32]uint32 // subscription ID -> channel ID
+}
+
+// handleFoxglove serves one Foxglove client; it needs the "web" scope
+func handleFoxglove(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		http.Error(w, "relay shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	release, err := limiter.acquire(r, "foxglove")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	claims, authErr := auth.authorize(r, "web")
+
+	u := upgrader
+	u.Subprotocols = []string{foxgloveSubprotocol}
+	ws, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("Upgrade failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	ws.SetReadLimit(int64(config.MaxFrameSize))
+	if authErr != nil {
+		msg := websocket.FormatCloseMessage(closeCodeFor(authErr), authErr.Error())
+		ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
+
+	c := &foxgloveClient{
+		conn: ws,
+		send: make(chan []byte, config.SendBuffer),
+		quit: make(chan struct{}),
+		subs: make(map[uint32]uint32),
+	}
+	foxglove.mu.Lock()
+	foxglove.clients[c] = struct{}{}
+	foxglove.mu.Unlock()
+	slog.Info("Foxglove client connected", "remote", r.RemoteAddr, "subject", claims.Subject)
+
+	defer func() {
+		foxglove.mu.Lock()
+		delete(foxglove.clients, c)
+		foxglove.mu.Unlock()
+		c.mu.Lock()
+		foxglove.subs.Add(-int32(len(c.subs)))
+		c.mu.Unlock()
+		close(c.quit)
+		ws.Close()
+		slog.Info("Foxglove client disconnected", "remote", r.RemoteAddr)
+	}()
+
+	go c.writeLoop()
+	c.readLoop()
+}
+
+// readLoop applies the client's subscribe and unsubscribe requests
+func (c *foxgloveClient) readLoop() {
+	c.conn.SetReadDeadline(time.Now().Add(config.ReadTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(config.ReadTimeout))
+		return nil
+	})
+	for {
+		msgType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(config.ReadTimeout))
+		if msgType != websocket.TextMessage {
+			continue
+		}
+		var req struct {
+			Op            string `json:"op"`
+			Subscriptions []struct {
+				ID        uint32 `json:"id"`
+				ChannelID uint32 `json:"channelId"`
+			} `json:"subscriptions"`
+			SubscriptionIDs []uint32 `json:"subscriptionIds"`
+		}
+		if json.Unmarshal(data, &req) != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		switch req.Op {
+		case "subscribe":
+			for _, s := range req.Subscriptions {
+				if _, ok := c.subs[s.ID]; !ok {
+					foxglove.subs.Add(1)
+				}
+				c.subs[s.ID] = s.ChannelID
+			}
+		case "unsubscribe":
+			for _, id := range req.SubscriptionIDs {
+				if _, ok := c.subs[id]; ok {
+					delete(c.subs, id)
+					foxglove.subs.Add(-1)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// writeLoop sends serverInfo and the channel list, then queued messages
+func (c *foxgloveClient) writeLoop() {
+	ticker := time.NewTicker(config.PingInterval)
+	defer ticker.Stop()
+
+	hello := []any{
+		map[string]any{
+			"op":           "serverInfo",
+			"name":         "teleop-relay",
+			"capabilities": []string{},
+		},
+		map[string]any{
+			"op":       "advertise",
+			"channels": foxgloveChannels,
+		},
+	}
+	for _, msg := range hello {
+		c.conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+		if c.conn.WriteJSON(msg) != nil {
+			c.conn.Close()
+			return
+		}
+	}
+
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+			if c.conn.WriteMessage(websocket.BinaryMessage, msg) != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+			if c.conn.WriteMessage(websocket.PingMessage, nil) != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// publish sends v as JSON to every subscription of channel
+func (s *FoxgloveServer) publish(channel uint32, v any) {
+	if s.subs.Load() == 0 {
+		return
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	now := uint64(time.Now().UnixNano())
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for c := range s.clients {
+		c.mu.Lock()
+		for subID, ch := range c.subs {
+			if ch != channel {
+				continue
+			}
+			msg := make([]byte, 13, 13+len(payload))
+			msg[0] = foxgloveOpMessageData
+			binary.LittleEndian.PutUint32(msg[1:5], subID)
+			binary.LittleEndian.PutUint64(msg[5:13], now)
+			select {
+			case c.send <- append(msg, payload...):
+			default:
+				metricDropped.WithLabelValues("foxglove", OverflowDropNewest).Inc()
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// publishTwist streams an 81-byte relay twist on /relay/twist
+func (s *FoxgloveServer) publishTwist(robotID string, twist []byte) {
+	if s.subs.Load() == 0 {
+		return
+	}
+	le := binary.LittleEndian
+	v := func(i int) float64 { return math.Float64frombits(le.Uint64(twist[17+8*i:])) }
+	s.publish(foxgloveChanTwist, foxgloveTwist{
+		RobotID:       robotID,
+		MsgID:         le.Uint64(twist[1:9]),
+		T1BrowserSend: le.Uint64(twist[9:17]),
+		T2RelayRx:     le.Uint64(twist[65:73]),
+		T3RelayTx:     le.Uint64(twist[73:81]),
+		Linear:        rosVector3{v(0), v(1), v(2)},
+		Angular:       rosVector3{v(3), v(4), v(5)},
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"go_relay/protocol"
+)
+
+// frameStream is a RelayService stream; each message is one binary frame
+type frameStream = grpc.BidiStreamingServer[wrapperspb.BytesValue, wrapperspb.BytesValue]
+
+// RelayService serves robot peers over gRPC, see relay.proto. There is no
+// generated code: the service descriptor below is what protoc would emit
+// for it, and messages are the well-known BytesValue.
+type RelayService struct{}
+
+// RelayServiceServer is the server interface protoc would generate
+type RelayServiceServer interface {
+	CommandStream(frameStream) error
+	AckStream(frameStream) error
+}
+
+var relayServiceDesc = grpc.ServiceDesc{
+	ServiceName: "teleop.relay.v1.RelayService",
+	HandlerType: (*RelayServiceServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "CommandStream",
+			Handler:       streamHandler(RelayServiceServer.CommandStream),
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "AckStream",
+			Handler:       streamHandler(RelayServiceServer.AckStream),
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "relay.proto",
+}
+
+func streamHandler(h func(RelayServiceServer, frameStream) error) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		return h(srv.(RelayServiceServer), &grpc.GenericServerStream[wrapperspb.BytesValue, wrapperspb.BytesValue]{ServerStream: stream})
+	}
+}
+
+// grpcServer is set by main when -grpc-addr is given
+var grpcServer *grpc.Server
+
+// serveGRPC runs RelayService on addr, with TLS when the relay has it
+func serveGRPC(addr string) error {
+	tlsConf, err := tlsConfig(config.TLS)
+	if err != nil {
+		return err
+	}
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    config.PingInterval,
+			Timeout: config.ReadTimeout - config.PingInterval,
+		}),
+	}
+	if tlsConf != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConf)))
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	grpcServer = grpc.NewServer(opts...)
+	grpcServer.RegisterService(&relayServiceDesc, &RelayService{})
+	slog.Info("gRPC listener", "addr", addr)
+	return grpcServer.Serve(lis)
+}
+
+// streamPeer reads the robot ID, token and peer metadata (client ID, room,
+// name, version, capabilities) from the stream's metadata
+func streamPeer(stream grpc.ServerStream) (robotID string, claims *Claims, meta PeerMeta, err error) {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	first := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	robotID = first("robot")
+	if robotID == "" {
+		robotID = protocol.DefaultRobotID
+	}
+	if len(robotID) > config.RobotIDMaxLen {
+		return "", nil, PeerMeta{}, status.Error(codes.InvalidArgument, "robot id too long")
+	}
+	if meta, err = parsePeerMeta(url.Values(md)); err != nil {
+		return "", nil, PeerMeta{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	robotID = roomRobotID(meta.Room, robotID)
+
+	remote := "grpc"
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		remote = p.Addr.String()
+	}
+	token := strings.TrimPrefix(first("authorization"), "Bearer ")
+	claims, err = auth.authorizeToken(token, remote, "python")
+	if err != nil {
+		code := codes.Unauthenticated
+		if errors.Is(err, errNoScope) {
+			code = codes.PermissionDenied
+		}
+		return "", nil, PeerMeta{}, status.Error(code, err.Error())
+	}
+	if meta.ClientID, err = auth.clientID(claims, meta.ClientID); err != nil {
+		return "", nil, PeerMeta{}, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return robotID, claims, meta, nil
+}
+
+// CommandStream registers the caller as the python peer for its robot and
+// serves it until either side ends the stream
+func (s *RelayService) CommandStream(stream frameStream) error {
+	if draining.Load() {
+		return status.Error(codes.Unavailable, "relay shutting down")
+	}
+	robotID, claims, meta, err := streamPeer(stream)
+	if err != nil {
+		return err
+	}
+
+	t := newGRPCTransport(stream)
+	peer := newPeer("python", robotID, claims.Subject, t)
+	peer.Meta = meta
+	servePeer(peer)
+	return t.status()
+}
+
+// AckStream feeds the robot's acks into its CommandStream session
+func (s *RelayService) AckStream(stream frameStream) error {
+	robotID, _, _, err := streamPeer(stream)
+	if err != nil {
+		return err
+	}
+	var t *grpcTransport
+	if python := manager.getPython(robotID); python != nil {
+		t, _ = python.Conn.(*grpcTransport)
+	}
+	if t == nil {
+		return status.Error(codes.FailedPrecondition, "no CommandStream for robot "+robotID)
+	}
+
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			if !t.deliver(msg.Value) {
+				return
+			}
+		}
+	}()
+	select {
+	case <-t.done:
+	case <-stream.Context().Done():
+	}
+	return nil
+}
+
+// grpcTransport is a Transport over a CommandStream plus any AckStream
+type grpcTransport struct {
+	stream frameStream
+
+	in       chan []byte // CommandStream and AckStream frames, merged
+	done     chan struct{}
+	failOnce sync.Once
+	err      error
+}
+
+func newGRPCTransport(stream frameStream) *grpcTransport {
+	t := &grpcTransport{
+		stream: stream,
+		in:     make(chan []byte, 64),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				t.fail(err)
+				return
+			}
+			if !t.deliver(msg.Value) {
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func (t *grpcTransport) fail(err error) {
+	t.failOnce.Do(func() {
+		t.err = err
+		close(t.done)
+	})
+}
+
+func (t *grpcTransport) deliver(frame []byte) bool {
+	select {
+	case t.in <- frame:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// status is what CommandStream returns once the session is over
+func (t *grpcTransport) status() error {
+	<-t.done
+	if s, ok := status.FromError(t.err); ok && s.Code() == codes.Unavailable {
+		return t.err // closed by the relay
+	}
+	return nil
+}
+
+func (t *grpcTransport) ReadFrame() ([]byte, error) {
+	select {
+	case frame := <-t.in:
+		return frame, nil
+	case <-t.done:
+		return nil, t.err
+	}
+}
+
+func (t *grpcTransport) WriteFrame(msg, trailer []byte) error {
+	frame := make([]byte, 0, len(msg)+len(trailer))
+	frame = append(append(frame, msg...), trailer...)
+	return t.stream.Send(&wrapperspb.BytesValue{Value: frame})
+}
+
+// Ping is a no-op: HTTP/2 keepalives, set from -ping-interval and
+// -read-timeout, already detect dead robots
+func (t *grpcTransport) Ping() error {
+	return t.stream.Context().Err()
+}
+
+// Shutdown ends the CommandStream with UNAVAILABLE and the reason
+func (t *grpcTransport) Shutdown(code int, reason string) {
+	t.fail(status.Error(codes.Unavailable, reason))
+}
+
+func (t *grpcTransport) Close() error {
+	t.fail(net.ErrClosed)
+	return nil
+}
+
+func (t *grpcTransport) RemoteAddr() string {
+	if p, ok := peer.FromContext(t.stream.Context()); ok {
+		return p.Addr.String()
+	}
+	return "grpc"
+}
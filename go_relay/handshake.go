@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"go_relay/protocol"
+)
+
+// ProtocolVersion is the highest wire protocol version this relay speaks.
+// Version 2 adds the Session handshake.
+const ProtocolVersion = 2
+
+// Feature bits exchanged in Hello/Welcome
+const (
+	// FeatureRobotTrailer: twists and acks carry the robot ID trailer
+	FeatureRobotTrailer uint32 = 1 << 0
+	// FeatureRelayTimestamps: twists to Python carry t2/t3 (81 bytes),
+	// acks to browsers carry t4/t5 (77 bytes) and odometry to browsers its
+	// relay receive/send times (129 bytes)
+	FeatureRelayTimestamps uint32 = 1 << 1
+	// FeatureCRC32: every frame except Hello/Welcome ends in a CRC32 of
+	// the preceding bytes, in both directions
+	FeatureCRC32 uint32 = 1 << 2
+	// FeatureHops: twists to and acks from a downstream relay end in a
+	// hop block, see federation.go
+	FeatureHops uint32 = 1 << 3
+	// FeatureTraceContext: twists and acks end in a trace block carrying
+	// the sender's OpenTelemetry span, see tracing.go
+	FeatureTraceContext uint32 = 1 << 4
+	// FeatureSession: the Welcome is followed by a binary Session frame
+	// the peer answers with a Session Ack; version 2 and up
+	FeatureSession uint32 = 1 << 5
+	// FeatureCBOR: every frame after the Welcome, in both directions, uses
+	// the CBOR encoding profile (protocol.ToCBOR); implies robot trailers
+	// and relay timestamps and excludes hop and trace blocks
+	FeatureCBOR uint32 = 1 << 6
+	// FeatureProtobuf: like FeatureCBOR, with the protobuf profile of
+	// frames.proto (protocol.ToProto); CBOR wins if both are offered
+	FeatureProtobuf uint32 = 1 << 7
+	// FeatureBatch: the peer accepts Batch frames packing several twists
+	// or acks (protocol.SplitBatch) and may send them; binary layouts only
+	FeatureBatch uint32 = 1 << 8
+	// FeatureRelaySeq: twists to and acks to the peer carry the relay's
+	// per-robot sequence number, see relayseq.go; binary layouts only
+	FeatureRelaySeq uint32 = 1 << 9
+
+	supportedFeatures = FeatureRobotTrailer | FeatureRelayTimestamps | FeatureCRC32 | FeatureHops | FeatureTraceContext | FeatureSession | FeatureCBOR | FeatureProtobuf | FeatureBatch | FeatureRelaySeq
+
+	// profileFeatures replace the binary layouts with another encoding
+	profileFeatures = FeatureCBOR | FeatureProtobuf
+)
+
+// Codec encodes relay-built frames for one peer according to what it
+// negotiated. Peers that never send Hello get legacyCodec, which is
+// exactly what the relay sent before the handshake existed.
+type Codec struct {
+	Version  byte
+	Features uint32
+}
+
+var legacyCodec = &Codec{Version: 0, Features: FeatureRobotTrailer | FeatureRelayTimestamps}
+
+func (c *Codec) has(f uint32) bool { return c.Features&f != 0 }
+
+// twist encodes an 81-byte relay twist for a Python peer
+func (c *Codec) twist(frame []byte, robotID string) []byte {
+	return c.appendTwist(nil, frame, robotID)
+}
+
+// ack encodes a 77-byte relay ack for a browser; without relay timestamps
+// it keeps Python's 69-byte layout (t4 stays in the reserved field)
+func (c *Codec) ack(frame []byte, robotID string) []byte {
+	return c.appendAck(nil, frame, robotID)
+}
+
+// appendTwist is twist appending to dst, for pooled frames
+func (c *Codec) appendTwist(dst, frame []byte, robotID string) []byte {
+	size := protocol.TwistBrowserSize
+	if c.has(FeatureRelayTimestamps) {
+		size = protocol.TwistToPythonSize
+	}
+	return c.appendFrame(dst, frame[:size], robotID)
+}
+
+// appendAck is ack appending to dst, for pooled frames
+func (c *Codec) appendAck(dst, frame []byte, robotID string) []byte {
+	size := protocol.AckFromPythonSize
+	if c.has(FeatureRelayTimestamps) {
+		size = protocol.AckToBrowserSize
+	}
+	return c.appendFrame(dst, frame[:size], robotID)
+}
+
+// appendOdometry encodes a 129-byte relay odometry frame for a browser;
+// without relay timestamps it keeps the robot's 113-byte layout
+func (c *Codec) appendOdometry(dst, frame []byte, robotID string) []byte {
+	size := protocol.OdometryFromPythonSize
+	if c.has(FeatureRelayTimestamps) {
+		size = protocol.OdometryToBrowserSize
+	}
+	return c.appendFrame(dst, frame[:size], robotID)
+}
+
+func (c *Codec) appendFrame(dst, frame []byte, robotID string) []byte {
+	dst = append(dst, frame...)
+	if c.has(FeatureRobotTrailer) {
+		dst = protocol.AppendRobotTrailer(dst, bareRobotID(robotID))
+	}
+	return dst
+}
+
+// layout identifies the features that change how twists and acks are
+// encoded, so peers sharing it can share one encoded frame; it is below 16
+func (c *Codec) layout() uint32 {
+	l := c.Features & (FeatureRobotTrailer | FeatureRelayTimestamps)
+	if c.has(FeatureTraceContext) {
+		l |= 1 << 2
+	}
+	if c.has(FeatureRelaySeq) {
+		l |= 1 << 3
+	}
+	return l
+}
+
+// usesProfile reports whether a frame of type t to or from peer is in
+// the CBOR or protobuf profile. Hello and Welcome stay binary, as with
+// CRCs; neither profile's frames can start with a Hello's first byte.
+// Everything else is transcoded at the edge, so profile and binary peers
+// mix freely: CRCs cover the encoded bytes, and frames that fail to decode
+// are rejected with a Protocol Error.
+func (p *Peer) usesProfile(t byte) bool {
+	return t != protocol.MsgTypeHello && t != protocol.MsgTypeWelcome && p.codec().has(profileFeatures)
+}
+
+// encodeProfile transcodes a relay-built frame into the peer's profile
+func (c *Codec) encodeProfile(frame []byte) ([]byte, error) {
+	if c.has(FeatureProtobuf) {
+		return protocol.ToProto(frame, true)
+	}
+	return protocol.ToCBOR(frame, true)
+}
+
+// decodeProfile transcodes a frame from the peer back into its binary
+// layout
+func (c *Codec) decodeProfile(data []byte) ([]byte, error) {
+	if c.has(FeatureProtobuf) {
+		return protocol.FromProto(data, false)
+	}
+	return protocol.FromCBOR(data, false)
+}
+
+// codec returns the peer's negotiated codec
+func (p *Peer) codec() *Codec {
+	if c := p.proto.Load(); c != nil {
+		return c
+	}
+	return legacyCodec
+}
+
+// handleHello negotiates the lower of both versions and the common
+// features, then answers with a Welcome; from then on the frames the
+// relay builds for the peer follow its codec
+func handleHello(peer *Peer, data []byte) {
+	hello, err := protocol.UnmarshalHello(data)
+	if err != nil {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.HelloSize)
+		return
+	}
+	if hello.Version == 0 {
+		peer.logger().Warn("Hello with version 0", "msg_type", "hello")
+		return
+	}
+	codec := negotiate(hello.Version, hello.Features)
+	peer.proto.Store(codec)
+
+	peer.send(protocol.Hello{Welcome: true, Version: codec.Version, Features: codec.Features}.Marshal())
+	if codec.has(FeatureSession) {
+		peer.send(encodeSession(peer, codec.Version))
+	}
+
+	peer.logger().Info("Protocol negotiated", "version", codec.Version, "features", codec.Features)
+}
+
+// negotiate returns the codec for a Hello offering version and features
+func negotiate(version byte, features uint32) *Codec {
+	codec := &Codec{
+		Version:  min(version, ProtocolVersion),
+		Features: features & supportedFeatures,
+	}
+	if codec.Version < 2 {
+		codec.Features &^= FeatureSession
+	}
+	if codec.has(FeatureCBOR) {
+		codec.Features &^= FeatureProtobuf
+	}
+	if codec.has(profileFeatures) {
+		codec.Features |= FeatureRobotTrailer | FeatureRelayTimestamps
+		codec.Features &^= FeatureHops | FeatureTraceContext | FeatureBatch | FeatureRelaySeq
+	}
+	return codec
+}
+
+// encodeSession builds the binary welcome sent right after the Welcome
+// to peers with FeatureSession: the negotiated version, uint64 relay time
+// ms, then the peer ID, robot ID and resumption token the JSON welcome
+// would carry, each behind a length byte. WebSocket peers that negotiate
+// it may connect with ?welcome=binary and skip the JSON welcome.
+func encodeSession(peer *Peer, version byte) []byte {
+	robotID := bareRobotID(manager.robotFor(peer))
+	frame := make([]byte, 10, protocol.SessionMinSize+len(peer.ID)+len(robotID)+len(peer.resumeToken))
+	frame[0] = protocol.MsgTypeSession
+	frame[1] = version
+	binary.LittleEndian.PutUint64(frame[2:10], currentTimeMs())
+	frame = append(frame, byte(len(peer.ID)))
+	frame = append(frame, peer.ID...)
+	frame = append(frame, byte(len(robotID)))
+	frame = append(frame, robotID...)
+	frame = append(frame, byte(len(peer.resumeToken)))
+	return append(frame, peer.resumeToken...)
+}
+
+// handleSessionAck completes the Session handshake. The echoed relay time
+// and the peer's clock make one more clock sample, as a beacon reply does.
+func handleSessionAck(peer *Peer, data []byte) {
+	t4 := currentTimeMs()
+	if len(data) < protocol.SessionAckSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.SessionAckSize)
+		return
+	}
+	if !peer.codec().has(FeatureSession) || !peer.session.CompareAndSwap(false, true) {
+		return
+	}
+	t1 := int64(binary.LittleEndian.Uint64(data[1:9]))
+	t2 := int64(binary.LittleEndian.Uint64(data[9:17]))
+	rtt := float64(int64(t4) - t1)
+	peer.clock.add(t4, float64((t2-t1)+(t2-int64(t4)))/2, rtt)
+	peer.logger().Info("Session established", "rtt_ms", rtt)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// RobotReadiness is one connected robot as judged by /health/ready
+type RobotReadiness struct {
+	ID        string  `json:"id"`
+	Ready     bool    `json:"ready"`
+	AckAgeSec float64 `json:"ack_age_s,omitempty"` // omitted until the first ack
+}
+
+// readiness reports which connected robots acked within -ready-ack-age,
+// only robotID if it is not empty
+func readiness(robotID string) []RobotReadiness {
+	now := time.Now()
+	robots := make([]RobotReadiness, 0)
+	for _, info := range manager.robotStates() {
+		if info.State != "connected" || (robotID != "" && info.ID != robotID) {
+			continue
+		}
+		r := RobotReadiness{ID: info.ID}
+		if info.LastAck != nil {
+			age := now.Sub(*info.LastAck)
+			r.AckAgeSec = age.Seconds()
+			r.Ready = age <= config.ReadyAckAge
+		}
+		robots = append(robots, r)
+	}
+	return robots
+}
+
+// handleReady serves GET /health/ready for readiness probes: 200 while a
+// robot peer is connected and its robot acked within -ready-ack-age (the
+// given one with ?robot=), 503 otherwise and while draining
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	robots := readiness(r.URL.Query().Get("robot"))
+	reason := ""
+	switch {
+	case draining.Load():
+		reason = "draining"
+	case len(robots) == 0:
+		reason = "no robot connected"
+	default:
+		reason = "no recent ack"
+		for _, robot := range robots {
+			if robot.Ready {
+				reason = ""
+				break
+			}
+		}
+	}
+
+	body := map[string]interface{}{
+		"status":          "ready",
+		"ready_ack_age_s": config.ReadyAckAge.Seconds(),
+		"robots":          robots,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if reason != "" {
+		body["status"], body["reason"] = "not_ready", reason
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// handleLive serves GET /health/live for liveness probes: the process is
+// up and serving HTTP, whatever its robots are doing
+func handleLive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ok",
+		"time":   currentTimeMs(),
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Heartbeat overrides the WebSocket keepalive for one peer type. Zero
+// fields fall back to ping_interval, pong_timeout and write_timeout. The
+// defaults take a minute to notice a dead peer; robots usually want
+// something like {ping_interval: 1s, pong_timeout: 2s}.
+type Heartbeat struct {
+	PingInterval time.Duration `yaml:"ping_interval"`
+	PongTimeout  time.Duration `yaml:"pong_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+}
+
+func (h Heartbeat) validate() error {
+	if h.PingInterval < 0 || h.PongTimeout < 0 || h.WriteTimeout < 0 {
+		return errors.New("durations must not be negative")
+	}
+	return nil
+}
+
+// heartbeatFor returns the keepalive settings for peers of peerType
+func (c *Config) heartbeatFor(peerType string) Heartbeat {
+	h := c.Heartbeats[peerType]
+	if h.PingInterval == 0 {
+		h.PingInterval = c.PingInterval
+	}
+	if h.PongTimeout == 0 {
+		h.PongTimeout = c.PongTimeout
+	}
+	if h.WriteTimeout == 0 {
+		h.WriteTimeout = c.WriteTimeout
+	}
+	return h
+}
+
+// validHeartbeats checks heartbeats' peer types and settings
+func (c *Config) validHeartbeats() error {
+	for t, h := range c.Heartbeats {
+		if !knownPeerType(t) {
+			return fmt.Errorf("heartbeats: unknown peer type %q", t)
+		}
+		if err := h.validate(); err != nil {
+			return fmt.Errorf("heartbeats[%s]: %w", t, err)
+		}
+		if h := c.heartbeatFor(t); h.PingInterval >= c.ReadTimeout {
+			return fmt.Errorf("heartbeats[%s]: read_timeout must exceed ping_interval", t)
+		}
+	}
+	return nil
+}
+
+// pinged counts a ping about to be sent to a WebSocket peer and arms its
+// pong deadline; other transports keep themselves alive
+func (p *Peer) pinged() {
+	if _, ok := p.Conn.(*wsTransport); !ok || p.heartbeat.PongTimeout <= 0 {
+		return
+	}
+	n := p.pings.Add(1)
+	time.AfterFunc(p.heartbeat.PongTimeout, func() {
+		if p.pongs.Load() < n {
+			p.missedPong()
+		}
+	})
+}
+
+// missedPong drops a peer that left a ping unanswered for its pong
+// timeout. A silent primary robot fails over as unresponsive; closing
+// the connection then runs the usual disconnect handling, which trips
+// the deadman of a robot whose driver this was.
+func (p *Peer) missedPong() {
+	if manager.getPeer(p.ID) != p {
+		return // gone meanwhile
+	}
+	metricMissedPongs.WithLabelValues(p.Type).Inc()
+	p.logger().Warn("Missed pong, closing peer", "pong_timeout", p.heartbeat.PongTimeout)
+	if p.isRobot() && config.FailoverTimeout > 0 {
+		failover(p.RobotID, p, FailoverUnresponsive)
+	}
+	p.Conn.Close()
+}
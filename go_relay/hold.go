@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HoldQueue buffers commands for robots whose robot peer dropped within
+// the last -reconnect-grace, so a brief Wi-Fi blip doesn't lose them.
+// When the robot reconnects the held commands are forwarded in order
+// (still subject to -max-command-age); when the grace window runs out
+// they are discarded with a Nack.
+type HoldQueue struct {
+	mu     sync.Mutex
+	robots map[string]*heldRobot
+}
+
+type heldRobot struct {
+	timer *time.Timer
+	cmds  []heldCommand
+}
+
+type heldCommand struct {
+	source string
+	msgID  uint64
+	joy    bool
+	web    bool // from a web peer, so only delivered while it drives
+	data   []byte
+	t2     uint64
+	hops   []HopRecord
+}
+
+var holds = &HoldQueue{robots: make(map[string]*heldRobot)}
+
+// robotDown opens robotID's grace window after its robot peer left
+func (h *HoldQueue) robotDown(robotID string) {
+	if config.ReconnectGrace <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.robots[robotID] != nil {
+		return
+	}
+	r := &heldRobot{}
+	r.timer = time.AfterFunc(config.ReconnectGrace, func() { h.expire(robotID, r) })
+	h.robots[robotID] = r
+}
+
+// hold buffers a command for robotID if it is within its grace window,
+// reporting whether it did. A full buffer (-hold-buffer) gives up its
+// oldest command.
+func (h *HoldQueue) hold(robotID, source string, msgID uint64, joy bool, data []byte, t2 uint64, hops []HopRecord) bool {
+	src := manager.getPeer(source)
+	h.mu.Lock()
+	r := h.robots[robotID]
+	if r == nil {
+		h.mu.Unlock()
+		return false
+	}
+	var dropped *heldCommand
+	if len(r.cmds) >= config.HoldBuffer {
+		oldest := r.cmds[0]
+		dropped = &oldest
+		r.cmds = r.cmds[1:]
+	}
+	r.cmds = append(r.cmds, heldCommand{
+		source: source,
+		msgID:  msgID,
+		joy:    joy,
+		web:    src != nil && src.watchesRobot(),
+		data:   append([]byte(nil), data...),
+		t2:     t2,
+		hops:   hops,
+	})
+	h.mu.Unlock()
+
+	metricHeldCommands.WithLabelValues("held").Inc()
+	if dropped != nil {
+		metricHeldCommands.WithLabelValues("overflow").Inc()
+		sendNack(dropped.source, dropped.msgID, NackHoldFull)
+	}
+	return true
+}
+
+// robotUp closes robotID's grace window and forwards what it held, unless
+// the robot was e-stopped or the sender stopped driving meanwhile
+func (h *HoldQueue) robotUp(robotID string) {
+	h.mu.Lock()
+	r := h.robots[robotID]
+	delete(h.robots, robotID)
+	h.mu.Unlock()
+	if r == nil {
+		return
+	}
+	r.timer.Stop()
+	if len(r.cmds) > 0 {
+		slog.Info("Flushing held commands", "robot_id", robotID, "count", len(r.cmds))
+	}
+	for _, c := range r.cmds {
+		switch {
+		case estops.engaged(robotID):
+			sendNack(c.source, c.msgID, NackEStopped)
+		case c.web && arbiter.driver(robotID) != c.source:
+			sendNack(c.source, c.msgID, NackNotDriver)
+		case c.joy:
+			forwardJoy(robotID, c.source, c.data, c.t2)
+		default:
+			forwardTwistHops(robotID, c.source, c.data, c.t2, c.hops, trace.SpanContext{})
+		}
+	}
+	metricHeldCommands.WithLabelValues("flushed").Add(float64(len(r.cmds)))
+}
+
+// clear discards robotID's held commands, telling their senders why
+func (h *HoldQueue) clear(robotID string, reason byte) {
+	h.mu.Lock()
+	var cmds []heldCommand
+	if r := h.robots[robotID]; r != nil {
+		cmds, r.cmds = r.cmds, nil
+	}
+	h.mu.Unlock()
+	for _, c := range cmds {
+		sendNack(c.source, c.msgID, reason)
+	}
+}
+
+// expire ends r's grace window if the robot has not reconnected
+func (h *HoldQueue) expire(robotID string, r *heldRobot) {
+	h.mu.Lock()
+	if h.robots[robotID] != r {
+		h.mu.Unlock()
+		return
+	}
+	delete(h.robots, robotID)
+	h.mu.Unlock()
+	if len(r.cmds) > 0 {
+		slog.Warn("Robot did not reconnect, dropping held commands", "robot_id", robotID, "count", len(r.cmds))
+	}
+	for _, c := range r.cmds {
+		sendNack(c.source, c.msgID, NackHoldExpired)
+	}
+	metricHeldCommands.WithLabelValues("expired").Add(float64(len(r.cmds)))
+}
+
+// snapshot returns the number of held commands per robot in its grace window
+func (h *HoldQueue) snapshot() map[string]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]int, len(h.robots))
+	for robotID, r := range h.robots {
+		out[robotID] = len(r.cmds)
+	}
+	return out
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+// withHoldConfig runs the test under the given grace window and buffer
+func withHoldConfig(t *testing.T, grace time.Duration, buffer int) {
+	cfg := *config
+	cfg.ReconnectGrace, cfg.HoldBuffer = grace, buffer
+	prev := config
+	config = &cfg
+	t.Cleanup(func() { config = prev })
+}
+
+func TestHoldQueueBuffers(t *testing.T) {
+	tests := []struct {
+		name     string
+		grace    time.Duration
+		buffer   int
+		down     bool // robot r1 dropped before the commands
+		commands int
+		wantHeld bool
+		wantIDs  []uint64 // held for r1, oldest first
+	}{
+		{"grace off", 0, 8, true, 2, false, nil},
+		{"robot never dropped", time.Minute, 8, false, 2, false, nil},
+		{"held in order", time.Minute, 8, true, 3, true, []uint64{1, 2, 3}},
+		{"full buffer gives up the oldest", time.Minute, 2, true, 5, true, []uint64{4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withHoldConfig(t, tt.grace, tt.buffer)
+			h := &HoldQueue{robots: make(map[string]*heldRobot)}
+			if tt.down {
+				h.robotDown("r1")
+			}
+			for id := range uint64(tt.commands) {
+				if held := h.hold("r1", "driver", id+1, false, []byte{1}, 0, nil); held != tt.wantHeld {
+					t.Fatalf("hold = %v, want %v", held, tt.wantHeld)
+				}
+			}
+			var ids []uint64
+			if r := h.robots["r1"]; r != nil {
+				for _, c := range r.cmds {
+					ids = append(ids, c.msgID)
+				}
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("held %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestHoldQueueWindowCloses(t *testing.T) {
+	withHoldConfig(t, 20*time.Millisecond, 8)
+	h := &HoldQueue{robots: make(map[string]*heldRobot)}
+	h.robotDown("lost")
+	h.robotDown("back")
+	h.hold("lost", "driver", 1, false, []byte{1}, 0, nil)
+
+	h.robotUp("back")
+	if got := h.snapshot(); !maps.Equal(got, map[string]int{"lost": 1}) {
+		t.Fatalf("after reconnect: %v", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got := h.snapshot(); len(got) != 0 {
+		t.Fatalf("grace window still open after it ran out: %v", got)
+	}
+	if h.hold("lost", "driver", 2, false, []byte{1}, 0, nil) {
+		t.Error("command held after the window closed")
+	}
+}
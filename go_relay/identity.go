@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Peer IDs are random UUIDs, unique per connection. A client that wants
+// to be recognisable across connections (an operator's browser, a robot
+// after a reboot) also names a stable client ID with ?client_id= or the
+// client_id gRPC metadata key. The relay logs it with every peer log
+// line, lists it in /admin/peers, tags the peer's records in session
+// recordings with it and counts connections per client ID.
+//
+// With auth enabled a client ID must be vouched for by the token: a
+// token with a client_id claim pins the peer to that ID (which it then
+// need not send), any other token allows only its own subject.
+
+// maxClientIDLen bounds client IDs, as recordings store a uint8 length
+const maxClientIDLen = 64
+
+var errClientID = errors.New("client_id not permitted by token")
+
+func newPeerID() string {
+	return uuid.NewString()
+}
+
+// validClientID checks a client ID's length and characters: ASCII
+// letters, digits and . _ - : @
+func validClientID(id string) error {
+	if len(id) > maxClientIDLen {
+		return fmt.Errorf("client_id longer than %d bytes", maxClientIDLen)
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '-', c == ':', c == '@':
+		default:
+			return fmt.Errorf("client_id has invalid character %q", c)
+		}
+	}
+	return nil
+}
+
+// clientID returns the client ID a peer authorized by claims goes by,
+// given the one it asked for (possibly ""); with auth disabled that is
+// whatever it asked for
+func (a *Authenticator) clientID(claims *Claims, requested string) (string, error) {
+	if !a.enabled() {
+		return requested, nil
+	}
+	switch {
+	case claims.ClientID != "" && (requested == "" || requested == claims.ClientID):
+		return claims.ClientID, nil
+	case claims.ClientID == "" && (requested == "" || requested == claims.Subject):
+		return requested, nil
+	}
+	return "", errClientID
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// active records an application message from the peer: a binary frame
+// or signaling, but not a pong
+func (p *Peer) active() {
+	p.lastMessage.Store(relayTime())
+}
+
+// idleFor returns how long the peer has sent no application message
+func (p *Peer) idleFor() time.Duration {
+	return time.Duration(relayTime()-p.lastMessage.Load()) * time.Millisecond
+}
+
+// watchIdlePeers closes web and observer peers that have sent nothing
+// but pongs for longer than timeout. Robot peers only answer, so they
+// are left to the heartbeat.
+func watchIdlePeers(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, p := range manager.allPeers() {
+			if !p.watchesRobot() || p.idleFor() < timeout {
+				continue
+			}
+			select {
+			case <-p.quit:
+				continue // already closing
+			default:
+			}
+			metricIdleClosed.WithLabelValues(p.Type).Inc()
+			p.logger().Info("Idle peer closed", "idle_for", p.idleFor().Round(time.Second))
+			p.close(websocket.CloseNormalClosure, "idle timeout")
+		}
+	}
+}
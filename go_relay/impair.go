@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// Impairment degrades one direction of the relay on purpose, for
+// experiments: frames are dropped with probability Loss, the rest held
+// for Delay plus a Jitter sample before the relay handles them.
+type Impairment struct {
+	Delay        time.Duration `yaml:"delay"`
+	Jitter       time.Duration `yaml:"jitter"`       // uniform: ±Jitter, normal: standard deviation
+	Distribution string        `yaml:"distribution"` // uniform (default) or normal
+	Loss         float64       `yaml:"loss"`         // 0..1
+}
+
+// impairmentJSON is Impairment on the admin endpoint, in milliseconds
+type impairmentJSON struct {
+	DelayMs      float64 `json:"delay_ms"`
+	JitterMs     float64 `json:"jitter_ms"`
+	Distribution string  `json:"distribution"`
+	Loss         float64 `json:"loss"`
+}
+
+func (i Impairment) MarshalJSON() ([]byte, error) {
+	return json.Marshal(impairmentJSON{
+		DelayMs:      float64(i.Delay) / float64(time.Millisecond),
+		JitterMs:     float64(i.Jitter) / float64(time.Millisecond),
+		Distribution: i.Distribution,
+		Loss:         i.Loss,
+	})
+}
+
+func (i *Impairment) UnmarshalJSON(data []byte) error {
+	var j impairmentJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j.Distribution == "" {
+		j.Distribution = "uniform"
+	}
+	*i = Impairment{
+		Delay:        time.Duration(j.DelayMs * float64(time.Millisecond)),
+		Jitter:       time.Duration(j.JitterMs * float64(time.Millisecond)),
+		Distribution: j.Distribution,
+		Loss:         j.Loss,
+	}
+	return nil
+}
+
+// String and Set make Impairment a flag value:
+// delay=100ms,jitter=20ms,distribution=normal,loss=0.05
+func (i *Impairment) String() string {
+	if i == nil || !i.active() {
+		return ""
+	}
+	return fmt.Sprintf("delay=%s,jitter=%s,distribution=%s,loss=%g", i.Delay, i.Jitter, i.Distribution, i.Loss)
+}
+
+func (i *Impairment) Set(spec string) error {
+	next := Impairment{Distribution: "uniform"}
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(field, "=")
+		var err error
+		switch key {
+		case "delay":
+			next.Delay, err = time.ParseDuration(value)
+		case "jitter":
+			next.Jitter, err = time.ParseDuration(value)
+		case "distribution", "dist":
+			next.Distribution = value
+		case "loss":
+			next.Loss, err = strconv.ParseFloat(value, 64)
+		default:
+			return fmt.Errorf("unknown impairment setting %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	*i = next
+	return nil
+}
+
+func (i Impairment) validate() error {
+	switch {
+	case i.Delay < 0 || i.Jitter < 0:
+		return fmt.Errorf("delay and jitter must not be negative")
+	case i.Loss < 0 || i.Loss > 1:
+		return fmt.Errorf("loss must be between 0 and 1")
+	case i.Distribution != "" && i.Distribution != "uniform" && i.Distribution != "normal":
+		return fmt.Errorf("distribution must be uniform or normal")
+	}
+	return nil
+}
+
+func (i Impairment) active() bool {
+	return i.Delay > 0 || i.Jitter > 0 || i.Loss > 0
+}
+
+// sample decides one frame's fate: dropped, or held for the returned delay
+func (i Impairment) sample() (time.Duration, bool) {
+	if i.Loss > 0 && rand.Float64() < i.Loss {
+		return 0, true
+	}
+	delay := i.Delay
+	if i.Jitter > 0 {
+		if i.Distribution == "normal" {
+			delay += time.Duration(rand.NormFloat64() * float64(i.Jitter))
+		} else {
+			delay += time.Duration((2*rand.Float64() - 1) * float64(i.Jitter))
+		}
+	}
+	return max(delay, 0), false
+}
+
+// ImpairmentConfig holds both directions. Uplink is every frame from web
+// and observer peers (twists, Joy, control), downlink every frame from
+// robot peers (acks, telemetry, media).
+type ImpairmentConfig struct {
+	Uplink   Impairment `yaml:"uplink" json:"uplink"`
+	Downlink Impairment `yaml:"downlink" json:"downlink"`
+}
+
+func (c ImpairmentConfig) validate() error {
+	if err := c.Uplink.validate(); err != nil {
+		return fmt.Errorf("uplink: %w", err)
+	}
+	if err := c.Downlink.validate(); err != nil {
+		return fmt.Errorf("downlink: %w", err)
+	}
+	return nil
+}
+
+// Impairer applies the current ImpairmentConfig; main seeds it from the
+// config and /admin/impairment changes it at runtime. Held frames keep
+// their order, so jitter never reorders a peer's frames, and E-Stops are
+// never impaired.
+type Impairer struct {
+	mu  sync.RWMutex
+	cfg ImpairmentConfig
+}
+
+var impairer = &Impairer{cfg: noImpairment()}
+
+// noImpairment leaves both directions alone
+func noImpairment() ImpairmentConfig {
+	return ImpairmentConfig{
+		Uplink:   Impairment{Distribution: "uniform"},
+		Downlink: Impairment{Distribution: "uniform"},
+	}
+}
+
+func (im *Impairer) get() ImpairmentConfig {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+	return im.cfg
+}
+
+func (im *Impairer) set(cfg ImpairmentConfig) {
+	im.mu.Lock()
+	im.cfg = cfg
+	im.mu.Unlock()
+	if cfg.Uplink.active() || cfg.Downlink.active() {
+		slog.Warn("Network impairment enabled", "uplink", cfg.Uplink.String(), "downlink", cfg.Downlink.String())
+	} else {
+		slog.Info("Network impairment disabled")
+	}
+}
+
+// forPeer returns the impairment of frames read from peer and its
+// direction's name
+func (im *Impairer) forPeer(peer *Peer) (Impairment, string) {
+	cfg := im.get()
+	if peer.isRobot() {
+		return cfg.Downlink, "downlink"
+	}
+	return cfg.Uplink, "uplink"
+}
+
+// impairedFrame is a frame read from a peer, to be handled at "at"
+type impairedFrame struct {
+	at   time.Time
+	data []byte
+}
+
+// impairedLine delays one peer's inbound frames in order. Once a peer has
+// one, every later frame passes through it, so frames are never handled
+// out of order or concurrently.
+type impairedLine struct {
+	frames chan impairedFrame
+	last   time.Time // latest scheduled time, which later frames never precede
+}
+
+// impair routes a frame read from peer through the impairment layer. It
+// reports false when the reader should handle the frame itself. E-Stops
+// are never impaired.
+func impair(peer *Peer, data []byte) bool {
+	if len(data) > 0 && data[0] == protocol.MsgTypeEStop {
+		return false
+	}
+	imp, direction := impairer.forPeer(peer)
+	if !imp.active() && peer.impaired == nil {
+		return false
+	}
+
+	delay, drop := imp.sample()
+	if drop {
+		metricImpaired.WithLabelValues(direction, "dropped").Inc()
+		return true
+	}
+	line := peer.impaired
+	if line == nil {
+		line = &impairedLine{frames: make(chan impairedFrame, config.SendBuffer)}
+		peer.impaired = line
+		go line.run(peer)
+	}
+	at := time.Now().Add(delay)
+	if at.Before(line.last) {
+		at = line.last
+	}
+	select {
+	case line.frames <- impairedFrame{at: at, data: append([]byte(nil), data...)}:
+		line.last = at
+		if delay > 0 {
+			metricImpaired.WithLabelValues(direction, "delayed").Inc()
+		}
+	default:
+		metricImpaired.WithLabelValues(direction, "overflow").Inc()
+	}
+	return true
+}
+
+func (l *impairedLine) run(peer *Peer) {
+	for f := range l.frames {
+		time.Sleep(time.Until(f.at))
+		handleBinary(peer, f.data)
+	}
+}
+
+// close stops the line once its queued frames are handled; called by the
+// reader when it exits
+func (l *impairedLine) close() {
+	if l != nil {
+		close(l.frames)
+	}
+}
+
+// handleImpairmentGet serves GET /admin/impairment
+func handleImpairmentGet(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(impairer.get())
+}
+
+// handleImpairmentPut serves PUT /admin/impairment: the directions given
+// in the body replace the current ones
+func handleImpairmentPut(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Uplink   *Impairment `json:"uplink"`
+		Downlink *Impairment `json:"downlink"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	cfg := impairer.get()
+	if req.Uplink != nil {
+		cfg.Uplink = *req.Uplink
+	}
+	if req.Downlink != nil {
+		cfg.Downlink = *req.Downlink
+	}
+	if err := cfg.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	impairer.set(cfg)
+	handleImpairmentGet(w, r)
+}
+
+// handleImpairmentDelete serves DELETE /admin/impairment: both
+// directions back to normal
+func handleImpairmentDelete(w http.ResponseWriter, r *http.Request) {
+	impairer.set(noImpairment())
+	handleImpairmentGet(w, r)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"math"
+
+	"go_relay/protocol"
+)
+
+// Joy frames carry raw joystick axes and buttons for robots that do their
+// own mixing. The browser layout is protocol.JoyHeaderSize plus 4 bytes per axis;
+// toward Python the relay appends t2/t3 as it does to twists, then the
+// robot trailer.
+const MaxJoyAxes = 16
+
+// joySize returns the length of a Joy frame's layout before any trailer,
+// or 0 if data is too short for the axis count it declares
+func joySize(data []byte) int {
+	if len(data) < protocol.JoyHeaderSize || data[21] > MaxJoyAxes {
+		return 0
+	}
+	n := protocol.JoyHeaderSize + 4*int(data[21])
+	if len(data) < n {
+		return 0
+	}
+	return n
+}
+
+// validJoyAxes reports whether every axis of frame is within [-1, 1]
+func validJoyAxes(frame []byte) bool {
+	for o := protocol.JoyHeaderSize; o < len(frame); o += 4 {
+		a := math.Float32frombits(binary.LittleEndian.Uint32(frame[o:]))
+		if !(a >= -1 && a <= 1) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendJoy encodes a relay Joy frame (browser layout plus t2/t3) for a
+// Python peer; without relay timestamps it keeps the browser's layout
+func (c *Codec) appendJoy(dst, frame []byte, robotID string) []byte {
+	if !c.has(FeatureRelayTimestamps) {
+		frame = frame[:len(frame)-16]
+	}
+	return c.appendFrame(dst, frame, robotID)
+}
+
+// handleJoy forwards a browser Joy frame under the same rules as a twist:
+// only the driver's reach the robot, none while it is e-stopped, and the
+// robot acks them with ordinary acks
+func handleJoy(peer *Peer, data []byte) {
+	t2 := currentTimeMs()
+
+	if peer.Type == "observer" {
+		metricObserverTwists.Inc()
+		peer.logger().Warn("Joy from observer rejected", "msg_type", "joy")
+		return
+	}
+	size := joySize(data)
+	switch {
+	case len(data) < protocol.JoyHeaderSize:
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.JoyHeaderSize)
+		return
+	case data[21] > MaxJoyAxes:
+		rejectFrame(peer, data, ProtoErrTooLong, protocol.JoyHeaderSize+4*MaxJoyAxes)
+		return
+	case size == 0:
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.JoyHeaderSize+4*int(data[21]))
+		return
+	}
+	if !validJoyAxes(data[:size]) {
+		peer.logger().Warn("Joy axis out of range", "msg_type", "joy")
+		return
+	}
+	msgID := binary.LittleEndian.Uint64(data[1:9])
+	if checkSequence(peer, msgID, "joy") {
+		return
+	}
+	robotID := commandTarget(peer, parseRobotTrailer(data, size))
+
+	if refuseStopped(robotID, peer.ID, msgID) {
+		return
+	}
+	if peer.Meta.Supervisor {
+		if overrides.command(robotID, peer.ID, joyMoves(data, size)) && forwardJoy(robotID, peer.ID, data[:size], t2) {
+			deadman.kick(robotID, peer.ID)
+		}
+		return
+	}
+	if overrides.active(robotID) {
+		peer.logger().Debug("Joy dropped during supervisor override", "robot_id", robotID)
+		sendNack(peer.ID, msgID, NackOverridden)
+		return
+	}
+	if twistMux != nil {
+		if twistMux.allow(robotID, peer, msgID) && forwardJoy(robotID, peer.ID, data[:size], t2) {
+			deadman.kick(robotID, peer.ID)
+		}
+		return
+	}
+	driving, claimed := arbiter.take(robotID, peer.ID)
+	if !driving {
+		peer.logger().Debug("Joy from non-driver dropped", "robot_id", robotID)
+		sendNack(peer.ID, msgID, NackNotDriver)
+		return
+	}
+	if claimed {
+		broadcastControlState(robotID)
+	}
+	if forwardJoy(robotID, peer.ID, data[:size], t2) {
+		deadman.kick(robotID, peer.ID)
+	}
+}
+
+// forwardJoy stamps t2/t3 onto a Joy frame and queues it for the robot's
+// Python peer, replacing a Joy frame from the same source still waiting.
+// Downstream relays don't take Joy frames.
+func forwardJoy(robotID, source string, frame []byte, t2 uint64) bool {
+	msgID := binary.LittleEndian.Uint64(frame[1:9])
+	python := manager.getPython(robotID)
+	if python == nil || python.Type != "python" {
+		if python == nil && holds.hold(robotID, source, msgID, true, frame, t2, nil) {
+			return true
+		}
+		slog.Debug("No python peer for joy", "robot_id", robotID, "source", source)
+		sendNack(source, msgID, NackNoRobot)
+		return false
+	}
+	expires := commandExpiry(source, binary.LittleEndian.Uint64(frame[9:17]), t2)
+	if commandStale(robotID, source, msgID, expires) {
+		return false
+	}
+	extended := make([]byte, len(frame)+16)
+	copy(extended, frame)
+	t3 := currentTimeMs()
+	binary.LittleEndian.PutUint64(extended[len(frame):], t2)
+	binary.LittleEndian.PutUint64(extended[len(frame)+8:], t3)
+
+	out := newFrame()
+	out.buf = python.codec().appendJoy(out.buf, extended, robotID)
+	stampCommand(out, source, msgID, expires)
+	recorder.record(RecordOut, robotID, python, out.buf)
+	if prev, replaced := python.twists.push(source+"/joy", out); replaced {
+		sendNack(source, prev, NackSuperseded)
+	}
+	manager.registry.command(robotID)
+	slog.Debug("Joy forwarded", "peer_id", python.ID, "peer_type", python.Type, "msg_type", "joy",
+		"msg_id", msgID, "robot_id", robotID, "source", source, "t2", t2, "t3", t3)
+	return true
+}
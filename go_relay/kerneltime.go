@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// With -kernel-timestamps the relay asks the kernel to timestamp every
+// TCP segment it receives (SO_TIMESTAMPING, Linux only) and reads them
+// back with each recvmsg. A frame's kernel receive time is that of the
+// read that completed it, next to t2 (or t4 for acks) stamped when the
+// reader goroutine got to the frame; the difference is time spent in
+// socket buffers and the scheduler, which application timestamps hide.
+
+// kernelStamped is a connection that knows when the kernel received the
+// data its last Read returned
+type kernelStamped interface {
+	// kernelRx returns that time as CLOCK_REALTIME ns, 0 if unknown,
+	// and whether the NIC stamped it
+	kernelRx() (ns int64, hardware bool)
+}
+
+// kernelStamper finds the timestamping connection under c, through TLS,
+// or returns nil
+func kernelStamper(c net.Conn) kernelStamped {
+	for c != nil {
+		if ks, ok := c.(kernelStamped); ok {
+			return ks
+		}
+		inner, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		c = inner.NetConn()
+	}
+	return nil
+}
+
+// kernelRxUs converts a kernel timestamp to relay time in µs (see
+// relayEpoch), 0 staying 0
+func kernelRxUs(ns int64) uint64 {
+	if ns == 0 {
+		return 0
+	}
+	return uint64(ns/1000 - wallSkew()*1000)
+}
+
+// stampKernelRx records when the kernel received the frame peer's reader
+// just read, if its transport knows
+func stampKernelRx(peer *Peer) {
+	ks, ok := peer.Conn.(kernelStamped)
+	if !ok {
+		return
+	}
+	ns, hardware := ks.kernelRx()
+	if ns == 0 {
+		return
+	}
+	peer.kernelRx.Store(kernelRxUs(ns))
+	clock := "software"
+	if hardware {
+		clock = "hardware"
+	}
+	metricKernelRxDelay.WithLabelValues(peer.Type, clock).Observe(time.Since(time.Unix(0, ns)).Seconds())
+}
+
+// kernelRxOf returns the kernel receive time of source's latest frame,
+// or 0 when -kernel-timestamps is off or the peer has gone
+func kernelRxOf(source string) uint64 {
+	if !config.KernelTimestamps {
+		return 0
+	}
+	if p := manager.getPeer(source); p != nil {
+		return p.kernelRx.Load()
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const kernelTimestampFlags = unix.SOF_TIMESTAMPING_RX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE |
+	unix.SOF_TIMESTAMPING_RX_HARDWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE
+
+// kernelTimestampListener turns on receive timestamping for every
+// connection ln accepts
+func kernelTimestampListener(ln net.Listener) net.Listener {
+	return &tsListener{Listener: ln}
+}
+
+type tsListener struct {
+	net.Listener
+	warned atomic.Bool
+}
+
+func (l *tsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	tcp, ok := c.(*net.TCPConn)
+	if !ok {
+		return c, nil
+	}
+	raw, err := tcp.SyscallConn()
+	if err == nil {
+		ctlErr := raw.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPING, kernelTimestampFlags)
+		})
+		if ctlErr != nil {
+			err = ctlErr
+		}
+	}
+	if err != nil {
+		if !l.warned.Swap(true) {
+			slog.Warn("Kernel timestamps unavailable, using application timestamps", "err", err)
+		}
+		return c, nil
+	}
+	return &tsConn{TCPConn: tcp, raw: raw}, nil
+}
+
+// tsConn reads with recvmsg to collect each read's timestamp
+type tsConn struct {
+	*net.TCPConn
+	raw    syscall.RawConn
+	oob    [128]byte
+	lastNs atomic.Int64
+	lastHw atomic.Bool
+}
+
+func (c *tsConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var n, oobn int
+	var recvErr error
+	err := c.raw.Read(func(fd uintptr) bool {
+		n, oobn, _, _, recvErr = unix.Recvmsg(int(fd), p, c.oob[:], 0)
+		return recvErr != unix.EAGAIN
+	})
+	if err == nil {
+		err = recvErr
+	}
+	if err != nil {
+		if n < 0 {
+			n = 0
+		}
+		return n, err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	c.stamp(c.oob[:oobn])
+	return n, nil
+}
+
+// stamp keeps the SCM_TIMESTAMPING time of a read: the NIC's raw
+// hardware stamp if there is one, else the software one
+func (c *tsConn) stamp(oob []byte) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for _, m := range msgs {
+		if m.Header.Level != unix.SOL_SOCKET || m.Header.Type != unix.SO_TIMESTAMPING ||
+			len(m.Data) < 3*int(unsafe.Sizeof(unix.Timespec{})) {
+			continue
+		}
+		ts := (*[3]unix.Timespec)(unsafe.Pointer(&m.Data[0]))
+		if hw := ts[2]; hw.Sec != 0 || hw.Nsec != 0 {
+			c.lastNs.Store(hw.Nano())
+			c.lastHw.Store(true)
+		} else if sw := ts[0]; sw.Sec != 0 || sw.Nsec != 0 {
+			c.lastNs.Store(sw.Nano())
+			c.lastHw.Store(false)
+		}
+	}
+}
+
+func (c *tsConn) kernelRx() (int64, bool) {
+	return c.lastNs.Load(), c.lastHw.Load()
+}
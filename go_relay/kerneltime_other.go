@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"log/slog"
+	"net"
+)
+
+// kernelTimestampListener returns ln as is: SO_TIMESTAMPING is Linux only
+func kernelTimestampListener(ln net.Listener) net.Listener {
+	slog.Warn("Kernel timestamps are only supported on Linux, using application timestamps")
+	return ln
+}
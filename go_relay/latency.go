@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LatencyRecord holds every timestamp the relay sees for one acked twist.
+// Times are ms since the Unix epoch on the clock that stamped them.
+type LatencyRecord struct {
+	MsgID   uint64 `json:"msg_id"`
+	RobotID string `json:"robot_id"`
+
+	PeerID      string `json:"peer_id,omitempty"`       // sender of the twist, if still known
+	RobotPeerID string `json:"robot_peer_id,omitempty"` // robot peer that acked it
+
+	T1BrowserSend uint64 `json:"t1_browser_send"`
+	T2RelayRx     uint64 `json:"t2_relay_rx"`
+	T3RelayTx     uint64 `json:"t3_relay_tx"`
+	T3PythonRx    uint64 `json:"t3_python_rx"`
+	T4PythonAck   uint64 `json:"t4_python_ack"`
+	T4RelayAckRx  uint64 `json:"t4_relay_ack_rx"`
+	T5RelayAckTx  uint64 `json:"t5_relay_ack_tx"`
+
+	DecodeUs  uint32 `json:"python_decode_us"`
+	ProcessUs uint32 `json:"python_process_us"`
+	EncodeUs  uint32 `json:"python_encode_us"`
+
+	// Downstream relays the twist crossed, nearest first (federation)
+	Hops []HopRecord `json:"hops,omitempty"`
+
+	// Kernel receive times of the twist and the ack, relay time in µs,
+	// with -kernel-timestamps (0 without)
+	T2KernelRxUs uint64 `json:"t2_kernel_rx_us,omitempty"`
+	T4KernelRxUs uint64 `json:"t4_kernel_rx_us,omitempty"`
+
+	// Sequence number the relay gave the twist (see relayseq.go), 0 if
+	// its ack came too late to match it
+	RelaySeq uint64 `json:"relay_seq,omitempty"`
+
+	// The wall clock stepped between t2 and t5: relay times are still
+	// consistent, but peer times (t1, t3/t4 python) may have jumped
+	ClockStep bool `json:"clock_step,omitempty"`
+}
+
+// parseLatencyRecord reads an ack as sent to browsers (77 bytes)
+func parseLatencyRecord(robotID string, ack []byte) LatencyRecord {
+	le := binary.LittleEndian
+	return LatencyRecord{
+		MsgID:         le.Uint64(ack[1:9]),
+		RobotID:       robotID,
+		T1BrowserSend: le.Uint64(ack[9:17]),
+		T2RelayRx:     le.Uint64(ack[17:25]),
+		T3RelayTx:     le.Uint64(ack[25:33]),
+		T3PythonRx:    le.Uint64(ack[33:41]),
+		T4PythonAck:   le.Uint64(ack[41:49]),
+		DecodeUs:      le.Uint32(ack[49:53]),
+		ProcessUs:     le.Uint32(ack[53:57]),
+		EncodeUs:      le.Uint32(ack[57:61]),
+		T4RelayAckRx:  le.Uint64(ack[61:69]),
+		T5RelayAckTx:  le.Uint64(ack[69:77]),
+	}
+}
+
+// Latency segments in ms. Segments crossing clocks (browser→relay,
+// relay→python) are only meaningful when peers are clock-synced.
+func (r LatencyRecord) browserToRelay() float64 { return msDiff(r.T2RelayRx, r.T1BrowserSend) }
+func (r LatencyRecord) relayToPython() float64 {
+	tx := r.T3RelayTx
+	if n := len(r.Hops); n > 0 {
+		tx = r.Hops[n-1].TwistTx // the relay nearest the robot
+	}
+	return msDiff(r.T3PythonRx, tx)
+}
+func (r LatencyRecord) pythonProcessing() float64 {
+	return float64(r.DecodeUs+r.ProcessUs+r.EncodeUs) / 1000
+}
+
+// roundTrip spans browser send to the ack leaving the relay; the final
+// relay→browser hop is only visible to the browser itself.
+func (r LatencyRecord) roundTrip() float64 { return msDiff(r.T5RelayAckTx, r.T1BrowserSend) }
+
+func msDiff(a, b uint64) float64 {
+	return float64(int64(a - b))
+}
+
+// LatencyStore keeps the most recent records in a ring buffer
+type LatencyStore struct {
+	mu      sync.Mutex
+	records []LatencyRecord
+	next    int
+	full    bool
+
+	senders map[senderKey]pendingTwist // twists awaiting their ack
+}
+
+// pendingTwist is what an ack needs to know about its twist
+type pendingTwist struct {
+	source   string    // sender peer ID
+	kernelRx uint64    // see LatencyRecord.T2KernelRxUs
+	sent     time.Time // forwarded, for ack timeouts
+	relaySeq uint64    // see LatencyRecord.RelaySeq
+}
+
+// unackedTwist is a pending twist whose ack timed out
+type unackedTwist struct {
+	robotID string
+	msgID   uint64
+	pendingTwist
+}
+
+// senderKey names a twist; acks carry no sender, so message IDs that two
+// browsers on one robot share attribute to whichever sent it last
+type senderKey struct {
+	robotID string
+	msgID   uint64
+}
+
+// maxPendingSenders bounds senders against robots that never ack
+const maxPendingSenders = 4096
+
+// latency is created by main with config.LatencyWindow slots
+var latency *LatencyStore
+
+func newLatencyStore(size int) *LatencyStore {
+	return &LatencyStore{records: make([]LatencyRecord, size), senders: make(map[senderKey]pendingTwist)}
+}
+
+// forwarded notes that source's twist msgID, which the kernel received at
+// kernelRx, went to robotID as relay sequence number seq, so its ack can
+// name the sender
+func (s *LatencyStore) forwarded(robotID string, msgID uint64, source string, kernelRx, seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.senders) >= maxPendingSenders {
+		for k := range s.senders {
+			delete(s.senders, k)
+			break
+		}
+	}
+	s.senders[senderKey{robotID, msgID}] = pendingTwist{source, kernelRx, time.Now(), seq}
+}
+
+// forget drops robotID's twist msgID, which will never reach the robot
+func (s *LatencyStore) forget(robotID string, msgID uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.senders, senderKey{robotID, msgID})
+}
+
+// expire removes and returns the twists forwarded more than timeout ago
+// that are still waiting for their ack
+func (s *LatencyStore) expire(timeout time.Duration) []unackedTwist {
+	cutoff := time.Now().Add(-timeout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []unackedTwist
+	for k, t := range s.senders {
+		if t.sent.Before(cutoff) {
+			delete(s.senders, k)
+			out = append(out, unackedTwist{k.robotID, k.msgID, t})
+		}
+	}
+	return out
+}
+
+// sender returns and forgets what is known of robotID's twist msgID:
+// its sender, kernel receive time and relay sequence number
+func (s *LatencyStore) sender(robotID string, msgID uint64) pendingTwist {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := senderKey{robotID, msgID}
+	t, ok := s.senders[key]
+	delete(s.senders, key)
+	if ok {
+		ackTimeouts.outcome(robotID, false)
+	}
+	return t
+}
+
+func (s *LatencyStore) add(rec LatencyRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[s.next] = rec
+	s.next++
+	if s.next == len(s.records) {
+		s.next = 0
+		s.full = true
+	}
+}
+
+// snapshot returns the stored records oldest first, filtered by robot
+// unless robotID is ""
+func (s *LatencyStore) snapshot(robotID string) []LatencyRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ordered := s.records[:s.next]
+	if s.full {
+		ordered = append(append([]LatencyRecord(nil), s.records[s.next:]...), s.records[:s.next]...)
+	}
+	out := make([]LatencyRecord, 0, len(ordered))
+	for _, rec := range ordered {
+		if robotID == "" || rec.RobotID == robotID {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// Percentiles summarizes one latency segment in ms
+type Percentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// percentiles uses the nearest-rank method; values is sorted in place
+func percentiles(values []float64) Percentiles {
+	if len(values) == 0 {
+		return Percentiles{}
+	}
+	sort.Float64s(values)
+	rank := func(p float64) float64 {
+		i := int(math.Ceil(p/100*float64(len(values)))) - 1
+		return values[max(i, 0)]
+	}
+	return Percentiles{P50: rank(50), P95: rank(95), P99: rank(99)}
+}
+
+// summarize computes per-segment percentiles over records
+func summarize(records []LatencyRecord) map[string]Percentiles {
+	segments := map[string]func(LatencyRecord) float64{
+		"browser_to_relay":  LatencyRecord.browserToRelay,
+		"relay_to_python":   LatencyRecord.relayToPython,
+		"python_processing": LatencyRecord.pythonProcessing,
+		"round_trip":        LatencyRecord.roundTrip,
+	}
+	out := make(map[string]Percentiles, len(segments))
+	for name, segment := range segments {
+		values := make([]float64, len(records))
+		for i, rec := range records {
+			values[i] = segment(rec)
+		}
+		out[name] = percentiles(values)
+	}
+	for name, values := range hopSegments(records) {
+		out[name] = percentiles(values)
+	}
+	return out
+}
+
+// hopSegments measures each relay-to-relay link: hop<N>_forward from the
+// previous relay sending the twist to relay N receiving it, hop<N>_return
+// from relay N sending the ack to the previous relay receiving it
+func hopSegments(records []LatencyRecord) map[string][]float64 {
+	out := make(map[string][]float64)
+	for _, rec := range records {
+		prev := HopRecord{TwistTx: rec.T3RelayTx, AckRx: rec.T4RelayAckRx}
+		for i, hop := range rec.Hops {
+			n := strconv.Itoa(i + 1)
+			out["hop"+n+"_forward"] = append(out["hop"+n+"_forward"], msDiff(hop.TwistRx, prev.TwistTx))
+			out["hop"+n+"_return"] = append(out["hop"+n+"_return"], msDiff(prev.AckRx, hop.AckTx))
+			prev = hop
+		}
+	}
+	return out
+}
+
+// handleLatency serves GET /latency[?robot=<id>]
+func handleLatency(w http.ResponseWriter, r *http.Request) {
+	robotID := r.URL.Query().Get("robot")
+	records := latency.snapshot(robotID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"robot":    robotID,
+		"samples":  len(records),
+		"window":   len(latency.records),
+		"unit":     "ms",
+		"segments": summarize(records),
+	})
+}
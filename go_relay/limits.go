@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+
+	"go_relay/protocol"
+)
+
+// Twist velocity offsets: linear x,y,z then angular x,y,z, float64 each
+const (
+	twistLinearOffset  = 17
+	twistAngularOffset = 41
+)
+
+// VelocityLimit bounds each linear (m/s) and angular (rad/s) component of
+// a twist, and how fast they change between twists (m/s², rad/s², and
+// their jerk in m/s³, rad/s³; see Shaper). Zero leaves that bound off.
+type VelocityLimit struct {
+	Linear       float64 `yaml:"linear"`
+	Angular      float64 `yaml:"angular"`
+	LinearAccel  float64 `yaml:"linear_accel"`
+	AngularAccel float64 `yaml:"angular_accel"`
+	LinearJerk   float64 `yaml:"linear_jerk"`
+	AngularJerk  float64 `yaml:"angular_jerk"`
+}
+
+func (l VelocityLimit) validate() error {
+	if l.Linear < 0 || l.Angular < 0 {
+		return errors.New("velocity limits must not be negative")
+	}
+	if l.LinearAccel < 0 || l.AngularAccel < 0 || l.LinearJerk < 0 || l.AngularJerk < 0 {
+		return errors.New("acceleration and jerk limits must not be negative")
+	}
+	return nil
+}
+
+// shapes reports whether the limit rate-limits velocity changes
+func (l VelocityLimit) shapes() bool {
+	return l.LinearAccel > 0 || l.AngularAccel > 0 || l.LinearJerk > 0 || l.AngularJerk > 0
+}
+
+// limitFor returns robotID's limit, falling back to the relay-wide one
+func (c *Config) limitFor(robotID string) VelocityLimit {
+	if l, ok := c.RobotLimits[robotID]; ok {
+		return l
+	}
+	return c.Limits
+}
+
+// clampTwist clamps the velocities of a browser twist in place to robotID's
+// limit and reports whether anything changed. NaN and infinite components
+// are zeroed whether or not a limit is set.
+func clampTwist(robotID string, data []byte) bool {
+	limit := config.limitFor(robotID)
+	clamped := clampComponents(data[twistLinearOffset:twistAngularOffset], limit.Linear)
+	if clampComponents(data[twistAngularOffset:protocol.TwistBrowserSize], limit.Angular) {
+		clamped = true
+	}
+	if clamped {
+		metricTwistsClamped.WithLabelValues(robotID).Inc()
+		msgID := binary.LittleEndian.Uint64(data[1:9])
+		slog.Debug("Twist clamped", "msg_type", "twist", "msg_id", msgID, "robot_id", robotID, "limit", limit.String())
+	}
+	return clamped
+}
+
+// clampComponents clamps three little-endian float64s to [-max, max]
+func clampComponents(b []byte, max float64) bool {
+	var clamped bool
+	for off := 0; off < 24; off += 8 {
+		v := math.Float64frombits(binary.LittleEndian.Uint64(b[off:]))
+		c := v
+		switch {
+		case math.IsNaN(v) || math.IsInf(v, 0):
+			c = 0
+		case max > 0:
+			c = math.Max(-max, math.Min(max, v))
+		}
+		if c != v {
+			binary.LittleEndian.PutUint64(b[off:], math.Float64bits(c))
+			clamped = true
+		}
+	}
+	return clamped
+}
+
+func (l VelocityLimit) String() string {
+	format := func(v float64, unit string) string {
+		if v == 0 {
+			return "unbounded"
+		}
+		return fmt.Sprintf("±%g %s", v, unit)
+	}
+	s := fmt.Sprintf("linear %s, angular %s", format(l.Linear, "m/s"), format(l.Angular, "rad/s"))
+	if l.shapes() {
+		s += fmt.Sprintf("; acceleration linear %s, angular %s; jerk linear %s, angular %s",
+			format(l.LinearAccel, "m/s²"), format(l.AngularAccel, "rad/s²"), format(l.LinearJerk, "m/s³"), format(l.AngularJerk, "rad/s³"))
+	}
+	return s
+}
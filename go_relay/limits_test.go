@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestClampComponents(t *testing.T) {
+	inf, nan := math.Inf(1), math.NaN()
+	tests := []struct {
+		name    string
+		in      [3]float64
+		max     float64
+		want    [3]float64
+		clamped bool
+	}{
+		{"within limit", [3]float64{0.5, -0.5, 0}, 1, [3]float64{0.5, -0.5, 0}, false},
+		{"over limit both ways", [3]float64{2, -3, 1}, 1, [3]float64{1, -1, 1}, true},
+		{"no limit", [3]float64{20, -30, 0}, 0, [3]float64{20, -30, 0}, false},
+		{"NaN and Inf zeroed without a limit", [3]float64{nan, inf, -inf}, 0, [3]float64{}, true},
+		{"NaN zeroed under a limit", [3]float64{nan, 0.2, 5}, 1, [3]float64{0, 0.2, 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := make([]byte, 24)
+			for i, v := range tt.in {
+				binary.LittleEndian.PutUint64(b[8*i:], math.Float64bits(v))
+			}
+			if got := clampComponents(b, tt.max); got != tt.clamped {
+				t.Errorf("clamped = %v, want %v", got, tt.clamped)
+			}
+			for i, want := range tt.want {
+				if got := math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:])); got != want {
+					t.Errorf("component %d = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitFor(t *testing.T) {
+	c := &Config{
+		Limits:      VelocityLimit{Linear: 1, Angular: 2},
+		RobotLimits: map[string]VelocityLimit{"slow": {Linear: 0.2}},
+	}
+	if got := c.limitFor("slow"); got != (VelocityLimit{Linear: 0.2}) {
+		t.Errorf("per-robot limit = %+v", got)
+	}
+	if got := c.limitFor("other"); got != c.Limits {
+		t.Errorf("fallback limit = %+v, want the relay-wide %+v", got, c.Limits)
+	}
+}
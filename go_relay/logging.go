@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// newLogHandler builds the slog handler for -log-level and -log-format:
+// "text" (key=value, the default) or "json" for Loki/ELK ingestion.
+// Forwarded twists and acks log at debug, connections and control changes
+// at info, rejected or malformed input at warn.
+func newLogHandler(w io.Writer, level, format string) (slog.Handler, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log_level: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("log_format must be text or json, not %q", format)
+	}
+}
+
+// setupLogging makes the configured handler the default; messages from
+// the standard log package (used by dependencies) go through it at Info
+func setupLogging(level, format string) error {
+	h, err := newLogHandler(os.Stderr, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal logs msg at Error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logger returns the default logger tagged with the peer's ID and type,
+// and its client ID and room if it has them
+func (p *Peer) logger() *slog.Logger {
+	args := []any{"peer_id", p.ID, "peer_type", p.Type}
+	if p.Meta.ClientID != "" {
+		args = append(args, "client_id", p.Meta.ClientID)
+	}
+	if p.Meta.Room != "" {
+		args = append(args, "room", p.Meta.Room)
+	}
+	return slog.With(args...)
+}
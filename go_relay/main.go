@@ -3,160 +3,564 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+
+	"go_relay/protocol"
 )
 
 /*
-BINARY PROTOCOL
-===============
-
-All messages use little-endian byte order.
-First byte is message type:
-  0x01 = Twist Command
-  0x02 = Twist Ack
-  0x03 = Clock Sync Request
-  0x04 = Clock Sync Response
-
-MESSAGE SIZES
--------------
-  Twist (browser):     65 bytes
-  Twist (to python):   81 bytes (+16 for relay timestamps)
-  Ack (from python):   69 bytes
-  Ack (to browser):    77 bytes (+8 for t5_relay_ack_tx)
-  Clock Sync Request:   9 bytes
-  Clock Sync Response: 25 bytes
-*/
+COMMANDS
+========
+go_relay [command] [flags]; without a command (or with flags first) it
+serves, so existing invocations keep working.
+  serve         the relay (this file)
+  replay        re-send a recorded session's twists (replay.go)
+  bench         load-test a relay and print round trips per robot (bench.go)
+  check         validate the configuration, or -probe a running relay (check.go)
+  check-client  conformance-test one client against a stand-in relay (conformance.go)
 
-// Message type constants
-const (
-	MsgTypeTwist            = 0x01
-	MsgTypeTwistAck         = 0x02
-	MsgTypeClockSyncRequest = 0x03
-	MsgTypeClockSyncResp    = 0x04
-
-	TwistBrowserSize  = 65
-	TwistToPythonSize = 81
-	AckFromPythonSize = 69
-	AckToBrowserSize  = 77
-	ClockSyncReqSize  = 9
-	ClockSyncRespSize = 25
-)
+PROTOCOL
+========
+The binary wire format, message types and frame layouts live in the
+protocol package (go_relay/protocol), shared by the relay and its
+subcommands; go_relay/client is a reconnecting Go peer built on it.
+
+*/
 
-// currentTimeMs returns milliseconds since Unix epoch
+// currentTimeMs returns relay time, milliseconds since Unix epoch on the
+// monotonic clock (see relayEpoch)
 func currentTimeMs() uint64 {
-	return uint64(time.Now().UnixMilli())
+	return uint64(relayTime())
+}
+
+// parseRobotTrailer returns the robot ID trailer starting at offset, or ""
+// if absent. Twists and acks may carry one after their fixed layout: a
+// length byte (1 to -robot-id-max-len) and the UTF-8 ID. A browser twist
+// with a trailer goes to that robot, one without to the robot its peer
+// registered with (?robot=, "default"); twists to robots and acks to
+// browsers get the trailer appended unless the peer negotiated it off.
+func parseRobotTrailer(data []byte, offset int) string {
+	return protocol.ParseRobotTrailer(data, offset, config.RobotIDMaxLen)
 }
 
 // Peer represents a WebSocket connection
 type Peer struct {
 	ID       string
-	Type     string // "web" or "python"
-	Conn     *websocket.Conn
-	SendChan chan []byte
-	mu       sync.Mutex
+	Type     string // "web", "observer" (read-only web), "python" or "relay" (a downstream relay serving the robot)
+	Subject  string // token subject when auth is enabled
+	Meta     PeerMeta
+	RobotID  string // robot served (python) or addressed (web), guarded by manager.mu
+	Conn     Transport
+	SendChan chan *Frame
+	urgent   chan *Frame // e-stops, written before SendChan
+
+	overflowPolicy string        // when SendChan is full, see sendQueueFor
+	drops          atomic.Uint64 // frames lost to a full queue
+	writes         atomic.Uint64 // frames written, see writeTimed
+	writeTime      atomic.Int64  // ns spent writing them
+	slow           slowState     // watchSlowConsumers only
+	heartbeat      Heartbeat     // keepalive for the peer's type
+	readLimit      int           // largest frame accepted, see readLimitFor
+	subprotocol    string        // negotiated on /ws/data, see subprotocols
+	resume         *resumable    // the peer's resumable session, see ResumeStore
+	resumeToken    string        // sent in the welcome, "" if it cannot resume
+	pings          atomic.Uint64 // pings sent, see pinged
+	pongs          atomic.Uint64 // pings answered
+	twists         *TwistQueue   // twists to python, latest per source
+	media          *MediaQueue   // media chunks to web peers, written last
+	mu             sync.Mutex
+
+	quit        chan struct{} // closed to make the writer flush and close
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
+
+	ConnectedAt time.Time
+	msgsIn      atomic.Uint64
+	msgsOut     atomic.Uint64
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	typesIn     typeCounts    // messages in by type
+	typesOut    typeCounts    // messages out by type
+	rtt         PingRTT       // WebSocket ping round trips, see pong
+	kernelRx    atomic.Uint64 // relay µs the kernel received the latest frame, see stampKernelRx
+
+	clock       ClockEstimate                // from sync beacons
+	signaled    atomic.Bool                  // sent WebRTC signaling, see hangupSignaling
+	proto       atomic.Pointer[Codec]        // set by Hello, see codec()
+	seq         SequenceTracker              // twist message IDs
+	lastSeen    atomic.Int64                 // Unix ms of the last message or pong, see touch
+	lastMessage atomic.Int64                 // Unix ms of the last message, see active
+	session     atomic.Bool                  // Session Ack received, see handleSessionAck
+	impaired    *impairedLine                // reader only, see impair
+	profile     atomic.Pointer[speedProfile] // assigned by an admin, see scaleTwist
+}
+
+// watchesRobot reports whether the peer gets a robot's operator fan-out:
+// acks, control state and e-stops. Observers get it but may not command.
+func (p *Peer) watchesRobot() bool {
+	return p.Type == "web" || p.Type == "observer"
+}
+
+// isRobot reports whether the peer serves a robot: a python peer, or a
+// downstream relay standing in for one
+func (p *Peer) isRobot() bool {
+	return p.Type == "python" || p.Type == "relay"
+}
+
+// sendUrgent queues msg ahead of everything in SendChan
+func (p *Peer) sendUrgent(msg []byte) bool {
+	return p.enqueue(p.urgent, wrapFrame(msg))
+}
+
+// send queues msg; it reports false (and counts a drop) when the peer's
+// buffer is full and its overflow policy drops msg
+func (p *Peer) send(msg []byte) bool {
+	return p.enqueue(p.SendChan, wrapFrame(msg))
+}
+
+// sendFrame is send for pooled frames; it takes over the caller's
+// reference, releasing it if the frame is dropped
+func (p *Peer) sendFrame(f *Frame) bool {
+	return p.enqueue(p.SendChan, f)
+}
+
+// sendDropped counts frames dropped because a peer's queue was full
+var sendDropped atomic.Uint64
+
+// enqueue queues f without blocking, or else leaves it to the peer's
+// overflow policy
+func (p *Peer) enqueue(queue chan *Frame, f *Frame) bool {
+	select {
+	case queue <- f:
+		return true
+	default:
+		return p.overflow(queue, f)
+	}
 }
 
 // PeerManager manages connected peers
 type PeerManager struct {
-	mu         sync.RWMutex
-	peers      map[string]*Peer
-	webPeers   map[string]*Peer
-	pythonPeer *Peer
+	mu       sync.RWMutex
+	peers    map[string]*Peer
+	webPeers map[string]*Peer   // web and observer peers
+	robots   map[string]*Peer   // robot ID -> python peer
+	standby  map[string][]*Peer // robot ID -> further robot peers, see failover
+	registry *RobotRegistry     // every robot seen, for /robots
 }
 
 var manager = &PeerManager{
 	peers:    make(map[string]*Peer),
 	webPeers: make(map[string]*Peer),
+	robots:   make(map[string]*Peer),
+	standby:  make(map[string][]*Peer),
+	registry: newRobotRegistry(),
 }
 
+// upgrader is configured by main from config buffer sizes and origins
 var upgrader = websocket.Upgrader{
-	CheckOrigin:     func(r *http.Request) bool { return true },
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
-func newPeerID() string {
-	return fmt.Sprintf("peer_%d", time.Now().UnixNano())
+	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
 func (m *PeerManager) addPeer(p *Peer) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.peers[p.ID] = p
-	if p.Type == "web" {
+	metricPeers.WithLabelValues(p.Type).Inc()
+	if p.Meta.ClientID != "" {
+		metricClientConnections.WithLabelValues(p.Type).Inc()
+	}
+	if p.watchesRobot() {
 		m.webPeers[p.ID] = p
-	} else if p.Type == "python" {
-		m.pythonPeer = p
+	} else if p.isRobot() {
+		if old, ok := m.robots[p.RobotID]; ok && config.FailoverTimeout > 0 {
+			m.standby[p.RobotID] = append(m.standby[p.RobotID], p)
+			p.logger().Info("Robot peer standing by", "robot_id", p.RobotID, "primary_peer_id", old.ID)
+		} else {
+			if ok {
+				p.logger().Warn("Robot peer replaced", "robot_id", p.RobotID, "replaced_peer_id", old.ID)
+			}
+			m.robots[p.RobotID] = p
+			m.registry.changed(p.RobotID)
+		}
 	}
-	log.Printf("+ Peer %s (%s), total: %d", p.ID, p.Type, len(m.peers))
+	p.logger().Info("Peer connected", "robot_id", p.RobotID, "subject", p.Subject, "name", p.Meta.Name, "total", len(m.peers))
 }
 
 func (m *PeerManager) removePeer(p *Peer) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.peers[p.ID] != p {
+		return // already removed, or its ID went to a resumed connection
+	}
 	delete(m.peers, p.ID)
+	metricPeers.WithLabelValues(p.Type).Dec()
 	delete(m.webPeers, p.ID)
-	if m.pythonPeer != nil && m.pythonPeer.ID == p.ID {
-		m.pythonPeer = nil
+	if cur, ok := m.robots[p.RobotID]; ok && cur.ID == p.ID {
+		delete(m.robots, p.RobotID)
+		m.registry.changed(p.RobotID)
+	} else if p.isRobot() {
+		m.removeStandbyLocked(p)
 	}
-	log.Printf("- Peer %s, total: %d", p.ID, len(m.peers))
+	p.logger().Info("Peer disconnected", "total", len(m.peers))
 }
 
-func (m *PeerManager) getPython() *Peer {
+// getPython returns the python peer serving robotID, or nil
+func (m *PeerManager) getPython(robotID string) *Peer {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.pythonPeer
+	return m.robots[robotID]
 }
 
-func (m *PeerManager) getWebPeers() []*Peer {
+// getWebPeers returns the web and observer peers currently addressing robotID
+func (m *PeerManager) getWebPeers(robotID string) []*Peer {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	peers := make([]*Peer, 0, len(m.webPeers))
 	for _, p := range m.webPeers {
-		peers = append(peers, p)
+		if p.RobotID == robotID {
+			peers = append(peers, p)
+		}
 	}
 	return peers
 }
 
-// WebSocket handler
-func handleWS(w http.ResponseWriter, r *http.Request) {
-	peerType := r.URL.Query().Get("type")
+// robotFor returns the robot a peer is bound to
+func (m *PeerManager) robotFor(p *Peer) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return p.RobotID
+}
+
+// retarget points a web peer at a different robot so acks follow it
+func (m *PeerManager) retarget(p *Peer, robotID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p.RobotID != robotID {
+		p.logger().Info("Peer retargeted", "robot_id", robotID, "previous_robot_id", p.RobotID)
+		p.RobotID = robotID
+	}
+}
+
+// isWebPeerOn reports whether peerID is a web (not observer) peer addressing robotID
+func (m *PeerManager) isWebPeerOn(peerID, robotID string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	p, ok := m.webPeers[peerID]
+	return ok && p.Type == "web" && p.RobotID == robotID
+}
+
+// robotIDs returns the sorted IDs of connected robots; caller holds m.mu
+func (m *PeerManager) robotIDs() []string {
+	ids := make([]string, 0, len(m.robots))
+	for id := range m.robots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// parsePeerQuery reads ?type= and ?robot= with their defaults, the robot
+// taken within ?room= (validated by parsePeerMeta). Unknown types are
+// refused, as the type labels metrics.
+func parsePeerQuery(r *http.Request) (peerType, robotID string, err error) {
+	peerType = r.URL.Query().Get("type")
 	if peerType == "" {
 		peerType = "web"
 	}
+	if !knownPeerType(peerType) {
+		return "", "", fmt.Errorf("unknown peer type %q", peerType)
+	}
+	robotID = r.URL.Query().Get("robot")
+	if robotID == "" {
+		robotID = protocol.DefaultRobotID
+	}
+	if len(robotID) > config.RobotIDMaxLen {
+		return "", "", errors.New("robot id too long")
+	}
+	return peerType, roomRobotID(r.URL.Query().Get("room"), robotID), nil
+}
+
+// PeerMeta is what a peer says about itself when it registers, from its
+// connect query or gRPC metadata. The relay echoes it in the JSON welcome
+// and lists it in /status and /admin/peers.
+type PeerMeta struct {
+	ClientID      string   `json:"client_id,omitempty"` // stable across connections, see identity.go
+	Room          string   `json:"room,omitempty"`      // see rooms.go
+	BlendWeight   float64  `json:"blend_weight"`        // see Blender
+	BlendPriority int      `json:"blend_priority"`
+	Supervisor    bool     `json:"supervisor,omitempty"` // see Overrides
+	MuxInput      string   `json:"mux_input,omitempty"`  // see TwistMux
+	Name          string   `json:"name,omitempty"`
+	Version       string   `json:"client_version,omitempty"`
+	Capabilities  []string `json:"capabilities,omitempty"`
+}
+
+const (
+	maxPeerMetaLen      = 64 // bytes per name, version or capability
+	maxPeerCapabilities = 16
+)
+
+// parsePeerMeta reads client ID, room, name, version and capabilities
+// (comma-separated) from a query string or gRPC metadata
+func parsePeerMeta(values url.Values) (PeerMeta, error) {
+	meta := PeerMeta{ClientID: values.Get("client_id"), Room: values.Get("room"), Name: values.Get("name"), Version: values.Get("version"),
+		Supervisor: values.Has("supervisor"), MuxInput: values.Get("mux_input")}
+	if err := validClientID(meta.ClientID); err != nil {
+		return PeerMeta{}, err
+	}
+	if err := validRoom(meta.Room); err != nil {
+		return PeerMeta{}, err
+	}
+	var err error
+	if meta.BlendWeight, meta.BlendPriority, err = parseBlendMeta(values.Get("blend_weight"), values.Get("blend_priority")); err != nil {
+		return PeerMeta{}, err
+	}
+	if meta.MuxInput != "" && !twistMux.has(meta.MuxInput) {
+		if twistMux == nil {
+			return PeerMeta{}, errors.New("mux_input without -mux")
+		}
+		return PeerMeta{}, errors.New("unknown mux_input")
+	}
+	if caps := values.Get("capabilities"); caps != "" {
+		for _, c := range strings.Split(caps, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				meta.Capabilities = append(meta.Capabilities, c)
+			}
+		}
+	}
+	if len(meta.Name) > maxPeerMetaLen || len(meta.Version) > maxPeerMetaLen {
+		return PeerMeta{}, errors.New("name or version too long")
+	}
+	if len(meta.Capabilities) > maxPeerCapabilities {
+		return PeerMeta{}, errors.New("too many capabilities")
+	}
+	for _, c := range meta.Capabilities {
+		if len(c) > maxPeerMetaLen {
+			return PeerMeta{}, errors.New("capability too long")
+		}
+	}
+	return meta, nil
+}
+
+// subprotocols are the /ws/data subprotocols the relay speaks, preferred
+// first
+var subprotocols = []string{protocol.Subprotocol}
+
+// WebSocket handler
+func handleWS(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		http.Error(w, "relay shutting down", http.StatusServiceUnavailable)
+		return
+	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	peerType, robotID, err := parsePeerQuery(r)
 	if err != nil {
-		log.Printf("Upgrade error: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	meta, err := parsePeerMeta(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, err := limiter.acquire(r, peerType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	claims, authErr := auth.authorize(r, peerType)
+	if authErr == nil {
+		meta.ClientID, authErr = auth.clientID(claims, meta.ClientID)
+	}
+	if authErr == nil {
+		authErr = authorizeSupervisor(claims, &meta, peerType)
+	}
+
+	u := upgrader
+	u.Subprotocols = subprotocols
+	ws, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("Upgrade failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+
+	// Reject after the upgrade so browsers can read the close code
+	if authErr != nil {
+		msg := websocket.FormatCloseMessage(closeCodeFor(authErr), authErr.Error())
+		ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
+	if ws.Subprotocol() == "" && config.RequireSubprotocol {
+		metricSubprotocolRejected.Inc()
+		slog.Warn("Connection without subprotocol rejected", "remote", r.RemoteAddr,
+			"offered", websocket.Subprotocols(r))
+		msg := websocket.FormatCloseMessage(CloseUpgradeRequired, "subprotocol "+protocol.Subprotocol+" required")
+		ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
+
+	transport := newWSTransport(ws)
+	if transport.deflate = upgrader.EnableCompression && offersDeflate(r); transport.deflate {
+		ws.SetCompressionLevel(config.CompressionLevel)
+	}
+	peer := newPeer(peerType, robotID, claims.Subject, transport)
+	transport.writeTimeout = peer.heartbeat.WriteTimeout
+	peer.subprotocol = ws.Subprotocol()
+	peer.Meta = meta
+	transport.onText = func(msg []byte) {
+		peer.active()
+		handleSignal(peer, msg)
+	}
+	transport.onPong = peer.pong
+
+	resumed := resumes.start(peer, r.URL.Query().Get("resume"))
+
+	// Send welcome (JSON)
+	welcome := map[string]interface{}{
+		"type":           "welcome",
+		"peer_id":        peer.ID,
+		"robot_id":       bareRobotID(peer.RobotID),
+		"room":           meta.Room,
+		"client_id":      meta.ClientID,
+		"name":           meta.Name,
+		"client_version": meta.Version,
+		"capabilities":   meta.Capabilities,
+	}
+	if peer.resumeToken != "" {
+		welcome["resume_token"] = peer.resumeToken
+		welcome["resumed"] = resumed
+	}
+	// Clients negotiating the Session handshake get it in binary instead
+	if r.URL.Query().Get("welcome") != "binary" {
+		ws.WriteJSON(welcome)
+	}
 
-	peer := &Peer{
-		ID:       newPeerID(),
-		Type:     peerType,
-		Conn:     conn,
-		SendChan: make(chan []byte, 256),
+	servePeer(peer)
+}
+
+func newPeer(peerType, robotID, subject string, conn Transport) *Peer {
+	queue := config.sendQueueFor(peerType)
+	p := &Peer{
+		ID:          newPeerID(),
+		Type:        peerType,
+		Subject:     subject,
+		RobotID:     robotID,
+		Conn:        conn,
+		SendChan:    make(chan *Frame, queue.Size),
+		urgent:      make(chan *Frame, urgentBuffer),
+		twists:      newTwistQueue(),
+		media:       newMediaQueue(),
+		quit:        make(chan struct{}),
+		ConnectedAt: time.Now(),
+
+		overflowPolicy: queue.Overflow,
+		heartbeat:      config.heartbeatFor(peerType),
+		readLimit:      config.readLimitFor(peerType),
+	}
+	if l, ok := conn.(readLimiter); ok {
+		l.setReadLimit(p.readLimit)
 	}
+	p.touch()
+	p.active()
+	return p
+}
+
+// servePeer registers a connected peer, sends it the current control,
+// telemetry and e-stop state, and runs its reader and writer until it disconnects
+func servePeer(peer *Peer) {
+	activeConns.Add(1)
+	profileAssignments.apply(peer)
 	manager.addPeer(peer)
 
 	defer func() {
+		defer activeConns.Done()
+		resumed := resumes.leave(peer)
+		if resumed == resumeSuperseded {
+			peer.Conn.Close() // the resumed connection carries on
+			return
+		}
 		manager.removePeer(peer)
-		conn.Close()
+		if peer.isRobot() {
+			failover(peer.RobotID, peer, FailoverDisconnected)
+		}
+		if peer.watchesRobot() {
+			robotID := manager.robotFor(peer)
+			hangupSignaling(peer, robotID)
+			broadcastPresence(robotID, PresencePeerLeft, peer.ID)
+		}
+		if peer.isRobot() && manager.getPython(peer.RobotID) == nil {
+			federation.robotDown(peer.RobotID)
+			holds.robotDown(peer.RobotID)
+			diagnostics.forget(peer.RobotID)
+			broadcastPresence(peer.RobotID, PresenceRobotDisconnected, peer.ID)
+		}
+		if resumed == resumeParked {
+			// Stop its robots but keep control for a resume
+			for _, robotID := range arbiter.drivenBy(peer.ID) {
+				deadman.trip(robotID, "driver disconnected")
+			}
+		} else {
+			for _, robotID := range arbiter.releaseAll(peer.ID) {
+				deadman.trip(robotID, "driver disconnected")
+				broadcastControlState(robotID)
+			}
+		}
+		for _, robotID := range overrides.leave(peer.ID) {
+			deadman.trip(robotID, "supervisor disconnected")
+		}
+		if blender != nil {
+			blender.leave(peer.ID)
+		}
+		deadman.leave(peer.ID)
+		peer.Conn.Close()
 	}()
 
-	// Send welcome (JSON)
-	welcome := map[string]interface{}{
-		"type":    "welcome",
-		"peer_id": peer.ID,
+	robotID := peer.RobotID
+	if peer.isRobot() {
+		holds.robotUp(robotID)
+		reliable.robotUp(robotID)
+		federation.robotUp(robotID)
+		if manager.getPython(robotID) == peer {
+			broadcastPresence(robotID, PresenceRobotConnected, peer.ID)
+		}
+	}
+	if peer.watchesRobot() {
+		peer.Conn.WriteFrame(encodeControlState(peer.ID, arbiter.driver(robotID)), nil)
+		if frame := telemetry.cached(robotID, peer.codec()); frame != nil {
+			peer.Conn.WriteFrame(frame, nil)
+		}
+		for _, frame := range diagnostics.alerts(robotID) {
+			peer.Conn.WriteFrame(frame, nil)
+		}
+		if frame := latencySLO.standing(robotID); frame != nil {
+			peer.Conn.WriteFrame(frame, nil)
+		}
+		broadcastPresence(robotID, PresencePeerJoined, peer.ID)
+	}
+	if estops.engaged(robotID) {
+		peer.Conn.WriteFrame(encodeEStop(EStopEngage), nil)
 	}
-	conn.WriteJSON(welcome)
 
 	// Start writer goroutine
 	go writeLoop(peer)
@@ -166,26 +570,80 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 }
 
 func writeLoop(peer *Peer) {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(peer.pingInterval())
 	defer ticker.Stop()
 
 	for {
+		// E-stops jump the queue
 		select {
+		case msg := <-peer.urgent:
+			if writeFrame(peer, msg) != nil {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case msg := <-peer.urgent:
+			if writeFrame(peer, msg) != nil {
+				return
+			}
+
 		case msg, ok := <-peer.SendChan:
 			if !ok {
-				peer.Conn.WriteMessage(websocket.CloseMessage, nil)
+				peer.Conn.Shutdown(websocket.CloseNormalClosure, "")
 				return
 			}
-			peer.mu.Lock()
-			err := peer.Conn.WriteMessage(websocket.BinaryMessage, msg)
-			peer.mu.Unlock()
-			if err != nil {
+			if peer.batchable(msg) && len(peer.SendChan) > 0 {
+				if writeBacklog(peer, msg) != nil {
+					return
+				}
+				continue
+			}
+			if writeFrame(peer, msg) != nil {
 				return
 			}
 
+		case <-peer.twists.ready:
+			msg := popTwist(peer)
+			if msg == nil {
+				continue
+			}
+			frames := []*Frame{msg}
+			for peer.batchable(msg) && len(frames) < protocol.MaxBatchFrames && peer.twists.len() > 0 {
+				if msg := popTwist(peer); msg != nil {
+					frames = append(frames, msg)
+				}
+			}
+			if writeBatch(peer, frames) != nil {
+				return
+			}
+
+		case <-peer.media.ready:
+			// Only when nothing else waits; re-armed for the next pass
+			if len(peer.SendChan) > 0 || len(peer.urgent) > 0 {
+				peer.media.signal()
+				continue
+			}
+			msg := peer.media.pop()
+			if msg == nil {
+				continue
+			}
+			if writeFrame(peer, msg) != nil {
+				return
+			}
+
+		case <-peer.quit:
+			flushAndClose(peer)
+			return
+
 		case <-ticker.C:
+			// Counted before it is on the wire, so a quick pong can't find
+			// the count behind it
+			peer.pinged()
 			peer.mu.Lock()
-			err := peer.Conn.WriteMessage(websocket.PingMessage, nil)
+			err := peer.Conn.Ping()
 			peer.mu.Unlock()
 			if err != nil {
 				return
@@ -194,21 +652,87 @@ func writeLoop(peer *Peer) {
 	}
 }
 
-func readLoop(peer *Peer) {
-	peer.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	peer.Conn.SetPongHandler(func(string) error {
-		peer.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+// popTwist returns the next queued twist to write, or nil when the queue
+// is empty or the twist was dropped for an e-stop or as stale
+func popTwist(peer *Peer) *Frame {
+	msg := peer.twists.pop()
+	if msg == nil {
 		return nil
-	})
+	}
+	robotID := manager.robotFor(peer)
+	if refuseStopped(robotID, msg.source, msg.msgID) {
+		msg.release() // queued before the e-stop
+		return nil
+	}
+	if dropStale(robotID, msg) {
+		return nil
+	}
+	return msg
+}
 
+// writeFrame writes f to the peer and releases it
+func writeFrame(peer *Peer, f *Frame) error {
+	peer.mu.Lock()
+	err := writeFrameLocked(peer, f)
+	peer.mu.Unlock()
+	f.release()
+	return err
+}
+
+// writeFrameLocked writes f and its CRC trailer, if any, as one frame
+// without copying it; caller holds peer.mu
+func writeFrameLocked(peer *Peer, f *Frame) error {
+	msg := f.buf
+	if f.text {
+		if err := peer.Conn.(textTransport).WriteText(msg); err != nil {
+			return err
+		}
+		observeMessage("out", "text", len(msg))
+		return nil
+	}
+	msgType := msg[0]
+	if peer.usesProfile(msgType) {
+		encoded, err := peer.codec().encodeProfile(msg)
+		if err != nil {
+			peer.logger().Warn("Frame not encoded in the peer's profile", "msg_type", protocol.TypeName(msgType), "error", err)
+			return nil
+		}
+		msg = encoded
+	}
+	var crcBuf [CRCSize]byte
+	trailer := peer.crcTrailer(msg, &crcBuf)
+	setCompression(peer, msgType, len(msg)+len(trailer))
+	if err := peer.writeTimed(msg, trailer); err != nil {
+		return err
+	}
+	metricBytes.WithLabelValues("out").Add(float64(len(msg) + len(trailer)))
+	observeMessage("out", protocol.TypeName(msgType), len(msg)+len(trailer))
+	peer.msgsOut.Add(1)
+	peer.bytesOut.Add(uint64(len(msg) + len(trailer)))
+	peer.typesOut.add(msgType)
+	return nil
+}
+
+func readLoop(peer *Peer) {
+	defer func() { peer.impaired.close() }()
 	for {
-		msgType, data, err := peer.Conn.ReadMessage()
+		data, err := peer.Conn.ReadFrame()
 		if err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				frameTooLarge(peer, 0)
+			}
 			return
 		}
-		peer.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-
-		if msgType == websocket.BinaryMessage {
+		if len(data) > peer.readLimit {
+			frameTooLarge(peer, len(data))
+			return
+		}
+		peer.touch()
+		peer.active()
+		if config.KernelTimestamps {
+			stampKernelRx(peer)
+		}
+		if !impair(peer, data) {
 			handleBinary(peer, data)
 		}
 	}
@@ -216,106 +740,412 @@ func readLoop(peer *Peer) {
 
 func handleBinary(peer *Peer, data []byte) {
 	if len(data) < 1 {
+		rejectFrame(peer, data, ProtoErrTooShort, 1)
+		return
+	}
+	if data[0] == protocol.MsgTypeBatch {
+		handleBatch(peer, data)
 		return
 	}
+	peer.msgsIn.Add(1)
+	peer.bytesIn.Add(uint64(len(data)))
+	metricBytes.WithLabelValues("in").Add(float64(len(data)))
+	wireSize := len(data)
+	recorder.record(RecordIn, manager.robotFor(peer), peer, data)
+
+	if peer.usesCRC(data[0]) {
+		payload, ok := verifyCRC(data)
+		if !ok {
+			crcFailures.Add(1)
+			rejectFrame(peer, data, ProtoErrBadCRC, 0)
+			return
+		}
+		data = payload
+	}
+	if peer.usesProfile(data[0]) {
+		codec := peer.codec()
+		frame, err := codec.decodeProfile(data)
+		if err != nil {
+			peer.logger().Debug("Frame not decoded", "error", err)
+			code := byte(ProtoErrBadCBOR)
+			if codec.has(FeatureProtobuf) {
+				code = ProtoErrBadProtobuf
+			}
+			rejectFrame(peer, data, code, 0)
+			return
+		}
+		data = frame
+	}
+	metricMessages.WithLabelValues(protocol.TypeName(data[0])).Inc()
+	observeMessage("in", protocol.TypeName(data[0]), wireSize)
+	peer.typesIn.add(data[0])
+
+	var parent trace.SpanContext
+	if peer.usesTrace(data[0]) {
+		minSize := protocol.AckFromPythonSize
+		if data[0] == protocol.MsgTypeTwist {
+			minSize = protocol.TwistBrowserSize
+		}
+		body, sc, ok := splitTraceBlock(data, minSize)
+		if !ok {
+			rejectFrame(peer, data, ProtoErrNoTrace, minSize+TraceBlockSize)
+			return
+		}
+		data, parent = body, sc
+	}
+
+	// Only the primary speaks for the robot; standbys just stay connected
+	if manager.isStandby(peer) {
+		switch data[0] {
+		case protocol.MsgTypeTwistAck, protocol.MsgTypeTelemetry, protocol.MsgTypeOdometry, protocol.MsgTypeMedia,
+			protocol.MsgTypeCommandAck, protocol.MsgTypeRaw, protocol.MsgTypeChat, protocol.MsgTypeFileChunk,
+			protocol.MsgTypeFileAck, protocol.MsgTypeParamResponse, protocol.MsgTypeServiceResponse,
+			protocol.MsgTypeDiagnostics:
+			return
+		}
+	}
 
 	switch data[0] {
-	case MsgTypeTwist:
-		handleTwist(peer, data)
-	case MsgTypeTwistAck:
-		handleAck(peer, data)
-	case MsgTypeClockSyncRequest:
+	case protocol.MsgTypeTwist:
+		handleTwist(peer, data, parent)
+	case protocol.MsgTypeTwistAck:
+		handleAck(peer, data, parent)
+	case protocol.MsgTypeClockSyncRequest:
 		handleClockSync(peer, data)
+	case protocol.MsgTypeEStop:
+		handleEStop(peer, data)
+	case protocol.MsgTypeTelemetry:
+		handleTelemetry(peer, data)
+	case protocol.MsgTypeOdometry:
+		handleOdometry(peer, data)
+	case protocol.MsgTypeMedia:
+		handleMedia(peer, data)
+	case protocol.MsgTypeJoy:
+		handleJoy(peer, data)
+	case protocol.MsgTypeControl:
+		handleControl(peer, data)
+	case protocol.MsgTypeCommand:
+		handleCommand(peer, data)
+	case protocol.MsgTypeCommandAck:
+		handleCommandAck(peer, data)
+	case protocol.MsgTypeRaw:
+		handleRaw(peer, data)
+	case protocol.MsgTypeChat:
+		handleChat(peer, data)
+	case protocol.MsgTypeFileChunk:
+		handleFileChunk(peer, data)
+	case protocol.MsgTypeFileAck:
+		handleFileAck(peer, data)
+	case protocol.MsgTypeParamRequest:
+		handleParamRequest(peer, data)
+	case protocol.MsgTypeParamResponse:
+		handleParamResponse(peer, data)
+	case protocol.MsgTypeServiceCall:
+		handleServiceCall(peer, data)
+	case protocol.MsgTypeServiceResponse:
+		handleServiceResponse(peer, data)
+	case protocol.MsgTypeDiagnostics:
+		handleDiagnostics(peer, data)
+	case protocol.MsgTypeBeaconReply:
+		handleBeaconReply(peer, data)
+	case protocol.MsgTypeHello:
+		handleHello(peer, data)
+	case protocol.MsgTypeSessionAck:
+		handleSessionAck(peer, data)
+	default:
+		rejectFrame(peer, data, ProtoErrUnknownType, 0)
 	}
 }
 
-func handleTwist(peer *Peer, data []byte) {
+// handleTwist forwards a browser twist; parent is the browser's span when
+// it sent a trace block
+func handleTwist(peer *Peer, data []byte, parent trace.SpanContext) {
+	start := time.Now()
 	t2 := currentTimeMs() // Relay receive time
 
-	if len(data) < TwistBrowserSize {
-		log.Printf("Invalid twist size: %d", len(data))
+	if peer.Type == "observer" {
+		metricObserverTwists.Inc()
+		peer.logger().Warn("Twist from observer rejected", "msg_type", "twist")
+		return
+	}
+	if len(data) < protocol.TwistBrowserSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.TwistBrowserSize)
+		return
+	}
+	msgID := binary.LittleEndian.Uint64(data[1:9])
+	if checkSequence(peer, msgID, "twist") {
 		return
 	}
 
-	python := manager.getPython()
-	if python == nil {
-		log.Printf("No Python peer")
+	robotID := commandTarget(peer, parseRobotTrailer(data, protocol.TwistBrowserSize))
+	scaleTwist(peer, data)
+
+	tt := traces.startTwist(parent, peer, msgID, binary.LittleEndian.Uint64(data[9:17]), t2)
+	forwarded := false
+	defer func() { traces.finishTwist(tt, robotID, msgID, forwarded) }()
+
+	if refuseStopped(robotID, peer.ID, msgID) {
+		return
+	}
+	if peer.Meta.Supervisor {
+		if forwarded = overrides.command(robotID, peer.ID, twistMoves(data)) &&
+			forwardTwistHops(robotID, peer.ID, data, t2, nil, tt.spanContext()); forwarded {
+			deadman.kick(robotID, peer.ID)
+		}
+		return
+	}
+	if overrides.active(robotID) {
+		peer.logger().Debug("Twist dropped during supervisor override", "robot_id", robotID)
+		sendNack(peer.ID, msgID, NackOverridden)
+		return
+	}
+	if blender != nil {
+		blender.input(robotID, peer, data)
+		deadman.kick(robotID, peer.ID)
+		forwarded = true
+		return
+	}
+	if twistMux != nil {
+		if !twistMux.allow(robotID, peer, msgID) {
+			return
+		}
+		if forwarded = forwardTwistHops(robotID, peer.ID, data, t2, nil, tt.spanContext()); forwarded {
+			metricTwistProcessing.Observe(time.Since(start).Seconds())
+			deadman.kick(robotID, peer.ID)
+		}
 		return
 	}
 
+	driving, claimed := arbiter.take(robotID, peer.ID)
+	if !driving {
+		peer.logger().Debug("Twist from non-driver dropped", "robot_id", robotID)
+		sendNack(peer.ID, msgID, NackNotDriver)
+		return
+	}
+	if claimed {
+		broadcastControlState(robotID)
+	}
+
+	if forwarded = forwardTwistHops(robotID, peer.ID, data, t2, nil, tt.spanContext()); forwarded {
+		metricTwistProcessing.Observe(time.Since(start).Seconds())
+		deadman.kick(robotID, peer.ID)
+	}
+}
+
+// commandTarget returns the robot a browser command is for: the one in
+// its trailer, which the peer is retargeted to (giving up driving its
+// previous robot), or else the one it already addresses
+func commandTarget(peer *Peer, robotID string) string {
+	if robotID != "" {
+		robotID = roomRobotID(peer.Meta.Room, robotID)
+	}
+	prev := manager.robotFor(peer)
+	if robotID == "" || robotID == prev {
+		return prev
+	}
+	manager.retarget(peer, robotID)
+	broadcastPresence(prev, PresencePeerLeft, peer.ID)
+	broadcastPresence(robotID, PresencePeerJoined, peer.ID)
+	if frame := telemetry.cached(robotID, peer.codec()); frame != nil {
+		peer.send(frame)
+	}
+	for _, frame := range diagnostics.alerts(robotID) {
+		peer.send(frame)
+	}
+	if frame := latencySLO.standing(robotID); frame != nil {
+		peer.send(frame)
+	}
+	if arbiter.release(prev, peer.ID) {
+		deadman.trip(prev, "driver switched robots")
+		broadcastControlState(prev)
+	}
+	return robotID
+}
+
+// forwardTwist stamps relay timestamps and the robot trailer onto a browser
+// twist and queues it for the robot's python peer, replacing any twist from
+// the same source still waiting there. t2 is the receive time.
+func forwardTwist(robotID, source string, data []byte, t2 uint64) bool {
+	return forwardTwistHops(robotID, source, data, t2, nil, trace.SpanContext{})
+}
+
+// forwardTwistHops is forwardTwist for a twist that already crossed
+// upstream relays, or is traced; hops reach the robot's peer if it is a
+// relay too, sc if it negotiated trace context
+func forwardTwistHops(robotID, source string, data []byte, t2 uint64, hops []HopRecord, sc trace.SpanContext) bool {
+	msgID := binary.LittleEndian.Uint64(data[1:9])
+	python := manager.getPython(robotID)
+	if python == nil {
+		if holds.hold(robotID, source, msgID, false, data, t2, hops) {
+			return true
+		}
+		slog.Debug("No robot peer", "robot_id", robotID, "source", source)
+		sendNack(source, msgID, NackNoRobot)
+		return false
+	}
+	var expires uint64
+	if msgID != DeadmanMsgID {
+		expires = commandExpiry(source, binary.LittleEndian.Uint64(data[9:17]), t2)
+	}
+	if commandStale(robotID, source, msgID, expires) {
+		return false
+	}
+
 	// Create extended message with relay timestamps
-	extended := make([]byte, TwistToPythonSize)
-	copy(extended, data[:TwistBrowserSize])
+	var extended [protocol.TwistToPythonSize]byte
+	copy(extended[:], data[:protocol.TwistBrowserSize])
+	clampTwist(robotID, extended[:])
+	shapeTwist(robotID, extended[:], msgID)
 
 	// Append relay timestamps (t2 and t3)
 	t3 := currentTimeMs() // Relay forward time
 	binary.LittleEndian.PutUint64(extended[65:], t2)
 	binary.LittleEndian.PutUint64(extended[73:], t3)
+	seq := relaySeqs.next(robotID)
+	out := newFrame()
+	codec := python.codec()
+	out.buf = codec.appendTwist(out.buf, extended[:], robotID)
+	if codec.has(FeatureRelaySeq) {
+		out.buf = appendRelaySeq(out.buf, seq)
+	}
+	if codec.has(FeatureHops) {
+		out.buf = appendHops(out.buf, hops)
+	}
+	if codec.has(FeatureTraceContext) {
+		out.buf = appendTraceBlock(out.buf, sc)
+	}
+	stampCommand(out, source, msgID, expires)
+	recorder.record(RecordOut, robotID, python, out.buf)
+	audit.twist(robotID, source, extended[:])
+	mcapRecorder.add(mcapTwist, robotID, extended[:])
+	foxglove.publishTwist(robotID, extended[:])
 
 	// Send to Python
-	select {
-	case python.SendChan <- extended:
-		msgID := binary.LittleEndian.Uint64(data[1:9])
-		log.Printf("→ Python: Twist #%d (t2=%d, t3=%d)", msgID, t2, t3)
-	default:
-		log.Printf("Python send buffer full")
+	if prev, replaced := python.twists.push(source, out); replaced {
+		latency.forget(robotID, prev)
+		sendNack(source, prev, NackSuperseded)
+	}
+	manager.registry.command(robotID)
+	if msgID != DeadmanMsgID {
+		latency.forwarded(robotID, msgID, source, kernelRxOf(source), seq)
 	}
+	slog.Debug("Twist forwarded", "peer_id", python.ID, "peer_type", python.Type, "msg_type", "twist",
+		"msg_id", msgID, "robot_id", robotID, "source", source, "relay_seq", seq, "t2", t2, "t3", t3)
+	return true
 }
 
-func handleAck(peer *Peer, data []byte) {
+// handleAck forwards a robot's ack to its operators; parent is the
+// robot's span when it sent a trace block
+func handleAck(peer *Peer, data []byte, parent trace.SpanContext) {
+	start := time.Now()
 	t4 := currentTimeMs() // Relay ack receive time
 
-	if peer.Type != "python" {
+	if !peer.isRobot() {
 		return
 	}
 
-	if len(data) < AckFromPythonSize {
-		log.Printf("Invalid ack size: %d bytes (expected %d)", len(data), AckFromPythonSize)
+	// Acks from a downstream relay carry its own times and the hop block
+	var hops []HopRecord
+	var own HopRecord
+	if peer.codec().has(FeatureHops) {
+		body, h, ok := splitHops(data, protocol.AckToBrowserSize)
+		if ok {
+			hops, own, ok = mergeAckHops(body, h)
+		}
+		if !ok {
+			peer.logger().Warn("Ack without valid hop block", "msg_type", "ack")
+			return
+		}
+		data = body
+	}
+
+	if len(data) < protocol.AckFromPythonSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.AckFromPythonSize)
 		return
 	}
 
+	// The python peer is bound to one robot; acks go to its operators
+	robotID := manager.robotFor(peer)
+	manager.registry.ack(robotID)
+
 	// Create extended ack for browser
-	extended := make([]byte, AckToBrowserSize)
-	copy(extended, data[:AckFromPythonSize])
+	var buf [protocol.AckToBrowserSize]byte
+	extended := buf[:]
+	copy(extended, data[:protocol.AckFromPythonSize])
 
 	// Fill t4_relay_ack_rx at offset 61 and append t5 at offset 69
 	t5 := currentTimeMs()
 	binary.LittleEndian.PutUint64(extended[61:69], t4)
 	binary.LittleEndian.PutUint64(extended[69:77], t5)
+	if hops != nil {
+		binary.LittleEndian.PutUint64(extended[17:25], own.TwistRx)
+		binary.LittleEndian.PutUint64(extended[25:33], own.TwistTx)
+	}
+
+	msgID := binary.LittleEndian.Uint64(data[1:9])
+	if msgID == DeadmanMsgID {
+		peer.logger().Info("Robot acked deadman stop", "robot_id", robotID)
+		return
+	}
+	rec := parseLatencyRecord(robotID, extended)
+	pending := latency.sender(robotID, msgID)
+	rec.PeerID, rec.T2KernelRxUs, rec.RelaySeq = pending.source, pending.kernelRx, pending.relaySeq
+	rec.RobotPeerID, rec.T4KernelRxUs = peer.ID, peer.kernelRx.Load()
+	rec.Hops = completeHops(hops)
+	sc, endSpan := traces.startAck(parent, peer, rec)
+	defer endSpan()
 
-	// Forward to all web peers
-	webPeers := manager.getWebPeers()
+	// Forward to web peers addressing this robot, each in its own format;
+	// peers with the same layout share one frame
+	webPeers := manager.getWebPeers(robotID)
+	var encoded [16]*Frame // by Codec.layout()
 	for _, web := range webPeers {
-		select {
-		case web.SendChan <- extended:
-		default:
+		codec := web.codec()
+		f := encoded[codec.layout()]
+		if f == nil {
+			f = newFrame()
+			f.buf = codec.appendAck(f.buf, extended, robotID)
+			if codec.has(FeatureRelaySeq) {
+				f.buf = appendRelaySeq(f.buf, rec.RelaySeq)
+			}
+			if codec.has(FeatureTraceContext) {
+				f.buf = appendTraceBlock(f.buf, sc)
+			}
+			encoded[codec.layout()] = f
+		}
+		web.sendFrame(f.retain())
+	}
+	for _, f := range encoded {
+		if f != nil {
+			f.release()
 		}
 	}
+	if recorder != nil {
+		recorder.record(RecordOut, robotID, nil, legacyCodec.ack(extended, robotID))
+	}
+	federation.forwardAck(robotID, extended, hops)
+	latency.add(rec)
+	latencySLO.observe(robotID, rec.roundTrip())
+	mcapRecorder.add(mcapAck, robotID, extended)
+	foxglove.publish(foxgloveChanAck, rec)
+	metricAckProcessing.Observe(time.Since(start).Seconds())
 
-	msgID := binary.LittleEndian.Uint64(data[1:9])
-	log.Printf("← Browser: Ack #%d to %d peers (t4=%d, t5=%d)", msgID, len(webPeers), t4, t5)
+	peer.logger().Debug("Ack forwarded", "msg_type", "ack", "msg_id", msgID, "robot_id", robotID,
+		"web_peers", len(webPeers), "t4", t4, "t5", t5,
+		"round_trip_ms", rec.roundTrip(), "python_ms", rec.pythonProcessing())
 }
 
 func handleClockSync(peer *Peer, data []byte) {
 	t2 := currentTimeMs()
 
-	if len(data) < ClockSyncReqSize {
+	req, err := protocol.UnmarshalClockSyncReq(data)
+	if err != nil {
 		return
 	}
 
-	t1 := binary.LittleEndian.Uint64(data[1:9])
-	t3 := currentTimeMs()
-
-	resp := make([]byte, ClockSyncRespSize)
-	resp[0] = MsgTypeClockSyncResp
-	binary.LittleEndian.PutUint64(resp[1:], t1)
-	binary.LittleEndian.PutUint64(resp[9:], t2)
-	binary.LittleEndian.PutUint64(resp[17:], t3)
-
-	select {
-	case peer.SendChan <- resp:
-		log.Printf("Clock sync: t1=%d t2=%d t3=%d", t1, t2, t3)
-	default:
+	resp := protocol.ClockSyncResp{T1: req.T1, T2: t2, T3: currentTimeMs()}
+	if peer.send(resp.Marshal()) {
+		peer.logger().Debug("Clock sync", "msg_type", "clock_sync", "t1", resp.T1, "t2", resp.T2, "t3", resp.T3)
 	}
 }
 
@@ -332,50 +1162,246 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	manager.mu.RLock()
 	defer manager.mu.RUnlock()
 
+	clocks := make(map[string]ClockSnapshot)
+	rtts := make(map[string]PingRTTSnapshot)
+	sequence := make(map[string]SequenceStats)
+	peers := make(map[string]PeerInfo)
+	observers := 0
+	for id, p := range manager.peers {
+		peers[id] = p.infoFor(p.RobotID)
+		if p.Type == "observer" {
+			observers++
+		}
+		if c := p.clock.snapshot(); c.Samples > 0 {
+			clocks[id] = c
+		}
+		if r := p.rtt.snapshot(); r.Samples > 0 {
+			rtts[id] = r
+		}
+		if s := p.seq.snapshot(); s.Received > 0 {
+			sequence[id] = s
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"total_peers":      len(manager.peers),
-		"web_peers":        len(manager.webPeers),
-		"python_connected": manager.pythonPeer != nil,
+		"peers":            peers,
+		"web_peers":        len(manager.webPeers) - observers,
+		"observers":        observers,
+		"python_connected": len(manager.robots) > 0,
+		"robots":           manager.robotIDs(),
+		"clock_offsets":    clocks,
+		"blend":            blender.snapshot(),
+		"mux":              twistMux.snapshot(),
+		"overrides":        overrides.snapshot(),
+		"ack_timeouts":     ackTimeouts.snapshot(),
+		"latency_slo":      latencySLO.snapshot(),
+		"pending_commands": reliable.snapshot(),
+		"file_transfers":   transfers.snapshot(),
+		"pending_services": services.snapshot(),
+		"clock_steps":      clockSteps.snapshot(),
+		"ping_rtt":         rtts,
+		"crc_failures":     crcFailures.Load(),
+		"protocol_errors":  protocolErrorCounts(),
+		"stale_dropped":    staleDropped.Load(),
+		"held":             holds.snapshot(),
+		"standby":          manager.standbySnapshot(),
+		"impairment":       impairer.get(),
+		"sequence":         sequence,
+		"estopped":         estops.snapshot(),
+		"telemetry":        telemetry.snapshot(),
+		"odometry":         odometry.snapshot(),
+		"media":            media.snapshot(),
+		"connections":      limiter.usage(),
 	})
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		if r.Method == "OPTIONS" {
-			return
+// runServe implements `serve [flags]`, the relay itself. It returns once
+// a signal has drained and shut the relay down.
+func runServe(args []string) error {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		fatal("Invalid config", "err", err)
+	}
+	config = cfg
+	if err := setupLogging(config.LogLevel, config.LogFormat); err != nil {
+		fatal("Invalid config", "err", err)
+	}
+	upgrader.ReadBufferSize = config.ReadBufferSize
+	upgrader.WriteBufferSize = config.WriteBufferSize
+	origins = newOriginPolicy(config.AllowedOrigins)
+	upgrader.CheckOrigin = origins.checkOrigin
+	upgrader.EnableCompression = config.Compression
+	if compression, err = newCompressionPolicy(config.CompressionExempt, config.CompressionMinSize); err != nil {
+		fatal("Invalid config", "err", err)
+	}
+	limiter = newConnLimiter(config.MaxConnsPerIP, config.MaxWebPeers)
+	if config.OTLPEndpoint != "" {
+		if err := setupTracing(config.OTLPEndpoint); err != nil {
+			fatal("Tracing failed", "err", err)
 		}
-		next.ServeHTTP(w, r)
-	})
-}
-
-func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	}
+	deadman = newDeadman(config.Deadman)
+	auth = newAuthenticator(config.JWTSecret)
+	latency = newLatencyStore(config.LatencyWindow)
+	if config.DebugAddr != "" {
+		go func() {
+			if err := serveDebug(config.DebugAddr); !errors.Is(err, http.ErrServerClosed) {
+				fatal("Debug listener failed", "err", err)
+			}
+		}()
+	}
+	if config.SyncBeaconInterval > 0 {
+		go runSyncBeacons(config.SyncBeaconInterval)
+	}
+	if config.FailoverTimeout > 0 {
+		go watchPrimaries(config.FailoverTimeout)
+	}
+	if config.IdleTimeout > 0 {
+		go watchIdlePeers(config.IdleTimeout)
+	}
+	if config.SlowConsumerTimeout > 0 {
+		go watchSlowConsumers(config.SlowConsumerTimeout)
+	}
+	go runEventTicker(config.EventsInterval)
+	go watchWallClock()
+	if config.AckTimeout > 0 {
+		go watchAckTimeouts()
+	}
+	if config.LatencySLO > 0 {
+		go watchLatencySLO()
+	}
+	if config.Blend != "" {
+		blender = newBlender()
+		go blender.run(time.Duration(float64(time.Second)/config.BlendRate), config.BlendTimeout, config.Blend)
+	}
+	if len(config.Mux) > 0 {
+		twistMux = newTwistMux(config.Mux)
+	}
+	if config.WebTransportAddr != "" {
+		go func() {
+			if err := serveWebTransport(config.WebTransportAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("WebTransport failed", "err", err)
+			}
+		}()
+	}
+	if config.UDPAddr != "" {
+		if udpListener, err = listenUDP(config.UDPAddr); err != nil {
+			fatal("UDP failed", "err", err)
+		}
+		go udpListener.serve()
+	}
+	if config.TCPAddr != "" {
+		if tcpListener, err = listenTCP(config.TCPAddr); err != nil {
+			fatal("TCP failed", "err", err)
+		}
+		go tcpListener.serve()
+	}
+	if config.UnixSocket != "" {
+		if unixListener, err = listenUnix(config.UnixSocket); err != nil {
+			fatal("Unix socket failed", "err", err)
+		}
+		go unixListener.serve()
+	}
+	if config.GRPCAddr != "" {
+		go func() {
+			if err := serveGRPC(config.GRPCAddr); err != nil {
+				fatal("gRPC failed", "err", err)
+			}
+		}()
+	}
+	if config.MQTT.Broker != "" {
+		if mqttBridge, err = connectMQTT(config.MQTT); err != nil {
+			fatal("MQTT failed", "err", err)
+		}
+	}
+	if config.Zenoh.Router != "" {
+		zenohBridge = connectZenoh(config.Zenoh)
+	}
+	if config.ROS2.Robot != "" {
+		if ros2Robot, err = startROS2(config.ROS2); err != nil {
+			fatal("ROS 2 failed", "err", err)
+		}
+	}
+	if config.Upstream != "" {
+		federation = newFederation(config.Upstream, config.UpstreamToken)
+	}
+	if config.RecordDir != "" {
+		if recorder, err = newRecorder(config.RecordDir); err != nil {
+			fatal("Recording failed", "err", err)
+		}
+		slog.Info("Recording session", "path", recorder.path)
+	}
+	if config.MCAPDir != "" {
+		if mcapRecorder, err = newMCAPRecorder(config.MCAPDir); err != nil {
+			fatal("MCAP recording failed", "err", err)
+		}
+		slog.Info("Recording MCAP", "path", mcapRecorder.path)
+	}
+	if config.AuditDB != "" {
+		if audit, err = openAuditLog(config.AuditDB); err != nil {
+			fatal("Audit log failed", "err", err)
+		}
+		slog.Info("Audit log open", "path", audit.path, "retention", config.AuditRetention, "max_rows", config.AuditMaxRows)
+	}
+	if config.MockRobot {
+		go runMockRobot(config.MockRobotID, config.MockDelay)
+	}
+	if config.Impairment.Uplink.active() || config.Impairment.Downlink.active() {
+		impairer.set(config.Impairment)
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws/data", handleWS)
+	mux.HandleFunc("/ws/rosbridge", handleRosbridge)
+	mux.HandleFunc("/ws/foxglove", handleFoxglove)
 	mux.HandleFunc("/health", handleHealth)
-	mux.HandleFunc("/status", handleStatus)
-	mux.Handle("/", http.FileServer(http.Dir("../web-client")))
-
-	fmt.Println(`
-╔═══════════════════════════════════════════════════════════╗
-║     Teleop Relay - Binary Protocol                        ║
-╚═══════════════════════════════════════════════════════════╝`)
-	fmt.Println()
-	fmt.Println("Binary Message Sizes:")
-	fmt.Println("  0x01 Twist:    65B (browser) → 81B (to Python)")
-	fmt.Println("  0x02 Ack:      69B (Python)  → 77B (to browser)")
-	fmt.Println("  0x03 SyncReq:   9B")
-	fmt.Println("  0x04 SyncResp: 25B")
-	fmt.Println()
-	fmt.Printf("Listening on :%s\n", port)
-	fmt.Println("  WS  /ws/data  - Binary data")
-	fmt.Println("  GET /         - Web client")
-
-	log.Fatal(http.ListenAndServe(":"+port, corsMiddleware(mux)))
+	mux.HandleFunc("GET /health/live", handleLive)
+	mux.HandleFunc("GET /health/ready", handleReady)
+	mux.HandleFunc("/status", requireRead(handleStatus))
+	mux.HandleFunc("GET /robots", requireRead(handleRobots))
+	mux.HandleFunc("GET /diagnostics", requireRead(handleDiagnosticsGet))
+	mux.HandleFunc("GET /control", requireRead(handleControlGet))
+	mux.HandleFunc("POST /control", requireScope("web", handleControlPost))
+	mux.HandleFunc("GET /estop", requireRead(handleEStopGet))
+	mux.HandleFunc("POST /estop", requireScope("web", handleEStopPost))
+	mux.HandleFunc("GET /admin/peers", requireScope("admin", handleAdminPeers))
+	mux.HandleFunc("DELETE /admin/peers/{id}", requireScope("admin", handleAdminKick))
+	mux.HandleFunc("PUT /admin/peers/{id}/profile", requireScope("admin", handleAdminProfilePut))
+	mux.HandleFunc("DELETE /admin/peers/{id}/profile", requireScope("admin", handleAdminProfileDelete))
+	mux.HandleFunc("GET /admin/profiles", requireScope("admin", handleAdminProfiles))
+	mux.HandleFunc("GET /admin/impairment", requireScope("admin", handleImpairmentGet))
+	mux.HandleFunc("PUT /admin/impairment", requireScope("admin", handleImpairmentPut))
+	mux.HandleFunc("DELETE /admin/impairment", requireScope("admin", handleImpairmentDelete))
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/latency", requireRead(handleLatency))
+	mux.HandleFunc("GET /clock", requireRead(handleClock))
+	mux.HandleFunc("GET /protocol", handleProtocol)
+	mux.HandleFunc("GET /export/latency", requireRead(handleLatencyExport))
+	mux.HandleFunc("GET /events", requireRead(handleEvents))
+	mux.Handle("/", newStaticHandler(config.StaticDir))
+
+	for _, w := range config.warnings() {
+		slog.Warn("Config: " + w)
+	}
+	slog.Info("Relay listening", "addr", config.Listen, "tls", config.TLS.describe(),
+		"features", strings.Join(config.features(), ","))
+
+	srv := &http.Server{Addr: config.Listen, Handler: corsMiddleware(mux)}
+	go func() {
+		if err := listenAndServe(srv, config.TLS); !errors.Is(err, http.ErrServerClosed) {
+			fatal("HTTP server failed", "err", err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	slog.Info("Draining", "signal", (<-sig).String(), "timeout", config.DrainTimeout)
+	signal.Stop(sig) // a second signal kills the process immediately
+	shutdown(srv, config.DrainTimeout)
+	recorder.close()
+	mcapRecorder.close()
+	audit.close()
+	return nil
 }
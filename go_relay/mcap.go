@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go_relay/protocol"
+)
+
+/*
+MCAP RECORDING
+==============
+
+With -mcap-dir set, the relay also writes relayed twists, acks and
+telemetry to session-<time>.mcap in that directory, in the "ros2" MCAP
+profile: CDR-encoded messages with ros2msg schemas, so Foxglove opens the
+file directly and rosbag2's MCAP storage plugin can play it back. Each
+robot gets its own topics under /robots/<robot ID>, with characters ROS
+does not allow in names replaced by "_" (the channel's robot_id metadata
+keeps the original):
+
+  .../cmd_vel    geometry_msgs/msg/TwistStamped, as forwarded (clamped);
+                 header.stamp is t2, when the relay received it
+  .../ack        teleop_relay/msg/TwistAck, the ack timestamps of /latency;
+                 header.stamp is t5
+  .../telemetry  teleop_relay/msg/Telemetry; header.stamp is the relay's
+                 receive time, robot_time the robot's own clock
+
+Log times are the relay's clock when it handled the message; publish
+times are the sender's (t1, t4 and robot_time). Messages are written
+unchunked and the file ends with a summary of schemas, channels and
+statistics. The session file of -record-dir is unaffected.
+*/
+
+// mcapMagic starts and ends every MCAP file
+var mcapMagic = []byte{0x89, 'M', 'C', 'A', 'P', 0x30, '\r', '\n'}
+
+// MCAP record opcodes
+const (
+	mcapOpHeader        = 0x01
+	mcapOpFooter        = 0x02
+	mcapOpSchema        = 0x03
+	mcapOpChannel       = 0x04
+	mcapOpMessage       = 0x05
+	mcapOpStatistics    = 0x0B
+	mcapOpSummaryOffset = 0x0E
+	mcapOpDataEnd       = 0x0F
+)
+
+// What an mcapEntry carries; also the schema ID
+const (
+	mcapTwist = iota + 1
+	mcapAck
+	mcapTelemetry
+)
+
+// rosHeaderDef holds the ros2msg definitions every schema below depends
+// on, after the separator ros2msg puts between them
+const (
+	rosSeparator = "================================================================================\n"
+	rosHeaderDef = rosSeparator + "MSG: std_msgs/Header\nbuiltin_interfaces/Time stamp\nstring frame_id\n" +
+		rosSeparator + "MSG: builtin_interfaces/Time\nint32 sec\nuint32 nanosec\n"
+)
+
+var mcapSchemas = []struct {
+	id     uint16
+	name   string
+	topic  string
+	schema string
+}{
+	{mcapTwist, "geometry_msgs/msg/TwistStamped", "cmd_vel",
+		"std_msgs/Header header\ngeometry_msgs/Twist twist\n" + rosHeaderDef +
+			rosSeparator + "MSG: geometry_msgs/Twist\nVector3 linear\nVector3 angular\n" +
+			rosSeparator + "MSG: geometry_msgs/Vector3\nfloat64 x\nfloat64 y\nfloat64 z\n"},
+	{mcapAck, "teleop_relay/msg/TwistAck", "ack",
+		"std_msgs/Header header\nuint64 msg_id\nuint64 t1_browser_send\nuint64 t2_relay_rx\nuint64 t3_relay_tx\n" +
+			"uint64 t3_python_rx\nuint64 t4_python_ack\nuint64 t4_relay_ack_rx\nuint64 t5_relay_ack_tx\n" +
+			"uint32 python_decode_us\nuint32 python_process_us\nuint32 python_encode_us\n" + rosHeaderDef},
+	{mcapTelemetry, "teleop_relay/msg/Telemetry", "telemetry",
+		"std_msgs/Header header\nuint64 robot_time\nfloat32 battery_pct\nuint8 drive_mode\nuint32 error_flags\n" + rosHeaderDef},
+}
+
+// mcapEntry is one queued message: the relay's frame in its extended
+// form (81-byte twist, 77-byte ack, 18-byte telemetry)
+type mcapEntry struct {
+	kind    int
+	robotID string
+	time    time.Time
+	frame   []byte
+}
+
+type mcapChannelKey struct {
+	kind    int
+	robotID string
+}
+
+// MCAPRecorder writes an MCAP file from a background goroutine, like
+// Recorder
+type MCAPRecorder struct {
+	path  string
+	queue chan mcapEntry
+	done  chan struct{}
+
+	// writer goroutine only
+	w              *bufio.Writer
+	offset         uint64
+	channels       map[mcapChannelKey]uint16
+	counts         map[uint16]uint64
+	seq            uint32
+	start          uint64
+	end            uint64
+	channelRecords [][]byte // as written, repeated in the summary
+}
+
+// mcapRecorder is nil unless -mcap-dir is set
+var mcapRecorder *MCAPRecorder
+
+// newMCAPRecorder creates a session file in dir named after the start time
+func newMCAPRecorder(dir string) (*MCAPRecorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "session-"+time.Now().Format("20060102-150405")+".mcap")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	m := &MCAPRecorder{
+		path:     path,
+		queue:    make(chan mcapEntry, recordQueueSize),
+		done:     make(chan struct{}),
+		w:        bufio.NewWriterSize(f, 64*1024),
+		channels: make(map[mcapChannelKey]uint16),
+		counts:   make(map[uint16]uint64),
+	}
+	go m.run(f)
+	return m, nil
+}
+
+// add queues a copy of frame; it never blocks
+func (m *MCAPRecorder) add(kind int, robotID string, frame []byte) {
+	if m == nil {
+		return
+	}
+	e := mcapEntry{kind: kind, robotID: robotID, time: time.Now(), frame: append([]byte(nil), frame...)}
+	select {
+	case m.queue <- e:
+	default:
+		metricRecordDropped.Inc()
+	}
+}
+
+func (m *MCAPRecorder) run(f *os.File) {
+	defer close(m.done)
+	m.write(mcapMagic)
+	m.record(mcapOpHeader, mcapString(nil, "ros2"), mcapString(nil, "teleop-relay"))
+	for _, s := range mcapSchemas {
+		m.record(mcapOpSchema, schemaRecord(s.id, s.name, s.schema))
+	}
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	for {
+		select {
+		case e, ok := <-m.queue:
+			if !ok {
+				m.finish()
+				if err := m.w.Flush(); err != nil {
+					slog.Error("MCAP write failed", "path", m.path, "err", err)
+				}
+				f.Close()
+				return
+			}
+			m.message(e)
+		case <-flush.C:
+			m.w.Flush()
+		}
+	}
+}
+
+// message writes e, preceded by its channel the first time
+func (m *MCAPRecorder) message(e mcapEntry) {
+	key := mcapChannelKey{e.kind, e.robotID}
+	id, ok := m.channels[key]
+	if !ok {
+		id = uint16(len(m.channels) + 1)
+		m.channels[key] = id
+		rec := channelRecord(id, uint16(e.kind), rosTopic(e.robotID, mcapSchemas[e.kind-1].topic), e.robotID)
+		m.channelRecords = append(m.channelRecords, rec)
+		m.record(mcapOpChannel, rec)
+	}
+
+	logTime := uint64(e.time.UnixNano())
+	data, publishTime := encodeROSMessage(e)
+	m.seq++
+	hdr := make([]byte, 22)
+	le := binary.LittleEndian
+	le.PutUint16(hdr[0:2], id)
+	le.PutUint32(hdr[2:6], m.seq)
+	le.PutUint64(hdr[6:14], logTime)
+	le.PutUint64(hdr[14:22], publishTime)
+	m.record(mcapOpMessage, hdr, data)
+
+	m.counts[id]++
+	if m.start == 0 || logTime < m.start {
+		m.start = logTime
+	}
+	m.end = max(m.end, logTime)
+}
+
+// finish writes the data end, the summary (schemas, channels,
+// statistics), its offsets and the footer
+func (m *MCAPRecorder) finish() {
+	m.record(mcapOpDataEnd, make([]byte, 4)) // data section CRC not computed
+	summaryStart := m.offset
+
+	schemaStart := m.offset
+	for _, s := range mcapSchemas {
+		m.record(mcapOpSchema, schemaRecord(s.id, s.name, s.schema))
+	}
+	channelStart := m.offset
+	for _, rec := range m.channelRecords {
+		m.record(mcapOpChannel, rec)
+	}
+	statsStart := m.offset
+	m.record(mcapOpStatistics, m.statistics())
+
+	offsetStart := m.offset
+	groups := []struct {
+		op         byte
+		start, end uint64
+	}{
+		{mcapOpSchema, schemaStart, channelStart},
+		{mcapOpChannel, channelStart, statsStart},
+		{mcapOpStatistics, statsStart, offsetStart},
+	}
+	for _, g := range groups {
+		if g.end > g.start {
+			rec := make([]byte, 17)
+			rec[0] = g.op
+			binary.LittleEndian.PutUint64(rec[1:9], g.start)
+			binary.LittleEndian.PutUint64(rec[9:17], g.end-g.start)
+			m.record(mcapOpSummaryOffset, rec)
+		}
+	}
+
+	footer := make([]byte, 20) // summary CRC not computed
+	binary.LittleEndian.PutUint64(footer[0:8], summaryStart)
+	binary.LittleEndian.PutUint64(footer[8:16], offsetStart)
+	m.record(mcapOpFooter, footer)
+	m.write(mcapMagic)
+}
+
+func (m *MCAPRecorder) statistics() []byte {
+	le := binary.LittleEndian
+	var total uint64
+	ids := make([]int, 0, len(m.counts))
+	for id, n := range m.counts {
+		total += n
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	b := le.AppendUint64(nil, total)
+	b = le.AppendUint16(b, uint16(len(mcapSchemas)))
+	b = le.AppendUint32(b, uint32(len(m.channels)))
+	b = le.AppendUint32(b, 0) // attachments
+	b = le.AppendUint32(b, 0) // metadata
+	b = le.AppendUint32(b, 0) // chunks
+	b = le.AppendUint64(b, m.start)
+	b = le.AppendUint64(b, m.end)
+	b = le.AppendUint32(b, uint32(len(ids)*10))
+	for _, id := range ids {
+		b = le.AppendUint16(b, uint16(id))
+		b = le.AppendUint64(b, m.counts[uint16(id)])
+	}
+	return b
+}
+
+// record writes one record: opcode, uint64 length, content parts
+func (m *MCAPRecorder) record(op byte, parts ...[]byte) {
+	var n uint64
+	for _, p := range parts {
+		n += uint64(len(p))
+	}
+	var hdr [9]byte
+	hdr[0] = op
+	binary.LittleEndian.PutUint64(hdr[1:], n)
+	m.write(hdr[:])
+	for _, p := range parts {
+		m.write(p)
+	}
+}
+
+func (m *MCAPRecorder) write(b []byte) {
+	m.w.Write(b)
+	m.offset += uint64(len(b))
+}
+
+// close writes the queued messages and the summary, then closes the file
+func (m *MCAPRecorder) close() {
+	if m == nil {
+		return
+	}
+	close(m.queue)
+	<-m.done
+	slog.Info("MCAP recording saved", "path", m.path)
+}
+
+// mcapString appends an MCAP string: uint32 length, then the bytes
+func mcapString(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func schemaRecord(id uint16, name, schema string) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, id)
+	b = mcapString(b, name)
+	b = mcapString(b, "ros2msg")
+	return mcapString(b, schema) // bytes share the string layout
+}
+
+func channelRecord(id, schemaID uint16, topic, robotID string) []byte {
+	le := binary.LittleEndian
+	b := le.AppendUint16(nil, id)
+	b = le.AppendUint16(b, schemaID)
+	b = mcapString(b, topic)
+	b = mcapString(b, "cdr")
+	meta := mcapString(mcapString(nil, "robot_id"), robotID)
+	b = le.AppendUint32(b, uint32(len(meta)))
+	return append(b, meta...)
+}
+
+// rosTopic builds /robots/<robot>/<name>, replacing characters ROS names
+// do not allow
+func rosTopic(robotID, name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, robotID)
+	if safe == "" || safe[0] >= '0' && safe[0] <= '9' {
+		safe = "r" + safe
+	}
+	return "/robots/" + safe + "/" + name
+}
+
+// cdrWriter encodes little-endian CDR; offsets align relative to the end
+// of the 4-byte encapsulation header
+type cdrWriter struct {
+	buf []byte
+}
+
+func newCDRWriter() *cdrWriter {
+	return &cdrWriter{buf: []byte{0x00, 0x01, 0x00, 0x00}} // CDR_LE
+}
+
+func (c *cdrWriter) align(n int) {
+	for (len(c.buf)-4)%n != 0 {
+		c.buf = append(c.buf, 0)
+	}
+}
+
+func (c *cdrWriter) u8(v byte) { c.buf = append(c.buf, v) }
+func (c *cdrWriter) u32(v uint32) {
+	c.align(4)
+	c.buf = binary.LittleEndian.AppendUint32(c.buf, v)
+}
+func (c *cdrWriter) u64(v uint64) {
+	c.align(8)
+	c.buf = binary.LittleEndian.AppendUint64(c.buf, v)
+}
+func (c *cdrWriter) f32(v float32) { c.u32(math.Float32bits(v)) }
+func (c *cdrWriter) f64(v float64) { c.u64(math.Float64bits(v)) }
+
+// str writes a CDR string: length including the terminating NUL
+func (c *cdrWriter) str(s string) {
+	c.u32(uint32(len(s) + 1))
+	c.buf = append(append(c.buf, s...), 0)
+}
+
+// header writes a std_msgs/Header stamped at ms since the Unix epoch
+func (c *cdrWriter) header(ms uint64, frameID string) {
+	c.u32(uint32(int32(ms / 1000)))
+	c.u32(uint32(ms%1000) * 1e6)
+	c.str(frameID)
+}
+
+// encodeROSMessage encodes e as CDR and returns it with its publish time
+func encodeROSMessage(e mcapEntry) (data []byte, publishTime uint64) {
+	le := binary.LittleEndian
+	f := e.frame
+	c := newCDRWriter()
+	switch e.kind {
+	case mcapTwist:
+		c.header(le.Uint64(f[65:73]), e.robotID)
+		for i := 0; i < 6; i++ {
+			c.f64(math.Float64frombits(le.Uint64(f[17+8*i:])))
+		}
+		publishTime = le.Uint64(f[9:17]) * 1e6
+	case mcapAck:
+		c.header(le.Uint64(f[69:77]), e.robotID)
+		for _, off := range []int{1, 9, 17, 25, 33, 41, 61, 69} {
+			c.u64(le.Uint64(f[off:]))
+		}
+		for _, off := range []int{49, 53, 57} {
+			c.u32(le.Uint32(f[off:]))
+		}
+		publishTime = le.Uint64(f[41:49]) * 1e6
+	case mcapTelemetry:
+		c.header(uint64(e.time.UnixMilli()), e.robotID)
+		c.u64(le.Uint64(f[1:9]))
+		c.f32(math.Float32frombits(le.Uint32(f[9:13])))
+		c.u8(f[13])
+		c.u32(le.Uint32(f[14:18]))
+		publishTime = le.Uint64(f[1:9]) * 1e6
+	}
+	return c.buf, publishTime
+}
+
+// mcapOpChunk holds records of other writers' files, see readMCAPTwists
+const mcapOpChunk = 0x06
+
+// readMCAPTwists calls fn for every geometry_msgs Twist or TwistStamped
+// message in an MCAP file, as a browser twist Record at its log time:
+// ours or another tool's, as long as chunks are uncompressed. The robot
+// is the channel's robot_id metadata, else the header's frame_id, else
+// "". Message IDs are numbered from 1 per robot.
+func readMCAPTwists(data []byte, fn func(Record) error) error {
+	if len(data) < 2*len(mcapMagic) || string(data[:len(mcapMagic)]) != string(mcapMagic) {
+		return errors.New("not an MCAP file (bad magic)")
+	}
+	type channel struct {
+		stamped bool
+		robotID string
+	}
+	schemas := make(map[uint16]string)
+	channels := make(map[uint16]channel)
+	msgIDs := make(map[string]uint64)
+
+	var walk func(records []byte) error
+	walk = func(records []byte) error {
+		for len(records) >= 9 {
+			op, n := records[0], binary.LittleEndian.Uint64(records[1:9])
+			if n > uint64(len(records)-9) {
+				return errors.New("MCAP record runs past the end of the file")
+			}
+			body := records[9 : 9+n]
+			records = records[9+n:]
+			r := &mcapReader{b: body}
+
+			switch op {
+			case mcapOpSchema:
+				id := r.u16()
+				schemas[id] = r.str()
+			case mcapOpChannel:
+				id, schemaID := r.u16(), r.u16()
+				r.str() // topic
+				if enc := r.str(); enc != "cdr" {
+					continue
+				}
+				meta := r.stringMap()
+				switch schemas[schemaID] {
+				case "geometry_msgs/msg/TwistStamped":
+					channels[id] = channel{stamped: true, robotID: meta["robot_id"]}
+				case "geometry_msgs/msg/Twist":
+					channels[id] = channel{robotID: meta["robot_id"]}
+				}
+			case mcapOpMessage:
+				id := r.u16()
+				ch, ok := channels[id]
+				if !ok {
+					continue
+				}
+				r.u32() // sequence
+				logTime := r.u64()
+				r.u64() // publish time
+				if r.err != nil {
+					return r.err
+				}
+				robotID, vel, err := decodeROSTwist(r.rest(), ch.stamped)
+				if err != nil {
+					return err
+				}
+				if ch.robotID != "" {
+					robotID = ch.robotID
+				}
+				msgIDs[robotID]++
+				frame := make([]byte, protocol.TwistBrowserSize)
+				frame[0] = protocol.MsgTypeTwist
+				binary.LittleEndian.PutUint64(frame[1:9], msgIDs[robotID])
+				for i, v := range vel {
+					binary.LittleEndian.PutUint64(frame[17+8*i:], math.Float64bits(v))
+				}
+				rec := Record{Time: time.Unix(0, int64(logTime)), Dir: RecordIn, RobotID: robotID, Frame: frame}
+				if err := fn(rec); err != nil {
+					return err
+				}
+			case mcapOpChunk:
+				r.u64() // start time
+				r.u64() // end time
+				r.u64() // uncompressed size
+				r.u32() // CRC
+				if compression := r.str(); compression != "" {
+					return fmt.Errorf("MCAP chunk compressed with %s, which replay cannot read", compression)
+				}
+				inner := r.bytes64()
+				if r.err != nil {
+					return r.err
+				}
+				if err := walk(inner); err != nil {
+					return err
+				}
+			case mcapOpDataEnd:
+				return nil
+			}
+			if r.err != nil {
+				return r.err
+			}
+		}
+		return nil
+	}
+	return walk(data[len(mcapMagic):])
+}
+
+// mcapReader decodes fields of one MCAP record, remembering the first
+// overrun in err
+type mcapReader struct {
+	b   []byte
+	err error
+}
+
+func (r *mcapReader) take(n uint64) []byte {
+	if r.err != nil || n > uint64(len(r.b)) {
+		r.err = errors.New("MCAP record too short")
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *mcapReader) u16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *mcapReader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *mcapReader) u64() uint64 {
+	if b := r.take(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *mcapReader) str() string     { return string(r.take(uint64(r.u32()))) }
+func (r *mcapReader) bytes64() []byte { return r.take(r.u64()) }
+func (r *mcapReader) rest() []byte    { return r.take(uint64(len(r.b))) }
+
+func (r *mcapReader) stringMap() map[string]string {
+	inner := &mcapReader{b: r.take(uint64(r.u32()))}
+	m := make(map[string]string)
+	for r.err == nil && inner.err == nil && len(inner.b) > 0 {
+		k := inner.str()
+		m[k] = inner.str()
+	}
+	if r.err == nil {
+		r.err = inner.err
+	}
+	return m
+}
+
+// decodeROSTwist reads a CDR Twist or TwistStamped, returning the
+// header's frame_id (stamped only) and linear then angular components
+func decodeROSTwist(msg []byte, stamped bool) (frameID string, vel [6]float64, err error) {
+	if len(msg) < 4 || msg[0] != 0 || msg[1] > 1 {
+		return "", vel, errors.New("MCAP twist is not CDR encoded")
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if msg[1] == 1 {
+		order = binary.LittleEndian
+	}
+	b := msg[4:]
+	off := 0
+	need := func(align, n int) bool {
+		off += (align - off%align) % align
+		return off+n <= len(b)
+	}
+	if stamped {
+		if !need(4, 12) {
+			return "", vel, errors.New("MCAP twist header too short")
+		}
+		n := int(order.Uint32(b[off+8:]))
+		off += 12
+		if n == 0 || off+n > len(b) {
+			return "", vel, errors.New("MCAP twist frame_id too long")
+		}
+		frameID = string(b[off : off+n-1])
+		off += n
+	}
+	for i := range vel {
+		if !need(8, 8) {
+			return "", vel, errors.New("MCAP twist too short")
+		}
+		vel[i] = math.Float64frombits(order.Uint64(b[off:]))
+		off += 8
+	}
+	return frameID, vel, nil
+}
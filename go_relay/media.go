@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync"
+
+	"go_relay/protocol"
+)
+
+// Media Chunk header, after which the payload runs to the end of the
+// frame: type, channel, codec, flags, uint32 frame ID, uint16 fragment
+// index, uint16 fragment count
+const (
+	MediaMaxPayload = 64 << 10
+
+	MediaCodecOpaque = 0
+	MediaCodecJPEG   = 1
+	MediaCodecH264   = 2
+
+	MediaFlagKeyframe = 1 << 0
+)
+
+type mediaChunk struct {
+	frameID uint32
+	frame   *Frame
+}
+
+type mediaChannel struct {
+	chunks []mediaChunk
+	skip   uint32 // frame whose remaining fragments are being dropped
+	skipOK bool
+}
+
+// MediaQueue holds the media chunks waiting to be written to one peer,
+// bounded per channel and kept apart from SendChan so video can neither
+// crowd out acks nor be written ahead of them. When a channel is full its
+// oldest whole video frame is discarded: viewers skip a frame rather
+// than fall behind.
+type MediaQueue struct {
+	mu       sync.Mutex
+	channels map[byte]*mediaChannel
+	next     byte          // channel to serve first, for round robin
+	ready    chan struct{} // holds a token while chunks are pending
+}
+
+func newMediaQueue() *MediaQueue {
+	return &MediaQueue{
+		channels: make(map[byte]*mediaChannel),
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// push queues a fragment of frameID on channel, returning how many
+// chunks were dropped to keep within config.MediaBuffer. The queue takes
+// over the caller's reference.
+func (q *MediaQueue) push(channel byte, frameID uint32, f *Frame) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ch, ok := q.channels[channel]
+	if !ok {
+		ch = &mediaChannel{}
+		q.channels[channel] = ch
+	}
+	if ch.skipOK && ch.skip == frameID {
+		f.release()
+		return 1
+	}
+	ch.skipOK = false
+
+	dropped := 0
+	if len(ch.chunks) >= config.MediaBuffer {
+		oldest := ch.chunks[0].frameID
+		if oldest == frameID {
+			// A single frame larger than the buffer: give up on it
+			ch.skip, ch.skipOK = frameID, true
+			f.release()
+			f = nil
+		}
+		kept := ch.chunks[:0]
+		for _, c := range ch.chunks {
+			if c.frameID == oldest {
+				c.frame.release()
+				dropped++
+			} else {
+				kept = append(kept, c)
+			}
+		}
+		clear(ch.chunks[len(kept):])
+		ch.chunks = kept
+		if f == nil {
+			return dropped + 1
+		}
+	}
+	ch.chunks = append(ch.chunks, mediaChunk{frameID, f})
+	q.signal()
+	return dropped
+}
+
+// pop returns the next chunk, taking channels in turn, or nil when the
+// queue is empty. The ready token is re-armed while chunks remain.
+func (q *MediaQueue) pop() *Frame {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := 0; i < 256; i++ {
+		channel := q.next
+		q.next++
+		ch, ok := q.channels[channel]
+		if !ok || len(ch.chunks) == 0 {
+			continue
+		}
+		f := ch.chunks[0].frame
+		ch.chunks[0] = mediaChunk{}
+		ch.chunks = ch.chunks[1:]
+		if q.pending() > 0 {
+			q.signal()
+		}
+		return f
+	}
+	return nil
+}
+
+// len returns the number of queued chunks
+func (q *MediaQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending()
+}
+
+// pending counts queued chunks; caller holds q.mu
+func (q *MediaQueue) pending() int {
+	n := 0
+	for _, ch := range q.channels {
+		n += len(ch.chunks)
+	}
+	return n
+}
+
+// signal arms ready without blocking
+func (q *MediaQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// MediaChannelStats is one robot channel as shown in /status
+type MediaChannelStats struct {
+	Chunks  uint64 `json:"chunks"`
+	Frames  uint64 `json:"frames"` // chunks with fragment index 0
+	Bytes   uint64 `json:"bytes"`  // payload
+	Dropped uint64 `json:"dropped"`
+}
+
+type mediaKey struct {
+	robotID string
+	channel byte
+}
+
+// MediaStats counts media per robot channel
+type MediaStats struct {
+	mu       sync.Mutex
+	channels map[mediaKey]*MediaChannelStats
+}
+
+var media = &MediaStats{channels: make(map[mediaKey]*MediaChannelStats)}
+
+func (m *MediaStats) record(robotID string, channel byte, fragment uint16, payload, dropped int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.channels[mediaKey{robotID, channel}]
+	if !ok {
+		s = &MediaChannelStats{}
+		m.channels[mediaKey{robotID, channel}] = s
+	}
+	s.Chunks++
+	if fragment == 0 {
+		s.Frames++
+	}
+	s.Bytes += uint64(payload)
+	s.Dropped += uint64(dropped)
+}
+
+// snapshot returns robot ID -> channel -> stats
+func (m *MediaStats) snapshot() map[string]map[string]MediaChannelStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[string]map[string]MediaChannelStats)
+	for k, s := range m.channels {
+		if stats[k.robotID] == nil {
+			stats[k.robotID] = make(map[string]MediaChannelStats)
+		}
+		stats[k.robotID][strconv.Itoa(int(k.channel))] = *s
+	}
+	return stats
+}
+
+// handleMedia passes a robot's media chunk through to the web and
+// observer peers on that robot, each through its own MediaQueue
+func handleMedia(peer *Peer, data []byte) {
+	if !peer.isRobot() {
+		return
+	}
+	if len(data) < protocol.MediaHeaderSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.MediaHeaderSize)
+		return
+	}
+	if len(data) > protocol.MediaHeaderSize+MediaMaxPayload {
+		rejectFrame(peer, data, ProtoErrTooLong, protocol.MediaHeaderSize+MediaMaxPayload)
+		return
+	}
+	robotID := manager.robotFor(peer)
+	channel := data[1]
+	frameID := binary.LittleEndian.Uint32(data[4:8])
+	fragment := binary.LittleEndian.Uint16(data[8:10])
+
+	// Shared by every viewer, and the transport may reuse data
+	f := wrapFrame(append([]byte(nil), data...))
+	dropped := 0
+	for _, web := range manager.getWebPeers(robotID) {
+		dropped += web.media.push(channel, frameID, f.retain())
+	}
+	f.release()
+	if dropped > 0 {
+		metricMediaDropped.WithLabelValues(strconv.Itoa(int(channel))).Add(float64(dropped))
+	}
+	media.record(robotID, channel, fragment, len(data)-protocol.MediaHeaderSize, dropped)
+}
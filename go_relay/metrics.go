@@ -0,0 +1,371 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served at /metrics
+var (
+	metricMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_messages_total",
+		Help: "Binary messages received, by message type.",
+	}, []string{"type"})
+
+	metricBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_bytes_total",
+		Help: "Binary payload bytes read from (in) and written to (out) peers.",
+	}, []string{"direction"})
+
+	metricTypedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_typed_messages_total",
+		Help: "Messages read from (in) and written to (out) peers, by message type.",
+	}, []string{"type", "direction"})
+
+	metricTypedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_typed_bytes_total",
+		Help: "Message bytes on the wire each way, by message type.",
+	}, []string{"type", "direction"})
+
+	metricMessageSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "relay_message_size_bytes",
+		Help:    "Wire size of messages each way, by message type.",
+		Buckets: prometheus.ExponentialBuckets(16, 4, 8), // 16 B .. 256 KiB
+	}, []string{"type", "direction"})
+
+	metricPeers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_peers",
+		Help: "Connected peers, by peer type.",
+	}, []string{"peer_type"})
+
+	metricDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_dropped_messages_total",
+		Help: "Messages dropped because the destination send buffer was full, by overflow policy.",
+	}, []string{"peer_type", "policy"})
+
+	metricSubprotocolRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_subprotocol_rejected_total",
+		Help: "/ws/data connections closed for offering no known subprotocol.",
+	})
+
+	metricOversizedFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_oversized_frames_total",
+		Help: "Peers closed for sending a frame over their read limit.",
+	}, []string{"peer_type"})
+
+	metricIdleClosed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_idle_peers_closed_total",
+		Help: "Web and observer peers closed after -idle-timeout without a message.",
+	}, []string{"peer_type"})
+
+	metricClientConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_client_connections_total",
+		Help: "Connections of peers that name a stable client ID; the ID itself is logged.",
+	}, []string{"peer_type"})
+
+	metricResumes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_session_resumes_total",
+		Help: "Resumption tokens presented and how parked sessions ended: resumed, rejected or expired.",
+	}, []string{"result"})
+
+	metricMissedPongs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_missed_pongs_total",
+		Help: "Peers closed for leaving a ping unanswered past the pong timeout.",
+	}, []string{"peer_type"})
+
+	metricSlowConsumers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_slow_consumers_evicted_total",
+		Help: "Peers closed for staying behind on their frames.",
+	}, []string{"peer_type"})
+
+	metricOverflowDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_overflow_disconnects_total",
+		Help: "Peers closed by the disconnect overflow policy.",
+	}, []string{"peer_type"})
+
+	metricOverrides = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_supervisor_overrides_total",
+		Help: "Supervisor overrides started, by robot.",
+	}, []string{"robot"})
+
+	metricBlendedTwists = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_blended_twists_total",
+		Help: "Twists the relay sent robots blended from several drivers' inputs (-blend).",
+	})
+
+	metricMuxDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_mux_dropped_total",
+		Help: "Commands dropped because a higher-priority mux input held the robot (-mux), by input.",
+	}, []string{"input"})
+
+	metricTwistsCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_twists_coalesced_total",
+		Help: "Queued twists replaced by a newer one from the same source before being sent.",
+	})
+
+	metricTwistsClamped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_twists_clamped_total",
+		Help: "Twists whose velocities were clamped to the robot's limits.",
+	}, []string{"robot"})
+
+	metricTwistsShaped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_twists_shaped_total",
+		Help: "Twists whose velocities were rate-limited to the robot's acceleration or jerk limits.",
+	}, []string{"robot"})
+
+	metricCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_reliable_commands_total",
+		Help: "Reliable commands by outcome: received, acked, undelivered or duplicate.",
+	}, []string{"outcome"})
+
+	metricCommandRetransmits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_command_retransmits_total",
+		Help: "Reliable commands sent to a robot again for lack of an ack.",
+	})
+
+	metricAckTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_ack_timeouts_total",
+		Help: "Forwarded twists not acked within -ack-timeout.",
+	}, []string{"robot"})
+
+	metricUnackedRatio = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_unacked_ratio",
+		Help: "Fraction of the robot's latest 100 forwarded twists not acked within -ack-timeout.",
+	}, []string{"robot"})
+
+	metricDuplicatesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_duplicates_dropped_total",
+		Help: "Twists and Joy frames dropped for repeating one of the sender's recent message IDs (-dedup).",
+	}, []string{"msg_type"})
+
+	metricStaleCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_stale_commands_total",
+		Help: "Twists and Joy frames dropped for exceeding -max-command-age.",
+	}, []string{"robot"})
+
+	metricNacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_nacks_total",
+		Help: "Nacks sent to browsers for discarded twists and Joy frames, by reason.",
+	}, []string{"reason"})
+
+	metricBatchedFrames = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_batched_frames_total",
+		Help: "Twists and acks sent packed in Batch frames.",
+	})
+
+	metricCompressed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_compressed_frames_total",
+		Help: "Frames sent with permessage-deflate, by message type.",
+	}, []string{"type"})
+
+	metricProtocolErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_protocol_errors_total",
+		Help: "Frames rejected as malformed or of an unknown type, by reason.",
+	}, []string{"reason"})
+
+	metricHeldCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_held_commands_total",
+		Help: "Commands held during -reconnect-grace, and how held commands ended: flushed, expired or overflow.",
+	}, []string{"result"})
+
+	metricFailovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_failovers_total",
+		Help: "Robots handed from their primary robot peer to a standby, by reason.",
+	}, []string{"reason"})
+
+	metricObserverTwists = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_observer_twists_rejected_total",
+		Help: "Twists and Joy frames sent by read-only observer peers and rejected.",
+	})
+
+	metricOriginRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_origin_rejected_total",
+		Help: "WebSocket and WebTransport upgrades refused because of their Origin.",
+	})
+
+	metricConnsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_connections_rejected_total",
+		Help: "Upgrades refused with 429, by limit hit (per_ip, web_peers).",
+	}, []string{"limit"})
+
+	metricMediaDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_media_dropped_total",
+		Help: "Media chunks discarded because a viewer's channel queue was full, by channel.",
+	}, []string{"channel"})
+
+	metricRawFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_raw_frames_total",
+		Help: "Raw frames forwarded, by direction (to_robot, to_web; one per viewer).",
+	}, []string{"direction"})
+
+	metricFileTransfers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_file_transfers_total",
+		Help: "File transfers by outcome (started, completed, rejected, aborted, timeout, refused).",
+	}, []string{"result"})
+
+	metricFileBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_file_bytes_total",
+		Help: "File chunk data forwarded, by direction (upload to robots, download from them).",
+	}, []string{"direction"})
+
+	metricParamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_param_requests_total",
+		Help: "Parameter requests by op (get, set) and result (ok, a robot status, or not_driver, timeout, no_robot, bad_request, busy from the relay).",
+	}, []string{"op", "result"})
+
+	metricServiceCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_service_calls_total",
+		Help: "Service calls by result (ok, unknown, failed from the robot; timeout, no_robot, busy, forbidden from the relay).",
+	}, []string{"result"})
+
+	metricServiceCallDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "relay_service_call_seconds",
+		Help:    "Time from forwarding a service call to the robot's response.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8), // 1 ms .. 16 s
+	})
+
+	metricDiagComponents = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_diagnostic_components",
+		Help: "Robot components by latest diagnostic level (ok, warn, error, stale).",
+	}, []string{"robot", "level"})
+
+	metricDiagAlerts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_diagnostic_alerts_total",
+		Help: "Diagnostic alerts sent to browsers, by the level entered (error, or the level recovered to).",
+	}, []string{"level"})
+
+	metricSLOP95 = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_latency_slo_p95_seconds",
+		Help: "Round-trip p95 over the -latency-slo-window, per robot.",
+	}, []string{"robot"})
+
+	metricSLODegraded = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "relay_latency_slo_degraded",
+		Help: "1 while a robot's round-trip p95 exceeds -latency-slo, until it recovers.",
+	}, []string{"robot"})
+
+	metricSLOViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_latency_slo_violations_total",
+		Help: "Times a robot's round-trip p95 went over -latency-slo.",
+	}, []string{"robot"})
+
+	metricChatMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_chat_messages_total",
+		Help: "Chat messages relayed to operators.",
+	})
+
+	metricImpaired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "relay_impaired_frames_total",
+		Help: "Inbound frames delayed or dropped by the impairment layer, by direction and result (delayed, dropped, overflow).",
+	}, []string{"direction", "result"})
+
+	metricAuditRows = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_audit_rows_total",
+		Help: "Twist and e-stop rows written to the -audit-db audit log.",
+	})
+
+	metricAuditDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_audit_dropped_total",
+		Help: "Audit rows lost to a full queue or a failed write.",
+	})
+
+	metricRecordDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_recording_dropped_total",
+		Help: "Frames not recorded because the recording or MCAP queue was full.",
+	})
+
+	// Relay-internal processing buckets: 10µs .. ~80ms
+	processingBuckets = prometheus.ExponentialBuckets(0.00001, 2, 14)
+
+	metricTwistProcessing = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "relay_twist_processing_seconds",
+		Help:    "Time from twist receive to queueing for Python (t3-t2).",
+		Buckets: processingBuckets,
+	})
+
+	metricAckProcessing = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "relay_ack_processing_seconds",
+		Help:    "Time from ack receive to queueing for browsers (t5-t4).",
+		Buckets: processingBuckets,
+	})
+
+	metricWallClockSteps = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "relay_wall_clock_steps_total",
+		Help: "Jumps of the system wall clock against the relay's monotonic time.",
+	})
+
+	metricWallClockSkew = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "relay_wall_clock_skew_seconds",
+		Help: "System wall clock minus relay time, which follows the wall clock as of startup.",
+	})
+
+	metricKernelRxDelay = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "relay_kernel_rx_delay_seconds",
+		Help:    "Time from the kernel receiving a frame to the relay reading it, with -kernel-timestamps.",
+		Buckets: processingBuckets,
+	}, []string{"peer_type", "clock"})
+
+	metricPingRTT = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "relay_ping_rtt_seconds",
+		Help:    "WebSocket ping to pong round trip, by peer type.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14), // 0.5ms .. ~4s
+	}, []string{"peer_type"})
+)
+
+// observeMessage counts one message of typeName and size wire bytes going
+// in direction ("in" or "out") in the per-type metrics
+func observeMessage(direction, typeName string, size int) {
+	metricTypedMessages.WithLabelValues(typeName, direction).Inc()
+	metricTypedBytes.WithLabelValues(typeName, direction).Add(float64(size))
+	metricMessageSize.WithLabelValues(typeName, direction).Observe(float64(size))
+}
+
+// peerCollector reports every connected peer's queue depths and ping
+// round trips at scrape time, so the series of a peer go away with it
+type peerCollector struct{}
+
+var (
+	sendQueueDepthDesc = prometheus.NewDesc("relay_send_queue_depth",
+		"Frames waiting for a peer's writer, by queue: send (-send-buffer), urgent, twists (coalesced) and media.",
+		[]string{"peer_id", "peer_type", "queue"}, nil)
+	sendQueueCapacityDesc = prometheus.NewDesc("relay_send_queue_capacity",
+		"Size of a peer's send queue, beyond which its overflow policy applies.",
+		[]string{"peer_id", "peer_type"}, nil)
+	peerPingRTTDesc = prometheus.NewDesc("relay_peer_ping_rtt_seconds",
+		"A WebSocket peer's ping round trip: its ewma, min and max since connecting.",
+		[]string{"peer_id", "peer_type", "stat"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(peerCollector{})
+}
+
+func (peerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sendQueueDepthDesc
+	ch <- sendQueueCapacityDesc
+	ch <- peerPingRTTDesc
+}
+
+func (peerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range manager.allPeers() {
+		depths := []struct {
+			queue string
+			n     int
+		}{
+			{"send", len(p.SendChan)},
+			{"urgent", len(p.urgent)},
+			{"twists", p.twists.len()},
+			{"media", p.media.len()},
+		}
+		for _, d := range depths {
+			ch <- prometheus.MustNewConstMetric(sendQueueDepthDesc, prometheus.GaugeValue, float64(d.n), p.ID, p.Type, d.queue)
+		}
+		ch <- prometheus.MustNewConstMetric(sendQueueCapacityDesc, prometheus.GaugeValue, float64(cap(p.SendChan)), p.ID, p.Type)
+
+		if rtt := p.rtt.snapshot(); rtt.Samples > 0 {
+			for stat, ms := range map[string]float64{"ewma": rtt.EWMAMs, "min": rtt.MinMs, "max": rtt.MaxMs} {
+				ch <- prometheus.MustNewConstMetric(peerPingRTTDesc, prometheus.GaugeValue, ms/1000, p.ID, p.Type, stat)
+			}
+		}
+	}
+}
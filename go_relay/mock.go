@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// mockReconnectDelay is how long the mock robot waits before registering
+// again after its peer was closed, e.g. kicked through /admin/peers
+const mockReconnectDelay = time.Second
+
+// runMockRobot serves robotID with an in-process robot peer that acks
+// every twist after delay, until the relay drains
+func runMockRobot(robotID string, delay time.Duration) {
+	for !draining.Load() {
+		t := &mockTransport{
+			delay: delay,
+			in:    make(chan []byte, config.SendBuffer),
+			done:  make(chan struct{}),
+		}
+		peer := newPeer("python", robotID, "mock", t)
+		peer.Meta = PeerMeta{Name: "mock robot"}
+		slog.Info("Mock robot connected", "robot_id", robotID, "delay", delay)
+		servePeer(peer)
+		time.Sleep(mockReconnectDelay)
+	}
+}
+
+// mockTransport is the mock robot's side of its peer. Twists written to
+// it come back as acks on ReadFrame after the simulated processing delay;
+// every other frame is ignored.
+type mockTransport struct {
+	delay time.Duration
+
+	in        chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *mockTransport) ReadFrame() ([]byte, error) {
+	select {
+	case frame := <-t.in:
+		return frame, nil
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// WriteFrame schedules the ack for a twist
+func (t *mockTransport) WriteFrame(msg, trailer []byte) error {
+	twist, err := protocol.UnmarshalTwist(msg, true)
+	if err != nil {
+		return nil
+	}
+	rx := currentTimeMs()
+	time.AfterFunc(t.delay, func() {
+		select {
+		case t.in <- encodeMockAck(twist, rx, currentTimeMs(), t.delay):
+		case <-t.done:
+		default:
+			metricDropped.WithLabelValues("python", OverflowDropNewest).Inc()
+		}
+	})
+	return nil
+}
+
+// Ping has nothing to prove; the mock robot is never silent by accident
+func (t *mockTransport) Ping() error { return nil }
+
+func (t *mockTransport) Shutdown(code int, reason string) { t.Close() }
+
+func (t *mockTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return nil
+}
+
+func (t *mockTransport) RemoteAddr() string { return "mock" }
+
+// encodeMockAck builds the ack a robot would send for a relayed twist,
+// received at rx and acked at tx, reporting process as its processing time
+func encodeMockAck(twist protocol.Twist, rx, tx uint64, process time.Duration) []byte {
+	ack := protocol.AckFor(twist, rx, tx)
+	ack.ProcessUs = uint32(process.Microseconds())
+	return ack.Marshal()
+}
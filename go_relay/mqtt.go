@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTOptions configures the MQTT bridge; an empty broker disables it
+type MQTTOptions struct {
+	Broker      string `yaml:"broker"` // e.g. tcp://localhost:1883
+	ClientID    string `yaml:"client_id"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	TopicPrefix string `yaml:"topic_prefix"`
+}
+
+// MQTTBridge lets robots behind MQTT-only gateways act as python peers.
+// A robot announces itself by publishing any frame (normally its Hello) on
+// <prefix>/<robot>/ack and from then on receives every frame addressed to
+// it on <prefix>/<robot>/cmd; each MQTT message is one binary frame. Like
+// UDP robots, MQTT robots that publish nothing for -read-timeout are
+// dropped, and the relay's Sync Beacons give an idle robot something to
+// answer. The broker's credentials and ACLs, not relay tokens, decide who
+// may publish.
+type MQTTBridge struct {
+	client paho.Client
+	prefix string
+
+	mu     sync.Mutex
+	robots map[string]*mqttTransport // robot ID -> peer
+}
+
+// mqttBridge is set by main when an MQTT broker is configured
+var mqttBridge *MQTTBridge
+
+func connectMQTT(opts MQTTOptions) (*MQTTBridge, error) {
+	b := &MQTTBridge{
+		prefix: strings.TrimSuffix(opts.TopicPrefix, "/"),
+		robots: make(map[string]*mqttTransport),
+	}
+	co := paho.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientID).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetKeepAlive(config.PingInterval).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(b.subscribe).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			slog.Warn("MQTT connection lost", "err", err)
+		})
+	b.client = paho.NewClient(co)
+
+	tok := b.client.Connect()
+	if !tok.WaitTimeout(config.WriteTimeout) {
+		return nil, errors.New("mqtt connect timed out")
+	}
+	if err := tok.Error(); err != nil {
+		return nil, err
+	}
+	slog.Info("MQTT bridge connected", "broker", opts.Broker, "topic_prefix", b.prefix)
+	return b, nil
+}
+
+// subscribe (re)subscribes to every robot's ack topic after each connect
+func (b *MQTTBridge) subscribe(c paho.Client) {
+	topic := b.prefix + "/+/ack"
+	if tok := c.Subscribe(topic, 0, b.handleMessage); tok.Wait() && tok.Error() != nil {
+		slog.Error("MQTT subscribe failed", "topic", topic, "err", tok.Error())
+	}
+}
+
+// handleMessage routes an ack topic message to its robot, registering the
+// robot on its first message
+func (b *MQTTBridge) handleMessage(_ paho.Client, m paho.Message) {
+	rest, ok := strings.CutPrefix(m.Topic(), b.prefix+"/")
+	robotID, ok2 := strings.CutSuffix(rest, "/ack")
+	if !ok || !ok2 || robotID == "" || len(robotID) > config.RobotIDMaxLen {
+		return
+	}
+	frame := m.Payload()
+	if len(frame) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	t := b.robots[robotID]
+	if t == nil && !draining.Load() {
+		t = &mqttTransport{
+			bridge:  b,
+			robotID: robotID,
+			topic:   b.prefix + "/" + robotID + "/cmd",
+			in:      make(chan []byte, 64),
+			done:    make(chan struct{}),
+		}
+		b.robots[robotID] = t
+		t.peer = newPeer("python", robotID, "", t)
+		go servePeer(t.peer)
+	}
+	b.mu.Unlock()
+	if t != nil {
+		t.deliver(frame)
+	}
+}
+
+func (b *MQTTBridge) forget(t *mqttTransport) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.robots[t.robotID] == t {
+		delete(b.robots, t.robotID)
+	}
+}
+
+func (b *MQTTBridge) close() {
+	b.client.Disconnect(uint(config.WriteTimeout / time.Millisecond))
+}
+
+// mqttTransport is one robot reached through the broker
+type mqttTransport struct {
+	bridge  *MQTTBridge
+	robotID string
+	topic   string // where frames for the robot are published
+	peer    *Peer
+
+	in        chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *mqttTransport) deliver(frame []byte) {
+	select {
+	case t.in <- frame:
+	case <-t.done:
+	default:
+		metricDropped.WithLabelValues("python", OverflowDropNewest).Inc()
+	}
+}
+
+// ReadFrame returns the robot's next message, failing once it has been
+// silent for -read-timeout
+func (t *mqttTransport) ReadFrame() ([]byte, error) {
+	timeout := time.NewTimer(config.ReadTimeout)
+	defer timeout.Stop()
+	select {
+	case frame := <-t.in:
+		return frame, nil
+	case <-timeout.C:
+		return nil, errors.New("mqtt robot timed out")
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// WriteFrame publishes at QoS 0: a lost twist is replaced by the next one
+func (t *mqttTransport) WriteFrame(msg, trailer []byte) error {
+	frame := make([]byte, 0, len(msg)+len(trailer))
+	frame = append(append(frame, msg...), trailer...)
+	tok := t.bridge.client.Publish(t.topic, 0, false, frame)
+	if !tok.WaitTimeout(config.WriteTimeout) {
+		return errors.New("mqtt publish timed out")
+	}
+	return tok.Error()
+}
+
+// Ping sends a Sync Beacon; the robot's Beacon Reply keeps it alive
+func (t *mqttTransport) Ping() error {
+	beacon := encodeSyncBeacon()
+	var crcBuf [CRCSize]byte
+	return t.WriteFrame(beacon, t.peer.crcTrailer(beacon, &crcBuf))
+}
+
+// Shutdown just stops serving the robot; it registers again with its next
+// message
+func (t *mqttTransport) Shutdown(code int, reason string) {
+	t.Close()
+}
+
+func (t *mqttTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.bridge.forget(t)
+	})
+	return nil
+}
+
+// RemoteAddr is the topic the robot is reached on; the broker hides its address
+func (t *mqttTransport) RemoteAddr() string {
+	return "mqtt:" + t.topic
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MuxInput is one named command source of the twist mux
+type MuxInput struct {
+	Name     string        `yaml:"name"`
+	Priority int           `yaml:"priority"` // higher wins
+	Timeout  time.Duration `yaml:"timeout"`  // how long a command keeps the input active
+}
+
+// MuxInputs is the -mux flag: name:priority:timeout,...
+type MuxInputs []MuxInput
+
+func (m *MuxInputs) String() string {
+	if m == nil {
+		return ""
+	}
+	fields := make([]string, len(*m))
+	for i, in := range *m {
+		fields[i] = fmt.Sprintf("%s:%d:%s", in.Name, in.Priority, in.Timeout)
+	}
+	return strings.Join(fields, ",")
+}
+
+func (m *MuxInputs) Set(spec string) error {
+	var next MuxInputs
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		parts := strings.Split(field, ":")
+		if len(parts) != 3 {
+			return fmt.Errorf("mux input %q is not name:priority:timeout", field)
+		}
+		priority, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return fmt.Errorf("mux input %s: priority: %w", parts[0], err)
+		}
+		timeout, err := time.ParseDuration(parts[2])
+		if err != nil {
+			return fmt.Errorf("mux input %s: timeout: %w", parts[0], err)
+		}
+		next = append(next, MuxInput{Name: parts[0], Priority: priority, Timeout: timeout})
+	}
+	*m = next
+	return nil
+}
+
+func (m MuxInputs) validate() error {
+	seen := make(map[string]bool, len(m))
+	for _, in := range m {
+		switch {
+		case in.Name == "":
+			return errors.New("mux input without a name")
+		case seen[in.Name]:
+			return fmt.Errorf("mux input %s listed twice", in.Name)
+		case in.Timeout <= 0:
+			return fmt.Errorf("mux input %s: timeout must be positive", in.Name)
+		}
+		seen[in.Name] = true
+	}
+	return nil
+}
+
+// TwistMux selects which input's commands reach a robot, as ROS's
+// twist_mux does. Every web peer belongs to an input (?mux_input=, the
+// first one configured by default), and an input stays active for a robot
+// for its timeout after its last command to it. A command is forwarded
+// only while no other active input has a higher priority, so e.g. safety
+// preempts teleop, teleop preempts autonomy, and control falls back as
+// soon as the higher input goes quiet. Within an input the latest command
+// wins; the mux replaces driver arbitration.
+type TwistMux struct {
+	inputs map[string]MuxInput
+	first  string
+
+	mu     sync.Mutex
+	robots map[string]map[string]time.Time // robot ID -> input -> last command
+}
+
+// MuxState is a robot's mux as reported in /status
+type MuxState struct {
+	Selected string           `json:"selected"` // highest-priority active input
+	Active   map[string]int64 `json:"active"`   // input -> ms since its last command
+}
+
+// twistMux is nil unless -mux is set
+var twistMux *TwistMux
+
+func newTwistMux(inputs MuxInputs) *TwistMux {
+	m := &TwistMux{inputs: make(map[string]MuxInput, len(inputs)), robots: make(map[string]map[string]time.Time)}
+	for _, in := range inputs {
+		m.inputs[in.Name] = in
+	}
+	m.first = inputs[0].Name
+	return m
+}
+
+// has reports whether name is a configured input; with the mux off
+// there are none
+func (m *TwistMux) has(name string) bool {
+	if m == nil {
+		return false
+	}
+	_, ok := m.inputs[name]
+	return ok
+}
+
+// admit records a command from input for robotID and reports whether it
+// may reach the robot, with the input that holds the robot if not
+func (m *TwistMux) admit(robotID, input string) (bool, string) {
+	if input == "" {
+		input = m.first
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	active := m.robots[robotID]
+	if active == nil {
+		active = make(map[string]time.Time)
+		m.robots[robotID] = active
+	}
+	active[input] = now
+	holder := m.selectLocked(active, now)
+	return m.inputs[holder].Priority <= m.inputs[input].Priority, holder
+}
+
+// selectLocked drops inputs past their timeout and returns the
+// highest-priority one left
+func (m *TwistMux) selectLocked(active map[string]time.Time, now time.Time) string {
+	selected := ""
+	for name, at := range active {
+		in := m.inputs[name]
+		if now.Sub(at) > in.Timeout {
+			delete(active, name)
+			continue
+		}
+		if selected == "" || in.Priority > m.inputs[selected].Priority {
+			selected = name
+		}
+	}
+	return selected
+}
+
+// allow admits a command from peer for robotID, dropping it with a Nack
+// if a higher-priority input holds the robot
+func (m *TwistMux) allow(robotID string, peer *Peer, msgID uint64) bool {
+	ok, holder := m.admit(robotID, peer.Meta.MuxInput)
+	if !ok {
+		peer.logger().Debug("Command dropped by mux", "robot_id", robotID, "input", peer.Meta.MuxInput, "holder", holder)
+		metricMuxDropped.WithLabelValues(holder).Inc()
+		sendNack(peer.ID, msgID, NackMuxed)
+	}
+	return ok
+}
+
+// snapshot returns every robot's active inputs
+func (m *TwistMux) snapshot() map[string]MuxState {
+	if m == nil {
+		return nil
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]MuxState, len(m.robots))
+	for robotID, active := range m.robots {
+		selected := m.selectLocked(active, now)
+		if selected == "" {
+			delete(m.robots, robotID)
+			continue
+		}
+		state := MuxState{Selected: selected, Active: make(map[string]int64, len(active))}
+		for name, at := range active {
+			state.Active[name] = now.Sub(at).Milliseconds()
+		}
+		out[robotID] = state
+	}
+	return out
+}
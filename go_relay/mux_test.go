@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTwistMuxAdmit(t *testing.T) {
+	inputs := MuxInputs{
+		{Name: "teleop", Priority: 10, Timeout: 500 * time.Millisecond},
+		{Name: "safety", Priority: 100, Timeout: 200 * time.Millisecond},
+		{Name: "autonomy", Priority: 1, Timeout: time.Second},
+	}
+	tests := []struct {
+		name       string
+		active     map[string]time.Duration // input -> age of its last command
+		input      string
+		wantOK     bool
+		wantHolder string
+	}{
+		{"idle robot", nil, "autonomy", true, "autonomy"},
+		{"default input", nil, "", true, "teleop"},
+		{"higher input preempts", map[string]time.Duration{"teleop": 0}, "safety", true, "safety"},
+		{"lower input is dropped", map[string]time.Duration{"safety": 50 * time.Millisecond}, "teleop", false, "safety"},
+		{"same input keeps driving", map[string]time.Duration{"teleop": 0}, "teleop", true, "teleop"},
+		{"falls back once the higher input is quiet", map[string]time.Duration{"safety": 300 * time.Millisecond}, "teleop", true, "teleop"},
+		{"lower input within its own timeout does not block", map[string]time.Duration{"autonomy": 0}, "teleop", true, "teleop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTwistMux(inputs)
+			if tt.active != nil {
+				m.robots["r1"] = make(map[string]time.Time)
+				for name, age := range tt.active {
+					m.robots["r1"][name] = time.Now().Add(-age)
+				}
+			}
+			ok, holder := m.admit("r1", tt.input)
+			if ok != tt.wantOK || holder != tt.wantHolder {
+				t.Errorf("admit(%q) = %v, %q, want %v, %q", tt.input, ok, holder, tt.wantOK, tt.wantHolder)
+			}
+		})
+	}
+}
+
+func TestTwistMuxHas(t *testing.T) {
+	var off *TwistMux
+	if off.has("teleop") {
+		t.Error("a relay without -mux accepted a mux input")
+	}
+	m := newTwistMux(MuxInputs{{Name: "teleop", Priority: 1, Timeout: time.Second}})
+	if !m.has("teleop") || m.has("safety") {
+		t.Error("has does not match the configured inputs")
+	}
+}
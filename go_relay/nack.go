@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"go_relay/protocol"
+)
+
+// Nack reason codes: why the relay discarded a browser's command
+const (
+	NackNoRobot     = 1 // no robot peer connected for the target robot
+	NackEStopped    = 2 // the robot is e-stopped
+	NackNotDriver   = 3 // another web peer drives the robot
+	NackSuperseded  = 4 // replaced in the robot's queue by a newer command
+	NackHoldExpired = 5 // held for a reconnect that didn't come in time
+	NackHoldFull    = 6 // pushed out of a full reconnect hold buffer
+	NackOverridden  = 7 // a supervisor overrides the robot's driver
+	NackUndelivered = 8 // a reliable command the robot never acked, see reliable.go
+	NackMuxed       = 9 // a higher-priority mux input holds the robot, see mux.go
+)
+
+// nackReasonName returns the metric label for a Nack reason code
+func nackReasonName(reason byte) string {
+	switch reason {
+	case NackNoRobot:
+		return "no_robot"
+	case NackEStopped:
+		return "estopped"
+	case NackNotDriver:
+		return "not_driver"
+	case NackSuperseded:
+		return "superseded"
+	case NackHoldExpired:
+		return "hold_expired"
+	case NackHoldFull:
+		return "hold_full"
+	case NackOverridden:
+		return "overridden"
+	case NackUndelivered:
+		return "undelivered"
+	case NackMuxed:
+		return "muxed"
+	default:
+		return "unknown"
+	}
+}
+
+// sendNack tells the web peer source that its command msgID was
+// discarded, when -nacks is on. Commands from the deadman or an upstream
+// relay have no browser to tell.
+func sendNack(source string, msgID uint64, reason byte) {
+	if !config.Nacks || msgID == DeadmanMsgID {
+		return
+	}
+	p := manager.getPeer(source)
+	if p == nil || !p.watchesRobot() {
+		return
+	}
+	msg := make([]byte, protocol.NackSize)
+	msg[0] = protocol.MsgTypeNack
+	binary.LittleEndian.PutUint64(msg[1:9], msgID)
+	msg[9] = reason
+	if p.send(msg) {
+		metricNacks.WithLabelValues(nackReasonName(reason)).Inc()
+	}
+}
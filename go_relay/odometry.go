@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// rateWindow is how long events are counted for a windowRate; a stream
+// silent for twice as long reports 0
+const rateWindow = time.Second
+
+// OdometryStats is one robot's odometry stream as shown in /status
+type OdometryStats struct {
+	Received uint64  `json:"received"`
+	RateHz   float64 `json:"rate_hz"`
+	AgeMs    int64   `json:"age_ms"` // since the last one
+}
+
+// windowRate measures how often an event happens; the caller locks
+type windowRate struct {
+	count    uint64
+	last     time.Time
+	window   time.Time // start of the current counting window
+	inWindow int
+	rate     float64 // Hz over the last full window
+}
+
+func (r *windowRate) observe(now time.Time) {
+	if r.window.IsZero() {
+		r.window = now
+	}
+	if elapsed := now.Sub(r.window); elapsed >= rateWindow {
+		r.rate = float64(r.inWindow) / elapsed.Seconds()
+		r.window, r.inWindow = now, 0
+	}
+	r.inWindow++
+	r.count++
+	r.last = now
+}
+
+// hz returns the rate over the last full window, or 0 once it went quiet
+func (r *windowRate) hz() float64 {
+	if time.Since(r.last) > 2*rateWindow {
+		return 0
+	}
+	return r.rate
+}
+
+// OdometryRates tracks how often each robot reports odometry
+type OdometryRates struct {
+	mu     sync.Mutex
+	robots map[string]*windowRate
+}
+
+var odometry = &OdometryRates{robots: make(map[string]*windowRate)}
+
+func (o *OdometryRates) observe(robotID string, now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	r, ok := o.robots[robotID]
+	if !ok {
+		r = &windowRate{}
+		o.robots[robotID] = r
+	}
+	r.observe(now)
+}
+
+// snapshot returns every robot's odometry stats
+func (o *OdometryRates) snapshot() map[string]OdometryStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	stats := make(map[string]OdometryStats, len(o.robots))
+	for robotID, r := range o.robots {
+		stats[robotID] = OdometryStats{Received: r.count, RateHz: r.hz(), AgeMs: time.Since(r.last).Milliseconds()}
+	}
+	return stats
+}
+
+// handleOdometry stamps a robot's odometry with the relay's receive and
+// send times and forwards it to the web and observer peers on that robot
+func handleOdometry(peer *Peer, data []byte) {
+	t2 := currentTimeMs()
+	if !peer.isRobot() {
+		return
+	}
+	if len(data) < protocol.OdometryFromPythonSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.OdometryFromPythonSize)
+		return
+	}
+	robotID := manager.robotFor(peer)
+	odometry.observe(robotID, time.Now())
+
+	var extended [protocol.OdometryToBrowserSize]byte
+	copy(extended[:], data[:protocol.OdometryFromPythonSize])
+	binary.LittleEndian.PutUint64(extended[113:121], t2)
+	binary.LittleEndian.PutUint64(extended[121:129], currentTimeMs())
+
+	for _, web := range manager.getWebPeers(robotID) {
+		web.send(web.codec().appendOdometry(nil, extended[:], robotID))
+	}
+	recorder.record(RecordOut, robotID, nil, extended[:])
+	federation.forwardRobotFrame(robotID, data[:protocol.OdometryFromPythonSize])
+}
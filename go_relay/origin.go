@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// OriginPolicy decides which browser origins may open WebSockets and
+// WebTransport sessions and call the REST API. Patterns are exact origins
+// ("https://app.example.com") or path.Match wildcards
+// ("https://*.example.com", "http://localhost:*"); "*" alone allows
+// everything. Matching ignores case.
+type OriginPolicy struct {
+	patterns []string
+}
+
+// origins is created by main from config.AllowedOrigins and checks both
+// WebSocket upgrades and CORS
+var origins = newOriginPolicy("")
+
+func newOriginPolicy(list string) *OriginPolicy {
+	p := &OriginPolicy{}
+	for _, o := range strings.Split(list, ",") {
+		if o = strings.ToLower(strings.TrimSpace(o)); o != "" {
+			p.patterns = append(p.patterns, o)
+		}
+	}
+	return p
+}
+
+// allows reports whether origin matches a pattern; with no patterns
+// configured every origin is allowed
+func (p *OriginPolicy) allows(origin string) bool {
+	if len(p.patterns) == 0 {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, pattern := range p.patterns {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin is the upgrader's CheckOrigin. Requests without an Origin
+// header come from non-browser clients and are always allowed.
+func (p *OriginPolicy) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || p.allows(origin) {
+		return true
+	}
+	metricOriginRejected.Inc()
+	slog.Warn("Origin rejected", "origin", origin, "remote", r.RemoteAddr, "path", r.URL.Path)
+	return false
+}
+
+// corsMiddleware lets pages from -allowed-origins call the REST API,
+// sending their bearer token; other origins get no CORS headers
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && origins.allows(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		}
+		if r.Method == "OPTIONS" {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
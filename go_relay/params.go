@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// Parameter requests let a browser read and write robot parameters such
+// as max speed or control gains. Only the robot's driver (or a
+// supervisor) may send them, since a gain is as much a command as a
+// twist. As with reliable commands, the relay renumbers requests towards
+// the robot so IDs stay unique across browsers, maps the robot's Param
+// Response back, and answers itself when the robot does not within
+// -param-timeout (its late response is dropped) or when others, observers
+// among them, send requests (not driver).
+
+// maxRobotParams bounds a robot's pending parameter requests
+const maxRobotParams = 64
+
+// ParamRequests holds the requests awaiting a robot's response
+type ParamRequests struct {
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*pendingParam // by relay ID
+}
+
+type pendingParam struct {
+	robotID string
+	source  string
+	reqID   uint64 // the browser's
+	op      byte
+	name    string
+	timer   *time.Timer
+}
+
+var params = &ParamRequests{pending: make(map[uint64]*pendingParam)}
+
+// paramOpName labels a Param Request operation in logs and metrics
+func paramOpName(op byte) string {
+	switch op {
+	case protocol.ParamGet:
+		return "get"
+	case protocol.ParamSet:
+		return "set"
+	default:
+		return "unknown"
+	}
+}
+
+// paramStatusName labels a Param Response status; robot-defined ones are
+// "error"
+func paramStatusName(status byte) string {
+	switch status {
+	case protocol.ParamOK:
+		return "ok"
+	case protocol.ParamUnknown:
+		return "unknown"
+	case protocol.ParamInvalid:
+		return "invalid"
+	case protocol.ParamReadOnly:
+		return "read_only"
+	case protocol.ParamNotDriver:
+		return "not_driver"
+	case protocol.ParamTimeout:
+		return "timeout"
+	case protocol.ParamNoRobot:
+		return "no_robot"
+	case protocol.ParamBadRequest:
+		return "bad_request"
+	case protocol.ParamBusy:
+		return "busy"
+	default:
+		return "error"
+	}
+}
+
+// handleParamRequest forwards a driver's get or set to its robot
+func handleParamRequest(peer *Peer, data []byte) {
+	if !peer.watchesRobot() {
+		return
+	}
+	if len(data) < protocol.ParamMinSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.ParamMinSize)
+		return
+	}
+	req, err := protocol.UnmarshalParam(data)
+	if err != nil || (req.Code != protocol.ParamGet && req.Code != protocol.ParamSet) {
+		peer.logger().Debug("Param request refused", "msg_type", "param_request", "error", err)
+		replyParam(peer, binary.LittleEndian.Uint64(data[1:9]), req.Code, protocol.ParamBadRequest, req.Name)
+		return
+	}
+	robotID := manager.robotFor(peer)
+	if peer.Type == "observer" || (!peer.Meta.Supervisor && arbiter.driver(robotID) != peer.ID) {
+		replyParam(peer, req.RequestID, req.Code, protocol.ParamNotDriver, req.Name)
+		return
+	}
+	python := manager.getPython(robotID)
+	if python == nil || python.Type != "python" {
+		replyParam(peer, req.RequestID, req.Code, protocol.ParamNoRobot, req.Name)
+		return
+	}
+
+	id, ok := params.add(&pendingParam{robotID: robotID, source: peer.ID, reqID: req.RequestID, op: req.Code, name: req.Name})
+	if !ok {
+		replyParam(peer, req.RequestID, req.Code, protocol.ParamBusy, req.Name)
+		return
+	}
+	frame := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint64(frame[1:9], id)
+	python.send(frame)
+	peer.logger().Debug("Param request sent", "msg_type", "param_request", "robot_id", robotID,
+		"op", paramOpName(req.Code), "name", req.Name, "request_id", req.RequestID, "relay_request_id", id)
+}
+
+// add registers p under a new relay ID, expiring it after
+// config.ParamTimeout, unless its robot already has maxRobotParams pending
+func (pr *ParamRequests) add(p *pendingParam) (id uint64, ok bool) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	n := 0
+	for _, other := range pr.pending {
+		if other.robotID == p.robotID {
+			n++
+		}
+	}
+	if n >= maxRobotParams {
+		return 0, false
+	}
+	pr.nextID++
+	id = pr.nextID
+	p.timer = time.AfterFunc(config.ParamTimeout, func() { pr.expire(id) })
+	pr.pending[id] = p
+	return id, true
+}
+
+// handleParamResponse passes the robot's answer to the browser that asked,
+// under the browser's request ID. Answers after the timeout are dropped.
+func handleParamResponse(peer *Peer, data []byte) {
+	if !peer.isRobot() {
+		return
+	}
+	if len(data) < protocol.ParamMinSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.ParamMinSize)
+		return
+	}
+	id := binary.LittleEndian.Uint64(data[1:9])
+	params.mu.Lock()
+	p := params.pending[id]
+	if p == nil || p.robotID != peer.RobotID {
+		params.mu.Unlock()
+		return
+	}
+	p.timer.Stop()
+	delete(params.pending, id)
+	params.mu.Unlock()
+
+	status := data[9]
+	metricParamRequests.WithLabelValues(paramOpName(p.op), paramStatusName(status)).Inc()
+	if status != protocol.ParamOK {
+		peer.logger().Info("Param request failed", "msg_type", "param_response", "op", paramOpName(p.op),
+			"name", p.name, "status", paramStatusName(status))
+	}
+	if web := manager.getPeer(p.source); web != nil && web.watchesRobot() {
+		frame := append([]byte(nil), data...)
+		binary.LittleEndian.PutUint64(frame[1:9], p.reqID)
+		web.send(frame)
+	}
+}
+
+// expire answers a request the robot left unanswered for
+// config.ParamTimeout
+func (pr *ParamRequests) expire(id uint64) {
+	pr.mu.Lock()
+	p := pr.pending[id]
+	delete(pr.pending, id)
+	pr.mu.Unlock()
+	if p == nil {
+		return
+	}
+	if web := manager.getPeer(p.source); web != nil {
+		replyParam(web, p.reqID, p.op, protocol.ParamTimeout, p.name)
+	}
+}
+
+// replyParam answers a browser's request on the robot's behalf, counting
+// it under op and status
+func replyParam(peer *Peer, reqID uint64, op, status byte, name string) {
+	metricParamRequests.WithLabelValues(paramOpName(op), paramStatusName(status)).Inc()
+	frame, err := protocol.Param{Response: true, RequestID: reqID, Code: status, Name: name}.Marshal()
+	if err == nil {
+		peer.send(frame)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go_relay/protocol"
+)
+
+func TestParamRequestsCap(t *testing.T) {
+	saved := config
+	config.ParamTimeout = time.Hour
+	t.Cleanup(func() { config = saved })
+
+	pr := &ParamRequests{pending: make(map[uint64]*pendingParam)}
+	t.Cleanup(func() {
+		for _, p := range pr.pending {
+			p.timer.Stop()
+		}
+	})
+	steps := []struct {
+		name    string
+		robotID string
+		count   int
+		ok      bool
+	}{
+		{"up to the cap", "r1", maxRobotParams, true},
+		{"past the cap", "r1", 1, false},
+		{"another robot", "r2", 1, true},
+	}
+	for _, st := range steps {
+		for i := range st.count {
+			if _, ok := pr.add(&pendingParam{robotID: st.robotID, reqID: uint64(i)}); ok != st.ok {
+				t.Fatalf("%s: request %d ok=%v, want %v", st.name, i, ok, st.ok)
+			}
+		}
+	}
+
+	// Answering one makes room for another
+	for id, p := range pr.pending {
+		if p.robotID == "r1" {
+			p.timer.Stop()
+			delete(pr.pending, id)
+			break
+		}
+	}
+	if _, ok := pr.add(&pendingParam{robotID: "r1"}); !ok {
+		t.Fatal("request refused after one was answered")
+	}
+}
+
+func TestParamStatusName(t *testing.T) {
+	tests := []struct {
+		status byte
+		want   string
+	}{
+		{protocol.ParamOK, "ok"},
+		{protocol.ParamNotDriver, "not_driver"},
+		{protocol.ParamBusy, "busy"},
+		{200, "error"},
+	}
+	for _, tt := range tests {
+		if got := paramStatusName(tt.status); got != tt.want {
+			t.Errorf("paramStatusName(%d) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
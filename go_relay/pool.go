@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"go_relay/protocol"
+)
+
+// pooledFrameCap fits the largest twist or ack with a full robot ID
+// trailer; frames that grew beyond it are left to the GC
+const pooledFrameCap = protocol.TwistToPythonSize + 1 + protocol.MaxRobotIDLen
+
+// Frame is an outbound message queued to one or more peers. Frames from
+// newFrame are reference counted and go back to framePool once every peer
+// they were queued to has written or discarded them; frames wrapping a
+// caller's slice are never pooled.
+type Frame struct {
+	buf    []byte
+	refs   atomic.Int32
+	pooled bool
+	text   bool // a signaling message, see sendText
+
+	// Twists and Joy frames only, see dropStale
+	source  string
+	msgID   uint64
+	expires uint64 // relay time in ms, 0 for never
+}
+
+var framePool = sync.Pool{
+	New: func() any { return &Frame{buf: make([]byte, 0, pooledFrameCap), pooled: true} },
+}
+
+// newFrame returns an empty pooled frame holding one reference
+func newFrame() *Frame {
+	f := framePool.Get().(*Frame)
+	f.buf = f.buf[:0]
+	f.source, f.msgID, f.expires = "", 0, 0
+	f.refs.Store(1)
+	return f
+}
+
+// wrapFrame queues msg as is, for frames off the hot path
+func wrapFrame(msg []byte) *Frame {
+	f := &Frame{buf: msg}
+	f.refs.Store(1)
+	return f
+}
+
+// retain adds a reference for one more queue the frame is placed on
+func (f *Frame) retain() *Frame {
+	f.refs.Add(1)
+	return f
+}
+
+// release drops a reference, recycling the frame after the last one
+func (f *Frame) release() {
+	n := f.refs.Add(-1)
+	switch {
+	case n < 0:
+		panic("frame released too many times")
+	case n == 0 && f.pooled && cap(f.buf) <= pooledFrameCap:
+		framePool.Put(f)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"go_relay/protocol"
+)
+
+// Presence events (second byte of a Presence frame)
+const (
+	PresenceRobotConnected    = 0x01
+	PresenceRobotDisconnected = 0x02
+	PresencePeerJoined        = 0x03 // a web or observer peer
+	PresencePeerLeft          = 0x04
+)
+
+// presenceEventNames label presence events on /events
+var presenceEventNames = map[byte]string{
+	PresenceRobotConnected:    "connected",
+	PresenceRobotDisconnected: "disconnected",
+	PresencePeerJoined:        "joined",
+	PresencePeerLeft:          "left",
+}
+
+// presenceCounts returns whether robotID has a robot peer and how many
+// web and observer peers address it
+func (m *PeerManager) presenceCounts(robotID string) (online bool, web, observers int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, online = m.robots[robotID]
+	for _, p := range m.webPeers {
+		if p.RobotID != robotID {
+			continue
+		}
+		if p.Type == "observer" {
+			observers++
+		} else {
+			web++
+		}
+	}
+	return online, web, observers
+}
+
+// encodePresence builds a Presence frame: type, event, robot connected
+// (0/1), uint16 web peers, uint16 observers (counts after the event), then
+// the length-prefixed ID of the peer the event is about
+func encodePresence(event byte, online bool, web, observers int, peerID string) []byte {
+	frame := make([]byte, protocol.PresenceMinSize, protocol.PresenceMinSize+len(peerID))
+	frame[0] = protocol.MsgTypePresence
+	frame[1] = event
+	if online {
+		frame[2] = 1
+	}
+	binary.LittleEndian.PutUint16(frame[3:5], uint16(min(web, 0xFFFF)))
+	binary.LittleEndian.PutUint16(frame[5:7], uint16(min(observers, 0xFFFF)))
+	frame[7] = byte(len(peerID))
+	return append(frame, peerID...)
+}
+
+// broadcastPresence tells robotID's web and observer peers, and /events,
+// that peerID caused event, with the robot's state and peer counts after it
+func broadcastPresence(robotID string, event byte, peerID string) {
+	online, web, observers := manager.presenceCounts(robotID)
+	frame := encodePresence(event, online, web, observers, peerID)
+	for _, p := range manager.getWebPeers(robotID) {
+		p.send(frame)
+	}
+
+	name, kind := "peer", presenceEventNames[event]
+	if event == PresenceRobotConnected || event == PresenceRobotDisconnected {
+		name = "robot"
+	}
+	events.publish(name, map[string]interface{}{
+		"event":           kind,
+		"robot_id":        robotID,
+		"peer_id":         peerID,
+		"robot_connected": online,
+		"web_peers":       web,
+		"observers":       observers,
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go_relay/protocol"
+)
+
+// SpeedProfiles maps profile names to the factor the relay scales a web
+// peer's twists by; it is also the -speed-profiles flag: name=factor,...
+type SpeedProfiles map[string]float64
+
+func (s *SpeedProfiles) String() string {
+	if s == nil {
+		return ""
+	}
+	fields := make([]string, 0, len(*s))
+	for name, scale := range *s {
+		fields = append(fields, fmt.Sprintf("%s=%g", name, scale))
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ",")
+}
+
+func (s *SpeedProfiles) Set(spec string) error {
+	next := make(SpeedProfiles)
+	for _, field := range strings.Split(spec, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(field, "=")
+		scale, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("speed profile %s: %w", name, err)
+		}
+		next[name] = scale
+	}
+	*s = next
+	return nil
+}
+
+func (s SpeedProfiles) validate() error {
+	for name, scale := range s {
+		if name == "" {
+			return errors.New("speed profile without a name")
+		}
+		if !(scale >= 0 && scale <= 1) {
+			return fmt.Errorf("speed profile %s: scale must be between 0 and 1", name)
+		}
+	}
+	return nil
+}
+
+// names lists the profiles, sorted
+func (s SpeedProfiles) names() []string {
+	out := make([]string, 0, len(s))
+	for name := range s {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// speedProfile is the profile an admin assigned a web peer
+type speedProfile struct {
+	Name  string  `json:"name"`
+	Scale float64 `json:"scale"`
+}
+
+// ProfileAssignments remembers the profile assigned to each client rather
+// than to its connection, so a trainee cannot shed a slow profile by
+// reloading the page or resuming: a reconnecting peer gets it back
+type ProfileAssignments struct {
+	mu    sync.Mutex
+	byKey map[string]*speedProfile
+}
+
+var profileAssignments = &ProfileAssignments{byKey: make(map[string]*speedProfile)}
+
+// profileKey names the client behind peer: its client ID, else its token
+// subject, else its peer ID, which a resumed session keeps
+func profileKey(peer *Peer) string {
+	switch {
+	case peer.Meta.ClientID != "":
+		return "client_id:" + peer.Meta.ClientID
+	case peer.Subject != "":
+		return "subject:" + peer.Subject
+	default:
+		return "peer:" + peer.ID
+	}
+}
+
+// assign gives peer's client profile, or takes it away if profile is nil,
+// on every connection it has open and the ones it opens later
+func (pa *ProfileAssignments) assign(peer *Peer, profile *speedProfile) {
+	key := profileKey(peer)
+	pa.mu.Lock()
+	if profile != nil {
+		pa.byKey[key] = profile
+	} else {
+		delete(pa.byKey, key)
+	}
+	pa.mu.Unlock()
+	peer.profile.Store(profile)
+	for _, p := range manager.allPeers() {
+		if p.Type == "web" && profileKey(p) == key {
+			p.profile.Store(profile)
+		}
+	}
+}
+
+// apply restores the profile of peer's client, once it connected or
+// resumed
+func (pa *ProfileAssignments) apply(peer *Peer) {
+	if peer.Type != "web" {
+		return
+	}
+	pa.mu.Lock()
+	profile := pa.byKey[profileKey(peer)]
+	pa.mu.Unlock()
+	peer.profile.Store(profile)
+}
+
+// scaleTwist rescales the velocities of a browser twist in place by the
+// peer's speed profile, if it has one. It runs before the robot's velocity
+// limits, which still bound the result. Joy frames are not scaled, as the
+// relay does not know how the robot maps their axes.
+func scaleTwist(peer *Peer, data []byte) {
+	profile := peer.profile.Load()
+	if profile == nil || profile.Scale == 1 {
+		return
+	}
+	for off := twistLinearOffset; off < protocol.TwistBrowserSize; off += 8 {
+		v := math.Float64frombits(binary.LittleEndian.Uint64(data[off:]))
+		binary.LittleEndian.PutUint64(data[off:], math.Float64bits(v*profile.Scale))
+	}
+}
+
+// handleAdminProfilePut serves PUT /admin/peers/{id}/profile with
+// {"profile": "<name>"}: the twists of the web peer's client are scaled by
+// that profile from now on, across reconnects, until it is cleared
+func handleAdminProfilePut(w http.ResponseWriter, r *http.Request) {
+	peer := manager.getPeer(r.PathValue("id"))
+	if peer == nil {
+		http.Error(w, "no such peer", http.StatusNotFound)
+		return
+	}
+	if peer.Type != "web" {
+		http.Error(w, "only web peers send twists", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Profile string `json:"profile"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	scale, ok := config.SpeedProfiles[req.Profile]
+	if !ok {
+		http.Error(w, "unknown profile, have "+strings.Join(config.SpeedProfiles.names(), ", "), http.StatusBadRequest)
+		return
+	}
+	profileAssignments.assign(peer, &speedProfile{Name: req.Profile, Scale: scale})
+	peer.logger().Info("Speed profile assigned", "admin", r.RemoteAddr, "profile", req.Profile, "scale", scale)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peer.info())
+}
+
+// handleAdminProfileDelete serves DELETE /admin/peers/{id}/profile: the
+// twists of the peer's client go through unscaled again
+func handleAdminProfileDelete(w http.ResponseWriter, r *http.Request) {
+	peer := manager.getPeer(r.PathValue("id"))
+	if peer == nil {
+		http.Error(w, "no such peer", http.StatusNotFound)
+		return
+	}
+	if peer.profile.Load() != nil {
+		peer.logger().Info("Speed profile cleared", "admin", r.RemoteAddr)
+	}
+	profileAssignments.assign(peer, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peer.info())
+}
+
+// handleAdminProfiles serves GET /admin/profiles: every speed profile
+func handleAdminProfiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"profiles": config.SpeedProfiles,
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestProfileSurvivesReconnect(t *testing.T) {
+	saved := profileAssignments
+	t.Cleanup(func() { profileAssignments = saved })
+
+	novice := &speedProfile{Name: "novice", Scale: 0.3}
+	tests := []struct {
+		name   string
+		first  *Peer
+		second *Peer // the reconnect
+		want   *speedProfile
+	}{
+		{"same client ID", &Peer{ID: "a", Type: "web", Meta: PeerMeta{ClientID: "trainee"}},
+			&Peer{ID: "b", Type: "web", Meta: PeerMeta{ClientID: "trainee"}}, novice},
+		{"same token subject", &Peer{ID: "a", Type: "web", Subject: "alice"},
+			&Peer{ID: "b", Type: "web", Subject: "alice"}, novice},
+		{"resumed peer ID", &Peer{ID: "a", Type: "web"}, &Peer{ID: "a", Type: "web"}, novice},
+		{"another client", &Peer{ID: "a", Type: "web", Meta: PeerMeta{ClientID: "trainee"}},
+			&Peer{ID: "b", Type: "web", Meta: PeerMeta{ClientID: "expert"}}, nil},
+		{"new anonymous connection", &Peer{ID: "a", Type: "web"}, &Peer{ID: "b", Type: "web"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profileAssignments = &ProfileAssignments{byKey: make(map[string]*speedProfile)}
+			profileAssignments.assign(tt.first, novice)
+			if got := tt.first.profile.Load(); got != novice {
+				t.Fatalf("assigned peer has profile %v", got)
+			}
+
+			profileAssignments.apply(tt.second)
+			if got := tt.second.profile.Load(); got != tt.want {
+				t.Fatalf("reconnected peer has profile %v, want %v", got, tt.want)
+			}
+
+			profileAssignments.assign(tt.first, nil)
+			profileAssignments.apply(tt.second)
+			if got := tt.second.profile.Load(); got != nil {
+				t.Fatalf("cleared profile came back as %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A Batch packs several frames into one WebSocket message: the type byte,
+// a uint8 frame count, then each frame behind a uint16 length, exactly as
+// it would otherwise be sent on its own (CRC trailer included). Batches
+// do not nest.
+
+// MaxBatchFrames is the most frames one Batch holds
+const MaxBatchFrames = 255
+
+// NewBatch appends an empty Batch header to dst
+func NewBatch(dst []byte) []byte {
+	return append(dst, MsgTypeBatch, 0)
+}
+
+// AppendBatch adds one frame, the concatenation of parts, to the Batch
+// at the start of batch. The caller keeps to MaxBatchFrames frames of at
+// most 64 KiB each.
+func AppendBatch(batch []byte, parts ...[]byte) []byte {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	batch = binary.LittleEndian.AppendUint16(batch, uint16(n))
+	for _, p := range parts {
+		batch = append(batch, p...)
+	}
+	batch[1]++
+	return batch
+}
+
+// SplitBatch returns the frames of a Batch, sharing data's memory
+func SplitBatch(data []byte) ([][]byte, error) {
+	if err := check(data, MsgTypeBatch, BatchHeaderSize); err != nil {
+		return nil, err
+	}
+	frames := make([][]byte, 0, data[1])
+	rest := data[BatchHeaderSize:]
+	for i := range int(data[1]) {
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("%w: batch frame %d has no length", ErrShort, i)
+		}
+		n := int(binary.LittleEndian.Uint16(rest))
+		if n == 0 || len(rest) < 2+n {
+			return nil, fmt.Errorf("%w: batch frame %d of %d bytes has %d", ErrShort, i, n, len(rest)-2)
+		}
+		frames = append(frames, rest[2:2+n])
+		rest = rest[2+n:]
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%w: %d bytes after the last batch frame", ErrTrailing, len(rest))
+	}
+	return frames, nil
+}
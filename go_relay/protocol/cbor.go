@@ -0,0 +1,207 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The CBOR profile needs only a small part of RFC 8949: definite-length
+// maps with text keys whose values are integers, floats, text, byte
+// strings, booleans or arrays of numbers. cborWriter and cborReader
+// implement that much; tags and indefinite lengths are rejected.
+
+// ErrCBOR is returned for CBOR the profile does not accept
+var ErrCBOR = errors.New("invalid CBOR")
+
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborSimple = 7 << 5
+
+	cborFloat32 = cborSimple | 26
+	cborFloat64 = cborSimple | 27
+
+	cborMaxDepth = 4
+)
+
+type cborWriter struct {
+	buf []byte
+}
+
+// head writes a major type with its argument in the shortest form
+func (w *cborWriter) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		w.buf = append(w.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		w.buf = append(w.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, major|26), uint32(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, major|27), n)
+	}
+}
+
+func (w *cborWriter) uint(n uint64) { w.head(cborUint, n) }
+
+func (w *cborWriter) text(s string) {
+	w.head(cborText, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *cborWriter) bytes(b []byte) {
+	w.head(cborBytes, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *cborWriter) float32(f float32) {
+	w.buf = binary.BigEndian.AppendUint32(append(w.buf, cborFloat32), math.Float32bits(f))
+}
+
+func (w *cborWriter) float64(f float64) {
+	w.buf = binary.BigEndian.AppendUint64(append(w.buf, cborFloat64), math.Float64bits(f))
+}
+
+// cborValue is a decoded item: uint64, int64 (negative only), float64,
+// string, []byte, bool, nil or []any
+type cborValue = any
+
+type cborReader struct {
+	data []byte
+	off  int
+}
+
+func (r *cborReader) byte() (byte, error) {
+	if r.off >= len(r.data) {
+		return 0, fmt.Errorf("%w: truncated", ErrCBOR)
+	}
+	b := r.data[r.off]
+	r.off++
+	return b, nil
+}
+
+func (r *cborReader) take(n uint64) ([]byte, error) {
+	if n > uint64(len(r.data)-r.off) {
+		return nil, fmt.Errorf("%w: truncated", ErrCBOR)
+	}
+	b := r.data[r.off : r.off+int(n)]
+	r.off += int(n)
+	return b, nil
+}
+
+// head reads an item's major type and argument
+func (r *cborReader) head() (major, info byte, n uint64, err error) {
+	b, err := r.byte()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b&0xE0, b&0x1F
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		arg, err := r.take(1 << (info - 24))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		for _, c := range arg {
+			n = n<<8 | uint64(c)
+		}
+		return major, info, n, nil
+	default:
+		return 0, 0, 0, fmt.Errorf("%w: indefinite length or reserved value 0x%02x", ErrCBOR, b)
+	}
+}
+
+// mapLen reads the head of the top-level map
+func (r *cborReader) mapLen() (int, error) {
+	major, _, n, err := r.head()
+	if err != nil {
+		return 0, err
+	}
+	if major != cborMap || n > uint64(len(r.data)) {
+		return 0, fmt.Errorf("%w: frame is not a map", ErrCBOR)
+	}
+	return int(n), nil
+}
+
+func (r *cborReader) value(depth int) (cborValue, error) {
+	if depth > cborMaxDepth {
+		return nil, fmt.Errorf("%w: nested too deep", ErrCBOR)
+	}
+	major, info, n, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborUint:
+		return n, nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("%w: integer out of range", ErrCBOR)
+		}
+		return -1 - int64(n), nil
+	case cborBytes:
+		return r.take(n)
+	case cborText:
+		b, err := r.take(n)
+		return string(b), err
+	case cborArray:
+		if n > uint64(len(r.data)-r.off) {
+			return nil, fmt.Errorf("%w: truncated", ErrCBOR)
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = r.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case cborSimple:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		case 25:
+			return float16(uint16(n)), nil
+		case 26:
+			return float64(math.Float32frombits(uint32(n))), nil
+		case 27:
+			return math.Float64frombits(n), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unsupported item 0x%02x", ErrCBOR, major|info)
+}
+
+// float16 widens an IEEE 754 half-precision value
+func float16(h uint16) float64 {
+	exp := int(h>>10) & 0x1F
+	frac := float64(h & 0x3FF)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(frac, -24)
+	case 0x1F:
+		f = math.Inf(1)
+		if frac != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(frac+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+)
+
+// Diagnostic levels, as in ROS diagnostic_msgs/DiagnosticStatus; decoding
+// reads any higher level as stale
+const (
+	DiagOK    = 0
+	DiagWarn  = 1
+	DiagError = 2
+	DiagStale = 3
+)
+
+// DiagValue is one key/value pair of a DiagStatus
+type DiagValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// DiagStatus is one component's state in a Diagnostics frame
+type DiagStatus struct {
+	Level      byte        `json:"level"`
+	Name       string      `json:"name"`
+	Message    string      `json:"message"`
+	HardwareID string      `json:"hardware_id,omitempty"`
+	Values     []DiagValue `json:"values,omitempty"`
+}
+
+// Diagnostics is a robot's status array (0x2A): type, uint64 robot time,
+// uint8 status count, then per status its level, name, message and
+// hardware ID (each uint8 length then UTF-8), uint8 value count and that
+// many key/value pairs encoded alike
+type Diagnostics struct {
+	Time     uint64
+	Statuses []DiagStatus
+}
+
+// Marshal encodes the array, failing on more than 255 statuses or values
+// or a string over 255 bytes
+func (d Diagnostics) Marshal() ([]byte, error) {
+	if len(d.Statuses) > math.MaxUint8 {
+		return nil, fmt.Errorf("%d diagnostic statuses, at most 255", len(d.Statuses))
+	}
+	frame := make([]byte, DiagnosticsMinSize)
+	frame[0] = MsgTypeDiagnostics
+	le.PutUint64(frame[1:9], d.Time)
+	frame[9] = byte(len(d.Statuses))
+	var err error
+	for _, s := range d.Statuses {
+		if len(s.Values) > math.MaxUint8 {
+			return nil, fmt.Errorf("diagnostic status %q has %d values, at most 255", s.Name, len(s.Values))
+		}
+		frame = append(frame, s.Level)
+		for _, str := range []string{s.Name, s.Message, s.HardwareID} {
+			if frame, err = appendDiagString(frame, str); err != nil {
+				return nil, err
+			}
+		}
+		frame = append(frame, byte(len(s.Values)))
+		for _, v := range s.Values {
+			if frame, err = appendDiagString(frame, v.Key); err != nil {
+				return nil, err
+			}
+			if frame, err = appendDiagString(frame, v.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return frame, nil
+}
+
+func appendDiagString(frame []byte, s string) ([]byte, error) {
+	if len(s) > math.MaxUint8 {
+		return nil, fmt.Errorf("diagnostic string of %d bytes, at most 255", len(s))
+	}
+	return append(append(frame, byte(len(s))), s...), nil
+}
+
+// UnmarshalDiagnostics decodes a Diagnostics frame
+func UnmarshalDiagnostics(frame []byte) (Diagnostics, error) {
+	if err := check(frame, MsgTypeDiagnostics, DiagnosticsMinSize); err != nil {
+		return Diagnostics{}, err
+	}
+	d := Diagnostics{Time: le.Uint64(frame[1:9]), Statuses: make([]DiagStatus, 0, frame[9])}
+	r := diagReader{frame: frame, off: DiagnosticsMinSize}
+	for i := 0; i < int(frame[9]); i++ {
+		s := DiagStatus{Level: min(r.u8(), DiagStale)}
+		s.Name, s.Message, s.HardwareID = r.text(), r.text(), r.text()
+		n := int(r.u8())
+		for j := 0; j < n && !r.short; j++ {
+			s.Values = append(s.Values, DiagValue{Key: r.text(), Value: r.text()})
+		}
+		if r.short {
+			return Diagnostics{}, fmt.Errorf("%w: diagnostics of %d bytes end in status %d", ErrShort, len(frame), i)
+		}
+		d.Statuses = append(d.Statuses, s)
+	}
+	if r.off < len(frame) {
+		return Diagnostics{}, fmt.Errorf("%w: %d bytes after the last diagnostic status", ErrTrailing, len(frame)-r.off)
+	}
+	return d, nil
+}
+
+// diagReader walks a Diagnostics frame, noting when it runs out
+type diagReader struct {
+	frame []byte
+	off   int
+	short bool
+}
+
+func (r *diagReader) u8() byte {
+	if r.off >= len(r.frame) {
+		r.short = true
+		return 0
+	}
+	r.off++
+	return r.frame[r.off-1]
+}
+
+func (r *diagReader) text() string {
+	n := int(r.u8())
+	if r.short || r.off+n > len(r.frame) {
+		r.short = true
+		return ""
+	}
+	r.off += n
+	return string(r.frame[r.off-n : r.off])
+}
+
+// DiagAlert tells browsers a robot component entered or left ERROR
+// (0x2B): type, uint64 relay time, level, uint8 name length, the name,
+// then the status message
+type DiagAlert struct {
+	Time    uint64
+	Level   byte
+	Name    string
+	Message string
+}
+
+func (a DiagAlert) Marshal() []byte {
+	name := a.Name[:min(len(a.Name), math.MaxUint8)]
+	frame := make([]byte, DiagAlertMinSize, DiagAlertMinSize+len(name)+len(a.Message))
+	frame[0] = MsgTypeDiagAlert
+	le.PutUint64(frame[1:9], a.Time)
+	frame[9] = a.Level
+	frame[10] = byte(len(name))
+	frame = append(frame, name...)
+	return append(frame, a.Message...)
+}
+
+func UnmarshalDiagAlert(frame []byte) (DiagAlert, error) {
+	if err := check(frame, MsgTypeDiagAlert, DiagAlertMinSize); err != nil {
+		return DiagAlert{}, err
+	}
+	end := DiagAlertMinSize + int(frame[10])
+	if err := checkSize(frame, end); err != nil {
+		return DiagAlert{}, err
+	}
+	return DiagAlert{
+		Time:    le.Uint64(frame[1:9]),
+		Level:   frame[9],
+		Name:    string(frame[DiagAlertMinSize:end]),
+		Message: string(frame[end:]),
+	}, nil
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func validDiagnostics() Diagnostics {
+	return Diagnostics{Time: 1000, Statuses: []DiagStatus{
+		{Level: DiagOK, Name: "battery", Message: "ok", Values: []DiagValue{{Key: "voltage", Value: "24.1"}}},
+		{Level: DiagError, Name: "left_motor", Message: "overcurrent", HardwareID: "m1"},
+	}}
+}
+
+func TestUnmarshalDiagnostics(t *testing.T) {
+	frame, err := validDiagnostics().Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"valid", frame, nil},
+		{"no statuses", []byte{MsgTypeDiagnostics, 0, 0, 0, 0, 0, 0, 0, 0, 0}, nil},
+		{"cut in a status", frame[:len(frame)-3], ErrShort},
+		{"trailing", append(append([]byte(nil), frame...), 0), ErrTrailing},
+		{"count past the end", append(append([]byte(nil), frame[:9]...), 3), ErrShort},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := UnmarshalDiagnostics(tt.frame); !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func FuzzUnmarshalDiagnostics(f *testing.F) {
+	frame, _ := validDiagnostics().Marshal()
+	f.Add(frame)
+	empty, _ := Diagnostics{Time: 1}.Marshal()
+	f.Add(empty)
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		fuzzRoundTrip(t, frame, UnmarshalDiagnostics, Diagnostics.Marshal)
+	})
+}
+
+func FuzzUnmarshalDiagAlert(f *testing.F) {
+	f.Add(DiagAlert{Time: 5, Level: DiagError, Name: "left_motor", Message: "overcurrent"}.Marshal())
+	f.Add(DiagAlert{Level: DiagOK, Name: "left_motor"}.Marshal())
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		fuzzRoundTrip(t, frame, UnmarshalDiagAlert, infallible(DiagAlert.Marshal))
+	})
+}
+
+func TestUnmarshalDiagnosticsClampsLevel(t *testing.T) {
+	frame, _ := Diagnostics{Statuses: []DiagStatus{{Level: 9, Name: "imu"}}}.Marshal()
+	d, err := UnmarshalDiagnostics(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Statuses[0].Level != DiagStale {
+		t.Fatalf("level %d, want stale", d.Statuses[0].Level)
+	}
+}
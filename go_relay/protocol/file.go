@@ -0,0 +1,101 @@
+package protocol
+
+import "fmt"
+
+// File transfers move a file between a browser and its robot in chunks,
+// the receiver pacing the sender with File Acks.
+const (
+	// FileMaxChunk bounds the data in one File Chunk
+	FileMaxChunk = 64 << 10
+	FileMaxName  = 255 // wire limit of a file name
+
+	FileFlagRequest = 1 << 0 // download request: send me Name from Offset
+	FileFlagLast    = 1 << 1 // the chunk ends the file
+)
+
+// File Ack statuses
+const (
+	FileStatusOK       = 0 // keep sending from Offset, up to Window bytes ahead
+	FileStatusComplete = 1 // the whole file arrived
+	FileStatusRejected = 2 // the receiver refused, or has no such file
+	FileStatusAborted  = 3 // the other end went away or stalled
+)
+
+// FileChunk is one piece of a file (0x24): type, uint32 transfer ID,
+// flags, uint64 offset, uint64 total size, uint8 name length, the name,
+// then up to FileMaxChunk bytes of data. A chunk without data at offset 0
+// opens an upload; the receiver answers with how much it already holds.
+type FileChunk struct {
+	TransferID uint32
+	Flags      byte
+	Offset     uint64
+	Total      uint64
+	Name       string
+	Data       []byte
+}
+
+func (c FileChunk) Marshal() []byte {
+	frame := make([]byte, FileChunkMinSize, FileChunkMinSize+len(c.Name)+len(c.Data))
+	frame[0] = MsgTypeFileChunk
+	le.PutUint32(frame[1:5], c.TransferID)
+	frame[5] = c.Flags
+	le.PutUint64(frame[6:14], c.Offset)
+	le.PutUint64(frame[14:22], c.Total)
+	frame[22] = byte(len(c.Name))
+	frame = append(frame, c.Name...)
+	return append(frame, c.Data...)
+}
+
+// UnmarshalFileChunk decodes a File Chunk; Data aliases frame
+func UnmarshalFileChunk(frame []byte) (FileChunk, error) {
+	if err := check(frame, MsgTypeFileChunk, FileChunkMinSize); err != nil {
+		return FileChunk{}, err
+	}
+	end := FileChunkMinSize + int(frame[22])
+	if err := checkSize(frame, end); err != nil {
+		return FileChunk{}, err
+	}
+	if len(frame)-end > FileMaxChunk {
+		return FileChunk{}, fmt.Errorf("%w: file chunk of %d data bytes, at most %d", ErrTrailing, len(frame)-end, FileMaxChunk)
+	}
+	return FileChunk{
+		TransferID: le.Uint32(frame[1:5]),
+		Flags:      frame[5],
+		Offset:     le.Uint64(frame[6:14]),
+		Total:      le.Uint64(frame[14:22]),
+		Name:       string(frame[FileChunkMinSize:end]),
+		Data:       frame[end:],
+	}, nil
+}
+
+// FileAck paces a transfer (0x25): type, uint32 transfer ID, status,
+// uint64 offset (bytes received in order so far), uint32 window (bytes
+// the receiver takes beyond Offset)
+type FileAck struct {
+	TransferID uint32
+	Status     byte
+	Offset     uint64
+	Window     uint32
+}
+
+func (a FileAck) Marshal() []byte {
+	frame := make([]byte, FileAckSize)
+	frame[0] = MsgTypeFileAck
+	le.PutUint32(frame[1:5], a.TransferID)
+	frame[5] = a.Status
+	le.PutUint64(frame[6:14], a.Offset)
+	le.PutUint32(frame[14:18], a.Window)
+	return frame
+}
+
+func UnmarshalFileAck(frame []byte) (FileAck, error) {
+	if err := check(frame, MsgTypeFileAck, FileAckSize); err != nil {
+		return FileAck{}, err
+	}
+	return FileAck{
+		TransferID: le.Uint32(frame[1:5]),
+		Status:     frame[5],
+		Offset:     le.Uint64(frame[6:14]),
+		Window:     le.Uint32(frame[14:18]),
+	}, nil
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUnmarshalFileChunk(t *testing.T) {
+	valid := FileChunk{TransferID: 3, Flags: FileFlagLast, Offset: 4096, Total: 4100, Name: "map.pgm", Data: []byte("data")}
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"valid", valid.Marshal(), nil},
+		{"open", FileChunk{TransferID: 1, Total: 10, Name: "a"}.Marshal(), nil},
+		{"name past the end", valid.Marshal()[:FileChunkMinSize+3], ErrShort},
+		{"oversized chunk", FileChunk{Name: "big", Data: make([]byte, FileMaxChunk+1)}.Marshal(), ErrTrailing},
+		{"wrong type", FileAck{}.Marshal(), ErrWrongType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := UnmarshalFileChunk(tt.frame); !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func FuzzUnmarshalFileChunk(f *testing.F) {
+	f.Add(FileChunk{TransferID: 3, Offset: 4096, Total: 8192, Name: "map.pgm", Data: []byte("data")}.Marshal())
+	f.Add(FileChunk{TransferID: 4, Flags: FileFlagRequest, Name: "log.txt"}.Marshal())
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		fuzzRoundTrip(t, frame, UnmarshalFileChunk, infallible(FileChunk.Marshal))
+	})
+}
+
+func FuzzUnmarshalFileAck(f *testing.F) {
+	f.Add(FileAck{TransferID: 3, Status: FileStatusOK, Offset: 4096, Window: 65536}.Marshal())
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		fuzzRoundTrip(t, frame, UnmarshalFileAck, infallible(FileAck.Marshal))
+	})
+}
@@ -0,0 +1,255 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+var le = binary.LittleEndian
+
+// Twist is a velocity command (0x01). Browsers send the 65-byte layout:
+// type, msg ID, t1, then linear x/y/z and angular x/y/z as float64. The
+// relay forwards the 81-byte layout, which appends its receive and send
+// times.
+type Twist struct {
+	MsgID         uint64
+	T1BrowserSend uint64     // ms, browser clock
+	Linear        [3]float64 // m/s
+	Angular       [3]float64 // rad/s
+
+	Relayed   bool   // the 81-byte layout, with the two times below
+	T2RelayRx uint64 // ms, relay clock
+	T3RelayTx uint64
+}
+
+// Marshal encodes the twist in the layout selected by Relayed
+func (t Twist) Marshal() []byte {
+	size := TwistBrowserSize
+	if t.Relayed {
+		size = TwistToPythonSize
+	}
+	frame := make([]byte, size)
+	frame[0] = MsgTypeTwist
+	le.PutUint64(frame[1:9], t.MsgID)
+	le.PutUint64(frame[9:17], t.T1BrowserSend)
+	for i, v := range append(t.Linear[:], t.Angular[:]...) {
+		le.PutUint64(frame[17+8*i:], math.Float64bits(v))
+	}
+	if t.Relayed {
+		le.PutUint64(frame[65:73], t.T2RelayRx)
+		le.PutUint64(frame[73:81], t.T3RelayTx)
+	}
+	return frame
+}
+
+// UnmarshalTwist decodes a twist in the browser layout, or the relayed one
+// if relayed is set; anything after it (robot trailer, blocks, CRC) is
+// ignored. Velocities must be finite.
+func UnmarshalTwist(frame []byte, relayed bool) (Twist, error) {
+	size := TwistBrowserSize
+	if relayed {
+		size = TwistToPythonSize
+	}
+	if err := check(frame, MsgTypeTwist, size); err != nil {
+		return Twist{}, err
+	}
+	t := Twist{
+		MsgID:         le.Uint64(frame[1:9]),
+		T1BrowserSend: le.Uint64(frame[9:17]),
+		Relayed:       relayed,
+	}
+	for i := 0; i < 6; i++ {
+		v := math.Float64frombits(le.Uint64(frame[17+8*i:]))
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return Twist{}, fmt.Errorf("%w: twist velocity %d is %v", ErrNotFinite, i, v)
+		}
+		if i < 3 {
+			t.Linear[i] = v
+		} else {
+			t.Angular[i-3] = v
+		}
+	}
+	if relayed {
+		t.T2RelayRx = le.Uint64(frame[65:73])
+		t.T3RelayTx = le.Uint64(frame[73:81])
+	}
+	return t, nil
+}
+
+// Ack answers a twist (0x02). The robot sends the 69-byte layout: type,
+// msg ID, t1-t3 echoed from the relayed twist, its own receive and ack
+// times, three uint32 durations in µs and eight bytes the relay fills
+// with its ack receive time. Browsers get the 77-byte layout, which
+// appends the relay's ack send time.
+type Ack struct {
+	MsgID         uint64
+	T1BrowserSend uint64
+	T2RelayRx     uint64
+	T3RelayTx     uint64
+	T3PythonRx    uint64 // ms, robot clock
+	T4PythonAck   uint64
+	DecodeUs      uint32
+	ProcessUs     uint32
+	EncodeUs      uint32
+	T4RelayAckRx  uint64 // zero from the robot
+
+	ToBrowser    bool // the 77-byte layout, with T5RelayAckTx
+	T5RelayAckTx uint64
+}
+
+// Marshal encodes the ack in the layout selected by ToBrowser
+func (a Ack) Marshal() []byte {
+	size := AckFromPythonSize
+	if a.ToBrowser {
+		size = AckToBrowserSize
+	}
+	frame := make([]byte, size)
+	frame[0] = MsgTypeTwistAck
+	le.PutUint64(frame[1:9], a.MsgID)
+	le.PutUint64(frame[9:17], a.T1BrowserSend)
+	le.PutUint64(frame[17:25], a.T2RelayRx)
+	le.PutUint64(frame[25:33], a.T3RelayTx)
+	le.PutUint64(frame[33:41], a.T3PythonRx)
+	le.PutUint64(frame[41:49], a.T4PythonAck)
+	le.PutUint32(frame[49:53], a.DecodeUs)
+	le.PutUint32(frame[53:57], a.ProcessUs)
+	le.PutUint32(frame[57:61], a.EncodeUs)
+	le.PutUint64(frame[61:69], a.T4RelayAckRx)
+	if a.ToBrowser {
+		le.PutUint64(frame[69:77], a.T5RelayAckTx)
+	}
+	return frame
+}
+
+// UnmarshalAck decodes an ack in the robot's layout, or the browser's if
+// toBrowser is set; anything after it is ignored
+func UnmarshalAck(frame []byte, toBrowser bool) (Ack, error) {
+	size := AckFromPythonSize
+	if toBrowser {
+		size = AckToBrowserSize
+	}
+	if err := check(frame, MsgTypeTwistAck, size); err != nil {
+		return Ack{}, err
+	}
+	a := Ack{
+		MsgID:         le.Uint64(frame[1:9]),
+		T1BrowserSend: le.Uint64(frame[9:17]),
+		T2RelayRx:     le.Uint64(frame[17:25]),
+		T3RelayTx:     le.Uint64(frame[25:33]),
+		T3PythonRx:    le.Uint64(frame[33:41]),
+		T4PythonAck:   le.Uint64(frame[41:49]),
+		DecodeUs:      le.Uint32(frame[49:53]),
+		ProcessUs:     le.Uint32(frame[53:57]),
+		EncodeUs:      le.Uint32(frame[57:61]),
+		T4RelayAckRx:  le.Uint64(frame[61:69]),
+		ToBrowser:     toBrowser,
+	}
+	if toBrowser {
+		a.T5RelayAckTx = le.Uint64(frame[69:77])
+	}
+	return a, nil
+}
+
+// AckFor returns the robot's ack for a relayed twist, received at rx and
+// acked at tx on the robot's clock
+func AckFor(t Twist, rx, tx uint64) Ack {
+	return Ack{
+		MsgID:         t.MsgID,
+		T1BrowserSend: t.T1BrowserSend,
+		T2RelayRx:     t.T2RelayRx,
+		T3RelayTx:     t.T3RelayTx,
+		T3PythonRx:    rx,
+		T4PythonAck:   tx,
+	}
+}
+
+// Hello opens protocol negotiation (0x14): type, version, uint32 feature
+// bits. The relay answers with a Welcome (0x15) of the same layout holding
+// the version and features it agreed to.
+type Hello struct {
+	Welcome  bool
+	Version  byte
+	Features uint32
+}
+
+func (h Hello) Marshal() []byte {
+	frame := make([]byte, HelloSize)
+	frame[0] = MsgTypeHello
+	if h.Welcome {
+		frame[0] = MsgTypeWelcome
+	}
+	frame[1] = h.Version
+	le.PutUint32(frame[2:6], h.Features)
+	return frame
+}
+
+// UnmarshalHello decodes a Hello or Welcome; anything after it (a robot
+// trailer) is ignored
+func UnmarshalHello(frame []byte) (Hello, error) {
+	if len(frame) == 0 {
+		return Hello{}, ErrEmpty
+	}
+	if frame[0] != MsgTypeHello && frame[0] != MsgTypeWelcome {
+		return Hello{}, fmt.Errorf("%w: 0x%02x, want hello or welcome", ErrWrongType, frame[0])
+	}
+	if err := checkSize(frame, HelloSize); err != nil {
+		return Hello{}, err
+	}
+	return Hello{
+		Welcome:  frame[0] == MsgTypeWelcome,
+		Version:  frame[1],
+		Features: le.Uint32(frame[2:6]),
+	}, nil
+}
+
+// ClockSyncReq starts an NTP-style exchange (0x03): type, t1 client send
+type ClockSyncReq struct {
+	T1 uint64
+}
+
+func (r ClockSyncReq) Marshal() []byte {
+	frame := make([]byte, ClockSyncReqSize)
+	frame[0] = MsgTypeClockSyncRequest
+	le.PutUint64(frame[1:9], r.T1)
+	return frame
+}
+
+func UnmarshalClockSyncReq(frame []byte) (ClockSyncReq, error) {
+	if err := check(frame, MsgTypeClockSyncRequest, ClockSyncReqSize); err != nil {
+		return ClockSyncReq{}, err
+	}
+	return ClockSyncReq{T1: le.Uint64(frame[1:9])}, nil
+}
+
+// ClockSyncResp answers a ClockSyncReq (0x04): type, t1 echoed, t2
+// relay receive, t3 relay send
+type ClockSyncResp struct {
+	T1, T2, T3 uint64
+}
+
+func (r ClockSyncResp) Marshal() []byte {
+	frame := make([]byte, ClockSyncRespSize)
+	frame[0] = MsgTypeClockSyncResp
+	le.PutUint64(frame[1:9], r.T1)
+	le.PutUint64(frame[9:17], r.T2)
+	le.PutUint64(frame[17:25], r.T3)
+	return frame
+}
+
+func UnmarshalClockSyncResp(frame []byte) (ClockSyncResp, error) {
+	if err := check(frame, MsgTypeClockSyncResp, ClockSyncRespSize); err != nil {
+		return ClockSyncResp{}, err
+	}
+	return ClockSyncResp{
+		T1: le.Uint64(frame[1:9]),
+		T2: le.Uint64(frame[9:17]),
+		T3: le.Uint64(frame[17:25]),
+	}, nil
+}
+
+// Offset estimates how far the responder's clock is ahead of the
+// requester's, in ms, given the requester's receive time t4
+func (r ClockSyncResp) Offset(t4 uint64) float64 {
+	return (float64(r.T2) - float64(r.T1) + float64(r.T3) - float64(t4)) / 2
+}
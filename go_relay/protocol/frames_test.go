@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestUnmarshalTwist(t *testing.T) {
+	valid := Twist{MsgID: 7, T1BrowserSend: 1000, Linear: [3]float64{0.5, 0, 0}, Angular: [3]float64{0, 0, -1}}
+	nan := valid.Marshal()
+	le.PutUint64(nan[17:], math.Float64bits(math.NaN()))
+	tests := []struct {
+		name    string
+		frame   []byte
+		relayed bool
+		err     error
+	}{
+		{"browser", valid.Marshal(), false, nil},
+		{"with trailer", AppendRobotTrailer(valid.Marshal(), "r1"), false, nil},
+		{"relayed", Twist{MsgID: 7, Relayed: true, T2RelayRx: 1, T3RelayTx: 2}.Marshal(), true, nil},
+		{"relayed too short", valid.Marshal(), true, ErrShort},
+		{"empty", nil, false, ErrEmpty},
+		{"wrong type", Ack{}.Marshal(), false, ErrWrongType},
+		{"not finite", nan, false, ErrNotFinite},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := UnmarshalTwist(tt.frame, tt.relayed)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalHello(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  Hello
+		err   error
+	}{
+		{"hello", Hello{Version: 3, Features: 0x15}.Marshal(), Hello{Version: 3, Features: 0x15}, nil},
+		{"welcome", Hello{Welcome: true, Version: 2, Features: 1}.Marshal(), Hello{Welcome: true, Version: 2, Features: 1}, nil},
+		{"with trailer", AppendRobotTrailer(Hello{Version: 1}.Marshal(), "r1"), Hello{Version: 1}, nil},
+		{"short", []byte{MsgTypeHello, 1}, Hello{}, ErrShort},
+		{"wrong type", ClockSyncReq{}.Marshal(), Hello{}, ErrWrongType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := UnmarshalHello(tt.frame)
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Fatalf("got %+v, %v; want %+v, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func FuzzUnmarshalTwist(f *testing.F) {
+	f.Add(Twist{MsgID: 1, T1BrowserSend: 2, Linear: [3]float64{1, 2, 3}, Angular: [3]float64{4, 5, 6}}.Marshal(), false)
+	f.Add(Twist{MsgID: 1, Relayed: true, T2RelayRx: 3, T3RelayTx: 4}.Marshal(), true)
+	f.Add(AppendRobotTrailer(Twist{MsgID: 9}.Marshal(), "robot-1"), false)
+	f.Fuzz(func(t *testing.T, frame []byte, relayed bool) {
+		fuzzRoundTrip(t, frame, func(b []byte) (Twist, error) { return UnmarshalTwist(b, relayed) }, infallible(Twist.Marshal))
+		if tw, err := UnmarshalTwist(frame, relayed); err == nil && !bytes.HasPrefix(frame, tw.Marshal()) {
+			t.Fatalf("re-encoded twist is not a prefix of % x", frame)
+		}
+	})
+}
+
+func FuzzUnmarshalAck(f *testing.F) {
+	twist := Twist{MsgID: 5, T1BrowserSend: 10, Relayed: true, T2RelayRx: 11, T3RelayTx: 12}
+	f.Add(AckFor(twist, 13, 14).Marshal(), false)
+	toBrowser := AckFor(twist, 13, 14)
+	toBrowser.ToBrowser, toBrowser.T4RelayAckRx, toBrowser.T5RelayAckTx = true, 15, 16
+	f.Add(toBrowser.Marshal(), true)
+	f.Fuzz(func(t *testing.T, frame []byte, toBrowser bool) {
+		fuzzRoundTrip(t, frame, func(b []byte) (Ack, error) { return UnmarshalAck(b, toBrowser) }, infallible(Ack.Marshal))
+		if a, err := UnmarshalAck(frame, toBrowser); err == nil && !bytes.HasPrefix(frame, a.Marshal()) {
+			t.Fatalf("re-encoded ack is not a prefix of % x", frame)
+		}
+	})
+}
+
+func FuzzUnmarshalHello(f *testing.F) {
+	f.Add(Hello{Version: 3, Features: 0xff}.Marshal())
+	f.Add(Hello{Welcome: true, Version: 1}.Marshal())
+	f.Add(AppendRobotTrailer(Hello{Version: 2}.Marshal(), "robot-1"))
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		fuzzRoundTrip(t, frame, UnmarshalHello, infallible(Hello.Marshal))
+	})
+}
+
+func FuzzUnmarshalClockSyncReq(f *testing.F) {
+	f.Add(ClockSyncReq{T1: 12345}.Marshal())
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		fuzzRoundTrip(t, frame, UnmarshalClockSyncReq, infallible(ClockSyncReq.Marshal))
+	})
+}
+
+func FuzzUnmarshalClockSyncResp(f *testing.F) {
+	f.Add(ClockSyncResp{T1: 1, T2: 2, T3: 3}.Marshal())
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		fuzzRoundTrip(t, frame, UnmarshalClockSyncResp, infallible(ClockSyncResp.Marshal))
+	})
+}
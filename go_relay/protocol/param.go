@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+)
+
+// Param Request operations
+const (
+	ParamGet = 1
+	ParamSet = 2
+)
+
+// Param Response statuses. The robot answers with the first four; the
+// relay answers with the others itself.
+const (
+	ParamOK         = 0
+	ParamUnknown    = 1 // no such parameter
+	ParamInvalid    = 2 // value of the wrong type or out of range
+	ParamReadOnly   = 3
+	ParamNotDriver  = 4 // the sender does not drive the robot
+	ParamTimeout    = 5 // the robot did not answer in time
+	ParamNoRobot    = 6
+	ParamBadRequest = 7 // unknown operation or value type
+	ParamBusy       = 8 // too many requests pending on the robot
+)
+
+// Param value types
+const (
+	ParamNone   = 0 // no value: a get, or an answer without one
+	ParamBool   = 1 // one byte, 0 or 1
+	ParamInt    = 2 // int64
+	ParamFloat  = 3 // float64
+	ParamString = 4 // UTF-8, the rest of the frame
+)
+
+// Param is a Param Request (0x26) or Param Response (0x27): type, uint64
+// request ID, op or status, value type, uint8 name length, the name, then
+// the value. Value is nil, bool, int64, float64 or string.
+type Param struct {
+	Response  bool
+	RequestID uint64
+	Code      byte // op of a request, status of a response
+	Name      string
+	Value     any
+}
+
+// Marshal encodes the frame, failing on a name over 255 bytes or a value
+// of another type
+func (p Param) Marshal() ([]byte, error) {
+	frame := make([]byte, ParamMinSize, ParamMinSize+len(p.Name)+8)
+	frame[0] = MsgTypeParamRequest
+	if p.Response {
+		frame[0] = MsgTypeParamResponse
+	}
+	le.PutUint64(frame[1:9], p.RequestID)
+	frame[9] = p.Code
+	if len(p.Name) > math.MaxUint8 {
+		return nil, fmt.Errorf("parameter name of %d bytes, at most 255", len(p.Name))
+	}
+	frame[11] = byte(len(p.Name))
+	frame = append(frame, p.Name...)
+	switch v := p.Value.(type) {
+	case nil:
+		frame[10] = ParamNone
+	case bool:
+		frame[10] = ParamBool
+		if v {
+			return append(frame, 1), nil
+		}
+		return append(frame, 0), nil
+	case int64:
+		frame[10] = ParamInt
+		return le.AppendUint64(frame, uint64(v)), nil
+	case float64:
+		frame[10] = ParamFloat
+		return le.AppendUint64(frame, math.Float64bits(v)), nil
+	case string:
+		frame[10] = ParamString
+		return append(frame, v...), nil
+	default:
+		return nil, fmt.Errorf("parameter value of type %T", p.Value)
+	}
+	return frame, nil
+}
+
+// UnmarshalParam decodes a Param Request or Response
+func UnmarshalParam(frame []byte) (Param, error) {
+	if len(frame) == 0 {
+		return Param{}, ErrEmpty
+	}
+	if frame[0] != MsgTypeParamRequest && frame[0] != MsgTypeParamResponse {
+		return Param{}, fmt.Errorf("%w: 0x%02x, want a param frame", ErrWrongType, frame[0])
+	}
+	if err := checkSize(frame, ParamMinSize); err != nil {
+		return Param{}, err
+	}
+	end := ParamMinSize + int(frame[11])
+	if err := checkSize(frame, end); err != nil {
+		return Param{}, err
+	}
+	p := Param{
+		Response:  frame[0] == MsgTypeParamResponse,
+		RequestID: le.Uint64(frame[1:9]),
+		Code:      frame[9],
+		Name:      string(frame[ParamMinSize:end]),
+	}
+	value := frame[end:]
+	switch frame[10] {
+	case ParamNone:
+	case ParamBool:
+		if len(value) < 1 {
+			return Param{}, fmt.Errorf("%w: bool parameter without a value", ErrShort)
+		}
+		p.Value = value[0] != 0
+	case ParamInt:
+		if len(value) < 8 {
+			return Param{}, fmt.Errorf("%w: int parameter of %d bytes", ErrShort, len(value))
+		}
+		p.Value = int64(le.Uint64(value))
+	case ParamFloat:
+		if len(value) < 8 {
+			return Param{}, fmt.Errorf("%w: float parameter of %d bytes", ErrShort, len(value))
+		}
+		f := math.Float64frombits(le.Uint64(value))
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return Param{}, fmt.Errorf("%w: %v", ErrNotFinite, f)
+		}
+		p.Value = f
+	case ParamString:
+		p.Value = string(value)
+	default:
+		return Param{}, fmt.Errorf("%w: parameter value type %d", ErrField, frame[10])
+	}
+	return p, nil
+}
@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParamRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		p    Param
+	}{
+		{"get", Param{RequestID: 1, Code: ParamGet, Name: "max_speed"}},
+		{"set bool", Param{RequestID: 2, Code: ParamSet, Name: "lights", Value: true}},
+		{"set int", Param{RequestID: 3, Code: ParamSet, Name: "mode", Value: int64(-4)}},
+		{"set float", Param{RequestID: 4, Code: ParamSet, Name: "kp", Value: 0.25}},
+		{"answer string", Param{Response: true, RequestID: 5, Code: ParamOK, Name: "frame", Value: "base_link"}},
+		{"busy", Param{Response: true, RequestID: 6, Code: ParamBusy, Name: "kp"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := tt.p.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := UnmarshalParam(frame)
+			if err != nil || got != tt.p {
+				t.Fatalf("got %+v, %v; want %+v", got, err, tt.p)
+			}
+		})
+	}
+}
+
+func TestUnmarshalParamErrors(t *testing.T) {
+	frame, _ := Param{RequestID: 1, Code: ParamSet, Name: "kp", Value: 1.5}.Marshal()
+	badType := append([]byte(nil), frame...)
+	badType[10] = 9
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"empty", nil, ErrEmpty},
+		{"wrong type", ClockSyncReq{}.Marshal(), ErrWrongType},
+		{"value cut", frame[:len(frame)-1], ErrShort},
+		{"name past the end", frame[:ParamMinSize+1], ErrShort},
+		{"unknown value type", badType, ErrField},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := UnmarshalParam(tt.frame); !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func FuzzUnmarshalParam(f *testing.F) {
+	for _, p := range []Param{
+		{RequestID: 1, Code: ParamGet, Name: "max_speed"},
+		{RequestID: 2, Code: ParamSet, Name: "lights", Value: true},
+		{RequestID: 3, Code: ParamSet, Name: "mode", Value: int64(2)},
+		{Response: true, RequestID: 4, Code: ParamOK, Name: "kp", Value: 0.5},
+		{Response: true, RequestID: 5, Code: ParamOK, Name: "frame", Value: "odom"},
+	} {
+		frame, _ := p.Marshal()
+		f.Add(frame)
+	}
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		fuzzRoundTrip(t, frame, UnmarshalParam, Param.Marshal)
+	})
+}
@@ -0,0 +1,461 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The CBOR encoding profile carries every message as a CBOR map instead
+// of a fixed-offset frame: "type" holds the message name from TypeName
+// (or its number), the remaining keys the fields of the binary layout
+// below, and "robot" the robot ID trailer if there is one. Field order
+// is free, unknown keys are ignored and missing fields are zero, so
+// fields can be added without breaking older peers. ToCBOR and FromCBOR
+// transcode between the two profiles.
+
+type fieldKind int
+
+const (
+	kindU8 fieldKind = iota
+	kindU16
+	kindU32
+	kindU64
+	kindF32
+	kindF64
+	kindText  // uint8 length, then UTF-8
+	kindCount // uint8 element count of the next field, implied in CBOR
+	kindF32s  // float32 array, counted by the preceding kindCount field
+	kindRest  // the rest of the frame, as a byte string
+)
+
+type field struct {
+	name string
+	kind fieldKind
+	n    int // array length for numeric kinds; 0 is a single value
+}
+
+// layout lists a frame's fields after the type byte
+type layout []field
+
+func u8(name string) field         { return field{name: name, kind: kindU8} }
+func u16(name string) field        { return field{name: name, kind: kindU16} }
+func u32(name string) field        { return field{name: name, kind: kindU32} }
+func u64(name string) field        { return field{name: name, kind: kindU64} }
+func f32(name string) field        { return field{name: name, kind: kindF32} }
+func vec(name string, n int) field { return field{name: name, kind: kindF64, n: n} }
+func text(name string) field       { return field{name: name, kind: kindText} }
+
+var (
+	twistLayout = layout{u64("msg_id"), u64("t1_browser_send"), vec("linear", 3), vec("angular", 3)}
+	ackLayout   = layout{u64("msg_id"), u64("t1_browser_send"), u64("t2_relay_rx"), u64("t3_relay_tx"),
+		u64("t3_python_rx"), u64("t4_python_ack"), u32("decode_us"), u32("process_us"), u32("encode_us"),
+		u64("t4_relay_ack_rx")}
+	odometryLayout = layout{u64("robot_time"), vec("position", 3), vec("orientation", 4),
+		vec("linear", 3), vec("angular", 3)}
+	joyLayout = layout{u64("msg_id"), u64("t1_browser_send"), u32("buttons"),
+		{name: "axis_count", kind: kindCount}, {name: "axes", kind: kindF32s}}
+)
+
+// peerLayouts are the frames as peers send them; the relay builds the
+// types it originates the same way
+var peerLayouts = map[byte]layout{
+	MsgTypeTwist:            twistLayout,
+	MsgTypeTwistAck:         ackLayout,
+	MsgTypeClockSyncRequest: {u64("t1")},
+	MsgTypeClockSyncResp:    {u64("t1"), u64("t2"), u64("t3")},
+	MsgTypeEStop:            {u8("action")},
+	MsgTypeTelemetry:        {u64("robot_time"), f32("battery"), u8("drive_mode"), u32("error_flags")},
+	MsgTypeOdometry:         odometryLayout,
+	MsgTypeMedia: {u8("channel"), u8("codec"), u8("flags"), u32("frame_id"),
+		u16("fragment_index"), u16("fragment_count"), {name: "payload", kind: kindRest}},
+	MsgTypeJoy:           joyLayout,
+	MsgTypeControl:       {u8("action")},
+	MsgTypeControlState:  {u8("role"), text("driver")},
+	MsgTypeSyncBeacon:    {u64("t1")},
+	MsgTypeBeaconReply:   {u64("t1"), u64("t2"), u64("t3")},
+	MsgTypeHello:         {u8("version"), u32("features")},
+	MsgTypeWelcome:       {u8("version"), u32("features")},
+	MsgTypeLossReport:    {u64("first"), u64("last")},
+	MsgTypeStaleCommand:  {u64("msg_id"), u32("age_ms")},
+	MsgTypeNack:          {u64("msg_id"), u8("reason")},
+	MsgTypeFailover:      {u8("reason"), text("peer")},
+	MsgTypePresence:      {u8("event"), u8("robot_connected"), u16("web_peers"), u16("observers"), text("peer")},
+	MsgTypeSession:       {u8("version"), u64("relay_time"), text("peer"), text("robot"), text("resume")},
+	MsgTypeSessionAck:    {u64("relay_time"), u64("peer_time")},
+	MsgTypeProtocolError: {u8("code"), u8("msg_type"), u16("expected"), u16("received")},
+	MsgTypeAckTimeout:    {u64("msg_id"), u32("waited_ms")},
+	MsgTypeCommand:       {u64("msg_id"), u8("kind"), {name: "payload", kind: kindRest}},
+	MsgTypeCommandAck:    {u64("msg_id"), u8("status")},
+	MsgTypeRaw:           {u16("channel"), u64("t_send"), u64("t_relay_rx"), u64("t_relay_tx"), {name: "payload", kind: kindRest}},
+	MsgTypeChat:          {u64("t_send"), text("from"), {name: "text", kind: kindRest}},
+	MsgTypeFileChunk: {u32("transfer_id"), u8("flags"), u64("offset"), u64("total"), text("name"),
+		{name: "data", kind: kindRest}},
+	MsgTypeFileAck: {u32("transfer_id"), u8("status"), u64("offset"), u32("window")},
+	MsgTypeParamRequest: {u64("request_id"), u8("op"), u8("value_type"), text("name"),
+		{name: "value", kind: kindRest}},
+	MsgTypeParamResponse: {u64("request_id"), u8("status"), u8("value_type"), text("name"),
+		{name: "value", kind: kindRest}},
+	MsgTypeServiceCall: {u64("call_id"), u32("timeout_ms"), text("service"),
+		{name: "payload", kind: kindRest}},
+	MsgTypeServiceResponse: {u64("call_id"), u8("status"), text("service"),
+		{name: "payload", kind: kindRest}},
+	MsgTypeDiagnostics:    {u64("t_robot"), u8("count"), {name: "statuses", kind: kindRest}},
+	MsgTypeDiagAlert:      {u64("t_relay"), u8("level"), text("name"), {name: "message", kind: kindRest}},
+	MsgTypeLatencyWarning: {u8("degraded"), u32("p95_ms"), u32("slo_ms"), u32("samples")},
+}
+
+// relayLayouts are the frames the relay forwards with its timestamps
+// appended; other types keep their peer layout
+var relayLayouts = map[byte]layout{
+	MsgTypeTwist:    append(twistLayout[:len(twistLayout):len(twistLayout)], u64("t2_relay_rx"), u64("t3_relay_tx")),
+	MsgTypeTwistAck: append(ackLayout[:len(ackLayout):len(ackLayout)], u64("t5_relay_ack_tx")),
+	MsgTypeOdometry: append(odometryLayout[:len(odometryLayout):len(odometryLayout)], u64("t_relay_rx"), u64("t_relay_tx")),
+	MsgTypeJoy:      append(joyLayout[:len(joyLayout):len(joyLayout)], u64("t2_relay_rx"), u64("t3_relay_tx")),
+}
+
+// typesByName maps TypeName back to message types
+var typesByName = func() map[string]byte {
+	m := make(map[string]byte, len(peerLayouts))
+	for t := range peerLayouts {
+		m[TypeName(t)] = t
+	}
+	return m
+}()
+
+// ErrField is returned for a CBOR or protobuf field whose value does not
+// fit its place in the binary layout
+var ErrField = errors.New("invalid field value")
+
+func layoutFor(t byte, fromRelay bool) (layout, bool) {
+	if fromRelay {
+		if l, ok := relayLayouts[t]; ok {
+			return l, true
+		}
+	}
+	l, ok := peerLayouts[t]
+	return l, ok
+}
+
+// ToCBOR transcodes a binary frame, without CRC, into the CBOR profile.
+// fromRelay selects the layouts the relay sends, with its timestamps, over
+// the ones peers send. Anything after the layout must be a robot ID
+// trailer.
+func ToCBOR(frame []byte, fromRelay bool) ([]byte, error) {
+	if len(frame) == 0 {
+		return nil, ErrEmpty
+	}
+	l, ok := layoutFor(frame[0], fromRelay)
+	if !ok {
+		return nil, fmt.Errorf("%w 0x%02x", ErrUnknownType, frame[0])
+	}
+
+	// Decode first: the map's size depends on the trailer
+	off := 1
+	values := make([]any, 0, len(l))
+	count := 0
+	for _, f := range l {
+		v, n, err := f.decode(frame[off:], count)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", TypeName(frame[0]), f.name, err)
+		}
+		if f.kind == kindCount {
+			count = int(v.(uint64))
+		}
+		values = append(values, v)
+		off += n
+	}
+	robot := ""
+	if off < len(frame) {
+		robot = ParseRobotTrailer(frame, off, MaxRobotIDLen)
+		if robot == "" || off+1+len(robot) != len(frame) {
+			return nil, fmt.Errorf("%w: %s has %d unexpected trailing bytes", ErrShort, TypeName(frame[0]), len(frame)-off)
+		}
+	}
+
+	entries := 1 + len(l)
+	for _, f := range l {
+		if f.kind == kindCount {
+			entries--
+		}
+	}
+	if robot != "" {
+		entries++
+	}
+	w := &cborWriter{buf: make([]byte, 0, 2*len(frame)+64)}
+	w.head(cborMap, uint64(entries))
+	w.text("type")
+	w.text(TypeName(frame[0]))
+	for i, f := range l {
+		if f.kind != kindCount {
+			w.text(f.name)
+			f.encode(w, values[i])
+		}
+	}
+	if robot != "" {
+		w.text("robot")
+		w.text(robot)
+	}
+	return w.buf, nil
+}
+
+// FromCBOR transcodes a frame in the CBOR profile back into the binary
+// layout selected by fromRelay, as ToCBOR does, with its robot ID
+// trailer if it names a robot
+func FromCBOR(data []byte, fromRelay bool) ([]byte, error) {
+	r := &cborReader{data: data}
+	n, err := r.mapLen()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		key, err := r.value(1)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: map key is not text", ErrCBOR)
+		}
+		if values[name], err = r.value(1); err != nil {
+			return nil, err
+		}
+	}
+	if r.off != len(data) {
+		return nil, fmt.Errorf("%w: %d bytes after the map", ErrCBOR, len(data)-r.off)
+	}
+
+	var t byte
+	switch v := values["type"].(type) {
+	case string:
+		var ok bool
+		if t, ok = typesByName[v]; !ok {
+			return nil, fmt.Errorf("%w %q", ErrUnknownType, v)
+		}
+	case uint64:
+		t = byte(v)
+		if v > math.MaxUint8 {
+			return nil, fmt.Errorf("%w %d", ErrUnknownType, v)
+		}
+	default:
+		return nil, fmt.Errorf("%w: no type", ErrCBOR)
+	}
+	l, ok := layoutFor(t, fromRelay)
+	if !ok {
+		return nil, fmt.Errorf("%w 0x%02x", ErrUnknownType, t)
+	}
+
+	frame := make([]byte, 1, MinSize(t)+16)
+	frame[0] = t
+	for i, f := range l {
+		if f.kind == kindCount {
+			items, _ := values[l[i+1].name].([]any)
+			frame = append(frame, byte(len(items)))
+			continue
+		}
+		if frame, err = f.append(frame, values[f.name]); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", TypeName(t), f.name, err)
+		}
+	}
+	if robot, ok := values["robot"].(string); ok && robot != "" {
+		if len(robot) > MaxRobotIDLen {
+			return nil, fmt.Errorf("%w: robot ID longer than %d bytes", ErrCBOR, MaxRobotIDLen)
+		}
+		frame = AppendRobotTrailer(frame, robot)
+	}
+	return frame, nil
+}
+
+// size is the width of one element of a fixed-size kind, else 0
+func (f field) size() int {
+	switch f.kind {
+	case kindU8, kindCount:
+		return 1
+	case kindU16:
+		return 2
+	case kindU32, kindF32:
+		return 4
+	case kindU64, kindF64:
+		return 8
+	}
+	return 0
+}
+
+// decode reads one field from the front of b, returning its value and
+// size: uint64, float64, string, []byte or []any of float64
+func (f field) decode(b []byte, count int) (any, int, error) {
+	size := f.size() * max(f.n, 1)
+	switch f.kind {
+	case kindText:
+		if len(b) < 1 {
+			return nil, 0, ErrShort
+		}
+		size = 1 + int(b[0])
+	case kindF32s:
+		size = 4 * count
+	case kindRest:
+		return b, len(b), nil
+	}
+	if len(b) < size {
+		return nil, 0, ErrShort
+	}
+
+	switch f.kind {
+	case kindU8, kindCount:
+		return uint64(b[0]), size, nil
+	case kindU16:
+		return uint64(le.Uint16(b)), size, nil
+	case kindU32:
+		return uint64(le.Uint32(b)), size, nil
+	case kindU64:
+		return le.Uint64(b), size, nil
+	case kindF32:
+		return float64(math.Float32frombits(le.Uint32(b))), size, nil
+	case kindF64:
+		if f.n == 0 {
+			return math.Float64frombits(le.Uint64(b)), size, nil
+		}
+		items := make([]any, f.n)
+		for i := range items {
+			items[i] = math.Float64frombits(le.Uint64(b[8*i:]))
+		}
+		return items, size, nil
+	case kindText:
+		return string(b[1:size]), size, nil
+	default: // kindF32s
+		items := make([]any, count)
+		for i := range items {
+			items[i] = float64(math.Float32frombits(le.Uint32(b[4*i:])))
+		}
+		return items, size, nil
+	}
+}
+
+// encode writes a value returned by decode
+func (f field) encode(w *cborWriter, v any) {
+	switch v := v.(type) {
+	case uint64:
+		w.uint(v)
+	case string:
+		w.text(v)
+	case []byte:
+		w.bytes(v)
+	case float64:
+		if f.kind == kindF32 {
+			w.float32(float32(v))
+		} else {
+			w.float64(v)
+		}
+	case []any:
+		w.head(cborArray, uint64(len(v)))
+		for _, item := range v {
+			if f.kind == kindF32s {
+				w.float32(float32(item.(float64)))
+			} else {
+				w.float64(item.(float64))
+			}
+		}
+	}
+}
+
+// append writes one field decoded from CBOR or protobuf onto frame; nil
+// is zero
+func (f field) append(frame []byte, v any) ([]byte, error) {
+	switch f.kind {
+	case kindU8, kindU16, kindU32, kindU64:
+		n, err := uintValue(v)
+		if err != nil {
+			return nil, err
+		}
+		size := f.size()
+		if size < 8 && n>>(8*size) != 0 {
+			return nil, fmt.Errorf("%w: %d out of range", ErrField, n)
+		}
+		for i := 0; i < size; i++ {
+			frame = append(frame, byte(n>>(8*i)))
+		}
+		return frame, nil
+	case kindF32:
+		x, err := floatValue(v)
+		return le.AppendUint32(frame, math.Float32bits(float32(x))), err
+	case kindF64:
+		if f.n == 0 {
+			x, err := floatValue(v)
+			return le.AppendUint64(frame, math.Float64bits(x)), err
+		}
+		items, _ := v.([]any)
+		if v != nil && len(items) != f.n {
+			return nil, fmt.Errorf("%w: want %d numbers", ErrField, f.n)
+		}
+		for i := 0; i < f.n; i++ {
+			var x float64
+			if items != nil {
+				var err error
+				if x, err = floatValue(items[i]); err != nil {
+					return nil, err
+				}
+			}
+			frame = le.AppendUint64(frame, math.Float64bits(x))
+		}
+		return frame, nil
+	case kindF32s:
+		items, ok := v.([]any)
+		if v != nil && !ok {
+			return nil, fmt.Errorf("%w: want an array", ErrField)
+		}
+		for _, item := range items {
+			x, err := floatValue(item)
+			if err != nil {
+				return nil, err
+			}
+			frame = le.AppendUint32(frame, math.Float32bits(float32(x)))
+		}
+		return frame, nil
+	case kindText:
+		s, ok := v.(string)
+		if v != nil && !ok {
+			return nil, fmt.Errorf("%w: want text", ErrField)
+		}
+		if len(s) > math.MaxUint8 {
+			return nil, fmt.Errorf("%w: text longer than 255 bytes", ErrField)
+		}
+		return append(append(frame, byte(len(s))), s...), nil
+	case kindRest:
+		b, ok := v.([]byte)
+		if v != nil && !ok {
+			return nil, fmt.Errorf("%w: want a byte string", ErrField)
+		}
+		return append(frame, b...), nil
+	}
+	return frame, nil
+}
+
+func uintValue(v any) (uint64, error) {
+	switch v := v.(type) {
+	case nil:
+		return 0, nil
+	case uint64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("%w: want an unsigned integer", ErrField)
+}
+
+func floatValue(v any) (float64, error) {
+	switch v := v.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return v, nil
+	case uint64:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	}
+	return 0, fmt.Errorf("%w: want a number", ErrField)
+}
@@ -0,0 +1,228 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The protobuf profile wraps every frame in the Frame message of the
+// relay's frames.proto. Twists, acks, clock sync and beacons travel as typed
+// messages in the Frame's oneof, under the field number equal to their
+// message type byte; their fields are numbered in layout order, so the
+// relay's extra timestamps follow the peer's fields. Every other message
+// keeps its fixed layout in Frame.frame. There is no generated code:
+// ToProto and FromProto encode the wire format directly.
+
+// ErrProto is returned for protobuf the profile does not accept
+var ErrProto = errors.New("invalid protobuf frame")
+
+const (
+	protoFieldFrame = 100 // bytes: any other message in its binary layout
+	protoFieldRobot = 101 // string: robot ID trailer of a typed message
+)
+
+// protoTypes are the message types with a typed protobuf message
+var protoTypes = map[byte]bool{
+	MsgTypeTwist:            true,
+	MsgTypeTwistAck:         true,
+	MsgTypeClockSyncRequest: true,
+	MsgTypeClockSyncResp:    true,
+	MsgTypeSyncBeacon:       true,
+	MsgTypeBeaconReply:      true,
+}
+
+// ToProto transcodes a binary frame, without CRC, into a protobuf Frame;
+// fromRelay selects layouts as for ToCBOR
+func ToProto(frame []byte, fromRelay bool) ([]byte, error) {
+	if len(frame) == 0 {
+		return nil, ErrEmpty
+	}
+	t := frame[0]
+	if !protoTypes[t] {
+		b := protowire.AppendTag(nil, protoFieldFrame, protowire.BytesType)
+		return protowire.AppendBytes(b, frame), nil
+	}
+	l, _ := layoutFor(t, fromRelay)
+
+	var msg []byte
+	off := 1
+	for i, f := range l {
+		v, n, err := f.decode(frame[off:], 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", TypeName(t), f.name, err)
+		}
+		msg = f.appendProto(msg, protowire.Number(i+1), v)
+		off += n
+	}
+	b := protowire.AppendTag(nil, protowire.Number(t), protowire.BytesType)
+	b = protowire.AppendBytes(b, msg)
+	if off < len(frame) {
+		robot := ParseRobotTrailer(frame, off, MaxRobotIDLen)
+		if robot == "" || off+1+len(robot) != len(frame) {
+			return nil, fmt.Errorf("%w: %s has %d unexpected trailing bytes", ErrShort, TypeName(t), len(frame)-off)
+		}
+		b = protowire.AppendTag(b, protoFieldRobot, protowire.BytesType)
+		b = protowire.AppendString(b, robot)
+	}
+	return b, nil
+}
+
+// appendProto writes one field, leaving out zero values as proto3 does
+func (f field) appendProto(b []byte, num protowire.Number, v any) []byte {
+	switch v := v.(type) {
+	case uint64:
+		if v != 0 {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, v)
+		}
+	case float64:
+		if v == 0 && !math.Signbit(v) {
+			break
+		}
+		if f.kind == kindF32 {
+			b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+			b = protowire.AppendFixed32(b, math.Float32bits(float32(v)))
+		} else {
+			b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(v))
+		}
+	case []any: // packed repeated double
+		var packed []byte
+		for _, item := range v {
+			packed = protowire.AppendFixed64(packed, math.Float64bits(item.(float64)))
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, packed)
+	case string:
+		if v != "" {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, v)
+		}
+	}
+	return b
+}
+
+// FromProto transcodes a protobuf Frame back into the binary layout
+// selected by fromRelay, with the robot ID trailer if it names a robot
+func FromProto(data []byte, fromRelay bool) ([]byte, error) {
+	var (
+		t     byte
+		msg   []byte
+		robot string
+	)
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %v", ErrProto, protowire.ParseError(n))
+		}
+		data = data[n:]
+		if typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, data); n < 0 {
+				return nil, fmt.Errorf("%w: %v", ErrProto, protowire.ParseError(n))
+			}
+			data = data[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %v", ErrProto, protowire.ParseError(n))
+		}
+		data = data[n:]
+		switch {
+		case num == protoFieldFrame:
+			if len(value) == 0 {
+				return nil, ErrEmpty
+			}
+			return append([]byte(nil), value...), nil
+		case num == protoFieldRobot:
+			robot = string(value)
+		case num < 256 && protoTypes[byte(num)]:
+			t, msg = byte(num), value
+		}
+	}
+	if t == 0 {
+		return nil, fmt.Errorf("%w: no message", ErrProto)
+	}
+
+	l, _ := layoutFor(t, fromRelay)
+	values, err := decodeProtoFields(msg, l)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", TypeName(t), err)
+	}
+	frame := make([]byte, 1, MinSize(t)+16)
+	frame[0] = t
+	for i, f := range l {
+		if frame, err = f.append(frame, values[i]); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", TypeName(t), f.name, err)
+		}
+	}
+	if robot != "" {
+		if len(robot) > MaxRobotIDLen {
+			return nil, fmt.Errorf("%w: robot ID longer than %d bytes", ErrProto, MaxRobotIDLen)
+		}
+		frame = AppendRobotTrailer(frame, robot)
+	}
+	return frame, nil
+}
+
+// decodeProtoFields reads a typed message into values by layout index, in
+// the forms field.append takes; unknown fields are skipped
+func decodeProtoFields(msg []byte, l layout) ([]any, error) {
+	values := make([]any, len(l))
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %v", ErrProto, protowire.ParseError(n))
+		}
+		msg = msg[n:]
+		i := int(num) - 1
+		known := i >= 0 && i < len(l)
+		var v any
+		switch typ {
+		case protowire.VarintType:
+			var x uint64
+			x, n = protowire.ConsumeVarint(msg)
+			v = x
+		case protowire.Fixed32Type:
+			var x uint32
+			x, n = protowire.ConsumeFixed32(msg)
+			v = float64(math.Float32frombits(x))
+		case protowire.Fixed64Type:
+			var x uint64
+			x, n = protowire.ConsumeFixed64(msg)
+			v = math.Float64frombits(x)
+			if known && l[i].n > 0 { // unpacked repeated double
+				items, _ := values[i].([]any)
+				v = append(items, v)
+			}
+		case protowire.BytesType:
+			var b []byte
+			b, n = protowire.ConsumeBytes(msg)
+			if known && l[i].n > 0 {
+				if len(b)%8 != 0 {
+					return nil, fmt.Errorf("%w: packed doubles of %d bytes", ErrProto, len(b))
+				}
+				items := make([]any, len(b)/8)
+				for j := range items {
+					items[j] = math.Float64frombits(le.Uint64(b[8*j:]))
+				}
+				v = items
+			} else {
+				v = string(b)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %v", ErrProto, protowire.ParseError(n))
+		}
+		msg = msg[n:]
+		if known {
+			values[i] = v
+		}
+	}
+	return values, nil
+}
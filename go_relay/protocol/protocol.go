@@ -0,0 +1,309 @@
+// Package protocol is the teleop relay's binary wire format: message
+// types, frame sizes and typed encoders and decoders for the frames both
+// ends build (twists, acks, clock sync), so the relay, its tools and Go
+// clients share one implementation. All integers are little-endian and
+// every frame starts with its message type byte. Each frame size constant
+// describes its layout.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Message types, the first byte of every frame
+const (
+	MsgTypeTwist            = 0x01 // browser → relay → python
+	MsgTypeTwistAck         = 0x02 // python → relay → browser
+	MsgTypeClockSyncRequest = 0x03 // peer → relay
+	MsgTypeClockSyncResp    = 0x04 // relay → peer
+	MsgTypeEStop            = 0x05 // browser → relay → python/browsers
+	MsgTypeTelemetry        = 0x06 // python → relay → browsers
+	MsgTypeOdometry         = 0x07 // python → relay → browsers
+	MsgTypeMedia            = 0x08 // python → relay → browsers
+	MsgTypeJoy              = 0x09 // browser → relay → python
+	MsgTypeControl          = 0x10 // browser → relay
+	MsgTypeControlState     = 0x11 // relay → browser
+	MsgTypeSyncBeacon       = 0x12 // relay → peer
+	MsgTypeBeaconReply      = 0x13 // peer → relay
+	MsgTypeHello            = 0x14 // peer → relay
+	MsgTypeWelcome          = 0x15 // relay → peer
+	MsgTypeLossReport       = 0x16 // relay → browser
+	MsgTypeStaleCommand     = 0x17 // relay → browser
+	MsgTypeNack             = 0x18 // relay → browser
+	MsgTypeFailover         = 0x19 // relay → browser
+	MsgTypePresence         = 0x1A // relay → browser
+	MsgTypeSession          = 0x1B // relay → peer
+	MsgTypeSessionAck       = 0x1C // peer → relay
+	MsgTypeProtocolError    = 0x1D // relay → peer
+	MsgTypeBatch            = 0x1E // either way, when negotiated
+	MsgTypeAckTimeout       = 0x1F // relay → browser
+	MsgTypeCommand          = 0x20 // browser → relay → python
+	MsgTypeCommandAck       = 0x21 // python → relay → browser
+	MsgTypeRaw              = 0x22 // either way between python and browsers
+	MsgTypeChat             = 0x23 // browser → relay → browsers, python
+	MsgTypeFileChunk        = 0x24 // either way between browser and python
+	MsgTypeFileAck          = 0x25 // either way between browser and python
+	MsgTypeParamRequest     = 0x26 // browser → relay → python
+	MsgTypeParamResponse    = 0x27 // python → relay → browser
+	MsgTypeServiceCall      = 0x28 // browser → relay → python
+	MsgTypeServiceResponse  = 0x29 // python → relay → browser
+	MsgTypeDiagnostics      = 0x2A // python → relay
+	MsgTypeDiagAlert        = 0x2B // relay → browser
+	MsgTypeLatencyWarning   = 0x2C // relay → browser
+)
+
+// Frame sizes in bytes, before any robot trailer, hop block, trace block
+// or CRC. Variable-length frames give their minimum.
+const (
+	TwistBrowserSize  = 65 // see Twist
+	TwistToPythonSize = 81 // plus t2 relay rx, t3 relay tx
+	AckFromPythonSize = 69 // see Ack
+	AckToBrowserSize  = 77 // plus t5 relay ack tx
+	ClockSyncReqSize  = 9  // type, t1
+	ClockSyncRespSize = 25 // type, t1 echoed, t2, t3
+	EStopSize         = 2  // type, action: 1=engage 2=release
+	TelemetrySize     = 18 // type, robot time, float32 battery %, uint8 drive mode, uint32 error flags
+
+	// Odometry: type, robot time, then float64 position x/y/z, orientation
+	// quaternion x/y/z/w, linear and angular velocity x/y/z; the relay
+	// appends t_relay_rx and t_relay_tx toward browsers
+	OdometryFromPythonSize = 113
+	OdometryToBrowserSize  = 129
+
+	MediaHeaderSize     = 12 // type, channel, codec, flags, uint32 frame ID, uint16 fragment index, uint16 fragment count
+	JoyHeaderSize       = 22 // type, msg ID, t1, uint32 buttons, uint8 axis count
+	ControlReqSize      = 2  // type, action: 1=take 2=release 3=steal
+	ControlStateMinSize = 3  // type, role: 0=observer 1=driver, driver ID length, then the ID
+	SyncBeaconSize      = 9  // type, t1 relay send
+	BeaconReplySize     = 25 // type, t1 echoed, t2 peer rx, t3 peer tx
+	HelloSize           = 6  // type, version, uint32 feature bits; Welcome has the same layout
+	LossReportSize      = 17 // type, first missing ID, last missing ID
+	StaleCommandSize    = 13 // type, msg ID, uint32 age ms
+	NackSize            = 10 // type, msg ID, uint8 reason
+	FailoverMinSize     = 3  // type, reason, peer ID length, then the ID
+	PresenceMinSize     = 8  // type, event, robot connected, uint16 web peers, uint16 observers, peer ID length, then the ID
+	SessionMinSize      = 13 // type, version, relay time, then length-prefixed peer ID, robot ID and resume token
+	SessionAckSize      = 17 // type, echoed relay time, peer time
+	ProtocolErrorSize   = 7  // type, code, offending type, uint16 expected size, uint16 received size
+	BatchHeaderSize     = 2  // type, uint8 frame count
+	AckTimeoutSize      = 13 // type, msg ID, uint32 waited ms
+	CommandMinSize      = 10 // type, msg ID, uint8 kind, then the payload
+	CommandAckSize      = 10 // type, msg ID, uint8 status
+	RawHeaderSize       = 27 // type, uint16 channel, t_send, t_relay_rx, t_relay_tx
+	ChatMinSize         = 10 // type, t_send, uint8 sender length, then the sender and text
+	FileChunkMinSize    = 23 // type, uint32 transfer ID, flags, offset, total, uint8 name length, then the name and data
+	FileAckSize         = 18 // type, uint32 transfer ID, uint8 status, offset, uint32 window
+	ParamMinSize        = 12 // type, request ID, uint8 op or status, uint8 value type, uint8 name length, then the name and value
+	ServiceCallMinSize  = 14 // type, call ID, uint32 timeout ms, uint8 service length, then the service and payload
+	ServiceRespMinSize  = 11 // type, call ID, uint8 status, uint8 service length, then the service and payload
+	DiagnosticsMinSize  = 10 // type, robot time, uint8 status count, then the statuses
+	DiagAlertMinSize    = 11 // type, relay time, uint8 level, uint8 name length, then the name and message
+	LatencyWarningSize  = 14 // type, uint8 degraded, uint32 p95 ms, uint32 SLO ms, uint32 samples
+
+	MaxRobotIDLen  = 255 // wire limit of the robot ID trailer
+	DefaultRobotID = "default"
+)
+
+// Subprotocol is the WebSocket subprotocol of /ws/data. A later revision
+// of the wire format gets a new name, negotiated alongside this one.
+const Subprotocol = "teleop.binary.v1"
+
+// Errors returned by Validate and the Unmarshal methods, wrapped with
+// details
+var (
+	ErrEmpty       = errors.New("empty frame")
+	ErrUnknownType = errors.New("unknown message type")
+	ErrWrongType   = errors.New("wrong message type")
+	ErrShort       = errors.New("frame too short")
+	ErrTrailing    = errors.New("unexpected trailing bytes")
+	ErrNotFinite   = errors.New("value not finite")
+)
+
+// minSizes is the smallest valid frame of each message type
+var minSizes = map[byte]int{
+	MsgTypeTwist:            TwistBrowserSize,
+	MsgTypeTwistAck:         AckFromPythonSize,
+	MsgTypeClockSyncRequest: ClockSyncReqSize,
+	MsgTypeClockSyncResp:    ClockSyncRespSize,
+	MsgTypeEStop:            EStopSize,
+	MsgTypeTelemetry:        TelemetrySize,
+	MsgTypeOdometry:         OdometryFromPythonSize,
+	MsgTypeMedia:            MediaHeaderSize,
+	MsgTypeJoy:              JoyHeaderSize,
+	MsgTypeControl:          ControlReqSize,
+	MsgTypeControlState:     ControlStateMinSize,
+	MsgTypeSyncBeacon:       SyncBeaconSize,
+	MsgTypeBeaconReply:      BeaconReplySize,
+	MsgTypeHello:            HelloSize,
+	MsgTypeWelcome:          HelloSize,
+	MsgTypeLossReport:       LossReportSize,
+	MsgTypeStaleCommand:     StaleCommandSize,
+	MsgTypeNack:             NackSize,
+	MsgTypeFailover:         FailoverMinSize,
+	MsgTypePresence:         PresenceMinSize,
+	MsgTypeSession:          SessionMinSize,
+	MsgTypeSessionAck:       SessionAckSize,
+	MsgTypeProtocolError:    ProtocolErrorSize,
+	MsgTypeBatch:            BatchHeaderSize,
+	MsgTypeAckTimeout:       AckTimeoutSize,
+	MsgTypeCommand:          CommandMinSize,
+	MsgTypeCommandAck:       CommandAckSize,
+	MsgTypeRaw:              RawHeaderSize,
+	MsgTypeChat:             ChatMinSize,
+	MsgTypeFileChunk:        FileChunkMinSize,
+	MsgTypeFileAck:          FileAckSize,
+	MsgTypeParamRequest:     ParamMinSize,
+	MsgTypeParamResponse:    ParamMinSize,
+	MsgTypeServiceCall:      ServiceCallMinSize,
+	MsgTypeServiceResponse:  ServiceRespMinSize,
+	MsgTypeDiagnostics:      DiagnosticsMinSize,
+	MsgTypeDiagAlert:        DiagAlertMinSize,
+	MsgTypeLatencyWarning:   LatencyWarningSize,
+}
+
+// MinSize returns the smallest valid frame of message type t, or 0 for
+// an unknown type
+func MinSize(t byte) int {
+	return minSizes[t]
+}
+
+// Validate checks that frame has a known message type and at least that
+// type's minimum size. Trailers and blocks are not inspected.
+func Validate(frame []byte) error {
+	if len(frame) == 0 {
+		return ErrEmpty
+	}
+	n, ok := minSizes[frame[0]]
+	if !ok {
+		return fmt.Errorf("%w 0x%02x", ErrUnknownType, frame[0])
+	}
+	return checkSize(frame, n)
+}
+
+// check verifies a frame's type and minimum size for an Unmarshal method
+func check(frame []byte, t byte, size int) error {
+	if len(frame) == 0 {
+		return ErrEmpty
+	}
+	if frame[0] != t {
+		return fmt.Errorf("%w: 0x%02x, want %s", ErrWrongType, frame[0], TypeName(t))
+	}
+	return checkSize(frame, size)
+}
+
+func checkSize(frame []byte, size int) error {
+	if len(frame) < size {
+		return fmt.Errorf("%w: %s of %d bytes, want %d", ErrShort, TypeName(frame[0]), len(frame), size)
+	}
+	return nil
+}
+
+// TypeName returns a short label for a message type byte
+func TypeName(t byte) string {
+	switch t {
+	case MsgTypeTwist:
+		return "twist"
+	case MsgTypeTwistAck:
+		return "ack"
+	case MsgTypeClockSyncRequest:
+		return "clock_sync_request"
+	case MsgTypeClockSyncResp:
+		return "clock_sync_response"
+	case MsgTypeEStop:
+		return "estop"
+	case MsgTypeTelemetry:
+		return "telemetry"
+	case MsgTypeOdometry:
+		return "odometry"
+	case MsgTypeMedia:
+		return "media"
+	case MsgTypeJoy:
+		return "joy"
+	case MsgTypeControl:
+		return "control"
+	case MsgTypeControlState:
+		return "control_state"
+	case MsgTypeSyncBeacon:
+		return "sync_beacon"
+	case MsgTypeBeaconReply:
+		return "beacon_reply"
+	case MsgTypeHello:
+		return "hello"
+	case MsgTypeWelcome:
+		return "welcome"
+	case MsgTypeLossReport:
+		return "loss_report"
+	case MsgTypeStaleCommand:
+		return "stale_command"
+	case MsgTypeNack:
+		return "nack"
+	case MsgTypeFailover:
+		return "failover"
+	case MsgTypePresence:
+		return "presence"
+	case MsgTypeSession:
+		return "session"
+	case MsgTypeSessionAck:
+		return "session_ack"
+	case MsgTypeProtocolError:
+		return "protocol_error"
+	case MsgTypeBatch:
+		return "batch"
+	case MsgTypeAckTimeout:
+		return "ack_timeout"
+	case MsgTypeCommand:
+		return "command"
+	case MsgTypeCommandAck:
+		return "command_ack"
+	case MsgTypeRaw:
+		return "raw"
+	case MsgTypeChat:
+		return "chat"
+	case MsgTypeFileChunk:
+		return "file_chunk"
+	case MsgTypeFileAck:
+		return "file_ack"
+	case MsgTypeParamRequest:
+		return "param_request"
+	case MsgTypeParamResponse:
+		return "param_response"
+	case MsgTypeServiceCall:
+		return "service_call"
+	case MsgTypeServiceResponse:
+		return "service_response"
+	case MsgTypeDiagnostics:
+		return "diagnostics"
+	case MsgTypeDiagAlert:
+		return "diag_alert"
+	case MsgTypeLatencyWarning:
+		return "latency_warning"
+	default:
+		return "unknown"
+	}
+}
+
+// TypeByName returns the message type TypeName labels name
+func TypeByName(name string) (byte, bool) {
+	t, ok := typesByName[name]
+	return t, ok
+}
+
+// AppendRobotTrailer appends the length-prefixed robot ID to a frame
+func AppendRobotTrailer(frame []byte, robotID string) []byte {
+	frame = append(frame, byte(len(robotID)))
+	return append(frame, robotID...)
+}
+
+// ParseRobotTrailer returns the robot ID trailer at offset, or "" if there
+// is none, it is empty or malformed, or it is longer than maxLen
+func ParseRobotTrailer(frame []byte, offset, maxLen int) string {
+	if len(frame) <= offset {
+		return ""
+	}
+	n := int(frame[offset])
+	if n == 0 || n > maxLen || len(frame) < offset+1+n {
+		return ""
+	}
+	return string(frame[offset+1 : offset+1+n])
+}
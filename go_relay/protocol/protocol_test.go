@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+// fuzzRoundTrip decodes frame and, when it decodes, checks that encoding
+// the result decodes again to a value that encodes to the same bytes
+func fuzzRoundTrip[T any](t *testing.T, frame []byte, unmarshal func([]byte) (T, error), marshal func(T) ([]byte, error)) {
+	t.Helper()
+	v, err := unmarshal(frame)
+	if err != nil {
+		return
+	}
+	first, err := marshal(v)
+	if err != nil {
+		t.Fatalf("marshal of decoded %+v: %v", v, err)
+	}
+	v2, err := unmarshal(first)
+	if err != nil {
+		t.Fatalf("unmarshal of re-encoded % x: %v", first, err)
+	}
+	second, err := marshal(v2)
+	if err != nil {
+		t.Fatalf("marshal of %+v: %v", v2, err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatalf("round trip changed the frame:\n% x\n% x", first, second)
+	}
+}
+
+// infallible adapts a Marshal method that cannot fail
+func infallible[T any](marshal func(T) []byte) func(T) ([]byte, error) {
+	return func(v T) ([]byte, error) { return marshal(v), nil }
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import "sort"
+
+// MessageSchema describes one message type's binary layout, generated
+// from the same field lists the encoding profiles use, so implementations
+// in other languages can check their offsets against it
+type MessageSchema struct {
+	Type    byte          `json:"type"`
+	Name    string        `json:"name"`
+	MinSize int           `json:"min_size"`
+	Fields  []FieldSchema `json:"fields"`
+
+	// The layout the relay forwards instead, with its timestamps
+	// appended, if it differs
+	RelayFields  []FieldSchema `json:"relay_fields,omitempty"`
+	RelayMinSize int           `json:"relay_min_size,omitempty"`
+}
+
+// FieldSchema is one field of a layout. Offsets count from the start of
+// the frame, the type byte; a field behind a variable-length one has
+// offset -1.
+type FieldSchema struct {
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	Type   string `json:"type"`            // u8, u16, u32, u64, f32, f64, text, count, f32[] or bytes
+	Count  int    `json:"count,omitempty"` // array length, for vectors
+	Size   int    `json:"size"`            // bytes, 0 if variable
+}
+
+// kindNames are the FieldSchema types of each field kind
+var kindNames = map[fieldKind]string{
+	kindU8:    "u8",
+	kindU16:   "u16",
+	kindU32:   "u32",
+	kindU64:   "u64",
+	kindF32:   "f32",
+	kindF64:   "f64",
+	kindText:  "text",
+	kindCount: "count",
+	kindF32s:  "f32[]",
+	kindRest:  "bytes",
+}
+
+// batchLayout is only described: Batches are never transcoded
+var batchLayout = layout{{name: "frame_count", kind: kindCount}, {name: "frames", kind: kindRest}}
+
+// Schema describes every message type, ordered by type byte
+func Schema() []MessageSchema {
+	out := make([]MessageSchema, 0, len(minSizes))
+	for t, size := range minSizes {
+		l, ok := peerLayouts[t]
+		if !ok && t == MsgTypeBatch {
+			l = batchLayout
+		}
+		m := MessageSchema{Type: t, Name: TypeName(t), MinSize: size, Fields: l.schema()}
+		if rl, ok := relayLayouts[t]; ok {
+			m.RelayFields = rl.schema()
+			m.RelayMinSize = rl.minSize()
+		}
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Type < out[j].Type })
+	return out
+}
+
+func (l layout) schema() []FieldSchema {
+	out := make([]FieldSchema, 0, len(l))
+	off := 1
+	for _, f := range l {
+		size := f.size() * max(f.n, 1)
+		if f.kind == kindText || f.kind == kindF32s || f.kind == kindRest {
+			size = 0
+		}
+		out = append(out, FieldSchema{Name: f.name, Offset: off, Type: kindNames[f.kind], Count: f.n, Size: size})
+		if size == 0 || off < 0 {
+			off = -1
+		} else {
+			off += size
+		}
+	}
+	return out
+}
+
+// minSize is the size of a frame with every variable-length field empty
+func (l layout) minSize() int {
+	n := 1
+	for _, f := range l {
+		switch f.kind {
+		case kindText:
+			n++ // the length byte
+		case kindF32s, kindRest:
+		default:
+			n += f.size() * max(f.n, 1)
+		}
+	}
+	return n
+}
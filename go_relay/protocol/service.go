@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"fmt"
+	"math"
+)
+
+// Service Response statuses. The robot answers with the first three; the
+// relay answers with the others itself.
+const (
+	ServiceOK        = 0
+	ServiceUnknown   = 1 // no such service
+	ServiceFailed    = 2 // the service ran and failed; the payload may say why
+	ServiceTimeout   = 3 // the robot did not answer in time
+	ServiceNoRobot   = 4
+	ServiceBusy      = 5 // too many calls pending on the robot
+	ServiceForbidden = 6 // observers may not call services
+)
+
+// ServiceCall asks the robot to run a named service (0x28): type, uint64
+// call ID, uint32 timeout in ms (0 = the relay's default), uint8 service
+// name length, the name, then a payload the service defines
+type ServiceCall struct {
+	CallID    uint64
+	TimeoutMs uint32
+	Service   string
+	Payload   []byte
+}
+
+// Marshal encodes the call, failing on a service name over 255 bytes
+func (c ServiceCall) Marshal() ([]byte, error) {
+	if len(c.Service) > math.MaxUint8 {
+		return nil, fmt.Errorf("service name of %d bytes, at most 255", len(c.Service))
+	}
+	frame := make([]byte, ServiceCallMinSize, ServiceCallMinSize+len(c.Service)+len(c.Payload))
+	frame[0] = MsgTypeServiceCall
+	le.PutUint64(frame[1:9], c.CallID)
+	le.PutUint32(frame[9:13], c.TimeoutMs)
+	frame[13] = byte(len(c.Service))
+	frame = append(frame, c.Service...)
+	return append(frame, c.Payload...), nil
+}
+
+// UnmarshalServiceCall decodes a Service Call; Payload aliases frame
+func UnmarshalServiceCall(frame []byte) (ServiceCall, error) {
+	if err := check(frame, MsgTypeServiceCall, ServiceCallMinSize); err != nil {
+		return ServiceCall{}, err
+	}
+	end := ServiceCallMinSize + int(frame[13])
+	if err := checkSize(frame, end); err != nil {
+		return ServiceCall{}, err
+	}
+	return ServiceCall{
+		CallID:    le.Uint64(frame[1:9]),
+		TimeoutMs: le.Uint32(frame[9:13]),
+		Service:   string(frame[ServiceCallMinSize:end]),
+		Payload:   frame[end:],
+	}, nil
+}
+
+// ServiceResponse answers a Service Call (0x29): type, uint64 call ID,
+// status, uint8 service name length, the name, then the service's result
+type ServiceResponse struct {
+	CallID  uint64
+	Status  byte
+	Service string
+	Payload []byte
+}
+
+// Marshal encodes the response, failing on a service name over 255 bytes
+func (r ServiceResponse) Marshal() ([]byte, error) {
+	if len(r.Service) > math.MaxUint8 {
+		return nil, fmt.Errorf("service name of %d bytes, at most 255", len(r.Service))
+	}
+	frame := make([]byte, ServiceRespMinSize, ServiceRespMinSize+len(r.Service)+len(r.Payload))
+	frame[0] = MsgTypeServiceResponse
+	le.PutUint64(frame[1:9], r.CallID)
+	frame[9] = r.Status
+	frame[10] = byte(len(r.Service))
+	frame = append(frame, r.Service...)
+	return append(frame, r.Payload...), nil
+}
+
+// UnmarshalServiceResponse decodes a Service Response; Payload aliases
+// frame
+func UnmarshalServiceResponse(frame []byte) (ServiceResponse, error) {
+	if err := check(frame, MsgTypeServiceResponse, ServiceRespMinSize); err != nil {
+		return ServiceResponse{}, err
+	}
+	end := ServiceRespMinSize + int(frame[10])
+	if err := checkSize(frame, end); err != nil {
+		return ServiceResponse{}, err
+	}
+	return ServiceResponse{
+		CallID:  le.Uint64(frame[1:9]),
+		Status:  frame[9],
+		Service: string(frame[ServiceRespMinSize:end]),
+		Payload: frame[end:],
+	}, nil
+}
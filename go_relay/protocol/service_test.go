@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUnmarshalServiceCall(t *testing.T) {
+	valid, _ := ServiceCall{CallID: 9, TimeoutMs: 500, Service: "/dock", Payload: []byte{1, 2}}.Marshal()
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"valid", valid, nil},
+		{"no payload", valid[:ServiceCallMinSize+5], nil},
+		{"name past the end", valid[:ServiceCallMinSize+2], ErrShort},
+		{"short", valid[:5], ErrShort},
+		{"wrong type", ClockSyncReq{}.Marshal(), ErrWrongType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := UnmarshalServiceCall(tt.frame); !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func FuzzUnmarshalServiceCall(f *testing.F) {
+	frame, _ := ServiceCall{CallID: 9, TimeoutMs: 500, Service: "/dock", Payload: []byte(`{"station":2}`)}.Marshal()
+	f.Add(frame)
+	frame, _ = ServiceCall{CallID: 10, Service: "/reset"}.Marshal()
+	f.Add(frame)
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		fuzzRoundTrip(t, frame, UnmarshalServiceCall, ServiceCall.Marshal)
+	})
+}
+
+func FuzzUnmarshalServiceResponse(f *testing.F) {
+	frame, _ := ServiceResponse{CallID: 9, Status: ServiceOK, Service: "/dock", Payload: []byte("docked")}.Marshal()
+	f.Add(frame)
+	frame, _ = ServiceResponse{CallID: 10, Status: ServiceTimeout, Service: "/reset"}.Marshal()
+	f.Add(frame)
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		fuzzRoundTrip(t, frame, UnmarshalServiceResponse, ServiceResponse.Marshal)
+	})
+}
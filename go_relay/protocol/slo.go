@@ -0,0 +1,36 @@
+package protocol
+
+// LatencyWarning tells browsers their robot's round-trip latency left or
+// returned within the relay's SLO (0x2C): type, degraded (1) or recovered
+// (0), uint32 p95 over the window in ms, uint32 SLO in ms, uint32 samples
+// in the window
+type LatencyWarning struct {
+	Degraded bool
+	P95Ms    uint32
+	SLOMs    uint32
+	Samples  uint32
+}
+
+func (w LatencyWarning) Marshal() []byte {
+	frame := make([]byte, LatencyWarningSize)
+	frame[0] = MsgTypeLatencyWarning
+	if w.Degraded {
+		frame[1] = 1
+	}
+	le.PutUint32(frame[2:6], w.P95Ms)
+	le.PutUint32(frame[6:10], w.SLOMs)
+	le.PutUint32(frame[10:14], w.Samples)
+	return frame
+}
+
+func UnmarshalLatencyWarning(frame []byte) (LatencyWarning, error) {
+	if err := check(frame, MsgTypeLatencyWarning, LatencyWarningSize); err != nil {
+		return LatencyWarning{}, err
+	}
+	return LatencyWarning{
+		Degraded: frame[1] != 0,
+		P95Ms:    le.Uint32(frame[2:6]),
+		SLOMs:    le.Uint32(frame[6:10]),
+		Samples:  le.Uint32(frame[10:14]),
+	}, nil
+}
@@ -0,0 +1,11 @@
+package protocol
+
+import "testing"
+
+func FuzzUnmarshalLatencyWarning(f *testing.F) {
+	f.Add(LatencyWarning{Degraded: true, P95Ms: 180, SLOMs: 150, Samples: 40}.Marshal())
+	f.Add(LatencyWarning{P95Ms: 90, SLOMs: 150, Samples: 25}.Marshal())
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		fuzzRoundTrip(t, frame, UnmarshalLatencyWarning, infallible(LatencyWarning.Marshal))
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"go_relay/protocol"
+)
+
+// Protocol Error codes: why the relay rejected a peer's frame
+const (
+	ProtoErrUnknownType = 1 // unknown type, or one the relay never accepts from peers
+	ProtoErrTooShort    = 2 // shorter than its type's layout
+	ProtoErrTooLong     = 3 // longer than its type allows
+	ProtoErrBadCRC      = 4 // negotiated CRC32 trailer missing or wrong
+	ProtoErrNoTrace     = 5 // negotiated trace block missing
+	ProtoErrBadCBOR     = 6 // negotiated CBOR profile frame not decodable
+	ProtoErrBadProtobuf = 7 // negotiated protobuf profile frame not decodable
+	protoErrCodes       = 8
+)
+
+// protoErrorName returns the metric label for a Protocol Error code
+func protoErrorName(code byte) string {
+	switch code {
+	case ProtoErrUnknownType:
+		return "unknown_type"
+	case ProtoErrTooShort:
+		return "too_short"
+	case ProtoErrTooLong:
+		return "too_long"
+	case ProtoErrBadCRC:
+		return "bad_crc"
+	case ProtoErrNoTrace:
+		return "no_trace"
+	case ProtoErrBadCBOR:
+		return "bad_cbor"
+	case ProtoErrBadProtobuf:
+		return "bad_protobuf"
+	default:
+		return "unknown"
+	}
+}
+
+// protocolErrors counts rejected frames by code, for /status
+var protocolErrors [protoErrCodes]atomic.Uint64
+
+func protocolErrorCounts() map[string]uint64 {
+	counts := make(map[string]uint64)
+	for code := byte(1); code < protoErrCodes; code++ {
+		if n := protocolErrors[code].Load(); n > 0 {
+			counts[protoErrorName(code)] = n
+		}
+	}
+	return counts
+}
+
+// rejectFrame drops a malformed frame from peer: it is logged and
+// counted, and with -protocol-errors the peer gets a Protocol Error
+// naming the code, the frame's type and the size the relay expected
+// (0 when the type has none).
+func rejectFrame(peer *Peer, data []byte, code byte, expected int) {
+	var msgType byte
+	if len(data) > 0 {
+		msgType = data[0]
+	}
+	protocolErrors[code].Add(1)
+	metricProtocolErrors.WithLabelValues(protoErrorName(code)).Inc()
+	peer.logger().Warn("Rejected frame", "msg_type", protocol.TypeName(msgType),
+		"reason", protoErrorName(code), "size", len(data), "expected", expected)
+	if !config.ProtocolErrors {
+		return
+	}
+
+	msg := make([]byte, protocol.ProtocolErrorSize)
+	msg[0] = protocol.MsgTypeProtocolError
+	msg[1] = code
+	msg[2] = msgType
+	binary.LittleEndian.PutUint16(msg[3:5], uint16(min(expected, 0xFFFF)))
+	binary.LittleEndian.PutUint16(msg[5:7], uint16(min(len(data), 0xFFFF)))
+	peer.send(msg)
+}
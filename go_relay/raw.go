@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"go_relay/protocol"
+)
+
+// Raw frames let a team prototype a new data flow without touching the
+// relay: a 16-bit channel ID and an opaque payload, passed between a
+// robot and its web and observer peers uninterpreted. The relay only
+// stamps t_relay_rx and t_relay_tx into the header, so latency shows
+// up the same way it does for twists.
+
+// stampRaw returns a copy of a raw frame with the relay's receive and
+// send times filled in
+func stampRaw(data []byte, t2 uint64) []byte {
+	frame := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint64(frame[11:19], t2)
+	binary.LittleEndian.PutUint64(frame[19:27], currentTimeMs())
+	return frame
+}
+
+// handleRaw forwards a web peer's raw frame to the robot it watches, or a
+// robot's to all of that robot's web and observer peers. Observers only
+// listen. Frames are not forwarded to downstream relays or upstream.
+func handleRaw(peer *Peer, data []byte) {
+	t2 := currentTimeMs()
+	if !peer.isRobot() && !peer.watchesRobot() {
+		return
+	}
+	if len(data) < protocol.RawHeaderSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.RawHeaderSize)
+		return
+	}
+	if peer.Type == "observer" {
+		peer.logger().Warn("Raw frame from observer rejected", "msg_type", "raw")
+		return
+	}
+	robotID := manager.robotFor(peer)
+	channel := binary.LittleEndian.Uint16(data[1:3])
+
+	if peer.isRobot() {
+		// Shared by every viewer, and the transport may reuse data
+		f := wrapFrame(stampRaw(data, t2))
+		n := 0
+		for _, web := range manager.getWebPeers(robotID) {
+			if web.sendFrame(f.retain()) {
+				n++
+			}
+		}
+		f.release()
+		metricRawFrames.WithLabelValues("to_web").Add(float64(n))
+		return
+	}
+
+	python := manager.getPython(robotID)
+	if python == nil || python.Type != "python" {
+		peer.logger().Debug("Raw frame dropped, no robot", "msg_type", "raw", "robot_id", robotID, "channel", channel)
+		return
+	}
+	if python.send(stampRaw(data, t2)) {
+		metricRawFrames.WithLabelValues("to_robot").Inc()
+	}
+}
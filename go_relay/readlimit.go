@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// readLimiter is implemented by transports that can refuse oversized
+// frames before reading them in full
+type readLimiter interface {
+	setReadLimit(n int)
+}
+
+// setReadLimit makes gorilla fail reads of longer messages with
+// ErrReadLimit, after closing the connection with 1009
+func (t *wsTransport) setReadLimit(n int) { t.conn.SetReadLimit(int64(n)) }
+
+// readLimitFor returns the largest frame accepted from peers of peerType:
+// -max-frame-size unless read_limits lowers it for that type
+func (c *Config) readLimitFor(peerType string) int {
+	if n, ok := c.ReadLimits[peerType]; ok {
+		return n
+	}
+	return c.MaxFrameSize
+}
+
+// validReadLimits checks read_limits' peer types and sizes
+func (c *Config) validReadLimits() error {
+	for t, n := range c.ReadLimits {
+		if !knownPeerType(t) {
+			return fmt.Errorf("read_limits: unknown peer type %q", t)
+		}
+		if n < 1 || n > c.MaxFrameSize {
+			return fmt.Errorf("read_limits[%s] must be 1-%d (max_frame_size)", t, c.MaxFrameSize)
+		}
+	}
+	return nil
+}
+
+// frameTooLarge handles a frame from peer over its read limit, size
+// bytes long or 0 when the transport refused it unread: it is logged and
+// counted, and the peer is told 1009 (message too big). The caller stops
+// reading, which disconnects the peer.
+func frameTooLarge(peer *Peer, size int) {
+	metricOversizedFrames.WithLabelValues(peer.Type).Inc()
+	peer.logger().Warn("Frame over read limit, closing peer", "limit", peer.readLimit, "size", size)
+	if _, ok := peer.Conn.(readLimiter); ok {
+		return // the transport already sent its close
+	}
+	peer.mu.Lock()
+	peer.Conn.Shutdown(websocket.CloseMessageTooBig, "frame too large")
+	peer.mu.Unlock()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+SESSION RECORDING FORMAT
+========================
+
+A recording starts with the 5-byte header "TLRC" + version (0x02),
+followed by records (little-endian):
+
+  [0-7]   int64   relay time, ns since Unix epoch
+  [8]     uint8   direction: 0 = received from peer, 1 = sent by relay
+  [9]     uint8   robot ID length R
+  [10..]  R bytes robot ID
+  [..]    uint8   peer ID length P (0 for fan-out to all web peers)
+  [..]    P bytes peer ID
+  [..]    uint8   client ID length C (0 if the peer named none)
+  [..]    C bytes client ID, stable across the peer's connections
+  [..]    uint32  frame length N
+  [..]    N bytes frame, exactly as read or written on the WebSocket
+
+Version 0x01 recordings lack the client ID and are still read.
+*/
+
+const (
+	recordMagic   = "TLRC"
+	recordVersion = 0x02
+
+	RecordIn  = 0x00
+	RecordOut = 0x01
+
+	// Records queued for the writer before new ones are dropped
+	recordQueueSize = 4096
+)
+
+// Record is one captured frame
+type Record struct {
+	Time     time.Time
+	Dir      byte
+	RobotID  string
+	PeerID   string
+	ClientID string
+	Frame    []byte
+}
+
+// Recorder appends records to a session file from a background goroutine
+// so disk latency never stalls the forwarding path.
+type Recorder struct {
+	path  string
+	queue chan Record
+	done  chan struct{}
+}
+
+// recorder is nil unless recording is enabled
+var recorder *Recorder
+
+// newRecorder creates a session file in dir named after the start time
+func newRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "session-"+time.Now().Format("20060102-150405")+".rec")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		path:  path,
+		queue: make(chan Record, recordQueueSize),
+		done:  make(chan struct{}),
+	}
+	go r.run(f)
+	return r, nil
+}
+
+// record queues a copy of frame, received from or sent to peer (nil for
+// a fan-out); it never blocks
+func (r *Recorder) record(dir byte, robotID string, peer *Peer, frame []byte) {
+	if r == nil {
+		return
+	}
+	rec := Record{
+		Time:    time.Now(),
+		Dir:     dir,
+		RobotID: robotID,
+		Frame:   append([]byte(nil), frame...),
+	}
+	if peer != nil {
+		rec.PeerID, rec.ClientID = peer.ID, peer.Meta.ClientID
+	}
+	select {
+	case r.queue <- rec:
+	default:
+		metricRecordDropped.Inc()
+	}
+}
+
+func (r *Recorder) run(f *os.File) {
+	defer close(r.done)
+	w := bufio.NewWriterSize(f, 64*1024)
+	w.WriteString(recordMagic)
+	w.WriteByte(recordVersion)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	for {
+		select {
+		case rec, ok := <-r.queue:
+			if !ok {
+				w.Flush()
+				f.Close()
+				return
+			}
+			if err := writeRecord(w, rec); err != nil {
+				slog.Error("Recording write failed", "path", r.path, "err", err)
+			}
+		case <-flush.C:
+			w.Flush()
+		}
+	}
+}
+
+// close flushes queued records and closes the file
+func (r *Recorder) close() {
+	if r == nil {
+		return
+	}
+	close(r.queue)
+	<-r.done
+	slog.Info("Recording saved", "path", r.path)
+}
+
+func writeRecord(w *bufio.Writer, rec Record) error {
+	var hdr [10]byte
+	binary.LittleEndian.PutUint64(hdr[0:8], uint64(rec.Time.UnixNano()))
+	hdr[8] = rec.Dir
+	hdr[9] = byte(len(rec.RobotID))
+	w.Write(hdr[:])
+	w.WriteString(rec.RobotID)
+	w.WriteByte(byte(len(rec.PeerID)))
+	w.WriteString(rec.PeerID)
+	w.WriteByte(byte(len(rec.ClientID)))
+	w.WriteString(rec.ClientID)
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(rec.Frame)))
+	w.Write(n[:])
+	_, err := w.Write(rec.Frame)
+	return err
+}
+
+// readRecording calls fn for every record in a session file
+func readRecording(rd io.Reader, fn func(Record) error) error {
+	r := bufio.NewReader(rd)
+
+	var magic [5]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return fmt.Errorf("reading header: %w", err)
+	}
+	version := magic[4]
+	if string(magic[:4]) != recordMagic || version < 0x01 || version > recordVersion {
+		return errors.New("not a session recording (bad header)")
+	}
+
+	for {
+		var hdr [10]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		rec := Record{
+			Time: time.Unix(0, int64(binary.LittleEndian.Uint64(hdr[0:8]))),
+			Dir:  hdr[8],
+		}
+		robot := make([]byte, hdr[9])
+		if _, err := io.ReadFull(r, robot); err != nil {
+			return err
+		}
+		rec.RobotID = string(robot)
+
+		plen, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		peer := make([]byte, plen)
+		if _, err := io.ReadFull(r, peer); err != nil {
+			return err
+		}
+		rec.PeerID = string(peer)
+		if version >= 0x02 {
+			clen, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			client := make([]byte, clen)
+			if _, err := io.ReadFull(r, client); err != nil {
+				return err
+			}
+			rec.ClientID = string(client)
+		}
+
+		var n [4]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return err
+		}
+		rec.Frame = make([]byte, binary.LittleEndian.Uint32(n[:]))
+		if _, err := io.ReadFull(r, rec.Frame); err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
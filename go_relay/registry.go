@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RobotRegistry remembers every robot a robot peer has served since the
+// relay started, with when it came and went, its last ack and how fast
+// commands are forwarded to it. It lives in PeerManager, which reports
+// connections; acks and commands are observed without taking manager.mu.
+type RobotRegistry struct {
+	mu     sync.Mutex
+	robots map[string]*robotRecord
+}
+
+type robotRecord struct {
+	since    time.Time // last connect or disconnect
+	lastAck  time.Time
+	commands windowRate
+}
+
+// RobotInfo is one robot as listed by /robots
+type RobotInfo struct {
+	ID            string     `json:"id"`
+	State         string     `json:"state"` // "connected" or "disconnected"
+	Since         time.Time  `json:"since"`
+	PeerID        string     `json:"peer_id,omitempty"` // primary robot peer
+	Standbys      int        `json:"standbys,omitempty"`
+	LastAck       *time.Time `json:"last_ack,omitempty"`
+	Driver        string     `json:"driver,omitempty"`
+	CommandRateHz float64    `json:"command_rate_hz"`
+	EStopped      bool       `json:"estopped"`
+}
+
+func newRobotRegistry() *RobotRegistry {
+	return &RobotRegistry{robots: make(map[string]*robotRecord)}
+}
+
+// record returns robotID's record, creating it; caller holds r.mu
+func (r *RobotRegistry) record(robotID string) *robotRecord {
+	rec, ok := r.robots[robotID]
+	if !ok {
+		rec = &robotRecord{}
+		r.robots[robotID] = rec
+	}
+	return rec
+}
+
+// changed notes that robotID connected or disconnected
+func (r *RobotRegistry) changed(robotID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(robotID).since = time.Now()
+}
+
+// ack notes an ack from robotID's robot peer
+func (r *RobotRegistry) ack(robotID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(robotID).lastAck = time.Now()
+}
+
+// command notes a twist or Joy frame queued for robotID
+func (r *RobotRegistry) command(robotID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(robotID).commands.observe(time.Now())
+}
+
+// listRobots returns every known robot, sorted by ID
+func (m *PeerManager) listRobots() []RobotInfo {
+	robots := m.robotStates()
+	for i := range robots {
+		robots[i].Driver = arbiter.driver(robots[i].ID)
+		robots[i].EStopped = estops.engaged(robots[i].ID)
+	}
+	return robots
+}
+
+// robotStates returns the registry's view of every robot, sorted by ID
+func (m *PeerManager) robotStates() []RobotInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	m.registry.mu.Lock()
+	defer m.registry.mu.Unlock()
+
+	robots := make([]RobotInfo, 0, len(m.registry.robots))
+	for robotID, rec := range m.registry.robots {
+		info := RobotInfo{
+			ID:            robotID,
+			State:         "disconnected",
+			Since:         rec.since,
+			Standbys:      len(m.standby[robotID]),
+			CommandRateHz: rec.commands.hz(),
+		}
+		if p, ok := m.robots[robotID]; ok {
+			info.State, info.PeerID = "connected", p.ID
+		}
+		if !rec.lastAck.IsZero() {
+			lastAck := rec.lastAck
+			info.LastAck = &lastAck
+		}
+		robots = append(robots, info)
+	}
+	sort.Slice(robots, func(i, j int) bool { return robots[i].ID < robots[j].ID })
+	return robots
+}
+
+// handleRobots serves GET /robots: every robot seen since startup
+func handleRobots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"robots": manager.listRobots(),
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	clockStepCheck     = time.Second
+	clockStepThreshold = 20 // ms the wall clock may move against the relay clock per check; NTP slews far slower
+	maxClockSteps      = 256
+)
+
+// relayEpoch anchors relay time: the wall clock once at startup, advanced
+// by Go's monotonic clock from then on, so NTP steps and manual clock
+// changes cannot make relay timestamps jump mid-session
+var relayEpoch = time.Now()
+
+// relayTime returns relay time as Unix ms, see relayEpoch
+func relayTime() int64 {
+	return relayEpoch.UnixMilli() + time.Since(relayEpoch).Milliseconds()
+}
+
+// ClockStep is a jump of the wall clock against relay time
+type ClockStep struct {
+	At     uint64 `json:"at"`      // relay time (Unix ms) the step was noticed
+	StepMs int64  `json:"step_ms"` // how far the wall clock moved, + is forward
+	SkewMs int64  `json:"skew_ms"` // wall clock minus relay time after the step
+}
+
+// ClockSteps remembers recent wall-clock steps
+type ClockSteps struct {
+	mu    sync.Mutex
+	steps []ClockStep
+}
+
+var clockSteps = &ClockSteps{}
+
+// wallSkew returns wall clock minus relay time in ms
+func wallSkew() int64 {
+	return time.Now().Round(0).UnixMilli() - relayTime()
+}
+
+// watchWallClock compares the wall clock with relay time every second
+// and records, logs and publishes any step
+func watchWallClock() {
+	ticker := time.NewTicker(clockStepCheck)
+	defer ticker.Stop()
+	last := wallSkew()
+	for range ticker.C {
+		skew := wallSkew()
+		metricWallClockSkew.Set(float64(skew) / 1000)
+		step := skew - last
+		last = skew
+		if step > -clockStepThreshold && step < clockStepThreshold {
+			continue
+		}
+		s := ClockStep{At: currentTimeMs(), StepMs: step, SkewMs: skew}
+		clockSteps.add(s)
+		metricWallClockSteps.Inc()
+		slog.Warn("Wall clock stepped; relay timestamps unaffected", "step_ms", step, "skew_ms", skew)
+		events.publish("clock_step", s)
+	}
+}
+
+func (c *ClockSteps) add(s ClockStep) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.steps = append(c.steps, s)
+	if len(c.steps) > maxClockSteps {
+		c.steps = c.steps[1:]
+	}
+}
+
+func (c *ClockSteps) snapshot() []ClockStep {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]ClockStep{}, c.steps...)
+}
+
+// between reports whether a step was noticed in [from, to] relay time,
+// widened by one check interval since steps are seen up to a second late
+func (c *ClockSteps) between(from, to uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.steps {
+		if s.At+uint64(clockStepCheck.Milliseconds()) >= from && s.At <= to+uint64(clockStepCheck.Milliseconds()) {
+			return true
+		}
+	}
+	return false
+}
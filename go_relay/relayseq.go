@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// RelaySeqBlockSize is the uint64 relay sequence number ending twists to
+// and acks to peers that negotiated FeatureRelaySeq. It follows the robot
+// trailer and comes before any hop or trace block.
+const RelaySeqBlockSize = 8
+
+// RelaySequencer numbers the twists forwarded to each robot. Browsers
+// number their own twists, so a robot driven by several of them, one
+// after another or blended, cannot tell a lost twist from a change of
+// sender; the relay's numbers increase by one per twist whoever sent it.
+// A robot sees a gap for every twist lost on the way, send queue drops
+// included, and browsers can order acks across drivers: an ack echoes its
+// twist's number, or 0 if it matches none. /latency reports them as
+// relay_seq.
+type RelaySequencer struct {
+	mu   sync.Mutex
+	last map[string]uint64
+}
+
+var relaySeqs = &RelaySequencer{last: make(map[string]uint64)}
+
+// next assigns robotID's next sequence number, starting at 1. Numbers
+// outlive robot reconnects but not the relay.
+func (s *RelaySequencer) next(robotID string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last[robotID]++
+	return s.last[robotID]
+}
+
+// appendRelaySeq appends the relay sequence block
+func appendRelaySeq(frame []byte, seq uint64) []byte {
+	return binary.LittleEndian.AppendUint64(frame, seq)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// Reliable commands are for non-safety input a robot must not miss, such
+// as parameter sets or waypoints: a browser's Command frame is buffered
+// until the robot acks it and retransmitted with backoff meanwhile. The
+// relay renumbers commands towards the robot with IDs unique across all
+// browsers, so the robot can drop retransmitted duplicates by ID alone,
+// and maps the robot's Command Ack back to the browser's ID. Commands
+// follow the twist rules (driver or supervisor only, none while
+// e-stopped) and are resent after -command-retry, doubling, at most
+// -command-retries times and at once when the robot reconnects; then the
+// browser gets a Nack with -nacks.
+const (
+	// maxPendingCommands bounds a robot's unacked commands
+	maxPendingCommands = 256
+	// maxCommandBackoff caps the retransmit interval
+	maxCommandBackoff = 5 * time.Second
+)
+
+// CommandStatusOK is the Command Ack status of a command the robot applied;
+// other values are robot-defined rejections
+const CommandStatusOK = 0
+
+// ReliableCommands holds the commands awaiting a robot's ack
+type ReliableCommands struct {
+	mu       sync.Mutex
+	nextID   uint64
+	pending  map[uint64]*pendingCommand // by relay ID
+	bySource map[commandKey]uint64      // browser resends of a pending command
+}
+
+type commandKey struct {
+	source string
+	msgID  uint64
+}
+
+type pendingCommand struct {
+	robotID  string
+	source   string
+	msgID    uint64 // the browser's
+	frame    []byte // as sent to the robot, with the relay's ID
+	attempts int
+	backoff  time.Duration
+	timer    *time.Timer
+}
+
+var reliable = &ReliableCommands{
+	pending:  make(map[uint64]*pendingCommand),
+	bySource: make(map[commandKey]uint64),
+}
+
+// handleCommand buffers a browser's Command for its robot and sends it.
+// Commands follow the twist rules: observers may not send them, only the
+// driver's (or a supervisor's) are taken, none while the robot is
+// e-stopped.
+func handleCommand(peer *Peer, data []byte) {
+	if !peer.watchesRobot() {
+		return
+	}
+	if peer.Type == "observer" {
+		peer.logger().Warn("Command from observer rejected", "msg_type", "command")
+		return
+	}
+	if len(data) < protocol.CommandMinSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.CommandMinSize)
+		return
+	}
+	msgID := binary.LittleEndian.Uint64(data[1:9])
+	robotID := manager.robotFor(peer)
+	if refuseStopped(robotID, peer.ID, msgID) {
+		return
+	}
+	if !peer.Meta.Supervisor {
+		driving, claimed := arbiter.take(robotID, peer.ID)
+		if !driving {
+			sendNack(peer.ID, msgID, NackNotDriver)
+			return
+		}
+		if claimed {
+			broadcastControlState(robotID)
+		}
+	}
+	reliable.add(robotID, peer.ID, msgID, data)
+}
+
+// add buffers a command and makes its first attempt
+func (rc *ReliableCommands) add(robotID, source string, msgID uint64, data []byte) {
+	rc.mu.Lock()
+	key := commandKey{source, msgID}
+	if _, ok := rc.bySource[key]; ok {
+		rc.mu.Unlock()
+		metricCommands.WithLabelValues("duplicate").Inc()
+		return // already on its way
+	}
+	n := 0
+	for _, c := range rc.pending {
+		if c.robotID == robotID {
+			n++
+		}
+	}
+	if n >= maxPendingCommands {
+		rc.mu.Unlock()
+		metricCommands.WithLabelValues("undelivered").Inc()
+		sendNack(source, msgID, NackUndelivered)
+		return
+	}
+	rc.nextID++
+	id := rc.nextID
+	frame := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint64(frame[1:9], id)
+	rc.pending[id] = &pendingCommand{
+		robotID: robotID,
+		source:  source,
+		msgID:   msgID,
+		frame:   frame,
+		backoff: config.CommandRetry,
+	}
+	rc.bySource[key] = id
+	rc.mu.Unlock()
+
+	metricCommands.WithLabelValues("received").Inc()
+	rc.attempt(id)
+}
+
+// attempt sends command id to its robot and schedules the next attempt, or
+// gives up after config.CommandRetries retransmissions
+func (rc *ReliableCommands) attempt(id uint64) {
+	rc.mu.Lock()
+	c := rc.pending[id]
+	if c == nil {
+		rc.mu.Unlock()
+		return
+	}
+	if c.attempts > config.CommandRetries {
+		rc.removeLocked(id, c)
+		rc.mu.Unlock()
+		slog.Warn("Command undelivered", "msg_type", "command", "msg_id", c.msgID, "robot_id", c.robotID,
+			"source", c.source, "attempts", c.attempts)
+		metricCommands.WithLabelValues("undelivered").Inc()
+		sendNack(c.source, c.msgID, NackUndelivered)
+		return
+	}
+	c.attempts++
+	if c.attempts > 1 {
+		metricCommandRetransmits.Inc()
+	}
+	delay := c.backoff
+	c.backoff = min(2*c.backoff, maxCommandBackoff)
+	c.timer = time.AfterFunc(delay, func() { rc.attempt(id) })
+	robotID, frame := c.robotID, c.frame
+	rc.mu.Unlock()
+
+	python := manager.getPython(robotID)
+	if python == nil {
+		return // retried until the robot is back or attempts run out
+	}
+	if python.Type != "python" {
+		// Downstream relays don't take commands
+		rc.mu.Lock()
+		rc.removeLocked(id, c)
+		rc.mu.Unlock()
+		sendNack(c.source, c.msgID, NackNoRobot)
+		return
+	}
+	python.send(frame)
+	slog.Debug("Command sent", "peer_id", python.ID, "msg_type", "command", "msg_id", c.msgID,
+		"relay_msg_id", id, "robot_id", robotID, "attempt", c.attempts)
+}
+
+// removeLocked forgets a pending command; rc.mu is held
+func (rc *ReliableCommands) removeLocked(id uint64, c *pendingCommand) {
+	c.timer.Stop()
+	delete(rc.pending, id)
+	delete(rc.bySource, commandKey{c.source, c.msgID})
+}
+
+// handleCommandAck completes a command and passes the robot's status to
+// its sender under the sender's own message ID. Acks of retransmitted
+// duplicates find nothing pending and are dropped.
+func handleCommandAck(peer *Peer, data []byte) {
+	if !peer.isRobot() {
+		return
+	}
+	if len(data) < protocol.CommandAckSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.CommandAckSize)
+		return
+	}
+	id := binary.LittleEndian.Uint64(data[1:9])
+	rc := reliable
+	rc.mu.Lock()
+	c := rc.pending[id]
+	if c == nil || c.robotID != peer.RobotID {
+		rc.mu.Unlock()
+		return
+	}
+	rc.removeLocked(id, c)
+	rc.mu.Unlock()
+
+	metricCommands.WithLabelValues("acked").Inc()
+	peer.logger().Debug("Command acked", "msg_type", "command_ack", "msg_id", c.msgID, "relay_msg_id", id,
+		"robot_id", c.robotID, "status", data[9], "attempts", c.attempts)
+	if web := manager.getPeer(c.source); web != nil && web.watchesRobot() {
+		ack := make([]byte, protocol.CommandAckSize)
+		copy(ack, data[:protocol.CommandAckSize])
+		binary.LittleEndian.PutUint64(ack[1:9], c.msgID)
+		web.send(ack)
+	}
+}
+
+// robotUp retransmits robotID's pending commands as soon as its robot is
+// back rather than at their next backoff
+func (rc *ReliableCommands) robotUp(robotID string) {
+	rc.mu.Lock()
+	var ids []uint64
+	for id, c := range rc.pending {
+		if c.robotID == robotID && c.timer.Stop() {
+			ids = append(ids, id)
+		}
+	}
+	rc.mu.Unlock()
+	for _, id := range ids {
+		rc.attempt(id)
+	}
+}
+
+// snapshot counts each robot's pending commands
+func (rc *ReliableCommands) snapshot() map[string]int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	out := make(map[string]int)
+	for _, c := range rc.pending {
+		out[c.robotID]++
+	}
+	return out
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go_relay/protocol"
+)
+
+// runReplay implements `replay [flags] <session.rec|session.mcap>`: it
+// re-sends the recorded browser twists with their original spacing
+// (divided by -speed), so they reach whichever Python peer serves the
+// robot. Each recorded (robot, browser) pair gets its own web peer
+// connection, so twists to several robots, or from several browsers, keep
+// their own drivers as when they were recorded. MCAP files are read for
+// their Twist and TwistStamped channels, such as -mcap-dir writes.
+// -dry-run prints the schedule instead of connecting.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	relayURL := fs.String("url", "ws://localhost:8080/ws/data", "relay WebSocket URL")
+	robot := fs.String("robot", "", "send to this robot instead of the recorded one")
+	token := fs.String("token", "", "JWT with 'web' scope if the relay requires auth")
+	speed := fs.Float64("speed", 1, "playback speed factor (2 = twice as fast)")
+	dryRun := fs.Bool("dry-run", false, "print the twists and their send offsets without connecting")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: go_relay replay [flags] <session.rec|session.mcap>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if !(*speed > 0) || math.IsInf(*speed, 1) {
+		return errors.New("-speed must be a positive number")
+	}
+
+	twists, err := loadReplayTwists(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(twists) == 0 {
+		return fmt.Errorf("%s: no twists recorded", fs.Arg(0))
+	}
+	// offset is when twist i goes out, relative to the first
+	offset := func(i int) time.Duration {
+		return time.Duration(float64(twists[i].Time.Sub(twists[0].Time)) / *speed)
+	}
+	streamFor := func(rec Record) replayStream {
+		if *robot != "" {
+			return replayStream{*robot, rec.PeerID}
+		}
+		return replayStream{rec.RobotID, rec.PeerID}
+	}
+
+	if *dryRun {
+		fmt.Println("offset_ms,robot_id,peer_id,msg_id,linear_x,linear_y,linear_z,angular_x,angular_y,angular_z")
+		for i, rec := range twists {
+			le := binary.LittleEndian
+			st := streamFor(rec)
+			fmt.Printf("%d,%s,%s,%d", offset(i).Milliseconds(), st.robotID, st.source, le.Uint64(rec.Frame[1:9]))
+			for j := 0; j < 6; j++ {
+				fmt.Printf(",%g", math.Float64frombits(le.Uint64(rec.Frame[17+8*j:])))
+			}
+			fmt.Println()
+		}
+		slog.Info("Dry run", "twists", len(twists), "duration", offset(len(twists)-1))
+		return nil
+	}
+
+	conns := make(map[replayStream]*websocket.Conn)
+	defer func() {
+		for _, conn := range conns {
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "replay finished"),
+				time.Now().Add(time.Second))
+			conn.Close()
+		}
+	}()
+	for _, rec := range twists {
+		st := streamFor(rec)
+		if conns[st] != nil {
+			continue
+		}
+		conn, err := dialRelay(*relayURL, "web", st.robotID, *token)
+		if err != nil {
+			return fmt.Errorf("robot %q, peer %q: %w", st.robotID, st.source, err)
+		}
+		conns[st] = conn
+		// Discard acks and state; the relay closes us if we stop reading pongs
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	slog.Info("Replaying", "twists", len(twists), "connections", len(conns),
+		"duration", offset(len(twists)-1), "speed", *speed)
+	start := time.Now()
+	for i, rec := range twists {
+		time.Sleep(time.Until(start.Add(offset(i))))
+
+		st := streamFor(rec)
+		frame := make([]byte, protocol.TwistBrowserSize, protocol.TwistBrowserSize+1+len(st.robotID))
+		copy(frame, rec.Frame[:protocol.TwistBrowserSize])
+		binary.LittleEndian.PutUint64(frame[9:17], currentTimeMs()) // fresh t1
+		frame = protocol.AppendRobotTrailer(frame, st.robotID)
+
+		if err := conns[st].WriteMessage(websocket.BinaryMessage, frame); err != nil {
+			return fmt.Errorf("twist %d/%d: %w", i+1, len(twists), err)
+		}
+	}
+	slog.Info("Replay finished", "elapsed", time.Since(start))
+	return nil
+}
+
+// replayStream is one recorded browser's twists to one robot, replayed
+// over a connection of its own
+type replayStream struct {
+	robotID string
+	source  string // the recorded peer ID; empty in MCAP files
+}
+
+// loadReplayTwists reads the browser twists of a session recording or an
+// MCAP file, told apart by their magic
+func loadReplayTwists(path string) ([]Record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var twists []Record
+	keep := func(rec Record) error {
+		if rec.Dir == RecordIn && len(rec.Frame) >= protocol.TwistBrowserSize && rec.Frame[0] == protocol.MsgTypeTwist {
+			twists = append(twists, rec)
+		}
+		return nil
+	}
+	if bytes.HasPrefix(data, mcapMagic) {
+		err = readMCAPTwists(data, keep)
+	} else {
+		err = readRecording(bytes.NewReader(data), keep)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return twists, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ResumeStore lets a web or observer peer that reconnects within
+// -resume-grace pick up where its last connection left off. Every such
+// peer gets a one-time resumption token in its welcome; presenting it as
+// ?resume= on the next connection restores the peer ID, the robot it
+// addressed, any robots it drove and its twist sequence state, and hands
+// out a fresh token. Driver status outlives the disconnect for the grace
+// window (the robot itself is still stopped by the deadman), so nobody
+// else can take control meanwhile short of a steal.
+type ResumeStore struct {
+	mu       sync.Mutex
+	sessions map[string]*resumable // token -> session
+}
+
+// resumable is one resumable session
+type resumable struct {
+	token    string // current token, rotated on every resume
+	peerID   string
+	typ      string
+	subject  string
+	clientID string
+	room     string
+	robotID  string
+	prev     *Peer       // the connection the session was last served on
+	live     bool        // prev is still connected
+	timer    *time.Timer // grace window once prev disconnected
+}
+
+// What leave found for a disconnecting peer
+const (
+	resumeNone       = iota // not resumable, clean up as usual
+	resumeParked            // kept for the grace window, keep control
+	resumeSuperseded        // a resumed connection took its place
+)
+
+var resumes = &ResumeStore{sessions: make(map[string]*resumable)}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// resumesType reports whether peers of peerType can resume their session
+func resumesType(peerType string) bool {
+	return config.ResumeGrace > 0 && (peerType == "web" || peerType == "observer")
+}
+
+// start resumes the session behind the ?resume= token of a new peer if it
+// can, and otherwise issues it one, setting peer.resumeToken either way
+func (s *ResumeStore) start(peer *Peer, token string) (resumed bool) {
+	if !resumesType(peer.Type) {
+		return false
+	}
+	if token != "" {
+		peer.resumeToken, resumed = s.resume(peer, token)
+	}
+	if !resumed {
+		peer.resumeToken = s.issue(peer)
+	}
+	return resumed
+}
+
+// issue registers peer as a new resumable session and returns its token,
+// or "" if its type does not resume
+func (s *ResumeStore) issue(peer *Peer) string {
+	if !resumesType(peer.Type) {
+		return ""
+	}
+	r := &resumable{
+		token:    newResumeToken(),
+		peerID:   peer.ID,
+		typ:      peer.Type,
+		subject:  peer.Subject,
+		clientID: peer.Meta.ClientID,
+		room:     peer.Meta.Room,
+		robotID:  peer.RobotID,
+		prev:     peer,
+		live:     true,
+	}
+	peer.resume = r
+	s.mu.Lock()
+	s.sessions[r.token] = r
+	s.mu.Unlock()
+	return r.token
+}
+
+// resume moves the session behind token onto peer, not yet registered,
+// and returns the session's next token. The session must belong to the
+// same peer type, token subject, client ID and room. If its previous
+// connection is still up (the client noticed the drop first) that
+// connection is dropped without the usual disconnect handling. ok is
+// false for unknown or expired tokens, and peer then starts a session of
+// its own.
+func (s *ResumeStore) resume(peer *Peer, token string) (next string, ok bool) {
+	s.mu.Lock()
+	r := s.sessions[token]
+	if r == nil || r.typ != peer.Type || r.subject != peer.Subject || r.clientID != peer.Meta.ClientID || r.room != peer.Meta.Room {
+		s.mu.Unlock()
+		metricResumes.WithLabelValues("rejected").Inc()
+		return "", false
+	}
+	delete(s.sessions, token)
+	r.token = newResumeToken()
+	s.sessions[r.token] = r
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	prev, live := r.prev, r.live
+	if live {
+		r.robotID = manager.robotFor(prev)
+	}
+	r.prev, r.live = peer, true
+	peer.ID, peer.RobotID = r.peerID, r.robotID
+	peer.resume = r
+	next = r.token
+	s.mu.Unlock()
+
+	peer.seq.restore(&prev.seq)
+	if live {
+		manager.removePeer(prev)
+		prev.Conn.Close()
+	}
+	metricResumes.WithLabelValues("resumed").Inc()
+	peer.logger().Info("Session resumed", "robot_id", peer.RobotID, "replaced_connection", live)
+	return next, true
+}
+
+// leave is called as peer disconnects. A resumable session is parked for
+// -resume-grace unless a resumed connection already replaced peer.
+func (s *ResumeStore) leave(peer *Peer) int {
+	r := peer.resume
+	if r == nil {
+		return resumeNone
+	}
+	robotID := manager.robotFor(peer)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.prev != peer {
+		return resumeSuperseded
+	}
+	r.live, r.robotID = false, robotID
+	r.timer = time.AfterFunc(config.ResumeGrace, func() { s.expire(r) })
+	return resumeParked
+}
+
+// expire ends r's grace window if nobody resumed it, giving up the
+// robots it still drives
+func (s *ResumeStore) expire(r *resumable) {
+	s.mu.Lock()
+	if s.sessions[r.token] != r || r.live {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.sessions, r.token)
+	s.mu.Unlock()
+
+	metricResumes.WithLabelValues("expired").Inc()
+	slog.Info("Session expired", "peer_id", r.peerID, "robot_id", r.robotID)
+	for _, robotID := range arbiter.releaseAll(r.peerID) {
+		broadcastControlState(robotID)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rooms keep concurrent experiments on one relay apart. A peer joins one
+// with ?room= (gRPC metadata room), and every robot ID it names, on
+// connect or in a robot ID trailer, is then taken within that room: the
+// relay keys the robot as "<room>/<robot>". Since routing, control,
+// e-stops, holds and the ack, telemetry, odometry and presence fan-out
+// all go by that key, two rooms can each run a robot "default" without
+// seeing each other's commands or acks. Peers keep seeing the bare ID
+// (in trailers, the Session frame and the welcome); REST endpoints,
+// metrics, logs and recordings use the key. A peer without a room may
+// name a room's robot directly as "<room>/<robot>", which is how UDP
+// robots join one. Rooms separate, they do not authorize.
+
+// maxRoomLen bounds room names
+const maxRoomLen = 32
+
+// validRoom checks a room name: "" (no room), or up to maxRoomLen ASCII
+// letters, digits and . _ -
+func validRoom(room string) error {
+	if len(room) > maxRoomLen {
+		return fmt.Errorf("room longer than %d bytes", maxRoomLen)
+	}
+	for _, c := range room {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return fmt.Errorf("room has invalid character %q", c)
+		}
+	}
+	return nil
+}
+
+// roomRobotID is the key of robotID within room
+func roomRobotID(room, robotID string) string {
+	if room == "" {
+		return robotID
+	}
+	return room + "/" + robotID
+}
+
+// splitRobotID splits a robot key into its room, if it names a valid
+// one, and the robot ID within it
+func splitRobotID(key string) (room, robotID string) {
+	if i := strings.IndexByte(key, '/'); i > 0 && validRoom(key[:i]) == nil {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// bareRobotID is the robot ID peers in the key's room know it by
+func bareRobotID(key string) string {
+	_, robotID := splitRobotID(key)
+	return robotID
+}
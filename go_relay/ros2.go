@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// ROS2Options configures native ROS 2 mode; an empty robot disables it
+type ROS2Options struct {
+	Robot    string `yaml:"robot"`     // robot ID served by the relay's own node
+	Node     string `yaml:"node"`      // ROS 2 node name
+	CmdTopic string `yaml:"cmd_topic"` // geometry_msgs/Twist published here
+	AckTopic string `yaml:"ack_topic"` // std_msgs/UInt64 acks read here
+}
+
+// ros2Node is the relay's own ROS 2 node: rclgo with -tags ros2 (see
+// ros2_rclgo.go), otherwise a stub that fails to open
+type ros2Node interface {
+	publishTwist(v [6]float64) error
+	close()
+}
+
+// ROS2Robot serves one robot by publishing to ROS 2 from inside the relay,
+// so no Python bridge runs at all. Twists go out on the command topic as
+// geometry_msgs/Twist and e-stop engages as a zero twist. A std_msgs/UInt64
+// on the ack topic acks the twist with that message ID, or the last twist
+// published if 0, with the robot's times set to its arrival. Like the mock
+// robot, the peer registers again a second after being closed.
+type ROS2Robot struct {
+	robotID string
+	node    ros2Node
+
+	mu      sync.Mutex
+	current *ros2Transport
+}
+
+// ros2Robot is set by main when -ros2-robot is given
+var ros2Robot *ROS2Robot
+
+func startROS2(opts ROS2Options) (*ROS2Robot, error) {
+	r := &ROS2Robot{robotID: opts.Robot}
+	node, err := openROS2Node(opts, r.handleAck)
+	if err != nil {
+		return nil, err
+	}
+	r.node = node
+	slog.Info("ROS 2 node started", "node", opts.Node, "cmd_topic", opts.CmdTopic, "ack_topic", opts.AckTopic)
+	go r.serve()
+	return r, nil
+}
+
+// serve keeps the robot registered until the relay drains
+func (r *ROS2Robot) serve() {
+	for !draining.Load() {
+		t := &ros2Transport{
+			node: r.node,
+			in:   make(chan []byte, 64),
+			done: make(chan struct{}),
+		}
+		r.mu.Lock()
+		r.current = t
+		r.mu.Unlock()
+
+		peer := newPeer("python", r.robotID, "", t)
+		peer.Meta = PeerMeta{Name: "ros2 node"}
+		servePeer(peer)
+		time.Sleep(mockReconnectDelay)
+	}
+}
+
+// handleAck is called by the node for every ack message
+func (r *ROS2Robot) handleAck(msgID uint64) {
+	r.mu.Lock()
+	t := r.current
+	r.mu.Unlock()
+	if t != nil {
+		t.deliver(t.ack(msgID))
+	}
+}
+
+func (r *ROS2Robot) close() {
+	r.node.close()
+}
+
+// ros2Transport is the robot peer's side of the node. It never
+// negotiates, so frames arrive without CRCs and trailers.
+type ros2Transport struct {
+	node ros2Node
+
+	mu   sync.Mutex
+	last []byte // last twist published, for acks
+
+	in        chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *ros2Transport) deliver(frame []byte) {
+	select {
+	case t.in <- frame:
+	case <-t.done:
+	default:
+		metricDropped.WithLabelValues("python", OverflowDropNewest).Inc()
+	}
+}
+
+// ack builds the binary ack for msgID, taking t1-t3 from the last twist
+// when it is the one acked
+func (t *ros2Transport) ack(msgID uint64) []byte {
+	now := currentTimeMs()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if twist, err := protocol.UnmarshalTwist(t.last, true); err == nil && (msgID == 0 || msgID == twist.MsgID) {
+		return protocol.AckFor(twist, now, now).Marshal()
+	}
+	return protocol.Ack{MsgID: msgID, T3PythonRx: now, T4PythonAck: now}.Marshal()
+}
+
+func (t *ros2Transport) ReadFrame() ([]byte, error) {
+	select {
+	case frame := <-t.in:
+		return frame, nil
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// WriteFrame publishes twists and e-stop engages; every other frame has
+// no ROS 2 equivalent and is dropped
+func (t *ros2Transport) WriteFrame(msg, trailer []byte) error {
+	var twist [6]float64
+	switch {
+	case len(msg) >= protocol.TwistToPythonSize && msg[0] == protocol.MsgTypeTwist:
+		t.mu.Lock()
+		t.last = append(t.last[:0], msg[:protocol.TwistToPythonSize]...)
+		t.mu.Unlock()
+		for i := range twist {
+			twist[i] = math.Float64frombits(binary.LittleEndian.Uint64(msg[17+8*i:]))
+		}
+	case len(msg) >= protocol.EStopSize && msg[0] == protocol.MsgTypeEStop && msg[1] == EStopEngage:
+		// zero twist
+	default:
+		return nil
+	}
+	return t.node.publishTwist(twist)
+}
+
+// Ping has nothing to prove; the node lives in the relay
+func (t *ros2Transport) Ping() error { return nil }
+
+func (t *ros2Transport) Shutdown(code int, reason string) { t.Close() }
+
+func (t *ros2Transport) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return nil
+}
+
+func (t *ros2Transport) RemoteAddr() string { return "ros2" }
@@ -0,0 +1,75 @@
+//go:build ros2
+
+// Bindings for the messages used are generated from the sourced ROS 2
+// install into ./msgs (go generate -tags ros2 ./...), and rclgo itself is
+// fetched with go get github.com/tiiuae/rclgo.
+
+//go:generate rclgo-gen generate -d msgs --include-go-package-deps ./...
+
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/tiiuae/rclgo/pkg/rclgo"
+
+	geometry_msgs_msg "go_relay/msgs/geometry_msgs/msg"
+	std_msgs_msg "go_relay/msgs/std_msgs/msg"
+)
+
+// rclgoNode publishes twists and spins the ack subscription until closed
+type rclgoNode struct {
+	rcl    *rclgo.Context
+	pub    *geometry_msgs_msg.TwistPublisher
+	cancel context.CancelFunc
+}
+
+func openROS2Node(opts ROS2Options, onAck func(msgID uint64)) (ros2Node, error) {
+	rcl, err := rclgo.NewContext(0, nil)
+	if err != nil {
+		return nil, err
+	}
+	node, err := rcl.NewNode(opts.Node, "")
+	if err != nil {
+		rcl.Close()
+		return nil, err
+	}
+	pub, err := geometry_msgs_msg.NewTwistPublisher(node, opts.CmdTopic, nil)
+	if err != nil {
+		rcl.Close()
+		return nil, err
+	}
+	_, err = std_msgs_msg.NewUInt64Subscription(node, opts.AckTopic, nil,
+		func(msg *std_msgs_msg.UInt64, _ *rclgo.MessageInfo, err error) {
+			if err != nil {
+				slog.Warn("ROS 2: bad ack", "topic", opts.AckTopic, "err", err)
+				return
+			}
+			onAck(msg.Data)
+		})
+	if err != nil {
+		rcl.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		if err := rcl.Spin(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("ROS 2 spin failed", "err", err)
+		}
+	}()
+	return &rclgoNode{rcl: rcl, pub: pub, cancel: cancel}, nil
+}
+
+func (n *rclgoNode) publishTwist(v [6]float64) error {
+	msg := geometry_msgs_msg.NewTwist()
+	msg.Linear.X, msg.Linear.Y, msg.Linear.Z = v[0], v[1], v[2]
+	msg.Angular.X, msg.Angular.Y, msg.Angular.Z = v[3], v[4], v[5]
+	return n.pub.Publish(msg)
+}
+
+func (n *rclgoNode) close() {
+	n.cancel()
+	n.rcl.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !ros2
+
+package main
+
+import "errors"
+
+// openROS2Node fails: rclgo needs cgo and a sourced ROS 2 install, so
+// native mode is only compiled in with -tags ros2
+func openROS2Node(opts ROS2Options, onAck func(msgID uint64)) (ros2Node, error) {
+	return nil, errors.New("relay built without ROS 2 support, rebuild with -tags ros2")
+}
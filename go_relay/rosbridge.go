@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go_relay/protocol"
+)
+
+// rosbridgeMsg is one rosbridge v2 protocol operation. Only the fields the
+// relay reads or writes are declared.
+type rosbridgeMsg struct {
+	Op    string          `json:"op"`
+	Topic string          `json:"topic,omitempty"`
+	Type  string          `json:"type,omitempty"`
+	Msg   json.RawMessage `json:"msg,omitempty"`
+}
+
+// rosVector3 and rosTwist mirror geometry_msgs/Vector3 and Twist
+type rosVector3 struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+type rosTwist struct {
+	Linear  rosVector3 `json:"linear"`
+	Angular rosVector3 `json:"angular"`
+}
+
+// rosAck is what the robot publishes on the ack topic. Every field is
+// optional: a missing message_id acks the last twist published, and the
+// robot's timestamps default to when the relay received the ack.
+type rosAck struct {
+	MessageID  *uint64 `json:"message_id"`
+	T3PythonRx uint64  `json:"t3_python_rx"`
+	T4Ack      uint64  `json:"t4_python_ack"`
+	DecodeUs   uint32  `json:"python_decode_us"`
+	ProcessUs  uint32  `json:"python_process_us"`
+	EncodeUs   uint32  `json:"python_encode_us"`
+}
+
+// handleRosbridge accepts a robot speaking the rosbridge JSON protocol
+// (?robot=<id>) and serves it as the robot's python peer: twists, and a
+// zero twist on E-Stop engage, are published on -rosbridge-cmd-topic and
+// messages on -rosbridge-ack-topic become acks. Other frames are not sent.
+func handleRosbridge(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		http.Error(w, "relay shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	_, robotID, err := parsePeerQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	meta, err := parsePeerMeta(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, err := limiter.acquire(r, "python")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	claims, authErr := auth.authorize(r, "python")
+	if authErr == nil {
+		meta.ClientID, authErr = auth.clientID(claims, meta.ClientID)
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("Upgrade failed", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	if authErr != nil {
+		msg := websocket.FormatCloseMessage(closeCodeFor(authErr), authErr.Error())
+		ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
+
+	t, err := newRosbridgeTransport(ws)
+	if err != nil {
+		slog.Warn("rosbridge setup failed", "remote", r.RemoteAddr, "err", err)
+		ws.Close()
+		return
+	}
+	peer := newPeer("python", robotID, claims.Subject, t)
+	peer.Meta = meta
+	servePeer(peer)
+}
+
+// rosbridgeTransport translates between the binary protocol and rosbridge
+// JSON. Twists are published on the command topic as geometry_msgs/Twist,
+// e-stops as a zero twist, and messages on the ack topic become binary
+// acks; every other frame has no rosbridge equivalent and is dropped.
+type rosbridgeTransport struct {
+	*wsTransport
+
+	mu   sync.Mutex
+	last [protocol.TwistToPythonSize]byte // last twist published, for acks
+}
+
+func newRosbridgeTransport(conn *websocket.Conn) (*rosbridgeTransport, error) {
+	t := &rosbridgeTransport{wsTransport: newWSTransport(conn)}
+	ops := []rosbridgeMsg{
+		{Op: "advertise", Topic: config.RosbridgeCmdTopic, Type: "geometry_msgs/Twist"},
+		{Op: "subscribe", Topic: config.RosbridgeAckTopic},
+	}
+	for _, op := range ops {
+		if err := t.writeJSON(op); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *rosbridgeTransport) writeJSON(v any) error {
+	t.conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+	return t.conn.WriteJSON(v)
+}
+
+// ReadFrame returns the next ack published by the robot; other operations
+// (the robot's own advertise and subscribe, status messages) are ignored
+func (t *rosbridgeTransport) ReadFrame() ([]byte, error) {
+	for {
+		msgType, data, err := t.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		t.conn.SetReadDeadline(time.Now().Add(config.ReadTimeout))
+		if msgType != websocket.TextMessage {
+			continue
+		}
+		var op rosbridgeMsg
+		if err := json.Unmarshal(data, &op); err != nil {
+			slog.Warn("rosbridge: bad message", "remote", t.RemoteAddr(), "err", err)
+			continue
+		}
+		if op.Op != "publish" || op.Topic != config.RosbridgeAckTopic {
+			continue
+		}
+		var ack rosAck
+		if err := json.Unmarshal(op.Msg, &ack); err != nil {
+			slog.Warn("rosbridge: bad ack", "remote", t.RemoteAddr(), "msg_type", "ack", "err", err)
+			continue
+		}
+		return t.encodeAck(ack), nil
+	}
+}
+
+// encodeAck builds a 69-byte python ack, taking t1-t3 from the last twist
+// when it is the one acked
+func (t *rosbridgeTransport) encodeAck(ack rosAck) []byte {
+	now := currentTimeMs()
+	frame := make([]byte, protocol.AckFromPythonSize)
+	frame[0] = protocol.MsgTypeTwistAck
+
+	t.mu.Lock()
+	lastID := binary.LittleEndian.Uint64(t.last[1:9])
+	if ack.MessageID == nil || *ack.MessageID == lastID {
+		copy(frame[1:9], t.last[1:9])     // message ID
+		copy(frame[9:17], t.last[9:17])   // t1
+		copy(frame[17:33], t.last[65:81]) // t2, t3
+	} else {
+		binary.LittleEndian.PutUint64(frame[1:9], *ack.MessageID)
+	}
+	t.mu.Unlock()
+
+	if ack.T3PythonRx == 0 {
+		ack.T3PythonRx = now
+	}
+	if ack.T4Ack == 0 {
+		ack.T4Ack = now
+	}
+	binary.LittleEndian.PutUint64(frame[33:41], ack.T3PythonRx)
+	binary.LittleEndian.PutUint64(frame[41:49], ack.T4Ack)
+	binary.LittleEndian.PutUint32(frame[49:53], ack.DecodeUs)
+	binary.LittleEndian.PutUint32(frame[53:57], ack.ProcessUs)
+	binary.LittleEndian.PutUint32(frame[57:61], ack.EncodeUs)
+	return frame
+}
+
+// WriteFrame publishes twists and e-stop engages on the command topic.
+// The peer never negotiates, so frames arrive without CRCs and trailer
+// is always empty.
+func (t *rosbridgeTransport) WriteFrame(msg, trailer []byte) error {
+	var twist rosTwist
+	switch {
+	case len(msg) >= protocol.TwistToPythonSize && msg[0] == protocol.MsgTypeTwist:
+		t.mu.Lock()
+		copy(t.last[:], msg)
+		t.mu.Unlock()
+		v := func(i int) float64 {
+			return math.Float64frombits(binary.LittleEndian.Uint64(msg[17+8*i:]))
+		}
+		twist.Linear = rosVector3{v(0), v(1), v(2)}
+		twist.Angular = rosVector3{v(3), v(4), v(5)}
+	case len(msg) >= protocol.EStopSize && msg[0] == protocol.MsgTypeEStop && msg[1] == EStopEngage:
+		// zero twist
+	default:
+		return nil
+	}
+
+	body, err := json.Marshal(twist)
+	if err != nil {
+		return err
+	}
+	return t.writeJSON(rosbridgeMsg{Op: "publish", Topic: config.RosbridgeCmdTopic, Msg: body})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// pingRTTAlpha weights the newest sample in the EWMA: about the last ten
+// pongs count
+const pingRTTAlpha = 0.2
+
+// PingRTT tracks the round trips of a peer's WebSocket pings, each of
+// which carries its send time, as "ping_rtt" in /status. Pongs are
+// answered by the client's WebSocket stack, not its application, so a
+// high RTT here points at the network while a normal one next to slow
+// acks points at the peer itself.
+type PingRTT struct {
+	mu      sync.Mutex
+	last    time.Duration
+	ewma    float64 // ns
+	min     time.Duration
+	max     time.Duration
+	samples uint64
+}
+
+// PingRTTSnapshot is a peer's ping statistics in ms
+type PingRTTSnapshot struct {
+	LastMs  float64 `json:"last_ms"`
+	EWMAMs  float64 `json:"ewma_ms"`
+	MinMs   float64 `json:"min_ms"`
+	MaxMs   float64 `json:"max_ms"`
+	Samples uint64  `json:"samples"`
+}
+
+func (r *PingRTT) add(rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.samples == 0 {
+		r.ewma, r.min, r.max = float64(rtt), rtt, rtt
+	} else {
+		r.ewma += pingRTTAlpha * (float64(rtt) - r.ewma)
+		r.min, r.max = min(r.min, rtt), max(r.max, rtt)
+	}
+	r.last = rtt
+	r.samples++
+}
+
+func (r *PingRTT) snapshot() PingRTTSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return PingRTTSnapshot{
+		LastMs:  ms(r.last),
+		EWMAMs:  r.ewma / float64(time.Millisecond),
+		MinMs:   ms(r.min),
+		MaxMs:   ms(r.max),
+		Samples: r.samples,
+	}
+}
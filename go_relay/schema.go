@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go_relay/protocol"
+)
+
+// featureNames label the Hello/Welcome feature bits in /protocol
+var featureNames = map[string]uint32{
+	"robot_trailer":    FeatureRobotTrailer,
+	"relay_timestamps": FeatureRelayTimestamps,
+	"crc32":            FeatureCRC32,
+	"hops":             FeatureHops,
+	"trace_context":    FeatureTraceContext,
+	"session":          FeatureSession,
+	"cbor":             FeatureCBOR,
+	"protobuf":         FeatureProtobuf,
+	"batch":            FeatureBatch,
+	"relay_seq":        FeatureRelaySeq,
+}
+
+// BlockSchema describes what may follow a message's layout, in the
+// order blocks appear
+type BlockSchema struct {
+	Name    string   `json:"name"`
+	Feature string   `json:"feature,omitempty"` // the feature bit that enables it
+	Size    int      `json:"size"`              // bytes, 0 if variable
+	Types   []string `json:"types,omitempty"`   // message types carrying it; every type after the Welcome if empty
+}
+
+var protocolBlocks = []BlockSchema{
+	{Name: "robot_trailer", Feature: "robot_trailer", Types: []string{"twist", "ack", "estop", "telemetry", "odometry", "joy"}},
+	{Name: "relay_seq", Feature: "relay_seq", Size: RelaySeqBlockSize, Types: []string{"twist", "ack"}},
+	{Name: "hops", Feature: "hops", Types: []string{"twist", "ack"}},
+	{Name: "trace", Feature: "trace_context", Size: TraceBlockSize, Types: []string{"twist", "ack"}},
+	{Name: "crc32", Feature: "crc32", Size: 4},
+}
+
+// NegotiatedProtocol is what one peer agreed on in its Hello
+type NegotiatedProtocol struct {
+	PeerID   string `json:"peer_id"`
+	Version  byte   `json:"version"`
+	Features uint32 `json:"features"`
+}
+
+// handleProtocol serves GET /protocol, for checking a client in another
+// language against the running relay: every message type's layout from
+// the field lists the CBOR and protobuf profiles use (with the layout the
+// relay forwards, where it appends timestamps), the blocks that may follow
+// it and the feature bits, and with ?peer=<id> what that peer negotiated
+// (404 if unknown)
+func handleProtocol(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]interface{}{
+		"version":     ProtocolVersion,
+		"subprotocol": protocol.Subprotocol,
+		"byte_order":  "little-endian",
+		"features":    featureNames,
+		"messages":    protocol.Schema(),
+		"blocks":      protocolBlocks,
+	}
+	if id := r.URL.Query().Get("peer"); id != "" {
+		p := manager.getPeer(id)
+		if p == nil {
+			http.Error(w, "no such peer", http.StatusNotFound)
+			return
+		}
+		codec := p.codec()
+		resp["negotiated"] = NegotiatedProtocol{PeerID: p.ID, Version: codec.Version, Features: codec.Features}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// What enqueue does with a frame for a peer whose send queue is full
+const (
+	OverflowDropNewest = "drop-newest" // drop the new frame
+	OverflowDropOldest = "drop-oldest" // drop the longest-queued frame to make room
+	OverflowBlock      = "block"       // wait up to send_block_timeout, then drop the new frame; python queues only
+	OverflowDisconnect = "disconnect"  // drop the new frame and close the peer
+)
+
+// peerTypes are the types send_queues may configure
+var peerTypes = []string{"web", "observer", "python", "relay"}
+
+func knownPeerType(t string) bool {
+	for _, pt := range peerTypes {
+		if t == pt {
+			return true
+		}
+	}
+	return false
+}
+
+// SendQueue sizes one peer type's send queue and picks its overflow
+// policy. Zero values fall back to send_buffer and send_overflow.
+type SendQueue struct {
+	Size     int    `yaml:"size"`
+	Overflow string `yaml:"overflow"`
+}
+
+func (q SendQueue) validate() error {
+	if q.Size < 0 {
+		return errors.New("size must not be negative")
+	}
+	switch q.Overflow {
+	case "", OverflowDropNewest, OverflowDropOldest, OverflowBlock, OverflowDisconnect:
+		return nil
+	}
+	return fmt.Errorf("unknown overflow policy %q (drop-newest, drop-oldest, block or disconnect)", q.Overflow)
+}
+
+// sendQueueFor returns the queue settings for peers of peerType
+func (c *Config) sendQueueFor(peerType string) SendQueue {
+	q := c.SendQueues[peerType]
+	if q.Size == 0 {
+		q.Size = c.SendBuffer
+	}
+	if q.Overflow == "" {
+		q.Overflow = c.SendOverflow
+	}
+	return q
+}
+
+// validSendQueues checks send_queues' peer types and settings. Block
+// waits on the sender's goroutine, so only robot queues may use it: the
+// browsers writing to a robot wait on that robot alone, while browser,
+// observer and relay queues are fed by robot readers fanning out, which
+// one slow client would stall for everybody.
+func (c *Config) validSendQueues() error {
+	for t, q := range c.SendQueues {
+		if !knownPeerType(t) {
+			return fmt.Errorf("send_queues: unknown peer type %q", t)
+		}
+		if err := q.validate(); err != nil {
+			return fmt.Errorf("send_queues[%s]: %w", t, err)
+		}
+	}
+	for _, t := range peerTypes {
+		if t != "python" && c.sendQueueFor(t).Overflow == OverflowBlock {
+			return fmt.Errorf("send_queues[%s]: block is only allowed for python peers, whose senders wait on that robot alone", t)
+		}
+	}
+	return nil
+}
+
+// overflow handles f for a full queue by the peer's policy, reporting
+// whether f was queued after all
+func (p *Peer) overflow(queue chan *Frame, f *Frame) bool {
+	switch p.overflowPolicy {
+	case OverflowDropOldest:
+		select {
+		case old := <-queue:
+			old.release()
+			p.countDrop()
+		default:
+		}
+		select {
+		case queue <- f:
+			return true
+		default: // refilled meanwhile
+		}
+
+	case OverflowBlock:
+		timer := time.NewTimer(config.SendBlockTimeout)
+		defer timer.Stop()
+		select {
+		case queue <- f:
+			return true
+		case <-timer.C:
+		case <-p.quit:
+		}
+
+	case OverflowDisconnect:
+		select {
+		case <-p.quit: // already closing
+		default:
+			metricOverflowDisconnects.WithLabelValues(p.Type).Inc()
+			p.logger().Warn("Send queue full, disconnecting peer", "queued", len(queue))
+			p.close(websocket.CloseTryAgainLater, "send queue full")
+		}
+	}
+	f.release()
+	p.countDrop()
+	return false
+}
+
+// countDrop records a frame lost to a full send queue
+func (p *Peer) countDrop() {
+	metricDropped.WithLabelValues(p.Type, p.overflowPolicy).Inc()
+	sendDropped.Add(1)
+	p.drops.Add(1)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"go_relay/protocol"
+)
+
+// seqWindow is how far behind the newest ID a late twist can still be
+// told apart from a duplicate
+const seqWindow = 64
+
+// SequenceTracker checks the message IDs of one peer's twists for
+// continuity. IDs are expected to increase by one per twist, and Joy
+// frames share the sequence; the counts go under "sequence" in /status.
+type SequenceTracker struct {
+	mu        sync.Mutex
+	started   bool
+	first     uint64 // IDs before it were never expected
+	last      uint64
+	seen      uint64 // bit i set: ID last-i arrived
+	received  uint64
+	gaps      uint64
+	lost      uint64
+	reordered uint64
+	duplicate uint64
+}
+
+// SequenceStats is a snapshot of a tracker, served in /status
+type SequenceStats struct {
+	Received   uint64  `json:"received"`
+	Gaps       uint64  `json:"gaps"`
+	Lost       uint64  `json:"lost"`
+	Reordered  uint64  `json:"reordered"`
+	Duplicates uint64  `json:"duplicates"`
+	LossRatio  float64 `json:"loss_ratio"`
+}
+
+// observe records id and returns the missing range [from, to] if it
+// skipped ahead, or gap=false otherwise, and whether id arrived before
+// within the window. A late twist that fills part of a recent gap is
+// counted as reordered and no longer as lost; one older than the first ID
+// seen filled no gap and is ignored.
+func (s *SequenceTracker) observe(id uint64) (from, to uint64, gap, dup bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.received++
+	switch {
+	case !s.started:
+		s.started = true
+		s.first, s.last, s.seen = id, id, 1
+	case id < s.first:
+	case id > s.last:
+		if id > s.last+1 {
+			from, to, gap = s.last+1, id-1, true
+			s.gaps++
+			s.lost += id - s.last - 1
+		}
+		if shift := id - s.last; shift < seqWindow {
+			s.seen = s.seen<<shift | 1
+		} else {
+			s.seen = 1
+		}
+		s.last = id
+	case s.last-id >= seqWindow:
+		s.reordered++ // too old to tell; leave the loss count alone
+	case s.seen&(1<<(s.last-id)) != 0:
+		s.duplicate++
+		dup = true
+	default:
+		s.seen |= 1 << (s.last - id)
+		s.reordered++
+		if s.lost > 0 {
+			s.lost--
+		}
+	}
+	return
+}
+
+func (s *SequenceTracker) snapshot() SequenceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := SequenceStats{
+		Received:   s.received,
+		Gaps:       s.gaps,
+		Lost:       s.lost,
+		Reordered:  s.reordered,
+		Duplicates: s.duplicate,
+	}
+	if total := s.received + s.lost; total > 0 {
+		st.LossRatio = float64(s.lost) / float64(total)
+	}
+	return st
+}
+
+// restore copies from's state into s, so a resumed session's twists
+// continue its previous connection's sequence
+func (s *SequenceTracker) restore(from *SequenceTracker) {
+	from.mu.Lock()
+	started, first, last, seen := from.started, from.first, from.last, from.seen
+	received, gaps, lost := from.received, from.gaps, from.lost
+	reordered, duplicate := from.reordered, from.duplicate
+	from.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started, s.first, s.last, s.seen = started, first, last, seen
+	s.received, s.gaps, s.lost = received, gaps, lost
+	s.reordered, s.duplicate = reordered, duplicate
+}
+
+// checkSequence tracks a twist's or Joy frame's message ID and, with
+// -loss-reports, tells the sender which IDs never arrived. It reports
+// whether the frame repeats one of the sender's last seqWindow IDs and,
+// with -dedup, must be dropped: a browser retrying a send after a hiccup
+// would otherwise have the robot execute the command twice. A resumed
+// session keeps its window; frames further behind it are forwarded as
+// reordered and left to -max-command-age.
+func checkSequence(peer *Peer, msgID uint64, msgType string) (duplicate bool) {
+	from, to, gap, dup := peer.seq.observe(msgID)
+	if dup && config.Dedup {
+		metricDuplicatesDropped.WithLabelValues(msgType).Inc()
+		peer.logger().Debug("Duplicate dropped", "msg_type", msgType, "msg_id", msgID)
+		return true
+	}
+	if !gap {
+		return false
+	}
+	peer.logger().Warn("Twists missing", "msg_type", msgType, "first_msg_id", from, "last_msg_id", to)
+	if !config.LossReports {
+		return false
+	}
+	report := make([]byte, protocol.LossReportSize)
+	report[0] = protocol.MsgTypeLossReport
+	binary.LittleEndian.PutUint64(report[1:9], from)
+	binary.LittleEndian.PutUint64(report[9:17], to)
+	peer.send(report)
+	return false
+}
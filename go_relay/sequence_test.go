@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestSequenceTracker(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []uint64
+		want SequenceStats
+	}{
+		{"in order", []uint64{1, 2, 3}, SequenceStats{Received: 3}},
+		{"gap", []uint64{1, 2, 5}, SequenceStats{Received: 3, Gaps: 1, Lost: 2}},
+		{"gap filled late", []uint64{1, 4, 2, 3}, SequenceStats{Received: 4, Gaps: 1, Reordered: 2}},
+		{"duplicate", []uint64{1, 2, 2}, SequenceStats{Received: 3, Duplicates: 1}},
+		{"older than the first", []uint64{10, 11, 5}, SequenceStats{Received: 3}},
+		{"older than the first after a gap", []uint64{10, 13, 9, 8}, SequenceStats{Received: 4, Gaps: 1, Lost: 2}},
+		{"beyond the window", []uint64{100, 200, 101}, SequenceStats{Received: 3, Gaps: 1, Lost: 99, Reordered: 1}},
+		{"jump past the window filled late", []uint64{1, 100, 99}, SequenceStats{Received: 3, Gaps: 1, Lost: 97, Reordered: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s SequenceTracker
+			for _, id := range tt.ids {
+				s.observe(id)
+			}
+			got := s.snapshot()
+			got.LossRatio = 0
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSequenceTrackerReportsGap(t *testing.T) {
+	var s SequenceTracker
+	s.observe(1)
+	from, to, gap, dup := s.observe(4)
+	if !gap || dup || from != 2 || to != 3 {
+		t.Fatalf("got [%d, %d] gap=%v dup=%v, want [2, 3] gap", from, to, gap, dup)
+	}
+	if _, _, _, dup := s.observe(4); !dup {
+		t.Fatal("repeated ID not reported as duplicate")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// Service calls are generic RPCs from a browser to the robot it watches:
+// a named service, a payload the service defines, and one Service
+// Response back. As with reliable commands, the relay renumbers calls
+// towards the robot so IDs stay unique across browsers and maps the
+// response back to the browser that called. Each call carries its own
+// timeout (0 for -service-timeout, capped at -service-max-timeout), which
+// the robot gets too; after it the relay answers timeout for the robot and
+// drops its late response. Observers' calls are answered forbidden.
+
+// maxRobotCalls bounds a robot's pending service calls
+const maxRobotCalls = 256
+
+// ServiceCalls holds the calls awaiting a robot's response
+type ServiceCalls struct {
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*pendingCall // by relay ID
+}
+
+type pendingCall struct {
+	robotID string
+	source  string
+	callID  uint64 // the browser's
+	service string
+	started time.Time
+	timer   *time.Timer
+}
+
+var services = &ServiceCalls{pending: make(map[uint64]*pendingCall)}
+
+// serviceStatusName labels a Service Response status; robot-defined ones
+// are "error"
+func serviceStatusName(status byte) string {
+	switch status {
+	case protocol.ServiceOK:
+		return "ok"
+	case protocol.ServiceUnknown:
+		return "unknown"
+	case protocol.ServiceFailed:
+		return "failed"
+	case protocol.ServiceTimeout:
+		return "timeout"
+	case protocol.ServiceNoRobot:
+		return "no_robot"
+	case protocol.ServiceBusy:
+		return "busy"
+	case protocol.ServiceForbidden:
+		return "forbidden"
+	default:
+		return "error"
+	}
+}
+
+// callTimeout is how long the relay waits on a call asking for ms; 0 asks
+// for config.ServiceTimeout, and no call waits past config.ServiceMaxTimeout
+func callTimeout(ms uint32) time.Duration {
+	d := time.Duration(ms) * time.Millisecond
+	if ms == 0 {
+		d = config.ServiceTimeout
+	}
+	return min(d, config.ServiceMaxTimeout)
+}
+
+// handleServiceCall forwards a browser's call to its robot, with the
+// timeout the relay applies
+func handleServiceCall(peer *Peer, data []byte) {
+	if !peer.watchesRobot() {
+		return
+	}
+	call, err := protocol.UnmarshalServiceCall(data)
+	if err != nil {
+		code, expected := serviceCallReject(data, err)
+		rejectFrame(peer, data, code, expected)
+		return
+	}
+	if peer.Type == "observer" {
+		replyService(peer, call.CallID, protocol.ServiceForbidden, call.Service)
+		return
+	}
+	robotID := manager.robotFor(peer)
+	python := manager.getPython(robotID)
+	if python == nil || python.Type != "python" {
+		replyService(peer, call.CallID, protocol.ServiceNoRobot, call.Service)
+		return
+	}
+	timeout := callTimeout(call.TimeoutMs)
+
+	services.mu.Lock()
+	n := 0
+	for _, c := range services.pending {
+		if c.robotID == robotID {
+			n++
+		}
+	}
+	if n >= maxRobotCalls {
+		services.mu.Unlock()
+		replyService(peer, call.CallID, protocol.ServiceBusy, call.Service)
+		return
+	}
+	services.nextID++
+	id := services.nextID
+	c := &pendingCall{robotID: robotID, source: peer.ID, callID: call.CallID, service: call.Service, started: time.Now()}
+	c.timer = time.AfterFunc(timeout, func() { services.expire(id) })
+	services.pending[id] = c
+	services.mu.Unlock()
+
+	frame := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint64(frame[1:9], id)
+	binary.LittleEndian.PutUint32(frame[9:13], uint32(timeout.Milliseconds()))
+	python.send(frame)
+	peer.logger().Debug("Service call sent", "msg_type", "service_call", "robot_id", robotID,
+		"service", call.Service, "call_id", call.CallID, "relay_call_id", id, "timeout", timeout)
+}
+
+// serviceCallReject returns the Protocol Error code and expected size for
+// a Service Call that failed to decode with err
+func serviceCallReject(data []byte, err error) (code byte, expected int) {
+	switch {
+	case errors.Is(err, protocol.ErrTrailing):
+		return ProtoErrTooLong, len(data)
+	case len(data) < protocol.ServiceCallMinSize:
+		return ProtoErrTooShort, protocol.ServiceCallMinSize
+	default:
+		return ProtoErrTooShort, protocol.ServiceCallMinSize + int(data[13])
+	}
+}
+
+// handleServiceResponse passes the robot's response to the browser that
+// called, under the browser's call ID. Responses after the timeout are
+// dropped.
+func handleServiceResponse(peer *Peer, data []byte) {
+	if !peer.isRobot() {
+		return
+	}
+	if len(data) < protocol.ServiceRespMinSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.ServiceRespMinSize)
+		return
+	}
+	id := binary.LittleEndian.Uint64(data[1:9])
+	services.mu.Lock()
+	c := services.pending[id]
+	if c == nil || c.robotID != peer.RobotID {
+		services.mu.Unlock()
+		peer.logger().Debug("Late or unknown service response dropped", "msg_type", "service_response", "relay_call_id", id)
+		return
+	}
+	c.timer.Stop()
+	delete(services.pending, id)
+	services.mu.Unlock()
+
+	status := data[9]
+	metricServiceCalls.WithLabelValues(serviceStatusName(status)).Inc()
+	metricServiceCallDuration.Observe(time.Since(c.started).Seconds())
+	if web := manager.getPeer(c.source); web != nil && web.watchesRobot() {
+		frame := append([]byte(nil), data...)
+		binary.LittleEndian.PutUint64(frame[1:9], c.callID)
+		web.send(frame)
+	}
+}
+
+// expire answers a call the robot left unanswered past its timeout
+func (sc *ServiceCalls) expire(id uint64) {
+	sc.mu.Lock()
+	c := sc.pending[id]
+	delete(sc.pending, id)
+	sc.mu.Unlock()
+	if c == nil {
+		return
+	}
+	if web := manager.getPeer(c.source); web != nil {
+		replyService(web, c.callID, protocol.ServiceTimeout, c.service)
+	} else {
+		metricServiceCalls.WithLabelValues("timeout").Inc()
+	}
+}
+
+// replyService answers a browser's call on the robot's behalf
+func replyService(peer *Peer, callID uint64, status byte, service string) {
+	metricServiceCalls.WithLabelValues(serviceStatusName(status)).Inc()
+	frame, err := protocol.ServiceResponse{CallID: callID, Status: status, Service: service}.Marshal()
+	if err == nil {
+		peer.send(frame)
+	}
+}
+
+// snapshot counts pending calls per robot
+func (sc *ServiceCalls) snapshot() map[string]int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	out := make(map[string]int)
+	for _, c := range sc.pending {
+		out[c.robotID]++
+	}
+	return out
+}
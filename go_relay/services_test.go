@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go_relay/protocol"
+)
+
+func TestServiceCallReject(t *testing.T) {
+	frame, _ := protocol.ServiceCall{CallID: 1, Service: "/dock", Payload: []byte{1}}.Marshal()
+	tests := []struct {
+		name     string
+		data     []byte
+		err      error // nil: decode data
+		code     byte
+		expected int
+	}{
+		{"header cut", frame[:5], nil, ProtoErrTooShort, protocol.ServiceCallMinSize},
+		{"name cut", frame[:protocol.ServiceCallMinSize+2], nil, ProtoErrTooShort, protocol.ServiceCallMinSize + 5},
+		{"trailing", frame, fmt.Errorf("%w: payload too long", protocol.ErrTrailing), ProtoErrTooLong, len(frame)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.err
+			if err == nil {
+				if _, err = protocol.UnmarshalServiceCall(tt.data); err == nil {
+					t.Fatal("frame decoded")
+				}
+			}
+			code, expected := serviceCallReject(tt.data, err)
+			if code != tt.code || expected != tt.expected {
+				t.Fatalf("got code %d expected %d, want code %d expected %d", code, expected, tt.code, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	saved := config
+	config.ServiceTimeout, config.ServiceMaxTimeout = 5*time.Second, 30*time.Second
+	t.Cleanup(func() { config = saved })
+	tests := []struct {
+		ms   uint32
+		want time.Duration
+	}{
+		{0, 5 * time.Second},
+		{250, 250 * time.Millisecond},
+		{60000, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := callTimeout(tt.ms); got != tt.want {
+			t.Errorf("callTimeout(%d) = %v, want %v", tt.ms, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxShapeStep caps the time one forwarded twist may account for, so a
+// twist after a pause can't jump straight to the browser's target
+const maxShapeStep = 250 * time.Millisecond
+
+// Shaper rate-limits velocity changes between the twists forwarded to a
+// robot: each component moves towards the browser's value by at most the
+// robot's acceleration limit times the time since the previous twist, and
+// with a jerk limit the acceleration itself ramps too. Deadman stops are
+// never shaped; they reset the robot to rest.
+type Shaper struct {
+	mu     sync.Mutex
+	robots map[string]*shapeState
+}
+
+type shapeState struct {
+	vel   [6]float64
+	accel [6]float64
+	at    time.Time // when the previous twist was forwarded
+}
+
+var shaper = &Shaper{robots: make(map[string]*shapeState)}
+
+// shapeTwist shapes the velocities of a relay twist in place to robotID's
+// acceleration and jerk limits and reports whether anything changed
+func shapeTwist(robotID string, data []byte, msgID uint64) bool {
+	limit := config.limitFor(robotID)
+	if !limit.shapes() {
+		return false
+	}
+	var target [6]float64
+	for i := range target {
+		target[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[twistLinearOffset+8*i:]))
+	}
+	now := time.Now()
+
+	shaper.mu.Lock()
+	s := shaper.robots[robotID]
+	if s == nil || msgID == DeadmanMsgID {
+		// Robots start at rest, and stop without ramping
+		s = &shapeState{at: now}
+		shaper.robots[robotID] = s
+		if msgID == DeadmanMsgID {
+			shaper.mu.Unlock()
+			return false
+		}
+	}
+	dt := min(now.Sub(s.at), maxShapeStep).Seconds()
+	s.at = now
+	shaped := false
+	for i, v := range target {
+		accel, jerk := limit.LinearAccel, limit.LinearJerk
+		if i >= 3 {
+			accel, jerk = limit.AngularAccel, limit.AngularJerk
+		}
+		out, a := shapeComponent(s.vel[i], s.accel[i], v, dt, accel, jerk)
+		s.vel[i], s.accel[i] = out, a
+		if out != v {
+			binary.LittleEndian.PutUint64(data[twistLinearOffset+8*i:], math.Float64bits(out))
+			shaped = true
+		}
+	}
+	shaper.mu.Unlock()
+
+	if shaped {
+		metricTwistsShaped.WithLabelValues(robotID).Inc()
+		slog.Debug("Twist shaped", "msg_type", "twist", "msg_id", msgID, "robot_id", robotID)
+	}
+	return shaped
+}
+
+// shapeComponent moves velocity v with acceleration a towards target over
+// dt seconds. With a jerk limit the acceleration changes by at most
+// jerk*dt and is kept low enough to come to rest at the target rather than
+// overshoot it. Zero limits leave that stage out.
+func shapeComponent(v, a, target, dt, accel, jerk float64) (float64, float64) {
+	if dt <= 0 {
+		return v, a
+	}
+	want := (target - v) / dt
+	if jerk > 0 {
+		brake := math.Sqrt(2 * jerk * math.Abs(target-v))
+		want = math.Max(-brake, math.Min(brake, want))
+		want = math.Max(a-jerk*dt, math.Min(a+jerk*dt, want))
+	}
+	if accel > 0 {
+		want = math.Max(-accel, math.Min(accel, want))
+	}
+	next := v + want*dt
+	if (target-v)*(target-next) <= 0 {
+		// Reached or crossed the target: settle on it
+		return target, (target - v) / dt
+	}
+	return next, want
+}
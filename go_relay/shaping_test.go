@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestShapeComponent(t *testing.T) {
+	tests := []struct {
+		name             string
+		v, a, target, dt float64
+		accel, jerk      float64
+		wantV, wantA     float64
+	}{
+		{"no limits jump to the target", 0, 0, 1, 0.1, 0, 0, 1, 10},
+		{"acceleration limit", 0, 0, 1, 0.1, 2, 0, 0.2, 2},
+		{"deceleration limit", 1, 0, 0, 0.1, 2, 0, 0.8, -2},
+		{"settles on a close target", 0.9, 2, 1, 0.1, 2, 0, 1, 1},
+		{"jerk ramps acceleration", 0, 0, 1, 0.1, 0, 10, 0.1, 1},
+		{"no time passed", 0.3, 1, 1, 0, 2, 10, 0.3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, a := shapeComponent(tt.v, tt.a, tt.target, tt.dt, tt.accel, tt.jerk)
+			if math.Abs(v-tt.wantV) > 1e-9 || math.Abs(a-tt.wantA) > 1e-9 {
+				t.Errorf("got v=%g a=%g, want v=%g a=%g", v, a, tt.wantV, tt.wantA)
+			}
+		})
+	}
+}
+
+// A jerk-limited ramp reaches its target without overshooting it or
+// breaking either limit on the way
+func TestShapeComponentRamp(t *testing.T) {
+	const dt, accel, jerk, target = 0.02, 1.5, 6.0, 1.0
+	v, a := 0.0, 0.0
+	for step := range 500 {
+		nv, na := shapeComponent(v, a, target, dt, accel, jerk)
+		if nv > target {
+			t.Fatalf("step %d: overshot to %g", step, nv)
+		}
+		if nv != target && (math.Abs(na) > accel+1e-9 || math.Abs(na-a) > jerk*dt+1e-9) {
+			t.Fatalf("step %d: acceleration %g after %g breaks the limits", step, na, a)
+		}
+		if v, a = nv, na; v == target {
+			return
+		}
+	}
+	t.Fatalf("still at %g after 10s", v)
+}
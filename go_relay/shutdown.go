@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// draining is set once shutdown starts; new upgrades are refused
+	draining atomic.Bool
+
+	// activeConns counts upgraded connections still being served
+	activeConns sync.WaitGroup
+)
+
+// close asks the peer's writer to flush queued messages and send a close
+// frame with the given code and reason. Safe to call more than once.
+func (p *Peer) close(code int, reason string) {
+	p.closeOnce.Do(func() {
+		p.closeCode, p.closeReason = code, reason
+		close(p.quit)
+	})
+}
+
+// flushAndClose drains whatever is queued for the peer, e-stops first and
+// twists next, then says goodbye
+func flushAndClose(peer *Peer) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	write := func(f *Frame) bool {
+		err := writeFrameLocked(peer, f)
+		f.release()
+		return err == nil
+	}
+	drain := func(queue chan *Frame) bool {
+		for {
+			select {
+			case msg := <-queue:
+				if !write(msg) {
+					return false
+				}
+			default:
+				return true
+			}
+		}
+	}
+
+	if !drain(peer.urgent) {
+		return
+	}
+	if robotID := manager.robotFor(peer); !estops.engaged(robotID) {
+		for msg := peer.twists.pop(); msg != nil; msg = peer.twists.pop() {
+			if dropStale(robotID, msg) {
+				continue
+			}
+			if !write(msg) {
+				return
+			}
+		}
+	}
+	if !drain(peer.SendChan) {
+		return
+	}
+	peer.Conn.Shutdown(peer.closeCode, peer.closeReason)
+}
+
+// allPeers returns every connected peer
+func (m *PeerManager) allPeers() []*Peer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	peers := make([]*Peer, 0, len(m.peers))
+	for _, p := range m.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// shutdown stops the listener, stops any moving robot, asks every peer to
+// close, and waits up to timeout for them to go before cutting them off.
+func shutdown(srv *http.Server, timeout time.Duration) {
+	draining.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Hijacked WebSocket connections are not tracked by Shutdown; it only
+	// closes the listener and idle HTTP connections here. /events streams
+	// are ended first so it need not wait for them.
+	events.close()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("HTTP shutdown", "err", err)
+	}
+
+	deadman.tripAll("relay shutting down")
+
+	peers := manager.allPeers()
+	slog.Info("Closing peers", "peers", len(peers))
+	for _, p := range peers {
+		p.close(websocket.CloseGoingAway, "relay shutting down")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		activeConns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("All peers closed")
+	case <-ctx.Done():
+		remaining := manager.allPeers()
+		slog.Warn("Drain timeout, dropping peers", "peers", len(remaining))
+		for _, p := range remaining {
+			p.Conn.Close()
+		}
+	}
+	if wtServer != nil {
+		wtServer.Close()
+	}
+	if udpListener != nil {
+		udpListener.close()
+	}
+	if tcpListener != nil {
+		tcpListener.close()
+	}
+	if unixListener != nil {
+		unixListener.close()
+	}
+	if grpcServer != nil {
+		grpcServer.Stop()
+	}
+	federation.close()
+	if debugServer != nil {
+		debugServer.Close()
+	}
+	if mqttBridge != nil {
+		mqttBridge.close()
+	}
+	if zenohBridge != nil {
+		zenohBridge.close()
+	}
+	if ros2Robot != nil {
+		ros2Robot.close()
+	}
+
+	flush, cancelFlush := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelFlush()
+	shutdownTracing(flush)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+)
+
+// WebRTC signaling messages, JSON text over /ws/data. The relay reads
+// only "type" and "to" and stamps "from" with the sender's peer ID; the
+// SDP and candidates pass through untouched.
+const (
+	SignalOffer  = "webrtc_offer"
+	SignalAnswer = "webrtc_answer"
+	SignalICE    = "webrtc_ice"
+	SignalHangup = "webrtc_hangup"
+	SignalError  = "webrtc_error" // relay → sender, when there is no one to deliver to
+
+	// maxSignalSize bounds a signaling message; SDP offers are a few KB
+	maxSignalSize = 64 << 10
+)
+
+// textTransport is implemented by transports that also carry text
+// messages; only their peers can take part in signaling
+type textTransport interface {
+	WriteText(msg []byte) error
+}
+
+// sendText queues a text message like send queues a binary one
+func (p *Peer) sendText(msg []byte) bool {
+	f := wrapFrame(msg)
+	f.text = true
+	return p.enqueue(p.SendChan, f)
+}
+
+// canSignal reports whether the peer can receive signaling messages
+func (p *Peer) canSignal() bool {
+	_, ok := p.Conn.(textTransport)
+	return ok
+}
+
+// getWebPeer returns the web or observer peer peerID if it addresses
+// robotID, or nil
+func (m *PeerManager) getWebPeer(peerID, robotID string) *Peer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if p, ok := m.webPeers[peerID]; ok && p.RobotID == robotID {
+		return p
+	}
+	return nil
+}
+
+// handleSignal routes a signaling message from a web or observer peer to
+// its robot's Python peer, and from the Python peer to the web peer named
+// in "to"
+func handleSignal(peer *Peer, data []byte) {
+	metricMessages.WithLabelValues("signal").Inc()
+	observeMessage("in", "signal", len(data))
+	if len(data) > maxSignalSize {
+		peer.logger().Warn("Invalid message size", "msg_type", "signal", "size", len(data))
+		return
+	}
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		peer.logger().Warn("Invalid signaling message", "err", err)
+		return
+	}
+	var typ, to string
+	json.Unmarshal(msg["type"], &typ)
+	json.Unmarshal(msg["to"], &to)
+	switch typ {
+	case SignalOffer, SignalAnswer, SignalICE, SignalHangup:
+	default:
+		peer.logger().Warn("Unknown signaling message", "type", typ)
+		return
+	}
+
+	robotID := manager.robotFor(peer)
+	var dest *Peer
+	switch {
+	case peer.watchesRobot():
+		if python := manager.getPython(robotID); python != nil && python.Type == "python" {
+			dest = python
+		}
+		peer.signaled.Store(true)
+	case peer.Type == "python":
+		dest = manager.getWebPeer(to, robotID)
+	}
+	if dest == nil || !dest.canSignal() {
+		sendSignalError(peer, typ, to, "no peer to signal")
+		return
+	}
+
+	msg["from"], _ = json.Marshal(peer.ID)
+	out, _ := json.Marshal(msg)
+	dest.sendText(out)
+	slog.Debug("Signal relayed", "type", typ, "robot_id", robotID, "from", peer.ID, "to", dest.ID)
+}
+
+func sendSignalError(peer *Peer, typ, to, reason string) {
+	out, _ := json.Marshal(map[string]string{
+		"type":    SignalError,
+		"request": typ,
+		"to":      to,
+		"error":   reason,
+	})
+	peer.sendText(out)
+}
+
+// hangupSignaling tells the robot's Python peer that a web peer which
+// signaled is gone, so it can tear down that peer's connection
+func hangupSignaling(peer *Peer, robotID string) {
+	if !peer.signaled.Load() {
+		return
+	}
+	python := manager.getPython(robotID)
+	if python == nil || python.Type != "python" || !python.canSignal() {
+		return
+	}
+	out, _ := json.Marshal(map[string]string{"type": SignalHangup, "from": peer.ID})
+	python.sendText(out)
+}
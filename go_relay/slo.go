@@ -0,0 +1,200 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// With -latency-slo set, the relay watches each robot's round-trip
+// latency (browser send to ack leaving the relay) over a sliding window.
+// When its p95 exceeds the SLO, the robot's browsers get a Latency Warning
+// so drivers know to slow down, and another once the p95 is back under 90%
+// of the SLO; the margin keeps a p95 hovering at the SLO from flapping.
+// Browsers joining a degraded robot get the warning too.
+
+const (
+	// sloMinSamples is how many acks a window needs before its p95 counts
+	sloMinSamples = 20
+	// sloMaxSamples bounds a window; the oldest samples go first
+	sloMaxSamples = 10000
+	// sloRecover is the fraction of the SLO a degraded robot's p95 must
+	// fall under to recover
+	sloRecover = 0.9
+)
+
+// LatencySLO tracks every robot's recent round trips against config.LatencySLO
+type LatencySLO struct {
+	mu     sync.Mutex
+	robots map[string]*sloWindow
+}
+
+type sloWindow struct {
+	ring     []sloSample // grows to sloMaxSamples, then wraps
+	head     int         // oldest sample
+	n        int
+	degraded bool
+	p95      float64 // ms, as of the last check
+}
+
+type sloSample struct {
+	at  time.Time
+	rtt float64 // ms
+}
+
+// SLOState is one robot's entry in /status
+type SLOState struct {
+	Degraded bool    `json:"degraded"`
+	P95Ms    float64 `json:"p95_ms"`
+	Samples  int     `json:"samples"`
+}
+
+var latencySLO = &LatencySLO{robots: make(map[string]*sloWindow)}
+
+// observe adds an acked twist's round trip to robotID's window
+func (s *LatencySLO) observe(robotID string, rttMs float64) {
+	if config.LatencySLO <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.robots[robotID]
+	if w == nil {
+		w = &sloWindow{}
+		s.robots[robotID] = w
+	}
+	w.push(sloSample{time.Now(), rttMs})
+}
+
+// push appends a sample, overwriting the oldest once the window is full
+func (w *sloWindow) push(sample sloSample) {
+	if w.n == len(w.ring) {
+		if len(w.ring) == sloMaxSamples {
+			w.ring[w.head] = sample
+			w.head = (w.head + 1) % len(w.ring)
+			return
+		}
+		grown := make([]sloSample, min(max(2*len(w.ring), 64), sloMaxSamples))
+		for i := range w.n {
+			grown[i] = w.ring[(w.head+i)%len(w.ring)]
+		}
+		w.ring, w.head = grown, 0
+	}
+	w.ring[(w.head+w.n)%len(w.ring)] = sample
+	w.n++
+}
+
+// check drops samples older than the window as of now and re-evaluates
+// every robot, returning the robots whose state changed. A robot whose
+// window empties is forgotten, recovering first if it was degraded.
+func (s *LatencySLO) check(now time.Time) map[string]protocol.LatencyWarning {
+	cutoff := now.Add(-config.LatencySLOWindow)
+	slo := float64(config.LatencySLO.Milliseconds())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := make(map[string]protocol.LatencyWarning)
+	for robotID, w := range s.robots {
+		for w.n > 0 && w.ring[w.head].at.Before(cutoff) {
+			w.head = (w.head + 1) % len(w.ring)
+			w.n--
+		}
+		if w.n == 0 {
+			if w.degraded {
+				w.degraded = false
+				changed[robotID] = w.warning(slo)
+			}
+			delete(s.robots, robotID)
+			metricSLOP95.DeleteLabelValues(robotID)
+			metricSLODegraded.DeleteLabelValues(robotID)
+			continue
+		}
+		if w.n < sloMinSamples {
+			continue // too few to judge; the state stands
+		}
+		values := make([]float64, w.n)
+		for i := range values {
+			values[i] = w.ring[(w.head+i)%len(w.ring)].rtt
+		}
+		w.p95 = percentiles(values).P95
+		metricSLOP95.WithLabelValues(robotID).Set(w.p95 / 1000)
+		switch {
+		case !w.degraded && w.p95 > slo:
+			w.degraded = true
+			metricSLOViolations.WithLabelValues(robotID).Inc()
+		case w.degraded && w.p95 < slo*sloRecover:
+			w.degraded = false
+		default:
+			continue
+		}
+		degraded := 0.0
+		if w.degraded {
+			degraded = 1
+		}
+		metricSLODegraded.WithLabelValues(robotID).Set(degraded)
+		changed[robotID] = w.warning(slo)
+	}
+	return changed
+}
+
+func (w *sloWindow) warning(slo float64) protocol.LatencyWarning {
+	return protocol.LatencyWarning{
+		Degraded: w.degraded,
+		P95Ms:    uint32(min(math.Max(w.p95, 0), math.MaxUint32)),
+		SLOMs:    uint32(slo),
+		Samples:  uint32(w.n),
+	}
+}
+
+// standing returns robotID's warning if it is degraded, for browsers
+// joining it
+func (s *LatencySLO) standing(robotID string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w := s.robots[robotID]; w != nil && w.degraded {
+		return w.warning(float64(config.LatencySLO.Milliseconds())).Marshal()
+	}
+	return nil
+}
+
+// snapshot returns every watched robot's state
+func (s *LatencySLO) snapshot() map[string]SLOState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]SLOState, len(s.robots))
+	for robotID, w := range s.robots {
+		out[robotID] = SLOState{Degraded: w.degraded, P95Ms: w.p95, Samples: w.n}
+	}
+	return out
+}
+
+// watchLatencySLO checks the SLO every second, warning the browsers of
+// robots that became degraded or recovered
+func watchLatencySLO() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		for robotID, warning := range latencySLO.check(time.Now()) {
+			if warning.Degraded {
+				slog.Warn("Latency SLO exceeded", "robot_id", robotID, "p95_ms", warning.P95Ms,
+					"slo_ms", warning.SLOMs, "samples", warning.Samples)
+			} else {
+				slog.Info("Latency back within SLO", "robot_id", robotID, "p95_ms", warning.P95Ms,
+					"slo_ms", warning.SLOMs)
+			}
+			events.publish("latency_slo", map[string]interface{}{
+				"robot_id": robotID,
+				"degraded": warning.Degraded,
+				"p95_ms":   warning.P95Ms,
+				"slo_ms":   warning.SLOMs,
+			})
+			f := wrapFrame(warning.Marshal())
+			for _, web := range manager.getWebPeers(robotID) {
+				web.sendFrame(f.retain())
+			}
+			f.release()
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func withSLO(t *testing.T, slo, window time.Duration) {
+	t.Helper()
+	saved := config
+	config.LatencySLO, config.LatencySLOWindow = slo, window
+	t.Cleanup(func() { config = saved })
+}
+
+// fill adds count round trips of rtt ms, received at at, to robotID's window
+func (s *LatencySLO) fill(robotID string, at time.Time, rtt float64, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.robots[robotID]
+	if w == nil {
+		w = &sloWindow{}
+		s.robots[robotID] = w
+	}
+	for range count {
+		w.push(sloSample{at, rtt})
+	}
+}
+
+func TestLatencySLOCheck(t *testing.T) {
+	withSLO(t, 100*time.Millisecond, 30*time.Second)
+	start := time.Now()
+	type step struct {
+		rtt      float64
+		count    int
+		at       time.Duration // after start
+		checkAt  time.Duration
+		changed  bool
+		degraded bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"within the SLO", []step{{50, 30, 0, 0, false, false}}},
+		{"too few samples", []step{{500, sloMinSamples - 1, 0, 0, false, false}}},
+		{"exceeded", []step{{150, 30, 0, 0, true, true}}},
+		{"stays degraded inside the margin", []step{
+			{150, 30, 0, 0, true, true},
+			{95, 30, 40 * time.Second, 40 * time.Second, false, true},
+		}},
+		{"recovers under the margin", []step{
+			{150, 30, 0, 0, true, true},
+			{80, 30, 40 * time.Second, 40 * time.Second, true, false},
+		}},
+		{"recovers when the window empties", []step{
+			{150, 30, 0, 0, true, true},
+			{0, 0, 0, 40 * time.Second, true, false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &LatencySLO{robots: make(map[string]*sloWindow)}
+			for i, st := range tt.steps {
+				s.fill("r1", start.Add(st.at), st.rtt, st.count)
+				warning, changed := s.check(start.Add(st.checkAt))["r1"]
+				if changed != st.changed || (changed && warning.Degraded != st.degraded) {
+					t.Fatalf("step %d: changed=%v degraded=%v, want changed=%v degraded=%v",
+						i, changed, warning.Degraded, st.changed, st.degraded)
+				}
+			}
+		})
+	}
+}
+
+func TestLatencySLOForgetsEmptyWindows(t *testing.T) {
+	withSLO(t, 100*time.Millisecond, 30*time.Second)
+	s := &LatencySLO{robots: make(map[string]*sloWindow)}
+	start := time.Now()
+	s.fill("r1", start, 150, 30)
+	s.check(start)
+	if s.standing("r1") == nil {
+		t.Fatal("degraded robot has no standing warning")
+	}
+	s.check(start.Add(time.Minute))
+	if len(s.robots) != 0 || s.standing("r1") != nil {
+		t.Fatalf("robot kept after its window emptied: %+v", s.snapshot())
+	}
+}
+
+func TestSLOWindowRing(t *testing.T) {
+	var w sloWindow
+	start := time.Now()
+	for i := range sloMaxSamples + 10 {
+		w.push(sloSample{start.Add(time.Duration(i) * time.Millisecond), float64(i)})
+	}
+	if w.n != sloMaxSamples || len(w.ring) != sloMaxSamples {
+		t.Fatalf("n=%d len=%d, want %d", w.n, len(w.ring), sloMaxSamples)
+	}
+	if oldest := w.ring[w.head].rtt; oldest != 10 {
+		t.Fatalf("oldest sample %v, want 10", oldest)
+	}
+	if newest := w.ring[(w.head+w.n-1)%len(w.ring)].rtt; newest != sloMaxSamples+9 {
+		t.Fatalf("newest sample %v, want %d", newest, sloMaxSamples+9)
+	}
+}
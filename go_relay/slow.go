@@ -0,0 +1,86 @@
+package main
+
+import (
+	"time"
+)
+
+// CloseSlowConsumer closes peers that stayed too slow to keep up with
+// their frames (application range, mirroring HTTP 408)
+const CloseSlowConsumer = 4408
+
+// slowCloseGrace is how long an evicted peer's close frame gets
+const slowCloseGrace = time.Second
+
+// slowState is the watcher's view of one peer, see watchSlowConsumers
+type slowState struct {
+	since     time.Time // start of the current slow stretch, zero when keeping up
+	writes    uint64    // write count and total at the last check
+	writeTime int64
+}
+
+// writeTimed writes one frame, adding its duration to the peer's write
+// stats; caller holds peer.mu
+func (p *Peer) writeTimed(msg, trailer []byte) error {
+	start := time.Now()
+	err := p.Conn.WriteFrame(msg, trailer)
+	p.writeTime.Add(int64(time.Since(start)))
+	p.writes.Add(1)
+	return err
+}
+
+// avgWrite returns the mean frame write time since the peer connected
+func (p *Peer) avgWrite() time.Duration {
+	n := p.writes.Load()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(p.writeTime.Load() / int64(n))
+}
+
+// lagging reports whether the peer fell behind since the last check:
+// its send queue is at least -slow-queue-fill full, or its frames took
+// longer than -slow-write-latency to write on average
+func (p *Peer) lagging() bool {
+	s := &p.slow
+	writes, writeTime := p.writes.Load(), p.writeTime.Load()
+	avg := time.Duration(0)
+	if n := writes - s.writes; n > 0 {
+		avg = time.Duration((writeTime - s.writeTime) / int64(n))
+	}
+	s.writes, s.writeTime = writes, writeTime
+
+	full := float64(len(p.SendChan)) >= config.SlowQueueFill*float64(cap(p.SendChan))
+	return full || avg > config.SlowWriteLatency
+}
+
+// watchSlowConsumers checks every peer four times per timeout and closes
+// those that lag at every check for longer than timeout with
+// CloseSlowConsumer, without flushing their queue
+func watchSlowConsumers(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, p := range manager.allPeers() {
+			if !p.lagging() {
+				p.slow.since = time.Time{}
+				continue
+			}
+			if p.slow.since.IsZero() {
+				p.slow.since = now
+				p.logger().Debug("Peer falling behind", "queued", len(p.SendChan), "avg_write", p.avgWrite())
+				continue
+			}
+			if now.Sub(p.slow.since) < timeout {
+				continue
+			}
+			metricSlowConsumers.WithLabelValues(p.Type).Inc()
+			p.logger().Warn("Slow consumer evicted", "slow_for", now.Sub(p.slow.since).Round(time.Millisecond),
+				"queued", len(p.SendChan), "avg_write", p.avgWrite())
+			p.slow.since = time.Time{}
+			// The close frame waits behind whatever fills the socket;
+			// the connection goes regardless after slowCloseGrace
+			go p.Conn.Shutdown(CloseSlowConsumer, "slow consumer")
+			time.AfterFunc(slowCloseGrace, func() { p.Conn.Close() })
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"go_relay/protocol"
+)
+
+// staleDropped counts twists and Joy frames dropped for exceeding
+// -max-command-age, stale_dropped in /status
+var staleDropped atomic.Uint64
+
+// commandExpiry returns the relay time (ms) after which a command that
+// source sent at t1 (its clock) and the relay received at t2 is too old
+// to deliver, or 0 when -max-command-age is off. With a clock estimate
+// for the sender the budget runs from t1 mapped onto the relay clock,
+// otherwise (and for twists from an upstream relay) from t2. Commands are
+// checked on arrival and again just before the write; deadman stops
+// never expire.
+func commandExpiry(source string, t1, t2 uint64) uint64 {
+	if config.MaxCommandAge <= 0 {
+		return 0
+	}
+	sent := t2
+	if p := manager.getPeer(source); p != nil {
+		if c := p.clock.snapshot(); c.Samples > 0 {
+			sent = uint64(float64(t1) - c.OffsetMs)
+		}
+	}
+	return sent + uint64(config.MaxCommandAge.Milliseconds())
+}
+
+// stampCommand marks f with its expiry and sender, for dropStale
+func stampCommand(f *Frame, source string, msgID, expires uint64) {
+	f.source, f.msgID, f.expires = source, msgID, expires
+}
+
+// dropStale releases f and reports true if it has outlived its expiry
+func dropStale(robotID string, f *Frame) bool {
+	if !commandStale(robotID, f.source, f.msgID, f.expires) {
+		return false
+	}
+	f.release()
+	return true
+}
+
+// commandStale reports whether a command is past expires, counting it
+// and, with -stale-notify, telling the sender how old it was
+func commandStale(robotID, source string, msgID, expires uint64) bool {
+	now := currentTimeMs()
+	if expires == 0 || now <= expires {
+		return false
+	}
+	age := now - expires + uint64(config.MaxCommandAge.Milliseconds())
+	staleDropped.Add(1)
+	metricStaleCommands.WithLabelValues(robotID).Inc()
+	latency.forget(robotID, msgID)
+	if !config.StaleNotify {
+		return true
+	}
+	if p := manager.getPeer(source); p != nil {
+		msg := make([]byte, protocol.StaleCommandSize)
+		msg[0] = protocol.MsgTypeStaleCommand
+		binary.LittleEndian.PutUint64(msg[1:9], msgID)
+		binary.LittleEndian.PutUint32(msg[9:13], uint32(min(age, 1<<32-1)))
+		p.send(msg)
+	}
+	return true
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Smaller files are sent as is; compression would barely pay off
+	minCompressSize = 512
+	// Larger files are sent as is rather than held compressed in memory
+	maxCompressSize = 8 << 20
+)
+
+// staticHandler serves the web client from a directory. Text assets are
+// gzip or deflate compressed for clients that accept it, compressed once
+// per file version and kept in memory. Every response carries an ETag and
+// Cache-Control, and paths without an extension that match no file get
+// index.html, so client-side routes survive a reload.
+type staticHandler struct {
+	root http.FileSystem
+
+	mu    sync.Mutex
+	cache map[string]*compressedAsset // by file name and encoding
+}
+
+type compressedAsset struct {
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+func newStaticHandler(dir string) *staticHandler {
+	return &staticHandler{root: http.Dir(dir), cache: make(map[string]*compressedAsset)}
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	f, name, err := h.open(name)
+	if err != nil && path.Ext(name) == "" {
+		f, name, err = h.open("/index.html")
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	header := w.Header()
+	if path.Ext(name) == ".html" || config.StaticMaxAge == 0 {
+		header.Set("Cache-Control", "no-cache")
+	} else {
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(config.StaticMaxAge.Seconds())))
+	}
+	etag := fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size())
+
+	if compressible(name, info.Size()) {
+		header.Add("Vary", "Accept-Encoding")
+		if enc := acceptedEncoding(r.Header.Get("Accept-Encoding")); enc != "" {
+			data, err := h.compressed(f, name, enc, info.ModTime(), info.Size())
+			if err == nil {
+				header.Set("Content-Encoding", enc)
+				header.Set("ETag", `"`+etag+"-"+enc+`"`)
+				http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(data))
+				return
+			}
+			slog.Warn("Compressing static file failed", "file", name, "error", err)
+		}
+	}
+	header.Set("ETag", `"`+etag+`"`)
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// open opens name, or the index.html in it if it is a directory, and
+// returns the name actually opened
+func (h *staticHandler) open(name string) (http.File, string, error) {
+	f, err := h.root.Open(name)
+	if err != nil {
+		return nil, name, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, name, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return h.open(path.Join(name, "index.html"))
+	}
+	return f, name, nil
+}
+
+// compressed returns f encoded with enc, from the cache while the file is
+// unchanged
+func (h *staticHandler) compressed(f io.Reader, name, enc string, modTime time.Time, size int64) ([]byte, error) {
+	key := name + "\x00" + enc
+	h.mu.Lock()
+	asset, ok := h.cache[key]
+	h.mu.Unlock()
+	if ok && asset.modTime.Equal(modTime) && asset.size == size {
+		return asset.data, nil
+	}
+
+	var buf bytes.Buffer
+	var zw io.WriteCloser
+	if enc == "gzip" {
+		zw, _ = gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	} else {
+		zw, _ = zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	}
+	if _, err := io.Copy(zw, f); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	h.cache[key] = &compressedAsset{modTime: modTime, size: size, data: buf.Bytes()}
+	h.mu.Unlock()
+	return buf.Bytes(), nil
+}
+
+// compressible reports whether a file is text worth compressing
+func compressible(name string, size int64) bool {
+	if size < minCompressSize || size > maxCompressSize {
+		return false
+	}
+	ctype, _, _ := strings.Cut(mime.TypeByExtension(path.Ext(name)), ";")
+	switch {
+	case strings.HasPrefix(ctype, "text/"):
+		return true
+	case strings.HasSuffix(ctype, "javascript"), strings.HasSuffix(ctype, "json"),
+		strings.HasSuffix(ctype, "xml"), ctype == "application/wasm":
+		return true
+	}
+	return false
+}
+
+// acceptedEncoding picks gzip, else deflate, from an Accept-Encoding
+// header, or "" for neither
+func acceptedEncoding(header string) string {
+	var gz, deflate bool
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip":
+			gz = true
+		case "deflate":
+			deflate = true
+		}
+	}
+	switch {
+	case gz:
+		return "gzip"
+	case deflate:
+		return "deflate"
+	}
+	return ""
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"go_relay/protocol"
+)
+
+// streamLengthSize is the uint32 length in front of every frame on a
+// raw stream connection
+const streamLengthSize = 4
+
+// StreamListener bridges robot peers that speak the binary protocol over
+// a plain byte stream, TCP for controllers without a WebSocket stack or a
+// Unix socket for a robot process on the relay's machine. Each frame is a
+// uint32 length followed by the frame exactly as it would travel in a
+// WebSocket message, CRC included if negotiated. The first frame
+// registers the robot as on UDP: a Hello followed by a robot ID trailer
+// (length 0 for the default robot) and, with auth enabled, its token.
+type StreamListener struct {
+	name string // TCP or Unix, for logs
+	ln   net.Listener
+}
+
+// tcpListener is set by main when -tcp-addr is given
+var tcpListener *StreamListener
+
+func listenTCP(addr string) (*StreamListener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.KernelTimestamps {
+		ln = kernelTimestampListener(ln)
+	}
+	return &StreamListener{name: "TCP", ln: ln}, nil
+}
+
+// serve accepts robots until the listener is closed
+func (l *StreamListener) serve() {
+	slog.Info(l.name+" listener", "addr", l.ln.Addr().String())
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn(l.name+" accept failed", "err", err)
+			}
+			return
+		}
+		go l.register(conn)
+	}
+}
+
+// register admits a robot from its first frame, the registration Hello
+func (l *StreamListener) register(conn net.Conn) {
+	if draining.Load() {
+		conn.Close()
+		return
+	}
+	remote := conn.RemoteAddr().String()
+	if remote == "" || remote == "@" {
+		remote = "unix:" + conn.LocalAddr().String() // unnamed client socket
+	}
+	t := &streamTransport{
+		conn:         conn,
+		remote:       remote,
+		r:            bufio.NewReader(conn),
+		stamps:       kernelStamper(conn),
+		readLimit:    config.readLimitFor("python"),
+		writeTimeout: config.WriteTimeout,
+	}
+	hello, err := t.ReadFrame()
+	if err != nil || len(hello) < protocol.HelloSize || hello[0] != protocol.MsgTypeHello {
+		slog.Warn(l.name+" peer sent no Hello", "remote", t.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+	robotID := parseRobotTrailer(hello, protocol.HelloSize)
+	if robotID == "" {
+		robotID = protocol.DefaultRobotID
+	}
+	token := ""
+	if n := protocol.HelloSize; len(hello) > n {
+		token = string(hello[min(len(hello), n+1+int(hello[n])):])
+	}
+	claims, err := auth.authorizeToken(token, t.RemoteAddr(), "python")
+	if err != nil {
+		slog.Warn(l.name+" peer rejected", "remote", t.RemoteAddr(), "err", err)
+		conn.Close()
+		return
+	}
+
+	t.hello = hello[:protocol.HelloSize] // negotiate like any other peer
+	t.peer = newPeer("python", robotID, claims.Subject, t)
+	t.writeTimeout = t.peer.heartbeat.WriteTimeout
+	servePeer(t.peer)
+}
+
+func (l *StreamListener) close() error {
+	return l.ln.Close()
+}
+
+// streamTransport is one registered stream robot
+type streamTransport struct {
+	conn   net.Conn
+	remote string
+	r      *bufio.Reader
+	stamps kernelStamped // nil without -kernel-timestamps
+	peer   *Peer
+	hello  []byte // the registration Hello, read first
+	wbuf   []byte // reused by the writer
+
+	readLimit    int
+	writeTimeout time.Duration
+
+	closeOnce sync.Once
+}
+
+// ReadFrame returns the next length-prefixed frame, failing once the
+// robot has been silent for -read-timeout
+func (t *streamTransport) ReadFrame() ([]byte, error) {
+	if hello := t.hello; hello != nil {
+		t.hello = nil
+		return hello, nil
+	}
+	t.conn.SetReadDeadline(time.Now().Add(config.ReadTimeout))
+	var prefix [streamLengthSize]byte
+	if _, err := io.ReadFull(t.r, prefix[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.LittleEndian.Uint32(prefix[:]))
+	if n > t.readLimit {
+		t.Close()
+		return nil, fmt.Errorf("%w: %d-byte frame", websocket.ErrReadLimit, n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(t.r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// setReadLimit refuses longer frames from their length, unread
+func (t *streamTransport) setReadLimit(n int) { t.readLimit = n }
+
+// kernelRx is the receive time of the socket read that completed the
+// last frame, see kernelStamped
+func (t *streamTransport) kernelRx() (int64, bool) {
+	if t.stamps == nil {
+		return 0, false
+	}
+	return t.stamps.kernelRx()
+}
+
+func (t *streamTransport) WriteFrame(msg, trailer []byte) error {
+	t.wbuf = binary.LittleEndian.AppendUint32(t.wbuf[:0], uint32(len(msg)+len(trailer)))
+	t.wbuf = append(append(t.wbuf, msg...), trailer...)
+	t.conn.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+	_, err := t.conn.Write(t.wbuf)
+	return err
+}
+
+// Ping sends a Sync Beacon; keepalives would prove the socket alive
+// but not the robot, whose Beacon Reply refreshes its read deadline
+func (t *streamTransport) Ping() error {
+	beacon := encodeSyncBeacon()
+	var crcBuf [CRCSize]byte
+	return t.WriteFrame(beacon, t.peer.crcTrailer(beacon, &crcBuf))
+}
+
+// Shutdown closes the stream: a raw stream has no close reason, so the robot
+// just sees EOF
+func (t *streamTransport) Shutdown(code int, reason string) {
+	t.Close()
+}
+
+func (t *streamTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() { err = t.conn.Close() })
+	return err
+}
+
+func (t *streamTransport) RemoteAddr() string {
+	return t.remote
+}
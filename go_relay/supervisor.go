@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// SupervisorScope is the token scope a web peer needs to connect with
+// ?supervisor when auth is on
+const SupervisorScope = "supervisor"
+
+// Overrides lets supervisor peers (?supervisor), which never become driver
+// themselves, preempt a robot's driver or blend. A supervisor's command
+// that moves the robot starts or extends an override: while it lasts the
+// supervisor's commands reach the robot and everyone else's are dropped
+// with NackOverridden. It ends -supervisor-cooldown after the supervisor's
+// last moving command; zero commands in between are forwarded so the
+// supervisor can stop the robot, but don't extend it.
+type Overrides struct {
+	mu     sync.Mutex
+	robots map[string]*override
+}
+
+type override struct {
+	peerID string
+	since  time.Time
+	last   time.Time
+	timer  *time.Timer
+	gen    uint64
+}
+
+// OverrideInfo is one active override as reported in /status
+type OverrideInfo struct {
+	PeerID   string `json:"peer_id"`
+	SinceMs  int64  `json:"since_ms"`   // how long it has lasted
+	EndsInMs int64  `json:"ends_in_ms"` // until the cooldown ends it
+}
+
+var overrides = &Overrides{robots: make(map[string]*override)}
+
+// authorizeSupervisor checks that a peer asking for ?supervisor may have
+// it; with auth off any web peer may. Other peer types can't command
+// robots, so their ?supervisor is dropped.
+func authorizeSupervisor(claims *Claims, meta *PeerMeta, peerType string) error {
+	if peerType != "web" {
+		meta.Supervisor = false
+	}
+	if meta.Supervisor && auth.enabled() && !claims.hasScope(SupervisorScope) {
+		return errNoScope
+	}
+	return nil
+}
+
+// command decides whether a supervisor's command for robotID goes to the
+// robot; moving reports whether it commands any motion
+func (o *Overrides) command(robotID, peerID string, moving bool) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ov := o.robots[robotID]
+	if !moving {
+		return ov != nil && ov.peerID == peerID
+	}
+	now := time.Now()
+	if ov == nil {
+		ov = &override{peerID: peerID, since: now}
+		o.robots[robotID] = ov
+		metricOverrides.WithLabelValues(robotID).Inc()
+		slog.Warn("Supervisor override started", "peer_id", peerID, "robot_id", robotID)
+		events.publish("override", map[string]interface{}{"robot_id": robotID, "peer_id": peerID, "active": true})
+	} else if ov.peerID != peerID {
+		// The latest supervisor to move the robot holds the override
+		slog.Warn("Supervisor override taken over", "peer_id", peerID, "robot_id", robotID, "previous", ov.peerID)
+		ov.peerID = peerID
+	}
+	ov.last = now
+	if ov.timer != nil {
+		ov.timer.Stop()
+	}
+	ov.gen++
+	gen := ov.gen
+	ov.timer = time.AfterFunc(config.SupervisorCooldown, func() { o.expire(robotID, gen) })
+	return true
+}
+
+// expire ends robotID's override once its cooldown passed undisturbed
+func (o *Overrides) expire(robotID string, gen uint64) {
+	o.mu.Lock()
+	ov := o.robots[robotID]
+	if ov == nil || ov.gen != gen {
+		o.mu.Unlock()
+		return
+	}
+	delete(o.robots, robotID)
+	o.mu.Unlock()
+
+	slog.Info("Supervisor override ended", "peer_id", ov.peerID, "robot_id", robotID,
+		"duration", time.Since(ov.since).Round(time.Millisecond))
+	events.publish("override", map[string]interface{}{"robot_id": robotID, "peer_id": ov.peerID, "active": false})
+}
+
+// active reports whether a supervisor overrides robotID
+func (o *Overrides) active(robotID string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.robots[robotID] != nil
+}
+
+// leave ends the overrides held by a disconnecting supervisor at once:
+// nobody is left to stop the robot, so the deadman does
+func (o *Overrides) leave(peerID string) []string {
+	o.mu.Lock()
+	var robots []string
+	for robotID, ov := range o.robots {
+		if ov.peerID == peerID {
+			ov.timer.Stop()
+			delete(o.robots, robotID)
+			robots = append(robots, robotID)
+		}
+	}
+	o.mu.Unlock()
+	for _, robotID := range robots {
+		slog.Info("Supervisor override ended", "peer_id", peerID, "robot_id", robotID, "reason", "supervisor disconnected")
+		events.publish("override", map[string]interface{}{"robot_id": robotID, "peer_id": peerID, "active": false})
+	}
+	return robots
+}
+
+// snapshot returns the active overrides by robot
+func (o *Overrides) snapshot() map[string]OverrideInfo {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	out := make(map[string]OverrideInfo, len(o.robots))
+	for robotID, ov := range o.robots {
+		out[robotID] = OverrideInfo{
+			PeerID:   ov.peerID,
+			SinceMs:  now.Sub(ov.since).Milliseconds(),
+			EndsInMs: max(0, ov.last.Add(config.SupervisorCooldown).Sub(now).Milliseconds()),
+		}
+	}
+	return out
+}
+
+// twistMoves reports whether a browser twist commands any velocity
+func twistMoves(data []byte) bool {
+	for off := 17; off < 65; off += 8 {
+		if math.Float64frombits(binary.LittleEndian.Uint64(data[off:])) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// joyMoves reports whether a Joy frame of size bytes deflects an axis or
+// presses a button
+func joyMoves(data []byte, size int) bool {
+	if binary.LittleEndian.Uint32(data[17:21]) != 0 {
+		return true
+	}
+	for off := 22; off+4 <= size; off += 4 {
+		if math.Float32frombits(binary.LittleEndian.Uint32(data[off:])) != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSupervisorOverridesDriver(t *testing.T) {
+	cfg := *config
+	cfg.SupervisorCooldown = 30 * time.Millisecond
+	prev := config
+	config = &cfg
+	defer func() { config = prev }()
+
+	type step struct {
+		peer        string
+		moving      bool
+		wantForward bool
+	}
+	tests := []struct {
+		name       string
+		steps      []step
+		wait       time.Duration // after the steps
+		leave      string        // supervisor disconnecting after the wait
+		wantActive bool          // whether the driver's twists are now dropped
+	}{
+		{name: "moving command preempts the driver",
+			steps: []step{{"sup", true, true}}, wantActive: true},
+		{name: "stop without an override is not forwarded",
+			steps: []step{{"sup", false, false}}},
+		{name: "supervisor may stop the robot it holds",
+			steps: []step{{"sup", true, true}, {"sup", false, true}}, wantActive: true},
+		{name: "latest moving supervisor takes over",
+			steps: []step{{"sup", true, true}, {"sup2", true, true}, {"sup", false, false}}, wantActive: true},
+		{name: "override ends after the cooldown",
+			steps: []step{{"sup", true, true}, {"sup", false, true}}, wait: 90 * time.Millisecond},
+		{name: "override ends when the supervisor leaves",
+			steps: []step{{"sup", true, true}}, leave: "sup"},
+		{name: "bystander leaving keeps the override",
+			steps: []step{{"sup", true, true}}, leave: "driver", wantActive: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &Overrides{robots: make(map[string]*override)}
+			for i, s := range tt.steps {
+				if got := o.command("r1", s.peer, s.moving); got != s.wantForward {
+					t.Fatalf("step %d: %s forwarded = %v, want %v", i, s.peer, got, s.wantForward)
+				}
+			}
+			time.Sleep(tt.wait)
+			if tt.leave != "" {
+				ended := o.leave(tt.leave)
+				if want := !tt.wantActive; slices.Contains(ended, "r1") != want {
+					t.Errorf("leave(%s) ended %v", tt.leave, ended)
+				}
+			}
+			if got := o.active("r1"); got != tt.wantActive {
+				t.Errorf("active = %v, want %v", got, tt.wantActive)
+			}
+			if o.active("r2") {
+				t.Error("override spilled onto another robot")
+			}
+		})
+	}
+}
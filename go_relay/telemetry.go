@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// Drive modes (byte 13 of a Telemetry frame); robots may use others
+const (
+	DriveModeUnknown    = 0
+	DriveModeIdle       = 1
+	DriveModeTeleop     = 2
+	DriveModeAutonomous = 3
+	DriveModeCharging   = 4
+)
+
+// TelemetryState is a robot's last telemetry as shown in /status
+type TelemetryState struct {
+	RobotTime  uint64  `json:"robot_time"` // ms, robot clock
+	BatteryPct float32 `json:"battery_pct"`
+	DriveMode  uint8   `json:"drive_mode"`
+	ErrorFlags uint32  `json:"error_flags"` // bit 0 e-stopped, 1 motor fault, 2 low battery, 3 sensor fault
+	AgeMs      int64   `json:"age_ms"`      // since the relay received it
+}
+
+type telemetryEntry struct {
+	frame [protocol.TelemetrySize]byte
+	rx    time.Time
+}
+
+// TelemetryCache keeps each robot's last Telemetry frame so web peers
+// joining or switching robots get the current state immediately
+type TelemetryCache struct {
+	mu   sync.Mutex
+	last map[string]telemetryEntry
+}
+
+var telemetry = &TelemetryCache{last: make(map[string]telemetryEntry)}
+
+func (c *TelemetryCache) store(robotID string, frame []byte) {
+	e := telemetryEntry{rx: time.Now()}
+	copy(e.frame[:], frame)
+	c.mu.Lock()
+	c.last[robotID] = e
+	c.mu.Unlock()
+}
+
+// cached returns robotID's last telemetry encoded for codec, or nil
+func (c *TelemetryCache) cached(robotID string, codec *Codec) []byte {
+	c.mu.Lock()
+	e, ok := c.last[robotID]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return codec.appendFrame(nil, e.frame[:], robotID)
+}
+
+// snapshot returns every robot's last telemetry, decoded
+func (c *TelemetryCache) snapshot() map[string]TelemetryState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	le := binary.LittleEndian
+	states := make(map[string]TelemetryState, len(c.last))
+	for robotID, e := range c.last {
+		states[robotID] = TelemetryState{
+			RobotTime:  le.Uint64(e.frame[1:9]),
+			BatteryPct: math.Float32frombits(le.Uint32(e.frame[9:13])),
+			DriveMode:  e.frame[13],
+			ErrorFlags: le.Uint32(e.frame[14:18]),
+			AgeMs:      time.Since(e.rx).Milliseconds(),
+		}
+	}
+	return states
+}
+
+// handleTelemetry caches a robot's telemetry and fans it out to the web
+// and observer peers on that robot, and upstream when federated
+func handleTelemetry(peer *Peer, data []byte) {
+	if !peer.isRobot() {
+		return
+	}
+	if len(data) < protocol.TelemetrySize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.TelemetrySize)
+		return
+	}
+	frame := data[:protocol.TelemetrySize]
+	robotID := manager.robotFor(peer)
+	telemetry.store(robotID, frame)
+
+	for _, web := range manager.getWebPeers(robotID) {
+		web.send(web.codec().appendFrame(nil, frame, robotID))
+	}
+	recorder.record(RecordOut, robotID, nil, frame)
+	mcapRecorder.add(mcapTelemetry, robotID, frame)
+	federation.forwardRobotFrame(robotID, frame)
+	slog.Debug("Telemetry forwarded", "robot_id", robotID, "msg_type", "telemetry",
+		"battery_pct", math.Float32frombits(binary.LittleEndian.Uint32(frame[9:13])),
+		"drive_mode", frame[13], "error_flags", binary.LittleEndian.Uint32(frame[14:18]))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSOptions selects how the relay terminates TLS. With neither a cert/key
+// pair nor autocert domains the relay serves plain HTTP.
+type TLSOptions struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	AutocertDomains string `yaml:"autocert_domains"` // comma-separated host allowlist
+	AutocertCache   string `yaml:"autocert_cache"`   // directory for issued certificates
+	AutocertEmail   string `yaml:"autocert_email"`   // ACME account contact, optional
+	ACMEHTTPAddr    string `yaml:"acme_http_addr"`   // listener for http-01 challenges and redirects
+}
+
+func (o TLSOptions) validate() error {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if o.CertFile != "" && o.AutocertDomains != "" {
+		return errors.New("-tls-cert and -autocert-domains are mutually exclusive")
+	}
+	return nil
+}
+
+// describe returns a one-line summary for the startup banner
+func (o TLSOptions) describe() string {
+	switch {
+	case o.AutocertDomains != "":
+		return "Let's Encrypt (" + o.AutocertDomains + ")"
+	case o.CertFile != "":
+		return o.CertFile
+	default:
+		return "disabled"
+	}
+}
+
+// listenAndServe runs srv with the configured TLS mode
+func listenAndServe(srv *http.Server, opts TLSOptions) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	if config.KernelTimestamps {
+		ln = kernelTimestampListener(ln)
+	}
+	switch {
+	case opts.AutocertDomains != "":
+		m := autocertManager(opts)
+		srv.TLSConfig = m.TLSConfig()
+
+		// http-01 challenges; everything else is redirected to HTTPS
+		go func() {
+			slog.Info("ACME HTTP listener", "addr", opts.ACMEHTTPAddr)
+			if err := http.ListenAndServe(opts.ACMEHTTPAddr, m.HTTPHandler(nil)); err != nil {
+				slog.Error("ACME HTTP listener failed", "err", err)
+			}
+		}()
+		return srv.ServeTLS(ln, "", "")
+
+	case opts.CertFile != "":
+		return srv.ServeTLS(ln, opts.CertFile, opts.KeyFile)
+
+	default:
+		return srv.Serve(ln)
+	}
+}
+
+var (
+	acmeOnce    sync.Once
+	acmeManager *autocert.Manager
+)
+
+// autocertManager returns the one ACME manager shared by every listener
+func autocertManager(opts TLSOptions) *autocert.Manager {
+	acmeOnce.Do(func() {
+		var domains []string
+		for _, d := range strings.Split(opts.AutocertDomains, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				domains = append(domains, d)
+			}
+		}
+		acmeManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(opts.AutocertCache),
+			Email:      opts.AutocertEmail,
+		}
+	})
+	return acmeManager
+}
+
+// tlsConfig returns the certificates of the configured TLS mode for
+// listeners other than the main one, or nil when TLS is disabled
+func tlsConfig(opts TLSOptions) (*tls.Config, error) {
+	switch {
+	case opts.AutocertDomains != "":
+		return autocertManager(opts).TLSConfig(), nil
+	case opts.CertFile != "":
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"go_relay/protocol"
+)
+
+// TraceBlockSize is the W3C trace context carried by twists and acks of
+// peers that negotiated FeatureTraceContext: trace ID (16), parent span
+// ID (8), trace flags (1). It follows the robot trailer and hop block.
+const TraceBlockSize = 25
+
+// maxPendingTraces bounds the forwarded twists awaiting their ack
+const maxPendingTraces = 1024
+
+var tracer = otel.Tracer("go_relay")
+
+// tracerProvider is set by setupTracing; nil while tracing is disabled
+var tracerProvider *sdktrace.TracerProvider
+
+// setupTracing exports spans over OTLP/HTTP to endpoint, a URL such as
+// http://localhost:4318 (Jaeger's OTLP port); without a path spans go to
+// the standard /v1/traces
+func setupTracing(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	exp, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return err
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("teleop-relay"))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	return nil
+}
+
+// shutdownTracing flushes spans still batched for export
+func shutdownTracing(ctx context.Context) {
+	if tracerProvider != nil {
+		tracerProvider.Shutdown(ctx)
+	}
+}
+
+// appendTraceBlock appends sc as a trace block; an invalid context
+// encodes as zeros, which receivers treat as "no parent"
+func appendTraceBlock(frame []byte, sc trace.SpanContext) []byte {
+	tid, sid := sc.TraceID(), sc.SpanID()
+	frame = append(frame, tid[:]...)
+	frame = append(frame, sid[:]...)
+	return append(frame, byte(sc.TraceFlags()))
+}
+
+// splitTraceBlock strips the trace block from the end of frame. It
+// reports false if frame is too short to hold one past minSize.
+func splitTraceBlock(frame []byte, minSize int) ([]byte, trace.SpanContext, bool) {
+	n := len(frame) - TraceBlockSize
+	if n < minSize {
+		return nil, trace.SpanContext{}, false
+	}
+	var tid trace.TraceID
+	var sid trace.SpanID
+	copy(tid[:], frame[n:n+16])
+	copy(sid[:], frame[n+16:n+24])
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    tid,
+		SpanID:     sid,
+		TraceFlags: trace.TraceFlags(frame[n+24]),
+		Remote:     true,
+	})
+	return frame[:n], sc, true
+}
+
+// usesTrace reports whether frames of type t to and from peer carry a
+// trace block: twists and acks, once negotiated
+func (p *Peer) usesTrace(t byte) bool {
+	return (t == protocol.MsgTypeTwist || t == protocol.MsgTypeTwistAck) && p.codec().has(FeatureTraceContext)
+}
+
+// twistTrace holds the spans of one browser twist. With tracing disabled
+// both spans are nil and the browser's context is passed on unchanged.
+type twistTrace struct {
+	command trace.Span // from browser send to ack; nil under a browser's own trace
+	twist   trace.Span
+	sc      trace.SpanContext
+}
+
+// spanContext is the parent handed to the robot in the twist's trace block
+func (t twistTrace) spanContext() trace.SpanContext { return t.sc }
+
+type traceKey struct {
+	robotID string
+	msgID   uint64
+}
+
+// TraceStore remembers forwarded twists until their ack arrives, so the
+// ack's spans join the twist's trace even when the robot echoes no trace
+// block
+type TraceStore struct {
+	mu      sync.Mutex
+	pending map[traceKey]twistTrace
+}
+
+var traces = &TraceStore{pending: make(map[traceKey]twistTrace)}
+
+// startTwist starts the spans of a browser twist sent at t1 and received
+// at t2: a "teleop.command" root unless parent (the browser's trace
+// block) is valid, and "relay.twist" under it
+func (s *TraceStore) startTwist(parent trace.SpanContext, peer *Peer, msgID, t1, t2 uint64) twistTrace {
+	if tracerProvider == nil {
+		return twistTrace{sc: parent}
+	}
+	attrs := trace.WithAttributes(attribute.Int64("msg_id", int64(msgID)))
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), parent)
+	var t twistTrace
+	if !parent.IsValid() {
+		ctx, t.command = tracer.Start(ctx, "teleop.command", trace.WithTimestamp(msTime(t1)), attrs)
+	}
+	_, t.twist = tracer.Start(ctx, "relay.twist", trace.WithTimestamp(msTime(t2)), attrs,
+		trace.WithAttributes(
+			attribute.String("peer_id", peer.ID),
+			attribute.String("peer_type", peer.Type),
+		))
+	t.sc = t.twist.SpanContext()
+	return t
+}
+
+// finishTwist ends the relay.twist span; a twist that reached robotID is
+// kept until its ack, anything else ends the whole command
+func (s *TraceStore) finishTwist(t twistTrace, robotID string, msgID uint64, forwarded bool) {
+	if t.twist == nil {
+		return
+	}
+	t.twist.SetAttributes(attribute.String("robot_id", robotID), attribute.Bool("forwarded", forwarded))
+	t.twist.End()
+	if !forwarded {
+		if t.command != nil {
+			t.command.End()
+		}
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= maxPendingTraces {
+		for k, old := range s.pending {
+			if old.command != nil {
+				old.command.End()
+			}
+			delete(s.pending, k)
+			break
+		}
+	}
+	s.pending[traceKey{robotID, msgID}] = t
+}
+
+// startAck records the robot's processing ("robot.process", on the
+// robot's clock) and starts "relay.ack", both under the twist's span or
+// parent, the robot's trace block. end finishes the ack and its command.
+func (s *TraceStore) startAck(parent trace.SpanContext, peer *Peer, rec LatencyRecord) (sc trace.SpanContext, end func()) {
+	if tracerProvider == nil {
+		return parent, func() {}
+	}
+	key := traceKey{rec.RobotID, rec.MsgID}
+	s.mu.Lock()
+	t, ok := s.pending[key]
+	delete(s.pending, key)
+	s.mu.Unlock()
+	if !parent.IsValid() && ok {
+		parent = t.sc
+	}
+
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), parent)
+	attrs := trace.WithAttributes(
+		attribute.Int64("msg_id", int64(rec.MsgID)),
+		attribute.String("robot_id", rec.RobotID),
+	)
+	_, robot := tracer.Start(ctx, "robot.process", trace.WithTimestamp(msTime(rec.T3PythonRx)), attrs)
+	robot.End(trace.WithTimestamp(msTime(rec.T4PythonAck)))
+
+	_, span := tracer.Start(ctx, "relay.ack", trace.WithTimestamp(msTime(rec.T4RelayAckRx)), attrs,
+		trace.WithAttributes(
+			attribute.String("peer_id", peer.ID),
+			attribute.String("peer_type", peer.Type),
+			attribute.Float64("round_trip_ms", rec.roundTrip()),
+			attribute.Float64("python_ms", rec.pythonProcessing()),
+		))
+	return span.SpanContext(), func() {
+		span.End()
+		if t.command != nil {
+			t.command.End(trace.WithTimestamp(msTime(rec.T5RelayAckTx)))
+		}
+	}
+}
+
+// msTime converts a protocol timestamp (ms since the Unix epoch)
+func msTime(ms uint64) time.Time {
+	return time.UnixMilli(int64(ms))
+}
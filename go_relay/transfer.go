@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// File transfers carry a file between a browser and its robot as File
+// Chunks, paced by the receiver's File Acks: each ack says how much has
+// arrived in order and how far beyond it the sender may go, so a transfer
+// never floods the send queues that acks and control share. Uploads open
+// with an empty chunk at offset 0 and downloads with a request chunk; the
+// receiver answers with the offset it already holds, so a transfer cut off
+// by a reconnect resumes where it stopped. As with reliable commands, the
+// relay renumbers transfers towards the robot with IDs unique across
+// browsers and maps the robot's frames back. Frames of unknown transfers,
+// or of ones whose other end is gone, get an aborted ack, and transfers
+// are aborted towards both ends after -file-timeout without a chunk or
+// ack, or once the browser watches another robot. Observers may not
+// transfer files.
+
+// maxRobotTransfers bounds a robot's open transfers
+const maxRobotTransfers = 64
+
+// FileTransfers tracks the open transfers
+type FileTransfers struct {
+	mu       sync.Mutex
+	nextID   uint32
+	open     map[uint32]*fileTransfer // by relay ID
+	bySource map[transferKey]uint32
+}
+
+type transferKey struct {
+	source string
+	id     uint32
+}
+
+type fileTransfer struct {
+	id      uint32 // the relay's
+	robotID string
+	source  string // web peer ID
+	srcID   uint32 // the browser's
+	name    string
+	upload  bool
+	total   uint64
+	offset  uint64 // last acked
+	window  uint32 // bytes the receiver takes beyond offset
+	started time.Time
+	timer   *time.Timer
+}
+
+// FileTransferState is an open transfer as reported in /status
+type FileTransferState struct {
+	Peer      string `json:"peer"`
+	Name      string `json:"name"`
+	Direction string `json:"direction"` // upload (to the robot) or download
+	Offset    uint64 `json:"offset"`
+	Total     uint64 `json:"total"`
+	AgeMs     int64  `json:"age_ms"`
+}
+
+var transfers = &FileTransfers{
+	open:     make(map[uint32]*fileTransfer),
+	bySource: make(map[transferKey]uint32),
+}
+
+// checkFileChunk rejects a malformed File Chunk, reporting whether it is
+// well-formed
+func checkFileChunk(peer *Peer, data []byte) bool {
+	if len(data) < protocol.FileChunkMinSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.FileChunkMinSize)
+		return false
+	}
+	header := protocol.FileChunkMinSize + int(data[22])
+	if len(data) < header {
+		rejectFrame(peer, data, ProtoErrTooShort, header)
+		return false
+	}
+	if len(data) > header+protocol.FileMaxChunk {
+		rejectFrame(peer, data, ProtoErrTooLong, header+protocol.FileMaxChunk)
+		return false
+	}
+	return true
+}
+
+// handleFileChunk forwards a chunk or download request between a browser
+// and its robot. A browser's first frame of a transfer opens it; observers
+// may not transfer files.
+func handleFileChunk(peer *Peer, data []byte) {
+	if !peer.isRobot() && !peer.watchesRobot() {
+		return
+	}
+	if !checkFileChunk(peer, data) {
+		return
+	}
+	if peer.Type == "observer" {
+		peer.logger().Warn("File chunk from observer rejected", "msg_type", "file_chunk")
+		return
+	}
+	chunk, _ := protocol.UnmarshalFileChunk(data)
+	if peer.isRobot() {
+		transfers.fromRobot(peer, data, chunk.Total, len(chunk.Data))
+		return
+	}
+	transfers.fromWeb(peer, data, &chunk)
+}
+
+// handleFileAck forwards a receiver's ack to the sender, ending the
+// transfer on any status but OK
+func handleFileAck(peer *Peer, data []byte) {
+	if !peer.isRobot() && !peer.watchesRobot() {
+		return
+	}
+	if len(data) < protocol.FileAckSize {
+		rejectFrame(peer, data, ProtoErrTooShort, protocol.FileAckSize)
+		return
+	}
+	if peer.Type == "observer" {
+		return
+	}
+	if peer.isRobot() {
+		transfers.fromRobot(peer, data, 0, 0)
+		return
+	}
+	transfers.fromWeb(peer, data, nil)
+}
+
+// fromWeb sends a browser's frame on to the robot under the relay's
+// transfer ID; chunk is nil for acks. A transfer stays with the robot it
+// was opened to: once the browser watches another, it is aborted. Chunks
+// past the robot's acked offset and window are dropped.
+func (ft *FileTransfers) fromWeb(peer *Peer, data []byte, chunk *protocol.FileChunk) {
+	srcID := binary.LittleEndian.Uint32(data[1:5])
+	watching := manager.robotFor(peer)
+
+	ft.mu.Lock()
+	t := ft.open[ft.bySource[transferKey{peer.ID, srcID}]]
+	if t == nil && chunk != nil {
+		t = ft.openLocked(peer, watching, srcID, chunk)
+	}
+	if t == nil {
+		ft.mu.Unlock()
+		if chunk != nil {
+			sendFileAck(peer, srcID, protocol.FileStatusAborted)
+		}
+		return
+	}
+	if t.robotID != watching {
+		ft.mu.Unlock()
+		peer.logger().Info("File transfer aborted: peer switched robots", "msg_type", protocol.TypeName(data[0]),
+			"robot_id", t.robotID, "name", t.name)
+		ft.abort(t, "aborted")
+		return
+	}
+	if chunk != nil && !t.fits(chunk) {
+		ft.mu.Unlock()
+		peer.logger().Debug("File chunk past the window dropped", "msg_type", "file_chunk", "name", t.name,
+			"offset", chunk.Offset, "size", len(chunk.Data), "acked", t.offset, "window", t.window)
+		return
+	}
+	ft.progressLocked(t, data)
+	id := t.id
+	ft.mu.Unlock()
+
+	python := manager.getPython(t.robotID)
+	if python == nil || python.Type != "python" {
+		ft.finish(t, "aborted")
+		sendFileAck(peer, srcID, protocol.FileStatusAborted)
+		return
+	}
+	frame := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(frame[1:5], id)
+	python.send(frame)
+	if chunk != nil && len(chunk.Data) > 0 {
+		metricFileBytes.WithLabelValues("upload").Add(float64(len(chunk.Data)))
+	}
+}
+
+// fits reports whether chunk's data lies within the window the receiver
+// last acked; chunks without data always fit
+func (t *fileTransfer) fits(chunk *protocol.FileChunk) bool {
+	if len(chunk.Data) == 0 {
+		return true
+	}
+	limit := t.offset + uint64(t.window)
+	return chunk.Offset <= limit && uint64(len(chunk.Data)) <= limit-chunk.Offset
+}
+
+// openLocked starts a transfer for a browser's first chunk, or returns nil
+// if the robot has too many open; ft.mu is held
+func (ft *FileTransfers) openLocked(peer *Peer, robotID string, srcID uint32, chunk *protocol.FileChunk) *fileTransfer {
+	n := 0
+	for _, t := range ft.open {
+		if t.robotID == robotID {
+			n++
+		}
+	}
+	if n >= maxRobotTransfers {
+		metricFileTransfers.WithLabelValues("refused").Inc()
+		return nil
+	}
+	ft.nextID++
+	t := &fileTransfer{
+		id:      ft.nextID,
+		robotID: robotID,
+		source:  peer.ID,
+		srcID:   srcID,
+		name:    chunk.Name,
+		upload:  chunk.Flags&protocol.FileFlagRequest == 0,
+		total:   chunk.Total,
+		offset:  chunk.Offset,
+		started: time.Now(),
+	}
+	t.timer = time.AfterFunc(config.FileTimeout, func() { ft.expire(t) })
+	ft.open[t.id] = t
+	ft.bySource[transferKey{peer.ID, srcID}] = t.id
+	metricFileTransfers.WithLabelValues("started").Inc()
+	peer.logger().Info("File transfer opened", "msg_type", "file_chunk", "robot_id", robotID, "name", chunk.Name,
+		"upload", t.upload, "offset", chunk.Offset, "total", chunk.Total)
+	return t
+}
+
+// fromRobot sends the robot's frame back to the browser under its own
+// transfer ID. Frames of transfers the relay no longer knows are answered
+// with an abort, so the robot stops sending.
+func (ft *FileTransfers) fromRobot(peer *Peer, data []byte, total uint64, n int) {
+	id := binary.LittleEndian.Uint32(data[1:5])
+	ft.mu.Lock()
+	t := ft.open[id]
+	if t == nil || t.robotID != peer.RobotID {
+		ft.mu.Unlock()
+		if data[0] == protocol.MsgTypeFileChunk {
+			sendFileAck(peer, id, protocol.FileStatusAborted)
+		}
+		return
+	}
+	if total > 0 {
+		t.total = total
+	}
+	ft.progressLocked(t, data)
+	ft.mu.Unlock()
+
+	web := manager.getPeer(t.source)
+	if web == nil || !web.watchesRobot() {
+		ft.finish(t, "aborted")
+		sendFileAck(peer, id, protocol.FileStatusAborted)
+		return
+	}
+	frame := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(frame[1:5], t.srcID)
+	web.send(frame)
+	if n > 0 {
+		metricFileBytes.WithLabelValues("download").Add(float64(n))
+	}
+}
+
+// progressLocked notes a frame of t, ending t on an ack with a final
+// status; ft.mu is held
+func (ft *FileTransfers) progressLocked(t *fileTransfer, data []byte) {
+	if data[0] != protocol.MsgTypeFileAck {
+		t.timer.Reset(config.FileTimeout)
+		return
+	}
+	t.offset = binary.LittleEndian.Uint64(data[6:14])
+	t.window = binary.LittleEndian.Uint32(data[14:18])
+	switch data[5] {
+	case protocol.FileStatusOK:
+		t.timer.Reset(config.FileTimeout)
+	case protocol.FileStatusComplete:
+		ft.removeLocked(t, "completed")
+	case protocol.FileStatusRejected:
+		ft.removeLocked(t, "rejected")
+	default:
+		ft.removeLocked(t, "aborted")
+	}
+}
+
+func (ft *FileTransfers) finish(t *fileTransfer, result string) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.removeLocked(t, result)
+}
+
+// removeLocked forgets t, once; ft.mu is held
+func (ft *FileTransfers) removeLocked(t *fileTransfer, result string) {
+	if ft.open[t.id] != t {
+		return
+	}
+	t.timer.Stop()
+	delete(ft.open, t.id)
+	delete(ft.bySource, transferKey{t.source, t.srcID})
+	metricFileTransfers.WithLabelValues(result).Inc()
+	slog.Info("File transfer closed", "robot_id", t.robotID, "peer_id", t.source, "name", t.name,
+		"upload", t.upload, "offset", t.offset, "total", t.total, "result", result)
+}
+
+// expire aborts a transfer idle for config.FileTimeout
+func (ft *FileTransfers) expire(t *fileTransfer) {
+	ft.abort(t, "timeout")
+}
+
+// abort ends t towards both ends, counting it under result
+func (ft *FileTransfers) abort(t *fileTransfer, result string) {
+	ft.mu.Lock()
+	if ft.open[t.id] != t {
+		ft.mu.Unlock()
+		return
+	}
+	ft.removeLocked(t, result)
+	ft.mu.Unlock()
+
+	if web := manager.getPeer(t.source); web != nil {
+		sendFileAck(web, t.srcID, protocol.FileStatusAborted)
+	}
+	if python := manager.getPython(t.robotID); python != nil && python.Type == "python" {
+		sendFileAck(python, t.id, protocol.FileStatusAborted)
+	}
+}
+
+// sendFileAck tells peer the relay ended transfer id with status
+func sendFileAck(peer *Peer, id uint32, status byte) {
+	peer.send(protocol.FileAck{TransferID: id, Status: status}.Marshal())
+}
+
+// snapshot returns every robot's open transfers
+func (ft *FileTransfers) snapshot() map[string][]FileTransferState {
+	now := time.Now()
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	out := make(map[string][]FileTransferState)
+	for _, t := range ft.open {
+		dir := "download"
+		if t.upload {
+			dir = "upload"
+		}
+		out[t.robotID] = append(out[t.robotID], FileTransferState{
+			Peer:      t.source,
+			Name:      t.name,
+			Direction: dir,
+			Offset:    t.offset,
+			Total:     t.total,
+			AgeMs:     now.Sub(t.started).Milliseconds(),
+		})
+	}
+	return out
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"go_relay/protocol"
+)
+
+func TestFileTransferFits(t *testing.T) {
+	tr := &fileTransfer{offset: 1000, window: 500}
+	tests := []struct {
+		name   string
+		offset uint64
+		size   int
+		fits   bool
+	}{
+		{"no data", 1 << 40, 0, true},
+		{"at the acked offset", 1000, 500, true},
+		{"resend below the offset", 200, 100, true},
+		{"ends at the window", 1400, 100, true},
+		{"past the window", 1400, 101, false},
+		{"starts past the window", 1600, 1, false},
+		{"offset wraps", ^uint64(0) - 10, 20, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunk := &protocol.FileChunk{Offset: tt.offset, Data: make([]byte, tt.size)}
+			if got := tr.fits(chunk); got != tt.fits {
+				t.Fatalf("fits = %v, want %v", got, tt.fits)
+			}
+		})
+	}
+}
+
+func TestFileTransferAckOpensWindow(t *testing.T) {
+	saved := config
+	config.FileTimeout = time.Hour
+	t.Cleanup(func() { config = saved })
+
+	ft := &FileTransfers{open: make(map[uint32]*fileTransfer), bySource: make(map[transferKey]uint32)}
+	tr := &fileTransfer{id: 1, robotID: "r1", source: "web1", srcID: 7, upload: true, timer: time.AfterFunc(time.Hour, func() {})}
+	t.Cleanup(func() { tr.timer.Stop() })
+	ft.open[tr.id] = tr
+	ft.bySource[transferKey{tr.source, tr.srcID}] = tr.id
+
+	chunk := &protocol.FileChunk{Offset: 0, Data: make([]byte, 1024)}
+	if tr.fits(chunk) {
+		t.Fatal("data fits before the robot acked a window")
+	}
+	ack := protocol.FileAck{TransferID: 1, Status: protocol.FileStatusOK, Offset: 0, Window: 4096}.Marshal()
+	ft.mu.Lock()
+	ft.progressLocked(tr, ack)
+	ft.mu.Unlock()
+	if !tr.fits(chunk) {
+		t.Fatalf("chunk does not fit after a %d byte window", binary.LittleEndian.Uint32(ack[14:18]))
+	}
+	ack = protocol.FileAck{TransferID: 1, Status: protocol.FileStatusComplete, Offset: 1024}.Marshal()
+	ft.mu.Lock()
+	ft.progressLocked(tr, ack)
+	ft.mu.Unlock()
+	if len(ft.open) != 0 || len(ft.bySource) != 0 {
+		t.Fatal("completed transfer still open")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport carries one peer's binary frames. The writer goroutine is the
+// only caller of WriteFrame, Ping and Shutdown (under peer.mu); the reader
+// is the only caller of ReadFrame.
+type Transport interface {
+	// ReadFrame blocks for the next inbound binary frame
+	ReadFrame() ([]byte, error)
+	// WriteFrame sends msg followed by trailer as one frame
+	WriteFrame(msg, trailer []byte) error
+	// Ping proves liveness to the peer and keeps the read deadline alive
+	Ping() error
+	// Shutdown tells the peer why it is being closed, best effort
+	Shutdown(code int, reason string)
+	// Close tears the connection down immediately
+	Close() error
+	// RemoteAddr identifies the other end, for logs and /admin/peers
+	RemoteAddr() string
+}
+
+// wsTransport is a Transport over a WebSocket from /ws/data. Text
+// messages, which carry WebRTC signaling, go to onText; onPong, if set,
+// hears every pong with the round trip of the ping it answers.
+type wsTransport struct {
+	conn    *websocket.Conn
+	onText  func([]byte)
+	onPong  func(rtt time.Duration)
+	deflate bool          // permessage-deflate negotiated
+	stamps  kernelStamped // the socket's receive timestamps, nil without -kernel-timestamps
+
+	writeTimeout time.Duration // per write, see Config.heartbeatFor
+}
+
+func newWSTransport(conn *websocket.Conn) *wsTransport {
+	t := &wsTransport{conn: conn, writeTimeout: config.WriteTimeout, stamps: kernelStamper(conn.NetConn())}
+	conn.SetReadDeadline(time.Now().Add(config.ReadTimeout))
+	conn.SetPongHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(config.ReadTimeout))
+		if t.onPong != nil {
+			var rtt time.Duration
+			if len(data) == 8 {
+				sent := int64(binary.LittleEndian.Uint64([]byte(data)))
+				rtt = time.Duration(time.Now().UnixNano() - sent)
+			}
+			t.onPong(rtt)
+		}
+		return nil
+	})
+	return t
+}
+
+// kernelRx is the receive time of the socket read that completed the
+// last frame, see kernelStamped
+func (t *wsTransport) kernelRx() (int64, bool) {
+	if t.stamps == nil {
+		return 0, false
+	}
+	return t.stamps.kernelRx()
+}
+
+func (t *wsTransport) ReadFrame() ([]byte, error) {
+	for {
+		msgType, data, err := t.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		t.conn.SetReadDeadline(time.Now().Add(config.ReadTimeout))
+		switch {
+		case msgType == websocket.BinaryMessage:
+			return data, nil
+		case msgType == websocket.TextMessage && t.onText != nil:
+			t.onText(data)
+		}
+	}
+}
+
+// WriteFrame writes msg and trailer as one binary message without copying
+func (t *wsTransport) WriteFrame(msg, trailer []byte) error {
+	t.conn.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+	w, err := t.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	w.Write(msg)
+	w.Write(trailer)
+	return w.Close()
+}
+
+func (t *wsTransport) deflating() bool { return t.deflate }
+
+// compress switches compression for the following writes
+func (t *wsTransport) compress(on bool) { t.conn.EnableWriteCompression(on) }
+
+// WriteText sends msg as a text message
+func (t *wsTransport) WriteText(msg []byte) error {
+	t.conn.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+	return t.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// Ping carries its send time, which the pong echoes back
+func (t *wsTransport) Ping() error {
+	t.conn.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+	var sent [8]byte
+	binary.LittleEndian.PutUint64(sent[:], uint64(time.Now().UnixNano()))
+	return t.conn.WriteMessage(websocket.PingMessage, sent[:])
+}
+
+func (t *wsTransport) Shutdown(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	t.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(t.writeTimeout))
+}
+
+func (t *wsTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *wsTransport) RemoteAddr() string {
+	return t.conn.RemoteAddr().String()
+}
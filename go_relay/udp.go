@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// udpMaxDatagram bounds inbound datagrams; every relay frame fits easily
+const udpMaxDatagram = 2048
+
+// UDPListener bridges robot peers speaking the binary protocol over UDP.
+// A robot registers by sending a Hello followed by a robot ID trailer
+// (length 0 for the default robot) and, with auth enabled, its token; every later datagram from
+// the same address is one frame of that peer. Peers that send nothing
+// for -read-timeout are dropped, and the relay's periodic Sync Beacons
+// give an idle robot something to answer.
+type UDPListener struct {
+	conn *net.UDPConn
+
+	mu    sync.Mutex
+	peers map[string]*udpTransport // remote address -> peer
+}
+
+// udpListener is set by main when -udp-addr is given
+var udpListener *UDPListener
+
+func listenUDP(addr string) (*UDPListener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPListener{conn: conn, peers: make(map[string]*udpTransport)}, nil
+}
+
+// serve demultiplexes datagrams to their peers until the socket is closed
+func (l *UDPListener) serve() {
+	slog.Info("UDP listener", "addr", l.conn.LocalAddr().String())
+	buf := make([]byte, udpMaxDatagram)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("UDP read failed", "err", err)
+			}
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		frame := append([]byte(nil), buf[:n]...)
+
+		l.mu.Lock()
+		t := l.peers[addr.String()]
+		l.mu.Unlock()
+		if t != nil {
+			t.deliver(frame)
+			continue
+		}
+		if frame[0] == protocol.MsgTypeHello {
+			l.register(addr, frame)
+		}
+	}
+}
+
+// register admits a new robot from its Hello datagram
+func (l *UDPListener) register(addr *net.UDPAddr, hello []byte) {
+	if draining.Load() || len(hello) < protocol.HelloSize {
+		return
+	}
+	robotID := parseRobotTrailer(hello, protocol.HelloSize)
+	if robotID == "" {
+		robotID = protocol.DefaultRobotID
+	}
+	token := ""
+	if n := protocol.HelloSize; len(hello) > n {
+		token = string(hello[min(len(hello), n+1+int(hello[n])):])
+	}
+	claims, err := auth.authorizeToken(token, addr.String(), "python")
+	if err != nil {
+		slog.Warn("UDP peer rejected", "remote", addr.String(), "err", err)
+		return
+	}
+
+	t := &udpTransport{
+		listener: l,
+		addr:     addr,
+		key:      addr.String(),
+		in:       make(chan []byte, 64),
+		done:     make(chan struct{}),
+	}
+	l.mu.Lock()
+	l.peers[t.key] = t
+	l.mu.Unlock()
+
+	t.peer = newPeer("python", robotID, claims.Subject, t)
+	go servePeer(t.peer)
+	t.deliver(hello[:protocol.HelloSize]) // negotiate like any other peer
+}
+
+func (l *UDPListener) forget(t *udpTransport) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.peers[t.key] == t {
+		delete(l.peers, t.key)
+	}
+}
+
+func (l *UDPListener) close() error {
+	return l.conn.Close()
+}
+
+// udpTransport is one registered UDP peer
+type udpTransport struct {
+	listener *UDPListener
+	addr     *net.UDPAddr
+	key      string
+	peer     *Peer
+	wbuf     []byte // reused by the writer
+
+	in        chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *udpTransport) deliver(frame []byte) {
+	select {
+	case t.in <- frame:
+	case <-t.done:
+	default:
+		metricDropped.WithLabelValues("python", OverflowDropNewest).Inc()
+	}
+}
+
+// ReadFrame returns the next datagram, failing once the peer has been
+// silent for -read-timeout
+func (t *udpTransport) ReadFrame() ([]byte, error) {
+	timeout := time.NewTimer(config.ReadTimeout)
+	defer timeout.Stop()
+	select {
+	case frame := <-t.in:
+		return frame, nil
+	case <-timeout.C:
+		return nil, errors.New("udp peer timed out")
+	case <-t.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (t *udpTransport) WriteFrame(msg, trailer []byte) error {
+	t.wbuf = append(append(t.wbuf[:0], msg...), trailer...)
+	_, err := t.listener.conn.WriteToUDP(t.wbuf, t.addr)
+	return err
+}
+
+// Ping sends a Sync Beacon; the robot's Beacon Reply keeps it alive
+func (t *udpTransport) Ping() error {
+	beacon := encodeSyncBeacon()
+	var crcBuf [CRCSize]byte
+	return t.WriteFrame(beacon, t.peer.crcTrailer(beacon, &crcBuf))
+}
+
+// Shutdown stops reading: UDP has no close handshake, and the robot only
+// learns it was dropped when its own liveness check fails
+func (t *udpTransport) Shutdown(code int, reason string) {
+	t.Close()
+}
+
+func (t *udpTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.listener.forget(t)
+	})
+	return nil
+}
+
+func (t *udpTransport) RemoteAddr() string {
+	return t.key
+}
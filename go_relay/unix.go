@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// unixListener is set by main when -unix-socket is given: a robot process
+// on the relay's machine skips TCP loopback and WebSocket framing, using
+// the same length-prefixed frames as -tcp-addr. Who may connect is up to
+// the socket file's permissions.
+var unixListener *StreamListener
+
+func listenUnix(path string) (*StreamListener, error) {
+	// A socket left behind by a relay that crashed would fail the bind
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamListener{name: "Unix", ln: ln}, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+
+	"go_relay/protocol"
+)
+
+// wtServer serves /wt/data over HTTP/3 when -webtransport-addr is set
+var wtServer *webtransport.Server
+
+// serveWebTransport runs the WebTransport listener on a UDP address. It
+// shares the TCP listener's certificates, so TLS must be configured.
+func serveWebTransport(addr string) error {
+	tlsConf, err := tlsConfig(config.TLS)
+	if err != nil {
+		return err
+	}
+	if tlsConf == nil {
+		return errors.New("webtransport requires TLS (-tls-cert or -autocert-domains)")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wt/data", handleWebTransport)
+	wtServer = &webtransport.Server{
+		H3: &http3.Server{
+			Addr:      addr,
+			TLSConfig: http3.ConfigureTLSConfig(tlsConf),
+			Handler:   corsMiddleware(mux),
+			QUICConfig: &quic.Config{
+				EnableDatagrams: true,
+				MaxIdleTimeout:  config.ReadTimeout,
+				KeepAlivePeriod: config.PingInterval,
+			},
+		},
+		CheckOrigin: upgrader.CheckOrigin,
+	}
+	slog.Info("WebTransport listener", "addr", addr, "network", "udp")
+	return wtServer.ListenAndServe()
+}
+
+// handleWebTransport accepts a WebTransport session. The client must open
+// one bidirectional stream straight away; it carries every frame except
+// twists, which travel as datagrams in both directions.
+func handleWebTransport(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		http.Error(w, "relay shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	peerType, robotID, err := parsePeerQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	meta, err := parsePeerMeta(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	release, err := limiter.acquire(r, peerType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	claims, authErr := auth.authorize(r, peerType)
+	if authErr == nil {
+		meta.ClientID, authErr = auth.clientID(claims, meta.ClientID)
+	}
+	if authErr == nil {
+		authErr = authorizeSupervisor(claims, &meta, peerType)
+	}
+
+	sess, err := wtServer.Upgrade(w, r)
+	if err != nil {
+		slog.Warn("WebTransport upgrade failed", "remote", r.RemoteAddr, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if authErr != nil {
+		sess.CloseWithError(webtransport.SessionErrorCode(closeCodeFor(authErr)), authErr.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(sess.Context(), config.ReadTimeout)
+	str, err := sess.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		slog.Warn("WebTransport session opened no stream", "remote", r.RemoteAddr, "err", err)
+		sess.CloseWithError(0, "no stream")
+		return
+	}
+
+	peer := newPeer(peerType, robotID, claims.Subject, newWTTransport(sess, str))
+	peer.Meta = meta
+	resumes.start(peer, r.URL.Query().Get("resume"))
+	servePeer(peer)
+}
+
+// wtTransport is a Transport over a WebTransport session. Frames on the
+// stream carry a uint16 length prefix; datagrams hold exactly one frame.
+type wtTransport struct {
+	sess *webtransport.Session
+	str  *webtransport.Stream
+	wbuf []byte // reused by the writer
+
+	in       chan []byte // frames from the stream and datagrams, merged
+	done     chan struct{}
+	failOnce sync.Once
+	err      error
+}
+
+// wtMaxFrame is the largest frame the length prefix can describe
+const wtMaxFrame = 1<<16 - 1
+
+func newWTTransport(sess *webtransport.Session, str *webtransport.Stream) *wtTransport {
+	t := &wtTransport{
+		sess: sess,
+		str:  str,
+		in:   make(chan []byte, 64),
+		done: make(chan struct{}),
+	}
+	go t.readStream()
+	go t.readDatagrams()
+	return t
+}
+
+func (t *wtTransport) fail(err error) {
+	t.failOnce.Do(func() {
+		t.err = err
+		close(t.done)
+	})
+}
+
+func (t *wtTransport) deliver(frame []byte) bool {
+	select {
+	case t.in <- frame:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+func (t *wtTransport) readStream() {
+	r := bufio.NewReader(t.str)
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			t.fail(err)
+			return
+		}
+		frame := make([]byte, binary.LittleEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			t.fail(err)
+			return
+		}
+		if !t.deliver(frame) {
+			return
+		}
+	}
+}
+
+func (t *wtTransport) readDatagrams() {
+	for {
+		frame, err := t.sess.ReceiveDatagram(t.sess.Context())
+		if err != nil {
+			t.fail(err)
+			return
+		}
+		if !t.deliver(frame) {
+			return
+		}
+	}
+}
+
+func (t *wtTransport) ReadFrame() ([]byte, error) {
+	select {
+	case frame := <-t.in:
+		return frame, nil
+	case <-t.done:
+		return nil, t.err
+	}
+}
+
+// WriteFrame sends twists as datagrams, falling back to the stream when a
+// datagram would be too large, and everything else on the stream
+func (t *wtTransport) WriteFrame(msg, trailer []byte) error {
+	if len(msg)+len(trailer) > wtMaxFrame {
+		return errors.New("frame too large for webtransport")
+	}
+	if len(msg) > 0 && msg[0] == protocol.MsgTypeTwist {
+		t.wbuf = append(append(t.wbuf[:0], msg...), trailer...)
+		var tooLarge *quic.DatagramTooLargeError
+		if err := t.sess.SendDatagram(t.wbuf); !errors.As(err, &tooLarge) {
+			return err
+		}
+	}
+
+	t.wbuf = binary.LittleEndian.AppendUint16(t.wbuf[:0], uint16(len(msg)+len(trailer)))
+	t.wbuf = append(append(t.wbuf, msg...), trailer...)
+	t.str.SetWriteDeadline(time.Now().Add(config.WriteTimeout))
+	_, err := t.str.Write(t.wbuf)
+	return err
+}
+
+// Ping is a no-op: QUIC keep-alives and the idle timeout, set from
+// -ping-interval and -read-timeout, already detect dead peers
+func (t *wtTransport) Ping() error {
+	return t.sess.Context().Err()
+}
+
+func (t *wtTransport) Shutdown(code int, reason string) {
+	t.sess.CloseWithError(webtransport.SessionErrorCode(code), reason)
+}
+
+func (t *wtTransport) Close() error {
+	t.fail(net.ErrClosed)
+	return t.sess.CloseWithError(0, "")
+}
+
+func (t *wtTransport) RemoteAddr() string {
+	return t.sess.RemoteAddr().String()
+}
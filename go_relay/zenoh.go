@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go_relay/protocol"
+)
+
+// zenohRetryDelay is how long a dropped subscription waits before
+// subscribing again
+const zenohRetryDelay = time.Second
+
+// ZenohOptions configures the Zenoh bridge; an empty router disables it
+type ZenohOptions struct {
+	Router    string `yaml:"router"`     // REST plugin of a zenohd router, e.g. http://localhost:8000
+	KeyPrefix string `yaml:"key_prefix"` // first chunk of every key
+	Robots    string `yaml:"robots"`     // comma-separated robots served from startup
+}
+
+// ZenohBridge drives robots through a Zenoh router, talking to its REST
+// plugin so the relay needs no Zenoh library. Twists are put on
+// <prefix>/<robot>/cmd_vel as CDR-encoded geometry_msgs/Twist, which
+// zenoh-bridge-dds (or zenoh-bridge-ros2dds) with scope <prefix>/<robot>
+// hands to the robot's /cmd_vel, and e-stop engages as a zero twist.
+// Samples on <prefix>/<robot>/ack and /telemetry are the robot's binary
+// Ack and Telemetry frames; an empty ack sample acks the last twist put.
+// A stock ROS 2 robot publishes neither, so robots listed in Robots are
+// served from startup and others join with their first sample.
+type ZenohBridge struct {
+	router string
+	prefix string
+	client *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	robots map[string]*zenohTransport // robot ID -> peer
+}
+
+// zenohBridge is set by main when a Zenoh router is configured
+var zenohBridge *ZenohBridge
+
+func connectZenoh(opts ZenohOptions) *ZenohBridge {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &ZenohBridge{
+		router: strings.TrimSuffix(opts.Router, "/"),
+		prefix: strings.Trim(opts.KeyPrefix, "/"),
+		client: &http.Client{Timeout: config.WriteTimeout},
+		ctx:    ctx,
+		cancel: cancel,
+		robots: make(map[string]*zenohTransport),
+	}
+	for _, key := range []string{"ack", "telemetry"} {
+		go b.subscribe(b.prefix + "/*/" + key)
+	}
+	for _, robotID := range strings.Split(opts.Robots, ",") {
+		if robotID = strings.TrimSpace(robotID); robotID != "" {
+			b.robot(robotID)
+		}
+	}
+	slog.Info("Zenoh bridge started", "router", b.router, "key_prefix", b.prefix)
+	return b
+}
+
+// zenohSample is one sample of the REST plugin's event stream
+type zenohSample struct {
+	Key      string          `json:"key"`
+	Value    json.RawMessage `json:"value"`
+	Encoding string          `json:"encoding"`
+}
+
+// payload returns the sample's bytes: the REST plugin base64-encodes
+// binary payloads and sends text ones as a JSON string
+func (s zenohSample) payload() ([]byte, error) {
+	var text string
+	if err := json.Unmarshal(s.Value, &text); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(s.Encoding, "application/octet-stream") || strings.HasPrefix(s.Encoding, "zenoh/bytes") {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+// subscribe follows the event stream of keyExpr, resubscribing whenever
+// the router drops it, until the bridge closes
+func (b *ZenohBridge) subscribe(keyExpr string) {
+	for b.ctx.Err() == nil {
+		if err := b.follow(keyExpr); err != nil && b.ctx.Err() == nil {
+			slog.Warn("Zenoh subscription lost", "key_expr", keyExpr, "err", err)
+		}
+		select {
+		case <-time.After(zenohRetryDelay):
+		case <-b.ctx.Done():
+		}
+	}
+}
+
+func (b *ZenohBridge) follow(keyExpr string) error {
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodGet, b.router+"/"+keyExpr, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req) // no timeout: the stream stays open
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("router answered %s", resp.Status)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		data, ok := strings.CutPrefix(sc.Text(), "data:")
+		if !ok {
+			continue
+		}
+		var s zenohSample
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &s); err != nil {
+			slog.Warn("Zenoh: bad sample", "key_expr", keyExpr, "err", err)
+			continue
+		}
+		b.handleSample(s)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return errors.New("stream ended")
+}
+
+// handleSample routes an ack or telemetry sample to its robot, serving
+// the robot on its first sample
+func (b *ZenohBridge) handleSample(s zenohSample) {
+	rest, ok := strings.CutPrefix(s.Key, b.prefix+"/")
+	robotID, key, ok2 := strings.Cut(rest, "/")
+	if !ok || !ok2 || robotID == "" || len(robotID) > config.RobotIDMaxLen {
+		return
+	}
+	frame, err := s.payload()
+	if err != nil {
+		slog.Warn("Zenoh: bad payload", "key", s.Key, "err", err)
+		return
+	}
+	t := b.robot(robotID)
+	if t == nil {
+		return
+	}
+	switch {
+	case key == "ack" && len(frame) == 0:
+		t.deliver(t.ackLast())
+	case key == "ack" && frame[0] == protocol.MsgTypeTwistAck,
+		key == "telemetry" && len(frame) > 0 && frame[0] == protocol.MsgTypeTelemetry:
+		t.deliver(frame)
+	}
+}
+
+// robot returns robotID's peer, serving it if it has none yet
+func (b *ZenohBridge) robot(robotID string) *zenohTransport {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.robots[robotID]
+	if t == nil && !draining.Load() && b.ctx.Err() == nil {
+		t = &zenohTransport{
+			bridge: b,
+			key:    b.prefix + "/" + robotID + "/cmd_vel",
+			in:     make(chan []byte, 64),
+			done:   make(chan struct{}),
+		}
+		b.robots[robotID] = t
+		peer := newPeer("python", robotID, "", t)
+		peer.Meta = PeerMeta{Name: "zenoh robot"}
+		go servePeer(peer)
+	}
+	return t
+}
+
+func (b *ZenohBridge) forget(t *zenohTransport) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, rt := range b.robots {
+		if rt == t {
+			delete(b.robots, id)
+		}
+	}
+}
+
+// put publishes payload on key through the REST plugin
+func (b *ZenohBridge) put(key string, payload []byte) error {
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodPut, b.router+"/"+key, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("zenoh put %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+func (b *ZenohBridge) close() {
+	b.cancel()
+}
+
+// zenohTransport is one robot reached through the router. It never
+// negotiates, so frames arrive without CRCs and trailers.
+type zenohTransport struct {
+	bridge *ZenohBridge
+	key    string // where twists for the robot are put
+
+	mu   sync.Mutex
+	last []byte // last twist put, for empty acks
+
+	in        chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *zenohTransport) deliver(frame []byte) {
+	if frame == nil {
+		return
+	}
+	select {
+	case t.in <- frame:
+	case <-t.done:
+	default:
+		metricDropped.WithLabelValues("python", OverflowDropNewest).Inc()
+	}
+}
+
+// ackLast acks the last twist put, with the robot's times set to now; nil
+// if no twist was put yet
+func (t *zenohTransport) ackLast() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	twist, err := protocol.UnmarshalTwist(t.last, true)
+	if err != nil {
+		return nil
+	}
+	now := currentTimeMs()
+	return protocol.AckFor(twist, now, now).Marshal()
+}
+
+// ReadFrame returns the robot's next ack or telemetry frame. There is no
+// read timeout: a stock ROS 2 robot never publishes, yet still drives.
+func (t *zenohTransport) ReadFrame() ([]byte, error) {
+	select {
+	case frame := <-t.in:
+		return frame, nil
+	case <-t.done:
+		return nil, net.ErrClosed
+	case <-t.bridge.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// WriteFrame puts twists and e-stop engages on the cmd_vel key; every
+// other frame has no ROS 2 equivalent and is dropped
+func (t *zenohTransport) WriteFrame(msg, trailer []byte) error {
+	var twist [6]float64
+	switch {
+	case len(msg) >= protocol.TwistToPythonSize && msg[0] == protocol.MsgTypeTwist:
+		t.mu.Lock()
+		t.last = append(t.last[:0], msg[:protocol.TwistToPythonSize]...)
+		t.mu.Unlock()
+		for i := range twist {
+			twist[i] = math.Float64frombits(binary.LittleEndian.Uint64(msg[17+8*i:]))
+		}
+	case len(msg) >= protocol.EStopSize && msg[0] == protocol.MsgTypeEStop && msg[1] == EStopEngage:
+		// zero twist
+	default:
+		return nil
+	}
+	return t.bridge.put(t.key, encodeCDRTwist(twist))
+}
+
+// encodeCDRTwist serializes geometry_msgs/Twist as little-endian CDR, the
+// payload zenoh-bridge-dds forwards to DDS unchanged: the encapsulation
+// header, then linear and angular x, y, z as float64
+func encodeCDRTwist(v [6]float64) []byte {
+	buf := make([]byte, 4, 4+8*len(v))
+	buf[1] = 0x01 // CDR_LE
+	for _, f := range v {
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(f))
+	}
+	return buf
+}
+
+// Ping has nothing to prove: the robot may never publish
+func (t *zenohTransport) Ping() error { return nil }
+
+// Shutdown just stops serving the robot; it is served again with its next
+// sample
+func (t *zenohTransport) Shutdown(code int, reason string) {
+	t.Close()
+}
+
+func (t *zenohTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.bridge.forget(t)
+	})
+	return nil
+}
+
+// RemoteAddr is the key the robot is driven on; the router hides its address
+func (t *zenohTransport) RemoteAddr() string {
+	return "zenoh:" + t.key
+}
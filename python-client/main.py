@@ -7,24 +7,46 @@ Receives binary Twist commands and sends binary acknowledgments
 with timing data for end-to-end latency measurement.
 
 Usage:
-    python main.py [--url ws://localhost:8080/ws/data] [--topic /cmd_vel]
+    python main.py [--url ws://localhost:8080/ws/data] [--topic /cmd_vel] [--robot default]
+    python main.py --udp relay-host:9090 [--robot default]   # relay -udp-addr
+    python main.py --tcp relay-host:9092 [--robot default]   # relay -tcp-addr
+    python main.py --unix /run/teleop/relay.sock             # relay -unix-socket
 """
 
 import asyncio
 import argparse
+import json
 import logging
+import math
+import os
 import signal
 import sys
 from collections import deque
-from dataclasses import dataclass
-from typing import Optional, Callable
+from dataclasses import dataclass, field
+from typing import Optional, Callable, Union
+from urllib.parse import urlencode
 
 import aiohttp
 
 from twist_protocol import (
     TwistWithLatency, TwistAck, LatencyTimestamps,
-    ClockSyncRequest, ClockSyncResponse,
-    MessageType, current_time_ms, perf_counter_us,
+    ClockSyncRequest, ClockSyncResponse, Telemetry, Odometry, Joy,
+    DRIVE_MODE_IDLE, DRIVE_MODE_TELEOP, ERROR_ESTOP,
+    MessageType, current_time_ms, perf_counter_us, encode_beacon_reply,
+    encode_hello, decode_welcome, append_crc, strip_crc, FEATURE_CRC32,
+    FEATURE_RELAY_SEQ, decode_relay_seq,
+    decode_session, encode_session_ack, decode_protocol_error,
+    ESTOP_ENGAGE, encode_udp_register, encode_media_chunks,
+    STREAM_LENGTH_SIZE, encode_stream_frame, decode_stream_length,
+    MEDIA_CODEC_JPEG, MEDIA_MAX_PAYLOAD, SUBPROTOCOL,
+    decode_command, encode_command_ack, COMMAND_STATUS_OK,
+    encode_raw, decode_raw, encode_chat, decode_chat,
+    FileChunk, encode_file_ack, decode_file_ack, FILE_FLAG_REQUEST, FILE_FLAG_LAST,
+    FILE_STATUS_OK, FILE_STATUS_COMPLETE, FILE_STATUS_REJECTED,
+    encode_param, decode_param, PARAM_GET, PARAM_SET, PARAM_OK, PARAM_UNKNOWN,
+    PARAM_INVALID, PARAM_READ_ONLY, PARAM_BAD_REQUEST,
+    decode_service_call, encode_service_response, SERVICE_OK, SERVICE_UNKNOWN, SERVICE_FAILED,
+    encode_diagnostics,
 )
 
 # Logging setup
@@ -35,6 +57,8 @@ logging.basicConfig(
 )
 logger = logging.getLogger("TwistClient")
 
+CLIENT_VERSION = "python-client/1.0"
+
 
 # =============================================================================
 # Optional ROS2 Integration
@@ -94,6 +118,31 @@ class ROS2Publisher:
             rclpy.shutdown()
 
 
+# =============================================================================
+# File Transfers
+# =============================================================================
+
+# Chunk size we send, window we grant uploads, and how long a download
+# waits for acks before resending from the acked offset
+FILE_CHUNK = 16 * 1024
+FILE_WINDOW = 256 * 1024
+FILE_RESEND_AFTER = 1.0
+
+
+@dataclass
+class FileDownload:
+    """A file we are sending to a browser."""
+    id: int
+    name: str
+    path: str
+    total: int
+    offset: int  # next byte to send
+    acked: int  # bytes the browser holds
+    window: int = FILE_WINDOW  # until its first ack says otherwise
+    progress: asyncio.Event = field(default_factory=asyncio.Event)
+    task: Optional[asyncio.Task] = None
+
+
 # =============================================================================
 # Statistics
 # =============================================================================
@@ -172,19 +221,96 @@ class ClockSync:
 class TwistClient:
     """WebSocket client for binary Twist messages."""
     
-    def __init__(self, url: str, on_twist: Optional[Callable] = None, ros2_topic: Optional[str] = None):
-        self.url = f"{url}?type=python" if "?" not in url else f"{url}&type=python"
+    def __init__(self, url: str, on_twist: Optional[Callable] = None, ros2_topic: Optional[str] = None,
+                 robot_id: str = "default", token: Optional[str] = None, name: str = "",
+                 client_id: str = "", room: str = "", telemetry_interval: float = 1.0, odometry_hz: float = 0.0,
+                 on_signal: Optional[Callable] = None, on_joy: Optional[Callable] = None,
+                 on_command: Optional[Callable] = None, on_raw: Optional[Callable] = None,
+                 on_chat: Optional[Callable] = None, file_dir: Optional[str] = None,
+                 params: Optional[dict] = None, on_param_set: Optional[Callable] = None,
+                 services: Optional[dict] = None):
+        sep = "&" if "?" in url else "?"
+        # The relay's Session frame replaces the JSON welcome
+        query = {"type": "python", "robot": robot_id, "version": CLIENT_VERSION, "welcome": "binary"}
+        if name:
+            query["name"] = name
+        if client_id:
+            query["client_id"] = client_id  # stable across reconnects, unlike the peer ID
+        if room:
+            query["room"] = room  # robot ID taken within the room
+        if ros2_topic:
+            query["capabilities"] = "ros2"
+        self.url = f"{url}{sep}{urlencode(query)}"
+        self._headers = {"Authorization": f"Bearer {token}"} if token else None
         self.on_twist = on_twist
+        self.on_joy = on_joy  # raw Joy frames, for robots that mix their own commands
+        # Reliable commands (parameter sets, waypoints): called once per
+        # command with (kind, payload), returns a status byte (None = OK).
+        # The relay retransmits until acked, so duplicates are re-acked
+        # with the remembered status instead of running it again.
+        self.on_command = on_command
+        self._command_status = {}
+        self._command_order = deque()
+        # Raw frames from browsers, passed through the relay uninterpreted:
+        # called with (channel, payload); send back with send_raw
+        self.on_raw = on_raw
+        # Operators' chat, forwarded with the relay's -chat-to-robot: called
+        # with (sender, text); logged if unset
+        self.on_chat = on_chat
+        # Parameters the driver may read and write (max speed, gains), by
+        # name; names in read_only_params may only be read. A set must keep
+        # the value's type (an int may set a float) and is first passed to
+        # on_param_set(name, value), which may return a status or raise to
+        # refuse it.
+        self.params = dict(params or {})
+        self.read_only_params = set()
+        self.on_param_set = on_param_set
+        # Services browsers may call, by name: called with the call's
+        # payload, may be a coroutine function, and returns the result
+        # (bytes, str or None) or raises to fail the call. A call still
+        # running at the relay's timeout is cancelled.
+        self.services = dict(services or {})
+        self._calls = set()
+        # WebRTC signaling from browsers (dicts with type, from, sdp/candidate);
+        # may be a coroutine function. Without one, offers are declined.
+        self.on_signal = on_signal
         
         self._session: Optional[aiohttp.ClientSession] = None
         self._ws: Optional[aiohttp.ClientWebSocketResponse] = None
         self._connected = False
+        self._crc = False  # negotiated in the Hello/Welcome exchange
+        self._relay_seq = False  # likewise
+        self._last_relay_seq = 0  # survives reconnects, as the relay's numbering does
         
         self._clock = ClockSync()
         self.stats = Stats()
         
         self._ros2 = ROS2Publisher(ros2_topic) if ros2_topic else None
         self._tasks = []
+        
+        # Sent every telemetry_interval seconds (0 disables); integrations
+        # update battery_pct and error_flags, we track mode and e-stop
+        self.telemetry = Telemetry()
+        self._telemetry_interval = telemetry_interval
+        self._last_twist = 0.0
+        
+        # Sent odometry_hz times a second (0 disables). Without a real
+        # estimator we dead-reckon from the last twist in the plane.
+        self.odometry = Odometry()
+        self._odometry_hz = odometry_hz
+        self._yaw = 0.0
+        
+        # Media frame IDs per channel, see send_media
+        self._media_frames = {}
+        self._media_chunk = MEDIA_MAX_PAYLOAD
+        
+        # File transfers: browsers upload into and download from file_dir
+        # (None refuses them). Uploads land as <name>.part until complete,
+        # so a reopened upload resumes from the part's size.
+        self.file_dir = file_dir
+        self._uploads = {}  # transfer ID -> open .part file
+        self._downloads = {}  # transfer ID -> FileDownload
+        self._file_chunk = FILE_CHUNK
     
     @property
     def connected(self) -> bool:
@@ -193,15 +319,23 @@ class TwistClient:
     async def connect(self) -> bool:
         try:
             self._session = aiohttp.ClientSession()
-            self._ws = await self._session.ws_connect(self.url, heartbeat=25.0)
+            self._ws = await self._session.ws_connect(self.url, heartbeat=25.0, headers=self._headers,
+                                                      protocols=(SUBPROTOCOL,))
             
-            # Wait for welcome
-            msg = await asyncio.wait_for(self._ws.receive(), timeout=5.0)
-            if msg.type == aiohttp.WSMsgType.TEXT:
-                import json
-                data = json.loads(msg.data)
-                if data.get("type") == "welcome":
-                    logger.info(f"Connected: {data.get('peer_id')}")
+            # Negotiate before sending anything else, since the CRC
+            # feature changes every frame that follows. Relays without the
+            # Session handshake send a JSON welcome first, which is skipped.
+            await self._ws.send_bytes(encode_hello())
+            while True:
+                msg = await asyncio.wait_for(self._ws.receive(), timeout=5.0)
+                if msg.type in (aiohttp.WSMsgType.CLOSE, aiohttp.WSMsgType.CLOSED):
+                    raise ConnectionError(f"Rejected by relay: {msg.data} {msg.extra}")
+                if msg.type == aiohttp.WSMsgType.BINARY and msg.data[0] == MessageType.WELCOME:
+                    version, features = decode_welcome(msg.data)
+                    self._crc = bool(features & FEATURE_CRC32)
+                    self._relay_seq = bool(features & FEATURE_RELAY_SEQ)
+                    logger.info(f"Relay protocol v{version}, features={features:#x}")
+                    break
             
             self._connected = True
             
@@ -211,6 +345,10 @@ class TwistClient:
             # Start tasks
             self._tasks.append(asyncio.create_task(self._recv_loop()))
             self._tasks.append(asyncio.create_task(self._sync_loop()))
+            if self._telemetry_interval > 0:
+                self._tasks.append(asyncio.create_task(self._telemetry_loop()))
+            if self._odometry_hz > 0:
+                self._tasks.append(asyncio.create_task(self._odometry_loop()))
             
             await self._send_sync()
             return True
@@ -226,7 +364,7 @@ class TwistClient:
                 if msg.type == aiohttp.WSMsgType.BINARY:
                     await self._handle_binary(msg.data)
                 elif msg.type == aiohttp.WSMsgType.TEXT:
-                    pass  # Ignore JSON messages
+                    await self._handle_text(msg.data)
                 elif msg.type in (aiohttp.WSMsgType.CLOSE, aiohttp.WSMsgType.CLOSED):
                     break
         except asyncio.CancelledError:
@@ -235,17 +373,80 @@ class TwistClient:
             logger.error(f"Recv error: {e}")
         self._connected = False
     
+    async def _handle_text(self, text: str):
+        try:
+            msg = json.loads(text)
+        except ValueError:
+            return
+        kind = msg.get("type", "")
+        if not kind.startswith("webrtc_"):
+            return
+        if kind == "webrtc_error":
+            logger.warning(f"Signaling error: {msg.get('error')} ({msg.get('request')} to {msg.get('to')})")
+            return
+        if self.on_signal is None:
+            if kind == "webrtc_offer":
+                logger.info(f"Declining WebRTC offer from {msg.get('from')}: no signaling handler")
+                await self.send_signal({"type": "webrtc_hangup", "to": msg.get("from"), "reason": "unsupported"})
+            return
+        try:
+            result = self.on_signal(msg)
+            if asyncio.iscoroutine(result):
+                await result
+        except Exception as e:
+            logger.error(f"Signal callback error: {e}")
+    
+    async def send_signal(self, msg: dict):
+        """Send a WebRTC signaling message; msg["to"] names the browser's peer ID."""
+        if not self.connected:
+            return
+        try:
+            await self._ws.send_str(json.dumps(msg))
+        except Exception as e:
+            logger.error(f"Signal send error: {e}")
+    
     async def _handle_binary(self, data: bytes):
         if len(data) < 1:
             return
         
+        if self._crc:
+            data = strip_crc(data)
+            if data is None:
+                logger.warning("Dropped frame with bad CRC")
+                return
+        
         msg_type = data[0]
         rx_time = current_time_ms()
         
         if msg_type == MessageType.TWIST:
             await self._handle_twist(data, rx_time)
+        elif msg_type == MessageType.JOY:
+            await self._handle_joy(data, rx_time)
+        elif msg_type == MessageType.COMMAND:
+            await self._handle_command(data)
+        elif msg_type == MessageType.RAW:
+            self._handle_raw(data, rx_time)
+        elif msg_type == MessageType.CHAT:
+            self._handle_chat(data)
+        elif msg_type == MessageType.FILE_CHUNK:
+            await self._handle_file_chunk(data)
+        elif msg_type == MessageType.FILE_ACK:
+            self._handle_file_ack(data)
+        elif msg_type == MessageType.PARAM_REQUEST:
+            await self._handle_param(data)
+        elif msg_type == MessageType.SERVICE_CALL:
+            self._handle_service_call(data)
         elif msg_type == MessageType.CLOCK_SYNC_RESPONSE:
             self._handle_sync_response(data)
+        elif msg_type == MessageType.SYNC_BEACON:
+            await self._send_beacon_reply(data, rx_time)
+        elif msg_type == MessageType.ESTOP and len(data) >= 2:
+            self._handle_estop(data[1] == ESTOP_ENGAGE)
+        elif msg_type == MessageType.SESSION:
+            await self._handle_session(data)
+        elif msg_type == MessageType.PROTOCOL_ERROR and len(data) >= 7:
+            reason, bad_type, expected, got = decode_protocol_error(data)
+            logger.error(f"Relay rejected frame type 0x{bad_type:02x} ({got} bytes, expected {expected}): {reason}")
     
     async def _handle_twist(self, data: bytes, rx_time: int):
         # Decode
@@ -259,6 +460,12 @@ class TwistClient:
         
         twist.timestamps.t3_python_rx = rx_time
         twist.timestamps.python_decode_us = decode_us
+        if self._relay_seq:
+            self._check_relay_seq(decode_relay_seq(data))
+        if twist.message_id != 0:  # 0 is the relay's deadman stop
+            self._last_twist = asyncio.get_running_loop().time()
+        self.odometry.linear_x = twist.linear_x
+        self.odometry.angular_z = twist.angular_z
         
         # Process
         process_start = perf_counter_us()
@@ -281,7 +488,324 @@ class TwistClient:
         
         logger.debug(f"Twist #{twist.message_id}: lat={latency}ms")
     
-    async def _send_ack(self, twist: TwistWithLatency):
+    def _check_relay_seq(self, seq: Optional[int]):
+        # The relay numbers every twist to this robot whichever browser
+        # sent it, so a gap is a lost twist even across drivers
+        if seq is None:
+            return
+        last, self._last_relay_seq = self._last_relay_seq, seq
+        if last and seq > last + 1:
+            logger.warning(f"Lost {seq - last - 1} twist(s) before relay #{seq}")
+        elif last and seq <= last:
+            logger.warning(f"Twist relay #{seq} arrived after #{last} (reordered, or the relay restarted)")
+    
+    async def _handle_joy(self, data: bytes, rx_time: int):
+        decode_start = perf_counter_us()
+        try:
+            joy = Joy.decode(data)
+        except Exception as e:
+            logger.error(f"Decode error: {e} (size={len(data)})")
+            return
+        joy.timestamps.t3_python_rx = rx_time
+        joy.timestamps.python_decode_us = perf_counter_us() - decode_start
+        self._last_twist = asyncio.get_running_loop().time()
+        
+        process_start = perf_counter_us()
+        if self.on_joy:
+            try:
+                self.on_joy(joy)
+            except Exception as e:
+                logger.error(f"Joy callback error: {e}")
+        joy.timestamps.python_process_us = perf_counter_us() - process_start
+        
+        # Acked like a twist, so browsers see the same latency breakdown
+        await self._send_ack(joy)
+        logger.debug(f"Joy #{joy.message_id}: axes={joy.axes} buttons={joy.buttons:#x}")
+    
+    async def _handle_command(self, data: bytes):
+        try:
+            msg_id, kind, payload = decode_command(data)
+        except ValueError as e:
+            logger.error(f"Decode error: {e} (size={len(data)})")
+            return
+        status = self._command_status.get(msg_id)
+        if status is None:
+            status = COMMAND_STATUS_OK
+            if self.on_command:
+                try:
+                    status = self.on_command(kind, payload)
+                    status = COMMAND_STATUS_OK if status is None else int(status) & 0xFF
+                except Exception as e:
+                    logger.error(f"Command callback error: {e}")
+                    status = 0xFF
+            self._command_status[msg_id] = status
+            self._command_order.append(msg_id)
+            if len(self._command_order) > 1024:
+                self._command_status.pop(self._command_order.popleft(), None)
+            logger.info(f"Command #{msg_id} kind={kind} ({len(payload)} bytes): status {status}")
+        else:
+            logger.debug(f"Command #{msg_id} retransmitted, re-acking")
+        try:
+            await self._send(encode_command_ack(msg_id, status))
+        except Exception as e:
+            logger.error(f"Send command ack error: {e}")
+    
+    def _handle_raw(self, data: bytes, rx_time: int):
+        try:
+            channel, t_send, t_relay_rx, _, payload = decode_raw(data)
+        except ValueError as e:
+            logger.error(f"Decode error: {e} (size={len(data)})")
+            return
+        logger.debug(f"Raw on channel {channel} ({len(payload)} bytes), "
+                     f"relay rx +{t_relay_rx - t_send}ms, here +{rx_time - t_send}ms")
+        if self.on_raw:
+            try:
+                self.on_raw(channel, payload)
+            except Exception as e:
+                logger.error(f"Raw callback error: {e}")
+    
+    def _handle_chat(self, data: bytes):
+        try:
+            sender, text = decode_chat(data)
+        except ValueError as e:
+            logger.error(f"Decode error: {e} (size={len(data)})")
+            return
+        if not self.on_chat:
+            logger.info(f"Chat from {sender}: {text}")
+            return
+        try:
+            self.on_chat(sender, text)
+        except Exception as e:
+            logger.error(f"Chat callback error: {e}")
+    
+    async def send_chat(self, text: str):
+        """Tell the robot's operators something, e.g. that it is docking."""
+        if not self.connected:
+            return
+        try:
+            await self._send(encode_chat(text))
+        except Exception as e:
+            logger.error(f"Chat send error: {e}")
+    
+    async def send_diagnostics(self, statuses: list):
+        """Report components' DiagnosticStatus; the relay alerts operators of any in DIAG_ERROR."""
+        if not self.connected or not statuses:
+            return
+        try:
+            for i in range(0, len(statuses), 255):
+                await self._send(encode_diagnostics(statuses[i:i + 255]))
+        except Exception as e:
+            logger.error(f"Diagnostics send error: {e}")
+    
+    async def _handle_param(self, data: bytes):
+        try:
+            request_id, op, name, value = decode_param(data)
+        except ValueError as e:
+            logger.error(f"Decode error: {e} (size={len(data)})")
+            await self._send_param(request_id=int.from_bytes(data[1:9], 'little'), status=PARAM_BAD_REQUEST, name="")
+            return
+        status = self._apply_param(op, name, value)
+        if op == PARAM_SET:
+            logger.info(f"Param {name} = {value!r}: status {status}")
+        await self._send_param(request_id, status, name)
+    
+    def _apply_param(self, op: int, name: str, value) -> int:
+        """Status of a get or set of name; a successful set is applied."""
+        if op not in (PARAM_GET, PARAM_SET):
+            return PARAM_BAD_REQUEST
+        if name not in self.params:
+            return PARAM_UNKNOWN
+        if op == PARAM_GET:
+            return PARAM_OK
+        if name in self.read_only_params:
+            return PARAM_READ_ONLY
+        current = self.params[name]
+        if isinstance(current, float) and isinstance(value, int) and not isinstance(value, bool):
+            value = float(value)
+        if type(value) is not type(current):
+            return PARAM_INVALID
+        if self.on_param_set:
+            try:
+                status = self.on_param_set(name, value)
+            except Exception as e:
+                logger.error(f"Param callback error: {e}")
+                return PARAM_INVALID
+            if status is not None and int(status) != PARAM_OK:
+                return int(status) & 0xFF
+        self.params[name] = value
+        return PARAM_OK
+    
+    async def _send_param(self, request_id: int, status: int, name: str):
+        """Answer a Param Request with the value now in effect, if any."""
+        value = self.params.get(name) if status == PARAM_OK else None
+        try:
+            await self._send(encode_param(request_id, status, name, value, response=True))
+        except Exception as e:
+            logger.error(f"Send param response error: {e}")
+    
+    def _handle_service_call(self, data: bytes):
+        try:
+            call_id, timeout_ms, service, payload = decode_service_call(data)
+        except ValueError as e:
+            logger.error(f"Decode error: {e} (size={len(data)})")
+            return
+        # Run apart from the receive loop, so slow services don't hold up twists
+        task = asyncio.create_task(self._run_service(call_id, timeout_ms, service, payload))
+        self._calls.add(task)
+        task.add_done_callback(self._calls.discard)
+    
+    async def _run_service(self, call_id: int, timeout_ms: int, service: str, payload: bytes):
+        handler = self.services.get(service)
+        status, result = SERVICE_OK, b''
+        if handler is None:
+            status = SERVICE_UNKNOWN
+        else:
+            try:
+                result = handler(payload)
+                if asyncio.iscoroutine(result):
+                    result = await asyncio.wait_for(result, timeout_ms / 1000 if timeout_ms else None)
+                if result is None:
+                    result = b''
+                elif isinstance(result, str):
+                    result = result.encode('utf-8')
+            except asyncio.TimeoutError:
+                logger.warning(f"Service {service} call #{call_id} timed out after {timeout_ms}ms")
+                return  # the relay has answered for us
+            except Exception as e:
+                logger.error(f"Service {service} call #{call_id} failed: {e}")
+                status, result = SERVICE_FAILED, str(e).encode('utf-8')
+        logger.debug(f"Service {service} call #{call_id}: status {status} ({len(result)} bytes)")
+        try:
+            await self._send(encode_service_response(call_id, status, service, bytes(result)))
+        except Exception as e:
+            logger.error(f"Send service response error: {e}")
+    
+    def _file_path(self, name: str) -> Optional[str]:
+        """Where transfers of name live, or None if refused."""
+        base = os.path.basename(name)
+        if not self.file_dir or not base or base != name or base.startswith('.'):
+            return None
+        return os.path.join(self.file_dir, base)
+    
+    async def _handle_file_chunk(self, data: bytes):
+        try:
+            chunk = FileChunk.decode(data)
+        except ValueError as e:
+            logger.error(f"Decode error: {e} (size={len(data)})")
+            return
+        path = self._file_path(chunk.name)
+        if path is None:
+            logger.warning(f"File transfer of {chunk.name!r} refused")
+            await self._send_file_ack(chunk.transfer_id, FILE_STATUS_REJECTED)
+            return
+        if chunk.flags & FILE_FLAG_REQUEST:
+            self._start_download(chunk, path)
+            return
+        
+        f = self._uploads.get(chunk.transfer_id)
+        if f is None:
+            # A leftover part resumes the upload unless it is too long
+            f = open(path + '.part', 'ab')
+            if f.tell() > chunk.total:
+                f.truncate(0)
+                f.seek(0)
+            self._uploads[chunk.transfer_id] = f
+            logger.info(f"Upload of {chunk.name} ({chunk.total} bytes) from offset {f.tell()}")
+        if chunk.data and chunk.offset == f.tell():
+            f.write(chunk.data)
+        if f.tell() < chunk.total:
+            await self._send_file_ack(chunk.transfer_id, FILE_STATUS_OK, f.tell(), FILE_WINDOW)
+            return
+        f.close()
+        del self._uploads[chunk.transfer_id]
+        os.replace(path + '.part', path)
+        logger.info(f"Upload of {chunk.name} complete")
+        await self._send_file_ack(chunk.transfer_id, FILE_STATUS_COMPLETE, chunk.total)
+    
+    def _start_download(self, chunk: FileChunk, path: str):
+        old = self._downloads.get(chunk.transfer_id)
+        if old is not None:  # asked again after a reconnect
+            old.task.cancel()
+        if not os.path.isfile(path):
+            asyncio.create_task(self._send_file_ack(chunk.transfer_id, FILE_STATUS_REJECTED))
+            return
+        total = os.path.getsize(path)
+        if total == 0:
+            asyncio.create_task(self._send(FileChunk(transfer_id=chunk.transfer_id, offset=0, total=0,
+                                                     name=chunk.name, flags=FILE_FLAG_LAST).encode()))
+            return
+        dl = FileDownload(id=chunk.transfer_id, name=chunk.name, path=path, total=total,
+                          offset=chunk.offset, acked=chunk.offset)
+        self._downloads[chunk.transfer_id] = dl
+        dl.task = asyncio.create_task(self._serve_download(dl))
+        logger.info(f"Download of {chunk.name} ({total} bytes) from offset {chunk.offset}")
+    
+    async def _serve_download(self, dl: 'FileDownload'):
+        """Send dl's chunks within the browser's window, going back to the
+        acked offset whenever acks stall (a chunk lost over UDP). Runs until
+        the browser acks the end or the relay aborts."""
+        try:
+            with open(dl.path, 'rb') as f:
+                while True:
+                    limit = min(dl.acked + dl.window, dl.total)
+                    if self.connected and dl.offset < limit:
+                        f.seek(dl.offset)
+                        data = f.read(min(self._file_chunk, limit - dl.offset))
+                        if not data:
+                            break  # the file shrank
+                        flags = FILE_FLAG_LAST if dl.offset + len(data) >= dl.total else 0
+                        await self._send(FileChunk(transfer_id=dl.id, offset=dl.offset, total=dl.total,
+                                                   name=dl.name, data=data, flags=flags).encode())
+                        dl.offset += len(data)
+                        continue
+                    dl.progress.clear()
+                    try:
+                        await asyncio.wait_for(dl.progress.wait(), FILE_RESEND_AFTER)
+                    except asyncio.TimeoutError:
+                        dl.offset = dl.acked
+        except asyncio.CancelledError:
+            pass
+        except Exception as e:
+            logger.error(f"Download of {dl.name} failed: {e}")
+        finally:
+            if self._downloads.get(dl.id) is dl:
+                del self._downloads[dl.id]
+    
+    def _handle_file_ack(self, data: bytes):
+        try:
+            tid, status, offset, window = decode_file_ack(data)
+        except ValueError:
+            return
+        dl = self._downloads.get(tid)
+        if dl is None:
+            f = self._uploads.pop(tid, None)
+            if f is not None:  # the relay gave up on an upload; its part stays
+                f.close()
+            return
+        if status != FILE_STATUS_OK:
+            logger.info(f"Download of {dl.name} ended with status {status} at {offset} bytes")
+            dl.task.cancel()
+            return
+        dl.acked, dl.window = max(dl.acked, offset), window
+        dl.progress.set()
+    
+    async def _send_file_ack(self, transfer_id: int, status: int, offset: int = 0, window: int = 0):
+        try:
+            await self._send(encode_file_ack(transfer_id, status, offset, window))
+        except Exception as e:
+            logger.error(f"File ack send error: {e}")
+    
+    async def send_raw(self, channel: int, payload: bytes):
+        """Send payload to the robot's browsers on a Raw channel; the relay
+        forwards it without interpreting it."""
+        if not self.connected:
+            return
+        try:
+            await self._send(encode_raw(channel, payload))
+        except Exception as e:
+            logger.error(f"Raw send error: {e}")
+    
+    async def _send_ack(self, twist: Union[TwistWithLatency, Joy]):
         if not self.connected:
             return
         
@@ -299,11 +823,23 @@ class TwistClient:
         data = ack.encode()
         
         try:
-            await self._ws.send_bytes(data)
+            await self._send(data)
             self.stats.ack_count += 1
         except Exception as e:
             logger.error(f"Send ack error: {e}")
     
+    def _handle_estop(self, engaged: bool):
+        # The relay withholds twists while stopped; we only need to halt now
+        if engaged:
+            logger.warning("E-STOP engaged")
+            self.telemetry.error_flags |= ERROR_ESTOP
+            self.odometry.linear_x = self.odometry.angular_z = 0.0
+            if self._ros2:
+                self._ros2.publish(TwistWithLatency(message_id=0))
+        else:
+            logger.info("E-stop released")
+            self.telemetry.error_flags &= ~ERROR_ESTOP
+    
     def _handle_sync_response(self, data: bytes):
         t4 = current_time_ms()
         try:
@@ -321,15 +857,81 @@ class TwistClient:
         except asyncio.CancelledError:
             pass
     
+    async def _telemetry_loop(self):
+        try:
+            while self.connected:
+                # Driven if a twist arrived within the last interval
+                recent = asyncio.get_running_loop().time() - self._last_twist < max(self._telemetry_interval, 1.0)
+                self.telemetry.drive_mode = DRIVE_MODE_TELEOP if recent else DRIVE_MODE_IDLE
+                try:
+                    await self._send(self.telemetry.encode())
+                except Exception as e:
+                    logger.error(f"Telemetry send error: {e}")
+                await asyncio.sleep(self._telemetry_interval)
+        except asyncio.CancelledError:
+            pass
+    
+    async def _odometry_loop(self):
+        dt = 1.0 / self._odometry_hz
+        odom = self.odometry
+        try:
+            while self.connected:
+                self._yaw += odom.angular_z * dt
+                odom.x += odom.linear_x * math.cos(self._yaw) * dt
+                odom.y += odom.linear_x * math.sin(self._yaw) * dt
+                odom.qz, odom.qw = math.sin(self._yaw / 2), math.cos(self._yaw / 2)
+                try:
+                    await self._send(odom.encode())
+                except Exception as e:
+                    logger.error(f"Odometry send error: {e}")
+                await asyncio.sleep(dt)
+        except asyncio.CancelledError:
+            pass
+    
+    async def send_media(self, channel: int, payload: bytes, codec: int = MEDIA_CODEC_JPEG,
+                         keyframe: bool = True):
+        """Push one camera frame (e.g. a JPEG) to the robot's browsers on channel.
+        
+        The relay queues media apart from acks and drops whole frames when a
+        viewer falls behind, so callers can send at the camera's rate.
+        """
+        if not self.connected:
+            return
+        frame_id = self._media_frames.get(channel, 0) + 1
+        self._media_frames[channel] = frame_id
+        try:
+            for chunk in encode_media_chunks(channel, frame_id, payload, codec, keyframe, self._media_chunk):
+                await self._send(chunk)
+        except Exception as e:
+            logger.error(f"Media send error: {e}")
+    
     async def _send_sync(self):
         if not self.connected:
             return
         req = ClockSyncRequest(t1=current_time_ms())
         try:
-            await self._ws.send_bytes(req.encode())
+            await self._send(req.encode())
         except Exception as e:
             logger.error(f"Sync send error: {e}")
     
+    async def _send(self, data: bytes):
+        await self._ws.send_bytes(append_crc(data) if self._crc else data)
+    
+    async def _handle_session(self, data: bytes):
+        try:
+            version, relay_time, peer_id, robot_id = decode_session(data)
+            await self._send(encode_session_ack(relay_time))
+        except Exception as e:
+            logger.error(f"Session error: {e}")
+            return
+        logger.info(f"Connected: {peer_id} serving {robot_id} (protocol v{version})")
+    
+    async def _send_beacon_reply(self, data: bytes, rx_time: int):
+        try:
+            await self._send(encode_beacon_reply(data, rx_time))
+        except Exception as e:
+            logger.error(f"Beacon reply error: {e}")
+    
     async def _cleanup(self):
         for task in self._tasks:
             task.cancel()
@@ -348,9 +950,250 @@ class TwistClient:
     async def close(self):
         logger.info("Closing...")
         self._connected = False
+        for dl in list(self._downloads.values()):
+            dl.task.cancel()
+        for task in list(self._calls):
+            task.cancel()
+        for f in self._uploads.values():
+            f.close()  # parts stay, to resume
+        self._uploads.clear()
         await self._cleanup()
 
 
+# =============================================================================
+# UDP Client
+# =============================================================================
+
+class _DatagramQueue(asyncio.DatagramProtocol):
+    def __init__(self):
+        self.queue: asyncio.Queue = asyncio.Queue()
+    
+    def datagram_received(self, data: bytes, addr):
+        self.queue.put_nowait(data)
+    
+    def error_received(self, exc):
+        logger.warning(f"UDP error: {exc}")
+
+
+class UdpTwistClient(TwistClient):
+    """Same protocol over the relay's -udp-addr: one frame per datagram.
+    
+    Lost twists are not retransmitted. The relay beacons us every ping
+    interval; if nothing at all arrives for `timeout` seconds we consider
+    the relay gone.
+    """
+    
+    def __init__(self, addr: str, robot_id: str = "default", token: Optional[str] = None,
+                 timeout: float = 60.0, **kwargs):
+        super().__init__(url="", robot_id=robot_id, token=token, **kwargs)
+        host, _, port = addr.rpartition(":")
+        self._addr = (host or "localhost", int(port))
+        self._robot_id = robot_id
+        self._token = token
+        self._timeout = timeout
+        self._media_chunk = 1024  # keep datagrams within the relay's 2 KB
+        self._file_chunk = 1024
+        self._transport: Optional[asyncio.DatagramTransport] = None
+        self._proto: Optional[_DatagramQueue] = None
+    
+    @property
+    def connected(self) -> bool:
+        return self._connected and self._transport is not None
+    
+    async def connect(self) -> bool:
+        try:
+            loop = asyncio.get_running_loop()
+            self._transport, self._proto = await loop.create_datagram_endpoint(
+                _DatagramQueue, remote_addr=self._addr)
+            
+            # Registration doubles as the Hello; retry since it may be lost
+            for _ in range(5):
+                self._transport.sendto(encode_udp_register(self._robot_id, self._token))
+                try:
+                    data = await asyncio.wait_for(self._proto.queue.get(), timeout=1.0)
+                except asyncio.TimeoutError:
+                    continue
+                if data[0] == MessageType.WELCOME:
+                    version, features = decode_welcome(data)
+                    self._crc = bool(features & FEATURE_CRC32)
+                    self._relay_seq = bool(features & FEATURE_RELAY_SEQ)
+                    logger.info(f"Registered over UDP with {self._addr[0]}:{self._addr[1]}, "
+                                f"protocol v{version}, features={features:#x}")
+                    break
+            else:
+                raise ConnectionError("No Welcome from relay (rejected or unreachable)")
+            
+            self._connected = True
+            if self._ros2:
+                self._ros2.init()
+            self._tasks.append(asyncio.create_task(self._recv_loop()))
+            self._tasks.append(asyncio.create_task(self._sync_loop()))
+            if self._telemetry_interval > 0:
+                self._tasks.append(asyncio.create_task(self._telemetry_loop()))
+            if self._odometry_hz > 0:
+                self._tasks.append(asyncio.create_task(self._odometry_loop()))
+            await self._send_sync()
+            return True
+        
+        except Exception as e:
+            logger.error(f"Connect failed: {e}")
+            await self._cleanup()
+            return False
+    
+    async def _recv_loop(self):
+        try:
+            while True:
+                data = await asyncio.wait_for(self._proto.queue.get(), timeout=self._timeout)
+                await self._handle_binary(data)
+        except asyncio.TimeoutError:
+            logger.error(f"Nothing from relay for {self._timeout:.0f}s, giving up")
+        except asyncio.CancelledError:
+            pass
+        except Exception as e:
+            logger.error(f"Recv error: {e}")
+        self._connected = False
+    
+    async def _send(self, data: bytes):
+        self._transport.sendto(append_crc(data) if self._crc else data)
+    
+    async def send_signal(self, msg: dict):
+        logger.warning("WebRTC signaling needs a WebSocket connection to the relay")
+    
+    async def _cleanup(self):
+        for task in self._tasks:
+            task.cancel()
+            try:
+                await task
+            except asyncio.CancelledError:
+                pass
+        if self._transport:
+            self._transport.close()
+        if self._ros2:
+            self._ros2.shutdown()
+
+
+# =============================================================================
+# TCP Client
+# =============================================================================
+
+class TcpTwistClient(TwistClient):
+    """Same protocol over the relay's -tcp-addr: length-prefixed frames on
+    one TCP stream, for robots without a WebSocket stack.
+    
+    The relay beacons us every ping interval; if nothing at all arrives
+    for `timeout` seconds we consider the relay gone.
+    """
+    
+    def __init__(self, addr: str, robot_id: str = "default", token: Optional[str] = None,
+                 timeout: float = 60.0, **kwargs):
+        super().__init__(url="", robot_id=robot_id, token=token, **kwargs)
+        host, _, port = addr.rpartition(":")
+        self._addr = (host or "localhost", int(port))
+        self._robot_id = robot_id
+        self._token = token
+        self._timeout = timeout
+        self._reader: Optional[asyncio.StreamReader] = None
+        self._writer: Optional[asyncio.StreamWriter] = None
+    
+    @property
+    def connected(self) -> bool:
+        return self._connected and self._writer is not None
+    
+    def _describe(self) -> str:
+        return f"TCP with {self._addr[0]}:{self._addr[1]}"
+    
+    async def _open(self):
+        return await asyncio.open_connection(*self._addr)
+    
+    async def connect(self) -> bool:
+        try:
+            self._reader, self._writer = await self._open()
+            
+            # Registration doubles as the Hello
+            self._writer.write(encode_stream_frame(encode_udp_register(self._robot_id, self._token)))
+            try:
+                data = await asyncio.wait_for(self._read_frame(), timeout=5.0)
+            except (asyncio.TimeoutError, asyncio.IncompleteReadError):
+                raise ConnectionError("No Welcome from relay (rejected or unreachable)")
+            if data[0] != MessageType.WELCOME:
+                raise ConnectionError(f"Expected Welcome, got type {data[0]:#x}")
+            version, features = decode_welcome(data)
+            self._crc = bool(features & FEATURE_CRC32)
+            self._relay_seq = bool(features & FEATURE_RELAY_SEQ)
+            logger.info(f"Registered over {self._describe()}, "
+                        f"protocol v{version}, features={features:#x}")
+            
+            self._connected = True
+            if self._ros2:
+                self._ros2.init()
+            self._tasks.append(asyncio.create_task(self._recv_loop()))
+            self._tasks.append(asyncio.create_task(self._sync_loop()))
+            if self._telemetry_interval > 0:
+                self._tasks.append(asyncio.create_task(self._telemetry_loop()))
+            if self._odometry_hz > 0:
+                self._tasks.append(asyncio.create_task(self._odometry_loop()))
+            await self._send_sync()
+            return True
+        
+        except Exception as e:
+            logger.error(f"Connect failed: {e}")
+            await self._cleanup()
+            return False
+    
+    async def _read_frame(self) -> bytes:
+        header = await self._reader.readexactly(STREAM_LENGTH_SIZE)
+        return await self._reader.readexactly(decode_stream_length(header))
+    
+    async def _recv_loop(self):
+        try:
+            while True:
+                data = await asyncio.wait_for(self._read_frame(), timeout=self._timeout)
+                await self._handle_binary(data)
+        except asyncio.TimeoutError:
+            logger.error(f"Nothing from relay for {self._timeout:.0f}s, giving up")
+        except asyncio.IncompleteReadError:
+            logger.warning("Relay closed the connection")
+        except asyncio.CancelledError:
+            pass
+        except Exception as e:
+            logger.error(f"Recv error: {e}")
+        self._connected = False
+    
+    async def _send(self, data: bytes):
+        self._writer.write(encode_stream_frame(append_crc(data) if self._crc else data))
+        await self._writer.drain()
+    
+    async def send_signal(self, msg: dict):
+        logger.warning("WebRTC signaling needs a WebSocket connection to the relay")
+    
+    async def _cleanup(self):
+        for task in self._tasks:
+            task.cancel()
+            try:
+                await task
+            except asyncio.CancelledError:
+                pass
+        if self._writer:
+            self._writer.close()
+        if self._ros2:
+            self._ros2.shutdown()
+
+
+class UnixTwistClient(TcpTwistClient):
+    """TcpTwistClient over the relay's -unix-socket, for a robot process on
+    the relay's own machine."""
+    
+    def __init__(self, path: str, **kwargs):
+        super().__init__(":0", **kwargs)
+        self._path = path
+    
+    def _describe(self) -> str:
+        return f"Unix socket {self._path}"
+    
+    async def _open(self):
+        return await asyncio.open_unix_connection(self._path)
+
+
 # =============================================================================
 # Main
 # =============================================================================
@@ -358,25 +1201,86 @@ class TwistClient:
 def parse_args():
     parser = argparse.ArgumentParser(description="Twist Client - Binary Protocol")
     parser.add_argument("--url", "-u", default="ws://localhost:8080/ws/data")
+    parser.add_argument("--udp", default=None, metavar="HOST:PORT",
+                        help="Connect over UDP to the relay's -udp-addr instead of WebSocket")
+    parser.add_argument("--tcp", default=None, metavar="HOST:PORT",
+                        help="Connect over TCP to the relay's -tcp-addr instead of WebSocket")
+    parser.add_argument("--unix", default=None, metavar="PATH",
+                        help="Connect to the relay's -unix-socket on this machine instead of WebSocket")
     parser.add_argument("--topic", "-t", default=None, help="ROS2 topic")
+    parser.add_argument("--robot", "-r", default="default", help="Robot ID to register as")
+    parser.add_argument("--token", default=None, help="JWT with 'python' scope (relay JWT_SECRET set)")
+    parser.add_argument("--name", default="", help="Display name reported to the relay")
+    parser.add_argument("--client-id", default="",
+                        help="Stable identity reported to the relay (must match the token's subject with auth)")
+    parser.add_argument("--room", default="",
+                        help="Relay room to serve the robot in, isolating it from other experiments")
+    parser.add_argument("--telemetry-interval", type=float, default=1.0,
+                        help="Seconds between telemetry frames (0 disables)")
+    parser.add_argument("--odometry-hz", type=float, default=10.0,
+                        help="Dead-reckoned odometry frames per second (0 disables)")
+    parser.add_argument("--file-dir", default=None, metavar="DIR",
+                        help="Directory browsers may upload files into and download them from (default: refuse)")
+    parser.add_argument("--param", action="append", default=[], metavar="NAME=VALUE",
+                        help="Parameter the driver may read and set, e.g. max_speed=1.0 (repeatable; "
+                             "the value's type, bool, int, float or string, is kept)")
     parser.add_argument("--verbose", "-v", action="store_true")
     return parser.parse_args()
 
 
+def parse_param(arg: str) -> tuple:
+    """NAME=VALUE -> (name, value), the value a bool, int, float or str."""
+    name, sep, text = arg.partition("=")
+    if not sep or not name:
+        raise ValueError(f"--param {arg!r}: expected NAME=VALUE")
+    if text in ("true", "false"):
+        return name, text == "true"
+    for cast in (int, float):
+        try:
+            return name, cast(text)
+        except ValueError:
+            pass
+    return name, text
+
+
 async def main():
     args = parse_args()
     if args.verbose:
         logging.getLogger().setLevel(logging.DEBUG)
+    try:
+        params = dict(parse_param(p) for p in args.param)
+    except ValueError as e:
+        sys.exit(str(e))
     
     print("""
 ╔═══════════════════════════════════════════════════════════╗
 ║     Twist Client - Binary Protocol                        ║
 ╚═══════════════════════════════════════════════════════════╝
     """)
-    print(f"URL:   {args.url}")
+    url = ('udp://' + args.udp if args.udp else 'tcp://' + args.tcp if args.tcp
+           else 'unix://' + args.unix if args.unix else args.url)
+    print(f"URL:   {url}")
+    print(f"Robot: {args.robot}")
     print(f"Topic: {args.topic or 'disabled'}\n")
     
-    client = TwistClient(url=args.url, ros2_topic=args.topic)
+    if args.udp:
+        # UDP registrations carry no room; name the robot within it instead
+        robot_id = f"{args.room}/{args.robot}" if args.room else args.robot
+        client = UdpTwistClient(args.udp, ros2_topic=args.topic, robot_id=robot_id, token=args.token,
+                                telemetry_interval=args.telemetry_interval, odometry_hz=args.odometry_hz,
+                                file_dir=args.file_dir, params=params)
+    elif args.tcp or args.unix:
+        # Like UDP, stream registrations carry no room
+        robot_id = f"{args.room}/{args.robot}" if args.room else args.robot
+        kwargs = dict(ros2_topic=args.topic, robot_id=robot_id, token=args.token,
+                      telemetry_interval=args.telemetry_interval, odometry_hz=args.odometry_hz,
+                      file_dir=args.file_dir, params=params)
+        client = TcpTwistClient(args.tcp, **kwargs) if args.tcp else UnixTwistClient(args.unix, **kwargs)
+    else:
+        client = TwistClient(url=args.url, ros2_topic=args.topic, robot_id=args.robot, token=args.token,
+                             name=args.name, client_id=args.client_id, room=args.room,
+                             telemetry_interval=args.telemetry_interval,
+                             odometry_hz=args.odometry_hz, file_dir=args.file_dir, params=params)
     
     shutdown = asyncio.Event()
     loop = asyncio.get_event_loop()
@@ -1,6 +1,7 @@
 
 import struct
 import time
+import zlib
 from dataclasses import dataclass, field
 from enum import IntEnum
 from typing import Optional
@@ -16,6 +17,30 @@ class MessageType(IntEnum):
     TWIST_ACK = 0x02
     CLOCK_SYNC_REQUEST = 0x03
     CLOCK_SYNC_RESPONSE = 0x04
+    ESTOP = 0x05
+    TELEMETRY = 0x06
+    ODOMETRY = 0x07
+    MEDIA = 0x08
+    JOY = 0x09
+    SYNC_BEACON = 0x12
+    BEACON_REPLY = 0x13
+    HELLO = 0x14
+    WELCOME = 0x15
+    SESSION = 0x1B
+    SESSION_ACK = 0x1C
+    PROTOCOL_ERROR = 0x1D
+    COMMAND = 0x20
+    COMMAND_ACK = 0x21
+    RAW = 0x22
+    CHAT = 0x23
+    FILE_CHUNK = 0x24
+    FILE_ACK = 0x25
+    PARAM_REQUEST = 0x26
+    PARAM_RESPONSE = 0x27
+    SERVICE_CALL = 0x28
+    SERVICE_RESPONSE = 0x29
+    DIAGNOSTICS = 0x2A
+    DIAG_ALERT = 0x2B
 
 
 # Binary format strings for struct.pack/unpack
@@ -39,6 +64,97 @@ CLOCK_SYNC_REQUEST_SIZE = 9
 CLOCK_SYNC_RESPONSE_FORMAT = '<BQQQ'  # type + t1 + t2 + t3 = 25 bytes
 CLOCK_SYNC_RESPONSE_SIZE = 25
 
+ESTOP_ENGAGE = 0x01   # second byte of an E-Stop frame
+ESTOP_RELEASE = 0x02
+
+TELEMETRY_FORMAT = '<BQfBI'  # type + robot time + battery % + drive mode + error flags = 18 bytes
+TELEMETRY_SIZE = 18
+
+ODOMETRY_FORMAT = '<BQ13d'  # type + robot time + position + quaternion + linear + angular = 113 bytes
+ODOMETRY_SIZE = 113
+ODOMETRY_BROWSER_SIZE = 129  # Above + t_relay_rx + t_relay_tx
+
+JOY_HEADER_FORMAT = '<BQQIB'  # type + msg_id + t1 + button bitmap + axis count = 22 bytes, then float32 axes
+JOY_HEADER_SIZE = 22
+JOY_MAX_AXES = 16
+
+MEDIA_HEADER_FORMAT = '<BBBBIHH'  # type + channel + codec + flags + frame ID + fragment index/count = 12 bytes
+MEDIA_HEADER_SIZE = 12
+MEDIA_MAX_PAYLOAD = 64 * 1024
+MEDIA_CODEC_OPAQUE = 0
+MEDIA_CODEC_JPEG = 1
+MEDIA_CODEC_H264 = 2
+MEDIA_FLAG_KEYFRAME = 1 << 0
+
+DRIVE_MODE_UNKNOWN = 0
+DRIVE_MODE_IDLE = 1
+DRIVE_MODE_TELEOP = 2
+DRIVE_MODE_AUTONOMOUS = 3
+DRIVE_MODE_CHARGING = 4
+
+ERROR_ESTOP = 1 << 0
+ERROR_MOTOR = 1 << 1
+ERROR_LOW_BATTERY = 1 << 2
+ERROR_SENSOR = 1 << 3
+
+SYNC_BEACON_SIZE = 9   # relay-initiated, same layout as CLOCK_SYNC_REQUEST
+BEACON_REPLY_SIZE = 25  # same layout as CLOCK_SYNC_RESPONSE
+
+HELLO_FORMAT = '<BBI'  # type + protocol version + feature bits = 6 bytes (Welcome too)
+HELLO_SIZE = 6
+
+PROTOCOL_VERSION = 2
+SUBPROTOCOL = 'teleop.binary.v1'  # WebSocket subprotocol of /ws/data
+FEATURE_ROBOT_TRAILER = 1 << 0
+FEATURE_RELAY_TIMESTAMPS = 1 << 1
+FEATURE_CRC32 = 1 << 2  # every frame but Hello/Welcome ends in a CRC32
+FEATURE_SESSION = 1 << 5  # binary Session after the Welcome, answered by a Session Ack (v2)
+FEATURE_RELAY_SEQ = 1 << 9  # twists carry the relay's per-robot sequence number after the trailer
+RELAY_SEQ_SIZE = 8
+
+SESSION_MIN_SIZE = 12  # type + version + relay time + peer ID length + robot ID length
+SESSION_ACK_FORMAT = '<BQQ'  # type + echoed relay time + our time = 17 bytes
+PROTOCOL_ERROR_FORMAT = '<BBBHH'  # type + code + offending type + expected size + received size = 7 bytes
+PROTOCOL_ERRORS = {1: 'unknown type', 2: 'too short', 3: 'too long', 4: 'bad CRC', 5: 'no trace block', 6: 'bad CBOR', 7: 'bad protobuf'}
+
+COMMAND_HEADER_FORMAT = '<BQB'  # type + msg_id + kind = 10 bytes, then the payload
+COMMAND_HEADER_SIZE = 10
+COMMAND_ACK_FORMAT = '<BQB'  # type + msg_id + status = 10 bytes
+COMMAND_STATUS_OK = 0
+
+RAW_HEADER_FORMAT = '<BHQQQ'  # type + channel + t_send + t_relay_rx + t_relay_tx = 27 bytes, then the payload
+RAW_HEADER_SIZE = 27
+FILE_CHUNK_FORMAT = '<BIBQQB'  # type + transfer ID + flags + offset + total + name length = 23 bytes, then name and data
+FILE_CHUNK_MIN_SIZE = 23
+FILE_ACK_FORMAT = '<BIBQI'  # type + transfer ID + status + offset + window = 18 bytes
+FILE_MAX_CHUNK = 64 * 1024
+FILE_FLAG_REQUEST = 1 << 0  # download request: send the named file from offset
+FILE_FLAG_LAST = 1 << 1
+FILE_STATUS_OK, FILE_STATUS_COMPLETE, FILE_STATUS_REJECTED, FILE_STATUS_ABORTED = 0, 1, 2, 3
+
+PARAM_HEADER_FORMAT = '<BQBBB'  # type + request ID + op/status + value type + name length = 12 bytes, then name and value
+PARAM_MIN_SIZE = 12
+PARAM_GET, PARAM_SET = 1, 2
+PARAM_OK, PARAM_UNKNOWN, PARAM_INVALID, PARAM_READ_ONLY = 0, 1, 2, 3
+# Answered by the relay itself
+PARAM_NOT_DRIVER, PARAM_TIMEOUT, PARAM_NO_ROBOT, PARAM_BAD_REQUEST, PARAM_BUSY = 4, 5, 6, 7, 8
+PARAM_NONE, PARAM_BOOL, PARAM_INT, PARAM_FLOAT, PARAM_STRING = 0, 1, 2, 3, 4
+
+SERVICE_CALL_FORMAT = '<BQIB'  # type + call ID + timeout ms + service length = 14 bytes, then service and payload
+SERVICE_CALL_MIN_SIZE = 14
+SERVICE_RESPONSE_FORMAT = '<BQBB'  # type + call ID + status + service length = 11 bytes, then service and payload
+SERVICE_RESPONSE_MIN_SIZE = 11
+SERVICE_OK, SERVICE_UNKNOWN, SERVICE_FAILED = 0, 1, 2
+# Answered by the relay itself
+SERVICE_TIMEOUT, SERVICE_NO_ROBOT, SERVICE_BUSY, SERVICE_FORBIDDEN = 3, 4, 5, 6
+
+DIAGNOSTICS_MIN_SIZE = 10  # type + robot time + status count, then the statuses
+DIAG_OK, DIAG_WARN, DIAG_ERROR, DIAG_STALE = 0, 1, 2, 3  # as ROS diagnostic_msgs/DiagnosticStatus
+
+CHAT_MIN_SIZE = 10  # type + t_send + sender length, then the sender (the relay's to fill in) and UTF-8 text
+
+CRC_SIZE = 4
+
 
 # =============================================================================
 # UTILITY FUNCTIONS
@@ -174,6 +290,39 @@ class TwistWithLatency:
                 f"ang:({self.angular_x:.2f},{self.angular_y:.2f},{self.angular_z:.2f})]")
 
 
+@dataclass
+class Joy:
+    """Raw joystick axes (each -1..1) and buttons, acked like a twist."""
+    axes: list = field(default_factory=list)
+    buttons: int = 0  # bit i = button i pressed
+    message_id: int = 0
+    timestamps: LatencyTimestamps = field(default_factory=LatencyTimestamps)
+    
+    def button(self, i: int) -> bool:
+        return bool(self.buttons >> i & 1)
+    
+    def encode(self) -> bytes:
+        """Encode to the browser layout (22 + 4N bytes)."""
+        return struct.pack(JOY_HEADER_FORMAT, MessageType.JOY, self.message_id,
+                           self.timestamps.t1_browser_send, self.buttons, len(self.axes)) + \
+            struct.pack(f'<{len(self.axes)}f', *self.axes)
+    
+    @classmethod
+    def decode(cls, data: bytes, relay_timestamps: bool = True) -> 'Joy':
+        """Decode a Joy frame; from the relay t2/t3 follow the axes."""
+        if len(data) < JOY_HEADER_SIZE or data[0] != MessageType.JOY:
+            raise ValueError("Not a Joy frame")
+        _, msg_id, t1, buttons, n = struct.unpack(JOY_HEADER_FORMAT, data[:JOY_HEADER_SIZE])
+        size = JOY_HEADER_SIZE + 4 * n
+        if n > JOY_MAX_AXES or len(data) < size + (16 if relay_timestamps else 0):
+            raise ValueError(f"Bad Joy frame: {n} axes in {len(data)} bytes")
+        ts = LatencyTimestamps(t1_browser_send=t1)
+        if relay_timestamps:
+            ts.t2_relay_rx, ts.t3_relay_tx = struct.unpack('<QQ', data[size:size + 16])
+        axes = list(struct.unpack(f'<{n}f', data[JOY_HEADER_SIZE:size]))
+        return cls(axes=axes, buttons=buttons, message_id=msg_id, timestamps=ts)
+
+
 @dataclass
 class TwistAck:
     
@@ -277,6 +426,336 @@ class ClockSyncResponse:
         return cls(t1=values[1], t2=values[2], t3=values[3])
 
 
+@dataclass
+class Telemetry:
+    """Robot telemetry (18 bytes), sent periodically and cached by the relay."""
+    battery_pct: float = 100.0
+    drive_mode: int = DRIVE_MODE_IDLE
+    error_flags: int = 0
+    
+    def encode(self, robot_time: Optional[int] = None) -> bytes:
+        return struct.pack(TELEMETRY_FORMAT, MessageType.TELEMETRY,
+                           current_time_ms() if robot_time is None else robot_time,
+                           self.battery_pct, self.drive_mode, self.error_flags)
+    
+    @classmethod
+    def decode(cls, data: bytes) -> 'Telemetry':
+        if len(data) < TELEMETRY_SIZE:
+            raise ValueError(f"Expected {TELEMETRY_SIZE} bytes")
+        _, _, battery, mode, flags = struct.unpack(TELEMETRY_FORMAT, data[:TELEMETRY_SIZE])
+        return cls(battery_pct=battery, drive_mode=mode, error_flags=flags)
+
+
+@dataclass
+class Odometry:
+    """Robot pose and velocities (113 bytes), relayed to web peers."""
+    x: float = 0.0
+    y: float = 0.0
+    z: float = 0.0
+    qx: float = 0.0
+    qy: float = 0.0
+    qz: float = 0.0
+    qw: float = 1.0
+    linear_x: float = 0.0
+    linear_y: float = 0.0
+    linear_z: float = 0.0
+    angular_x: float = 0.0
+    angular_y: float = 0.0
+    angular_z: float = 0.0
+    
+    def encode(self, robot_time: Optional[int] = None) -> bytes:
+        return struct.pack(ODOMETRY_FORMAT, MessageType.ODOMETRY,
+                           current_time_ms() if robot_time is None else robot_time,
+                           self.x, self.y, self.z, self.qx, self.qy, self.qz, self.qw,
+                           self.linear_x, self.linear_y, self.linear_z,
+                           self.angular_x, self.angular_y, self.angular_z)
+    
+    @classmethod
+    def decode(cls, data: bytes) -> 'Odometry':
+        if len(data) < ODOMETRY_SIZE:
+            raise ValueError(f"Expected {ODOMETRY_SIZE} bytes")
+        return cls(*struct.unpack(ODOMETRY_FORMAT, data[:ODOMETRY_SIZE])[2:])
+
+
+def encode_media_chunks(channel: int, frame_id: int, payload: bytes,
+                        codec: int = MEDIA_CODEC_JPEG, keyframe: bool = True,
+                        max_payload: int = MEDIA_MAX_PAYLOAD) -> list:
+    """Split one camera frame into Media Chunks of at most max_payload bytes."""
+    parts = [payload[i:i + max_payload] for i in range(0, len(payload), max_payload)] or [b'']
+    flags = MEDIA_FLAG_KEYFRAME if keyframe else 0
+    return [struct.pack(MEDIA_HEADER_FORMAT, MessageType.MEDIA, channel, codec, flags,
+                        frame_id & 0xFFFFFFFF, i, len(parts)) + part
+            for i, part in enumerate(parts)]
+
+
+def encode_beacon_reply(beacon: bytes, t2: int) -> bytes:
+    """Answer a relay Sync Beacon: echo its t1 with our receive/send times."""
+    if len(beacon) < SYNC_BEACON_SIZE:
+        raise ValueError(f"Expected {SYNC_BEACON_SIZE} bytes")
+    t1 = struct.unpack('<Q', beacon[1:SYNC_BEACON_SIZE])[0]
+    return struct.pack(CLOCK_SYNC_RESPONSE_FORMAT, MessageType.BEACON_REPLY, t1, t2, current_time_ms())
+
+
+def encode_hello(version: int = PROTOCOL_VERSION,
+                 features: int = FEATURE_ROBOT_TRAILER | FEATURE_RELAY_TIMESTAMPS | FEATURE_CRC32 | FEATURE_SESSION
+                 | FEATURE_RELAY_SEQ) -> bytes:
+    """Hello (6 bytes): the highest version and the features we understand."""
+    return struct.pack(HELLO_FORMAT, MessageType.HELLO, version, features)
+
+
+def decode_welcome(data: bytes) -> tuple:
+    """Welcome (6 bytes) -> (negotiated version, negotiated features)."""
+    if len(data) < HELLO_SIZE:
+        raise ValueError(f"Expected {HELLO_SIZE} bytes")
+    _, version, features = struct.unpack(HELLO_FORMAT, data[:HELLO_SIZE])
+    return version, features
+
+
+def decode_relay_seq(twist: bytes) -> Optional[int]:
+    """The relay sequence number following a relay twist's robot trailer, if any."""
+    offset = TWIST_RELAY_SIZE
+    if len(twist) > offset:
+        offset += 1 + twist[offset]
+    if len(twist) < offset + RELAY_SEQ_SIZE:
+        return None
+    return struct.unpack_from('<Q', twist, offset)[0]
+
+
+def decode_session(data: bytes) -> tuple:
+    """Session (12+ bytes) -> (version, relay time ms, peer ID, robot ID)."""
+    if len(data) < SESSION_MIN_SIZE:
+        raise ValueError(f"Expected at least {SESSION_MIN_SIZE} bytes")
+    version, relay_time = data[1], struct.unpack('<Q', data[2:10])[0]
+    n = data[10]
+    peer_id = data[11:11 + n].decode('utf-8')
+    m = data[11 + n]
+    robot_id = data[12 + n:12 + n + m].decode('utf-8')
+    return version, relay_time, peer_id, robot_id
+
+
+def encode_session_ack(relay_time: int) -> bytes:
+    """Session Ack (17 bytes): echo the Session's relay time with ours."""
+    return struct.pack(SESSION_ACK_FORMAT, MessageType.SESSION_ACK, relay_time, current_time_ms())
+
+
+def decode_protocol_error(data: bytes) -> tuple:
+    """Protocol Error (7 bytes) -> (reason, offending type, expected size, received size)."""
+    _, code, msg_type, expected, got = struct.unpack(PROTOCOL_ERROR_FORMAT, data[:7])
+    return PROTOCOL_ERRORS.get(code, f"code {code}"), msg_type, expected, got
+
+
+def decode_command(data: bytes) -> tuple:
+    """Command (10+ bytes) -> (message ID, kind, payload)."""
+    if len(data) < COMMAND_HEADER_SIZE:
+        raise ValueError(f"Expected at least {COMMAND_HEADER_SIZE} bytes")
+    _, msg_id, kind = struct.unpack(COMMAND_HEADER_FORMAT, data[:COMMAND_HEADER_SIZE])
+    return msg_id, kind, data[COMMAND_HEADER_SIZE:]
+
+
+def encode_command_ack(msg_id: int, status: int = COMMAND_STATUS_OK) -> bytes:
+    """Command Ack (10 bytes): the command's message ID and our status."""
+    return struct.pack(COMMAND_ACK_FORMAT, MessageType.COMMAND_ACK, msg_id, status)
+
+
+def encode_raw(channel: int, payload: bytes) -> bytes:
+    """Raw (27+ bytes): an opaque payload on channel, relay times left 0."""
+    return struct.pack(RAW_HEADER_FORMAT, MessageType.RAW, channel, current_time_ms(), 0, 0) + payload
+
+
+def decode_raw(data: bytes) -> tuple:
+    """Raw (27+ bytes) -> (channel, t_send, t_relay_rx, t_relay_tx, payload)."""
+    if len(data) < RAW_HEADER_SIZE:
+        raise ValueError(f"Expected at least {RAW_HEADER_SIZE} bytes")
+    _, channel, t_send, t_relay_rx, t_relay_tx = struct.unpack(RAW_HEADER_FORMAT, data[:RAW_HEADER_SIZE])
+    return channel, t_send, t_relay_rx, t_relay_tx, data[RAW_HEADER_SIZE:]
+
+
+def encode_chat(text: str) -> bytes:
+    """Chat (10+ bytes): our text; the relay fills in the sender."""
+    return struct.pack('<BQB', MessageType.CHAT, current_time_ms(), 0) + text.encode('utf-8')
+
+
+def decode_chat(data: bytes) -> tuple:
+    """Chat (10+ bytes) -> (sender, text)."""
+    if len(data) < CHAT_MIN_SIZE or len(data) < CHAT_MIN_SIZE + data[9]:
+        raise ValueError(f"Expected at least {CHAT_MIN_SIZE} bytes and the sender")
+    end = CHAT_MIN_SIZE + data[9]
+    return data[CHAT_MIN_SIZE:end].decode('utf-8', 'replace'), data[end:].decode('utf-8', 'replace')
+
+
+@dataclass
+class FileChunk:
+    """File Chunk (23+ bytes): a piece of a transfer between browser and robot."""
+    transfer_id: int
+    offset: int
+    total: int
+    name: str = ""
+    data: bytes = b""
+    flags: int = 0
+    
+    def encode(self) -> bytes:
+        name = self.name.encode('utf-8')
+        return struct.pack(FILE_CHUNK_FORMAT, MessageType.FILE_CHUNK, self.transfer_id, self.flags,
+                           self.offset, self.total, len(name)) + name + self.data
+    
+    @classmethod
+    def decode(cls, data: bytes) -> 'FileChunk':
+        if len(data) < FILE_CHUNK_MIN_SIZE or len(data) < FILE_CHUNK_MIN_SIZE + data[22]:
+            raise ValueError(f"Expected at least {FILE_CHUNK_MIN_SIZE} bytes and the name")
+        _, tid, flags, offset, total, n = struct.unpack(FILE_CHUNK_FORMAT, data[:FILE_CHUNK_MIN_SIZE])
+        end = FILE_CHUNK_MIN_SIZE + n
+        return cls(transfer_id=tid, offset=offset, total=total, flags=flags,
+                   name=data[FILE_CHUNK_MIN_SIZE:end].decode('utf-8', 'replace'), data=data[end:])
+
+
+def encode_file_ack(transfer_id: int, status: int, offset: int = 0, window: int = 0) -> bytes:
+    """File Ack (18 bytes): how much arrived in order, and how far past it to send."""
+    return struct.pack(FILE_ACK_FORMAT, MessageType.FILE_ACK, transfer_id, status, offset, window)
+
+
+def decode_file_ack(data: bytes) -> tuple:
+    """File Ack (18 bytes) -> (transfer ID, status, offset, window)."""
+    if len(data) < 18:
+        raise ValueError("Expected 18 bytes")
+    _, tid, status, offset, window = struct.unpack(FILE_ACK_FORMAT, data[:18])
+    return tid, status, offset, window
+
+
+def encode_param(request_id: int, code: int, name: str, value=None, response: bool = False) -> bytes:
+    """Param Request or Response (12+ bytes): op or status, name and a bool, int, float, str or no value."""
+    if value is None:
+        vtype, raw = PARAM_NONE, b''
+    elif isinstance(value, bool):
+        vtype, raw = PARAM_BOOL, bytes([value])
+    elif isinstance(value, int):
+        vtype, raw = PARAM_INT, struct.pack('<q', value)
+    elif isinstance(value, float):
+        vtype, raw = PARAM_FLOAT, struct.pack('<d', value)
+    elif isinstance(value, str):
+        vtype, raw = PARAM_STRING, value.encode('utf-8')
+    else:
+        raise ValueError(f"Unsupported parameter value {value!r}")
+    msg_type = MessageType.PARAM_RESPONSE if response else MessageType.PARAM_REQUEST
+    name_bytes = name.encode('utf-8')
+    return struct.pack(PARAM_HEADER_FORMAT, msg_type, request_id, code, vtype, len(name_bytes)) + name_bytes + raw
+
+
+def decode_param(data: bytes) -> tuple:
+    """Param Request or Response (12+ bytes) -> (request ID, op or status, name, value)."""
+    if len(data) < PARAM_MIN_SIZE or len(data) < PARAM_MIN_SIZE + data[11]:
+        raise ValueError(f"Expected at least {PARAM_MIN_SIZE} bytes and the name")
+    _, request_id, code, vtype, n = struct.unpack(PARAM_HEADER_FORMAT, data[:PARAM_MIN_SIZE])
+    end = PARAM_MIN_SIZE + n
+    name, raw = data[PARAM_MIN_SIZE:end].decode('utf-8', 'replace'), data[end:]
+    if vtype == PARAM_NONE:
+        value = None
+    elif vtype == PARAM_BOOL and len(raw) >= 1:
+        value = raw[0] != 0
+    elif vtype == PARAM_INT and len(raw) >= 8:
+        value = struct.unpack('<q', raw[:8])[0]
+    elif vtype == PARAM_FLOAT and len(raw) >= 8:
+        value = struct.unpack('<d', raw[:8])[0]
+    elif vtype == PARAM_STRING:
+        value = raw.decode('utf-8', 'replace')
+    else:
+        raise ValueError(f"Bad parameter value (type {vtype}, {len(raw)} bytes)")
+    return request_id, code, name, value
+
+
+def encode_service_call(call_id: int, service: str, payload: bytes = b'', timeout_ms: int = 0) -> bytes:
+    """Service Call (14+ bytes): the service's name and payload; timeout 0 is the relay's default."""
+    name = service.encode('utf-8')
+    return struct.pack(SERVICE_CALL_FORMAT, MessageType.SERVICE_CALL, call_id, timeout_ms, len(name)) + name + payload
+
+
+def decode_service_call(data: bytes) -> tuple:
+    """Service Call (14+ bytes) -> (call ID, timeout ms, service, payload)."""
+    if len(data) < SERVICE_CALL_MIN_SIZE or len(data) < SERVICE_CALL_MIN_SIZE + data[13]:
+        raise ValueError(f"Expected at least {SERVICE_CALL_MIN_SIZE} bytes and the service")
+    _, call_id, timeout_ms, n = struct.unpack(SERVICE_CALL_FORMAT, data[:SERVICE_CALL_MIN_SIZE])
+    end = SERVICE_CALL_MIN_SIZE + n
+    return call_id, timeout_ms, data[SERVICE_CALL_MIN_SIZE:end].decode('utf-8', 'replace'), data[end:]
+
+
+def encode_service_response(call_id: int, status: int, service: str, payload: bytes = b'') -> bytes:
+    """Service Response (11+ bytes): our status and result for a call."""
+    name = service.encode('utf-8')
+    return struct.pack(SERVICE_RESPONSE_FORMAT, MessageType.SERVICE_RESPONSE, call_id, status, len(name)) + name + payload
+
+
+def decode_service_response(data: bytes) -> tuple:
+    """Service Response (11+ bytes) -> (call ID, status, service, payload)."""
+    if len(data) < SERVICE_RESPONSE_MIN_SIZE or len(data) < SERVICE_RESPONSE_MIN_SIZE + data[10]:
+        raise ValueError(f"Expected at least {SERVICE_RESPONSE_MIN_SIZE} bytes and the service")
+    _, call_id, status, n = struct.unpack(SERVICE_RESPONSE_FORMAT, data[:SERVICE_RESPONSE_MIN_SIZE])
+    end = SERVICE_RESPONSE_MIN_SIZE + n
+    return call_id, status, data[SERVICE_RESPONSE_MIN_SIZE:end].decode('utf-8', 'replace'), data[end:]
+
+
+@dataclass
+class DiagnosticStatus:
+    """One component's state in a Diagnostics frame, like ROS diagnostic_msgs/DiagnosticStatus."""
+    name: str
+    level: int = DIAG_OK
+    message: str = ""
+    hardware_id: str = ""
+    values: dict = field(default_factory=dict)
+    
+    def encode(self) -> bytes:
+        out = bytearray([self.level])
+        for s in (self.name, self.message, self.hardware_id):
+            out += _diag_string(s)
+        out.append(len(self.values))
+        for key, value in self.values.items():
+            out += _diag_string(key) + _diag_string(str(value))
+        return bytes(out)
+
+
+def _diag_string(s: str) -> bytes:
+    b = s.encode('utf-8')[:255]
+    return bytes([len(b)]) + b
+
+
+def encode_diagnostics(statuses: list, robot_time: Optional[int] = None) -> bytes:
+    """Diagnostics (10+ bytes): up to 255 component statuses."""
+    if len(statuses) > 255:
+        raise ValueError(f"{len(statuses)} statuses, at most 255 per frame")
+    t = current_time_ms() if robot_time is None else robot_time
+    return struct.pack('<BQB', MessageType.DIAGNOSTICS, t, len(statuses)) + b''.join(s.encode() for s in statuses)
+
+
+def encode_udp_register(robot_id: str = "", token: Optional[str] = None) -> bytes:
+    """Hello + robot ID trailer (+ token): registers a robot over UDP."""
+    rid = robot_id.encode('utf-8')
+    return encode_hello() + bytes([len(rid)]) + rid + (token or '').encode('utf-8')
+
+
+STREAM_LENGTH_SIZE = 4  # uint32 length before each frame over TCP
+
+
+def encode_stream_frame(data: bytes) -> bytes:
+    """Prefix a frame with its length, for the relay's -tcp-addr."""
+    return struct.pack('<I', len(data)) + data
+
+
+def decode_stream_length(header: bytes) -> int:
+    """Length of the frame following a STREAM_LENGTH_SIZE header."""
+    return struct.unpack('<I', header)[0]
+
+
+def append_crc(data: bytes) -> bytes:
+    """Append the little-endian CRC32 (IEEE) of data."""
+    return data + struct.pack('<I', zlib.crc32(data))
+
+
+def strip_crc(data: bytes) -> Optional[bytes]:
+    """Verify and remove a CRC32 trailer; None if it doesn't match."""
+    if len(data) <= CRC_SIZE:
+        return None
+    body, crc = data[:-CRC_SIZE], struct.unpack('<I', data[-CRC_SIZE:])[0]
+    return body if zlib.crc32(body) == crc else None
+
+
 # =============================================================================
 # SELF-TEST
 # =============================================================================
@@ -351,6 +830,51 @@ if __name__ == "__main__":
     resp_encoded = resp.encode()
     print(f"   Response size: {len(resp_encoded)} bytes (expected: 25)")
     
+    tel = Telemetry(battery_pct=87.5, drive_mode=DRIVE_MODE_TELEOP, error_flags=ERROR_LOW_BATTERY)
+    tel_encoded = tel.encode()
+    print(f"   Telemetry size: {len(tel_encoded)} bytes (expected: 18)")
+    print(f"   Telemetry round trip: {Telemetry.decode(tel_encoded) == tel}")
+    
+    odom = Odometry(x=1.5, y=-0.25, qz=0.7071, qw=0.7071, linear_x=0.5, angular_z=0.1)
+    odom_encoded = odom.encode()
+    print(f"   Odometry size: {len(odom_encoded)} bytes (expected: 113)")
+    print(f"   Odometry round trip: {Odometry.decode(odom_encoded) == odom}")
+    
+    joy = Joy(axes=[0.5, -1.0], buttons=0b101, message_id=7)
+    joy_relay = joy.encode() + struct.pack('<QQ', 1000, 1001)
+    print(f"   Joy size: {len(joy.encode())} bytes (expected: 30)")
+    print(f"   Joy round trip: {Joy.decode(joy_relay).axes == joy.axes and Joy.decode(joy_relay).button(2)}")
+    
+    session = bytes([MessageType.SESSION, 2]) + struct.pack('<Q', 1000) + b'\x02p1\x02r1'
+    print(f"   Session decode: {decode_session(session)} (expected: (2, 1000, 'p1', 'r1'))")
+    print(f"   Session Ack size: {len(encode_session_ack(1000))} bytes (expected: 17)")
+    
+    chunks = encode_media_chunks(channel=0, frame_id=1, payload=bytes(150_000))
+    print(f"   Media chunks: {len(chunks)} (expected: 3), "
+          f"largest {max(len(c) for c in chunks)} bytes (expected: {MEDIA_HEADER_SIZE + MEDIA_MAX_PAYLOAD})")
+    
+    raw = encode_raw(7, b'hello')
+    print(f"   Raw size: {len(raw)} bytes (expected: 32), decode: {decode_raw(raw)[0::4]} (expected: (7, b'hello'))")
+    
+    chunk = FileChunk(transfer_id=3, offset=0, total=5, name='map.yaml', data=b'hello', flags=FILE_FLAG_LAST)
+    print(f"   File chunk round trip: {FileChunk.decode(chunk.encode()) == chunk}, "
+          f"ack size: {len(encode_file_ack(3, FILE_STATUS_COMPLETE, 5))} bytes (expected: 18)")
+    
+    chat = encode_chat('hi')[:9] + b'\x02op' + b'hi'
+    print(f"   Chat decode: {decode_chat(chat)} (expected: ('op', 'hi'))")
+    
+    param = encode_param(9, PARAM_SET, 'max_speed', 1.5)
+    print(f"   Param size: {len(param)} bytes (expected: 29), "
+          f"decode: {decode_param(param)} (expected: (9, 2, 'max_speed', 1.5))")
+    
+    call = encode_service_call(4, 'dock', b'{}', 3000)
+    print(f"   Service call size: {len(call)} bytes (expected: 20), "
+          f"decode: {decode_service_call(call)} (expected: (4, 3000, 'dock', b'{{}}'))")
+    diag = encode_diagnostics([DiagnosticStatus('motor', DIAG_ERROR, 'overcurrent', values={'amps': 12.5})], 0)
+    print(f"   Diagnostics size: {len(diag)} bytes (expected: 41)")
+    resp = encode_service_response(4, SERVICE_FAILED, 'dock', b'blocked')
+    print(f"   Service response decode: {decode_service_response(resp)} (expected: (4, 2, 'dock', b'blocked'))")
+    
     # Performance test
     print("\n5. Performance Test (100,000 iterations)")
     print("-" * 50)
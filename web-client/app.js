@@ -5,10 +5,113 @@ const MSG_TWIST = 0x01;
 const MSG_ACK = 0x02;
 const MSG_SYNC_REQ = 0x03;
 const MSG_SYNC_RESP = 0x04;
+const MSG_ESTOP = 0x05;
+const MSG_TELEMETRY = 0x06;
+const MSG_ODOMETRY = 0x07;
+const MSG_MEDIA = 0x08;
+const MSG_JOY = 0x09;
+const MSG_CONTROL = 0x10;
+const MSG_CONTROL_STATE = 0x11;
+const MSG_SYNC_BEACON = 0x12;
+const MSG_BEACON_REPLY = 0x13;
+const MSG_HELLO = 0x14;
+const MSG_WELCOME = 0x15;
+const MSG_LOSS_REPORT = 0x16;
+const MSG_STALE_COMMAND = 0x17;
+const MSG_NACK = 0x18;
+const MSG_FAILOVER = 0x19;
+const MSG_PRESENCE = 0x1A;
+const MSG_SESSION = 0x1B;
+const MSG_SESSION_ACK = 0x1C;
+const MSG_PROTOCOL_ERROR = 0x1D;
+const MSG_BATCH = 0x1E;
+const MSG_ACK_TIMEOUT = 0x1F;
+const MSG_COMMAND = 0x20;
+const MSG_COMMAND_ACK = 0x21;
+const MSG_RAW = 0x22;
+const MSG_CHAT = 0x23;
+const MSG_FILE_CHUNK = 0x24;
+const MSG_FILE_ACK = 0x25;
+const MSG_PARAM_REQUEST = 0x26;
+const MSG_PARAM_RESPONSE = 0x27;
+const MSG_SERVICE_CALL = 0x28;
+const MSG_SERVICE_RESPONSE = 0x29;
+const MSG_DIAG_ALERT = 0x2B;
+const MSG_LATENCY_WARNING = 0x2C;
+
+const NACK_REASONS = { 1: 'no robot', 2: 'robot e-stopped', 3: 'not driver', 4: 'superseded', 5: 'robot did not reconnect', 6: 'hold buffer full', 7: 'supervisor override', 8: 'robot never acked', 9: 'higher-priority mux input' };
+const PROTOCOL_ERRORS = { 1: 'unknown type', 2: 'too short', 3: 'too long', 4: 'bad CRC', 5: 'no trace block', 6: 'bad CBOR', 7: 'bad protobuf' };
+
+const PROTOCOL_VERSION = 2;
+const SUBPROTOCOL = 'teleop.binary.v1';
+const FEATURE_ROBOT_TRAILER = 1 << 0;
+const FEATURE_RELAY_TIMESTAMPS = 1 << 1;
+const FEATURE_CRC32 = 1 << 2;
+const FEATURE_SESSION = 1 << 5;
+const FEATURE_BATCH = 1 << 8;
+
+const CONTROL_TAKE = 0x01;
+const CONTROL_RELEASE = 0x02;
+const CONTROL_STEAL = 0x03;
+
+const ESTOP_ENGAGE = 0x01;
+const ESTOP_RELEASE = 0x02;
+
+const MEDIA_HEADER_SIZE = 12;
+const MEDIA_CODEC_JPEG = 1;
+
+const RAW_HEADER_SIZE = 27;
+
+const FILE_CHUNK_HEADER_SIZE = 23;
+const FILE_CHUNK = 16 * 1024;      // bytes per chunk we send
+const FILE_WINDOW = 256 * 1024;    // bytes we let the robot send ahead of our ack
+const FILE_FLAG_REQUEST = 0x01;
+const FILE_FLAG_LAST = 0x02;
+const FILE_STATUS_OK = 0;
+const FILE_STATUS_COMPLETE = 1;
+const FILE_STATUSES = { 2: 'rejected by robot', 3: 'aborted' };
+
+const PARAM_HEADER_SIZE = 12;
+const PARAM_GET = 1;
+const PARAM_SET = 2;
+const PARAM_STATUSES = { 1: 'unknown parameter', 2: 'invalid value', 3: 'read-only', 4: 'not driver', 5: 'timeout', 6: 'no robot', 7: 'bad request', 8: 'busy' };
+
+const SERVICE_CALL_HEADER_SIZE = 14;
+const SERVICE_RESPONSE_HEADER_SIZE = 11;
+const SERVICE_STATUSES = { 1: 'unknown service', 2: 'failed', 3: 'timeout', 4: 'no robot', 5: 'busy', 6: 'forbidden' };
+
+const DIAG_ALERT_HEADER_SIZE = 11;
+const DIAG_ERROR = 2;
+
+const DRIVE_MODES = ['unknown', 'idle', 'teleop', 'autonomous', 'charging'];
+const TELEMETRY_ERRORS = ['e-stop', 'motor', 'low battery', 'sensor'];  // by bit
 
 // ============ CONFIG ============
+const PAGE_PARAMS = new URLSearchParams(location.search);
+const ROBOT_ID = PAGE_PARAMS.get('robot') || 'default';
+const CAMERA_CHANNEL = parseInt(PAGE_PARAMS.get('camera') || '0', 10);  // media channel shown
+const AUTH_TOKEN = PAGE_PARAMS.get('token');
+const USE_WEBTRANSPORT = PAGE_PARAMS.get('transport') === 'webtransport';
+const CLIENT_VERSION = 'web-client/1.0';
+// ?joy sends raw Joy frames (gamepad, or the on-screen controls) instead of twists
+const JOY_MODE = PAGE_PARAMS.has('joy');
+// ?observer watches the session read-only; the relay rejects its commands
+const OBSERVER = PAGE_PARAMS.has('observer');
+const PEER_QUERY = `?type=${OBSERVER ? 'observer' : 'web'}&robot=${encodeURIComponent(ROBOT_ID)}` +
+    `&version=${encodeURIComponent(CLIENT_VERSION)}&welcome=binary` +
+    (PAGE_PARAMS.get('name') ? `&name=${encodeURIComponent(PAGE_PARAMS.get('name'))}` : '') +
+    (PAGE_PARAMS.get('client_id') ? `&client_id=${encodeURIComponent(PAGE_PARAMS.get('client_id'))}` : '') +
+    (PAGE_PARAMS.get('room') ? `&room=${encodeURIComponent(PAGE_PARAMS.get('room'))}` : '') +
+    (PAGE_PARAMS.has('supervisor') ? '&supervisor' : '') +
+    (PAGE_PARAMS.get('mux_input') ? `&mux_input=${encodeURIComponent(PAGE_PARAMS.get('mux_input'))}` : '') +
+    (AUTH_TOKEN ? `&token=${encodeURIComponent(AUTH_TOKEN)}` : '');
+
 const CONFIG = {
-    wsUrl: `ws://${location.hostname || 'localhost'}:8080/ws/data?type=web`,
+    // Over HTTPS the relay serves the page itself, so reuse its host and port
+    wsUrl: (location.protocol === 'https:' ? `wss://${location.host}` : `ws://${location.hostname || 'localhost'}:8080`) +
+        '/ws/data' + PEER_QUERY,
+    // ?transport=webtransport, on the relay's -webtransport-addr port
+    wtUrl: `https://${location.hostname || 'localhost'}:${PAGE_PARAMS.get('wtPort') || 4433}/wt/data` + PEER_QUERY,
     sendHz: 20,
     chartWindowSec: 20,
     syncIntervalMs: 10000,
@@ -20,6 +123,7 @@ const CONFIG = {
 let ws = null;
 let connected = false;
 let msgId = 0;
+let commandId = 0;  // separate, so commands leave no gaps in twist IDs
 let history = [];
 let linY = 0, angZ = 0;
 let sendTimer = null;
@@ -32,6 +136,23 @@ let keyTimer = null;
 let clockOffset = 0, clockRtt = 0, clockSynced = false;
 let offsets = [];
 
+// Negotiated with the relay: frames after the Welcome end in a CRC32
+let useCrc = false;
+
+// From the Session: presented on reconnect to keep our peer ID and driver status
+let sessionPeerId = null, resumeToken = null;
+const resumeQuery = () => resumeToken ? `&resume=${encodeURIComponent(resumeToken)}` : '';
+
+// Control ownership
+let isDriver = false;
+let driverId = '';
+
+// Latched by the relay until released
+let estopped = false;
+
+// Pushed by the relay on robot and peer connect/disconnect
+let robotOnline = true;
+
 // Stats
 let ackCount = 0;
 let lastAckTime = 0;
@@ -65,6 +186,30 @@ function encodeTwist(id, t1, lx, ly, lz, ax, ay, az) {
     return buf;
 }
 
+/**
+ * Encode Joy message (22 + 4N bytes)
+ *
+ * Layout:
+ *   [0]      uint8   type (0x09)
+ *   [1-8]    uint64  message_id
+ *   [9-16]   uint64  t1_browser_send
+ *   [17-20]  uint32  button bitmap
+ *   [21]     uint8   axis count N (max 16)
+ *   [22-]    float32 × N axes, -1..1
+ */
+function encodeJoy(id, t1, axes, buttons) {
+    axes = axes.slice(0, 16);
+    const buf = new ArrayBuffer(22 + 4 * axes.length);
+    const v = new DataView(buf);
+    v.setUint8(0, MSG_JOY);
+    v.setBigUint64(1, BigInt(id), true);
+    v.setBigUint64(9, BigInt(t1), true);
+    v.setUint32(17, buttons >>> 0, true);
+    v.setUint8(21, axes.length);
+    axes.forEach((a, i) => v.setFloat32(22 + 4 * i, Math.max(-1, Math.min(1, a)), true));
+    return buf;
+}
+
 /**
  * Decode Twist Ack (77 bytes)
  * 
@@ -122,6 +267,283 @@ function decodeSyncResp(buf) {
     };
 }
 
+/**
+ * Encode Hello (6 bytes): type + protocol version + feature bits
+ */
+function encodeHello() {
+    const buf = new ArrayBuffer(6);
+    const v = new DataView(buf);
+    v.setUint8(0, MSG_HELLO);
+    v.setUint8(1, PROTOCOL_VERSION);
+    v.setUint32(2, FEATURE_ROBOT_TRAILER | FEATURE_RELAY_TIMESTAMPS | FEATURE_CRC32 | FEATURE_SESSION | FEATURE_BATCH, true);
+    return buf;
+}
+
+// ============ CRC32 (IEEE) ============
+
+const CRC_TABLE = (() => {
+    const t = new Uint32Array(256);
+    for (let n = 0; n < 256; n++) {
+        let c = n;
+        for (let k = 0; k < 8; k++) c = c & 1 ? 0xEDB88320 ^ (c >>> 1) : c >>> 1;
+        t[n] = c >>> 0;
+    }
+    return t;
+})();
+
+function crc32(bytes) {
+    let c = 0xFFFFFFFF;
+    for (let i = 0; i < bytes.length; i++) c = CRC_TABLE[(c ^ bytes[i]) & 0xFF] ^ (c >>> 8);
+    return (c ^ 0xFFFFFFFF) >>> 0;
+}
+
+/**
+ * Append a little-endian CRC32 of buf
+ */
+function appendCrc(buf) {
+    const out = new Uint8Array(buf.byteLength + 4);
+    out.set(new Uint8Array(buf));
+    new DataView(out.buffer).setUint32(buf.byteLength, crc32(new Uint8Array(buf)), true);
+    return out.buffer;
+}
+
+/**
+ * Verify and strip the CRC32 trailer; null if it doesn't match
+ */
+function stripCrc(buf) {
+    const n = buf.byteLength - 4;
+    if (n < 1) return null;
+    const crc = new DataView(buf).getUint32(n, true);
+    return crc32(new Uint8Array(buf, 0, n)) === crc ? buf.slice(0, n) : null;
+}
+
+/**
+ * Split a Batch: uint8 count, then each frame behind a uint16 length,
+ * CRC trailer included
+ */
+function splitBatch(buf) {
+    const v = new DataView(buf);
+    const frames = [];
+    let off = 2;
+    for (let i = 0; i < v.getUint8(1) && off + 2 <= buf.byteLength; i++) {
+        const n = v.getUint16(off, true);
+        frames.push(buf.slice(off + 2, off + 2 + n));
+        off += 2 + n;
+    }
+    return frames;
+}
+
+/**
+ * Encode Beacon Reply (25 bytes): echo relay's t1 + our rx/tx times
+ */
+function encodeBeaconReply(beacon, t2) {
+    const t1 = new DataView(beacon).getBigUint64(1, true);
+    const buf = new ArrayBuffer(25);
+    const v = new DataView(buf);
+    v.setUint8(0, MSG_BEACON_REPLY);
+    v.setBigUint64(1, t1, true);
+    v.setBigUint64(9, BigInt(t2), true);
+    v.setBigUint64(17, BigInt(Date.now()), true);
+    return buf;
+}
+
+/**
+ * Encode Command (10+N bytes): type, uint64 msg ID, uint8 kind, payload
+ */
+function encodeCommand(id, kind, payload) {
+    const buf = new ArrayBuffer(10 + payload.byteLength);
+    const v = new DataView(buf);
+    v.setUint8(0, MSG_COMMAND);
+    v.setBigUint64(1, BigInt(id), true);
+    v.setUint8(9, kind);
+    new Uint8Array(buf, 10).set(payload);
+    return buf;
+}
+
+/**
+ * Encode Raw (27+N bytes): type, uint16 channel, uint64 t_send, relay
+ * rx/tx times (left 0, the relay fills them in), payload
+ */
+function encodeRaw(channel, payload) {
+    const buf = new ArrayBuffer(RAW_HEADER_SIZE + payload.byteLength);
+    const v = new DataView(buf);
+    v.setUint8(0, MSG_RAW);
+    v.setUint16(1, channel, true);
+    v.setBigUint64(3, BigInt(Date.now()), true);
+    new Uint8Array(buf, RAW_HEADER_SIZE).set(payload);
+    return buf;
+}
+
+/**
+ * Encode Chat (10+N bytes): type, uint64 t_send, sender length 0 (the
+ * relay fills in the sender), UTF-8 text
+ */
+function encodeChat(text) {
+    const bytes = new TextEncoder().encode(text);
+    const buf = new ArrayBuffer(10 + bytes.byteLength);
+    const v = new DataView(buf);
+    v.setUint8(0, MSG_CHAT);
+    v.setBigUint64(1, BigInt(Date.now()), true);
+    new Uint8Array(buf, 10).set(bytes);
+    return buf;
+}
+
+/**
+ * Encode File Chunk (23+N bytes): type, uint32 transfer ID, flags, uint64
+ * offset, uint64 total, name length, name, data
+ */
+function encodeFileChunk(id, flags, offset, total, name, data) {
+    const nameBytes = new TextEncoder().encode(name);
+    const buf = new ArrayBuffer(FILE_CHUNK_HEADER_SIZE + nameBytes.byteLength + data.byteLength);
+    const v = new DataView(buf);
+    v.setUint8(0, MSG_FILE_CHUNK);
+    v.setUint32(1, id, true);
+    v.setUint8(5, flags);
+    v.setBigUint64(6, BigInt(offset), true);
+    v.setBigUint64(14, BigInt(total), true);
+    v.setUint8(22, nameBytes.byteLength);
+    new Uint8Array(buf, FILE_CHUNK_HEADER_SIZE).set(nameBytes);
+    new Uint8Array(buf, FILE_CHUNK_HEADER_SIZE + nameBytes.byteLength).set(data);
+    return buf;
+}
+
+/**
+ * Encode File Ack (18 bytes): type, uint32 transfer ID, status, uint64
+ * offset received, uint32 window
+ */
+function encodeFileAck(id, status, offset, window) {
+    const buf = new ArrayBuffer(18);
+    const v = new DataView(buf);
+    v.setUint8(0, MSG_FILE_ACK);
+    v.setUint32(1, id, true);
+    v.setUint8(5, status);
+    v.setBigUint64(6, BigInt(offset), true);
+    v.setUint32(14, window, true);
+    return buf;
+}
+
+/**
+ * Encode Param Request (12+N bytes): type, uint64 request ID, op, value
+ * type, name length, name, value. Integers go as int64, other numbers as
+ * float64; undefined sends no value.
+ */
+function encodeParam(id, op, name, value) {
+    const nameBytes = new TextEncoder().encode(name);
+    let vtype = 0, vbytes = new Uint8Array(0);
+    if (typeof value === 'boolean') {
+        vtype = 1;
+        vbytes = new Uint8Array([value ? 1 : 0]);
+    } else if (typeof value === 'bigint' || (typeof value === 'number' && Number.isInteger(value))) {
+        vtype = 2;
+        vbytes = new Uint8Array(8);
+        new DataView(vbytes.buffer).setBigInt64(0, BigInt(value), true);
+    } else if (typeof value === 'number') {
+        vtype = 3;
+        vbytes = new Uint8Array(8);
+        new DataView(vbytes.buffer).setFloat64(0, value, true);
+    } else if (typeof value === 'string') {
+        vtype = 4;
+        vbytes = new TextEncoder().encode(value);
+    }
+    const buf = new ArrayBuffer(PARAM_HEADER_SIZE + nameBytes.byteLength + vbytes.byteLength);
+    const v = new DataView(buf);
+    v.setUint8(0, MSG_PARAM_REQUEST);
+    v.setBigUint64(1, BigInt(id), true);
+    v.setUint8(9, op);
+    v.setUint8(10, vtype);
+    v.setUint8(11, nameBytes.byteLength);
+    new Uint8Array(buf, PARAM_HEADER_SIZE).set(nameBytes);
+    new Uint8Array(buf, PARAM_HEADER_SIZE + nameBytes.byteLength).set(vbytes);
+    return buf;
+}
+
+/**
+ * Encode Service Call (14+N bytes): type, uint64 call ID, uint32 timeout
+ * ms (0 = the relay's default), service length, service, payload
+ */
+function encodeServiceCall(id, service, timeoutMs, payload) {
+    const nameBytes = new TextEncoder().encode(service);
+    const buf = new ArrayBuffer(SERVICE_CALL_HEADER_SIZE + nameBytes.byteLength + payload.byteLength);
+    const v = new DataView(buf);
+    v.setUint8(0, MSG_SERVICE_CALL);
+    v.setBigUint64(1, BigInt(id), true);
+    v.setUint32(9, timeoutMs, true);
+    v.setUint8(13, nameBytes.byteLength);
+    new Uint8Array(buf, SERVICE_CALL_HEADER_SIZE).set(nameBytes);
+    new Uint8Array(buf, SERVICE_CALL_HEADER_SIZE + nameBytes.byteLength).set(payload);
+    return buf;
+}
+
+/**
+ * Encode Control Request (2 bytes): type + action
+ */
+function encodeControl(action) {
+    return new Uint8Array([MSG_CONTROL, action]).buffer;
+}
+
+/**
+ * Decode Control State (3+N bytes): type, role, driver ID length, driver ID
+ */
+function decodeControlState(buf) {
+    const b = new Uint8Array(buf);
+    const n = b[2];
+    return {
+        isDriver: b[1] === 1,
+        driverId: new TextDecoder().decode(b.subarray(3, 3 + n)),
+    };
+}
+
+/**
+ * Decode Telemetry (18 bytes): type, robot time, battery %, drive mode, error flags
+ */
+function decodeTelemetry(buf) {
+    const v = new DataView(buf);
+    return {
+        robotTime:  Number(v.getBigUint64(1, true)),
+        batteryPct: v.getFloat32(9, true),
+        driveMode:  v.getUint8(13),
+        errorFlags: v.getUint32(14, true),
+    };
+}
+
+/**
+ * Decode Odometry (113 bytes, 129 with relay timestamps): type, robot time,
+ * position xyz, orientation quaternion xyzw, linear xyz, angular xyz
+ */
+function decodeOdometry(buf) {
+    const v = new DataView(buf);
+    const f = i => v.getFloat64(9 + 8 * i, true);
+    const odom = {
+        robotTime:   Number(v.getBigUint64(1, true)),
+        position:    [f(0), f(1), f(2)],
+        orientation: [f(3), f(4), f(5), f(6)],
+        linear:      [f(7), f(8), f(9)],
+        angular:     [f(10), f(11), f(12)],
+    };
+    if (buf.byteLength >= 129) {
+        odom.relayRx = Number(v.getBigUint64(113, true));
+        odom.relayTx = Number(v.getBigUint64(121, true));
+    }
+    return odom;
+}
+
+/**
+ * Decode a Media Chunk header (12 bytes): type, channel, codec, flags,
+ * frame ID, fragment index, fragment count; the payload follows
+ */
+function decodeMediaChunk(buf) {
+    const v = new DataView(buf);
+    return {
+        channel:   v.getUint8(1),
+        codec:     v.getUint8(2),
+        flags:     v.getUint8(3),
+        frameId:   v.getUint32(4, true),
+        fragment:  v.getUint16(8, true),
+        fragments: v.getUint16(10, true),
+        payload:   new Uint8Array(buf, MEDIA_HEADER_SIZE),
+    };
+}
+
 // ============ CHART ============
 
 let chart = null;
@@ -158,22 +580,33 @@ function initChart() {
 function connect() {
     if (ws) ws.close();
     
-    console.log('Connecting to', CONFIG.wsUrl);
-    ws = new WebSocket(CONFIG.wsUrl);
-    ws.binaryType = 'arraybuffer';
+    if (USE_WEBTRANSPORT) {
+        console.log('Connecting to', CONFIG.wtUrl);
+        ws = openWebTransport(CONFIG.wtUrl + resumeQuery());
+    } else {
+        console.log('Connecting to', CONFIG.wsUrl);
+        ws = new WebSocket(CONFIG.wsUrl + resumeQuery(), SUBPROTOCOL);
+        ws.binaryType = 'arraybuffer';
+    }
     
     ws.onopen = () => {
         console.log('Connected');
         setConnected(true);
-        sendSyncReq();
-        setInterval(sendSyncReq, CONFIG.syncIntervalMs);
-        startSending();
+        updateDiagErrors();
+        useCrc = false;
+        ws.send(encodeHello()); // the rest starts once the relay answers
     };
     
-    ws.onclose = () => {
+    ws.onclose = (e) => {
+        if (e.code === 4401 || e.code === 4403 || e.code === 4426) console.error('Rejected by relay:', e.code, e.reason);
+        if (e.code === 4408) console.warn('Closed by relay as too slow to keep up:', e.reason);
         console.log('Disconnected');
         setConnected(false);
         stopSending();
+        failParams('disconnected');
+        failServiceCalls('disconnected');
+        diagErrors.clear();  // the relay repeats standing errors when we rejoin
+        latencyWarning = null;  // and a standing latency warning
     };
     
     ws.onerror = (e) => console.error('WebSocket error:', e);
@@ -181,17 +614,175 @@ function connect() {
     ws.onmessage = (e) => {
         if (e.data instanceof ArrayBuffer) {
             const type = new Uint8Array(e.data)[0];
-            if (type === MSG_ACK) handleAck(e.data);
-            else if (type === MSG_SYNC_RESP) handleSyncResp(e.data);
+            if (type === MSG_WELCOME) handleWelcome(e.data);
+            else if (type === MSG_BATCH) splitBatch(e.data).forEach(handleFrame);
+            else handleFrame(e.data);
+        } else if (typeof e.data === 'string') {
+            const msg = JSON.parse(e.data);
+            if (msg.type && msg.type.startsWith('webrtc_')) handleSignal(msg).catch(err => console.error('WebRTC:', err));
+        }
+    };
+}
+
+/**
+ * Dispatch one binary frame from the relay by type
+ */
+function handleFrame(data) {
+    if (useCrc && (data = stripCrc(data)) === null) {
+        console.warn('Dropped frame with bad CRC');
+        return;
+    }
+    const type = new Uint8Array(data)[0];
+    if (type === MSG_ACK) handleAck(data);
+    else if (type === MSG_SYNC_RESP) handleSyncResp(data);
+    else if (type === MSG_CONTROL_STATE) handleControlState(data);
+    else if (type === MSG_ESTOP) handleEStop(data);
+    else if (type === MSG_TELEMETRY) handleTelemetry(data);
+    else if (type === MSG_ODOMETRY) handleOdometry(data);
+    else if (type === MSG_MEDIA) handleMedia(data);
+    else if (type === MSG_SYNC_BEACON) sendFrame(encodeBeaconReply(data, Date.now()));
+    else if (type === MSG_LOSS_REPORT) handleLossReport(data);
+    else if (type === MSG_STALE_COMMAND) handleStaleCommand(data);
+    else if (type === MSG_ACK_TIMEOUT) handleAckTimeout(data);
+    else if (type === MSG_COMMAND_ACK) handleCommandAck(data);
+    else if (type === MSG_RAW) handleRaw(data);
+    else if (type === MSG_CHAT) handleChat(data);
+    else if (type === MSG_FILE_CHUNK) handleFileChunk(data);
+    else if (type === MSG_FILE_ACK) handleFileAck(data);
+    else if (type === MSG_PARAM_RESPONSE) handleParamResponse(data);
+    else if (type === MSG_SERVICE_RESPONSE) handleServiceResponse(data);
+    else if (type === MSG_DIAG_ALERT) handleDiagAlert(data);
+    else if (type === MSG_LATENCY_WARNING) handleLatencyWarning(data);
+    else if (type === MSG_NACK) handleNack(data);
+    else if (type === MSG_PROTOCOL_ERROR) handleProtocolError(data);
+    else if (type === MSG_FAILOVER) handleFailover(data);
+    else if (type === MSG_PRESENCE) handlePresence(data);
+    else if (type === MSG_SESSION) handleSession(data);
+}
+
+/**
+ * Open a WebTransport session behind the subset of the WebSocket API
+ * used above. Twists go as datagrams; every other frame goes on one
+ * bidirectional stream with a uint16 little-endian length prefix.
+ */
+function openWebTransport(url) {
+    const sock = { readyState: WebSocket.CONNECTING, onopen: null, onclose: null, onerror: null, onmessage: null };
+    const wt = new WebTransport(url);
+    let streamWriter = null, datagramWriter = null;
+
+    const deliver = (bytes) => {
+        if (sock.onmessage) sock.onmessage({ data: bytes.slice().buffer });
+    };
+
+    sock.send = (buf) => {
+        const bytes = new Uint8Array(buf);
+        if (bytes[0] === MSG_TWIST) {
+            datagramWriter.write(bytes);
+            return;
         }
+        const framed = new Uint8Array(2 + bytes.length);
+        new DataView(framed.buffer).setUint16(0, bytes.length, true);
+        framed.set(bytes, 2);
+        streamWriter.write(framed);
     };
+    sock.close = () => wt.close();
+
+    async function readStream(readable) {
+        const reader = readable.getReader();
+        let pending = new Uint8Array(0);
+        for (;;) {
+            const { value, done } = await reader.read();
+            if (done) return;
+            const joined = new Uint8Array(pending.length + value.length);
+            joined.set(pending);
+            joined.set(value, pending.length);
+            let o = 0;
+            while (joined.length - o >= 2) {
+                const n = joined[o] | (joined[o + 1] << 8);
+                if (joined.length - o - 2 < n) break;
+                deliver(joined.subarray(o + 2, o + 2 + n));
+                o += 2 + n;
+            }
+            pending = joined.slice(o);
+        }
+    }
+
+    async function readDatagrams(readable) {
+        const reader = readable.getReader();
+        for (;;) {
+            const { value, done } = await reader.read();
+            if (done) return;
+            deliver(value);
+        }
+    }
+
+    wt.ready.then(async () => {
+        const stream = await wt.createBidirectionalStream();
+        streamWriter = stream.writable.getWriter();
+        datagramWriter = wt.datagrams.writable.getWriter();
+        sock.readyState = WebSocket.OPEN;
+        if (sock.onopen) sock.onopen();
+        readStream(stream.readable).catch(() => {});
+        readDatagrams(wt.datagrams.readable).catch(() => {});
+    }).catch((e) => { if (sock.onerror) sock.onerror(e); });
+
+    wt.closed.then(
+        (info) => ({ code: info.closeCode, reason: info.reason }),
+        (e) => ({ code: 1006, reason: String(e) }),
+    ).then((e) => {
+        sock.readyState = WebSocket.CLOSED;
+        if (sock.onclose) sock.onclose(e);
+    });
+
+    return sock;
 }
 
 function disconnect() {
+    // Leaving on purpose: hand control back rather than hold it for a resume
+    if (ws && connected) sendControl(CONTROL_RELEASE);
+    resumeToken = null;
     if (ws) { ws.close(); ws = null; }
     stopSending();
 }
 
+function handleWelcome(buf) {
+    const v = new DataView(buf);
+    const features = v.getUint32(2, true);
+    useCrc = (features & FEATURE_CRC32) !== 0;
+    console.log(`Relay protocol v${v.getUint8(1)}, features=0x${features.toString(16)}`);
+
+    sendControl(CONTROL_TAKE);
+    sendSyncReq();
+    setInterval(sendSyncReq, CONFIG.syncIntervalMs);
+    startSending();
+    transfers.forEach(openTransfer);
+}
+
+// The relay's binary welcome; echo its clock so it can gauge ours
+function handleSession(buf) {
+    const b = new Uint8Array(buf);
+    const v = new DataView(buf);
+    const relayTime = v.getBigUint64(2, true);
+    const peerLen = b[10];
+    const dec = new TextDecoder();
+    const peerId = dec.decode(b.subarray(11, 11 + peerLen));
+    const robotLen = b[11 + peerLen];
+    const robotId = dec.decode(b.subarray(12 + peerLen, 12 + peerLen + robotLen));
+    // Relays with -resume-grace add a resumption token
+    const tokenAt = 12 + peerLen + robotLen;
+    const token = tokenAt < b.length ? dec.decode(b.subarray(tokenAt + 1, tokenAt + 1 + b[tokenAt])) : '';
+    console.log(peerId === sessionPeerId ? `Session ${peerId} resumed on robot ${robotId}` : `Session ${peerId} on robot ${robotId}`);
+    sessionPeerId = peerId;
+    resumeToken = token || null;
+
+    const ack = new ArrayBuffer(17);
+    const av = new DataView(ack);
+    av.setUint8(0, MSG_SESSION_ACK);
+    av.setBigUint64(1, relayTime, true);
+    av.setBigUint64(9, BigInt(Date.now()), true);
+    sendFrame(ack);
+}
+
 function handleAck(buf) {
     const now = Date.now();
     const ack = decodeAck(buf);
@@ -249,6 +840,485 @@ function handleSyncResp(buf) {
     document.getElementById('syncStatus').textContent = clockSynced ? 'Synced ✓' : 'Syncing...';
 }
 
+function handleLossReport(buf) {
+    const v = new DataView(buf);
+    const from = Number(v.getBigUint64(1, true));
+    const to = Number(v.getBigUint64(9, true));
+    console.warn(`Relay missed twists #${from}-#${to}`);
+}
+
+function handleStaleCommand(buf) {
+    const v = new DataView(buf);
+    const id = Number(v.getBigUint64(1, true));
+    console.warn(`Relay dropped stale command #${id} (${v.getUint32(9, true)} ms old)`);
+}
+
+function handleAckTimeout(buf) {
+    const v = new DataView(buf);
+    const id = Number(v.getBigUint64(1, true));
+    console.warn(`Robot did not ack command #${id} within ${v.getUint32(9, true)} ms`);
+}
+
+function handleCommandAck(buf) {
+    const v = new DataView(buf);
+    const id = Number(v.getBigUint64(1, true));
+    const status = v.getUint8(9);
+    if (status === 0) console.info(`Robot applied command #${id}`);
+    else console.warn(`Robot rejected command #${id} with status ${status}`);
+}
+
+// Raw frames from the robot, by channel: onRaw(channel, (payload, tSend) => ...)
+const rawHandlers = new Map();
+
+function onRaw(channel, handler) {
+    rawHandlers.set(channel, handler);
+}
+
+function handleRaw(buf) {
+    const v = new DataView(buf);
+    const channel = v.getUint16(1, true);
+    const tSend = Number(v.getBigUint64(3, true));
+    const payload = new Uint8Array(buf, RAW_HEADER_SIZE);
+    const handler = rawHandlers.get(channel);
+    if (handler) handler(payload, tSend);
+    else console.debug(`Raw frame on channel ${channel}: ${payload.byteLength} bytes`);
+}
+
+function handleChat(buf) {
+    const bytes = new Uint8Array(buf);
+    const n = bytes[9];
+    const decoder = new TextDecoder();
+    const from = decoder.decode(bytes.subarray(10, 10 + n));
+    const text = decoder.decode(bytes.subarray(10 + n));
+    const log = document.getElementById('chatLog');
+    const line = document.createElement('div');
+    const who = document.createElement('span');
+    who.className = 'chat-from';
+    who.textContent = from + ': ';
+    line.append(who, text);
+    log.append(line);
+    while (log.childElementCount > 200) log.firstElementChild.remove();
+    log.scrollTop = log.scrollHeight;
+}
+
+// ============ FILE TRANSFER ============
+// Uploads open with an empty chunk, downloads with a request; the robot
+// answers with the offset it (or we) already hold, so both resume after a
+// reconnect, when every open transfer is opened again.
+
+const transfers = new Map();  // our transfer ID -> state
+let transferId = 0;
+
+function uploadFile(file) {
+    const t = { id: ++transferId, name: file.name, upload: true, file, total: file.size, acked: 0, sent: 0, window: 0 };
+    transfers.set(t.id, t);
+    openTransfer(t);
+    return t.id;
+}
+
+function downloadFile(name) {
+    const t = { id: ++transferId, name, upload: false, parts: [], received: 0, total: 0 };
+    transfers.set(t.id, t);
+    openTransfer(t);
+    return t.id;
+}
+
+function openTransfer(t) {
+    if (!ws || ws.readyState !== WebSocket.OPEN || OBSERVER) return;
+    t.opening = true;
+    if (t.upload) sendFrame(encodeFileChunk(t.id, 0, 0, t.total, t.name, new Uint8Array(0)));
+    else sendFrame(encodeFileChunk(t.id, FILE_FLAG_REQUEST, t.received, 0, t.name, new Uint8Array(0)));
+    updateFileStatus(t);
+}
+
+function endTransfer(t, status) {
+    transfers.delete(t.id);
+    if (status === FILE_STATUS_COMPLETE) console.info(`${t.upload ? 'Upload' : 'Download'} of ${t.name} complete`);
+    else console.warn(`${t.upload ? 'Upload' : 'Download'} of ${t.name}: ${FILE_STATUSES[status] || `status ${status}`}`);
+    updateFileStatus(t, status);
+}
+
+// Acks pace our uploads; the robot's first ack after an open says where
+// to resume, and a repeated one that a chunk went missing
+function handleFileAck(buf) {
+    const v = new DataView(buf);
+    const t = transfers.get(v.getUint32(1, true));
+    if (!t) return;
+    const status = v.getUint8(5);
+    if (status !== FILE_STATUS_OK) {
+        endTransfer(t, status);
+        return;
+    }
+    if (!t.upload) return;
+    const offset = Number(v.getBigUint64(6, true));
+    if (t.opening || (offset === t.acked && t.sent > offset)) t.sent = offset;
+    t.opening = false;
+    t.acked = offset;
+    t.window = v.getUint32(14, true);
+    pumpUpload(t);
+}
+
+async function pumpUpload(t) {
+    if (t.pumping) return;
+    t.pumping = true;
+    while (transfers.has(t.id) && ws && ws.readyState === WebSocket.OPEN && t.sent < Math.min(t.acked + t.window, t.total)) {
+        const end = Math.min(t.sent + FILE_CHUNK, t.acked + t.window, t.total);
+        const data = new Uint8Array(await t.file.slice(t.sent, end).arrayBuffer());
+        sendFrame(encodeFileChunk(t.id, end >= t.total ? FILE_FLAG_LAST : 0, t.sent, t.total, t.name, data));
+        t.sent = end;
+    }
+    t.pumping = false;
+    updateFileStatus(t);
+}
+
+function handleFileChunk(buf) {
+    const b = new Uint8Array(buf);
+    const v = new DataView(buf);
+    const t = transfers.get(v.getUint32(1, true));
+    if (!t || t.upload) return;
+    const offset = Number(v.getBigUint64(6, true));
+    t.total = Number(v.getBigUint64(14, true));
+    t.opening = false;
+    const data = b.subarray(FILE_CHUNK_HEADER_SIZE + b[22]);
+    if (offset === t.received && data.byteLength > 0) {
+        t.parts.push(data.slice());
+        t.received += data.byteLength;
+    }
+    if (t.received < t.total) {
+        sendFrame(encodeFileAck(t.id, FILE_STATUS_OK, t.received, FILE_WINDOW));
+        updateFileStatus(t);
+        return;
+    }
+    sendFrame(encodeFileAck(t.id, FILE_STATUS_COMPLETE, t.received, 0));
+    const a = document.createElement('a');
+    a.href = URL.createObjectURL(new Blob(t.parts));
+    a.download = t.name;
+    a.click();
+    setTimeout(() => URL.revokeObjectURL(a.href), 10000);
+    endTransfer(t, FILE_STATUS_COMPLETE);
+}
+
+function updateFileStatus(t, status) {
+    const el = document.getElementById('fileStatus');
+    if (!el) return;
+    const done = t.upload ? t.acked : t.received;
+    const pct = t.total ? Math.floor(100 * done / t.total) : 0;
+    el.textContent = status === undefined ? `${t.upload ? '↑' : '↓'} ${t.name} ${pct} %`
+        : `${t.name}: ${status === FILE_STATUS_COMPLETE ? 'done' : FILE_STATUSES[status] || `status ${status}`}`;
+}
+
+function handleNack(buf) {
+    const v = new DataView(buf);
+    const id = Number(v.getBigUint64(1, true));
+    const reason = v.getUint8(9);
+    console.warn(`Relay dropped command #${id}: ${NACK_REASONS[reason] || `reason ${reason}`}`);
+}
+
+function handleProtocolError(buf) {
+    const v = new DataView(buf);
+    const code = v.getUint8(1);
+    const type = v.getUint8(2);
+    const expected = v.getUint16(3, true);
+    const got = v.getUint16(5, true);
+    console.error(`Relay rejected frame type 0x${type.toString(16)} (${got} bytes, expected ${expected}): ${PROTOCOL_ERRORS[code] || `code ${code}`}`);
+}
+
+function handleFailover(buf) {
+    const b = new Uint8Array(buf);
+    const peerId = new TextDecoder().decode(b.subarray(3, 3 + b[2]));
+    console.warn(`Robot failed over to ${peerId} (${b[1] === 2 ? 'primary unresponsive' : 'primary disconnected'})`);
+    // The video came from the old robot peer; a new session must be started
+    stopWebRTC(false);
+}
+
+function handlePresence(buf) {
+    const v = new DataView(buf);
+    const event = v.getUint8(1);
+    robotOnline = v.getUint8(2) === 1;
+    const web = v.getUint16(3, true), observers = v.getUint16(5, true);
+    document.getElementById('robotLink').textContent = robotOnline ? 'online' : 'offline';
+    document.getElementById('robotPeers').textContent = `${web} web, ${observers} observer${observers === 1 ? '' : 's'}`;
+    if (event === 2) console.warn('Robot disconnected');
+    updateStatusText();
+}
+
+function handleControlState(buf) {
+    const st = decodeControlState(buf);
+    isDriver = st.isDriver;
+    driverId = st.driverId;
+    updateStatusText();
+}
+
+function handleEStop(buf) {
+    estopped = new Uint8Array(buf)[1] === ESTOP_ENGAGE;
+    const btn = document.getElementById('estopBtn');
+    if (btn) btn.textContent = estopped ? 'Release E-STOP' : 'E-STOP (Esc)';
+    updateStatusText();
+}
+
+function handleTelemetry(buf) {
+    const tel = decodeTelemetry(buf);
+    const errors = TELEMETRY_ERRORS.filter((_, bit) => tel.errorFlags & (1 << bit));
+    if (tel.errorFlags >>> TELEMETRY_ERRORS.length) errors.push(`0x${tel.errorFlags.toString(16)}`);
+    document.getElementById('telBattery').textContent = tel.batteryPct.toFixed(0) + ' %';
+    document.getElementById('telMode').textContent = DRIVE_MODES[tel.driveMode] || `mode ${tel.driveMode}`;
+    document.getElementById('telErrors').textContent = errors.length ? errors.join(', ') : 'none';
+}
+
+// Components in ERROR, by name; the relay alerts on entering and leaving
+// it, and repeats standing errors when we join a robot
+const diagErrors = new Map();
+
+function handleDiagAlert(buf) {
+    if (buf.byteLength < DIAG_ALERT_HEADER_SIZE) return;
+    const bytes = new Uint8Array(buf);
+    const end = DIAG_ALERT_HEADER_SIZE + bytes[10];
+    const decoder = new TextDecoder();
+    const name = decoder.decode(bytes.subarray(DIAG_ALERT_HEADER_SIZE, end));
+    const message = decoder.decode(bytes.subarray(end));
+    if (bytes[9] === DIAG_ERROR) {
+        if (!diagErrors.has(name)) console.error(`Robot ${name}: ${message}`);
+        diagErrors.set(name, message);
+    } else {
+        console.log(`Robot ${name} recovered${message ? ': ' + message : ''}`);
+        diagErrors.delete(name);
+    }
+    updateDiagErrors();
+}
+
+function updateDiagErrors() {
+    const el = document.getElementById('diagErrors');
+    el.textContent = diagErrors.size ? [...diagErrors].map(([n, m]) => m ? `${n}: ${m}` : n).join('; ') : 'ok';
+    el.style.color = diagErrors.size ? 'var(--magenta)' : '';
+}
+
+// The relay's latest Latency Warning while the robot's round-trip p95 is
+// over its SLO, null otherwise
+let latencyWarning = null;
+
+function handleLatencyWarning(buf) {
+    if (buf.byteLength < 14) return;
+    const v = new DataView(buf);
+    const w = { p95: v.getUint32(2, true), slo: v.getUint32(6, true), samples: v.getUint32(10, true) };
+    if (v.getUint8(1)) {
+        console.warn(`Latency degraded: p95 ${w.p95} ms over the ${w.slo} ms SLO (${w.samples} round trips); slow down`);
+        latencyWarning = w;
+    } else {
+        console.log(`Latency recovered: p95 ${w.p95} ms`);
+        latencyWarning = null;
+    }
+    updateStatusText();
+}
+
+function handleOdometry(buf) {
+    const odom = decodeOdometry(buf);
+    const [x, y] = odom.position;
+    const [qx, qy, qz, qw] = odom.orientation;
+    const yaw = Math.atan2(2 * (qw * qz + qx * qy), 1 - 2 * (qy * qy + qz * qz));
+    document.getElementById('odomPose').textContent =
+        `${x.toFixed(2)}, ${y.toFixed(2)} m @ ${(yaw * 180 / Math.PI).toFixed(0)}°`;
+    document.getElementById('odomSpeed').textContent =
+        `${odom.linear[0].toFixed(2)} m/s, ${odom.angular[2].toFixed(2)} rad/s`;
+}
+
+// Fragments of the camera frame being reassembled; a chunk of a newer
+// frame abandons it, since the relay drops whole frames under load
+let mediaFrame = null;
+let cameraUrl = null;
+
+function handleMedia(buf) {
+    const chunk = decodeMediaChunk(buf);
+    if (chunk.channel !== CAMERA_CHANNEL || chunk.codec !== MEDIA_CODEC_JPEG) return;
+    if (!mediaFrame || mediaFrame.id !== chunk.frameId) {
+        mediaFrame = { id: chunk.frameId, parts: new Array(chunk.fragments), got: 0 };
+    }
+    if (chunk.fragment >= mediaFrame.parts.length) return;
+    if (mediaFrame.parts[chunk.fragment] === undefined) {
+        mediaFrame.parts[chunk.fragment] = chunk.payload;
+        mediaFrame.got++;
+    }
+    if (mediaFrame.got < mediaFrame.parts.length) return;
+
+    const blob = new Blob(mediaFrame.parts, { type: 'image/jpeg' });
+    mediaFrame = null;
+    if (cameraUrl) URL.revokeObjectURL(cameraUrl);
+    cameraUrl = URL.createObjectURL(blob);
+    const img = document.getElementById('cameraImg');
+    img.src = cameraUrl;
+    img.style.display = '';
+}
+
+// ============ PARAMETERS ============
+// Robot parameters (max speed, gains) for the driver to read and set from
+// the console: await getParam('max_speed'), await setParam('max_speed', 1.5).
+// The relay answers for the robot if it does not within -param-timeout.
+
+const pendingParams = new Map();  // request ID -> { resolve, reject }
+let paramId = 0;
+
+function getParam(name) {
+    return requestParam(PARAM_GET, name);
+}
+
+function setParam(name, value) {
+    return requestParam(PARAM_SET, name, value);
+}
+
+function requestParam(op, name, value) {
+    if (!ws || ws.readyState !== WebSocket.OPEN || OBSERVER) return Promise.reject(new Error('not connected'));
+    const id = ++paramId;
+    return new Promise((resolve, reject) => {
+        pendingParams.set(id, { resolve, reject });
+        sendFrame(encodeParam(id, op, name, value));
+    });
+}
+
+// Resolves with the value in effect, rejects with the status otherwise
+function handleParamResponse(buf) {
+    if (buf.byteLength < PARAM_HEADER_SIZE) return;
+    const v = new DataView(buf);
+    const id = Number(v.getBigUint64(1, true));
+    const status = v.getUint8(9);
+    const vtype = v.getUint8(10);
+    const bytes = new Uint8Array(buf);
+    const end = PARAM_HEADER_SIZE + bytes[11];
+    const name = new TextDecoder().decode(bytes.subarray(PARAM_HEADER_SIZE, end));
+    let value;
+    if (vtype === 1) value = bytes[end] !== 0;
+    else if (vtype === 2 && buf.byteLength >= end + 8) value = Number(v.getBigInt64(end, true));
+    else if (vtype === 3 && buf.byteLength >= end + 8) value = v.getFloat64(end, true);
+    else if (vtype === 4) value = new TextDecoder().decode(bytes.subarray(end));
+    const pending = pendingParams.get(id);
+    pendingParams.delete(id);
+    if (status !== 0) console.warn(`Param ${name}: ${PARAM_STATUSES[status] || `status ${status}`}`);
+    else console.log(`Param ${name} = ${value}`);
+    if (!pending) return;
+    if (status === 0) pending.resolve(value);
+    else pending.reject(new Error(PARAM_STATUSES[status] || `status ${status}`));
+}
+
+function failParams(reason) {
+    for (const p of pendingParams.values()) p.reject(new Error(reason));
+    pendingParams.clear();
+}
+
+// ============ SERVICE CALLS ============
+// Named services on the robot, from the console:
+// await callService('dock') or callService('goto', '{"x": 1}', 10000).
+// Resolves with the result as text; the relay answers for the robot if it
+// does not within the timeout (0 = the relay's default).
+
+const pendingCalls = new Map();  // call ID -> { resolve, reject }
+let callId = 0;
+
+function callService(service, payload = '', timeoutMs = 0) {
+    if (!ws || ws.readyState !== WebSocket.OPEN || OBSERVER) return Promise.reject(new Error('not connected'));
+    const bytes = typeof payload === 'string' ? new TextEncoder().encode(payload) : new Uint8Array(payload);
+    const id = ++callId;
+    return new Promise((resolve, reject) => {
+        pendingCalls.set(id, { resolve, reject });
+        sendFrame(encodeServiceCall(id, service, timeoutMs, bytes));
+    });
+}
+
+function handleServiceResponse(buf) {
+    if (buf.byteLength < SERVICE_RESPONSE_HEADER_SIZE) return;
+    const v = new DataView(buf);
+    const id = Number(v.getBigUint64(1, true));
+    const status = v.getUint8(9);
+    const bytes = new Uint8Array(buf);
+    const end = SERVICE_RESPONSE_HEADER_SIZE + bytes[10];
+    const decoder = new TextDecoder();
+    const service = decoder.decode(bytes.subarray(SERVICE_RESPONSE_HEADER_SIZE, end));
+    const result = decoder.decode(bytes.subarray(end));
+    const pending = pendingCalls.get(id);
+    pendingCalls.delete(id);
+    if (!pending) return;
+    if (status === 0) {
+        pending.resolve(result);
+        return;
+    }
+    const reason = SERVICE_STATUSES[status] || `status ${status}`;
+    console.warn(`Service ${service}: ${reason}${result ? ': ' + result : ''}`);
+    pending.reject(new Error(result ? `${reason}: ${result}` : reason));
+}
+
+function failServiceCalls(reason) {
+    for (const c of pendingCalls.values()) c.reject(new Error(reason));
+    pendingCalls.clear();
+}
+
+// ============ WEBRTC ============
+
+// Video straight from the robot; the relay only carries the signaling
+// (JSON text on the same WebSocket) to and from its Python peer
+let rtc = null;
+
+function sendSignal(msg) {
+    if (ws && ws.readyState === WebSocket.OPEN && !USE_WEBTRANSPORT) ws.send(JSON.stringify(msg));
+}
+
+async function startWebRTC() {
+    stopWebRTC();
+    rtc = new RTCPeerConnection({ iceServers: [{ urls: 'stun:stun.l.google.com:19302' }] });
+    rtc.addTransceiver('video', { direction: 'recvonly' });
+    rtc.onicecandidate = (e) => {
+        if (e.candidate) sendSignal({ type: 'webrtc_ice', candidate: e.candidate.toJSON() });
+    };
+    rtc.ontrack = (e) => {
+        const video = document.getElementById('cameraVideo');
+        video.srcObject = e.streams[0] || new MediaStream([e.track]);
+        video.style.display = '';
+    };
+    await rtc.setLocalDescription(await rtc.createOffer());
+    sendSignal({ type: 'webrtc_offer', sdp: rtc.localDescription.sdp });
+    document.getElementById('webrtcBtn').textContent = 'Stop WebRTC Video';
+}
+
+function stopWebRTC(notify = true) {
+    if (!rtc) return;
+    rtc.close();
+    rtc = null;
+    if (notify) sendSignal({ type: 'webrtc_hangup' });
+    document.getElementById('cameraVideo').style.display = 'none';
+    document.getElementById('webrtcBtn').textContent = 'Start WebRTC Video';
+}
+
+async function handleSignal(msg) {
+    if (msg.type === 'webrtc_error') return console.warn('Signaling:', msg.error);
+    if (!rtc) return;
+    if (msg.type === 'webrtc_answer') await rtc.setRemoteDescription({ type: 'answer', sdp: msg.sdp });
+    else if (msg.type === 'webrtc_ice' && msg.candidate) await rtc.addIceCandidate(msg.candidate);
+    else if (msg.type === 'webrtc_hangup') {
+        console.log('Robot ended WebRTC video', msg.reason || '');
+        stopWebRTC(false);
+    }
+}
+
+function updateStatusText() {
+    const text = document.getElementById('statusText');
+    if (!text || !connected) return;
+    if (estopped) text.textContent = 'Connected (E-STOPPED)';
+    else if (!robotOnline) text.textContent = 'Connected (robot offline)';
+    else if (OBSERVER) text.textContent = 'Connected (read-only)';
+    else text.textContent = isDriver ? 'Connected (driver)' : (driverId ? 'Connected (observer)' : 'Connected');
+    if (latencyWarning && robotOnline && !estopped) {
+        text.textContent += ` · slow down: latency p95 ${latencyWarning.p95} ms over ${latencyWarning.slo} ms`;
+    }
+}
+
+function toggleEStop() {
+    if (!ws || ws.readyState !== WebSocket.OPEN) return;
+    linY = 0; angZ = 0;
+    updateControlDisplay();
+    sendFrame(new Uint8Array([MSG_ESTOP, estopped ? ESTOP_RELEASE : ESTOP_ENGAGE]).buffer);
+}
+
+function sendControl(action) {
+    if (!ws || ws.readyState !== WebSocket.OPEN) return;
+    sendFrame(encodeControl(action));
+}
+
 // ============ SENDING ============
 
 function startSending() {
@@ -261,15 +1331,57 @@ function stopSending() {
 }
 
 function sendTwist() {
-    if (!ws || ws.readyState !== WebSocket.OPEN) return;
+    if (!ws || ws.readyState !== WebSocket.OPEN || OBSERVER) return;
+    if (JOY_MODE) return sendJoy();
     msgId++;
     const buf = encodeTwist(msgId, Date.now(), 0, linY, 0, 0, 0, angZ);
-    ws.send(buf);
+    sendFrame(buf);
+}
+
+// The first connected gamepad as is, or the on-screen controls as a
+// two-axis stick (turn left, forward positive)
+function sendJoy() {
+    const pad = navigator.getGamepads ? [...navigator.getGamepads()].find(p => p && p.connected) : null;
+    const axes = pad ? [...pad.axes] : [angZ / CONFIG.maxSpeed, linY / CONFIG.maxSpeed];
+    const buttons = pad ? pad.buttons.reduce((bits, b, i) => i < 32 && b.pressed ? bits | (1 << i) : bits, 0) : 0;
+    msgId++;
+    sendFrame(encodeJoy(msgId, Date.now(), axes, buttons));
+}
+
+// Reliable command (parameter set, waypoint, ...): the relay retransmits it
+// until the robot acks it. kind is robot-defined; payload is a string
+// (sent as UTF-8) or bytes. Returns the message ID, or 0 if not connected.
+function sendCommand(kind, payload) {
+    if (!ws || ws.readyState !== WebSocket.OPEN || OBSERVER) return 0;
+    const bytes = typeof payload === 'string' ? new TextEncoder().encode(payload) : new Uint8Array(payload);
+    commandId++;
+    sendFrame(encodeCommand(commandId, kind, bytes));
+    return commandId;
+}
+
+// Raw frame to the robot on a prototyping channel; the relay forwards it
+// uninterpreted. payload is a string (sent as UTF-8) or bytes.
+function sendRaw(channel, payload) {
+    if (!ws || ws.readyState !== WebSocket.OPEN || OBSERVER) return false;
+    const bytes = typeof payload === 'string' ? new TextEncoder().encode(payload) : new Uint8Array(payload);
+    sendFrame(encodeRaw(channel, bytes));
+    return true;
+}
+
+// Chat message to everyone watching the robot, observers included
+function sendChat(text) {
+    if (!ws || ws.readyState !== WebSocket.OPEN || !text) return false;
+    sendFrame(encodeChat(text));
+    return true;
 }
 
 function sendSyncReq() {
     if (!ws || ws.readyState !== WebSocket.OPEN) return;
-    ws.send(encodeSyncReq(Date.now()));
+    sendFrame(encodeSyncReq(Date.now()));
+}
+
+function sendFrame(buf) {
+    ws.send(useCrc ? appendCrc(buf) : buf);
 }
 
 function sendStop() {
@@ -285,6 +1397,10 @@ function setupKeyboard() {
         if (e.target.tagName === 'INPUT') return;
         
         const key = e.key.toLowerCase();
+        if (key === 'escape' && !estopped) {
+            toggleEStop();
+            return;
+        }
         if (['w', 's', 'a', 'd', 'arrowup', 'arrowdown', 'arrowleft', 'arrowright', ' '].includes(key)) {
             e.preventDefault();
             keysPressed.add(key);
@@ -513,11 +1629,31 @@ function init() {
     // Button handlers
     const connectBtn = document.getElementById('connectBtn');
     const stopBtn = document.getElementById('stopBtn');
+    const estopBtn = document.getElementById('estopBtn');
     const syncBtn = document.getElementById('syncBtn');
+    const webrtcBtn = document.getElementById('webrtcBtn');
+    const chatInput = document.getElementById('chatInput');
+    const uploadInput = document.getElementById('uploadInput');
+    const downloadName = document.getElementById('downloadName');
     
     if (connectBtn) connectBtn.onclick = () => connected ? disconnect() : connect();
     if (stopBtn) stopBtn.onclick = sendStop;
+    if (estopBtn) estopBtn.onclick = toggleEStop;
     if (syncBtn) syncBtn.onclick = sendSyncReq;
+    if (webrtcBtn) webrtcBtn.onclick = () => rtc ? stopWebRTC() : startWebRTC().catch(err => console.error('WebRTC:', err));
+    if (chatInput) chatInput.onkeydown = (e) => {
+        if (e.key === 'Enter' && sendChat(chatInput.value.trim())) chatInput.value = '';
+    };
+    if (uploadInput) uploadInput.onchange = () => {
+        for (const file of uploadInput.files) uploadFile(file);
+        uploadInput.value = '';
+    };
+    if (downloadName) downloadName.onkeydown = (e) => {
+        if (e.key === 'Enter' && downloadName.value.trim()) {
+            downloadFile(downloadName.value.trim());
+            downloadName.value = '';
+        }
+    };
     
     // Initialize breakdown with empty state
     updateBreakdown({});